@@ -0,0 +1,149 @@
+package guerrilla
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig gets the certificates from an ACME CA, such as Let's Encrypt, see ServerConfig.ACME
+type ACMEConfig struct {
+	// DirectoryURL is the ACME directory of the CA. Defaults to Let's Encrypt
+	DirectoryURL string `json:"directory_url,omitempty"`
+	// Email is given to the CA, for notices about the certificates. Optional
+	Email string `json:"email,omitempty"`
+	// CacheDir is where the certificates & the account key are kept
+	CacheDir string `json:"cache_dir"`
+	// Hosts are the names to get certificates for
+	Hosts []string `json:"hosts"`
+}
+
+// validate returns an error if the config cannot be used
+func (c *ACMEConfig) validate() error {
+	if c.CacheDir == "" {
+		return errors.New("acme cache_dir is empty")
+	}
+	if len(c.Hosts) == 0 {
+		return errors.New("acme hosts is empty")
+	}
+	for _, host := range c.Hosts {
+		if !strings.Contains(strings.Trim(host, "."), ".") {
+			return errors.New("invalid acme host: " + host)
+		}
+	}
+	return nil
+}
+
+// acmeManagers are shared by the servers that use the same cache dir, so that a certificate
+// is not requested twice, and the certificates are renewed once after a config reload
+var acmeManagers = struct {
+	sync.Mutex
+	m map[string]*acmeManager
+}{m: make(map[string]*acmeManager)}
+
+// acmeManager gets & renews the certificates of the hosts of all the servers using it
+type acmeManager struct {
+	*autocert.Manager
+	guard sync.RWMutex
+	hosts map[string]bool
+}
+
+// getACMEManager returns the manager for the cache dir of c, and allows it to get the
+// certificates of c.Hosts. The directory & email of the first config using the cache dir are used
+func getACMEManager(c *ACMEConfig) *acmeManager {
+	acmeManagers.Lock()
+	defer acmeManagers.Unlock()
+	dir := filepath.Clean(c.CacheDir)
+	m, ok := acmeManagers.m[dir]
+	if !ok {
+		m = &acmeManager{hosts: make(map[string]bool)}
+		m.Manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(dir),
+			HostPolicy: m.hostPolicy,
+			Email:      c.Email,
+			Client:     &acme.Client{DirectoryURL: c.DirectoryURL},
+		}
+		acmeManagers.m[dir] = m
+	}
+	m.guard.Lock()
+	for _, host := range c.Hosts {
+		m.hosts[acmeHostName(host)] = true
+	}
+	m.guard.Unlock()
+	return m
+}
+
+// acmeHostName normalizes the name of a host
+func acmeHostName(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// allowed returns true if a certificate for host can be requested
+func (m *acmeManager) allowed(host string) bool {
+	m.guard.RLock()
+	defer m.guard.RUnlock()
+	return m.hosts[acmeHostName(host)]
+}
+
+// hostPolicy is the autocert.HostPolicy, so that certificates are only requested for the hosts in the config
+func (m *acmeManager) hostPolicy(ctx context.Context, host string) error {
+	if m.allowed(host) {
+		return nil
+	}
+	return fmt.Errorf("acme host %s is not in the config", host)
+}
+
+// getCertificate returns the tls.Config.GetCertificate callback of a server. The certificates of
+// the hosts are from the CA, other names get the static certificates (certs may be nil if there are none).
+// Clients that do not send a server name get the certificate of the first host, when there is no static one.
+// If the CA fails to issue a certificate, the static certificates are used until it succeeds
+func (m *acmeManager) getCertificate(hosts []string, certs *certStore, mainlog func() log.Logger) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" && certs == nil {
+			h := *hello
+			h.ServerName = hosts[0]
+			hello = &h
+		}
+		if !m.allowed(hello.ServerName) {
+			if certs == nil {
+				return nil, errors.New("no certificate for " + hello.ServerName)
+			}
+			return certs.getCertificate(hello)
+		}
+		cert, err := m.GetCertificate(hello)
+		if err == nil || certs == nil || isACMEChallenge(hello) {
+			return cert, err
+		}
+		mainlog().WithError(err).Warnf("could not get the ACME certificate for %s, using the static certificate", hello.ServerName)
+		return certs.getCertificate(hello)
+	}
+}
+
+// obtain gets the certificates of the hosts that are not in the cache yet, so that the first
+// clients do not have to wait. Errors are logged only, they are tried again at the next handshake
+func (m *acmeManager) obtain(hosts []string, mainlog func() log.Logger) {
+	for _, host := range hosts {
+		// the ECDSA certificate, which most clients ask for
+		hello := &tls.ClientHelloInfo{
+			ServerName:   host,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+		if _, err := m.GetCertificate(hello); err != nil {
+			mainlog().WithError(err).Errorf("could not get the ACME certificate for %s", host)
+		}
+	}
+}
+
+// isACMEChallenge returns true if the handshake is the CA verifying a TLS-ALPN-01 challenge
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"time"
 )
 
@@ -22,6 +25,14 @@ type Daemon struct {
 
 	configLoadTime time.Time
 	subs           []deferredSub
+	// listener of the health check, see EnableHealthCheck
+	health net.Listener
+}
+
+// healthStatus is the JSON body returned by the health check
+type healthStatus struct {
+	Status    string            `json:"status"`
+	Unhealthy map[string]string `json:"unhealthy,omitempty"`
 }
 
 type deferredSub struct {
@@ -31,12 +42,21 @@ type deferredSub struct {
 
 const defaultInterface = "127.0.0.1:2525"
 
+// how long the readiness check waits for the backend to reply to a ping
+const healthCheckTimeout = time.Second * 5
+
 // AddProcessor adds a processor constructor to the backend.
 // name is the identifier to be used in the config. See backends docs for more info.
 func (d *Daemon) AddProcessor(name string, pc backends.ProcessorConstructor) {
 	backends.Svc.AddProcessor(name, pc)
 }
 
+// SetClientCertMapper sets how the clients that presented a verified certificate are mapped to
+// the identity they are authenticated as, see ServerConfig.ClientAuth. nil for DefaultClientCertMapper
+func (d *Daemon) SetClientCertMapper(m ClientCertMapper) {
+	setClientCertMapper(m)
+}
+
 // Starts the daemon, initializing d.Config, d.Logger and d.Backend with defaults
 // can only be called once through the lifetime of the program
 func (d *Daemon) Start() (err error) {
@@ -47,6 +67,9 @@ func (d *Daemon) Start() (err error) {
 		if err = d.configureDefaults(); err != nil {
 			return err
 		}
+		if err = log.SetFormat(d.Config.LogFormat); err != nil {
+			return err
+		}
 		if d.Logger == nil {
 			d.Logger, err = log.GetLogger(d.Config.LogFile, d.Config.LogLevel)
 			if err != nil {
@@ -81,10 +104,136 @@ func (d *Daemon) Start() (err error) {
 
 // Shuts down the daemon, including servers and backend.
 // Do not call Start on it again, use a new server.
-func (d *Daemon) Shutdown() {
+// Returns ErrShutdownTimeout if the clients or the backend did not finish within
+// the shutdown_timeout, nil if the shutdown was clean
+func (d *Daemon) Shutdown() error {
+	if d.health != nil {
+		d.health.Close()
+		d.health = nil
+	}
 	if d.g != nil {
-		d.g.Shutdown()
+		return d.g.Shutdown()
+	}
+	return nil
+}
+
+// Deliver hands e to the backend without a connection, for messages made by the program itself.
+// Like with a message received by a server, the recipients are validated, then the backend saves it,
+// the Result has the reply. The error is not nil if the message was not accepted.
+// Safe to call while the servers are running. e is not kept once Deliver returns, so it can
+// be returned to the mail.Pool it was borrowed from
+func (d *Daemon) Deliver(e *mail.Envelope) (backends.Result, error) {
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return nil, errors.New("daemon not started")
+	}
+	return g.deliver(e)
+}
+
+// EnableHealthCheck serves a health check over HTTP on addr, eg. "127.0.0.1:8080", for use as
+// liveness and readiness probes. /healthz replies 200 while the process is up.
+// /readyz replies 200 if all the enabled servers are listening and the backend is healthy,
+// otherwise 503 with the unhealthy components in the JSON body.
+// /metrics has the number of messages waiting for a backend worker, in the Prometheus text format.
+// The listener is closed when the daemon is shut down
+func (d *Daemon) EnableHealthCheck(addr string) error {
+	if d.health != nil {
+		return errors.New("health check already enabled")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, nil)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, d.unhealthy())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeMetrics(w, d.metrics())
+	})
+	d.health = ln
+	go http.Serve(ln, mux)
+	d.Log().Infof("health check listening on %s", ln.Addr())
+	return nil
+}
+
+// unhealthy returns the components that are not ready, with the reason
+func (d *Daemon) unhealthy() map[string]string {
+	if g, ok := d.g.(*guerrilla); ok {
+		return g.unhealthy()
+	}
+	return map[string]string{"daemon": "not started"}
+}
+
+// metrics are the values served by /metrics
+type metrics struct {
+	// messages waiting for a backend worker
+	queueDepth int
+	// running backend workers
+	workers int
+	// the counters of the envelope pools of the servers
+	envelopes mail.PoolStats
+}
+
+// metrics returns the current metrics, zero if the daemon is not started
+func (d *Daemon) metrics() metrics {
+	var m metrics
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return m
+	}
+	b := g.backend()
+	if q, ok := b.(backends.QueueDepther); ok {
+		m.queueDepth = q.QueueDepth()
+	}
+	if c, ok := b.(backends.WorkerCounter); ok {
+		m.workers = c.WorkerCount()
+	}
+	m.envelopes = g.envelopeStats()
+	return m
+}
+
+// writeMetrics replies with the metrics in the Prometheus text format
+func writeMetrics(w http.ResponseWriter, m metrics) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Connection", "close")
+	fmt.Fprintf(w, "# HELP guerrilla_backend_queue_depth Messages waiting for a backend worker.\n"+
+		"# TYPE guerrilla_backend_queue_depth gauge\n"+
+		"guerrilla_backend_queue_depth %d\n"+
+		"# HELP guerrilla_backend_workers Running backend workers.\n"+
+		"# TYPE guerrilla_backend_workers gauge\n"+
+		"guerrilla_backend_workers %d\n", m.queueDepth, m.workers)
+	fmt.Fprintf(w, "# HELP guerrilla_envelope_pool_gets_total Envelopes borrowed from the pools.\n"+
+		"# TYPE guerrilla_envelope_pool_gets_total counter\n"+
+		"guerrilla_envelope_pool_gets_total %d\n"+
+		"# HELP guerrilla_envelope_pool_puts_total Envelopes put back in the pools for reuse.\n"+
+		"# TYPE guerrilla_envelope_pool_puts_total counter\n"+
+		"guerrilla_envelope_pool_puts_total %d\n"+
+		"# HELP guerrilla_envelope_pool_news_total Envelopes allocated because the pools were empty.\n"+
+		"# TYPE guerrilla_envelope_pool_news_total counter\n"+
+		"guerrilla_envelope_pool_news_total %d\n"+
+		"# HELP guerrilla_envelope_pool_in_use Envelopes in use by the connections.\n"+
+		"# TYPE guerrilla_envelope_pool_in_use gauge\n"+
+		"guerrilla_envelope_pool_in_use %d\n",
+		m.envelopes.Gets, m.envelopes.Puts, m.envelopes.News, m.envelopes.InUse)
+}
+
+// writeHealth replies with 200 if there are no problems, 503 otherwise
+func writeHealth(w http.ResponseWriter, problems map[string]string) {
+	status := healthStatus{Status: "ok"}
+	code := http.StatusOK
+	if len(problems) > 0 {
+		status = healthStatus{Status: "unavailable", Unhealthy: problems}
+		code = http.StatusServiceUnavailable
 	}
+	w.Header().Set("Content-Type", "application/json")
+	// no keep-alive, so that no connections are left open after the listener is closed
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
 }
 
 // LoadConfig reads in the config from a JSON file.
@@ -107,14 +256,15 @@ func (d *Daemon) LoadConfig(path string) (AppConfig, error) {
 
 // SetConfig is same as LoadConfig, except you can pass AppConfig directly
 // does not emit any change events, instead use ReloadConfig after daemon has started
+// ${ENV_VAR} references are not substituted, since c would usually come from LoadConfig
 func (d *Daemon) SetConfig(c AppConfig) error {
-	// need to call c.Load, thus need to convert the config
+	// need to call c.load, thus need to convert the config
 	// d.load takes json bytes, marshal it
 	data, err := json.Marshal(&c)
 	if err != nil {
 		return err
 	}
-	err = c.Load(data)
+	err = c.load(data, false)
 	if err != nil {
 		return err
 	}
@@ -161,7 +311,10 @@ func (d *Daemon) ReopenLogs() error {
 	return nil
 }
 
-// Subscribe for subscribing to config change events
+// Subscribe for subscribing to config change events, and to the mail events:
+// EventMailReceived, EventMailAccepted and EventMailRejected, with a func(*mail.Envelope).
+// The mail events are delivered from a worker, in the order they happened, with a copy of
+// the envelope. A subscriber that panics is logged
 func (d *Daemon) Subscribe(topic Event, fn interface{}) error {
 	if d.g == nil {
 		d.subs = append(d.subs, deferredSub{topic, fn})
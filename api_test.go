@@ -2,13 +2,17 @@ package guerrilla
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -254,6 +258,59 @@ func TestReopenLog(t *testing.T) {
 	}
 }
 
+// Test that each server logs to its own log_file, and that the files are re-opened
+func TestServerLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logA := filepath.Join(dir, "a.log")
+	logB := filepath.Join(dir, "b.log")
+	cfg := &AppConfig{LogFile: "tests/testlog", AllowedHosts: []string{"grr.la"}}
+	cfg.Servers = append(cfg.Servers,
+		ServerConfig{ListenInterface: "127.0.0.1:2530", IsEnabled: true, LogFile: logA},
+		ServerConfig{ListenInterface: "127.0.0.1:2531", IsEnabled: true, LogFile: logB},
+	)
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("start error", err)
+	}
+	talkToServer("127.0.0.1:2530")
+	talkToServer("127.0.0.1:2531")
+	// logrotate moves the file away, then sends a SIGHUP
+	if err := os.Rename(logA, logA+".1"); err != nil {
+		t.Fatal(err)
+	}
+	d.ReopenLogs()
+	talkToServer("127.0.0.1:2530")
+	d.Shutdown()
+
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Error("could not read log file", err)
+		}
+		return string(b)
+	}
+	for name, want := range map[string]string{logA + ".1": "2530", logB: "2531"} {
+		other := "2531"
+		if want == "2531" {
+			other = "2530"
+		}
+		out := read(name)
+		if !strings.Contains(out, "Listening on TCP 127.0.0.1:"+want) || !strings.Contains(out, "Handle client") {
+			t.Error(name, "is missing the lines of server", want, ", got:", out)
+		}
+		if strings.Contains(out, "127.0.0.1:"+other) {
+			t.Error(name, "has the lines of server", other, ", got:", out)
+		}
+	}
+	if out := read(logA); !strings.Contains(out, "Handle client") {
+		t.Error("the re-opened log file is missing the client, got:", out)
+	}
+}
+
 func TestSetConfig(t *testing.T) {
 
 	os.Truncate("test/testlog", 0)
@@ -298,6 +355,30 @@ func TestSetConfig(t *testing.T) {
 
 }
 
+// Test that values loaded from the environment are not substituted again by SetConfig
+func TestSetConfigEnv(t *testing.T) {
+	os.Setenv("GG_TEST_SECRET", "pa${ss}word")
+	defer os.Unsetenv("GG_TEST_SECRET")
+	cfg := AppConfig{}
+	if err := cfg.Load([]byte(`{
+    "log_file" : "tests/testlog",
+    "allowed_hosts" : ["grr.la"],
+    "backend_config" : {"mysql_pass" : "${GG_TEST_SECRET}"},
+    "servers" : [{"is_enabled" : true, "listen_interface" : "127.0.0.1:2526"}]
+}`)); err != nil {
+		t.Error("Cannot load config |", err)
+		t.FailNow()
+	}
+	d := Daemon{}
+	if err := d.SetConfig(cfg); err != nil {
+		t.Error("SetConfig returned an error:", err)
+		t.FailNow()
+	}
+	if d.Config.BackendConfig["mysql_pass"] != "pa${ss}word" {
+		t.Error("expecting mysql_pass pa${ss}word, got:", d.Config.BackendConfig["mysql_pass"])
+	}
+}
+
 func TestSetConfigError(t *testing.T) {
 
 	os.Truncate("tests/testlog", 0)
@@ -405,6 +486,187 @@ func TestSetAddProcessor(t *testing.T) {
 
 }
 
+// slowSave is a processor that takes slowSaveDelay to save
+var slowSaveDelay time.Duration
+
+func slowSave() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					time.Sleep(slowSaveDelay)
+				}
+				return p.Process(e, task)
+			})
+	}
+}
+
+// sendSlowMessage sends a message and returns a channel that gets the reply to the end of DATA,
+// and a channel that is closed when the server has the message
+func sendSlowMessage(t *testing.T, address string) (chan string, chan bool) {
+	reply := make(chan string, 1)
+	sent := make(chan bool)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Error("could not connect:", err)
+		close(sent)
+		reply <- ""
+		return reply, sent
+	}
+	go func() {
+		defer conn.Close()
+		in := bufio.NewReader(conn)
+		in.ReadString('\n')
+		for _, cmd := range []string{
+			"HELO maildiranasaurustester",
+			"MAIL FROM:<test@example.com>",
+			"RCPT TO:<test@grr.la>",
+			"DATA",
+		} {
+			fmt.Fprint(conn, cmd+"\r\n")
+			in.ReadString('\n')
+		}
+		fmt.Fprint(conn, "Subject: Test subject\r\n\r\nA an email body\r\n.\r\n")
+		close(sent)
+		str, _ := in.ReadString('\n')
+		reply <- str
+	}()
+	return reply, sent
+}
+
+// Test that a save that takes too long is cut off after the shutdown_timeout,
+// and that a save that finishes within the timeout completes
+func TestShutdownTimeout(t *testing.T) {
+	cfg := &AppConfig{
+		LogFile:         "tests/testlog",
+		AllowedHosts:    []string{"grr.la"},
+		ShutdownTimeout: 1,
+		BackendConfig: backends.BackendConfig{
+			"save_process":    "SlowSave",
+			"gw_save_timeout": "30s",
+		},
+	}
+	d := Daemon{Config: cfg}
+	d.AddProcessor("SlowSave", slowSave)
+	if err := d.Start(); err != nil {
+		t.Fatal("start error", err)
+	}
+	slowSaveDelay = time.Millisecond * 200
+	reply, sent := sendSlowMessage(t, "127.0.0.1:2525")
+	<-sent
+	time.Sleep(time.Millisecond * 50)
+	if err := d.Shutdown(); err != nil {
+		t.Error("shutdown should be clean, got:", err)
+	}
+	if str := <-reply; strings.Index(str, "250") != 0 {
+		t.Error("the in-flight save should complete, got:", str)
+	}
+
+	d = Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("start error", err)
+	}
+	slowSaveDelay = time.Second * 5
+	reply, sent = sendSlowMessage(t, "127.0.0.1:2525")
+	<-sent
+	time.Sleep(time.Millisecond * 50)
+	start := time.Now()
+	if err := d.Shutdown(); err != ErrShutdownTimeout {
+		t.Error("expecting ErrShutdownTimeout, got:", err)
+	}
+	if took := time.Since(start); took > time.Second*3 {
+		t.Error("shutdown should give up after the timeout, it took:", took)
+	}
+	expected := "421 4.3.2"
+	if str := <-reply; strings.Index(str, expected) != 0 {
+		t.Error("expected", expected, "but got:", str)
+	}
+}
+
+// pingError is returned by the pinger of the FailPing processor
+var pingError error
+
+func failPing() backends.Decorator {
+	backends.Svc.AddPinger(backends.PingWith(func() error {
+		return pingError
+	}))
+	return func(p backends.Processor) backends.Processor {
+		return p
+	}
+}
+
+// getHealth returns the status code and body of a health check request
+func getHealth(t *testing.T, url string) (int, healthStatus) {
+	var status healthStatus
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Error("health check request failed:", err)
+		return 0, status
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Error("could not decode the health status:", err)
+	}
+	return resp.StatusCode, status
+}
+
+func TestHealthCheck(t *testing.T) {
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"grr.la"},
+		BackendConfig: backends.BackendConfig{
+			"save_process": "FailPing",
+		},
+	}
+	d := Daemon{Config: cfg}
+	d.AddProcessor("FailPing", failPing)
+	if err := d.EnableHealthCheck("127.0.0.1:2580"); err != nil {
+		t.Fatal("could not enable the health check:", err)
+	}
+	if code, status := getHealth(t, "http://127.0.0.1:2580/readyz"); code != http.StatusServiceUnavailable ||
+		status.Unhealthy["daemon"] == "" {
+		t.Error("expecting 503 before the daemon is started, got:", code, status)
+	}
+	pingError = nil
+	if err := d.Start(); err != nil {
+		t.Fatal("start error", err)
+	}
+	if code, _ := getHealth(t, "http://127.0.0.1:2580/healthz"); code != http.StatusOK {
+		t.Error("expecting 200 from /healthz, got:", code)
+	}
+	if code, status := getHealth(t, "http://127.0.0.1:2580/readyz"); code != http.StatusOK || status.Status != "ok" {
+		t.Error("expecting 200 from /readyz, got:", code, status)
+	}
+	resp, err := http.Get("http://127.0.0.1:2580/metrics")
+	if err != nil {
+		t.Fatal("could not get the metrics:", err)
+	}
+	metrics, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(metrics), "\nguerrilla_backend_queue_depth 0\n") {
+		t.Errorf("expecting the queue depth in the metrics, got: %q", metrics)
+	}
+	if !strings.Contains(string(metrics), "\nguerrilla_backend_workers 1\n") {
+		t.Errorf("expecting the worker count in the metrics, got: %q", metrics)
+	}
+	if !strings.Contains(string(metrics), "\nguerrilla_envelope_pool_in_use 0\n") {
+		t.Errorf("expecting the envelope pool in the metrics, got: %q", metrics)
+	}
+	// the database went away
+	pingError = errors.New("connection refused")
+	code, status := getHealth(t, "http://127.0.0.1:2580/readyz")
+	if code != http.StatusServiceUnavailable || status.Unhealthy["backend"] != "connection refused" {
+		t.Error("expecting 503 with the backend unhealthy, got:", code, status)
+	}
+	if code, _ := getHealth(t, "http://127.0.0.1:2580/healthz"); code != http.StatusOK {
+		t.Error("expecting 200 from /healthz, got:", code)
+	}
+	d.Shutdown()
+	if _, err := http.Get("http://127.0.0.1:2580/healthz"); err == nil {
+		t.Error("the health check should stop listening after shutdown")
+	}
+}
+
 func talkToServer(address string) {
 
 	conn, err := net.Dial("tcp", address)
@@ -535,6 +797,47 @@ func TestAPILog(t *testing.T) {
 }
 
 // Test the allowed_hosts config option with a single entry of ".", which will allow all hosts.
+func TestJSONLog(t *testing.T) {
+	defer log.SetFormat(log.FormatText)
+	var ac AppConfig
+	if err := ac.Load([]byte(`{"log_format":"xml"}`)); err == nil {
+		t.Error("expecting an error for an invalid log_format")
+	}
+	os.Truncate("tests/testlog", 0)
+	cfg := &AppConfig{LogFile: "tests/testlog", LogFormat: log.FormatJSON}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("start error", err)
+	}
+	d.Log().WithField("guid", "abc123").Info("GUID is already seen")
+	d.Shutdown()
+
+	b, err := ioutil.ReadFile("tests/testlog")
+	if err != nil {
+		t.Fatal("could not read logfile")
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Error("log line is not JSON:", line)
+			continue
+		}
+		if entry["level"] == nil || entry["time"] == nil {
+			t.Error("log line is missing the level or time:", line)
+		}
+		if entry["msg"] == "GUID is already seen" {
+			found = true
+			if entry["guid"] != "abc123" || entry["level"] != "info" {
+				t.Error("expecting the guid field and info level, got:", line)
+			}
+		}
+	}
+	if !found {
+		t.Error("the log entry was not found in tests/testlog")
+	}
+}
+
 func TestSkipAllowsHost(t *testing.T) {
 
 	d := Daemon{}
@@ -559,3 +862,330 @@ func TestSkipAllowsHost(t *testing.T) {
 	}
 
 }
+
+// Test reloading the config with a new server, a removed server and a new processor chain
+func TestReloadConfigServers(t *testing.T) {
+	os.Truncate("tests/testlog", 0)
+	cfg := AppConfig{
+		LogFile:      "tests/testlog",
+		AllowedHosts: []string{"grr.la"},
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|Debugger",
+		},
+	}
+	cfg.Servers = append(cfg.Servers, ServerConfig{ListenInterface: "127.0.0.1:2526", IsEnabled: true})
+	d := Daemon{Config: &cfg}
+	if err := d.Start(); err != nil {
+		t.Error("start error", err)
+		return
+	}
+	defer d.Shutdown()
+
+	var added, removed []string
+	d.Subscribe(EventConfigServerNew, func(sc *ServerConfig) {
+		added = append(added, sc.ListenInterface)
+	})
+	d.Subscribe(EventConfigServerRemove, func(sc *ServerConfig) {
+		removed = append(removed, sc.ListenInterface)
+	})
+
+	// replace 127.0.0.1:2526 with 127.0.0.1:2528 and change the processors
+	newCfg := cfg
+	newCfg.Servers = []ServerConfig{{ListenInterface: "127.0.0.1:2528", IsEnabled: true}}
+	newCfg.BackendConfig = backends.BackendConfig{
+		"save_process": "HeadersParser|Header|Debugger",
+	}
+	if err := d.ReloadConfig(newCfg); err != nil {
+		t.Error("reload error", err)
+		return
+	}
+	if len(added) != 1 || added[0] != "127.0.0.1:2528" {
+		t.Error("expecting an event for the added server, got:", added)
+	}
+	if len(removed) != 1 || removed[0] != "127.0.0.1:2526" {
+		t.Error("expecting an event for the removed server, got:", removed)
+	}
+
+	// the new server should accept connections
+	conn, err := net.Dial("tcp", "127.0.0.1:2528")
+	if err != nil {
+		t.Error("could not connect to the new server:", err)
+		return
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil || !strings.HasPrefix(greeting, "220") {
+		t.Error("expecting a 220 greeting from the new server, got:", greeting, err)
+	}
+	// the removed server should be stopped
+	if conn, err := net.Dial("tcp", "127.0.0.1:2526"); err == nil {
+		conn.Close()
+		t.Error("127.0.0.1:2526 should have been stopped")
+	}
+
+	b, err := ioutil.ReadFile("tests/testlog")
+	if err != nil {
+		t.Error("could not read logfile")
+		return
+	}
+	if strings.Index(string(b), "new backend started") < 0 {
+		t.Error("expecting the backend to be rebuilt with the new processors")
+	}
+}
+
+// rejectAll is a processor that rejects all the messages
+func rejectAll() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					return backends.NewResult("554 5.7.1 rejected"), errors.New("rejected")
+				}
+				return p.Process(e, task)
+			})
+	}
+}
+
+// waitMailEvents returns the events received from events, until n were received or a timeout
+func waitMailEvents(events chan string, n int) []string {
+	var got []string
+	timeout := time.After(time.Second * 5)
+	for len(got) < n {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-timeout:
+			return got
+		}
+	}
+	return got
+}
+
+func TestMailEvents(t *testing.T) {
+	os.Truncate("tests/testlog", 0)
+	d := Daemon{Config: &AppConfig{LogFile: "tests/testlog", AllowedHosts: []string{"grr.la"}}}
+	events := make(chan string, 10)
+	// subscribed before the start
+	d.Subscribe(EventMailReceived, func(e *mail.Envelope) {
+		events <- EventMailReceived.String() + " " + e.MailFrom.String()
+		panic("a subscriber that panics")
+	})
+	d.Subscribe(EventMailAccepted, func(e *mail.Envelope) {
+		events <- EventMailAccepted.String() + " " + e.RcptTo[0].String()
+	})
+	d.Subscribe(EventMailRejected, func(e *mail.Envelope) {
+		events <- EventMailRejected.String()
+	})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	talkToServer("127.0.0.1:2525")
+	got := waitMailEvents(events, 2)
+	d.Shutdown()
+
+	// the accepted event comes after the received event, even though its subscriber panicked
+	if len(got) != 2 || got[0] != "mail:received test@example.com" || got[1] != "mail:accepted test@grr.la" {
+		t.Error("unexpected events:", got)
+	}
+	b, err := ioutil.ReadFile("tests/testlog")
+	if err != nil {
+		t.Fatal("could not read logfile")
+	}
+	if !strings.Contains(string(b), "a subscriber that panics") {
+		t.Error("expecting the panic to be logged")
+	}
+}
+
+func TestMailEventsRejected(t *testing.T) {
+	cfg := &AppConfig{
+		LogFile:      "tests/testlog",
+		AllowedHosts: []string{"grr.la"},
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|Reject",
+		},
+	}
+	d := Daemon{Config: cfg}
+	d.AddProcessor("Reject", rejectAll)
+	events := make(chan string, 10)
+	d.Subscribe(EventMailRejected, func(e *mail.Envelope) {
+		events <- EventMailRejected.String() + " " + e.Subject
+	})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	talkToServer("127.0.0.1:2525")
+	got := waitMailEvents(events, 1)
+	d.Shutdown()
+
+	if len(got) != 1 || got[0] != "mail:rejected Test subject" {
+		t.Error("unexpected events:", got)
+	}
+}
+
+// stubDeliver is a processor that rejects the recipient nobody@grr.la, and sends the
+// subjects of the saved messages to stubDelivered
+var stubDelivered = make(chan string, 10)
+
+func stubDeliver() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskValidateRcpt && e.RcptTo[len(e.RcptTo)-1].User == "nobody" {
+					return backends.NewResult("550 5.1.1 no such user"), backends.NoSuchUser
+				}
+				if task == backends.TaskSaveMail {
+					stubDelivered <- e.Subject
+				}
+				return p.Process(e, task)
+			})
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	cfg := &AppConfig{
+		LogFile:      "tests/testlog",
+		AllowedHosts: []string{"grr.la"},
+		BackendConfig: backends.BackendConfig{
+			"save_process":     "HeadersParser|Stub",
+			"validate_process": "Stub",
+		},
+	}
+	d := Daemon{Config: cfg}
+	d.AddProcessor("Stub", stubDeliver)
+	pool := mail.NewPool(5)
+	newEnvelope := func(subject string, rcpts ...string) *mail.Envelope {
+		e := pool.Borrow("127.0.0.1", 1)
+		e.ResetTransaction()
+		e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+		for _, r := range rcpts {
+			e.PushRcpt(mail.Address{User: r, Host: "grr.la"})
+		}
+		e.Data.WriteString("Subject: " + subject + "\n\nHello\n")
+		return e
+	}
+	if _, err := d.Deliver(newEnvelope("early", "test")); err == nil {
+		t.Error("expecting an error before the start")
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	// alongside each other
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			e := newEnvelope(fmt.Sprintf("message %d", i), "test")
+			res, err := d.Deliver(e)
+			if err == nil && res.Code() != 250 {
+				err = errors.New("unexpected result: " + res.String())
+			}
+			pool.Return(e)
+			results <- err
+		}(i)
+	}
+	subjects := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+		subjects[<-stubDelivered] = true
+	}
+	if len(subjects) != 3 || !subjects["message 0"] || !subjects["message 2"] {
+		t.Error("expecting the 3 messages to be saved, got:", subjects)
+	}
+
+	// the recipients are validated
+	e := newEnvelope("rejected", "test", "nobody")
+	res, err := d.Deliver(e)
+	if err == nil || !strings.HasPrefix(res.String(), "550 5.1.1") {
+		t.Error("expecting the recipient to be rejected, got:", res, err)
+	}
+	if len(e.RcptTo) != 2 {
+		t.Error("the recipients of the envelope should be kept, got:", e.RcptTo)
+	}
+	if _, err := d.Deliver(newEnvelope("no recipients")); err == nil {
+		t.Error("expecting an error without recipients")
+	}
+	select {
+	case s := <-stubDelivered:
+		t.Error("expecting the rejected messages not to be saved, got:", s)
+	default:
+	}
+}
+
+// Test a server that listens on a unix socket, left behind by a server that didn't exit cleanly
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "smtp.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	backends.Memory.Reset()
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"grr.la"},
+		Servers: []ServerConfig{{
+			IsEnabled:       true,
+			ListenInterface: "unix:" + path,
+			SocketMode:      "0600",
+			// the clients of the socket are not filtered by their network
+			AllowedNets: []string{"192.0.2.0/24"},
+		}},
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|Header|Memory",
+		},
+	}
+	d := Daemon{Config: cfg}
+	if err := d.Start(); err != nil {
+		t.Fatal("start error", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Error("expecting a socket with the socket_mode, got:", info, err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		d.Shutdown()
+		t.Fatal("could not connect to the socket:", err)
+	}
+	in := bufio.NewReader(conn)
+	if str, _ := in.ReadString('\n'); !strings.HasPrefix(str, "220") {
+		t.Error("expecting the greeting, got:", str)
+	}
+	for _, cmd := range []string{
+		"HELO test",
+		"MAIL FROM:<test@example.com>",
+		"RCPT TO:<test@grr.la>",
+	} {
+		fmt.Fprint(conn, cmd+"\r\n")
+		if str, _ := in.ReadString('\n'); !strings.HasPrefix(str, "250") {
+			t.Errorf("expecting 250 to %s, got: %s", cmd, str)
+		}
+	}
+	fmt.Fprint(conn, "DATA\r\n")
+	in.ReadString('\n')
+	fmt.Fprint(conn, "Subject: Test subject\r\n\r\nA an email body\r\n.\r\n")
+	if str, _ := in.ReadString('\n'); !strings.HasPrefix(str, "250") {
+		t.Error("expecting the message to be queued, got:", str)
+	}
+	fmt.Fprint(conn, "QUIT\r\n")
+	in.ReadString('\n')
+	conn.Close()
+	d.Shutdown()
+
+	if list := backends.Memory.List(); len(list) != 1 || list[0].RemoteIP != "127.0.0.1" {
+		t.Error("expecting the message from 127.0.0.1, got:", list)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expecting the socket to be removed on shutdown, got:", err)
+	}
+}
@@ -0,0 +1,87 @@
+//go:build amqp
+// +build amqp
+
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// the publisher of the amqp processor, only built with -tags amqp
+func init() {
+	newAMQPPublisher = dialAMQP
+}
+
+// amqp091Publisher is an amqpPublisher on a connection of amqp091-go
+type amqp091Publisher struct {
+	conn    *amqp.Connection
+	ch      *amqp.Channel
+	returns chan amqp.Return
+	timeout time.Duration
+}
+
+func dialAMQP(url string, tlsConfig *tls.Config, confirmTimeout time.Duration) (amqpPublisher, error) {
+	// the tlsConfig is only used with amqps://
+	conn, err := amqp.DialTLS(url, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p := &amqp091Publisher{conn: conn, ch: ch, timeout: confirmTimeout}
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return p, nil
+}
+
+func (p *amqp091Publisher) Publish(exchange, key string, msg *amqpMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	confirm, err := p.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, true, false, amqp.Publishing{
+		ContentType:  msg.ContentType,
+		MessageId:    msg.MessageId,
+		Timestamp:    msg.Timestamp,
+		Headers:      amqp.Table(msg.Headers),
+		Body:         msg.Body,
+		DeliveryMode: amqp.Persistent,
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("the message was nacked by the broker")
+	}
+	// the broker sends the return of an unroutable message before its ack
+	for {
+		select {
+		case r := <-p.returns:
+			if r.MessageId == msg.MessageId {
+				return errors.New("the message was returned by the broker: " + r.ReplyText)
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *amqp091Publisher) IsClosed() bool {
+	return p.conn.IsClosed()
+}
+
+func (p *amqp091Publisher) Close() error {
+	return p.conn.Close()
+}
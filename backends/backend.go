@@ -46,6 +46,36 @@ type Backend interface {
 	Start() error
 }
 
+// Aborter is implemented by backends that can cancel their in-flight tasks,
+// used when shutting down does not complete in time
+type Aborter interface {
+	Abort()
+}
+
+// ListExpander is implemented by backends that can expand a mailing list, used by the EXPN command.
+// Returns an error if the list is not known
+type ListExpander interface {
+	ExpandList(list string) ([]mail.Address, error)
+}
+
+// Pinger is implemented by backends that can check if they are healthy,
+// eg. that their database connections are up. Used by the readiness check
+type Pinger interface {
+	Ping() error
+}
+
+// QueueDepther is implemented by backends that queue the messages for their workers,
+// QueueDepth returns how many messages are waiting for a worker
+type QueueDepther interface {
+	QueueDepth() int
+}
+
+// WorkerCounter is implemented by backends with a pool of workers,
+// WorkerCount returns how many are running
+type WorkerCounter interface {
+	WorkerCount() int
+}
+
 type BackendConfig map[string]interface{}
 
 // All config structs extend from this
@@ -54,6 +84,10 @@ type BaseConfig interface{}
 type notifyMsg struct {
 	err      error
 	queuedID string
+	// the save can be tried again
+	retryable bool
+	// result is the reply of the processor that failed the save
+	result Result
 }
 
 // Result represents a response to an SMTP client after receiving DATA.
@@ -90,6 +124,119 @@ func NewResult(message string) Result {
 	return result(message)
 }
 
+// RcptResults is implemented by results that have a reply for each recipient, in the order
+// of e.RcptTo, eg. when some recipients were delivered and others were not. String and Code
+// are of the message as a whole. Used by LMTP, which replies for each recipient after DATA
+type RcptResults interface {
+	Result
+	RcptResults() []Result
+}
+
+type rcptResults struct {
+	Result
+	results []Result
+}
+
+func (r rcptResults) RcptResults() []Result {
+	return r.results
+}
+
+// NewRcptResults returns message, with the replies of each recipient
+func NewRcptResults(message Result, results []Result) Result {
+	return rcptResults{Result: message, results: results}
+}
+
+// ResultsForRcpts returns a reply for each of the n recipients. It is r for all of them
+// if r does not have the replies of each recipient, or they don't match n
+func ResultsForRcpts(r Result, n int) []Result {
+	if rr, ok := r.(RcptResults); ok {
+		if results := rr.RcptResults(); len(results) == n {
+			return results
+		}
+	}
+	results := make([]Result, n)
+	for i := range results {
+		results[i] = r
+	}
+	return results
+}
+
+// ValueRcptResults is the e.Values key of the map[string]Result of the recipients that a processor
+// gave their own outcome, by the address of the recipient, see SetRcptResult
+const ValueRcptResults = "rcpt_results"
+
+// SetRcptResult sets the outcome of rcpt, a recipient of e, eg. when it could not be delivered
+// while the others were. The gateway replies with it for the recipient (see RcptResults), the
+// recipients that were not set get the reply of the message.
+// The result of a recipient that was rewritten may be set for its rewritten address
+func SetRcptResult(e *mail.Envelope, rcpt mail.Address, r Result) {
+	results, ok := e.Values[ValueRcptResults].(map[string]Result)
+	if !ok {
+		results = make(map[string]Result)
+		e.Values[ValueRcptResults] = results
+	}
+	results[strings.ToLower(rcpt.String())] = r
+}
+
+// envelopeRcptResults returns the result of each of rcpts, as set on e by SetRcptResult, or
+// message if it was not set. A rewritten recipient fails only if all its targets did.
+// Returns nil if no result was set
+func envelopeRcptResults(e *mail.Envelope, rcpts []mail.Address, message Result) []Result {
+	set, ok := e.Values[ValueRcptResults].(map[string]Result)
+	if !ok || len(set) == 0 {
+		return nil
+	}
+	rewrites, _ := e.Values[ValueRewrites].([]Rewrite)
+	results := make([]Result, len(rcpts))
+	for i := range rcpts {
+		addr := strings.ToLower(rcpts[i].String())
+		results[i] = message
+		if r, ok := set[addr]; ok {
+			results[i] = r
+			continue
+		}
+		for _, rw := range rewrites {
+			if rw.Field != "rcpt" || strings.ToLower(rw.From) != addr || len(rw.To) == 0 {
+				continue
+			}
+			var failed Result
+			for _, to := range rw.To {
+				r, ok := set[strings.ToLower(to)]
+				if !ok || r.Code() < 300 {
+					failed = nil
+					break
+				}
+				if failed == nil {
+					failed = r
+				}
+			}
+			if failed != nil {
+				results[i] = failed
+			}
+			break
+		}
+	}
+	return results
+}
+
+// combineRcptResults returns message with the results of each recipient, or the first failure
+// if none of the recipients was delivered
+func combineRcptResults(message Result, results []Result) Result {
+	var failed Result
+	for _, r := range results {
+		if r.Code() < 300 {
+			return NewRcptResults(message, results)
+		}
+		if failed == nil {
+			failed = r
+		}
+	}
+	if failed == nil {
+		failed = message
+	}
+	return NewRcptResults(failed, results)
+}
+
 type processorInitializer interface {
 	Initialize(backendConfig BackendConfig) error
 }
@@ -98,8 +245,13 @@ type processorShutdowner interface {
 	Shutdown() error
 }
 
+type processorPinger interface {
+	Ping() error
+}
+
 type InitializeWith func(backendConfig BackendConfig) error
 type ShutdownWith func() error
+type PingWith func() error
 
 // Satisfy ProcessorInitializer interface
 // So we can now pass an anonymous function that implements ProcessorInitializer
@@ -114,6 +266,12 @@ func (s ShutdownWith) Shutdown() error {
 	return s()
 }
 
+// satisfy ProcessorPinger interface, same concept as InitializeWith type
+func (p PingWith) Ping() error {
+	// delegate
+	return p()
+}
+
 type Errors []error
 
 // implement the Error interface
@@ -129,6 +287,32 @@ func (e Errors) Error() string {
 	return msg
 }
 
+// RetryableError is implemented by the errors of processors that failed for a transient reason,
+// eg. a deadlock or a database that is briefly down. The gateway retries a save that failed with one
+type RetryableError interface {
+	error
+	Retryable() bool
+}
+
+type retryableError struct {
+	error
+}
+
+func (e retryableError) Retryable() bool {
+	return true
+}
+
+// NewRetryableError marks err as transient, so that the save is retried
+func NewRetryableError(err error) error {
+	return retryableError{err}
+}
+
+// isRetryable returns true if err was marked as transient
+func isRetryable(err error) bool {
+	r, ok := err.(RetryableError)
+	return ok && r.Retryable()
+}
+
 func convertError(name string) error {
 	return fmt.Errorf("failed to load backend config (%s)", name)
 }
@@ -136,6 +320,7 @@ func convertError(name string) error {
 type service struct {
 	initializers []processorInitializer
 	shutdowners  []processorShutdowner
+	pingers      []processorPinger
 	sync.Mutex
 	mainlog atomic.Value
 }
@@ -167,9 +352,38 @@ func (s *service) AddShutdowner(sh processorShutdowner) {
 	s.shutdowners = append(s.shutdowners, sh)
 }
 
-// reset clears the initializers and Shutdowners
+// AddPinger adds a function that implements ProcessorPinger to be called when checking the health
+// of the backend, eg. to ping a database connection
+func (s *service) AddPinger(p processorPinger) {
+	s.Lock()
+	defer s.Unlock()
+	s.pingers = append(s.pingers, p)
+}
+
+// takePingers removes the pingers that were added so far and returns them, see takeShutdowners
+func (s *service) takePingers() []processorPinger {
+	s.Lock()
+	defer s.Unlock()
+	p := s.pingers
+	s.pingers = make([]processorPinger, 0)
+	return p
+}
+
+// takeShutdowners removes the shutdowners that were added so far and returns them.
+// A gateway takes the shutdowners of its processors so that shutting it down does not
+// affect the processors of another gateway, eg. when a new gateway replaces it on config reload
+func (s *service) takeShutdowners() []processorShutdowner {
+	s.Lock()
+	defer s.Unlock()
+	sh := s.shutdowners
+	s.shutdowners = make([]processorShutdowner, 0)
+	return sh
+}
+
+// reset clears the initializers, Shutdowners and Pingers
 func (s *service) reset() {
 	s.shutdowners = make([]processorShutdowner, 0)
+	s.pingers = make([]processorPinger, 0)
 	s.initializers = make([]processorInitializer, 0)
 }
 
@@ -267,6 +481,15 @@ func (s *service) ExtractConfig(configData BackendConfig, configType BaseConfig)
 				return configType, convertError("property missing/invalid: '" + field_name + "' of expected type: " + f.Type().Name())
 			}
 		}
+		if f.Type().Name() == "float64" {
+			if floatVal, converted := configData[field_name].(float64); converted {
+				v.Field(i).SetFloat(floatVal)
+			} else if intVal, converted := configData[field_name].(int); converted {
+				v.Field(i).SetFloat(float64(intVal))
+			} else if !omitempty {
+				return configType, convertError("property missing/invalid: '" + field_name + "' of expected type: " + f.Type().Name())
+			}
+		}
 		if f.Type().Name() == "string" {
 			if stringVal, converted := configData[field_name].(string); converted {
 				v.Field(i).SetString(stringVal)
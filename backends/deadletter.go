@@ -0,0 +1,82 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const (
+	// extension of the files in the dead_letter_dir
+	deadLetterExt = ".dead"
+	// the e.Values key where the name of the processor that failed the save is kept
+	valueFailedProcessor = "failed_processor"
+)
+
+// DeadLetterSink keeps the messages that could not be saved, so that they can be replayed.
+// The gateway uses a DeadLetterDir if dead_letter_dir is set, other sinks can be set with
+// BackendGateway.SetDeadLetterSink
+type DeadLetterSink interface {
+	// Store keeps e, which failed in the processor named processor with err
+	Store(e *mail.Envelope, processor string, err error) error
+}
+
+// deadLetter is what is written for a message that could not be saved. The envelope is
+// written like in the fallback spool, so it can be read back with readSpooled
+type deadLetter struct {
+	spooledEnvelope
+	Error     string
+	Processor string
+	FailedAt  int64
+}
+
+// DeadLetterDir is a DeadLetterSink that writes each message to a file in a directory,
+// as JSON with the .dead extension
+type DeadLetterDir string
+
+// NewDeadLetterDir returns a DeadLetterDir for dir, which must exist
+func NewDeadLetterDir(dir string) (DeadLetterDir, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", errors.New("dead_letter_dir is not a directory: " + dir)
+	}
+	return DeadLetterDir(dir), nil
+}
+
+// Store writes e to a new file in the dir, the file appears when it is complete
+func (d DeadLetterDir) Store(e *mail.Envelope, processor string, err error) error {
+	b, jsonErr := json.Marshal(&deadLetter{
+		spooledEnvelope: *newSpooledEnvelope(e),
+		Error:           err.Error(),
+		Processor:       processor,
+		FailedAt:        time.Now().Unix(),
+	})
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return writeSpoolFile(string(d), b, deadLetterExt)
+}
+
+// namedDecorator wraps a decorator so that when its processor fails a save, its name is put
+// in e.Values[valueFailedProcessor] for the dead letter. The innermost processor that failed
+// gets there first, the processors that passed the error on don't replace it
+func namedDecorator(name string, d Decorator) Decorator {
+	return func(p Processor) Processor {
+		inner := d(p)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			result, err := inner.Process(e, task)
+			if err != nil && task == TaskSaveMail && e.Values != nil {
+				if _, ok := e.Values[valueFailedProcessor]; !ok {
+					e.Values[valueFailedProcessor] = name
+				}
+			}
+			return result, err
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package backends
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	// the hash algorithm of the signatures
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// The DKIM results, as reported in the Authentication-Results header (RFC 8601)
+const (
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMNeutral   = "neutral"
+	DKIMTempError = "temperror"
+	DKIMPermError = "permerror"
+	DKIMNone      = "none"
+)
+
+// the smallest RSA key accepted, see RFC 8301
+const dkimMinRSABits = 1024
+
+// dkimLookupTXT looks up the key records. It's a variable so that the tests can replace it
+var dkimLookupTXT = net.LookupTXT
+
+// dkimNow is the time that the x= expiration is checked against, it can be replaced in the tests
+var dkimNow = time.Now
+
+// dkimError is a reason why a signature did not verify, with the result that it leads to
+type dkimError struct {
+	result string
+	reason string
+}
+
+func (e *dkimError) Error() string {
+	return e.reason
+}
+
+func dkimPermError(reason string) error {
+	return &dkimError{result: DKIMPermError, reason: reason}
+}
+
+// dkimResult returns the result for the error returned by the verification
+func dkimResult(err error) string {
+	if err == nil {
+		return DKIMPass
+	}
+	if e, ok := err.(*dkimError); ok {
+		return e.result
+	}
+	return DKIMPermError
+}
+
+// dkimSignature is a parsed DKIM-Signature header
+type dkimSignature struct {
+	// the header field, as in the message
+	field     string
+	algorithm string
+	hash      crypto.Hash
+	b         []byte
+	bh        []byte
+	domain    string
+	selector  string
+	identity  string
+	headers   []string
+	// relaxed canonicalization of the header and the body, or simple
+	relaxedHeader bool
+	relaxedBody   bool
+	// the l= body length, -1 if the whole body is signed
+	length int64
+	// the t= and x= timestamps, 0 if not set
+	timestamp int64
+	expires   int64
+}
+
+// dkimKey is a public key published with a "selector._domainkey.domain" TXT record
+type dkimKey struct {
+	algorithm string
+	rsa       *rsa.PublicKey
+	ed25519   ed25519.PublicKey
+	// the acceptable hash algorithms, any if empty
+	hashes []string
+	// the "s" flag, the i= domain must be the d= domain
+	strict bool
+}
+
+// dkimTags parses a tag-list, such as the value of the DKIM-Signature header or a key record
+func dkimTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		i := strings.IndexByte(tag, '=')
+		if i < 1 {
+			return nil, errors.New("invalid tag [" + tag + "]")
+		}
+		name := strings.TrimSpace(tag[:i])
+		if _, ok := tags[name]; ok {
+			return nil, errors.New("duplicate tag [" + name + "]")
+		}
+		tags[name] = strings.TrimSpace(tag[i+1:])
+	}
+	return tags, nil
+}
+
+// dkimStripSpace removes the folding white space from a base64 value
+func dkimStripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// dkimCRLF returns data with the bare LF line endings replaced with CRLF, the message is signed
+// as it is sent over SMTP
+func dkimCRLF(data []byte) []byte {
+	lf := bytes.Count(data, []byte("\n"))
+	if lf == bytes.Count(data, []byte("\r\n")) {
+		return data
+	}
+	out := make([]byte, 0, len(data)+lf)
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// dkimSplit splits a message with CRLF line endings into its header fields, with their
+// continuation lines and the ending CRLF, and the body
+func dkimSplit(data []byte) (fields []string, body []byte) {
+	for len(data) > 0 {
+		end := bytes.Index(data, []byte("\r\n"))
+		if end == 0 {
+			return fields, data[2:]
+		}
+		if end == -1 {
+			end = len(data)
+		} else {
+			end += 2
+		}
+		line := string(data[:end])
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+		data = data[end:]
+	}
+	return fields, nil
+}
+
+// dkimHeaderName returns the name of a header field
+func dkimHeaderName(field string) string {
+	if i := strings.IndexByte(field, ':'); i != -1 {
+		return strings.TrimRight(field[:i], " \t")
+	}
+	return field
+}
+
+// dkimCollapse replaces each run of white space with a single space
+func dkimCollapse(s []byte) []byte {
+	out := make([]byte, 0, len(s))
+	for i, c := range s {
+		if c == ' ' || c == '\t' {
+			if i > 0 && (s[i-1] == ' ' || s[i-1] == '\t') {
+				continue
+			}
+			c = ' '
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// dkimCanonHeader canonicalizes a header field, with the "relaxed" or the "simple" algorithm
+func dkimCanonHeader(field string, relaxed bool) string {
+	if !relaxed {
+		return field
+	}
+	i := strings.IndexByte(field, ':')
+	if i == -1 {
+		return field
+	}
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.Trim(string(dkimCollapse([]byte(value))), " ")
+	return strings.ToLower(dkimHeaderName(field)) + ":" + value + "\r\n"
+}
+
+// dkimCanonBody canonicalizes a body with CRLF line endings, with the "relaxed" or the "simple" algorithm
+func dkimCanonBody(body []byte, relaxed bool) []byte {
+	lines := bytes.Split(body, []byte("\r\n"))
+	if relaxed {
+		for i := range lines {
+			lines[i] = bytes.TrimRight(dkimCollapse(lines[i]), " ")
+		}
+	}
+	// the empty lines at the end are ignored
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	out := make([]byte, 0, len(body)+2)
+	for _, line := range lines {
+		out = append(out, line...)
+		out = append(out, '\r', '\n')
+	}
+	return out
+}
+
+// dkimSelectHeaders returns the header fields named in h=, in that order. When a header is named
+// several times, its instances are taken from the bottom up. Names of missing headers are skipped
+func dkimSelectHeaders(fields []string, names []string) []string {
+	used := make([]bool, len(fields))
+	selected := make([]string, 0, len(names))
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(dkimHeaderName(fields[i]), name) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// matches the b= tag of a signature header value, but not bh=
+var dkimBTag = regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// dkimStripB returns a signature header field with an empty b= value, as it is signed
+func dkimStripB(field string) string {
+	i := strings.IndexByte(field, ':')
+	value := strings.TrimSuffix(field[i+1:], "\r\n")
+	return field[:i+1] + dkimBTag.ReplaceAllString(value, "${1}${2}") + "\r\n"
+}
+
+// dkimHeaderHash hashes the selected header fields and the signature header field, without its b=
+// value and its ending CRLF
+func dkimHeaderHash(h crypto.Hash, fields []string, names []string, sigField string, relaxed bool) []byte {
+	hash := h.New()
+	for _, field := range dkimSelectHeaders(fields, names) {
+		io.WriteString(hash, dkimCanonHeader(field, relaxed))
+	}
+	io.WriteString(hash, strings.TrimSuffix(dkimCanonHeader(dkimStripB(sigField), relaxed), "\r\n"))
+	return hash.Sum(nil)
+}
+
+// parseDKIMSignature parses a DKIM-Signature header field
+func parseDKIMSignature(field string) (*dkimSignature, error) {
+	tags, err := dkimTags(field[strings.IndexByte(field, ':')+1:])
+	if err != nil {
+		return nil, dkimPermError(err.Error())
+	}
+	if v, ok := tags["v"]; !ok {
+		return nil, dkimPermError("missing v= tag")
+	} else if v != "1" {
+		return nil, dkimPermError("unsupported version " + v)
+	}
+	s, err := newDKIMSignature(field, tags)
+	if err != nil {
+		return s, err
+	}
+	from := false
+	for _, name := range s.headers {
+		from = from || strings.EqualFold(name, "from")
+	}
+	if !from {
+		return s, dkimPermError("From header not signed")
+	}
+	if q, ok := tags["q"]; ok && !strings.Contains(strings.ToLower(q), "dns/txt") {
+		return s, dkimPermError("unsupported query method " + q)
+	}
+	if i, ok := tags["i"]; ok {
+		at := strings.LastIndexByte(i, '@')
+		host := strings.ToLower(strings.TrimSuffix(i[at+1:], "."))
+		if at == -1 || (host != s.domain && !strings.HasSuffix(host, "."+s.domain)) {
+			return s, dkimPermError("i= domain does not match d= domain")
+		}
+		s.identity = i
+	}
+	return s, nil
+}
+
+// newDKIMSignature reads the tags that the DKIM-Signature and the ARC-Message-Signature headers share
+func newDKIMSignature(field string, tags map[string]string) (*dkimSignature, error) {
+	for _, name := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[name] == "" {
+			return nil, dkimPermError("missing " + name + "= tag")
+		}
+	}
+	s := &dkimSignature{
+		field:    field,
+		domain:   strings.ToLower(strings.TrimSuffix(tags["d"], ".")),
+		selector: strings.ToLower(tags["s"]),
+		length:   -1,
+	}
+	s.identity = "@" + s.domain
+	var err error
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		s.algorithm, s.hash = "rsa", crypto.SHA256
+	case "ed25519-sha256":
+		s.algorithm, s.hash = "ed25519", crypto.SHA256
+	case "rsa-sha1":
+		// no longer accepted, see RFC 8301
+		return s, dkimPermError("rsa-sha1 is not accepted")
+	default:
+		return s, dkimPermError("unsupported algorithm " + tags["a"])
+	}
+	if s.b, err = base64.StdEncoding.DecodeString(dkimStripSpace(tags["b"])); err != nil {
+		return s, dkimPermError("invalid b= tag")
+	}
+	if s.bh, err = base64.StdEncoding.DecodeString(dkimStripSpace(tags["bh"])); err != nil {
+		return s, dkimPermError("invalid bh= tag")
+	}
+	for _, name := range strings.Split(tags["h"], ":") {
+		s.headers = append(s.headers, strings.TrimSpace(name))
+	}
+	c := strings.Split(strings.ToLower(tags["c"]), "/")
+	if len(c) > 2 {
+		return s, dkimPermError("invalid c= tag")
+	}
+	for i, algorithm := range c {
+		switch algorithm {
+		case "relaxed":
+			if i == 0 {
+				s.relaxedHeader = true
+			} else {
+				s.relaxedBody = true
+			}
+		case "simple", "":
+		default:
+			return s, dkimPermError("unsupported canonicalization " + algorithm)
+		}
+	}
+	if l, ok := tags["l"]; ok {
+		if s.length, err = strconv.ParseInt(l, 10, 64); err != nil || s.length < 0 {
+			return s, dkimPermError("invalid l= tag")
+		}
+	}
+	for name, v := range map[string]*int64{"t": &s.timestamp, "x": &s.expires} {
+		if value, ok := tags[name]; ok {
+			if *v, err = strconv.ParseInt(value, 10, 64); err != nil || *v < 0 {
+				return s, dkimPermError("invalid " + name + "= tag")
+			}
+		}
+	}
+	if s.expires != 0 && s.timestamp != 0 && s.expires < s.timestamp {
+		return s, dkimPermError("x= is before t=")
+	}
+	return s, nil
+}
+
+// lookupDKIMKey fetches the key of a selector
+func lookupDKIMKey(selector, domain string) (*dkimKey, error) {
+	records, err := dkimLookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Err == "no such host" {
+			return nil, dkimPermError("no key for signature")
+		}
+		return nil, &dkimError{result: DKIMTempError, reason: "key unavailable"}
+	}
+	if len(records) == 0 {
+		return nil, dkimPermError("no key for signature")
+	}
+	// there should be a single record, the first one that parses is used
+	err = dkimPermError("invalid key record")
+	for _, record := range records {
+		var key *dkimKey
+		if key, err = parseDKIMKey(record); err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
+// parseDKIMKey parses a key record
+func parseDKIMKey(record string) (*dkimKey, error) {
+	tags, err := dkimTags(record)
+	if err != nil {
+		return nil, dkimPermError("invalid key record")
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, dkimPermError("invalid key record version")
+	}
+	p, ok := tags["p"]
+	if !ok {
+		return nil, dkimPermError("invalid key record")
+	}
+	if p = dkimStripSpace(p); p == "" {
+		return nil, dkimPermError("key revoked")
+	}
+	b, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, dkimPermError("invalid key")
+	}
+	key := &dkimKey{algorithm: strings.ToLower(tags["k"])}
+	switch key.algorithm {
+	case "", "rsa":
+		key.algorithm = "rsa"
+		pub, err := x509.ParsePKIXPublicKey(b)
+		if err != nil {
+			return nil, dkimPermError("invalid key")
+		}
+		if key.rsa, ok = pub.(*rsa.PublicKey); !ok {
+			return nil, dkimPermError("invalid key")
+		}
+		if key.rsa.N.BitLen() < dkimMinRSABits {
+			return nil, dkimPermError("key too short")
+		}
+	case "ed25519":
+		if len(b) != ed25519.PublicKeySize {
+			return nil, dkimPermError("invalid key")
+		}
+		key.ed25519 = ed25519.PublicKey(b)
+	default:
+		return nil, dkimPermError("unsupported key type " + key.algorithm)
+	}
+	if h, ok := tags["h"]; ok {
+		for _, hash := range strings.Split(h, ":") {
+			key.hashes = append(key.hashes, strings.ToLower(strings.TrimSpace(hash)))
+		}
+	}
+	for _, flag := range strings.Split(tags["t"], ":") {
+		if strings.TrimSpace(flag) == "s" {
+			key.strict = true
+		}
+	}
+	return key, nil
+}
+
+// verify checks the signature of sum, a hash with h
+func (k *dkimKey) verify(h crypto.Hash, sum []byte, sig []byte) error {
+	if len(k.hashes) > 0 {
+		accepted := false
+		for _, hash := range k.hashes {
+			accepted = accepted || (hash == "sha256" && h == crypto.SHA256)
+		}
+		if !accepted {
+			return dkimPermError("hash algorithm not accepted by the key")
+		}
+	}
+	switch {
+	case k.rsa != nil:
+		if err := rsa.VerifyPKCS1v15(k.rsa, h, sum, sig); err != nil {
+			return &dkimError{result: DKIMFail, reason: "signature did not verify"}
+		}
+	case k.ed25519 != nil:
+		// the hash is signed, see RFC 8463
+		if !ed25519.Verify(k.ed25519, sum, sig) {
+			return &dkimError{result: DKIMFail, reason: "signature did not verify"}
+		}
+	}
+	return nil
+}
+
+// verify checks the signature of the message made of fields and body, with CRLF line endings
+func (s *dkimSignature) verify(fields []string, body []byte) error {
+	if s.expires != 0 && dkimNow().Unix() > s.expires {
+		return dkimPermError("signature expired")
+	}
+	key, err := lookupDKIMKey(s.selector, s.domain)
+	if err != nil {
+		return err
+	}
+	if key.algorithm != s.algorithm {
+		return dkimPermError("key type does not match the algorithm")
+	}
+	if key.strict {
+		at := strings.LastIndexByte(s.identity, '@')
+		if !strings.EqualFold(strings.TrimSuffix(s.identity[at+1:], "."), s.domain) {
+			return dkimPermError("i= domain must be the d= domain")
+		}
+	}
+	canon := dkimCanonBody(body, s.relaxedBody)
+	if s.length >= 0 {
+		if s.length > int64(len(canon)) {
+			return dkimPermError("l= is longer than the body")
+		}
+		canon = canon[:s.length]
+	}
+	hash := s.hash.New()
+	hash.Write(canon)
+	if !bytes.Equal(hash.Sum(nil), s.bh) {
+		return &dkimError{result: DKIMFail, reason: "body hash did not verify"}
+	}
+	return key.verify(s.hash, dkimHeaderHash(s.hash, fields, s.headers, s.field, s.relaxedHeader), s.b)
+}
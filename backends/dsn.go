@@ -0,0 +1,209 @@
+package backends
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const (
+	// ValueDSNRet is the e.Values key that the server sets to the RET= of MAIL FROM, "FULL" or "HDRS"
+	ValueDSNRet = "dsn_ret"
+	// ValueDSNEnvID is the e.Values key that the server sets to the ENVID= of MAIL FROM
+	ValueDSNEnvID = "dsn_envid"
+	// ValueDSNRcpts is the e.Values key of the map[string]DSNRcpt of the recipients that were
+	// given DSN parameters, by the address of the recipient
+	ValueDSNRcpts = "dsn_rcpts"
+)
+
+// the NOTIFY= values of RCPT TO, see RFC 3461
+const (
+	DSNNotifyNever   = "NEVER"
+	DSNNotifySuccess = "SUCCESS"
+	DSNNotifyFailure = "FAILURE"
+	DSNNotifyDelay   = "DELAY"
+)
+
+// DSNRcpt has the DSN parameters of a recipient
+type DSNRcpt struct {
+	// Notify are the NOTIFY= values, none if not given
+	Notify []string
+	// ORCPT is the original recipient, eg. "rfc822;bob@example.com", decoded from xtext
+	ORCPT string
+}
+
+// notifies returns true if the sender asked to be notified of the event, one of the DSNNotify* values.
+// Without a NOTIFY=, failures are notified
+func (r DSNRcpt) notifies(event string) bool {
+	if len(r.Notify) == 0 {
+		return event == DSNNotifyFailure
+	}
+	for _, n := range r.Notify {
+		if n == event {
+			return true
+		}
+	}
+	return false
+}
+
+// dsnSendMail sends the bounces, a var so that the tests can catch them
+var dsnSendMail = smtp.SendMail
+
+// an enhanced status code at the start of a reply text, eg. "5.1.1"
+var dsnStatusRegex = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}$`)
+
+// dsnFailure is a recipient that could not be delivered to, and its reply
+type dsnFailure struct {
+	rcpt   mail.Address
+	dsn    DSNRcpt
+	result Result
+}
+
+// dsnStatus returns the enhanced status code of r, or one made from its basic code
+func dsnStatus(r Result) string {
+	fields := strings.Fields(r.String())
+	if len(fields) > 1 && dsnStatusRegex.MatchString(fields[1]) {
+		return fields[1]
+	}
+	return strconv.Itoa(r.Code()/100) + ".0.0"
+}
+
+// newDSN composes the delivery status notification of the failed recipients of e, as
+// a multipart/report (RFC 3462) with a message/delivery-status part (RFC 3464).
+// The headers of the message are attached, or all of it if RET=FULL was given
+func newDSN(e *mail.Envelope, reportingMTA string, failed []dsnFailure) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	now := time.Now()
+	header := "From: Mail Delivery System <MAILER-DAEMON@" + reportingMTA + ">\r\n" +
+		"To: <" + e.MailFrom.String() + ">\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"Date: " + now.Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + e.QueuedId + ".dsn@" + reportingMTA + ">\r\n" +
+		"Auto-Submitted: auto-replied\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status;\r\n" +
+		"\tboundary=\"" + w.Boundary() + "\"\r\n\r\n"
+
+	// the explanation for humans
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=us-ascii"}})
+	if err != nil {
+		return nil, err
+	}
+	text := "This is the mail system at " + reportingMTA + ".\r\n\r\n" +
+		"Your message could not be delivered to the following recipients:\r\n\r\n"
+	for _, f := range failed {
+		text += "<" + f.rcpt.String() + ">: " + f.result.String() + "\r\n"
+	}
+	if _, err = part.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+
+	// the per-message fields, then the fields of each recipient
+	part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	status := "Reporting-MTA: dns; " + reportingMTA + "\r\n"
+	if envID, ok := e.Values[ValueDSNEnvID].(string); ok && envID != "" {
+		status += "Original-Envelope-Id: " + envID + "\r\n"
+	}
+	status += "Arrival-Date: " + now.Format(time.RFC1123Z) + "\r\n"
+	for _, f := range failed {
+		status += "\r\nFinal-Recipient: rfc822; " + f.rcpt.String() + "\r\n"
+		if f.dsn.ORCPT != "" {
+			status += "Original-Recipient: " + f.dsn.ORCPT + "\r\n"
+		}
+		status += "Action: failed\r\n" +
+			"Status: " + dsnStatus(f.result) + "\r\n" +
+			"Diagnostic-Code: smtp; " + strings.TrimSpace(f.result.String()) + "\r\n"
+	}
+	if _, err = part.Write([]byte(status)); err != nil {
+		return nil, err
+	}
+
+	// the returned message
+	data := dkimCRLF(e.Data.Bytes())
+	contentType := "message/rfc822"
+	if ret, _ := e.Values[ValueDSNRet].(string); ret != "FULL" {
+		contentType = "text/rfc822-headers"
+		if end := headerEnd(data); end != -1 {
+			data = data[:end]
+		}
+	}
+	part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte(header), buf.Bytes()...), nil
+}
+
+// bounce sends a DSN to the sender of e for the recipients in rcpts that were rejected with a
+// permanent failure, when the others were delivered. The DSN goes to the gw_bounce_relay, and
+// the client is told that the message was delivered.
+// Returns res if nothing was bounced, eg. all the recipients failed, or the client gets the
+// reply of each recipient with LMTP
+func (gw *BackendGateway) bounce(e *mail.Envelope, rcpts []mail.Address, res Result) Result {
+	if gw.gwConfig.BounceRelay == "" || e.MailFrom.IsEmpty() {
+		// never bounce a bounce
+		return res
+	}
+	if protocol, _ := e.Values[ValueProtocol].(string); strings.HasPrefix(protocol, "LMTP") {
+		return res
+	}
+	if _, ok := res.(RcptResults); !ok {
+		// the same reply for all of them
+		return res
+	}
+	dsnRcpts, _ := e.Values[ValueDSNRcpts].(map[string]DSNRcpt)
+	var (
+		delivered Result
+		failed    []dsnFailure
+		notify    []dsnFailure
+	)
+	for i, r := range ResultsForRcpts(res, len(rcpts)) {
+		switch code := r.Code(); {
+		case code >= 200 && code < 300:
+			if delivered == nil {
+				delivered = r
+			}
+		case code >= 500:
+			f := dsnFailure{rcpt: rcpts[i], dsn: dsnRcpts[rcpts[i].String()], result: r}
+			failed = append(failed, f)
+			if f.dsn.notifies(DSNNotifyFailure) {
+				notify = append(notify, f)
+			}
+		default:
+			// the client tries again later
+			return res
+		}
+	}
+	if delivered == nil || len(failed) == 0 {
+		return res
+	}
+	if len(notify) > 0 {
+		msg, err := newDSN(e, gw.gwConfig.BounceHostname, notify)
+		if err == nil {
+			err = dsnSendMail(gw.gwConfig.BounceRelay, nil, "", []string{e.MailFrom.String()}, msg)
+		}
+		if err != nil {
+			Log().WithError(err).Error("could not send the bounce of message ", e.QueuedId)
+			return res
+		}
+	}
+	Log().Infof("bounced %d of %d recipients of message %s", len(failed), len(rcpts), e.QueuedId)
+	return delivered
+}
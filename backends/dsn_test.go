@@ -0,0 +1,195 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// bounceRecorder saves the recipients that are not at example.org, and rejects the others
+func bounceRecorder() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail && e.RcptTo[0].Host == "example.org" {
+				return NewResult("550 5.1.1 No such user"), errors.New("no such user")
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// sentMail is a message sent with dsnSendMail
+type sentMail struct {
+	addr, from string
+	to         []string
+	msg        []byte
+}
+
+func newBounceGateway(t *testing.T) (*BackendGateway, *[]sentMail) {
+	processors["bouncerecorder"] = func() Decorator {
+		return bounceRecorder()
+	}
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	var config BackendConfig
+	if err := json.Unmarshal([]byte(`{
+		"save_process": "debugger",
+		"log_received_mails": false,
+		"save_chains": {"remote": "bouncerecorder"},
+		"gw_routes": [{"domains": "example.org", "chain": "remote"}],
+		"gw_bounce_relay": "relay.example.com:25",
+		"gw_bounce_hostname": "mx.example.com"
+	}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(config); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	sent := new([]sentMail)
+	dsnSendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		*sent = append(*sent, sentMail{addr, from, to, msg})
+		return nil
+	}
+	return gateway, sent
+}
+
+func newBounceEnvelope(sender string) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc123"
+	if sender != "" {
+		e.MailFrom = mail.Address{User: sender, Host: "example.net"}
+	}
+	e.PushRcpt(mail.Address{User: "alice", Host: "example.com"})
+	e.PushRcpt(mail.Address{User: "carol", Host: "example.org"})
+	e.Data.WriteString("From: sender@example.net\r\nSubject: hello\r\n\r\nthe body\r\n")
+	return e
+}
+
+// dsnParts returns the content type of each part of a DSN, and their content
+func dsnParts(t *testing.T, msg []byte) ([]string, []string) {
+	m, err := netmail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatal("unexpected Content-Type:", m.Header.Get("Content-Type"), err)
+	}
+	if to := m.Header.Get("To"); to != "<sender@example.net>" {
+		t.Error("unexpected To:", to)
+	}
+	var types, contents []string
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(part)
+		types = append(types, part.Header.Get("Content-Type"))
+		contents = append(contents, string(b))
+	}
+	return types, contents
+}
+
+func TestBounce(t *testing.T) {
+	gateway, sent := newBounceGateway(t)
+	defer func() {
+		dsnSendMail = smtp.SendMail
+		delete(processors, "bouncerecorder")
+		gateway.Shutdown()
+	}()
+
+	e := newBounceEnvelope("sender")
+	e.Values[ValueDSNRet] = "FULL"
+	e.Values[ValueDSNEnvID] = "QQ314159"
+	e.Values[ValueDSNRcpts] = map[string]DSNRcpt{
+		"carol@example.org": {Notify: []string{DSNNotifyFailure}, ORCPT: "rfc822;carol@example.org"},
+	}
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting the message to be delivered to alice, got:", result)
+	}
+	if len(*sent) != 1 {
+		t.Fatal("expecting a bounce, got:", len(*sent))
+	}
+	bounce := (*sent)[0]
+	if bounce.addr != "relay.example.com:25" || bounce.from != "" || len(bounce.to) != 1 || bounce.to[0] != "sender@example.net" {
+		t.Errorf("unexpected bounce envelope: %+v", bounce)
+	}
+	types, contents := dsnParts(t, bounce.msg)
+	if strings.Join(types, ",") != "text/plain; charset=us-ascii,message/delivery-status,message/rfc822" {
+		t.Fatal("unexpected parts:", types)
+	}
+	for _, field := range []string{
+		"Reporting-MTA: dns; mx.example.com\r\n",
+		"Original-Envelope-Id: QQ314159\r\n",
+		"\r\n\r\nFinal-Recipient: rfc822; carol@example.org\r\n",
+		"Original-Recipient: rfc822;carol@example.org\r\n",
+		"Action: failed\r\n",
+		"Status: 5.1.1\r\n",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+	} {
+		if !strings.Contains(contents[1], field) {
+			t.Errorf("expecting %q in the delivery status: %q", field, contents[1])
+		}
+	}
+	if strings.Contains(contents[1], "alice") {
+		t.Error("the delivered recipient should not be in the delivery status:", contents[1])
+	}
+	if contents[2] != e.Data.String() {
+		t.Errorf("expecting the full message with RET=FULL, got: %q", contents[2])
+	}
+
+	// only the headers by default
+	*sent = nil
+	if result := gateway.Process(newBounceEnvelope("sender")); result.Code() != 250 || len(*sent) != 1 {
+		t.Fatal("expecting a bounce, got:", result, len(*sent))
+	}
+	types, contents = dsnParts(t, (*sent)[0].msg)
+	if len(types) != 3 || types[2] != "text/rfc822-headers" || contents[2] != "From: sender@example.net\r\nSubject: hello\r\n\r\n" {
+		t.Errorf("expecting the headers, got: %q %q", types, contents)
+	}
+
+	// NOTIFY=NEVER
+	*sent = nil
+	e = newBounceEnvelope("sender")
+	e.Values[ValueDSNRcpts] = map[string]DSNRcpt{"carol@example.org": {Notify: []string{DSNNotifyNever}}}
+	if result := gateway.Process(e); result.Code() != 250 || len(*sent) != 0 {
+		t.Error("expecting no bounce with NOTIFY=NEVER, got:", result, len(*sent))
+	}
+
+	// a bounce is never bounced, the client gets the failure
+	if result := gateway.Process(newBounceEnvelope("")); result.Code() != 550 || len(*sent) != 0 {
+		t.Error("expecting the failure for a null sender, got:", result, len(*sent))
+	}
+
+	// the client gets the reply of each recipient with LMTP
+	e = newBounceEnvelope("sender")
+	e.Values[ValueProtocol] = "LMTP"
+	if result := gateway.Process(e); result.Code() != 550 || len(*sent) != 0 {
+		t.Error("expecting no bounce with LMTP, got:", result, len(*sent))
+	}
+
+	// the bounce could not be sent
+	dsnSendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		return errors.New("connection refused")
+	}
+	if result := gateway.Process(newBounceEnvelope("sender")); result.Code() != 550 {
+		t.Error("expecting the failure when the bounce was not sent, got:", result)
+	}
+}
@@ -3,8 +3,11 @@ package backends
 import (
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flashmob/go-guerrilla/log"
@@ -21,20 +24,55 @@ var ErrProcessorNotFound error
 // via a channel. Shutting down via Shutdown() will stop all workers.
 // The rest of this program always talks to the backend via this gateway.
 type BackendGateway struct {
+	// the number of messages waiting for a worker, first for the alignment of the atomic operations
+	queued int64
+	// the number of running workers, see WorkerCount
+	workers int64
+
 	// channel for distributing envelopes to workers
 	conveyor chan *workerMsg
 
 	// waits for backend workers to start/stop
 	wg           sync.WaitGroup
 	workStoppers []chan bool
-	processors   []Processor
-	validators   []Processor
+	// the chains of each worker, by name
+	processors []map[string]Processor
+	validators []Processor
+	// the gw_routes, checked
+	routes []route
 
 	// controls access to state
 	sync.Mutex
 	State    backendState
 	config   BackendConfig
 	gwConfig *GatewayConfig
+
+	// shutdowners of the processors, taken from Svc after initializing
+	shutdowners []processorShutdowner
+	// pingers of the processors, taken from Svc after initializing
+	pingers []processorPinger
+	// read-locked while a task is in-flight, Shutdown write-locks it to wait for in-flight tasks
+	inFlight sync.RWMutex
+	// closed by Abort to cancel the tasks that are waiting for the workers
+	abort      chan struct{}
+	abortGuard sync.Mutex
+	// keeps the messages that could not be saved, nil if none. It has its own guard, the
+	// tasks in-flight store to it while Shutdown holds the lock to wait for them
+	deadLetter      DeadLetterSink
+	deadLetterGuard sync.Mutex
+	// the workers started by the scaler when the queue grew, see GatewayConfig.MaxWorkers
+	scaled      map[*scaledWorker]bool
+	scaledGuard sync.Mutex
+	// closed to stop the scaler, which closes scalerDone when it returns
+	stopScaler chan struct{}
+	scalerDone chan struct{}
+}
+
+// scaledWorker is a worker started by the scaler, with its own processors
+type scaledWorker struct {
+	stop chan bool
+	// the shutdowners of its processors, called when it stops
+	shutdowners []processorShutdowner
 }
 
 type GatewayConfig struct {
@@ -48,6 +86,35 @@ type GatewayConfig struct {
 	TimeoutSave string `json:"gw_save_timeout,omitempty"`
 	// TimeoutValidateRcpt duration before timeout when validating a recipient, eg "1s"
 	TimeoutValidateRcpt string `json:"gw_val_rcpt_timeout,omitempty"`
+	// MaxRetries is how many times to retry a save that failed with a RetryableError, 0 for no retries
+	MaxRetries int `json:"gw_max_retries,omitempty"`
+	// RetryDelay is the wait before the first retry, eg "500ms"
+	RetryDelay string `json:"gw_retry_delay,omitempty"`
+	// RetryBackoff multiplies the wait after each retry, eg "2"
+	RetryBackoff string `json:"gw_retry_backoff,omitempty"`
+	// DeadLetterDir is where the messages that could not be saved are written, so that they can be replayed
+	DeadLetterDir string `json:"dead_letter_dir,omitempty"`
+	// SaveChains are more chains of processors for saving email, by name, eg. {"archive": "header|redis"}
+	SaveChains map[string]string `json:"save_chains,omitempty"`
+	// Routes send the recipients to the SaveChains, the first route that a recipient matches is used.
+	// The recipients that match none are saved by the SaveProcess
+	Routes []RouteConfig `json:"gw_routes,omitempty"`
+	// BounceRelay is the host:port of the server that the bounces are sent to, eg. "localhost:25".
+	// If set, the recipients that fail while others are delivered are bounced, see RFC 3464
+	BounceRelay string `json:"gw_bounce_relay,omitempty"`
+	// BounceHostname is the Reporting-MTA of the bounces, the hostname by default
+	BounceHostname string `json:"gw_bounce_hostname,omitempty"`
+	// QueueHighWater is how many messages may wait for a worker when all the workers are busy,
+	// more messages get a 451 reply so that they are sent again later. 0 for no limit
+	QueueHighWater int `json:"queue_high_water,omitempty"`
+	// MinWorkers & MaxWorkers let the number of workers follow the load. When messages are waiting
+	// for a worker, more workers are started, up to MaxWorkers. The workers over MinWorkers stop
+	// after being idle for the WorkerCooldown. MinWorkers is the WorkersSize if not set.
+	// The number of workers is fixed if MaxWorkers is not over MinWorkers
+	MinWorkers int `json:"min_workers,omitempty"`
+	MaxWorkers int `json:"max_workers,omitempty"`
+	// WorkerCooldown is how long a worker over MinWorkers may be idle before it stops, eg. "30s"
+	WorkerCooldown string `json:"worker_cooldown,omitempty"`
 }
 
 // workerMsg is what get placed on the BackendGateway.saveMailChan channel
@@ -58,6 +125,8 @@ type workerMsg struct {
 	notifyMe chan *notifyMsg
 	// select the task type
 	task SelectTask
+	// the name of the chain that saves the email
+	chain string
 }
 
 type backendState int
@@ -75,8 +144,20 @@ const (
 	// default timeout for validating rcpt to, if 'gw_val_rcpt_timeout' not present in config
 	validateRcptTimeout = time.Second * 5
 	defaultProcessor    = "Debugger"
+	// default wait before the first retry, if 'gw_retry_delay' not present in config
+	retryDelay = time.Second
+	// default factor to multiply the wait by after each retry, if 'gw_retry_backoff' not present in config
+	retryBackoff = 2.0
+	// default idle time before a worker over min_workers stops, if 'worker_cooldown' not present in config
+	workerCooldown = time.Second * 30
+	// how often the scaler checks if messages are waiting for a worker
+	scaleInterval = time.Millisecond * 50
 )
 
+// stacksGuard serializes building the processors & initializing them, since their initializers,
+// shutdowners and pingers are added to Svc and then taken by the gateway or the worker that built them
+var stacksGuard sync.Mutex
+
 func (s backendState) String() string {
 	switch s {
 	case BackendStateNew:
@@ -123,37 +204,189 @@ func (w *workerMsg) reset(e *mail.Envelope, task SelectTask) {
 	}
 	w.e = e
 	w.task = task
+	w.chain = DefaultChain
 }
 
-// Process distributes an envelope to one of the backend workers with a TaskSaveMail task
+// Process distributes an envelope to one of the backend workers with a TaskSaveMail task.
+// A save that fails with a RetryableError is tried again, up to gw_max_retries times, with a
+// growing delay. When the retries run out, the client gets a 451 so that it tries again later.
+// Messages that could not be saved go to the dead letter sink.
+// When the recipients are routed to several chains, each chain saves a copy of the envelope
+// with its recipients, and the Result has the reply of each recipient, see RcptResults.
+// A processor can also fail some of the recipients with SetRcptResult, the message is
+// accepted if any recipient was delivered.
+// If gw_bounce_relay is set, the recipients that failed are bounced when the others were delivered
 func (gw *BackendGateway) Process(e *mail.Envelope) Result {
+	gw.inFlight.RLock()
+	defer gw.inFlight.RUnlock()
 	if gw.State != BackendStateRunning {
 		return NewResult(response.Canned.FailBackendNotRunning + gw.State.String())
 	}
+	// the processors may change the recipients
+	rcpts := append([]mail.Address(nil), e.RcptTo...)
+	groups := routeRcpts(gw.routes, e)
+	if len(groups) == 1 {
+		return gw.bounce(e, rcpts, gw.processChain(e, groups[0].chain))
+	}
+	return gw.bounce(e, rcpts, gw.processRoutes(e, groups))
+}
+
+// processRoutes saves a copy of e with the recipients of each group, by the group's chain.
+// The message is saved only if all the groups were, otherwise the reply is the first failure,
+// so that a client that doesn't look at the replies of each recipient doesn't lose any
+func (gw *BackendGateway) processRoutes(e *mail.Envelope, groups []routeGroup) Result {
+	results := make([]Result, len(e.RcptTo))
+	var failed Result
+	for _, g := range groups {
+		c := e.Copy()
+		c.SetContext(e.Context())
+		c.RcptTo = c.RcptTo[:0]
+		for _, i := range g.rcpts {
+			c.RcptTo = append(c.RcptTo, e.RcptTo[i])
+		}
+		res := gw.processChain(c, g.chain)
+		for j, r := range ResultsForRcpts(res, len(g.rcpts)) {
+			results[g.rcpts[j]] = r
+		}
+		if res.Code() >= 300 && failed == nil {
+			failed = res
+		}
+	}
+	if failed != nil {
+		return NewRcptResults(failed, results)
+	}
+	return NewRcptResults(NewResult(response.Canned.SuccessMessageQueued+e.QueuedId), results)
+}
+
+// processChain saves e with the chain, retrying as described by Process
+func (gw *BackendGateway) processChain(e *mail.Envelope, chain string) Result {
+	// the processors add to the header, each attempt starts with the original
+	deliveryHeader := e.DeliveryHeader
+	// the processors may change the recipients, the results are of these
+	rcpts := append([]mail.Address(nil), e.RcptTo...)
+	for attempt := 0; ; attempt++ {
+		if e.Values != nil {
+			delete(e.Values, valueFailedProcessor)
+			delete(e.Values, ValueRcptResults)
+		}
+		status, fail := gw.save(e, chain)
+		if fail != nil {
+			return fail
+		}
+		if status.err == nil {
+			queued := NewResult(response.Canned.SuccessMessageQueued + status.queuedID)
+			// some recipients may have failed
+			if rr, ok := status.result.(RcptResults); ok {
+				return combineRcptResults(queued, rr.RcptResults())
+			}
+			if results := envelopeRcptResults(e, rcpts, queued); results != nil {
+				return combineRcptResults(queued, results)
+			}
+			return queued
+		}
+		if !status.retryable {
+			gw.storeDeadLetter(e, status.err)
+			if code := resultCode(status.result); code >= 400 && code < 600 {
+				// the processor's own reply, eg. a 550 for a policy rejection
+				return status.result
+			}
+			return NewResult(response.Canned.FailBackendTransaction + status.err.Error())
+		}
+		if attempt >= gw.gwConfig.MaxRetries {
+			Log().WithError(status.err).Errorf("could not save email after %d retries", attempt)
+			gw.storeDeadLetter(e, status.err)
+			if code := resultCode(status.result); code >= 400 && code < 500 {
+				return status.result
+			}
+			return NewResult(response.Canned.ErrorBackendTransaction + status.err.Error())
+		}
+		delay := gw.retryDelay(attempt)
+		Log().WithError(status.err).Warnf("transient error while saving email, retry %d in %s", attempt+1, delay)
+		select {
+		case <-time.After(delay):
+		case <-gw.abort:
+			return NewResult(response.Canned.FailBackendTimeout)
+		}
+		e.DeliveryHeader = deliveryHeader
+		e.RcptTo = append(e.RcptTo[:0], rcpts...)
+	}
+}
+
+// storeDeadLetter gives a message that could not be saved to the dead letter sink
+func (gw *BackendGateway) storeDeadLetter(e *mail.Envelope, err error) {
+	gw.deadLetterGuard.Lock()
+	sink := gw.deadLetter
+	gw.deadLetterGuard.Unlock()
+	if sink == nil {
+		return
+	}
+	processor, _ := e.Values[valueFailedProcessor].(string)
+	if storeErr := sink.Store(e, processor, err); storeErr != nil {
+		Log().WithError(storeErr).WithField("queued_id", e.QueuedId).Error("could not store the dead letter")
+		return
+	}
+	Log().WithField("queued_id", e.QueuedId).WithField("processor", processor).Info("stored the dead letter")
+}
+
+// SetDeadLetterSink sets where the messages that could not be saved go, replacing the dead_letter_dir
+func (gw *BackendGateway) SetDeadLetterSink(sink DeadLetterSink) {
+	gw.deadLetterGuard.Lock()
+	defer gw.deadLetterGuard.Unlock()
+	gw.deadLetter = sink
+}
+
+// save gives the envelope to one of the workers and waits for the outcome. The Result is
+// not nil if the save could not be completed, eg. it timed out
+func (gw *BackendGateway) save(e *mail.Envelope, chain string) (*notifyMsg, Result) {
 	// borrow a workerMsg from the pool
 	workerMsg := workerMsgPool.Get().(*workerMsg)
 	workerMsg.reset(e, TaskSaveMail)
+	workerMsg.chain = chain
+	if hw := gw.gwConfig.QueueHighWater; hw > 0 && atomic.LoadInt64(&gw.queued) >= int64(hw) {
+		workerMsgPool.Put(workerMsg)
+		Log().Warnf("Backend is busy, %d messages are waiting for a worker", hw)
+		return nil, NewResult(response.Canned.ErrorBackendBusy)
+	}
 	// place on the channel so that one of the save mail workers can pick it up
-	gw.conveyor <- workerMsg
+	atomic.AddInt64(&gw.queued, 1)
+	select {
+	case gw.conveyor <- workerMsg:
+	case <-gw.abort:
+		atomic.AddInt64(&gw.queued, -1)
+		return nil, NewResult(response.Canned.FailBackendTimeout)
+	}
 	// wait for the save to complete
 	// or timeout
 	select {
 	case status := <-workerMsg.notifyMe:
-		defer workerMsgPool.Put(workerMsg) // can be recycled since we used the notifyMe channel
-		if status.err != nil {
-			return NewResult(response.Canned.FailBackendTransaction + status.err.Error())
-		}
-		return NewResult(response.Canned.SuccessMessageQueued + status.queuedID)
+		workerMsgPool.Put(workerMsg) // can be recycled since we used the notifyMe channel
+		return status, nil
 
 	case <-time.After(gw.saveTimeout()):
 		Log().Error("Backend has timed out while saving eamil")
-		return NewResult(response.Canned.FailBackendTimeout)
+		return nil, NewResult(response.Canned.FailBackendTimeout)
+
+	case <-gw.abort:
+		Log().Error("Backend was aborted while saving email")
+		return nil, NewResult(response.Canned.FailBackendTimeout)
 	}
 }
 
+// QueueDepth returns how many messages are waiting for a worker
+func (gw *BackendGateway) QueueDepth() int {
+	return int(atomic.LoadInt64(&gw.queued))
+}
+
+// WorkerCount returns how many workers are running, it changes with the load if max_workers is set
+func (gw *BackendGateway) WorkerCount() int {
+	return int(atomic.LoadInt64(&gw.workers))
+}
+
 // ValidateRcpt asks one of the workers to validate the recipient
 // Only the last recipient appended to e.RcptTo will be validated.
 func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
+	gw.inFlight.RLock()
+	defer gw.inFlight.RUnlock()
 	if gw.State != BackendStateRunning {
 		return StorageNotAvailable
 	}
@@ -164,7 +397,11 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 	// place on the channel so that one of the save mail workers can pick it up
 	workerMsg := workerMsgPool.Get().(*workerMsg)
 	workerMsg.reset(e, TaskValidateRcpt)
-	gw.conveyor <- workerMsg
+	select {
+	case gw.conveyor <- workerMsg:
+	case <-gw.abort:
+		return StorageTimeout
+	}
 	// wait for the validation to complete
 	// or timeout
 	select {
@@ -177,20 +414,30 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 	case <-time.After(gw.validateRcptTimeout()):
 		Log().Error("Backend has timed out while validating rcpt")
 		return StorageTimeout
+
+	case <-gw.abort:
+		return StorageTimeout
 	}
 }
 
 // Shutdown shuts down the backend and leaves it in BackendStateShuttered state
+// Tasks that are in-flight will be completed before the workers are stopped
 func (gw *BackendGateway) Shutdown() error {
 	gw.Lock()
 	defer gw.Unlock()
 	if gw.State != BackendStateShuttered {
-		// send a signal to all workers
+		// wait for in-flight tasks to complete
+		gw.inFlight.Lock()
+		defer gw.inFlight.Unlock()
+		// no more workers are started, then send a signal to all workers
+		gw.stopScaling()
 		gw.stopWorkers()
-		// wait for workers to stop
-		gw.wg.Wait()
+		// wait for workers to stop, unless aborted since they may be stuck
+		if !gw.aborted() {
+			gw.wg.Wait()
+		}
 		// call shutdown on all processor shutdowners
-		if err := Svc.shutdown(); err != nil {
+		if err := gw.shutdownProcessors(); err != nil {
 			return err
 		}
 		gw.State = BackendStateShuttered
@@ -198,6 +445,66 @@ func (gw *BackendGateway) Shutdown() error {
 	return nil
 }
 
+// Abort cancels the tasks that are waiting for the workers, they fail with a timeout.
+// Used when shutting down takes too long, Shutdown then doesn't wait for the workers
+func (gw *BackendGateway) Abort() {
+	gw.abortGuard.Lock()
+	defer gw.abortGuard.Unlock()
+	if gw.abort != nil && !gw.aborted() {
+		close(gw.abort)
+	}
+}
+
+// Ping returns an error if the gateway is not running, or if any of its processors is unhealthy,
+// eg. lost the connection to its database
+func (gw *BackendGateway) Ping() error {
+	gw.Lock()
+	state := gw.State
+	pingers := gw.pingers
+	gw.Unlock()
+	if state != BackendStateRunning {
+		return fmt.Errorf("backend is in %s", state)
+	}
+	var errors Errors
+	for i := range pingers {
+		if err := pingers[i].Ping(); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if len(errors) > 0 {
+		return errors
+	}
+	return nil
+}
+
+// aborted returns true if Abort was called since the gateway was started
+func (gw *BackendGateway) aborted() bool {
+	select {
+	case <-gw.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownProcessors calls the shutdowners of the gateway's processors
+// Only the shutdowners that failed are kept, so that it can be called again to retry
+func (gw *BackendGateway) shutdownProcessors() error {
+	var errors Errors
+	failed := make([]processorShutdowner, 0)
+	for i := range gw.shutdowners {
+		if err := gw.shutdowners[i].Shutdown(); err != nil {
+			errors = append(errors, err)
+			failed = append(failed, gw.shutdowners[i])
+		}
+	}
+	gw.shutdowners = failed
+	if len(errors) > 0 {
+		return errors
+	}
+	return nil
+}
+
 // Reinitialize initializes the gateway with the existing config after it was shutdown
 func (gw *BackendGateway) Reinitialize() error {
 	if gw.State != BackendStateShuttered {
@@ -230,7 +537,7 @@ func (gw *BackendGateway) newStack(stackConfig string) (Processor, error) {
 	for i := range items {
 		name := items[len(items)-1-i] // reverse order, since decorators are stacked
 		if makeFunc, ok := processors[name]; ok {
-			decorators = append(decorators, makeFunc())
+			decorators = append(decorators, namedDecorator(name, makeFunc()))
 		} else {
 			ErrProcessorNotFound = errors.New(fmt.Sprintf("processor [%s] not found", name))
 			return nil, ErrProcessorNotFound
@@ -252,6 +559,26 @@ func (gw *BackendGateway) loadConfig(cfg BackendConfig) error {
 		return err
 	}
 	gw.gwConfig = bcfg.(*GatewayConfig)
+	// not strings, ints or bools
+	if err := configValue(cfg, "save_chains", &gw.gwConfig.SaveChains); err != nil {
+		return err
+	}
+	if err := configValue(cfg, "gw_routes", &gw.gwConfig.Routes); err != nil {
+		return err
+	}
+	if err := checkChains(gw.gwConfig.SaveChains); err != nil {
+		return err
+	}
+	if gw.gwConfig.BounceRelay != "" {
+		if _, _, err := net.SplitHostPort(gw.gwConfig.BounceRelay); err != nil {
+			return errors.New("invalid gw_bounce_relay: " + err.Error())
+		}
+		if gw.gwConfig.BounceHostname == "" {
+			if gw.gwConfig.BounceHostname, err = os.Hostname(); err != nil {
+				return errors.New("gw_bounce_hostname not set, and the hostname is not available: " + err.Error())
+			}
+		}
+	}
 	return nil
 }
 
@@ -267,26 +594,34 @@ func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 		gw.State = BackendStateError
 		return err
 	}
+	if gw.gwConfig.DeadLetterDir != "" {
+		sink, err := NewDeadLetterDir(gw.gwConfig.DeadLetterDir)
+		if err != nil {
+			gw.State = BackendStateError
+			return err
+		}
+		gw.SetDeadLetterSink(sink)
+	}
 	workersSize := gw.workersSize()
 	if workersSize < 1 {
 		gw.State = BackendStateError
 		return errors.New("Must have at least 1 worker")
 	}
-	gw.processors = make([]Processor, 0)
+	if gw.routes, err = newRoutes(gw.gwConfig.Routes, gw.gwConfig.SaveChains); err != nil {
+		gw.State = BackendStateError
+		return err
+	}
+	gw.processors = make([]map[string]Processor, 0)
 	gw.validators = make([]Processor, 0)
+	stacksGuard.Lock()
+	defer stacksGuard.Unlock()
 	for i := 0; i < workersSize; i++ {
-		p, err := gw.newStack(gw.gwConfig.SaveProcess)
-		if err != nil {
-			gw.State = BackendStateError
-			return err
-		}
-		gw.processors = append(gw.processors, p)
-
-		v, err := gw.newStack(gw.gwConfig.ValidateProcess)
+		chains, v, err := gw.newWorkerStacks()
 		if err != nil {
 			gw.State = BackendStateError
 			return err
 		}
+		gw.processors = append(gw.processors, chains)
 		gw.validators = append(gw.validators, v)
 	}
 	// initialize processors
@@ -294,9 +629,13 @@ func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 		gw.State = BackendStateError
 		return err
 	}
+	gw.shutdowners = Svc.takeShutdowners()
+	gw.pingers = Svc.takePingers()
 	if gw.conveyor == nil {
 		gw.conveyor = make(chan *workerMsg, workersSize)
 	}
+	// the scaler initializes the processors of the workers that it starts with it
+	gw.config = cfg
 	// ready to start
 	gw.State = BackendStateInitialized
 	return nil
@@ -311,29 +650,24 @@ func (gw *BackendGateway) Start() error {
 		workersSize := gw.workersSize()
 		// make our slice of channels for stopping
 		gw.workStoppers = make([]chan bool, 0)
+		gw.abortGuard.Lock()
+		gw.abort = make(chan struct{})
+		gw.abortGuard.Unlock()
 		// set the wait group
 		gw.wg.Add(workersSize)
 
 		for i := 0; i < workersSize; i++ {
 			stop := make(chan bool)
-			go func(workerId int, stop chan bool) {
-				// blocks here until the worker exits
-				for {
-					state := gw.workDispatcher(
-						gw.conveyor,
-						gw.processors[workerId],
-						gw.validators[workerId],
-						workerId+1,
-						stop)
-					// keep running after panic
-					if state != dispatcherStatePanic {
-						break
-					}
-				}
-				gw.wg.Done()
-			}(i, stop)
+			atomic.AddInt64(&gw.workers, 1)
+			go gw.runWorker(gw.processors[i], gw.validators[i], i+1, stop, 0, nil)
 			gw.workStoppers = append(gw.workStoppers, stop)
 		}
+		if gw.gwConfig.MaxWorkers > workersSize {
+			gw.scaled = make(map[*scaledWorker]bool)
+			gw.stopScaler = make(chan struct{})
+			gw.scalerDone = make(chan struct{})
+			go gw.scale(workersSize, gw.stopScaler, gw.scalerDone)
+		}
 		gw.State = BackendStateRunning
 		return nil
 	} else {
@@ -341,15 +675,174 @@ func (gw *BackendGateway) Start() error {
 	}
 }
 
-// workersSize gets the number of workers to use for saving email by reading the save_workers_size config value
-// Returns 1 if no config value was set
+// runWorker runs a worker until it stops, it keeps running after a panic. If idle is not 0,
+// retire is called after the worker was idle for that long, the worker stops if it returns true
+func (gw *BackendGateway) runWorker(
+	save map[string]Processor,
+	validate Processor,
+	workerId int,
+	stop chan bool,
+	idle time.Duration,
+	retire func() bool) {
+
+	// blocks here until the worker exits
+	for {
+		state := gw.workDispatcher(gw.conveyor, save, validate, workerId, stop, idle, retire)
+		// keep running after panic
+		if state != dispatcherStatePanic {
+			break
+		}
+	}
+	atomic.AddInt64(&gw.workers, -1)
+	gw.wg.Done()
+}
+
+// newWorkerStacks builds the processors of a worker, its save chains by name and its validator.
+// Called with the stacksGuard held, the processors are then initialized by Svc.initialize
+func (gw *BackendGateway) newWorkerStacks() (map[string]Processor, Processor, error) {
+	chains := make(map[string]Processor, len(gw.gwConfig.SaveChains)+1)
+	p, err := gw.newStack(gw.gwConfig.SaveProcess)
+	if err != nil {
+		return nil, nil, err
+	}
+	chains[DefaultChain] = p
+	for name, stackConfig := range gw.gwConfig.SaveChains {
+		if chains[name], err = gw.newStack(stackConfig); err != nil {
+			return nil, nil, err
+		}
+	}
+	v, err := gw.newStack(gw.gwConfig.ValidateProcess)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chains, v, nil
+}
+
+// scale starts a worker when messages are waiting for one, until max_workers are running.
+// The workers it starts stop after being idle for the worker_cooldown. Returns when stop is closed
+func (gw *BackendGateway) scale(workersSize int, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+	workerId := workersSize
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt64(&gw.queued) == 0 || gw.WorkerCount() >= gw.gwConfig.MaxWorkers {
+				continue
+			}
+			workerId++
+			if err := gw.startScaledWorker(workerId); err != nil {
+				Log().WithError(err).Error("could not start a backend worker")
+			}
+		}
+	}
+}
+
+// startScaledWorker builds & initializes the processors of a new worker, then starts it.
+// Only called by the scaler, which is stopped before the workers are
+func (gw *BackendGateway) startScaledWorker(workerId int) error {
+	stacksGuard.Lock()
+	save, validate, err := gw.newWorkerStacks()
+	if err == nil {
+		if errs := Svc.initialize(gw.config); errs != nil {
+			err = errs
+		}
+	}
+	w := &scaledWorker{stop: make(chan bool), shutdowners: Svc.takeShutdowners()}
+	// the pingers of the other workers are enough
+	Svc.takePingers()
+	if err != nil {
+		// the worker is not started, so don't retry its initializers
+		Svc.reset()
+	}
+	stacksGuard.Unlock()
+	if err != nil {
+		w.shutdown(workerId)
+		return err
+	}
+	gw.scaledGuard.Lock()
+	gw.scaled[w] = true
+	gw.scaledGuard.Unlock()
+	gw.wg.Add(1)
+	atomic.AddInt64(&gw.workers, 1)
+	go func() {
+		gw.runWorker(save, validate, workerId, w.stop, gw.workerCooldown(), func() bool {
+			return gw.retire(w)
+		})
+		w.shutdown(workerId)
+	}()
+	return nil
+}
+
+// retire removes w from the scaled workers so that it can stop. Returns false if w is being
+// stopped by Shutdown, it must wait for its stop signal then
+func (gw *BackendGateway) retire(w *scaledWorker) bool {
+	gw.scaledGuard.Lock()
+	defer gw.scaledGuard.Unlock()
+	if !gw.scaled[w] {
+		return false
+	}
+	delete(gw.scaled, w)
+	return true
+}
+
+// shutdown calls the shutdowners of the worker's processors, eg. to close its database connection
+func (w *scaledWorker) shutdown(workerId int) {
+	for i := range w.shutdowners {
+		if err := w.shutdowners[i].Shutdown(); err != nil {
+			Log().WithError(err).Errorf("could not shut down the processors of worker (#%d)", workerId)
+		}
+	}
+}
+
+// stopScaling stops the scaler, then sends a signal to the workers that it started
+func (gw *BackendGateway) stopScaling() {
+	if gw.stopScaler == nil {
+		return
+	}
+	close(gw.stopScaler)
+	<-gw.scalerDone
+	gw.stopScaler = nil
+	gw.scaledGuard.Lock()
+	workers := gw.scaled
+	gw.scaled = nil
+	gw.scaledGuard.Unlock()
+	for w := range workers {
+		select {
+		case w.stop <- true:
+		case <-gw.abort:
+			// the worker may be stuck, don't wait for it
+		}
+	}
+}
+
+// workersSize gets the number of workers to use for saving email by reading the min_workers or
+// save_workers_size config value. Returns 1 if no config value was set
 func (gw *BackendGateway) workersSize() int {
+	if gw.gwConfig.MinWorkers > 0 {
+		return gw.gwConfig.MinWorkers
+	}
 	if gw.gwConfig.WorkersSize <= 0 {
 		return 1
 	}
 	return gw.gwConfig.WorkersSize
 }
 
+// workerCooldown returns how long a worker over min_workers may be idle before it stops
+func (gw *BackendGateway) workerCooldown() time.Duration {
+	if gw.gwConfig.WorkerCooldown == "" {
+		return workerCooldown
+	}
+	t, err := time.ParseDuration(gw.gwConfig.WorkerCooldown)
+	if err != nil || t <= 0 {
+		return workerCooldown
+	}
+	return t
+}
+
 // saveTimeout returns the maximum amount of seconds to wait before timing out a save processing task
 func (gw *BackendGateway) saveTimeout() time.Duration {
 	if gw.gwConfig.TimeoutSave == "" {
@@ -362,6 +855,41 @@ func (gw *BackendGateway) saveTimeout() time.Duration {
 	return t
 }
 
+// resultCode returns the SMTP code of a processor's result, or 0 if it doesn't start with one
+func resultCode(r Result) int {
+	if r == nil {
+		return 0
+	}
+	s := strings.TrimSpace(r.String())
+	if len(s) < 3 {
+		return 0
+	}
+	if _, err := strconv.Atoi(s[:3]); err != nil {
+		return 0
+	}
+	return r.Code()
+}
+
+// retryDelay returns how long to wait before retrying a save for the nth time, counting from 0
+func (gw *BackendGateway) retryDelay(n int) time.Duration {
+	delay := retryDelay
+	if gw.gwConfig.RetryDelay != "" {
+		if d, err := time.ParseDuration(gw.gwConfig.RetryDelay); err == nil {
+			delay = d
+		}
+	}
+	backoff := retryBackoff
+	if gw.gwConfig.RetryBackoff != "" {
+		if f, err := strconv.ParseFloat(gw.gwConfig.RetryBackoff, 64); err == nil && f >= 1 {
+			backoff = f
+		}
+	}
+	for i := 0; i < n; i++ {
+		delay = time.Duration(float64(delay) * backoff)
+	}
+	return delay
+}
+
 // validateRcptTimeout returns the maximum amount of seconds to wait before timing out a recipient validation  task
 func (gw *BackendGateway) validateRcptTimeout() time.Duration {
 	if gw.gwConfig.TimeoutValidateRcpt == "" {
@@ -386,10 +914,12 @@ const (
 
 func (gw *BackendGateway) workDispatcher(
 	workIn chan *workerMsg,
-	save Processor,
+	save map[string]Processor,
 	validate Processor,
 	workerId int,
-	stop chan bool) (state dispatcherState) {
+	stop chan bool,
+	idle time.Duration,
+	retire func() bool) (state dispatcherState) {
 
 	var msg *workerMsg
 
@@ -402,8 +932,9 @@ func (gw *BackendGateway) workDispatcher(
 			Log().Error("worker recovered from panic:", r, string(debug.Stack()))
 
 			if state == dispatcherStateWorking {
-				msg.notifyMe <- &notifyMsg{err: errors.New("storage failed")}
+				// msg is recycled by the gateway once notified
 				msg.e.Unlock()
+				gw.notify(msg, &notifyMsg{err: errors.New("storage failed")})
 			}
 			state = dispatcherStatePanic
 			return
@@ -415,45 +946,75 @@ func (gw *BackendGateway) workDispatcher(
 	state = dispatcherStateIdle
 	Log().Infof("processing worker started (#%d)", workerId)
 	for {
+		// nil, so never ready, unless the worker stops when idle
+		var idleTimeout <-chan time.Time
+		if idle > 0 {
+			idleTimeout = time.After(idle)
+		}
 		select {
 		case <-stop:
 			state = dispatcherStateStopped
 			Log().Infof("stop signal for worker (#%d)", workerId)
 			return
+		case <-idleTimeout:
+			if retire() {
+				state = dispatcherStateStopped
+				Log().Infof("idle worker stopped (#%d)", workerId)
+				return
+			}
+			continue
 		case msg = <-workIn:
-			msg.e.Lock()
+			if msg.task == TaskSaveMail {
+				atomic.AddInt64(&gw.queued, -1)
+			}
+			// msg is recycled by the gateway once notified, keep the envelope to unlock it
+			e := msg.e
+			e.Lock()
 			state = dispatcherStateWorking
 			if msg.task == TaskSaveMail {
 				// process the email here
-				result, _ := save.Process(msg.e, TaskSaveMail)
+				result, err := save[msg.chain].Process(msg.e, TaskSaveMail)
 				state = dispatcherStateNotify
 				if result.Code() < 300 {
 					// if all good, let the gateway know that it was queued
-					msg.notifyMe <- &notifyMsg{nil, msg.e.QueuedId}
+					gw.notify(msg, &notifyMsg{err: nil, queuedID: msg.e.QueuedId, result: result})
 				} else {
 					// notify the gateway about the error
-					msg.notifyMe <- &notifyMsg{err: errors.New(result.String())}
+					gw.notify(msg, &notifyMsg{err: errors.New(result.String()), retryable: isRetryable(err), result: result})
 				}
 			} else if msg.task == TaskValidateRcpt {
 				_, err := validate.Process(msg.e, TaskValidateRcpt)
 				state = dispatcherStateNotify
 				if err != nil {
 					// validation failed
-					msg.notifyMe <- &notifyMsg{err: err}
+					gw.notify(msg, &notifyMsg{err: err})
 				} else {
 					// all good.
-					msg.notifyMe <- &notifyMsg{err: nil}
+					gw.notify(msg, &notifyMsg{err: nil})
 				}
 			}
-			msg.e.Unlock()
+			e.Unlock()
 		}
 		state = dispatcherStateIdle
 	}
 }
 
+// notify sends the outcome of a task to the gateway, gives up if the gateway was aborted
+// since nobody may be waiting for it
+func (gw *BackendGateway) notify(msg *workerMsg, n *notifyMsg) {
+	select {
+	case msg.notifyMe <- n:
+	case <-gw.abort:
+	}
+}
+
 // stopWorkers sends a signal to all workers to stop
 func (gw *BackendGateway) stopWorkers() {
 	for i := range gw.workStoppers {
-		gw.workStoppers[i] <- true
+		select {
+		case gw.workStoppers[i] <- true:
+		case <-gw.abort:
+			// the worker may be stuck, don't wait for it
+		}
 	}
 }
@@ -1,10 +1,16 @@
 package backends
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -86,7 +92,7 @@ func TestStartProcessStop(t *testing.T) {
 	e.Data.WriteString("Subject:Test\n\nThis is a test.")
 	notify := make(chan *notifyMsg)
 
-	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail}
+	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail, DefaultChain}
 
 	// it should not produce any errors
 	// headers (subject) should be parsed.
@@ -111,3 +117,616 @@ func TestStartProcessStop(t *testing.T) {
 		t.Error("Gateway did not shutdown")
 	}
 }
+
+// flakyProcessor fails with a RetryableError until it was called failures times,
+// or always with a permanent error if retryable is false
+func flakyProcessor(failures int, retryable bool, calls *int) Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				*calls++
+				e.DeliveryHeader += "X-Attempt: " + fmt.Sprint(*calls) + "\n"
+				if !retryable {
+					return NewResult("554 5.3.0 Error: bad data"), errors.New("bad data")
+				}
+				if *calls <= failures {
+					return NewResult("451 4.3.0 Error: deadlock"), NewRetryableError(errors.New("deadlock"))
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+func newRetryGateway(t *testing.T, failures int, retryable bool, calls *int) *BackendGateway {
+	processors["flaky"] = func() Decorator {
+		return flakyProcessor(failures, retryable, calls)
+	}
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":     "flaky",
+		"gw_max_retries":   3,
+		"gw_retry_delay":   "10ms",
+		"gw_retry_backoff": "2",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	return gateway
+}
+
+func TestProcessRetry(t *testing.T) {
+	defer delete(processors, "flaky")
+	calls := 0
+	gateway := newRetryGateway(t, 2, true, &calls)
+	defer gateway.Shutdown()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc12345"
+	start := time.Now()
+	result := gateway.Process(e)
+	if result.Code() != 250 {
+		t.Error("expecting the save to succeed on the third try, got:", result)
+	}
+	if calls != 3 {
+		t.Error("expecting 3 tries, got:", calls)
+	}
+	// 10ms then 20ms
+	if d := time.Since(start); d < time.Millisecond*30 {
+		t.Error("expecting a backoff between the tries, took:", d)
+	}
+	if e.DeliveryHeader != "X-Attempt: 3\n" {
+		t.Error("expecting each try to start with the original header, got:", e.DeliveryHeader)
+	}
+
+	// the retries run out
+	calls = 0
+	gateway.gwConfig.MaxRetries = 1
+	result = gateway.Process(mail.NewEnvelope("127.0.0.1", 1))
+	if result.Code() != 451 {
+		t.Error("expecting a tempfail after the retries, got:", result)
+	}
+	if calls != 2 {
+		t.Error("expecting 2 tries, got:", calls)
+	}
+}
+
+func TestProcessNoRetry(t *testing.T) {
+	defer delete(processors, "flaky")
+	calls := 0
+	gateway := newRetryGateway(t, 0, false, &calls)
+	defer gateway.Shutdown()
+	result := gateway.Process(mail.NewEnvelope("127.0.0.1", 1))
+	if result.Code() != 554 {
+		t.Error("expecting a permanent error to fail, got:", result)
+	}
+	if result.String() != "554 5.3.0 Error: bad data" {
+		t.Error("expecting the reply of the processor, got:", result)
+	}
+	if calls != 1 {
+		t.Error("expecting a permanent error not to be retried, got tries:", calls)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	gateway := &BackendGateway{gwConfig: &GatewayConfig{}}
+	if d := gateway.retryDelay(2); d != time.Second*4 {
+		t.Error("expecting the default delay to double, got:", d)
+	}
+	gateway.gwConfig.RetryDelay = "100ms"
+	gateway.gwConfig.RetryBackoff = "1.5"
+	if d := gateway.retryDelay(2); d != time.Millisecond*225 {
+		t.Error("expecting 225ms, got:", d)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	calls := 0
+	processors["flaky"] = func() Decorator {
+		return flakyProcessor(0, false, &calls)
+	}
+	defer delete(processors, "flaky")
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":    "HeadersParser|flaky",
+		"dead_letter_dir": dir,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer gateway.Shutdown()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc12345"
+	e.MailFrom = mail.Address{User: "alice", Host: "example.com"}
+	e.PushRcpt(mail.Address{User: "bob", Host: "example.org"})
+	e.Data.WriteString("Subject: lost\n\nplease keep me\n")
+	if result := gateway.Process(e); result.Code() != 554 {
+		t.Fatal("expecting the save to fail, got:", result)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 || filepath.Ext(files[0]) != deadLetterExt {
+		t.Fatal("expecting one dead letter, got:", files)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dead deadLetter
+	if err := json.Unmarshal(b, &dead); err != nil {
+		t.Fatal("invalid dead letter:", err)
+	}
+	if dead.Processor != "flaky" || !strings.Contains(dead.Error, "bad data") || dead.FailedAt == 0 {
+		t.Error("expecting the failed processor and its error, got:", dead.Processor, dead.Error, dead.FailedAt)
+	}
+	// it can be replayed
+	replay, err := readSpooled(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.QueuedId != "abc12345" || replay.MailFrom.String() != "alice@example.com" ||
+		len(replay.RcptTo) != 1 || replay.Data.String() != "Subject: lost\n\nplease keep me\n" {
+		t.Error("the dead letter does not have the message, got:", replay)
+	}
+	if _, ok := replay.Values[valueFailedProcessor]; ok {
+		t.Error("the name of the failed processor should not be kept in the values")
+	}
+
+	// the dir must exist
+	Svc.reset()
+	if err := (&BackendGateway{}).Initialize(BackendConfig{
+		"save_process":    "HeadersParser",
+		"dead_letter_dir": filepath.Join(dir, "missing"),
+	}); err == nil {
+		t.Error("expecting an error for a dead_letter_dir that does not exist")
+	}
+}
+
+// deadLetterRecorder is a DeadLetterSink that keeps the queued ids of the messages
+type deadLetterRecorder struct {
+	stored chan string
+}
+
+func (d *deadLetterRecorder) Store(e *mail.Envelope, processor string, err error) error {
+	d.stored <- e.QueuedId
+	return nil
+}
+
+func TestDeadLetterDuringShutdown(t *testing.T) {
+	started := make(chan struct{})
+	processors["slowfail"] = func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if task == TaskSaveMail {
+					close(started)
+					// Shutdown is waiting for the save by now
+					time.Sleep(time.Millisecond * 100)
+					return NewResult("554 5.3.0 Error: bad data"), errors.New("bad data")
+				}
+				return p.Process(e, task)
+			})
+		}
+	}
+	defer delete(processors, "slowfail")
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{"save_process": "slowfail"}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	sink := &deadLetterRecorder{stored: make(chan string, 1)}
+	gateway.SetDeadLetterSink(sink)
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "abc12345"
+	e.PushRcpt(mail.Address{User: "bob", Host: "example.org"})
+	e.Data.WriteString("Subject: lost\n\nplease keep me\n")
+	done := make(chan Result, 1)
+	go func() {
+		done <- gateway.Process(e)
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- gateway.Shutdown()
+	}()
+	select {
+	case result := <-done:
+		if result.Code() != 554 {
+			t.Error("expecting the save to fail, got:", result)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("the dead-lettered save did not return while shutting down")
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error("Shutdown failed:", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Shutdown did not return")
+	}
+	if id := <-sink.stored; id != "abc12345" {
+		t.Error("expecting the dead letter, got:", id)
+	}
+}
+
+// routeRecorder records the recipients that its chain saved, and fails them if full is set
+func routeRecorder(chain string, saved map[string][]string, full bool) Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				for i := range e.RcptTo {
+					saved[chain] = append(saved[chain], e.RcptTo[i].String())
+				}
+				if full {
+					return NewResult("452 4.2.2 Mailbox full"), errors.New("mailbox full")
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+func TestRouteRcpts(t *testing.T) {
+	saved := make(map[string][]string)
+	for _, chain := range []string{"local", "archive", "vip", "other"} {
+		name, chain := "route"+chain, chain
+		processors[name] = func() Decorator {
+			return routeRecorder(chain, saved, chain == "archive")
+		}
+		defer delete(processors, name)
+	}
+	Svc.AddRouteMatcher("VIP", func(e *mail.Envelope, rcpt mail.Address) bool {
+		return rcpt.User == "boss"
+	})
+	defer delete(routeMatchers, "vip")
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	var config BackendConfig
+	if err := json.Unmarshal([]byte(`{
+		"save_process": "routeother",
+		"save_chains": {"local": "routelocal", "archive": "routearchive", "vip": "routevip"},
+		"gw_routes": [
+			{"matcher": "vip", "domains": "example.com", "chain": "vip"},
+			{"domains": "example.com, example.net", "chain": "local"},
+			{"regex": "@archive\\.", "chain": "archive"}
+		]
+	}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(config); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer gateway.Shutdown()
+
+	// all the recipients go to one chain
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "alice", Host: "Example.com"})
+	e.PushRcpt(mail.Address{User: "bob", Host: "example.net"})
+	if result := gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting the message to be saved, got:", result)
+	}
+	if len(saved["local"]) != 2 || len(saved) != 1 {
+		t.Error("expecting the local chain to save the 2 recipients, got:", saved)
+	}
+
+	// each recipient goes to a different chain
+	for chain := range saved {
+		delete(saved, chain)
+	}
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "alice", Host: "example.com"})
+	e.PushRcpt(mail.Address{User: "carol", Host: "archive.example.org"})
+	e.PushRcpt(mail.Address{User: "boss", Host: "example.com"})
+	e.PushRcpt(mail.Address{User: "dave", Host: "example.org"})
+	result := gateway.Process(e)
+	if result.Code() != 452 {
+		t.Error("expecting the failure of the archive chain, got:", result)
+	}
+	expected := map[string]string{
+		"local":   "alice@example.com",
+		"archive": "carol@archive.example.org",
+		"vip":     "boss@example.com",
+		"other":   "dave@example.org",
+	}
+	for chain, rcpt := range expected {
+		if len(saved[chain]) != 1 || saved[chain][0] != rcpt {
+			t.Error("expecting the", chain, "chain to save", rcpt, "got:", saved[chain])
+		}
+	}
+	results := ResultsForRcpts(result, len(e.RcptTo))
+	for i, code := range []int{250, 452, 250, 250} {
+		if results[i].Code() != code {
+			t.Error("expecting", code, "for", e.RcptTo[i].String(), "got:", results[i])
+		}
+	}
+	if len(e.RcptTo) != 4 {
+		t.Error("the recipients of the envelope should not change, got:", e.RcptTo)
+	}
+}
+
+func TestRouteConfig(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	for _, config := range []string{
+		`{"save_chains": {"default": "debugger"}}`,
+		`{"save_chains": {"Local": "debugger"}}`,
+		`{"save_chains": {"local": "nosuchprocessor"}}`,
+		`{"save_chains": "local"}`,
+		`{"gw_routes": [{"domains": "example.com", "chain": "local"}]}`,
+		`{"save_chains": {"local": "debugger"}, "gw_routes": [{"chain": "local"}]}`,
+		`{"save_chains": {"local": "debugger"}, "gw_routes": [{"regex": "(", "chain": "local"}]}`,
+		`{"save_chains": {"local": "debugger"}, "gw_routes": [{"matcher": "nosuchmatcher", "chain": "local"}]}`,
+	} {
+		var cfg BackendConfig
+		if err := json.Unmarshal([]byte(config), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		cfg["log_received_mails"] = false
+		Svc.reset()
+		if err := (&BackendGateway{}).Initialize(cfg); err == nil {
+			t.Error("expecting the config to fail:", config)
+		}
+	}
+}
+
+// slowProcessor saves once release is closed
+func slowProcessor(release chan struct{}) Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				<-release
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+func TestQueueHighWater(t *testing.T) {
+	release := make(chan struct{})
+	processors["slow"] = func() Decorator {
+		return slowProcessor(release)
+	}
+	defer delete(processors, "slow")
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "slow",
+		"save_workers_size": 1,
+		"queue_high_water":  1,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer gateway.Shutdown()
+
+	results := make(chan Result, 3)
+	process := func() {
+		results <- gateway.Process(mail.NewEnvelope("127.0.0.1", 1))
+	}
+	// the worker is busy with the first, the second waits
+	go process()
+	go process()
+	for start := time.Now(); gateway.QueueDepth() != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expecting a message to wait for the worker, got:", gateway.QueueDepth())
+		}
+	}
+	go process()
+	select {
+	case result := <-results:
+		if result.Code() != 451 || !strings.Contains(result.String(), "4.3.2") {
+			t.Error("expecting a 451 when the queue is full, got:", result)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("expecting a 451 instead of waiting for the worker")
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if result := <-results; result.Code() != 250 {
+			t.Error("expecting the waiting messages to be saved, got:", result)
+		}
+	}
+	if depth := gateway.QueueDepth(); depth != 0 {
+		t.Error("expecting no messages to wait, got:", depth)
+	}
+}
+
+// workerResources counts the initializers & shutdowners of its processors, like a processor
+// that opens a database connection for each worker
+func workerResources(inits, shutdowns *int64) Decorator {
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		atomic.AddInt64(inits, 1)
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		atomic.AddInt64(shutdowns, 1)
+		return nil
+	}))
+	return func(p Processor) Processor {
+		return p
+	}
+}
+
+func TestScaleWorkers(t *testing.T) {
+	release := make(chan struct{})
+	var inits, shutdowns int64
+	processors["slow"] = func() Decorator {
+		return slowProcessor(release)
+	}
+	processors["resources"] = func() Decorator {
+		return workerResources(&inits, &shutdowns)
+	}
+	defer delete(processors, "slow")
+	defer delete(processors, "resources")
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":    "resources|slow",
+		"min_workers":     1,
+		"max_workers":     3,
+		"worker_cooldown": "100ms",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	if count := gateway.WorkerCount(); count != 1 {
+		t.Error("expecting to start with 1 worker, got:", count)
+	}
+
+	// a burst, the messages wait for the workers
+	results := make(chan Result, 6)
+	for i := 0; i < 6; i++ {
+		go func() {
+			results <- gateway.Process(mail.NewEnvelope("127.0.0.1", 1))
+		}()
+	}
+	for start := time.Now(); gateway.WorkerCount() != 3; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expecting the pool to grow to 3 workers, got:", gateway.WorkerCount())
+		}
+	}
+	// no more than max_workers
+	time.Sleep(scaleInterval * 3)
+	if count := gateway.WorkerCount(); count != 3 {
+		t.Error("expecting the pool to stop growing at 3 workers, got:", count)
+	}
+	if n := atomic.LoadInt64(&inits); n != 3 {
+		t.Error("expecting the processors of each worker to be initialized, got:", n)
+	}
+	close(release)
+	for i := 0; i < 6; i++ {
+		if result := <-results; result.Code() != 250 {
+			t.Error("expecting the burst to be saved, got:", result)
+		}
+	}
+
+	// the idle workers are retired after the cooldown
+	for start := time.Now(); gateway.WorkerCount() != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expecting the pool to shrink to 1 worker, got:", gateway.WorkerCount())
+		}
+	}
+	for start := time.Now(); atomic.LoadInt64(&shutdowns) != 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expecting the processors of the retired workers to shut down, got:", atomic.LoadInt64(&shutdowns))
+		}
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shut down because:", err)
+	}
+	if n := atomic.LoadInt64(&shutdowns); n != 3 {
+		t.Error("expecting the processors of all the workers to shut down, got:", n)
+	}
+	if count := gateway.WorkerCount(); count != 0 {
+		t.Error("expecting no workers after shutdown, got:", count)
+	}
+}
+
+// rcptFailer fails the recipients that start with "bad" with SetRcptResult
+func rcptFailer() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				for _, rcpt := range e.RcptTo {
+					if strings.HasPrefix(rcpt.User, "bad") {
+						SetRcptResult(e, rcpt, NewResult("550 5.1.1 No such user"))
+					}
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+func TestRcptResults(t *testing.T) {
+	processors["rcptfailer"] = rcptFailer
+	defer delete(processors, "rcptfailer")
+	path := writeRewriteRules(t, rewriteRules+"list@example.com bad1@example.com, bad2@example.com\n")
+	defer os.Remove(path)
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	Svc.reset()
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process": "rewrite|rcptfailer",
+		"rewrite_file": path,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer gateway.Shutdown()
+
+	newEnvelope := func(rcpts ...string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		for _, rcpt := range rcpts {
+			a, _ := mail.NewAddress(rcpt)
+			e.PushRcpt(a)
+		}
+		return e
+	}
+	// the team is delivered if one of its targets is, the list is not
+	e := newEnvelope("alice@example.org", "bad@example.org", "list@example.com", "team@example.com", "a@loop.test")
+	rcpts := append([]mail.Address(nil), e.RcptTo...)
+	result := gateway.Process(e)
+	if result.Code() != 250 {
+		t.Error("expecting the message to be accepted, got:", result)
+	}
+	if _, ok := result.(RcptResults); !ok {
+		t.Fatal("expecting the result of each recipient")
+	}
+	results := ResultsForRcpts(result, len(rcpts))
+	for i, code := range []int{250, 550, 550, 250, 554} {
+		if results[i].Code() != code {
+			t.Error("expecting", code, "for", rcpts[i].String(), "got:", results[i])
+		}
+	}
+
+	// none of them was delivered
+	e = newEnvelope("bad@example.org", "list@example.com")
+	if result = gateway.Process(e); result.Code() != 550 {
+		t.Error("expecting the message to be rejected, got:", result)
+	}
+	// the processors that don't set any keep a single result
+	e = newEnvelope("alice@example.org", "bob@example.org")
+	if result = gateway.Process(e); result.Code() != 250 {
+		t.Error("expecting the message to be accepted, got:", result)
+	} else if _, ok := result.(RcptResults); ok {
+		t.Error("expecting a single result, got:", result)
+	}
+}
@@ -0,0 +1,100 @@
+//go:build grpc
+// +build grpc
+
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// the connection of the grpc processor, only built with -tags grpc
+func init() {
+	newGRPCConn = dialGRPC
+}
+
+// grpcRawCodec sends the messages as they were encoded by the processor, in place of the
+// generated code
+type grpcRawCodec struct{}
+
+func (grpcRawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (grpcRawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (grpcRawCodec) Name() string {
+	return "proto"
+}
+
+// grpcClientConn is a grpcConn on grpc-go
+type grpcClientConn struct {
+	conn *grpc.ClientConn
+}
+
+func dialGRPC(target string, tlsConfig *tls.Config) (grpcConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	// connecting does not wait for the service, it is dialed when needed
+	conn, err := grpc.Dial(target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcRawCodec{})))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClientConn{conn: conn}, nil
+}
+
+func (c *grpcClientConn) Call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	var reply []byte
+	if err := c.conn.Invoke(ctx, method, &req, &reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *grpcClientConn) Stream(ctx context.Context, method string, next func() ([]byte, error)) ([]byte, error) {
+	// cancelled to release the stream if it is not received to the end
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true}, method)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		req, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err := stream.SendMsg(&req); err == io.EOF {
+			// the service ended the stream, its status is returned by RecvMsg
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	var reply []byte
+	if err := stream.RecvMsg(&reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *grpcClientConn) Close() error {
+	return c.conn.Close()
+}
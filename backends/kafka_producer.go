@@ -0,0 +1,78 @@
+//go:build kafka
+// +build kafka
+
+package backends
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// the producer of the kafka processor, librdkafka needs cgo so it is only built with -tags kafka
+func init() {
+	newKafkaProducer = newRdKafkaProducer
+}
+
+// rdKafkaProducer is a kafkaProducer on librdkafka
+type rdKafkaProducer struct {
+	p       *kafka.Producer
+	timeout time.Duration
+}
+
+func newRdKafkaProducer(brokers []string, clientID string, timeout time.Duration) (kafkaProducer, error) {
+	p, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers": strings.Join(brokers, ","),
+		"client.id":         clientID,
+		// the retries don't duplicate or reorder the records, it implies acks=all
+		"enable.idempotence": true,
+		// the delivery report fails after this
+		"message.timeout.ms": int(timeout / time.Millisecond),
+		// the same partition for a key as the Java clients
+		"partitioner": "murmur2_random",
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the errors that aren't about a record, eg. the brokers can't be reached
+	go func() {
+		for ev := range p.Events() {
+			if err, ok := ev.(kafka.Error); ok {
+				Log().WithError(err).Warn("kafka producer error")
+			}
+		}
+	}()
+	return &rdKafkaProducer{p: p, timeout: timeout}, nil
+}
+
+func (r *rdKafkaProducer) Produce(topic string, key, value []byte, headers map[string]string) error {
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            key,
+		Value:          value,
+	}
+	for k, v := range headers {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	report := make(chan kafka.Event, 1)
+	if err := r.p.Produce(msg, report); err != nil {
+		return err
+	}
+	switch ev := (<-report).(type) {
+	case *kafka.Message:
+		return ev.TopicPartition.Error
+	case kafka.Error:
+		return ev
+	default:
+		return errors.New("unexpected kafka delivery report: " + ev.String())
+	}
+}
+
+func (r *rdKafkaProducer) Close() {
+	if n := r.p.Flush(int(r.timeout / time.Millisecond)); n > 0 {
+		Log().Warnf("kafka producer closed with %d records not delivered", n)
+	}
+	r.p.Close()
+}
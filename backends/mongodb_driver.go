@@ -0,0 +1,112 @@
+//go:build mongodb
+// +build mongodb
+
+package backends
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// the database of the mongodb processor, only built with -tags mongodb
+func init() {
+	newMongoDatabase = connectMongoDB
+}
+
+// mongoDriverDatabase is a mongoDatabase on the official driver
+type mongoDriverDatabase struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+func connectMongoDB(uri, database string, wc *mongoWriteConcern, timeout time.Duration) (mongoDatabase, error) {
+	opts := []writeconcern.Option{writeconcern.J(wc.Journal)}
+	if n, err := strconv.Atoi(wc.W); err == nil {
+		opts = append(opts, writeconcern.W(n))
+	} else {
+		opts = append(opts, writeconcern.WMajority())
+	}
+	clientOptions := options.Client().ApplyURI(uri).
+		SetConnectTimeout(timeout).
+		SetServerSelectionTimeout(timeout).
+		SetWriteConcern(writeconcern.New(opts...))
+	if err := clientOptions.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// connecting does not wait for the servers, they are dialed when needed
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &mongoDriverDatabase{client: client, db: client.Database(database)}, nil
+}
+
+func (m *mongoDriverDatabase) Insert(ctx context.Context, collection string, doc *mongoDocument) error {
+	_, err := m.db.Collection(collection).InsertOne(ctx, doc)
+	return err
+}
+
+func (m *mongoDriverDatabase) bucket(name string) (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(m.db, options.GridFSBucket().SetName(name))
+}
+
+func (m *mongoDriverDatabase) Upload(ctx context.Context, bucket, id, filename string, data []byte) error {
+	b, err := m.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		b.SetWriteDeadline(deadline)
+	}
+	return b.UploadFromStreamWithID(id, filename, bytes.NewReader(data))
+}
+
+func (m *mongoDriverDatabase) Delete(ctx context.Context, bucket, id string) error {
+	b, err := m.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.DeleteContext(ctx, id)
+}
+
+// the code of the error when the index exists with other options
+const mongoIndexOptionsConflict = 85
+
+func (m *mongoDriverDatabase) EnsureTTLIndex(ctx context.Context, collection, field string, ttl time.Duration) error {
+	seconds := int32(ttl / time.Second)
+	_, err := m.db.Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(seconds),
+	})
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == mongoIndexOptionsConflict {
+		// the ttl was changed, the index is updated
+		return m.db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collection},
+			{Key: "index", Value: bson.D{
+				{Key: "keyPattern", Value: bson.D{{Key: field, Value: 1}}},
+				{Key: "expireAfterSeconds", Value: seconds},
+			}},
+		}).Err()
+	}
+	return err
+}
+
+func (m *mongoDriverDatabase) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
+
+func (m *mongoDriverDatabase) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	return m.client.Disconnect(ctx)
+}
@@ -0,0 +1,197 @@
+package backends
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ValueAuthLogin is the e.Values key that the server sets to the login of the client,
+// when the client was authenticated, eg. by a proxy with XCLIENT LOGIN=
+const ValueAuthLogin = "auth_login"
+
+// ValueAbuseToken is the e.Values key set to the signed token of the message by the abusereport processor
+const ValueAbuseToken = "abuse_token"
+
+const (
+	// default name of the header, if 'abuse_header_name' not present in config
+	abuseHeaderName = "X-Report-Abuse"
+	// default value of the header, if 'abuse_header_format' not present in config
+	abuseHeaderFormat = "Please forward this message to our abuse desk, id={token}"
+	// the placeholder in 'abuse_header_format' replaced with the token
+	abuseTokenPlaceholder = "{token}"
+	// length of the signature in the token, in hex
+	abuseSignatureLen = 32
+)
+
+var errAbuseTokenInvalid = errors.New("invalid abuse token")
+
+type AbuseReportConfig struct {
+	// AbuseSecret is the key used to sign the tokens
+	AbuseSecret string `json:"abuse_secret"`
+	// AbuseHeaderName is the name of the header, eg. "X-Report-Abuse" (default) or "Feedback-ID"
+	AbuseHeaderName string `json:"abuse_header_name,omitempty"`
+	// AbuseHeaderFormat is the value of the header, {token} is replaced with the token
+	AbuseHeaderFormat string `json:"abuse_header_format,omitempty"`
+	// AbuseLogFile is a file where the submission of each token is recorded, one JSON object per line
+	AbuseLogFile string `json:"abuse_log_file,omitempty"`
+}
+
+// abuseRecord is what is recorded about a submission, to trace it from its token
+type abuseRecord struct {
+	Token    string   `json:"token"`
+	QueuedId string   `json:"queued_id"`
+	Time     int64    `json:"time"`
+	RemoteIP string   `json:"remote_ip"`
+	Helo     string   `json:"helo"`
+	Login    string   `json:"login,omitempty"`
+	MailFrom string   `json:"mail_from"`
+	RcptTo   []string `json:"rcpt_to"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: abusereport
+// ----------------------------------------------------------------------------------
+// Description   : Adds a header with a signed token to each message, so that when a
+//               : recipient reports abuse, the message can be traced back to its
+//               : submission & the authenticated user. The token is
+//               : <queued id>.<unix time>.<signature>, see VerifyAbuseToken.
+//               : Each submission is logged with its token
+// ----------------------------------------------------------------------------------
+// Config Options: abuse_secret string - key to sign the tokens with
+//               : abuse_header_name string - name of the header, default "X-Report-Abuse"
+//               : abuse_header_format string - value of the header, {token} is replaced
+//               : with the token
+//               : abuse_log_file string - where to record the submissions, as JSON lines.
+//               : Optional, the main log is used too
+// --------------:-------------------------------------------------------------------
+// Input         : e.QueuedId, e.RemoteIP, e.Helo, e.MailFrom, e.RcptTo
+//               : e.Values[ValueAuthLogin]
+// ----------------------------------------------------------------------------------
+// Output        : e.Values[ValueAbuseToken] is set, and the header is appended to
+//               : e.DeliveryHeader (place after the header processor)
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["abusereport"] = func() Decorator {
+		return AbuseReport()
+	}
+}
+
+func AbuseReport() Decorator {
+
+	var (
+		config  *AbuseReportConfig
+		logFile *os.File
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&AbuseReportConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*AbuseReportConfig)
+		if config.AbuseSecret == "" {
+			return errors.New("abuse_secret cannot be empty")
+		}
+		if config.AbuseHeaderName == "" {
+			config.AbuseHeaderName = abuseHeaderName
+		}
+		if config.AbuseHeaderFormat == "" {
+			config.AbuseHeaderFormat = abuseHeaderFormat
+		}
+		if !strings.Contains(config.AbuseHeaderFormat, abuseTokenPlaceholder) {
+			return errors.New("abuse_header_format must have a " + abuseTokenPlaceholder)
+		}
+		if config.AbuseLogFile != "" {
+			// each line is written at once, so the workers can share the file
+			if logFile, err = os.OpenFile(config.AbuseLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if logFile != nil {
+			return logFile.Close()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				now := time.Now()
+				token := signAbuseToken(config.AbuseSecret, e.QueuedId, now)
+				e.Values[ValueAbuseToken] = token
+				e.DeliveryHeader += config.AbuseHeaderName + ": " +
+					strings.Replace(config.AbuseHeaderFormat, abuseTokenPlaceholder, token, -1) + "\n"
+				record := abuseRecord{
+					Token:    token,
+					QueuedId: e.QueuedId,
+					Time:     now.Unix(),
+					RemoteIP: e.RemoteIP,
+					Helo:     e.Helo,
+					MailFrom: e.MailFrom.String(),
+				}
+				record.Login, _ = e.Values[ValueAuthLogin].(string)
+				for i := range e.RcptTo {
+					record.RcptTo = append(record.RcptTo, e.RcptTo[i].String())
+				}
+				Log().WithField("token", token).WithField("queued_id", e.QueuedId).
+					WithField("ip", e.RemoteIP).WithField("login", record.Login).Info("abuse token added")
+				if logFile != nil {
+					if b, err := json.Marshal(&record); err == nil {
+						if _, err := logFile.Write(append(b, '\n')); err != nil {
+							Log().WithError(err).Error("could not record the abuse token")
+						}
+					}
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// abuseSignature signs the payload of a token
+func abuseSignature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))[:abuseSignatureLen]
+}
+
+// signAbuseToken returns the token of a message queued as queuedID at t
+func signAbuseToken(secret, queuedID string, t time.Time) string {
+	payload := queuedID + "." + strconv.FormatInt(t.Unix(), 10)
+	return payload + "." + abuseSignature(secret, payload)
+}
+
+// VerifyAbuseToken checks the signature of a token added by the abusereport processor,
+// and returns the queued id and the time of the message
+func VerifyAbuseToken(secret, token string) (string, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", time.Time{}, errAbuseTokenInvalid
+	}
+	expected := abuseSignature(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(parts[2]))) {
+		return "", time.Time{}, errAbuseTokenInvalid
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, errAbuseTokenInvalid
+	}
+	return parts[0], time.Unix(unix, 0), nil
+}
@@ -0,0 +1,88 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestAbuseReport(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+	p := newTestProcessor(t, BackendConfig{
+		"abuse_secret":   "s3cret",
+		"abuse_log_file": logFile.Name(),
+	}, AbuseReport)
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.Helo = "client.example.com"
+	e.MailFrom, _ = mail.NewAddress("alice@example.com")
+	e.RcptTo = []mail.Address{{User: "bob", Host: "example.org"}}
+	e.Values[ValueAuthLogin] = "alice"
+	e.Data.WriteString("Subject: hi\n\nhello\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("abusereport failed:", err)
+	}
+	Svc.shutdown()
+
+	token, _ := e.Values[ValueAbuseToken].(string)
+	expected := "X-Report-Abuse: Please forward this message to our abuse desk, id=" + token + "\n"
+	if token == "" || e.DeliveryHeader != expected {
+		t.Fatal("expecting the header with the token, got:", e.DeliveryHeader)
+	}
+	queuedID, when, err := VerifyAbuseToken("s3cret", token)
+	if err != nil || queuedID != e.QueuedId || time.Since(when) > time.Minute {
+		t.Error("expecting the token to be verified, got:", queuedID, when, err)
+	}
+	if _, _, err := VerifyAbuseToken("other", token); err == nil {
+		t.Error("expecting the token to fail with another secret")
+	}
+	forged := strings.Replace(token, e.QueuedId, "0123456789abcdef", 1)
+	if _, _, err := VerifyAbuseToken("s3cret", forged); err == nil {
+		t.Error("expecting a forged token to fail")
+	}
+
+	// the submission was recorded
+	b, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record abuseRecord
+	if err := json.Unmarshal(b, &record); err != nil {
+		t.Fatal("could not read the record:", err, string(b))
+	}
+	if record.Token != token || record.Login != "alice" || record.RemoteIP != "203.0.113.5" ||
+		record.MailFrom != "alice@example.com" || len(record.RcptTo) != 1 || record.RcptTo[0] != "bob@example.org" {
+		t.Error("the record does not match the submission:", string(b))
+	}
+}
+
+func TestAbuseReportConfig(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{
+		"abuse_secret":        "s3cret",
+		"abuse_header_name":   "Feedback-ID",
+		"abuse_header_format": "{token}:newsletter",
+	}, AbuseReport)
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	p.Process(e, TaskSaveMail)
+	if e.DeliveryHeader != "Feedback-ID: "+e.Values[ValueAbuseToken].(string)+":newsletter\n" {
+		t.Error("expecting the header to be formatted, got:", e.DeliveryHeader)
+	}
+
+	for _, c := range []BackendConfig{
+		{},
+		{"abuse_secret": "s3cret", "abuse_header_format": "no token"},
+	} {
+		if _, errs := initTestProcessor(c, AbuseReport); errs == nil {
+			t.Error("expecting an error for", c)
+		}
+	}
+}
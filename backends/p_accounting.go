@@ -0,0 +1,370 @@
+package backends
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const (
+	accountingSinkFile  = "file"
+	accountingSinkMySQL = "mysql"
+
+	accountingTenantSender = "sender_domain"
+	accountingTenantRcpt   = "rcpt_domain"
+	accountingTenantAuth   = "auth_user"
+
+	// default fields of the records, if 'accounting_fields' not present in config
+	accountingFields = "tenant,messages,bytes,recipients,time"
+	// default table, if 'accounting_table' not present in config
+	accountingTable = "accounting"
+	// defaults for 'accounting_batch' & 'accounting_flush_interval'
+	accountingBatch         = 100
+	accountingFlushInterval = 10
+	// the most records kept while the sink is failing, the oldest are dropped after that
+	accountingMaxPending = 100000
+)
+
+// accountingFieldNames are the fields a record may have
+var accountingFieldNames = map[string]bool{
+	"tenant": true, "messages": true, "bytes": true, "recipients": true, "time": true, "queued_id": true,
+}
+
+type AccountingConfig struct {
+	// AccountingSink is where the records go, "file" or "mysql"
+	AccountingSink string `json:"accounting_sink"`
+	// AccountingFile is the file the "file" sink appends the records to, as JSON lines
+	AccountingFile string `json:"accounting_file,omitempty"`
+	// AccountingMySQLDSN is the data source name of the "mysql" sink, eg. "user:pass@tcp(127.0.0.1:3306)/billing"
+	AccountingMySQLDSN string `json:"accounting_mysql_dsn,omitempty"`
+	// AccountingTable is the table of the "mysql" sink, with a column for each field
+	AccountingTable string `json:"accounting_table,omitempty"`
+	// AccountingTenantBy is how the tenant is found: "sender_domain" (default), "rcpt_domain" or "auth_user"
+	AccountingTenantBy string `json:"accounting_tenant_by,omitempty"`
+	// AccountingFields is a comma separated list of the fields of the records
+	AccountingFields string `json:"accounting_fields,omitempty"`
+	// AccountingBatch is how many records are buffered before they are written to the sink
+	AccountingBatch int `json:"accounting_batch,omitempty"`
+	// AccountingFlushInterval is how often the buffered records are written, in seconds
+	AccountingFlushInterval int `json:"accounting_flush_interval,omitempty"`
+}
+
+// accountingRecord is what a tenant is billed for a message
+type accountingRecord struct {
+	Tenant     string
+	Messages   int
+	Bytes      int
+	Recipients int
+	Time       int64
+	QueuedId   string
+}
+
+// value returns the field of the record by its name in the config
+func (r *accountingRecord) value(field string) interface{} {
+	switch field {
+	case "tenant":
+		return r.Tenant
+	case "messages":
+		return r.Messages
+	case "bytes":
+		return r.Bytes
+	case "recipients":
+		return r.Recipients
+	case "time":
+		return r.Time
+	case "queued_id":
+		return r.QueuedId
+	}
+	return nil
+}
+
+// accountingSink writes records somewhere they can be billed from
+type accountingSink interface {
+	write(records []accountingRecord, fields []string) error
+	close() error
+}
+
+// accountingFileSink appends the records to a file, one JSON object per line
+type accountingFileSink struct {
+	file *os.File
+}
+
+func (s *accountingFileSink) write(records []accountingRecord, fields []string) error {
+	var buf []byte
+	for i := range records {
+		obj := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			obj[f] = records[i].value(f)
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	// the whole batch at once, so that a failed write can be tried again
+	if _, err := s.file.Write(buf); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *accountingFileSink) close() error {
+	return s.file.Close()
+}
+
+// accountingMySQLSink inserts the records into a table, in one transaction
+type accountingMySQLSink struct {
+	db    *sql.DB
+	table string
+}
+
+func (s *accountingMySQLSink) write(records []accountingRecord, fields []string) error {
+	query := "INSERT INTO " + s.table + " (`" + strings.Join(fields, "`, `") + "`) VALUES (?" +
+		strings.Repeat(", ?", len(fields)-1) + ")"
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		vals := make([]interface{}, len(fields))
+		for j, f := range fields {
+			vals[j] = records[i].value(f)
+		}
+		if _, err := tx.Exec(query, vals...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *accountingMySQLSink) close() error {
+	return s.db.Close()
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: accounting
+// ----------------------------------------------------------------------------------
+// Description   : Emits a record for each message & tenant, for metered billing.
+//               : The records are buffered and written to the sink in batches, every
+//               : flush interval, and when the backend shuts down. If the sink fails,
+//               : the records are kept and written on the next flush
+// ----------------------------------------------------------------------------------
+// Config Options: accounting_sink string - "file" or "mysql"
+//               : accounting_file string - file for the "file" sink, JSON lines
+//               : accounting_mysql_dsn string - data source name for the "mysql" sink
+//               : accounting_table string - table for the "mysql" sink, default "accounting"
+//               : accounting_tenant_by string - "sender_domain" (default) the domain of
+//               : the MAIL FROM, "rcpt_domain" the domains of the recipients, a message
+//               : to several domains gets a record for each, or "auth_user" the
+//               : authenticated user, else the sender domain
+//               : accounting_fields string - comma separated list of tenant, messages,
+//               : bytes, recipients, time (unix), queued_id.
+//               : Default "tenant,messages,bytes,recipients,time"
+//               : accounting_batch int - records buffered before a write, default 100
+//               : accounting_flush_interval int - seconds between writes, default 10
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.Data, e.QueuedId
+//               : e.Values[ValueAuthLogin]
+// ----------------------------------------------------------------------------------
+// Output        : none
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["accounting"] = func() Decorator {
+		return Accounting()
+	}
+}
+
+func Accounting() Decorator {
+
+	var (
+		config  *AccountingConfig
+		fields  []string
+		sink    accountingSink
+		pending []accountingRecord
+		// guards pending & sink
+		mu   sync.Mutex
+		stop chan bool
+		done chan bool
+	)
+
+	// flush writes the pending records to the sink, mu must be held
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := sink.write(pending, fields); err != nil {
+			if len(pending) > accountingMaxPending {
+				Log().Errorf("accounting sink failing, dropped %d records", len(pending)-accountingMaxPending)
+				pending = append(pending[:0], pending[len(pending)-accountingMaxPending:]...)
+			}
+			return err
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&AccountingConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*AccountingConfig)
+		switch config.AccountingTenantBy {
+		case "":
+			config.AccountingTenantBy = accountingTenantSender
+		case accountingTenantSender, accountingTenantRcpt, accountingTenantAuth:
+		default:
+			return errors.New("invalid accounting_tenant_by: " + config.AccountingTenantBy)
+		}
+		if config.AccountingFields == "" {
+			config.AccountingFields = accountingFields
+		}
+		fields = nil
+		for _, f := range strings.Split(config.AccountingFields, ",") {
+			f = strings.ToLower(strings.TrimSpace(f))
+			if !accountingFieldNames[f] {
+				return errors.New("invalid field in accounting_fields: " + f)
+			}
+			fields = append(fields, f)
+		}
+		if config.AccountingBatch <= 0 {
+			config.AccountingBatch = accountingBatch
+		}
+		if config.AccountingFlushInterval <= 0 {
+			config.AccountingFlushInterval = accountingFlushInterval
+		}
+		switch config.AccountingSink {
+		case accountingSinkFile:
+			if config.AccountingFile == "" {
+				return errors.New("accounting_file cannot be empty")
+			}
+			f, err := os.OpenFile(config.AccountingFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return err
+			}
+			sink = &accountingFileSink{file: f}
+		case accountingSinkMySQL:
+			if config.AccountingTable == "" {
+				config.AccountingTable = accountingTable
+			}
+			db, err := sql.Open("mysql", config.AccountingMySQLDSN)
+			if err != nil {
+				return err
+			}
+			if err = db.Ping(); err != nil {
+				db.Close()
+				return err
+			}
+			sink = &accountingMySQLSink{db: db, table: config.AccountingTable}
+		default:
+			return errors.New("invalid accounting_sink: " + config.AccountingSink)
+		}
+		stop = make(chan bool)
+		done = make(chan bool)
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(time.Duration(config.AccountingFlushInterval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					mu.Lock()
+					if err := flush(); err != nil {
+						Log().WithError(err).Error("could not write the accounting records")
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+		return nil
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if sink == nil {
+			return nil
+		}
+		close(stop)
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		err := flush()
+		if err != nil {
+			Log().WithError(err).Errorf("could not write the last %d accounting records", len(pending))
+		}
+		if closeErr := sink.close(); err == nil {
+			err = closeErr
+		}
+		sink = nil
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				records := accountingRecords(e, config.AccountingTenantBy, time.Now())
+				mu.Lock()
+				pending = append(pending, records...)
+				if len(pending) >= config.AccountingBatch {
+					if err := flush(); err != nil {
+						Log().WithError(err).Error("could not write the accounting records")
+					}
+				}
+				mu.Unlock()
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// accountingRecords returns the records of a message, one for each tenant it is billed to
+func accountingRecords(e *mail.Envelope, tenantBy string, now time.Time) []accountingRecord {
+	record := accountingRecord{
+		Messages:   1,
+		Bytes:      e.Data.Len(),
+		Recipients: len(e.RcptTo),
+		Time:       now.Unix(),
+		QueuedId:   e.QueuedId,
+	}
+	switch tenantBy {
+	case accountingTenantRcpt:
+		var records []accountingRecord
+		// the recipients of each domain, in the order the domains first appear
+		index := make(map[string]int)
+		for i := range e.RcptTo {
+			domain := strings.ToLower(e.RcptTo[i].Host)
+			if j, ok := index[domain]; ok {
+				records[j].Recipients++
+				continue
+			}
+			index[domain] = len(records)
+			r := record
+			r.Tenant = domain
+			r.Recipients = 1
+			records = append(records, r)
+		}
+		return records
+	case accountingTenantAuth:
+		if login, ok := e.Values[ValueAuthLogin].(string); ok && login != "" {
+			record.Tenant = login
+			break
+		}
+		fallthrough
+	default:
+		record.Tenant = strings.ToLower(e.MailFrom.Host)
+	}
+	return []accountingRecord{record}
+}
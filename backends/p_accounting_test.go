@@ -0,0 +1,142 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func newAccountingEnvelope(from string, data string, rcpt ...string) *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.MailFrom, _ = mail.NewAddress(from)
+	for _, r := range rcpt {
+		a, _ := mail.NewAddress(r)
+		e.RcptTo = append(e.RcptTo, a)
+	}
+	e.Data.WriteString(data)
+	return e
+}
+
+// readAccounting returns the records written to the file
+func readAccounting(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal("invalid record:", scanner.Text())
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAccountingTwoTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "billing.log")
+
+	p := newTestProcessor(t, BackendConfig{
+		"accounting_sink":   "file",
+		"accounting_file":   path,
+		"accounting_fields": "tenant, messages, bytes, recipients, time, queued_id",
+	}, Accounting)
+	messages := []*mail.Envelope{
+		newAccountingEnvelope("alice@tenant-a.com", "Subject: one\n\nhello\n", "x@example.org"),
+		newAccountingEnvelope("bob@Tenant-B.com", "Subject: two\n\nhello there\n", "x@example.org", "y@example.net"),
+		newAccountingEnvelope("carol@tenant-a.com", strings.Repeat("z", 1000), "x@example.org", "y@example.org", "z@example.org"),
+	}
+	for i, e := range messages {
+		e.QueuedId = "q" + strconv.Itoa(i+1)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Fatal("the message should pass, got:", err)
+		}
+	}
+	// buffered until the shutdown
+	if b, _ := ioutil.ReadFile(path); len(b) != 0 {
+		t.Error("expecting the records to be buffered, got:", string(b))
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal("shutdown failed:", err)
+	}
+
+	records := readAccounting(t, path)
+	if len(records) != 3 {
+		t.Fatal("expecting 3 records, got:", records)
+	}
+	expected := []struct {
+		tenant     string
+		bytes      int
+		recipients int
+	}{
+		{"tenant-a.com", 20, 1},
+		{"tenant-b.com", 26, 2},
+		{"tenant-a.com", 1000, 3},
+	}
+	totals := make(map[string]float64)
+	for i, r := range records {
+		// JSON numbers are float64
+		if r["tenant"] != expected[i].tenant || r["messages"] != float64(1) ||
+			r["bytes"] != float64(expected[i].bytes) || r["recipients"] != float64(expected[i].recipients) ||
+			r["queued_id"] != "q"+strconv.Itoa(i+1) {
+			t.Error("unexpected record", i, r)
+		}
+		if ts, ok := r["time"].(float64); !ok || ts <= 0 {
+			t.Error("expecting a timestamp, got:", r["time"])
+		}
+		totals[r["tenant"].(string)] += r["bytes"].(float64)
+	}
+	if totals["tenant-a.com"] != 1020 || totals["tenant-b.com"] != 26 {
+		t.Error("unexpected bytes per tenant:", totals)
+	}
+}
+
+func TestAccountingTenants(t *testing.T) {
+	e := newAccountingEnvelope("alice@tenant-a.com", "hello", "x@tenant-b.com", "y@tenant-c.com", "z@Tenant-B.com")
+	records := accountingRecords(e, accountingTenantRcpt, time.Unix(1500000000, 0))
+	if len(records) != 2 || records[0].Tenant != "tenant-b.com" || records[0].Recipients != 2 ||
+		records[1].Tenant != "tenant-c.com" || records[1].Recipients != 1 || records[1].Bytes != 5 {
+		t.Error("expecting a record for each recipient domain, got:", records)
+	}
+
+	records = accountingRecords(e, accountingTenantAuth, time.Unix(1500000000, 0))
+	if len(records) != 1 || records[0].Tenant != "tenant-a.com" {
+		t.Error("expecting the sender domain without a login, got:", records)
+	}
+	e.Values[ValueAuthLogin] = "customer42"
+	records = accountingRecords(e, accountingTenantAuth, time.Unix(1500000000, 0))
+	if len(records) != 1 || records[0].Tenant != "customer42" || records[0].Recipients != 3 ||
+		records[0].Time != 1500000000 {
+		t.Error("expecting the authenticated user, got:", records)
+	}
+}
+
+func TestAccountingConfig(t *testing.T) {
+	for _, c := range []BackendConfig{
+		{"accounting_sink": "kafka"},
+		{"accounting_sink": "file"},
+		{"accounting_sink": "file", "accounting_file": os.DevNull, "accounting_fields": "tenant,price"},
+		{"accounting_sink": "file", "accounting_file": os.DevNull, "accounting_tenant_by": "ip"},
+	} {
+		if _, errs := initTestProcessor(c, Accounting); errs == nil {
+			t.Error("expecting an error for", c)
+			Svc.shutdown()
+		}
+	}
+}
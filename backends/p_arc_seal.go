@@ -0,0 +1,398 @@
+package backends
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ValueARC is the e.Values key set to the result of the validation of the ARC chain that the
+// message came with, one of the ARC* results
+const ValueARC = "arc"
+
+// The results of the validation of an ARC chain, and the cv= of the ARC-Seal
+const (
+	ARCPass = "pass"
+	ARCFail = "fail"
+	ARCNone = "none"
+)
+
+const (
+	// the most ARC sets of a message, see RFC 8617
+	arcMaxInstance = 50
+	// the headers signed by the ARC-Message-Signature, if 'arc_headers' not present in config
+	arcDefaultHeaders = "from,to,cc,subject,date,message-id,reply-to,in-reply-to,references," +
+		"mime-version,content-type,content-transfer-encoding,dkim-signature"
+)
+
+type ARCSealConfig struct {
+	// ARCDomain & ARCSelector are where the public key is published, the d= & s= of the signatures
+	ARCDomain   string `json:"arc_domain"`
+	ARCSelector string `json:"arc_selector"`
+	// ARCPrivateKeyFile is the RSA key to sign with, in PEM format
+	ARCPrivateKeyFile string `json:"arc_private_key_file"`
+	// ARCAuthServID names this server in the ARC-Authentication-Results header, the hostname by default
+	ARCAuthServID string `json:"arc_authserv_id,omitempty"`
+	// ARCHeaders is a comma separated list of the headers to sign
+	ARCHeaders string `json:"arc_headers,omitempty"`
+}
+
+// arcSet are the headers of an instance of the ARC chain
+type arcSet struct {
+	aar  string
+	ams  string
+	seal string
+}
+
+// arcSealer signs the messages with the config
+type arcSealer struct {
+	domain     string
+	selector   string
+	key        *rsa.PrivateKey
+	authServID string
+	headers    []string
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: arcseal
+// ----------------------------------------------------------------------------------
+// Description   : Adds an ARC set to the message (ARC-Authentication-Results,
+//               : ARC-Message-Signature & ARC-Seal), so that the results of the
+//               : authentication done here survive the forwarding of the message.
+//               : The ARC chain that the message came with is validated, the set is
+//               : chained to it with the next i= and its result as the cv=. A chain
+//               : that already failed is not sealed again
+// ----------------------------------------------------------------------------------
+// Config Options: arc_domain string - the signing domain, d=
+//               : arc_selector string - the selector of the key, s=
+//               : arc_private_key_file string - the RSA key, in PEM format
+//               : arc_authserv_id string - the name of the server in the results,
+//               : the hostname by default
+//               : arc_headers string - comma separated list of the headers to sign
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.Values[ValueAuthResults], set by the authentication processors.
+//               : Place this processor after them (eg. dkimverify) and the header
+//               : processor, and after any processor that changes e.Data
+// ----------------------------------------------------------------------------------
+// Output        : The ARC set is appended to e.DeliveryHeader, e.Values[ValueARC]
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["arcseal"] = func() Decorator {
+		return ARCSeal()
+	}
+}
+
+// loadRSAKey reads a PEM encoded RSA private key, PKCS #1 or PKCS #8
+func loadRSAKey(file string) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM key found in " + file)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("invalid key in " + file + ": " + err.Error())
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key in " + file)
+	}
+	return rsaKey, nil
+}
+
+// newARCSealer parses the config
+func newARCSealer(config *ARCSealConfig) (*arcSealer, error) {
+	a := &arcSealer{
+		domain:     strings.ToLower(strings.TrimSpace(config.ARCDomain)),
+		selector:   strings.ToLower(strings.TrimSpace(config.ARCSelector)),
+		authServID: strings.TrimSpace(config.ARCAuthServID),
+	}
+	if a.domain == "" || strings.ContainsAny(a.domain, " \t;") {
+		return nil, errors.New("invalid arc_domain: " + config.ARCDomain)
+	}
+	if a.selector == "" || strings.ContainsAny(a.selector, " \t;") {
+		return nil, errors.New("invalid arc_selector: " + config.ARCSelector)
+	}
+	var err error
+	if a.key, err = loadRSAKey(config.ARCPrivateKeyFile); err != nil {
+		return nil, errors.New("could not load the arc_private_key_file: " + err.Error())
+	}
+	if a.key.N.BitLen() < dkimMinRSABits {
+		return nil, errors.New("the arc_private_key_file key is too short")
+	}
+	if a.authServID == "" {
+		if a.authServID, err = os.Hostname(); err != nil {
+			return nil, errors.New("arc_authserv_id not set, and the hostname is not available: " + err.Error())
+		}
+	}
+	if strings.ContainsAny(a.authServID, " \t;\r\n") {
+		return nil, errors.New("invalid arc_authserv_id: " + a.authServID)
+	}
+	headers := config.ARCHeaders
+	if headers == "" {
+		headers = arcDefaultHeaders
+	}
+	for _, h := range splitList(headers) {
+		h = strings.ToLower(h)
+		if strings.HasPrefix(h, "arc-") || h == "authentication-results" {
+			return nil, errors.New("arc_headers cannot sign the " + h + " header")
+		}
+		a.headers = append(a.headers, h)
+	}
+	return a, nil
+}
+
+// arcInstance returns the i= of an ARC header field, or 0 if it's invalid
+func arcInstance(field string) int {
+	value := field[strings.IndexByte(field, ':')+1:]
+	if strings.EqualFold(dkimHeaderName(field), "ARC-Authentication-Results") {
+		// the i= tag is followed by the results
+		value = strings.SplitN(value, ";", 2)[0]
+	}
+	tags, err := dkimTags(value)
+	if err != nil {
+		return 0
+	}
+	i, err := strconv.Atoi(tags["i"])
+	if err != nil || i < 1 || i > arcMaxInstance {
+		return 0
+	}
+	return i
+}
+
+// arcChain returns the ARC sets of a message, by instance. An error is returned if the chain is
+// not complete, with the sets found
+func arcChain(fields []string) ([]arcSet, error) {
+	var chain []arcSet
+	for _, field := range fields {
+		name := strings.ToLower(dkimHeaderName(field))
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+		i := arcInstance(field)
+		if i == 0 {
+			return chain, errors.New("invalid " + name + " header")
+		}
+		for len(chain) < i {
+			chain = append(chain, arcSet{})
+		}
+		header := &chain[i-1].seal
+		if name == "arc-authentication-results" {
+			header = &chain[i-1].aar
+		} else if name == "arc-message-signature" {
+			header = &chain[i-1].ams
+		}
+		if *header != "" {
+			return chain, errors.New("duplicate " + name + " header for i=" + strconv.Itoa(i))
+		}
+		*header = field
+	}
+	for i, set := range chain {
+		if set.aar == "" || set.ams == "" || set.seal == "" {
+			return chain, errors.New("incomplete ARC set for i=" + strconv.Itoa(i+1))
+		}
+	}
+	return chain, nil
+}
+
+// arcSealHash hashes the ARC sets of chain for the ARC-Seal of the last one, without its b= value
+func arcSealHash(chain []arcSet) []byte {
+	h := sha256.New()
+	for i, set := range chain {
+		io.WriteString(h, dkimCanonHeader(set.aar, true))
+		io.WriteString(h, dkimCanonHeader(set.ams, true))
+		if i == len(chain)-1 {
+			io.WriteString(h, strings.TrimSuffix(dkimCanonHeader(dkimStripB(set.seal), true), "\r\n"))
+		} else {
+			io.WriteString(h, dkimCanonHeader(set.seal, true))
+		}
+	}
+	return h.Sum(nil)
+}
+
+// arcTags returns the tags of an ARC-Message-Signature or ARC-Seal field
+func arcTags(field string) map[string]string {
+	tags, err := dkimTags(field[strings.IndexByte(field, ':')+1:])
+	if err != nil {
+		return map[string]string{}
+	}
+	return tags
+}
+
+// arcValidate validates an ARC chain, of a message made of fields and body
+func arcValidate(chain []arcSet, fields []string, body []byte) error {
+	n := len(chain)
+	if arcTags(chain[n-1].seal)["cv"] == ARCFail {
+		return errors.New("the chain has failed already")
+	}
+	// the signature of the message, by the last instance
+	ams, err := newDKIMSignature(chain[n-1].ams, arcTags(chain[n-1].ams))
+	if err != nil {
+		return err
+	}
+	if ams.algorithm != "rsa" {
+		return errors.New("unsupported ARC-Message-Signature algorithm")
+	}
+	if err := ams.verify(fields, body); err != nil {
+		return errors.New("ARC-Message-Signature i=" + strconv.Itoa(n) + ": " + err.Error())
+	}
+	// the seals, from the last one
+	for i := n; i >= 1; i-- {
+		tags := arcTags(chain[i-1].seal)
+		cv := ARCPass
+		if i == 1 {
+			cv = ARCNone
+		}
+		if tags["cv"] != cv {
+			return errors.New("ARC-Seal i=" + strconv.Itoa(i) + ": unexpected cv=" + tags["cv"])
+		}
+		if _, ok := tags["h"]; ok || strings.ToLower(tags["a"]) != "rsa-sha256" {
+			return errors.New("ARC-Seal i=" + strconv.Itoa(i) + ": invalid seal")
+		}
+		b, err := base64.StdEncoding.DecodeString(dkimStripSpace(tags["b"]))
+		if err != nil {
+			return errors.New("ARC-Seal i=" + strconv.Itoa(i) + ": invalid b= tag")
+		}
+		key, err := lookupDKIMKey(strings.ToLower(tags["s"]), strings.ToLower(tags["d"]))
+		if err == nil && key.algorithm != "rsa" {
+			err = errors.New("key type does not match the algorithm")
+		}
+		if err == nil {
+			err = key.verify(crypto.SHA256, arcSealHash(chain[:i]), b)
+		}
+		if err != nil {
+			return errors.New("ARC-Seal i=" + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// arcFold folds a base64 value for a header
+func arcFold(b []byte) string {
+	s := base64.StdEncoding.EncodeToString(b)
+	folded := ""
+	for len(s) > 72 {
+		folded += s[:72] + "\r\n\t"
+		s = s[72:]
+	}
+	return folded + s
+}
+
+// sign returns a signature of sum, a SHA-256 hash, for a header
+func (a *arcSealer) sign(sum []byte) (string, error) {
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum)
+	if err != nil {
+		return "", err
+	}
+	return arcFold(sig), nil
+}
+
+// seal validates the ARC chain of the message, and returns the result and the new ARC set,
+// which is empty if the chain can't be extended
+func (a *arcSealer) seal(data []byte, authResults []string) (string, *arcSet, error) {
+	fields, body := dkimSplit(dkimCRLF(data))
+	cv := ARCNone
+	chain, err := arcChain(fields)
+	if err == nil && len(chain) > 0 {
+		if arcTags(chain[len(chain)-1].seal)["cv"] == ARCFail {
+			// the chain is over
+			return ARCFail, nil, nil
+		}
+		err = arcValidate(chain, fields, body)
+		cv = ARCPass
+	}
+	if err != nil {
+		Log().WithError(err).Debug("ARC chain failed")
+		cv = ARCFail
+	}
+	if len(chain) >= arcMaxInstance {
+		return cv, nil, nil
+	}
+	i := strconv.Itoa(len(chain) + 1)
+	t := strconv.FormatInt(dkimNow().Unix(), 10)
+	set := arcSet{}
+	set.aar = "ARC-Authentication-Results: i=" + i + "; " + a.authServID + ";\r\n\t" +
+		strings.Join(append(append([]string{}, authResults...), "arc="+cv), ";\r\n\t") + "\r\n"
+
+	// each instance of the headers is signed
+	var names []string
+	for _, name := range a.headers {
+		for _, field := range fields {
+			if strings.EqualFold(dkimHeaderName(field), name) {
+				names = append(names, name)
+			}
+		}
+	}
+	bh := sha256.Sum256(dkimCanonBody(body, true))
+	set.ams = "ARC-Message-Signature: i=" + i + "; a=rsa-sha256; c=relaxed/relaxed;\r\n\td=" + a.domain +
+		"; s=" + a.selector + "; t=" + t + ";\r\n\th=" + strings.Join(names, ":") +
+		";\r\n\tbh=" + base64.StdEncoding.EncodeToString(bh[:]) + ";\r\n\tb=\r\n"
+	b, err := a.sign(dkimHeaderHash(crypto.SHA256, fields, names, set.ams, true))
+	if err != nil {
+		return cv, nil, err
+	}
+	set.ams = strings.TrimSuffix(set.ams, "\r\n") + b + "\r\n"
+
+	set.seal = "ARC-Seal: i=" + i + "; a=rsa-sha256; t=" + t + "; cv=" + cv + ";\r\n\td=" + a.domain +
+		"; s=" + a.selector + ";\r\n\tb=\r\n"
+	if b, err = a.sign(arcSealHash(append(chain, set))); err != nil {
+		return cv, nil, err
+	}
+	set.seal = strings.TrimSuffix(set.seal, "\r\n") + b + "\r\n"
+	return cv, &set, nil
+}
+
+func ARCSeal() Decorator {
+
+	var sealer *arcSealer
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ARCSealConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		sealer, err = newARCSealer(bcfg.(*ARCSealConfig))
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				authResults, _ := e.Values[ValueAuthResults].([]string)
+				cv, set, err := sealer.seal(e.Data.Bytes(), authResults)
+				if err != nil {
+					// the message can still be delivered without the set
+					Log().WithError(err).Error("could not ARC seal the message")
+				}
+				e.Values[ValueARC] = cv
+				if set != nil {
+					e.DeliveryHeader += strings.Replace(set.seal+set.ams+set.aar, "\r\n", "\n", -1)
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package backends
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// newARCTestKey writes a new key to a file, and returns the file and the key record
+func newARCTestKey(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "arc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	return f.Name(), "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+// arcTestSeal seals data, and returns the sealed message
+func arcTestSeal(t *testing.T, p Processor, data string) (string, *mail.Envelope) {
+	e := newDKIMEnvelope(data)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	// the Authentication-Results header of dkimverify, and the set
+	return e.DeliveryHeader + e.Data.String(), e
+}
+
+// arcTestValidate validates the ARC chain of a message
+func arcTestValidate(t *testing.T, data string) ([]arcSet, error) {
+	fields, body := dkimSplit(dkimCRLF([]byte(data)))
+	chain, err := arcChain(fields)
+	if err != nil {
+		return chain, err
+	}
+	return chain, arcValidate(chain, fields, body)
+}
+
+func TestARCSeal(t *testing.T) {
+	file, record := newARCTestKey(t)
+	defer os.Remove(file)
+	defer dkimTestDNS(map[string]string{
+		"sel._domainkey.example.com":  dkimTestKey,
+		"arc._domainkey.forward.test": record,
+	})()
+	// dkimverify adds its results first
+	p := newTestProcessor(t, BackendConfig{
+		"arc_domain":           "forward.test",
+		"arc_selector":         "arc",
+		"arc_private_key_file": file,
+		"arc_authserv_id":      "mx.forward.test",
+		"dkim_authserv_id":     "mx.forward.test",
+	}, ARCSeal, DKIMVerify)
+	sealed, e := arcTestSeal(t, p, dkimTestRelaxed)
+	if e.Values[ValueARC] != ARCNone {
+		t.Error("expecting no chain, got:", e.Values[ValueARC])
+	}
+	chain, err := arcTestValidate(t, sealed)
+	if err != nil {
+		t.Fatal("the ARC set did not validate:", err, sealed)
+	}
+	if len(chain) != 1 {
+		t.Fatal("expecting a single instance, got:", len(chain))
+	}
+	set := chain[0]
+	expect := "ARC-Authentication-Results: i=1; mx.forward.test;\r\n\tdkim=pass header.d=example.com header.s=sel header.b=ax3arj5W;\r\n\tarc=none\r\n"
+	if set.aar != expect {
+		t.Errorf("unexpected ARC-Authentication-Results: %q", set.aar)
+	}
+	if !strings.HasPrefix(set.ams, "ARC-Message-Signature: i=1; a=rsa-sha256; c=relaxed/relaxed;\r\n\td=forward.test; s=arc; t=") ||
+		!strings.Contains(set.ams, "h=from:to:subject:date:message-id:dkim-signature;") {
+		t.Errorf("unexpected ARC-Message-Signature: %q", set.ams)
+	}
+	if !strings.HasPrefix(set.seal, "ARC-Seal: i=1; a=rsa-sha256; t=") || !strings.Contains(set.seal, "; cv=none;\r\n\td=forward.test; s=arc;\r\n\tb=") {
+		t.Errorf("unexpected ARC-Seal: %q", set.seal)
+	}
+	// the set doesn't survive changes
+	for _, changed := range []string{
+		strings.Replace(sealed, "signed.", "changed.", 1),
+		strings.Replace(sealed, "Subject:  Hello", "Subject: Hullo", 1),
+		strings.Replace(sealed, "arc=none", "arc=pass", 1),
+		strings.Replace(sealed, "ARC-Seal: i=1", "ARC-Seal: i=2", 1),
+	} {
+		if _, err := arcTestValidate(t, changed); err == nil {
+			t.Error("expecting the changed message to fail validation")
+		}
+	}
+}
+
+func TestARCSealChain(t *testing.T) {
+	file, record := newARCTestKey(t)
+	defer os.Remove(file)
+	defer dkimTestDNS(map[string]string{"arc._domainkey.forward.test": record})()
+	p := newTestProcessor(t, BackendConfig{
+		"arc_domain":           "forward.test",
+		"arc_selector":         "arc",
+		"arc_private_key_file": file,
+		"arc_headers":          "From, Subject",
+	}, ARCSeal, DKIMVerify)
+	msg := "From: alice@example.com\r\nSubject: chained\r\n\r\nthe body\r\n"
+	once, _ := arcTestSeal(t, p, msg)
+	twice, e := arcTestSeal(t, p, once)
+	if e.Values[ValueARC] != ARCPass {
+		t.Error("expecting the chain to pass, got:", e.Values[ValueARC])
+	}
+	chain, err := arcTestValidate(t, twice)
+	if err != nil || len(chain) != 2 {
+		t.Fatal("expecting 2 valid instances, got:", len(chain), err)
+	}
+	if !strings.Contains(chain[1].seal, "i=2;") || !strings.Contains(chain[1].seal, "cv=pass;") ||
+		!strings.Contains(chain[1].aar, "arc=pass") || !strings.Contains(chain[1].ams, "h=from:subject;") {
+		t.Errorf("unexpected second set: %q", chain[1])
+	}
+
+	// a broken chain is sealed with cv=fail, and not after that
+	broken, e := arcTestSeal(t, p, strings.Replace(twice, "the body", "another body", 1))
+	if e.Values[ValueARC] != ARCFail {
+		t.Error("expecting the chain to fail, got:", e.Values[ValueARC])
+	}
+	fields, _ := dkimSplit(dkimCRLF([]byte(broken)))
+	if chain, err := arcChain(fields); err != nil || len(chain) != 3 || !strings.Contains(chain[2].seal, "cv=fail;") {
+		t.Errorf("expecting a third set with cv=fail, got: %q, %v", chain, err)
+	}
+	if _, e = arcTestSeal(t, p, broken); e.Values[ValueARC] != ARCFail || strings.Contains(e.DeliveryHeader, "ARC-Seal") {
+		t.Error("a failed chain should not be sealed, got:", e.DeliveryHeader)
+	}
+	// missing ARC-Message-Signature
+	incomplete := strings.Replace(once, "ARC-Message-Signature:", "X-ARC-Message-Signature:", 1)
+	if _, e = arcTestSeal(t, p, incomplete); e.Values[ValueARC] != ARCFail || !strings.Contains(e.DeliveryHeader, "ARC-Seal: i=2;") {
+		t.Error("expecting an incomplete chain to fail, got:", e.Values[ValueARC], e.DeliveryHeader)
+	}
+}
+
+func TestARCSealConfig(t *testing.T) {
+	file, _ := newARCTestKey(t)
+	defer os.Remove(file)
+	notAKey, _ := ioutil.TempFile("", "arc")
+	notAKey.WriteString("not a key")
+	notAKey.Close()
+	defer os.Remove(notAKey.Name())
+	for _, config := range []BackendConfig{
+		{"arc_selector": "arc", "arc_private_key_file": file},
+		{"arc_domain": "forward.test", "arc_private_key_file": file},
+		{"arc_domain": "forward.test", "arc_selector": "arc"},
+		{"arc_domain": "forward.test", "arc_selector": "arc", "arc_private_key_file": file + ".missing"},
+		{"arc_domain": "forward.test", "arc_selector": "arc", "arc_private_key_file": notAKey.Name()},
+		{"arc_domain": "forward test", "arc_selector": "arc", "arc_private_key_file": file},
+		{"arc_domain": "forward.test", "arc_selector": "arc", "arc_private_key_file": file, "arc_authserv_id": "mx;1"},
+		{"arc_domain": "forward.test", "arc_selector": "arc", "arc_private_key_file": file, "arc_headers": "from,arc-seal"},
+	} {
+		if _, errs := initTestProcessor(config, ARCSeal); errs == nil {
+			t.Error("expecting the config to fail:", config)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package backends
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// default seconds between flushes, if 'auditlog_flush_interval' not present in config
+const auditLogFlushInterval = 1
+
+type AuditLogConfig struct {
+	// AuditLogFile is the file the records are appended to, as JSON lines
+	AuditLogFile string `json:"auditlog_file"`
+	// AuditLogMaxSize rotates the file before it gets bigger, in bytes. Not rotated by size if 0
+	AuditLogMaxSize int `json:"auditlog_max_size,omitempty"`
+	// AuditLogRotateDaily rotates the file at the first record of each day
+	AuditLogRotateDaily bool `json:"auditlog_rotate_daily,omitempty"`
+	// AuditLogRejected also records the messages that the processors after this one rejected
+	AuditLogRejected bool `json:"auditlog_rejected,omitempty"`
+	// AuditLogHashes adds the SHA-256 of the message to the records
+	AuditLogHashes bool `json:"auditlog_hashes,omitempty"`
+	// AuditLogFlushInterval is how often the buffered records are written, in seconds
+	AuditLogFlushInterval int `json:"auditlog_flush_interval,omitempty"`
+}
+
+// auditRcpt is the outcome of a recipient in an auditRecord
+type auditRcpt struct {
+	Address string `json:"address"`
+	Code    int    `json:"code"`
+	Reply   string `json:"reply"`
+}
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Time       string        `json:"time"`
+	QueuedId   string        `json:"queued_id"`
+	RemoteIP   string        `json:"remote_ip"`
+	Helo       string        `json:"helo"`
+	AuthUser   string        `json:"auth_user,omitempty"`
+	TLS        *mail.TLSInfo `json:"tls,omitempty"`
+	MailFrom   string        `json:"mail_from"`
+	Rcpts      []auditRcpt   `json:"rcpts"`
+	Size       int           `json:"size"`
+	Subject    string        `json:"subject"`
+	Code       int           `json:"code"`
+	Reply      string        `json:"reply"`
+	BodySHA256 string        `json:"body_sha256,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: auditlog
+// ----------------------------------------------------------------------------------
+// Description   : Appends a record of each message to a file, as JSON lines, with the
+//               : client, the sender, the outcome of each recipient and the reply.
+//               : Place first in save_process, so that the outcome of the processors
+//               : after it is recorded. A message that is retried gets a record for
+//               : each attempt. The records are buffered and written every flush
+//               : interval, and when the backend shuts down. The file is reopened when
+//               : it was moved away, eg. by logrotate, and when the config is reloaded.
+//               : The transactions that the server rejected before the DATA are not
+//               : recorded, they don't reach the backend
+// ----------------------------------------------------------------------------------
+// Config Options: auditlog_file string - the file the records are appended to
+//               : auditlog_max_size int - rotate the file before it gets bigger, in
+//               : bytes, 0 (default) for no limit. The rotated file is renamed to
+//               : the auditlog_file with the time of the rotation appended
+//               : auditlog_rotate_daily bool - rotate the file each day
+//               : auditlog_rejected bool - also record the rejected messages
+//               : auditlog_hashes bool - add the SHA-256 of the message (body_sha256),
+//               : nothing of the body is recorded otherwise
+//               : auditlog_flush_interval int - seconds between writes, default 1
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP, e.Helo, e.TLSInfo, e.MailFrom, e.RcptTo, e.Data, e.Subject
+//               : e.Values[ValueAuthLogin] & e.Values[ValueRcptResults]
+// ----------------------------------------------------------------------------------
+// Output        : none
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["auditlog"] = func() Decorator {
+		return AuditLog()
+	}
+}
+
+// auditLogFile is a buffered, rotated log file
+type auditLogFile struct {
+	path    string
+	maxSize int64
+	daily   bool
+	file    *os.File
+	w       *bufio.Writer
+	// size of the file, including what is buffered
+	size int64
+	// when the file was opened, for the daily rotation
+	opened time.Time
+}
+
+// open opens the file for appending
+func (l *auditLogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size, l.opened = f, info.Size(), time.Now()
+	if l.w == nil {
+		l.w = bufio.NewWriter(f)
+	} else {
+		l.w.Reset(f)
+	}
+	return nil
+}
+
+// write adds a line to the buffer, rotating the file first if the line doesn't fit
+// or the day changed
+func (l *auditLogFile) write(line []byte, now time.Time) error {
+	rotate := l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize
+	if l.daily && l.size > 0 {
+		y, m, d := l.opened.Date()
+		ny, nm, nd := now.Date()
+		rotate = rotate || y != ny || m != nm || d != nd
+	}
+	if rotate {
+		if err := l.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate renames the file to its path with the time appended, and opens a new one
+func (l *auditLogFile) rotate(now time.Time) error {
+	if err := l.close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(l.path, l.path+"."+now.Format("20060102-150405.000000"))
+	// appends to the same file if it could not be renamed
+	if err := l.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+// flush writes the buffered lines, then reopens the file if it was moved away
+func (l *auditLogFile) flush() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if current, err := os.Stat(l.path); err == nil && os.SameFile(info, current) {
+		return nil
+	}
+	l.file.Close()
+	return l.open()
+}
+
+func (l *auditLogFile) close() error {
+	err := l.w.Flush()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// auditFinalResult returns the reply that the gateway gives for the outcome of the processors
+func auditFinalResult(res Result, err error) Result {
+	if err == nil && res != nil {
+		return res
+	}
+	if err != nil {
+		if code := resultCode(res); code >= 400 && code < 600 {
+			return res
+		}
+		return NewResult(response.Canned.FailBackendTransaction + err.Error())
+	}
+	return BackendResultOK
+}
+
+// newAuditRecord returns the record of e, which has the reply res. rcpts are the recipients
+// of e before the processors changed them
+func newAuditRecord(e *mail.Envelope, rcpts []mail.Address, res Result, hashes bool, now time.Time) *auditRecord {
+	r := &auditRecord{
+		Time:     now.UTC().Format(time.RFC3339),
+		QueuedId: e.QueuedId,
+		RemoteIP: e.RemoteIP,
+		Helo:     e.Helo,
+		TLS:      e.TLSInfo,
+		MailFrom: e.MailFrom.String(),
+		Rcpts:    make([]auditRcpt, len(rcpts)),
+		Size:     e.Data.Len(),
+		Subject:  e.Subject,
+		Code:     resultCode(res),
+		Reply:    strings.TrimSpace(res.String()),
+	}
+	r.AuthUser, _ = e.Values[ValueAuthLogin].(string)
+	results := ResultsForRcpts(res, len(rcpts))
+	if _, ok := res.(RcptResults); !ok {
+		if set := envelopeRcptResults(e, rcpts, res); set != nil {
+			results = set
+		}
+	}
+	for i := range rcpts {
+		r.Rcpts[i] = auditRcpt{
+			Address: rcpts[i].String(),
+			Code:    resultCode(results[i]),
+			Reply:   strings.TrimSpace(results[i].String()),
+		}
+	}
+	if hashes {
+		sum := sha256.Sum256(e.Data.Bytes())
+		r.BodySHA256 = hex.EncodeToString(sum[:])
+	}
+	return r
+}
+
+func AuditLog() Decorator {
+
+	var (
+		config  *AuditLogConfig
+		logFile *auditLogFile
+		// guards logFile
+		mu   sync.Mutex
+		stop chan bool
+		done chan bool
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&AuditLogConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*AuditLogConfig)
+		if config.AuditLogFile == "" {
+			return errors.New("auditlog_file cannot be empty")
+		}
+		if config.AuditLogMaxSize < 0 {
+			return errors.New("auditlog_max_size cannot be negative")
+		}
+		if config.AuditLogFlushInterval <= 0 {
+			config.AuditLogFlushInterval = auditLogFlushInterval
+		}
+		l := &auditLogFile{
+			path:    config.AuditLogFile,
+			maxSize: int64(config.AuditLogMaxSize),
+			daily:   config.AuditLogRotateDaily,
+		}
+		if err := l.open(); err != nil {
+			return fmt.Errorf("cannot open auditlog_file: %s", err)
+		}
+		mu.Lock()
+		logFile = l
+		mu.Unlock()
+		stop = make(chan bool)
+		done = make(chan bool)
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(time.Duration(config.AuditLogFlushInterval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					mu.Lock()
+					if err := logFile.flush(); err != nil {
+						Log().WithError(err).Error("could not write the audit log")
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+		return nil
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		mu.Lock()
+		l := logFile
+		mu.Unlock()
+		if l == nil {
+			return nil
+		}
+		close(stop)
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		logFile = nil
+		return l.close()
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				// the processors may rewrite the recipients
+				rcpts := append([]mail.Address(nil), e.RcptTo...)
+				// next processor
+				res, err := p.Process(e, task)
+				final := auditFinalResult(res, err)
+				if resultCode(final) >= 300 && !config.AuditLogRejected {
+					return res, err
+				}
+				if e.Header == nil {
+					// the subject is not parsed yet
+					e.ParseHeaders()
+				}
+				now := time.Now()
+				line, jsonErr := json.Marshal(newAuditRecord(e, rcpts, final, config.AuditLogHashes, now))
+				if jsonErr != nil {
+					Log().WithError(jsonErr).WithField("queued_id", e.QueuedId).Error("could not encode the audit record")
+					return res, err
+				}
+				mu.Lock()
+				if logFile != nil {
+					if writeErr := logFile.write(append(line, '\n'), now); writeErr != nil {
+						Log().WithError(writeErr).WithField("queued_id", e.QueuedId).Error("could not write the audit log")
+					}
+				}
+				mu.Unlock()
+				return res, err
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
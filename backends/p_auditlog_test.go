@@ -0,0 +1,222 @@
+package backends
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// readAuditLog returns the records written to the file
+func readAuditLog(t *testing.T, path string) []auditRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal("invalid record:", scanner.Text())
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// auditTestStorage fails the recipients at blocked.example, and rejects the messages to nobody@
+func auditTestStorage() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			for _, rcpt := range e.RcptTo {
+				if rcpt.User == "nobody" {
+					return NewResult(response.Canned.FailContentRejected), errors.New("no such user")
+				}
+				if rcpt.Host == "blocked.example" {
+					SetRcptResult(e, rcpt, NewResult(response.Canned.FailMailboxFull))
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+func newAuditLogEnvelope(id string, data string, rcpt ...string) *mail.Envelope {
+	e := newAccountingEnvelope("alice@example.com", data, rcpt...)
+	e.QueuedId = id
+	e.Helo = "mx.example.com"
+	return e
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	// the auditlog processes first
+	p := newTestProcessor(t, BackendConfig{"auditlog_file": path, "auditlog_flush_interval": 60}, auditTestStorage, AuditLog)
+
+	secure := newAuditLogEnvelope("q1", "Subject: first\n\nhello\n", "bob@example.org")
+	secure.TLS = true
+	secure.TLSInfo = &mail.TLSInfo{Version: "TLSv1.3", CipherSuite: "TLS_AES_128_GCM_SHA256"}
+	secure.Values[ValueAuthLogin] = "alice"
+	partial := newAuditLogEnvelope("q2", "Subject: second\n\nhello there\n", "bob@example.org", "carol@blocked.example")
+	rejected := newAuditLogEnvelope("q3", "Subject: third\n\nhi\n", "nobody@example.org")
+	for _, e := range []*mail.Envelope{secure, partial, rejected} {
+		p.Process(e, TaskSaveMail)
+	}
+	// buffered until the flush
+	if b, _ := ioutil.ReadFile(path); len(b) != 0 {
+		t.Error("expecting the records to be buffered, got:", string(b))
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal("shutdown failed:", err)
+	}
+
+	records := readAuditLog(t, path)
+	if len(records) != 2 {
+		t.Fatal("expecting a record for each delivered message, got:", records)
+	}
+	r := records[0]
+	if r.QueuedId != "q1" || r.RemoteIP != "203.0.113.5" || r.Helo != "mx.example.com" ||
+		r.AuthUser != "alice" || r.MailFrom != "alice@example.com" || r.Size != 22 ||
+		r.Subject != "first" || r.Code != 200 || r.BodySHA256 != "" {
+		t.Error("unexpected record:", r)
+	}
+	if r.TLS == nil || r.TLS.Version != "TLSv1.3" || r.TLS.CipherSuite != "TLS_AES_128_GCM_SHA256" {
+		t.Error("expecting the TLS details, got:", r.TLS)
+	}
+	if ts, err := time.Parse(time.RFC3339, r.Time); err != nil || time.Since(ts) > time.Minute {
+		t.Error("expecting the time of the record, got:", r.Time)
+	}
+	if len(r.Rcpts) != 1 || r.Rcpts[0].Address != "bob@example.org" || r.Rcpts[0].Code != 200 {
+		t.Error("expecting the recipient to be delivered, got:", r.Rcpts)
+	}
+
+	r = records[1]
+	if r.QueuedId != "q2" || r.AuthUser != "" || r.TLS != nil || r.Subject != "second" {
+		t.Error("unexpected record:", r)
+	}
+	if len(r.Rcpts) != 2 || r.Rcpts[0].Code != 200 || r.Rcpts[1].Address != "carol@blocked.example" ||
+		r.Rcpts[1].Code != 552 || r.Rcpts[1].Reply != strings.TrimSpace(response.Canned.FailMailboxFull) {
+		t.Error("expecting the outcome of each recipient, got:", r.Rcpts)
+	}
+}
+
+func TestAuditLogRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	p := newTestProcessor(t, BackendConfig{
+		"auditlog_file":     path,
+		"auditlog_rejected": true,
+		"auditlog_hashes":   true,
+	}, auditTestStorage, AuditLog)
+	p.Process(newAuditLogEnvelope("q1", "Subject: first\n\nhello\n", "bob@example.org"), TaskSaveMail)
+	p.Process(newAuditLogEnvelope("q2", "Subject: second\n\nhi\n", "nobody@example.org"), TaskSaveMail)
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal("shutdown failed:", err)
+	}
+	records := readAuditLog(t, path)
+	if len(records) != 2 {
+		t.Fatal("expecting a record for each message, got:", records)
+	}
+	sum := sha256.Sum256([]byte("Subject: first\n\nhello\n"))
+	if records[0].BodySHA256 != hex.EncodeToString(sum[:]) {
+		t.Error("expecting the hash of the message, got:", records[0].BodySHA256)
+	}
+	if records[1].BodySHA256 == records[0].BodySHA256 {
+		t.Error("expecting the hashes of different messages to differ")
+	}
+	r := records[1]
+	if r.QueuedId != "q2" || r.Code != 550 || len(r.Rcpts) != 1 || r.Rcpts[0].Code != 550 {
+		t.Error("expecting the rejection to be recorded, got:", r)
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	l := &auditLogFile{path: path, maxSize: 25}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, line := range []string{"first line\n", "second line\n", "third line\n"} {
+		if err := l.write([]byte(line), now); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	if err := l.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "third line\n" {
+		t.Error("expecting the file to be rotated, got:", string(b))
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 {
+		t.Fatal("expecting a rotated file, got:", rotated)
+	}
+	if b, _ := ioutil.ReadFile(rotated[0]); string(b) != "first line\nsecond line\n" {
+		t.Error("unexpected rotated file:", string(b))
+	}
+
+	// rotated daily
+	l.maxSize, l.daily = 0, true
+	if err := l.write([]byte("next day\n"), now.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	l.flush()
+	if b, _ := ioutil.ReadFile(path); string(b) != "next day\n" {
+		t.Error("expecting the file to be rotated the next day, got:", string(b))
+	}
+
+	// moved away, eg. by logrotate
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.flush(); err != nil {
+		t.Fatal(err)
+	}
+	l.write([]byte("after the move\n"), now.Add(24*time.Hour))
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "after the move\n" {
+		t.Error("expecting the file to be reopened, got:", string(b))
+	}
+}
+
+func TestAuditLogConfig(t *testing.T) {
+	for _, c := range []BackendConfig{
+		{},
+		{"auditlog_file": "/nonexistent/dir/audit.log"},
+		{"auditlog_file": "audit.log", "auditlog_max_size": -1},
+	} {
+		if _, errs := initTestProcessor(c, AuditLog); errs == nil {
+			t.Error("expecting the config to be invalid:", c)
+		}
+	}
+}
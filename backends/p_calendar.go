@@ -0,0 +1,354 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ValueCalendar is the e.Values key where the calendar processor stores the *Calendar
+const ValueCalendar = "calendar"
+
+// how deep to look into nested multipart messages
+const calendarMaxDepth = 5
+
+type CalendarConfig struct {
+	// CalendarEnabled turns the processor on
+	CalendarEnabled bool `json:"calendar_enabled"`
+	// CalendarMethods is a comma separated list of the methods to handle, eg. "REQUEST,CANCEL"
+	CalendarMethods string `json:"calendar_methods,omitempty"`
+}
+
+// CalendarAddress is an organizer or an attendee of an event
+type CalendarAddress struct {
+	// Email is the address without the mailto: prefix
+	Email string
+	// Name is the common name (CN), if present
+	Name string
+	// Role, eg. REQ-PARTICIPANT, attendees only
+	Role string
+	// Status is the participation status (PARTSTAT), eg. ACCEPTED, attendees only
+	Status string
+}
+
+// Calendar holds the details of an invitation, taken from the first event of the ICS
+type Calendar struct {
+	// Method is the iTIP method, eg. REQUEST, CANCEL or REPLY
+	Method    string
+	UID       string
+	Summary   string
+	Organizer CalendarAddress
+	Attendees []CalendarAddress
+	Start     time.Time
+	End       time.Time
+	// AllDay is true when the start is a date without a time
+	AllDay bool
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: calendar
+// ----------------------------------------------------------------------------------
+// Description   : Looks for a text/calendar part (an ICS invitation) in the message,
+//               : and parses the method, organizer, attendees, start/end and UID of
+//               : the event. Messages with a malformed ICS are passed through as they are
+// ----------------------------------------------------------------------------------
+// Config Options: calendar_enabled bool - turns the processor on
+//               : calendar_methods string - comma separated methods to handle,
+//               : default "REQUEST,CANCEL,REPLY"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.Values["encrypted"] - encrypted messages are skipped
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["calendar"] is set to a *Calendar
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["calendar"] = func() Decorator {
+		return CalendarParser()
+	}
+}
+
+func CalendarParser() Decorator {
+
+	var (
+		config  *CalendarConfig
+		methods map[string]bool
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&CalendarConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*CalendarConfig)
+		list := config.CalendarMethods
+		if list == "" {
+			list = "REQUEST,CANCEL,REPLY"
+		}
+		methods = make(map[string]bool)
+		for _, m := range splitList(list) {
+			methods[strings.ToUpper(m)] = true
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			// the parts of an encrypted message can't be seen
+			if task == TaskSaveMail && config.CalendarEnabled && !encrypted(e) {
+				cal, err := findCalendar(e.Data.Bytes())
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Debug("could not parse the calendar")
+				} else if cal != nil && methods[cal.Method] {
+					e.Values[ValueCalendar] = cal
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// findCalendar returns the calendar from the first text/calendar part of the message,
+// or nil if there is none
+func findCalendar(data []byte) (*Calendar, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, err
+	}
+	return findCalendarPart(header, r.R, 0)
+}
+
+// findCalendarPart walks through the parts of a multipart message, looking for a text/calendar part
+func findCalendarPart(header textproto.MIMEHeader, body io.Reader, depth int) (*Calendar, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// no content type, the default is text/plain
+		return nil, nil
+	}
+	switch {
+	case mediaType == "text/calendar":
+		ics, err := ioutil.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+		if err != nil {
+			return nil, err
+		}
+		cal, err := parseICS(string(ics))
+		if err != nil {
+			return nil, err
+		}
+		if cal.Method == "" {
+			// the method may only be given as a Content-Type parameter
+			cal.Method = strings.ToUpper(params["method"])
+		}
+		return cal, nil
+	case strings.HasPrefix(mediaType, "multipart/") && depth < calendarMaxDepth:
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if cal, err := findCalendarPart(part.Header, part, depth+1); cal != nil || err != nil {
+				return cal, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// decodeTransfer decodes the body of a part according to its Content-Transfer-Encoding
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// icsProperty is a content line of an ICS, eg. ATTENDEE;CN=Jane:mailto:jane@example.com
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+var errICSMalformed = errors.New("malformed calendar")
+
+// parseICS parses the VCALENDAR in ics. Only the first VEVENT is used
+func parseICS(ics string) (*Calendar, error) {
+	// unfold the lines
+	ics = strings.Replace(ics, "\r\n", "\n", -1)
+	ics = strings.Replace(ics, "\n ", "", -1)
+	ics = strings.Replace(ics, "\n\t", "", -1)
+	cal := &Calendar{}
+	var inCalendar, inEvent, seenEvent bool
+	var tzStart, tzEnd string
+	for _, line := range strings.Split(ics, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		prop, err := parseICSLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case prop.name == "BEGIN" && strings.ToUpper(prop.value) == "VCALENDAR":
+			inCalendar = true
+		case !inCalendar:
+			return nil, errICSMalformed
+		case prop.name == "BEGIN" && strings.ToUpper(prop.value) == "VEVENT":
+			inEvent = !seenEvent
+		case prop.name == "END" && strings.ToUpper(prop.value) == "VEVENT":
+			if inEvent {
+				seenEvent = true
+			}
+			inEvent = false
+		case prop.name == "END" && strings.ToUpper(prop.value) == "VCALENDAR":
+			if !seenEvent {
+				return nil, errors.New("calendar has no event")
+			}
+			cal.Start = inZone(cal.Start, tzStart)
+			cal.End = inZone(cal.End, tzEnd)
+			return cal, nil
+		case prop.name == "METHOD" && !inEvent:
+			cal.Method = strings.ToUpper(prop.value)
+		case !inEvent:
+			// a property of the calendar, or of another component
+		case prop.name == "UID":
+			cal.UID = prop.value
+		case prop.name == "SUMMARY":
+			cal.Summary = unescapeICS(prop.value)
+		case prop.name == "ORGANIZER":
+			cal.Organizer = icsAddress(prop)
+		case prop.name == "ATTENDEE":
+			cal.Attendees = append(cal.Attendees, icsAddress(prop))
+		case prop.name == "DTSTART":
+			cal.AllDay = prop.params["VALUE"] == "DATE" || len(prop.value) == 8
+			if cal.Start, err = parseICSDate(prop); err != nil {
+				return nil, err
+			}
+			tzStart = prop.params["TZID"]
+		case prop.name == "DTEND":
+			if cal.End, err = parseICSDate(prop); err != nil {
+				return nil, err
+			}
+			tzEnd = prop.params["TZID"]
+		}
+	}
+	// END:VCALENDAR is missing
+	return nil, errICSMalformed
+}
+
+// parseICSLine splits a content line into the name, parameters and value
+func parseICSLine(line string) (*icsProperty, error) {
+	prop := &icsProperty{params: make(map[string]string)}
+	// find the colon that separates the value, skipping the quoted parameter values
+	quoted := false
+	colon := -1
+	for i := 0; i < len(line) && colon == -1; i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				colon = i
+			}
+		}
+	}
+	if colon < 1 {
+		return nil, errICSMalformed
+	}
+	prop.value = line[colon+1:]
+	parts := splitICSParams(line[:colon])
+	prop.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		if eq := strings.Index(param, "="); eq > 0 {
+			prop.params[strings.ToUpper(param[:eq])] = strings.Trim(param[eq+1:], `"`)
+		}
+	}
+	return prop, nil
+}
+
+// splitICSParams splits at the semicolons that are not quoted
+func splitICSParams(s string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// icsAddress makes a CalendarAddress from an ORGANIZER or ATTENDEE property
+func icsAddress(prop *icsProperty) CalendarAddress {
+	email := prop.value
+	if len(email) > 7 && strings.EqualFold(email[:7], "mailto:") {
+		email = email[7:]
+	}
+	return CalendarAddress{
+		Email:  email,
+		Name:   prop.params["CN"],
+		Role:   prop.params["ROLE"],
+		Status: prop.params["PARTSTAT"],
+	}
+}
+
+// parseICSDate parses a DATE or DATE-TIME value. Times that are not in UTC are returned
+// as UTC for now, inZone moves them to their time zone
+func parseICSDate(prop *icsProperty) (time.Time, error) {
+	switch len(prop.value) {
+	case 8:
+		return time.Parse("20060102", prop.value)
+	case 15:
+		return time.Parse("20060102T150405", prop.value)
+	case 16:
+		return time.Parse("20060102T150405Z", prop.value)
+	}
+	return time.Time{}, errors.New("invalid calendar date: " + prop.value)
+}
+
+// inZone moves t to the time zone tzid, t is unchanged if the zone is not known
+func inZone(t time.Time, tzid string) time.Time {
+	if tzid == "" || t.IsZero() {
+		return t
+	}
+	loc, err := time.LoadLocation(tzid)
+	if err != nil {
+		// eg. a Windows time zone name, keep the time as it is
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+}
+
+// unescapeICS removes the escaping of TEXT values
+func unescapeICS(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
@@ -0,0 +1,133 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const testMeetingRequest = `From: Alice <alice@example.com>
+To: bob@example.com
+Subject: Invitation: Planning
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+
+You are invited to Planning
+--inner
+Content-Type: text/calendar; charset=utf-8; method=REQUEST
+Content-Transfer-Encoding: quoted-printable
+
+BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Test//EN
+METHOD:REQUEST
+BEGIN:VTIMEZONE
+TZID:Europe/Berlin
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:abc-123@example.com
+SUMMARY:Planning\, Q3
+ORGANIZER;CN=3DAlice:mailto:alice@example.com
+ATTENDEE;CN=3D"Bob; Builder";ROLE=3DREQ-PARTICIPANT;PARTSTAT=3DNEEDS-ACTION:=
+mailto:bob@example.com
+ATTENDEE;CN=3DCarol;ROLE=3DOPT-PARTICIPANT;PARTSTAT=3DACCEPTED:mailto:carol@=
+example.com
+DTSTART;TZID=3DEurope/Berlin:20170612T100000
+DTEND:20170612T090000Z
+END:VEVENT
+END:VCALENDAR
+--inner--
+--outer--
+`
+
+func processCalendar(t *testing.T, p Processor, data string) *Calendar {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(data)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("calendar processor failed:", err)
+	}
+	cal, _ := e.Values[ValueCalendar].(*Calendar)
+	return cal
+}
+
+func TestCalendarRequest(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"calendar_enabled": true}, CalendarParser)
+	cal := processCalendar(t, p, testMeetingRequest)
+	if cal == nil {
+		t.Fatal("expecting the calendar to be extracted")
+	}
+	if cal.Method != "REQUEST" || cal.UID != "abc-123@example.com" || cal.Summary != "Planning, Q3" {
+		t.Error("unexpected method, uid or summary:", cal.Method, cal.UID, cal.Summary)
+	}
+	if cal.Organizer.Email != "alice@example.com" || cal.Organizer.Name != "Alice" {
+		t.Error("unexpected organizer:", cal.Organizer)
+	}
+	if len(cal.Attendees) != 2 {
+		t.Fatal("expecting 2 attendees, got:", cal.Attendees)
+	}
+	bob := CalendarAddress{Email: "bob@example.com", Name: "Bob; Builder", Role: "REQ-PARTICIPANT", Status: "NEEDS-ACTION"}
+	if cal.Attendees[0] != bob {
+		t.Error("unexpected attendee:", cal.Attendees[0])
+	}
+	if cal.Attendees[1].Email != "carol@example.com" || cal.Attendees[1].Status != "ACCEPTED" {
+		t.Error("unexpected attendee:", cal.Attendees[1])
+	}
+	end := time.Date(2017, 6, 12, 9, 0, 0, 0, time.UTC)
+	if !cal.End.Equal(end) {
+		t.Error("unexpected end:", cal.End)
+	}
+	if _, err := time.LoadLocation("Europe/Berlin"); err == nil && !cal.Start.Equal(end.Add(-time.Hour)) {
+		// 10:00 in Berlin is 08:00 UTC in summer
+		t.Error("unexpected start:", cal.Start)
+	}
+	if cal.AllDay {
+		t.Error("the event is not all day")
+	}
+}
+
+func TestCalendarMethods(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{
+		"calendar_enabled": true,
+		"calendar_methods": "cancel, reply",
+	}, CalendarParser)
+	if cal := processCalendar(t, p, testMeetingRequest); cal != nil {
+		t.Error("REQUEST should not be handled, got:", cal)
+	}
+	// a bare calendar, the method is only in the content type
+	cancel := "Content-Type: text/calendar; method=CANCEL\n\n" +
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:1234\n 5678\nDTSTART;VALUE=DATE:20170612\nEND:VEVENT\nEND:VCALENDAR\n"
+	cal := processCalendar(t, p, cancel)
+	if cal == nil || cal.Method != "CANCEL" || cal.UID != "12345678" || !cal.AllDay {
+		t.Error("expecting an all day CANCEL, got:", cal)
+	}
+
+	p = newTestProcessor(t, BackendConfig{"calendar_enabled": false}, CalendarParser)
+	if cal := processCalendar(t, p, testMeetingRequest); cal != nil {
+		t.Error("the processor is not enabled, got:", cal)
+	}
+}
+
+func TestCalendarMalformed(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"calendar_enabled": true}, CalendarParser)
+	for _, ics := range []string{
+		"BEGIN:VCALENDAR\nMETHOD:REQUEST\nBEGIN:VEVENT\nUID:1\n",
+		"BEGIN:VCALENDAR\nMETHOD:REQUEST\nEND:VCALENDAR\n",
+		"BEGIN:VCALENDAR\nMETHOD:REQUEST\nBEGIN:VEVENT\nDTSTART:tomorrow\nEND:VEVENT\nEND:VCALENDAR\n",
+		"METHOD:REQUEST\nnot a calendar\n",
+	} {
+		if cal := processCalendar(t, p, "Content-Type: text/calendar\n\n"+ics); cal != nil {
+			t.Error("expecting no calendar for a malformed ics, got:", cal)
+		}
+	}
+	// no calendar at all
+	if cal := processCalendar(t, p, "Subject: hi\n\nhello\n"); cal != nil {
+		t.Error("expecting no calendar, got:", cal)
+	}
+}
@@ -0,0 +1,311 @@
+package backends
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default time to cache the result of a callout, if 'callout_cache_ttl' not present in config
+	calloutCacheTTL = time.Hour
+	// default timeout of a callout, if 'callout_timeout' not present in config
+	// It must be shorter than the gateway's gw_val_rcpt_timeout
+	calloutTimeout = time.Second * 4
+	// maximum number of addresses kept in a cache
+	calloutCacheMax = 10000
+)
+
+var (
+	// calloutLookupMX, calloutPort and calloutIsLocal can be changed for testing
+	calloutLookupMX = net.LookupMX
+	calloutPort     = "25"
+	calloutIsLocal  = isLocalHost
+)
+
+var errCalloutLoop = errors.New("the MX is this host")
+
+// calloutCaches holds the caches shared by the callout processors of all workers,
+// there is one cache for each callout_from & callout_helo pair
+var calloutCaches = struct {
+	sync.Mutex
+	m map[string]*calloutCache
+}{m: make(map[string]*calloutCache)}
+
+type CalloutConfig struct {
+	// CalloutEnabled turns the callout on
+	CalloutEnabled bool `json:"callout_enabled"`
+	// CalloutCacheTTL is how long to remember the result for an address, eg "1h"
+	CalloutCacheTTL string `json:"callout_cache_ttl,omitempty"`
+	// CalloutTimeout is the maximum duration of a callout, eg "10s"
+	CalloutTimeout string `json:"callout_timeout,omitempty"`
+	// CalloutFrom is the address used in the MAIL FROM of the probe, null sender if empty
+	CalloutFrom string `json:"callout_from,omitempty"`
+	// CalloutHelo is the name to use in the HELO of the probe
+	CalloutHelo string `json:"callout_helo,omitempty"`
+}
+
+type calloutResult struct {
+	exists  bool
+	expires time.Time
+}
+
+// calloutCache remembers which addresses were probed
+type calloutCache struct {
+	sync.Mutex
+	results map[string]calloutResult
+}
+
+func (c *calloutCache) get(addr string) (exists bool, found bool) {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.results[addr]
+	if !ok {
+		return false, false
+	}
+	if time.Now().After(r.expires) {
+		delete(c.results, addr)
+		return false, false
+	}
+	return r.exists, true
+}
+
+func (c *calloutCache) set(addr string, exists bool, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if len(c.results) >= calloutCacheMax {
+		// sweep the expired results
+		for key, r := range c.results {
+			if now.After(r.expires) {
+				delete(c.results, key)
+			}
+		}
+		// still full, make room by dropping any result
+		for key := range c.results {
+			if len(c.results) < calloutCacheMax {
+				break
+			}
+			delete(c.results, key)
+		}
+	}
+	c.results[addr] = calloutResult{exists: exists, expires: now.Add(ttl)}
+}
+
+// sharedCalloutCache returns the cache for the config, so that all workers use the same cache
+func sharedCalloutCache(config *CalloutConfig) *calloutCache {
+	calloutCaches.Lock()
+	defer calloutCaches.Unlock()
+	key := strings.ToLower(config.CalloutFrom + "|" + config.CalloutHelo)
+	c, ok := calloutCaches.m[key]
+	if !ok {
+		c = &calloutCache{results: make(map[string]calloutResult)}
+		calloutCaches.m[key] = c
+	}
+	return c
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: callout
+// ----------------------------------------------------------------------------------
+// Description   : Verifies that the recipient exists by probing the recipient's MX
+//               : with MAIL FROM / RCPT TO, then RSET. Only a permanent (5xx) reply
+//               : to the RCPT causes the recipient to be rejected. If the probe cannot be
+//               : completed, the recipient is accepted. Results are cached.
+//               : MX hosts that resolve to this host are not probed, to avoid loops
+// ----------------------------------------------------------------------------------
+// Config Options: callout_enabled bool - turns the callout on
+//               : callout_cache_ttl string - how long to cache results, default "1h"
+//               : callout_timeout string - maximum duration of a probe, default "4s",
+//               : shortened to fit into gw_val_rcpt_timeout
+//               : callout_from string - address for the MAIL FROM of the probe, default null sender
+//               : callout_helo string - name to use in the HELO of the probe, default "localhost"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo - the last recipient is checked
+// ----------------------------------------------------------------------------------
+// Output        : NoSuchUser error if the MX rejected the recipient
+//               : To be used in the validate_process chain
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["callout"] = func() Decorator {
+		return Callout()
+	}
+}
+
+func Callout() Decorator {
+
+	var (
+		config  *CalloutConfig
+		ttl     time.Duration
+		timeout time.Duration
+		cache   *calloutCache
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&CalloutConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*CalloutConfig)
+		ttl = calloutCacheTTL
+		if config.CalloutCacheTTL != "" {
+			if ttl, err = time.ParseDuration(config.CalloutCacheTTL); err != nil {
+				return err
+			}
+		}
+		gwConfig, err := Svc.ExtractConfig(backendConfig, BaseConfig(&GatewayConfig{}))
+		if err != nil {
+			return err
+		}
+		if timeout, err = probeTimeout(config, gwConfig.(*GatewayConfig)); err != nil {
+			return err
+		}
+		cache = sharedCalloutCache(config)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt && config.CalloutEnabled && len(e.RcptTo) > 0 {
+				rcpt := e.RcptTo[len(e.RcptTo)-1]
+				addr := strings.ToLower(rcpt.String())
+				exists, found := cache.get(addr)
+				if !found {
+					var err error
+					exists, err = callout(&rcpt, config, timeout)
+					if err != nil {
+						// could not verify, let it through
+						Log().WithError(err).WithField("rcpt", addr).Debug("callout failed")
+						return p.Process(e, task)
+					}
+					cache.set(addr, exists, ttl)
+				}
+				if !exists {
+					return NewResult(response.Canned.FailRcptCmd), NoSuchUser
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// probeTimeout returns the callout_timeout, shortened if needed so that the probe
+// finishes before the gateway gives up on the validation (gw_val_rcpt_timeout)
+func probeTimeout(config *CalloutConfig, gwConfig *GatewayConfig) (time.Duration, error) {
+	timeout := calloutTimeout
+	if config.CalloutTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(config.CalloutTimeout); err != nil {
+			return 0, err
+		}
+	}
+	gwTimeout := validateRcptTimeout
+	if gwConfig.TimeoutValidateRcpt != "" {
+		var err error
+		if gwTimeout, err = time.ParseDuration(gwConfig.TimeoutValidateRcpt); err != nil {
+			return 0, err
+		}
+	}
+	if limit := gwTimeout * 4 / 5; timeout > limit {
+		Log().Warnf("callout_timeout %s is too long for gw_val_rcpt_timeout %s, using %s", timeout, gwTimeout, limit)
+		timeout = limit
+	}
+	return timeout, nil
+}
+
+// callout probes the recipient's MX to find out if the recipient exists
+// Returns an error if none of the MX hosts could be asked
+func callout(rcpt *mail.Address, config *CalloutConfig, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	hosts := []string{rcpt.Host}
+	if mxs, err := calloutLookupMX(rcpt.Host); err == nil && len(mxs) > 0 {
+		hosts = hosts[:0]
+		for _, mx := range mxs {
+			hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+		}
+	}
+	var err error
+	for _, host := range hosts {
+		if time.Now().After(deadline) {
+			break
+		}
+		if calloutIsLocal(host) {
+			// probing ourselves would loop
+			return false, errCalloutLoop
+		}
+		var exists bool
+		if exists, err = probe(host, rcpt, config, deadline); err == nil {
+			return exists, nil
+		}
+	}
+	return false, err
+}
+
+// probe asks host if it would accept mail for rcpt
+func probe(host string, rcpt *mail.Address, config *CalloutConfig, deadline time.Time) (bool, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, calloutPort), deadline.Sub(time.Now()))
+	if err != nil {
+		return false, err
+	}
+	conn.SetDeadline(deadline)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	defer c.Close()
+	helo := config.CalloutHelo
+	if helo == "" {
+		helo = "localhost"
+	}
+	if err = c.Hello(helo); err != nil {
+		return false, err
+	}
+	if err = c.Mail(config.CalloutFrom); err != nil {
+		return false, err
+	}
+	err = c.Rcpt(rcpt.String())
+	c.Reset()
+	c.Quit()
+	if err != nil {
+		if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// isLocalHost returns true if host resolves to an address of this machine
+func isLocalHost(host string) bool {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return true
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
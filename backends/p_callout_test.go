@@ -0,0 +1,149 @@
+package backends
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// stubMX accepts any recipient except nobody@, and counts the RCPT commands it got
+func stubMX(t *testing.T, rcptCount *int32) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				conn.Write([]byte("220 stub ESMTP\r\n"))
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(line)
+					switch {
+					case strings.HasPrefix(cmd, "RCPT TO:"):
+						atomic.AddInt32(rcptCount, 1)
+						if strings.Contains(cmd, "NOBODY@") {
+							conn.Write([]byte("550 5.1.1 no such user\r\n"))
+						} else {
+							conn.Write([]byte("250 2.1.5 OK\r\n"))
+						}
+					case strings.HasPrefix(cmd, "QUIT"):
+						conn.Write([]byte("221 2.0.0 Bye\r\n"))
+						return
+					default:
+						conn.Write([]byte("250 OK\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestCallout(t *testing.T) {
+	var rcptCount int32
+	ln := stubMX(t, &rcptCount)
+	defer ln.Close()
+
+	defer func(lookup func(string) ([]*net.MX, error), port string, isLocal func(string) bool) {
+		calloutLookupMX = lookup
+		calloutPort = port
+		calloutIsLocal = isLocal
+	}(calloutLookupMX, calloutPort, calloutIsLocal)
+	calloutLookupMX = func(name string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+	}
+	_, calloutPort, _ = net.SplitHostPort(ln.Addr().String())
+	// the stub MX listens on the loopback
+	calloutIsLocal = func(host string) bool { return false }
+
+	config := BackendConfig{
+		"callout_enabled": true,
+		"callout_timeout": "2s",
+		"callout_from":    "probe-test@example.com",
+	}
+	// a processor for each of two workers
+	p := newTestProcessor(t, config, Callout)
+	p2 := newTestProcessor(t, config, Callout)
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "someone", Host: "example.com"})
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Error("recipient should be accepted, got:", err)
+	}
+	e.PushRcpt(mail.Address{User: "nobody", Host: "example.com"})
+	if _, err := p.Process(e, TaskValidateRcpt); err != NoSuchUser {
+		t.Error("recipient should be rejected with NoSuchUser, got:", err)
+	}
+	// the result is cached, and the cache is shared by the workers
+	if _, err := p.Process(e, TaskValidateRcpt); err != NoSuchUser {
+		t.Error("recipient should be rejected with NoSuchUser, got:", err)
+	}
+	if _, err := p2.Process(e, TaskValidateRcpt); err != NoSuchUser {
+		t.Error("recipient should be rejected with NoSuchUser, got:", err)
+	}
+	if n := atomic.LoadInt32(&rcptCount); n != 2 {
+		t.Error("expecting the stub MX to be probed 2 times, got:", n)
+	}
+
+	// the MX is this host, it is not probed
+	calloutIsLocal = func(host string) bool { return true }
+	e.PushRcpt(mail.Address{User: "nobody", Host: "example.net"})
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Error("recipient should be accepted when the MX is this host, got:", err)
+	}
+	if n := atomic.LoadInt32(&rcptCount); n != 2 {
+		t.Error("expecting the stub MX to be probed 2 times, got:", n)
+	}
+	calloutIsLocal = func(host string) bool { return false }
+
+	// unreachable MX, the recipient is accepted
+	ln.Close()
+	e.PushRcpt(mail.Address{User: "nobody", Host: "example.org"})
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Error("recipient should be accepted when the MX cannot be reached, got:", err)
+	}
+}
+
+func TestCalloutTimeout(t *testing.T) {
+	timeout, err := probeTimeout(&CalloutConfig{}, &GatewayConfig{})
+	if err != nil || timeout != calloutTimeout {
+		t.Error("expecting the default timeout, got:", timeout, err)
+	}
+	// too long for the gateway's validation timeout
+	timeout, err = probeTimeout(&CalloutConfig{CalloutTimeout: "10s"}, &GatewayConfig{TimeoutValidateRcpt: "5s"})
+	if err != nil || timeout != 4*time.Second {
+		t.Error("expecting the timeout to be shortened to 4s, got:", timeout, err)
+	}
+	if _, err = probeTimeout(&CalloutConfig{CalloutTimeout: "soon"}, &GatewayConfig{}); err == nil {
+		t.Error("expecting an error for an invalid callout_timeout")
+	}
+}
+
+func TestCalloutCacheMax(t *testing.T) {
+	c := &calloutCache{results: make(map[string]calloutResult)}
+	for i := 0; i < calloutCacheMax+10; i++ {
+		c.set(strconv.Itoa(i)+"@example.com", true, time.Hour)
+	}
+	if len(c.results) > calloutCacheMax {
+		t.Error("cache should not grow beyond", calloutCacheMax, "got:", len(c.results))
+	}
+	if _, found := c.get(strconv.Itoa(calloutCacheMax+9) + "@example.com"); !found {
+		t.Error("the last result should be cached")
+	}
+}
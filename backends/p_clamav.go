@@ -0,0 +1,240 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default address of clamd, if 'clamav_address' not present in config
+	clamavAddress = "localhost:3310"
+	// default time to wait for a scan, connecting included, if 'clamav_timeout' not present in config
+	clamavTimeout = time.Second * 30
+	// the size of the chunks that the message is streamed in
+	clamavChunkSize = 64 * 1024
+)
+
+// what to do with an infected message
+const (
+	clamavActionReject     = "reject"
+	clamavActionQuarantine = "quarantine"
+)
+
+// what to do when clamd fails
+const (
+	clamavOnErrorTempFail = "tempfail"
+	clamavOnErrorAccept   = "accept"
+)
+
+// ValueVirusName is the e.Values key set to the name of the virus found by clamd, when the
+// message was quarantined
+const ValueVirusName = "virus_name"
+
+var errVirusFound = errors.New("virus found")
+
+type ClamAVConfig struct {
+	// ClamAVAddress is clamd's socket, "host:port" or "unix:/path/to/socket"
+	ClamAVAddress string `json:"clamav_address,omitempty"`
+	// ClamAVTimeout is how long to wait for a scan, connecting included, eg. "30s"
+	ClamAVTimeout string `json:"clamav_timeout,omitempty"`
+	// ClamAVAction is what to do with an infected message: "reject" (default) or "quarantine"
+	ClamAVAction string `json:"clamav_action,omitempty"`
+	// ClamAVQuarantineDir is the directory that the infected messages are saved to
+	ClamAVQuarantineDir string `json:"clamav_quarantine_dir,omitempty"`
+	// ClamAVOnError is what to do when clamd fails: "tempfail" (default), fail closed, or
+	// "accept", fail open
+	ClamAVOnError string `json:"clamav_on_error,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: clamav
+// ----------------------------------------------------------------------------------
+// Description   : Scans the message for viruses with ClamAV's clamd, streamed with the
+//               : INSTREAM command over TCP or a unix socket. An infected message is
+//               : rejected with a 554 that names the virus, or saved to the quarantine
+//               : directory instead, see the dumper. The X-Virus-Scanned header is
+//               : added to the scanned messages. When clamd cannot be reached, times
+//               : out or fails, eg. when the message is over its StreamMaxLength, the
+//               : message is deferred with a 451 (fail closed), or accepted without
+//               : being scanned with clamav_on_error "accept" (fail open)
+// ----------------------------------------------------------------------------------
+// Config Options: clamav_address string - "host:port", or "unix:/path/to/socket",
+//               : default "localhost:3310"
+//               : clamav_timeout string - how long to wait for a scan, default "30s"
+//               : clamav_action string - "reject" (default) or "quarantine" the
+//               : infected messages
+//               : clamav_quarantine_dir string - where the infected messages are
+//               : saved, needed by the "quarantine" action
+//               : clamav_on_error string - when clamd fails, "tempfail" (default) or
+//               : "accept" the message
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : the X-Virus-Scanned header is appended to e.DeliveryHeader (place
+//               : after the header processor)
+//               : e.Values[ValueQuarantineDir] & e.Values[ValueVirusName] if quarantined
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["clamav"] = func() Decorator {
+		return ClamAV()
+	}
+}
+
+// loadConfig checks the config & sets the defaults
+func (c *ClamAVConfig) loadConfig() error {
+	if c.ClamAVAddress == "" {
+		c.ClamAVAddress = clamavAddress
+	}
+	switch c.ClamAVAction {
+	case "":
+		c.ClamAVAction = clamavActionReject
+	case clamavActionReject:
+	case clamavActionQuarantine:
+		if c.ClamAVQuarantineDir == "" {
+			return errors.New("clamav_action is quarantine, clamav_quarantine_dir is required")
+		}
+	default:
+		return errors.New("invalid clamav_action: " + c.ClamAVAction)
+	}
+	switch c.ClamAVOnError {
+	case "":
+		c.ClamAVOnError = clamavOnErrorTempFail
+	case clamavOnErrorTempFail, clamavOnErrorAccept:
+	default:
+		return errors.New("invalid clamav_on_error: " + c.ClamAVOnError)
+	}
+	return nil
+}
+
+func ClamAV() Decorator {
+
+	var (
+		config  *ClamAVConfig
+		timeout time.Duration
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ClamAVConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*ClamAVConfig)
+		if err := c.loadConfig(); err != nil {
+			return err
+		}
+		timeout = clamavTimeout
+		if c.ClamAVTimeout != "" {
+			if timeout, err = time.ParseDuration(c.ClamAVTimeout); err != nil {
+				return err
+			}
+		}
+		config = c
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				virus, err := clamavScan(e, config.ClamAVAddress, timeout)
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("clamav scan failed")
+					if config.ClamAVOnError == clamavOnErrorAccept {
+						return p.Process(e, task)
+					}
+					return NewResult(response.Canned.ErrorBackendTransaction + "virus scan failed"), NewRetryableError(err)
+				}
+				if virus != "" {
+					if config.ClamAVAction == clamavActionReject {
+						Log().WithField("ip", e.RemoteIP).WithField("queued_id", e.QueuedId).Info("message rejected, infected by ", virus)
+						return NewResult(response.Canned.FailVirusFound + " " + virus), errVirusFound
+					}
+					Log().WithField("queued_id", e.QueuedId).Info("message quarantined, infected by ", virus)
+					e.Values[ValueQuarantineDir] = config.ClamAVQuarantineDir
+					e.Values[ValueVirusName] = virus
+					e.DeliveryHeader += "X-Virus-Scanned: ClamAV\nX-Virus-Status: Infected (" + virus + ")\n"
+				} else {
+					e.DeliveryHeader += "X-Virus-Scanned: ClamAV\n"
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// clamavScan streams e.Data to clamd with INSTREAM, and returns the name of the virus
+// found, or "" if the message is clean
+func clamavScan(e *mail.Envelope, address string, timeout time.Duration) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := e.Context().Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(e.Context(), network, address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+	w := bufio.NewWriterSize(conn, clamavChunkSize+4)
+	// the z prefix: the command & the reply end with a NUL
+	w.WriteString("zINSTREAM\x00")
+	data := e.Data.Bytes()
+	var size [4]byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > clamavChunkSize {
+			n = clamavChunkSize
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		if _, err := w.Write(data[:n]); err != nil {
+			// clamd closes the connection when the stream is over its limit, read its reply
+			break
+		}
+		data = data[n:]
+	}
+	// a chunk of size 0 ends the stream
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	w.Flush()
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", err
+	}
+	return parseClamavReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamavReply returns the virus of the reply, eg. "stream: Eicar-Signature FOUND",
+// "" for "stream: OK", or the error of clamd, eg. "INSTREAM size limit exceeded. ERROR"
+func parseClamavReply(reply string) (string, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		virus := strings.TrimSuffix(reply, " FOUND")
+		if i := strings.Index(virus, ": "); i != -1 {
+			virus = virus[i+2:]
+		}
+		return virus, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return "", nil
+	default:
+		return "", errors.New("clamd error: " + reply)
+	}
+}
@@ -0,0 +1,186 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const clamavTestEICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// clamavTestServer is a clamd that finds the EICAR test file, is over its limit from
+// maxSize & takes delay to reply
+type clamavTestServer struct {
+	net.Listener
+	maxSize int
+	delay   time.Duration
+	chunks  []int
+	sync.Mutex
+}
+
+func newClamavTestServer(t *testing.T, network, address string) *clamavTestServer {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &clamavTestServer{Listener: l, maxSize: 1 << 20}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *clamavTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if cmd, _ := r.ReadString(0); cmd != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var data []byte
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint32(size[:]))
+		if n == 0 {
+			break
+		}
+		if len(data)+n > s.maxSize {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+		s.Lock()
+		s.chunks = append(s.chunks, n)
+		s.Unlock()
+	}
+	time.Sleep(s.delay)
+	if strings.Contains(string(data), clamavTestEICAR) {
+		conn.Write([]byte("stream: Win.Test.EICAR_HDB-1 FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamAV(t *testing.T) {
+	s := newClamavTestServer(t, "tcp", "127.0.0.1:0")
+	defer s.Close()
+	p := newTestProcessor(t, BackendConfig{"clamav_address": s.Addr().String()}, ClamAV)
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\n"+strings.Repeat("x", 100*1024), "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be accepted, got:", err)
+	}
+	if e.DeliveryHeader != "X-Virus-Scanned: ClamAV\n" {
+		t.Errorf("unexpected headers: %q", e.DeliveryHeader)
+	}
+	s.Lock()
+	if len(s.chunks) != 2 || s.chunks[0] != clamavChunkSize {
+		t.Error("expecting the message in 2 chunks, got:", s.chunks)
+	}
+	s.Unlock()
+
+	e = newAccountingEnvelope("alice@example.com", "Subject: test\n\n"+clamavTestEICAR+"\n", "bob@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if err == nil || result.String() != response.Canned.FailVirusFound+" Win.Test.EICAR_HDB-1" {
+		t.Error("expecting the message to be rejected, got:", result, err)
+	}
+
+	// over the limit of clamd, fails closed
+	s.maxSize = 1024
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\n"+strings.Repeat("x", 100*1024), "bob@example.org")
+	result, err = p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+}
+
+func TestClamAVQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clamav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newClamavTestServer(t, "unix", filepath.Join(dir, "clamd.sock"))
+	defer s.Close()
+	p := newTestProcessor(t, BackendConfig{
+		"clamav_address":        "unix:" + filepath.Join(dir, "clamd.sock"),
+		"clamav_action":         "quarantine",
+		"clamav_quarantine_dir": dir,
+		"clamav_timeout":        "50ms",
+		"clamav_on_error":       "accept",
+	}, ClamAV)
+	e := newAccountingEnvelope("alice@example.com", "Subject: test\n\n"+clamavTestEICAR+"\n", "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be quarantined, got:", err)
+	}
+	if e.Values[ValueQuarantineDir] != dir || e.Values[ValueVirusName] != "Win.Test.EICAR_HDB-1" ||
+		!strings.Contains(e.DeliveryHeader, "X-Virus-Status: Infected (Win.Test.EICAR_HDB-1)\n") {
+		t.Error("unexpected quarantine:", e.Values, e.DeliveryHeader)
+	}
+
+	// timed out, fails open
+	s.delay = time.Millisecond * 200
+	e = newAccountingEnvelope("alice@example.com", "Subject: test\n\n"+clamavTestEICAR+"\n", "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.DeliveryHeader != "" {
+		t.Error("expecting the message to be accepted without being scanned, got:", err, e.DeliveryHeader)
+	}
+}
+
+func TestClamAVReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		virus string
+		err   string
+	}{
+		{"stream: OK", "", ""},
+		{"stream: Eicar-Signature FOUND", "Eicar-Signature", ""},
+		{"INSTREAM size limit exceeded. ERROR", "", "size limit exceeded"},
+		{"UNKNOWN COMMAND", "", "clamd error"},
+	}
+	for _, test := range tests {
+		virus, err := parseClamavReply(test.reply)
+		if virus != test.virus || (test.err == "") != (err == nil) || err != nil && !strings.Contains(err.Error(), test.err) {
+			t.Errorf("unexpected result of %q: %q %v", test.reply, virus, err)
+		}
+	}
+}
+
+func TestClamAVConfig(t *testing.T) {
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"clamav_action": "delete"}, "invalid clamav_action"},
+		{BackendConfig{"clamav_action": "quarantine"}, "clamav_quarantine_dir is required"},
+		{BackendConfig{"clamav_on_error": "reject"}, "invalid clamav_on_error"},
+		{BackendConfig{"clamav_timeout": "soon"}, "invalid duration"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, ClamAV)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
@@ -2,10 +2,16 @@ package backends
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
-	"github.com/flashmob/go-guerrilla/mail"
+	"errors"
 	"io"
+	"io/ioutil"
+	"strings"
 	"sync"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/klauspost/compress/zstd"
 )
 
 // ----------------------------------------------------------------------------------
@@ -13,7 +19,10 @@ import (
 // ----------------------------------------------------------------------------------
 // Description   : Compress the e.Data (email data) and e.DeliveryHeader together
 // ----------------------------------------------------------------------------------
-// Config Options: None
+// Config Options: compressor_algorithm string - "zlib" (default), "gzip" or "zstd"
+//               : compressor_level int - the level of the algorithm, eg. 1-9 for zlib
+//               : & gzip, 1-22 for zstd. The default is the fastest level for zlib &
+//               : gzip, and the default level of zstd
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data, e.DeliveryHeader generated by Header() processor
 // ----------------------------------------------------------------------------------
@@ -22,7 +31,10 @@ import (
 //               : eg. fmt.Println("%s", e.Info["zlib-compressor"])
 //               : or just call the String() func .Info["zlib-compressor"].String()
 //               : Note that it can only be outputted once. It destroys the buffer
-//               : after being printed
+//               : after being printed. The key is the same for all the algorithms
+//               : e.Values["compression"] is set to the algorithm, so that the data can
+//               : be read back with Decompress. It is "none" if the algorithm is not
+//               : available, then no compressor is set
 // ----------------------------------------------------------------------------------
 func init() {
 	processors["compressor"] = func() Decorator {
@@ -30,12 +42,91 @@ func init() {
 	}
 }
 
-// compressedData struct will be compressed using zlib when printed via fmt
+const (
+	CompressionZlib = "zlib"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// ValueCompression is the e.Values key set to the algorithm that the data was compressed with
+const ValueCompression = "compression"
+
+// compressionWriter returns a writer that compresses to w at the level, 0 for the default level
+type compressionWriter func(w io.Writer, level int) (io.WriteCloser, error)
+
+// compressionReader returns a reader that decompresses r
+type compressionReader func(r io.Reader) (io.ReadCloser, error)
+
+var compressionWriters = map[string]compressionWriter{
+	CompressionZlib: func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = zlib.BestSpeed
+		}
+		return zlib.NewWriterLevel(w, level)
+	},
+	CompressionGzip: func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = gzip.BestSpeed
+		}
+		return gzip.NewWriterLevel(w, level)
+	},
+	CompressionZstd: func(w io.Writer, level int) (io.WriteCloser, error) {
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			if level < 1 || level > 22 {
+				return nil, errors.New("invalid zstd level")
+			}
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		// the data is compressed in one go, no need for concurrency
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+	},
+}
+
+var compressionReaders = map[string]compressionReader{
+	CompressionZlib: zlib.NewReader,
+	CompressionGzip: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	CompressionZstd: func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+	CompressionNone: func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(r), nil
+	},
+}
+
+// Decompress returns a reader of the data in r, compressed with the algorithm
+// that the compressor put in e.Values["compression"]
+func Decompress(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	newReader, ok := compressionReaders[strings.ToLower(algorithm)]
+	if !ok {
+		return nil, errors.New("unknown compression: " + algorithm)
+	}
+	return newReader(r)
+}
+
+type CompressorConfig struct {
+	// CompressorAlgorithm is "zlib" (default), "gzip" or "zstd"
+	CompressorAlgorithm string `json:"compressor_algorithm,omitempty"`
+	// CompressorLevel is the compression level, 0 for the default of the algorithm
+	CompressorLevel int `json:"compressor_level,omitempty"`
+}
+
+// compressedData struct will be compressed using zlib, or the configured algorithm, when printed via fmt
 type compressor struct {
 	extraHeaders []byte
 	data         *bytes.Buffer
 	// the pool is used to recycle buffers to ease up on the garbage collector
 	pool *sync.Pool
+	// newWriter & level are used to compress, zlib at the fastest level if not set
+	newWriter compressionWriter
+	level     int
 }
 
 // newCompressedData returns a new CompressedData
@@ -49,7 +140,8 @@ func newCompressor() *compressor {
 		},
 	}
 	return &compressor{
-		pool: &p,
+		pool:      &p,
+		newWriter: compressionWriters[CompressionZlib],
 	}
 }
 
@@ -75,7 +167,11 @@ func (c *compressor) String() string {
 	}()
 
 	var r *bytes.Reader
-	w, _ := zlib.NewWriterLevel(b, zlib.BestSpeed)
+	w, err := c.newWriter(b, c.level)
+	if err != nil {
+		// the level was checked when the processor was initialized
+		return ""
+	}
 	r = bytes.NewReader(c.extraHeaders)
 	io.Copy(w, r)
 	io.Copy(w, c.data)
@@ -90,13 +186,55 @@ func (c *compressor) clear() {
 }
 
 func Compressor() Decorator {
+
+	var (
+		algorithm string
+		level     int
+		newWriter compressionWriter
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&CompressorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*CompressorConfig)
+		algorithm = strings.ToLower(config.CompressorAlgorithm)
+		if algorithm == "" {
+			algorithm = CompressionZlib
+		}
+		level = config.CompressorLevel
+		newWriter = compressionWriters[algorithm]
+		if newWriter == nil {
+			Log().WithField("algorithm", algorithm).Warn("compression algorithm not available, not compressing")
+			algorithm = CompressionNone
+			return nil
+		}
+		// try the level
+		if w, err := newWriter(ioutil.Discard, level); err != nil {
+			Log().WithError(err).WithField("algorithm", algorithm).
+				Warn("compression level not available, not compressing")
+			algorithm = CompressionNone
+			newWriter = nil
+		} else {
+			w.Close()
+		}
+		return nil
+	}))
+
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
-				compressor := newCompressor()
-				compressor.set([]byte(e.DeliveryHeader), &e.Data)
-				// put the pointer in there for other processors to use later in the line
-				e.Values["zlib-compressor"] = compressor
+				e.Values[ValueCompression] = algorithm
+				if newWriter != nil {
+					compressor := newCompressor()
+					compressor.newWriter = newWriter
+					compressor.level = level
+					compressor.set([]byte(e.DeliveryHeader), &e.Data)
+					// put the pointer in there for other processors to use later in the line
+					e.Values["zlib-compressor"] = compressor
+				}
 				// continue to the next Processor in the decorator stack
 				return p.Process(e, task)
 			} else {
@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// compress runs the compressor with the config and returns the compressed data
+// and the algorithm it recorded
+func compress(t *testing.T, config BackendConfig, e *mail.Envelope) (string, string) {
+	p := newTestProcessor(t, config, Compressor)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	algorithm, _ := e.Values[ValueCompression].(string)
+	c, ok := e.Values["zlib-compressor"].(*compressor)
+	if !ok {
+		return "", algorithm
+	}
+	return c.String(), algorithm
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	header := "Received: from mx.example.com\n"
+	body := "Subject: test\n\n" + strings.Repeat("hello compression ", 200)
+	for _, c := range []struct {
+		algorithm string
+		level     int
+	}{
+		{"", 0},
+		{CompressionZlib, 9},
+		{CompressionGzip, 0},
+		{CompressionGzip, 6},
+		{CompressionZstd, 0},
+		{CompressionZstd, 19},
+	} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.DeliveryHeader = header
+		e.Data.WriteString(body)
+		compressed, algorithm := compress(t, BackendConfig{
+			"compressor_algorithm": c.algorithm,
+			"compressor_level":     c.level,
+		}, e)
+		expected := c.algorithm
+		if expected == "" {
+			expected = CompressionZlib
+		}
+		if algorithm != expected {
+			t.Error("expecting", expected, "got:", algorithm)
+			continue
+		}
+		if len(compressed) == 0 || len(compressed) >= len(header+body) {
+			t.Error(algorithm, "did not compress, got length:", len(compressed))
+		}
+		r, err := Decompress(algorithm, bytes.NewReader([]byte(compressed)))
+		if err != nil {
+			t.Error(algorithm, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(b) != header+body {
+			t.Error(algorithm, "did not round-trip, got:", string(b), err)
+		}
+	}
+}
+
+func TestCompressorUnavailable(t *testing.T) {
+	for _, config := range []BackendConfig{
+		{"compressor_algorithm": "brotli"},
+		{"compressor_algorithm": "gzip", "compressor_level": 42},
+	} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString("Subject: test\n\nhello\n")
+		compressed, algorithm := compress(t, config, e)
+		if algorithm != CompressionNone || compressed != "" {
+			t.Error("expecting no compression for", config, "got:", algorithm)
+		}
+		r, err := Decompress(algorithm, &e.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(r); string(b) != "Subject: test\n\nhello\n" {
+			t.Error("expecting the data as is, got:", string(b))
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// ValueContentTags is the e.Values key set to the names of the contentfilter rules that
+	// tagged the message, a []string
+	ValueContentTags = "content_tags"
+	// ValueQuarantineDir is the e.Values key set to the directory that the message is to be saved
+	// to instead, when a contentfilter rule quarantined it. The dumper processor saves it there
+	ValueQuarantineDir = "quarantine_dir"
+)
+
+// the fields of a message that a content rule matches
+const (
+	contentFieldSubject = "subject"
+	contentFieldHeader  = "header"
+	contentFieldBody    = "body"
+)
+
+// what a content rule does to a message that it matches
+const (
+	contentActionReject     = "reject"
+	contentActionTag        = "tag"
+	contentActionQuarantine = "quarantine"
+)
+
+var errContentRejected = errors.New("message content rejected")
+
+// ContentRule is a rule of the content_filter_rules
+type ContentRule struct {
+	// Name names the rule in the logs & the X-Spam-Rule header, "rule <n>" by default
+	Name string `json:"name,omitempty"`
+	// Field is "subject", "header" or "body"
+	Field string `json:"field"`
+	// Header is the name of the header field to match, eg. "From", when the Field is "header".
+	// The whole header is matched if empty
+	Header string `json:"header,omitempty"`
+	// Regex is matched against the field, eg. "(?i)verify your account"
+	Regex string `json:"regex"`
+	// Action is "reject", "tag" or "quarantine"
+	Action string `json:"action"`
+}
+
+type ContentFilterConfig struct {
+	// Rules are checked in order
+	Rules []ContentRule `json:"content_filter_rules,omitempty"`
+	// RejectReply is the reply to the messages that a rule rejects, must be a 550, eg.
+	// "550 5.7.1 Phishing is not welcome here". The canned FailContentRejected by default
+	RejectReply string `json:"content_filter_reject_reply,omitempty"`
+	// QuarantineDir is the directory that the quarantined messages are saved to,
+	// needed by the rules with the "quarantine" action
+	QuarantineDir string `json:"content_filter_quarantine_dir,omitempty"`
+}
+
+// contentRule is a ContentRule ready to match
+type contentRule struct {
+	ContentRule
+	regex *regexp.Regexp
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: contentfilter
+// ----------------------------------------------------------------------------------
+// Description   : Checks the message against an ordered list of rules, each matching a
+//               : regexp against the subject, the header or the body. The message is
+//               : rejected by the first "reject" rule that matches. "tag" rules add the
+//               : X-Spam-Flag & X-Spam-Rule headers. "quarantine" rules have the
+//               : message saved to the quarantine directory instead, see the dumper.
+//               : The body is matched as it was sent, it is not decoded
+// ----------------------------------------------------------------------------------
+// Config Options: content_filter_rules array - the rules, eg.
+//               : [{"name": "phish", "field": "subject", "regex": "(?i)verify your
+//               : account", "action": "reject"}], "field" is "subject", "header" or
+//               : "body", "header" names a header field to match, eg. "From".
+//               : "action" is "reject", "tag" or "quarantine"
+//               : content_filter_reject_reply string - the 550 reply to rejected
+//               : messages, default "550 5.7.1 Error: message content rejected"
+//               : content_filter_quarantine_dir string - where the quarantined messages
+//               : are saved, needed by the "quarantine" rules
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.Header & e.Subject, parsed if the headersparser processor didn't
+// ----------------------------------------------------------------------------------
+// Output        : e.Values[ValueContentTags] and the X-Spam-* headers are appended to
+//               : e.DeliveryHeader (place after the header processor)
+//               : e.Values[ValueQuarantineDir] if quarantined
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["contentfilter"] = func() Decorator {
+		return ContentFilter()
+	}
+}
+
+// loadConfig checks the config & compiles the regexps of the rules
+func (c *ContentFilterConfig) loadConfig() ([]contentRule, error) {
+	if c.RejectReply == "" {
+		c.RejectReply = response.Canned.FailContentRejected
+	} else if !strings.HasPrefix(c.RejectReply, "550 ") {
+		return nil, errors.New("content_filter_reject_reply must be a 550 reply: " + c.RejectReply)
+	}
+	rules := make([]contentRule, 0, len(c.Rules))
+	for i, r := range c.Rules {
+		if r.Name == "" {
+			r.Name = "rule " + strconv.Itoa(i+1)
+		}
+		r.Field = strings.ToLower(r.Field)
+		switch r.Field {
+		case contentFieldSubject, contentFieldBody, contentFieldHeader:
+		default:
+			return nil, fmt.Errorf("invalid field of content filter %s: %s", r.Name, r.Field)
+		}
+		r.Action = strings.ToLower(r.Action)
+		switch r.Action {
+		case contentActionReject, contentActionTag:
+		case contentActionQuarantine:
+			if c.QuarantineDir == "" {
+				return nil, fmt.Errorf("content filter %s quarantines, content_filter_quarantine_dir is required", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid action of content filter %s: %s", r.Name, r.Action)
+		}
+		regex, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex of content filter %s: %s", r.Name, err)
+		}
+		rules = append(rules, contentRule{ContentRule: r, regex: regex})
+	}
+	return rules, nil
+}
+
+// matches returns true if the rule's field of e matches its regexp
+func (r *contentRule) matches(e *mail.Envelope) bool {
+	data := e.Data.Bytes()
+	end := headerEnd(data)
+	switch r.Field {
+	case contentFieldSubject:
+		return r.regex.MatchString(e.Subject)
+	case contentFieldHeader:
+		if r.Header == "" {
+			if end == -1 {
+				return r.regex.Match(data)
+			}
+			return r.regex.Match(data[:end])
+		}
+		for _, v := range e.Header[textproto.CanonicalMIMEHeaderKey(r.Header)] {
+			if r.regex.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	default:
+		if end == -1 {
+			// only a header
+			return false
+		}
+		return r.regex.Match(data[end:])
+	}
+}
+
+func ContentFilter() Decorator {
+
+	var (
+		config *ContentFilterConfig
+		rules  []contentRule
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ContentFilterConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*ContentFilterConfig)
+		if err := configValue(backendConfig, "content_filter_rules", &c.Rules); err != nil {
+			return err
+		}
+		if rules, err = c.loadConfig(); err != nil {
+			return err
+		}
+		config = c
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail && len(rules) > 0 {
+				if e.Header == nil {
+					// the subject & the header fields are not parsed yet
+					e.ParseHeaders()
+				}
+				var tags []string
+				quarantine := false
+				for i := range rules {
+					r := &rules[i]
+					if !r.matches(e) {
+						continue
+					}
+					switch r.Action {
+					case contentActionReject:
+						Log().WithField("ip", e.RemoteIP).WithField("queued_id", e.QueuedId).
+							Info("message rejected by content filter ", r.Name)
+						return NewResult(config.RejectReply), errContentRejected
+					case contentActionTag:
+						tags = append(tags, r.Name)
+					case contentActionQuarantine:
+						if !quarantine {
+							Log().WithField("queued_id", e.QueuedId).Info("message quarantined by content filter ", r.Name)
+						}
+						quarantine = true
+					}
+				}
+				if len(tags) > 0 {
+					e.Values[ValueContentTags] = tags
+					e.DeliveryHeader += "X-Spam-Flag: YES\nX-Spam-Rule: " + strings.Join(tags, ", ") + "\n"
+				}
+				if quarantine {
+					e.Values[ValueQuarantineDir] = config.QuarantineDir
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const testContentMessage = "From: Support <support@paypa1.example>\n" +
+	"Subject: Please verify your account\n" +
+	"Content-Type: text/plain\n" +
+	"\n" +
+	"Click http://paypa1.example/login to keep your account open\n"
+
+func newContentFilterEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.Data.WriteString(testContentMessage)
+	return e
+}
+
+// contentRules returns the rules as they would be decoded from the config file
+func contentRules(rules ...map[string]interface{}) []interface{} {
+	list := make([]interface{}, len(rules))
+	for i := range rules {
+		list[i] = rules[i]
+	}
+	return list
+}
+
+func TestContentFilterFields(t *testing.T) {
+	tests := []struct {
+		rule  map[string]interface{}
+		match bool
+	}{
+		{map[string]interface{}{"field": "subject", "regex": "(?i)verify your account"}, true},
+		{map[string]interface{}{"field": "subject", "regex": "invoice"}, false},
+		{map[string]interface{}{"field": "header", "header": "from", "regex": `paypa1\.example`}, true},
+		// the Subject has it, not the From
+		{map[string]interface{}{"field": "header", "header": "From", "regex": "verify"}, false},
+		{map[string]interface{}{"field": "header", "regex": "(?m)^Content-Type: text/plain"}, true},
+		// only in the body
+		{map[string]interface{}{"field": "header", "regex": "login"}, false},
+		{map[string]interface{}{"field": "body", "regex": `http://[^/]+/login`}, true},
+		// only in the header
+		{map[string]interface{}{"field": "body", "regex": "Support"}, false},
+	}
+	for _, test := range tests {
+		test.rule["action"] = "tag"
+		p := newTestProcessor(t, BackendConfig{"content_filter_rules": contentRules(test.rule)}, ContentFilter)
+		e := newContentFilterEnvelope()
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Fatal("the message should be tagged only, got:", err)
+		}
+		if _, tagged := e.Values[ValueContentTags]; tagged != test.match {
+			t.Errorf("rule %v: expecting a match to be %v", test.rule, test.match)
+		}
+	}
+}
+
+func TestContentFilterReject(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"content_filter_rules": contentRules(
+		map[string]interface{}{"name": "link", "field": "body", "regex": "login", "action": "tag"},
+		map[string]interface{}{"name": "phish", "field": "subject", "regex": "(?i)verify", "action": "reject"},
+		map[string]interface{}{"name": "never", "field": "body", "regex": "keep", "action": "tag"},
+	)}, ContentFilter)
+	e := newContentFilterEnvelope()
+	result, err := p.Process(e, TaskSaveMail)
+	if err != errContentRejected {
+		t.Fatal("expecting the message to be rejected, got:", err)
+	}
+	if result.String() != response.Canned.FailContentRejected {
+		t.Error("expecting the canned reply, got:", result.String())
+	}
+	if e.DeliveryHeader != "" {
+		t.Error("a rejected message should not be tagged, got:", e.DeliveryHeader)
+	}
+
+	// a custom reply, and a message that no rule rejects
+	p = newTestProcessor(t, BackendConfig{
+		"content_filter_reject_reply": "550 5.7.1 Phishing is not welcome here",
+		"content_filter_rules": contentRules(
+			map[string]interface{}{"field": "subject", "regex": "(?i)verify", "action": "reject"},
+		),
+	}, ContentFilter)
+	if result, _ := p.Process(newContentFilterEnvelope(), TaskSaveMail); result.String() != "550 5.7.1 Phishing is not welcome here" {
+		t.Error("expecting the configured reply, got:", result.String())
+	}
+	e = mail.NewEnvelope("203.0.113.5", 1)
+	e.Data.WriteString("Subject: hello\n\nhi\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("the message should not be rejected, got:", err)
+	}
+}
+
+func TestContentFilterTag(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"content_filter_rules": contentRules(
+		map[string]interface{}{"name": "verify", "field": "subject", "regex": "(?i)verify", "action": "tag"},
+		map[string]interface{}{"field": "body", "regex": "invoice", "action": "tag"},
+		map[string]interface{}{"field": "body", "regex": "login", "action": "tag"},
+	)}, ContentFilter)
+	e := newContentFilterEnvelope()
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be tagged only, got:", err)
+	}
+	if tags := e.Values[ValueContentTags]; !reflect.DeepEqual(tags, []string{"verify", "rule 3"}) {
+		t.Error("expecting the message to be tagged by verify & rule 3, got:", tags)
+	}
+	if e.DeliveryHeader != "X-Spam-Flag: YES\nX-Spam-Rule: verify, rule 3\n" {
+		t.Error("expecting the X-Spam-* headers, got:", e.DeliveryHeader)
+	}
+	if _, ok := e.Values[ValueQuarantineDir]; ok {
+		t.Error("a tagged message should not be quarantined")
+	}
+}
+
+func TestContentFilterQuarantine(t *testing.T) {
+	dumps, err := ioutil.TempDir("", "contentfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dumps)
+	quarantine := filepath.Join(dumps, "quarantine")
+	if err := os.Mkdir(quarantine, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProcessor(t, BackendConfig{
+		"dumper_dir":                    dumps,
+		"content_filter_quarantine_dir": quarantine,
+		"content_filter_rules": contentRules(
+			map[string]interface{}{"field": "header", "header": "From", "regex": `paypa1\.example`, "action": "quarantine"},
+		),
+	}, Dumper, ContentFilter)
+	e := newContentFilterEnvelope()
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be quarantined, got:", err)
+	}
+	if e.Values[ValueQuarantineDir] != quarantine {
+		t.Error("expecting the message to be quarantined, got:", e.Values[ValueQuarantineDir])
+	}
+	files, _ := filepath.Glob(filepath.Join(quarantine, "*.eml"))
+	if len(files) != 1 {
+		t.Fatal("expecting the message to be dumped in the quarantine dir, got:", files)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dumps, "*.eml")); len(files) != 0 {
+		t.Error("expecting no message in the dumper dir, got:", files)
+	}
+
+	// not quarantined
+	e = mail.NewEnvelope("203.0.113.5", 1)
+	e.Data.WriteString("From: a@example.com\n\nhi\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dumps, "*.eml")); len(files) != 1 {
+		t.Error("expecting the message in the dumper dir, got:", files)
+	}
+}
+
+func TestContentFilterConfig(t *testing.T) {
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"content_filter_rules": contentRules(
+			map[string]interface{}{"field": "body", "regex": "[a-", "action": "reject"})},
+			"invalid regex"},
+		{BackendConfig{"content_filter_rules": contentRules(
+			map[string]interface{}{"field": "envelope", "regex": "a", "action": "reject"})},
+			"invalid field"},
+		{BackendConfig{"content_filter_rules": contentRules(
+			map[string]interface{}{"field": "body", "regex": "a", "action": "drop"})},
+			"invalid action"},
+		{BackendConfig{"content_filter_rules": contentRules(
+			map[string]interface{}{"field": "body", "regex": "a", "action": "quarantine"})},
+			"content_filter_quarantine_dir is required"},
+		{BackendConfig{"content_filter_reject_reply": "451 4.7.1 try later"},
+			"must be a 550 reply"},
+		{BackendConfig{"content_filter_rules": "subject"},
+			"invalid content_filter_rules"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, ContentFilter)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
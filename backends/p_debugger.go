@@ -1,16 +1,32 @@
 package backends
 
 import (
-	"github.com/flashmob/go-guerrilla/mail"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
 )
 
 // ----------------------------------------------------------------------------------
 // Processor Name: debugger
 // ----------------------------------------------------------------------------------
-// Description   : Log received emails
+// Description   : Log received emails, and optionally dump them to a directory
 // ----------------------------------------------------------------------------------
 // Config Options: log_received_mails bool - log if true
+//               : debugger_dump_dir string - if set, each email is written to
+//               : <QueuedId>.eml in this directory, with its metadata (remote IP,
+//               : MAIL FROM, RCPT TO, TLS) in <QueuedId>.json
+//               : debugger_dump_body bool - dump the body too, only the headers if false
+//               : debugger_sample_rate string - fraction of the emails to dump, from
+//               : "0.0" to "1.0", default "1.0"
 // --------------:-------------------------------------------------------------------
 // Input         : e.MailFrom, e.RcptTo, e.Header
 // ----------------------------------------------------------------------------------
@@ -22,12 +38,35 @@ func init() {
 	}
 }
 
+// the most dumps being written at once, the emails that come when all are busy are not dumped
+const debuggerDumpConcurrency = 4
+
 type debuggerConfig struct {
-	LogReceivedMails bool `json:"log_received_mails"`
+	LogReceivedMails bool   `json:"log_received_mails"`
+	DumpDir          string `json:"debugger_dump_dir,omitempty"`
+	DumpBody         bool   `json:"debugger_dump_body,omitempty"`
+	SampleRate       string `json:"debugger_sample_rate,omitempty"`
+}
+
+// debuggerMeta is written next to a dumped email
+type debuggerMeta struct {
+	QueuedId string   `json:"queued_id"`
+	RemoteIP string   `json:"remote_ip"`
+	Helo     string   `json:"helo"`
+	MailFrom string   `json:"mail_from"`
+	RcptTo   []string `json:"rcpt_to"`
+	TLS      bool     `json:"tls"`
+	Time     int64    `json:"time"`
 }
 
 func Debugger() Decorator {
-	var config *debuggerConfig
+	var (
+		config     *debuggerConfig
+		sampleRate float64
+		// limits the writes, and waits for them on shutdown
+		sem = make(chan struct{}, debuggerDumpConcurrency)
+		wg  sync.WaitGroup
+	)
 	initFunc := InitializeWith(func(backendConfig BackendConfig) error {
 		configType := BaseConfig(&debuggerConfig{})
 		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
@@ -35,9 +74,30 @@ func Debugger() Decorator {
 			return err
 		}
 		config = bcfg.(*debuggerConfig)
+		sampleRate = 1
+		if config.SampleRate != "" {
+			if sampleRate, err = strconv.ParseFloat(config.SampleRate, 64); err != nil {
+				return err
+			}
+			if sampleRate < 0 || sampleRate > 1 {
+				return errors.New("debugger_sample_rate must be between 0.0 and 1.0")
+			}
+		}
+		if config.DumpDir != "" {
+			if info, err := os.Stat(config.DumpDir); err != nil {
+				return err
+			} else if !info.IsDir() {
+				return errors.New("debugger_dump_dir is not a directory: " + config.DumpDir)
+			}
+		}
 		return nil
 	})
 	Svc.AddInitializer(initFunc)
+	// wait for the dumps being written
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		wg.Wait()
+		return nil
+	}))
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
@@ -45,6 +105,25 @@ func Debugger() Decorator {
 					Log().Infof("Mail from: %s / to: %v", e.MailFrom.String(), e.RcptTo)
 					Log().Info("Headers are:", e.Header)
 				}
+				if config.DumpDir != "" && sampleRate > 0 && rand.Float64() < sampleRate {
+					select {
+					case sem <- struct{}{}:
+						// the envelope is reused after the processors are done, so copy it
+						name, data, meta := debuggerDump(e, config.DumpBody)
+						wg.Add(1)
+						go func() {
+							defer func() {
+								<-sem
+								wg.Done()
+							}()
+							if err := writeDebuggerDump(config.DumpDir, name, data, meta); err != nil {
+								Log().WithError(err).Error("could not dump email ", name)
+							}
+						}()
+					default:
+						Log().WithField("queued_id", e.QueuedId).Debug("debugger busy, email not dumped")
+					}
+				}
 				// continue to the next Processor in the decorator stack
 				return p.Process(e, task)
 			} else {
@@ -53,3 +132,49 @@ func Debugger() Decorator {
 		})
 	}
 }
+
+// debuggerDump returns the file name, a copy of the email and its metadata
+func debuggerDump(e *mail.Envelope, withBody bool) (string, []byte, *debuggerMeta) {
+	name := filepath.Base(e.QueuedId)
+	if e.QueuedId == "" || name == "." || name == string(filepath.Separator) {
+		name = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	body := e.Data.Bytes()
+	if !withBody {
+		if end := headerEnd(body); end != -1 {
+			body = body[:end]
+		}
+	}
+	data := make([]byte, 0, len(e.DeliveryHeader)+len(body))
+	data = append(data, e.DeliveryHeader...)
+	data = append(data, body...)
+	meta := &debuggerMeta{
+		QueuedId: e.QueuedId,
+		RemoteIP: e.RemoteIP,
+		Helo:     e.Helo,
+		MailFrom: e.MailFrom.String(),
+		TLS:      e.TLS,
+		Time:     time.Now().Unix(),
+	}
+	for i := range e.RcptTo {
+		meta.RcptTo = append(meta.RcptTo, e.RcptTo[i].String())
+	}
+	return name, data, meta
+}
+
+// writeDebuggerDump writes the metadata, then the email, so that the .json
+// is there when the .eml appears
+func writeDebuggerDump(dir string, name string, data []byte, meta *debuggerMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path+".json", b, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path+".eml")
+}
@@ -0,0 +1,114 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestDebuggerDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debugger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestProcessor(t, BackendConfig{
+		"log_received_mails": false,
+		"debugger_dump_dir":  dir,
+	}, Debugger)
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.QueuedId = "dump1"
+	e.Helo = "mx.example.com"
+	e.TLS = true
+	e.MailFrom, _ = mail.NewAddress("alice@example.com")
+	rcpt, _ := mail.NewAddress("bob@example.org")
+	e.RcptTo = append(e.RcptTo, rcpt)
+	e.DeliveryHeader = "Received: from mx.example.com\n"
+	e.Data.WriteString("Subject: test\n\nthe secret body\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	// waits for the writes
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dump1.eml"))
+	if err != nil {
+		t.Fatal("expecting the email to be dumped:", err)
+	}
+	if string(b) != "Received: from mx.example.com\nSubject: test\n\n" {
+		t.Error("expecting only the headers, got:", string(b))
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, "dump1.json"))
+	if err != nil {
+		t.Fatal("expecting the metadata to be dumped:", err)
+	}
+	var meta debuggerMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.RemoteIP != "203.0.113.5" || meta.MailFrom != "alice@example.com" || !meta.TLS ||
+		len(meta.RcptTo) != 1 || meta.RcptTo[0] != "bob@example.org" {
+		t.Error("unexpected metadata:", string(b))
+	}
+}
+
+func TestDebuggerDumpBodyAndSampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debugger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		rate  string
+		count int
+	}{
+		{"1.0", debuggerDumpConcurrency},
+		{"0", 0},
+	} {
+		p := newTestProcessor(t, BackendConfig{
+			"log_received_mails":   false,
+			"debugger_dump_dir":    dir,
+			"debugger_dump_body":   true,
+			"debugger_sample_rate": c.rate,
+		}, Debugger)
+		// no more than the writes that can run at once, so that none is dropped
+		for i := 0; i < debuggerDumpConcurrency; i++ {
+			e := mail.NewEnvelope("203.0.113.5", uint64(i+1))
+			e.QueuedId = c.rate + "-" + strconv.Itoa(i)
+			e.Data.WriteString("Subject: test\n\nthe body\n")
+			p.Process(e, TaskSaveMail)
+		}
+		Svc.shutdown()
+		files, _ := filepath.Glob(filepath.Join(dir, c.rate+"-*.eml"))
+		if len(files) != c.count {
+			t.Error("expecting", c.count, "dumps at rate", c.rate, "got:", files)
+		}
+		for _, f := range files {
+			if b, _ := ioutil.ReadFile(f); !strings.Contains(string(b), "the body") {
+				t.Error("expecting the body in", f)
+			}
+		}
+	}
+}
+
+func TestDebuggerConfig(t *testing.T) {
+	for _, c := range []BackendConfig{
+		{"log_received_mails": false, "debugger_dump_dir": "/does/not/exist"},
+		{"log_received_mails": false, "debugger_sample_rate": "1.5"},
+		{"log_received_mails": false, "debugger_sample_rate": "half"},
+	} {
+		if _, errs := initTestProcessor(c, Debugger); errs == nil {
+			t.Error("expecting an error for", c)
+		}
+	}
+}
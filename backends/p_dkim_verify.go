@@ -0,0 +1,228 @@
+package backends
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// ValueDKIM is the e.Values key set to the []DKIMResult of the signatures of the message
+	ValueDKIM = "dkim"
+	// ValueAuthResults is the e.Values key of the []string of results added to the
+	// Authentication-Results header, eg. "dkim=pass header.d=example.com"
+	ValueAuthResults = "auth_results"
+)
+
+// the most signatures of a message that are checked, the others are ignored
+const dkimMaxSignatures = 8
+
+// DKIMResult is the result of a DKIM-Signature of the message
+type DKIMResult struct {
+	// Domain & Selector are the d= and the s= of the signature
+	Domain   string
+	Selector string
+	// Result is one of the DKIM* results
+	Result string
+	// Reason explains the result when the signature didn't pass
+	Reason string
+	// Signature is the b= value, its start tells the signatures apart
+	Signature string
+}
+
+type DKIMVerifyConfig struct {
+	// DKIMAuthServID names this server in the Authentication-Results header, the hostname by default
+	DKIMAuthServID string `json:"dkim_authserv_id,omitempty"`
+	// DKIMRejectDomains is a comma separated list of the domains that get rejected if their
+	// signatures fail, and none passes
+	DKIMRejectDomains string `json:"dkim_reject_domains,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dkimverify
+// ----------------------------------------------------------------------------------
+// Description   : Verifies the DKIM-Signature headers of the message, rsa-sha256 and
+//               : ed25519-sha256, and adds an Authentication-Results header with
+//               : the result of each. Expired signatures (x=) and body lengths (l=)
+//               : longer than the body are a permerror. Sets ValueSenderAuthenticated
+//               : if a signature of the From domain passes
+// ----------------------------------------------------------------------------------
+// Config Options: dkim_authserv_id string - the name of the server in the header,
+//               : the hostname by default
+//               : dkim_reject_domains string - comma separated list of domains that
+//               : are rejected when one of their signatures fails and none passes
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values[ValueDKIM] & e.Values[ValueAuthResults], and the
+//               : Authentication-Results header is appended to e.DeliveryHeader
+//               : (place after the header processor)
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dkimverify"] = func() Decorator {
+		return DKIMVerify()
+	}
+}
+
+// verifyDKIM checks the signatures of a message
+func verifyDKIM(data []byte) []DKIMResult {
+	fields, body := dkimSplit(dkimCRLF(data))
+	var results []DKIMResult
+	for _, field := range fields {
+		if !strings.EqualFold(dkimHeaderName(field), "DKIM-Signature") {
+			continue
+		}
+		if len(results) == dkimMaxSignatures {
+			break
+		}
+		var result DKIMResult
+		sig, err := parseDKIMSignature(field)
+		if sig != nil {
+			result.Domain, result.Selector = sig.domain, sig.selector
+			result.Signature = base64.StdEncoding.EncodeToString(sig.b)
+		}
+		if err == nil {
+			err = sig.verify(fields, body)
+		}
+		result.Result = dkimResult(err)
+		if err != nil {
+			result.Reason = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// fromDomain returns the domain of the From header of a message, an empty string if not found
+func fromDomain(data []byte) string {
+	fields, _ := dkimSplit(dkimCRLF(data))
+	for _, field := range fields {
+		if !strings.EqualFold(dkimHeaderName(field), "From") {
+			continue
+		}
+		value := strings.TrimSpace(field[strings.IndexByte(field, ':')+1:])
+		list, err := mail.NewAddressList(strings.Replace(value, "\r\n", "", -1))
+		if err != nil || len(list) != 1 {
+			return ""
+		}
+		return strings.ToLower(list[0].Host)
+	}
+	return ""
+}
+
+// dkimAuthResults returns the results for the Authentication-Results header
+func dkimAuthResults(results []DKIMResult) []string {
+	if len(results) == 0 {
+		return []string{"dkim=" + DKIMNone}
+	}
+	authResults := make([]string, 0, len(results))
+	for _, r := range results {
+		s := "dkim=" + r.Result
+		if r.Reason != "" {
+			s += " reason=\"" + r.Reason + "\""
+		}
+		if r.Domain != "" {
+			s += " header.d=" + r.Domain
+		}
+		if r.Selector != "" {
+			s += " header.s=" + r.Selector
+		}
+		if b := r.Signature; b != "" {
+			// the first 8 characters are enough to tell them apart, see RFC 6008
+			if len(b) > 8 {
+				b = b[:8]
+			}
+			s += " header.b=" + b
+		}
+		authResults = append(authResults, s)
+	}
+	return authResults
+}
+
+// dkimReject returns the domain to reject the message for, one of domains with a failed
+// signature and no signature that passed
+func dkimReject(results []DKIMResult, domains map[string]bool) string {
+	passed := make(map[string]bool)
+	for _, r := range results {
+		if r.Result == DKIMPass {
+			passed[r.Domain] = true
+		}
+	}
+	for _, r := range results {
+		if r.Result == DKIMFail && domains[r.Domain] && !passed[r.Domain] {
+			return r.Domain
+		}
+	}
+	return ""
+}
+
+func DKIMVerify() Decorator {
+
+	var (
+		authServID    string
+		rejectDomains map[string]bool
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&DKIMVerifyConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*DKIMVerifyConfig)
+		authServID = strings.TrimSpace(config.DKIMAuthServID)
+		if authServID == "" {
+			if authServID, err = os.Hostname(); err != nil {
+				return errors.New("dkim_authserv_id not set, and the hostname is not available: " + err.Error())
+			}
+		}
+		if strings.ContainsAny(authServID, " \t;\r\n") {
+			return errors.New("invalid dkim_authserv_id: " + authServID)
+		}
+		rejectDomains = make(map[string]bool)
+		for _, d := range splitList(config.DKIMRejectDomains) {
+			host, err := mail.ASCIIHost(d)
+			if err != nil || strings.ContainsAny(host, " \t@") {
+				return errors.New("invalid domain in dkim_reject_domains: " + d)
+			}
+			rejectDomains[strings.ToLower(host)] = true
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				results := verifyDKIM(e.Data.Bytes())
+				if domain := dkimReject(results, rejectDomains); domain != "" {
+					Log().WithField("ip", e.RemoteIP).Info("rejected message with a failed DKIM signature of ", domain)
+					return NewResult(response.Canned.FailDKIMRejected), errors.New("DKIM signature of " + domain + " failed")
+				}
+				from := fromDomain(e.Data.Bytes())
+				for _, r := range results {
+					// the signing domain is the From domain, or its parent
+					if r.Result == DKIMPass && from != "" && (from == r.Domain || strings.HasSuffix(from, "."+r.Domain)) {
+						e.Values[ValueSenderAuthenticated] = true
+					}
+				}
+				authResults := dkimAuthResults(results)
+				e.Values[ValueDKIM] = results
+				if previous, ok := e.Values[ValueAuthResults].([]string); ok {
+					e.Values[ValueAuthResults] = append(previous, authResults...)
+				} else {
+					e.Values[ValueAuthResults] = authResults
+				}
+				e.DeliveryHeader += "Authentication-Results: " + authServID + ";\n\t" +
+					strings.Join(authResults, ";\n\t") + "\n"
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
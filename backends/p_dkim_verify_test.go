@@ -0,0 +1,305 @@
+package backends
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"golang.org/x/crypto/ed25519"
+)
+
+// the key of sel._domainkey.example.com, which signed the messages below
+const dkimTestKey = "v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQCp15qeNMnUKK1rIU7O+68c0d8lzLG3kHlM15" +
+	"HzhcJAPoKKLwfZSpSPhz6eWDG9L46wOmgqhGRZrQNBCGmGMEgsFQtgyL0NPcmR3oZeqxS+ZIii45lW9vjBdo6vKyG/5Jzi" +
+	"DOlensXndws2rzbzgqyV0HP/73RV2kmlX7SegBRqqQIDAQAB"
+
+const dkimTestMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject:  Hello   there \r\n" +
+	"Date: Fri, 16 Oct 2026 10:00:00 +1100\r\n" +
+	"Message-ID: <1234@example.com>\r\n" +
+	"\r\n" +
+	"Hi Bob,\r\n" +
+	"\r\n" +
+	"this  is\tsigned. \r\n" +
+	"\r\n\r\n"
+
+// dkimTestMessage, signed with relaxed/relaxed
+const dkimTestRelaxed = "DKIM-Signature: v=1; a=rsa-sha256; q=dns/txt; c=relaxed/relaxed;\r\n" +
+	" s=sel; d=example.com; h=from:to:subject:date:message-id;\r\n" +
+	" bh=Bh467pGM/OS+nFUDSohHX/MyH+AIvjnsbja9FGvCT20=;\r\n" +
+	" b=ax3arj5WR0cO9gTpmLIy1q2RVvoY4GjZv1riQ+gdvCP/0NEkFsb1V1EmoUjxmJQ1QT8sIO\r\n" +
+	" ac3QtWrXrS/Ij23mV8ehIdgPjgw88c44mW4f7XufcQG2Qm6MGsm9FE02sztOCihSx8hu0i\r\n" +
+	" ShrkBLiLcldHMTxWcvS37xYYUq2Rkqo=\r\n" + dkimTestMessage
+
+// dkimTestMessage, signed with simple/simple
+const dkimTestSimple = "DKIM-Signature: v=1; a=rsa-sha256; q=dns/txt; c=simple/simple;\r\n" +
+	" s=sel; d=example.com; h=from:to:subject:date:message-id;\r\n" +
+	" bh=gGFy9uG7shmbA/X6/hst7pkKcdBA9hSQbg5vQvMKTeM=;\r\n" +
+	" b=bHqzm1NxuZeyWyIq9hwYVs0rd6Fvp/jbi9jyPtq29h+R1W1aDFfuyNkkChqqptfDlGrcEI\r\n" +
+	" JtFTot9vD14mfdqyYeedThL86dPtrQNCVAyQxQvRET5KEOE+otOlP90Q6gPI+C7FjhT/rS\r\n" +
+	" JTI4uiAwl4FXmDmTk4s+DkiwVwk5EvY=\r\n" + dkimTestMessage
+
+// dkimTestDNS replaces the lookups with records, the names not in records are not found
+func dkimTestDNS(records map[string]string) func() {
+	dkimLookupTXT = func(name string) ([]string, error) {
+		if record, ok := records[name]; ok {
+			if record == "SERVFAIL" {
+				return nil, errors.New("server misbehaving")
+			}
+			return []string{record}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name}
+	}
+	return func() {
+		dkimLookupTXT = net.LookupTXT
+	}
+}
+
+// dkimTestSign signs msg with an ed25519 key, with relaxed/relaxed. tags are added to the signature,
+// the body is signed up to length if it's not -1
+func dkimTestSign(msg string, key ed25519.PrivateKey, domain string, tags string, length int64) string {
+	fields, body := dkimSplit([]byte(msg))
+	canon := dkimCanonBody(body, true)
+	if length >= 0 {
+		canon = canon[:length]
+		tags += " l=" + strconv.FormatInt(length, 10) + ";"
+	}
+	bh := sha256.Sum256(canon)
+	field := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed; d=" + domain + "; s=ed;\r\n" +
+		" h=from:to:subject;" + tags + " bh=" + base64.StdEncoding.EncodeToString(bh[:]) + ";\r\n b=\r\n"
+	sum := dkimHeaderHash(crypto.SHA256, fields, []string{"from", "to", "subject"}, field, true)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, sum))
+	return strings.TrimSuffix(field, "\r\n") + sig + "\r\n" + msg
+}
+
+func newDKIMTestKey(t *testing.T) (string, ed25519.PrivateKey) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), key
+}
+
+func newDKIMEnvelope(data string) *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.Data.WriteString(data)
+	return e
+}
+
+func TestDKIMCanon(t *testing.T) {
+	field := "Subject :  Hello \t there \r\n\tagain  \r\n"
+	if c := dkimCanonHeader(field, true); c != "subject:Hello there again\r\n" {
+		t.Errorf("unexpected relaxed header: %q", c)
+	}
+	if c := dkimCanonHeader(field, false); c != field {
+		t.Errorf("unexpected simple header: %q", c)
+	}
+	for body, expect := range map[string][2]string{
+		"":                        {"\r\n", ""},
+		"\r\n\r\n":                {"\r\n", ""},
+		"a  b \r\n \r\n\r\n":      {"a  b \r\n \r\n", "a b\r\n"},
+		"a\r\n\r\nb":              {"a\r\n\r\nb\r\n", "a\r\n\r\nb\r\n"},
+		" \t leading\twhite \r\n": {" \t leading\twhite \r\n", " leading white\r\n"},
+	} {
+		if c := string(dkimCanonBody([]byte(body), false)); c != expect[0] {
+			t.Errorf("unexpected simple body for %q: %q", body, c)
+		}
+		if c := string(dkimCanonBody([]byte(body), true)); c != expect[1] {
+			t.Errorf("unexpected relaxed body for %q: %q", body, c)
+		}
+	}
+	fields, body := dkimSplit(dkimCRLF([]byte("A: 1\nB: 2\n 3\nA: 4\n\nbody\n")))
+	if len(fields) != 3 || fields[1] != "B: 2\r\n 3\r\n" || string(body) != "body\r\n" {
+		t.Errorf("unexpected split: %q %q", fields, body)
+	}
+	if selected := dkimSelectHeaders(fields, []string{"a", "c", "b", "a", "a"}); len(selected) != 3 ||
+		selected[0] != "A: 4\r\n" || selected[2] != "A: 1\r\n" {
+		t.Errorf("unexpected headers: %q", selected)
+	}
+	if s := dkimStripB("DKIM-Signature: a=x; bh=abc;\r\n b=de\r\n f; c=d\r\n"); s != "DKIM-Signature: a=x; bh=abc;\r\n b=; c=d\r\n" {
+		t.Errorf("unexpected stripped signature: %q", s)
+	}
+}
+
+func TestDKIMVerifyKnownGood(t *testing.T) {
+	defer dkimTestDNS(map[string]string{"sel._domainkey.example.com": dkimTestKey})()
+	p := newTestProcessor(t, BackendConfig{"dkim_authserv_id": "mx.example.net"}, DKIMVerify)
+	for _, data := range []string{
+		dkimTestRelaxed,
+		dkimTestSimple,
+		// as read from DATA
+		strings.Replace(dkimTestRelaxed, "\r\n", "\n", -1),
+	} {
+		e := newDKIMEnvelope(data)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Fatal(err)
+		}
+		results, _ := e.Values[ValueDKIM].([]DKIMResult)
+		if len(results) != 1 || results[0].Result != DKIMPass || results[0].Domain != "example.com" || results[0].Selector != "sel" {
+			t.Errorf("expecting the signature to pass, got: %+v", results)
+			continue
+		}
+		expect := "Authentication-Results: mx.example.net;\n\tdkim=pass header.d=example.com header.s=sel header.b=" +
+			results[0].Signature[:8] + "\n"
+		if e.DeliveryHeader != expect {
+			t.Errorf("unexpected header: %q", e.DeliveryHeader)
+		}
+		if authenticated, _ := e.Values[ValueSenderAuthenticated].(bool); !authenticated {
+			t.Error("expecting the sender to be authenticated")
+		}
+		if r, _ := e.Values[ValueAuthResults].([]string); len(r) != 1 || !strings.HasPrefix(r[0], "dkim=pass") {
+			t.Error("unexpected auth results:", r)
+		}
+	}
+	// changed on the way
+	for _, data := range []string{
+		strings.Replace(dkimTestRelaxed, "signed.", "changed.", 1),
+		strings.Replace(dkimTestSimple, "Hello", "Hullo", 1),
+		// the simple canonicalization doesn't allow a change in the white space
+		strings.Replace(dkimTestSimple, "Hi Bob,", "Hi  Bob,", 1),
+	} {
+		e := newDKIMEnvelope(data)
+		p.Process(e, TaskSaveMail)
+		results, _ := e.Values[ValueDKIM].([]DKIMResult)
+		if len(results) != 1 || results[0].Result != DKIMFail {
+			t.Errorf("expecting the signature to fail, got: %+v", results)
+		}
+		if e.Values[ValueSenderAuthenticated] != nil {
+			t.Error("the sender should not be authenticated")
+		}
+	}
+	// relaxed allows it
+	e := newDKIMEnvelope(strings.Replace(dkimTestRelaxed, "Hi Bob,", "Hi  Bob,  ", 1))
+	p.Process(e, TaskSaveMail)
+	if results, _ := e.Values[ValueDKIM].([]DKIMResult); len(results) != 1 || results[0].Result != DKIMPass {
+		t.Errorf("expecting the relaxed signature to pass, got: %+v", results)
+	}
+}
+
+func TestDKIMVerifyResults(t *testing.T) {
+	record, key := newDKIMTestKey(t)
+	otherRecord, _ := newDKIMTestKey(t)
+	defer dkimTestDNS(map[string]string{
+		"ed._domainkey.example.com":  record,
+		"ed._domainkey.example.org":  otherRecord,
+		"ed._domainkey.revoked.test": "v=DKIM1; k=ed25519; p=",
+		"ed._domainkey.temp.test":    "SERVFAIL",
+		"ed._domainkey.rsa.test":     dkimTestKey,
+	})()
+	dkimNow = func() time.Time { return time.Unix(1700000000, 0) }
+	defer func() { dkimNow = time.Now }()
+
+	msg := "From: alice@example.com\r\nTo: bob@example.org\r\nSubject: results\r\n\r\nthe body\r\n"
+	tests := []struct {
+		data   string
+		result string
+		reason string
+	}{
+		{dkimTestSign(msg, key, "example.com", "", -1), DKIMPass, ""},
+		{dkimTestSign(msg, key, "example.com", " t=1600000000; x=1800000000;", -1), DKIMPass, ""},
+		{dkimTestSign(msg, key, "example.com", " t=1600000000; x=1650000000;", -1), DKIMPermError, "signature expired"},
+		{dkimTestSign(msg, key, "example.com", " t=1600000000; x=1500000000;", -1), DKIMPermError, "x= is before t="},
+		// the signed part of the body is still there
+		{dkimTestSign(msg, key, "example.com", "", 5) + "appended\r\n", DKIMPass, ""},
+		{dkimTestSign(msg, key, "example.com", "", 0), DKIMPass, ""},
+		{strings.Replace(dkimTestSign(msg, key, "example.com", "", 5), "the body", "thebody", 1), DKIMFail, "body hash did not verify"},
+		{dkimTestSign(msg, key, "example.com", " l=100;", -1), DKIMPermError, "l= is longer than the body"},
+		{dkimTestSign(msg, key, "example.org", "", -1), DKIMFail, "signature did not verify"},
+		{dkimTestSign(msg, key, "example.net", "", -1), DKIMPermError, "no key for signature"},
+		{dkimTestSign(msg, key, "revoked.test", "", -1), DKIMPermError, "key revoked"},
+		{dkimTestSign(msg, key, "temp.test", "", -1), DKIMTempError, "key unavailable"},
+		{dkimTestSign(msg, key, "rsa.test", "", -1), DKIMPermError, "key type does not match the algorithm"},
+		{dkimTestSign(msg, key, "example.com", " i=alice@example.org;", -1), DKIMPermError, "i= domain does not match d= domain"},
+		{strings.Replace(dkimTestSign(msg, key, "example.com", "", -1), "h=from:to:subject", "h=to:subject", 1), DKIMPermError, "From header not signed"},
+		{strings.Replace(dkimTestSign(msg, key, "example.com", "", -1), "ed25519-sha256", "rsa-sha1", 1), DKIMPermError, "rsa-sha1 is not accepted"},
+	}
+	for i, test := range tests {
+		results := verifyDKIM([]byte(test.data))
+		if len(results) != 1 || results[0].Result != test.result || results[0].Reason != test.reason {
+			t.Errorf("test #%d: expecting %s (%s), got: %+v", i, test.result, test.reason, results)
+		}
+	}
+}
+
+func TestDKIMVerifyMultiple(t *testing.T) {
+	record, key := newDKIMTestKey(t)
+	otherRecord, _ := newDKIMTestKey(t)
+	defer dkimTestDNS(map[string]string{
+		"sel._domainkey.example.com": dkimTestKey,
+		"ed._domainkey.example.com":  record,
+		"ed._domainkey.mailer.test":  otherRecord,
+	})()
+	// a passing signature of example.com, and a failing one of mailer.test
+	data := dkimTestSign(dkimTestRelaxed, key, "mailer.test", "", -1)
+	data = dkimTestSign(data, key, "example.com", "", -1)
+	results := verifyDKIM([]byte(data))
+	if len(results) != 3 || results[0].Result != DKIMPass || results[1].Result != DKIMFail || results[2].Result != DKIMPass {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	p := newTestProcessor(t, BackendConfig{"dkim_authserv_id": "mx.example.net"}, DKIMVerify)
+	e := newDKIMEnvelope(data)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if h := e.DeliveryHeader; strings.Count(h, "\tdkim=") != 3 || !strings.Contains(h, ";\n\tdkim=fail reason=\"signature did not verify\" header.d=mailer.test header.s=ed") {
+		t.Errorf("unexpected header: %q", h)
+	}
+
+	// no signatures
+	e = newDKIMEnvelope(dkimTestMessage)
+	p.Process(e, TaskSaveMail)
+	if e.DeliveryHeader != "Authentication-Results: mx.example.net;\n\tdkim=none\n" {
+		t.Errorf("unexpected header: %q", e.DeliveryHeader)
+	}
+}
+
+func TestDKIMVerifyReject(t *testing.T) {
+	record, key := newDKIMTestKey(t)
+	defer dkimTestDNS(map[string]string{
+		"sel._domainkey.example.com": dkimTestKey,
+		"ed._domainkey.example.com":  record,
+		"ed._domainkey.bank.test":    record,
+	})()
+	p := newTestProcessor(t, BackendConfig{"dkim_authserv_id": "mx.example.net", "dkim_reject_domains": "bank.test, Example.com"}, DKIMVerify)
+	msg := "From: alice@bank.test\r\nTo: bob@example.org\r\nSubject: pay\r\n\r\nthe body\r\n"
+	tests := []struct {
+		data string
+		code int
+	}{
+		{dkimTestSign(msg, key, "bank.test", "", -1), 200},
+		{strings.Replace(dkimTestSign(msg, key, "bank.test", "", -1), "pay", "pay now", 1), 550},
+		// not a hard fail
+		{dkimTestSign(msg, key, "bank.test", " x=1;", -1), 200},
+		{dkimTestSign(msg, key, "other.test", "", -1), 200},
+		{strings.Replace(dkimTestRelaxed, "signed", "changed", 1), 550},
+		// another signature of the domain passes
+		{dkimTestSign(strings.Replace(dkimTestRelaxed, "Hello", "Hullo", 1), key, "example.com", "", -1), 200},
+	}
+	for i, test := range tests {
+		result, err := p.Process(newDKIMEnvelope(test.data), TaskSaveMail)
+		if result.Code() != test.code || (err != nil) != (test.code != 200) {
+			t.Errorf("test #%d: expecting %d, got: %s, %v", i, test.code, result, err)
+		}
+	}
+}
+
+func TestDKIMVerifyConfig(t *testing.T) {
+	for _, config := range []BackendConfig{
+		{"dkim_authserv_id": "mx example"},
+		{"dkim_authserv_id": "mx;example"},
+		{"dkim_reject_domains": "bank.test, bad domain"},
+	} {
+		if _, errs := initTestProcessor(config, DKIMVerify); errs == nil {
+			t.Error("expecting the config to fail:", config)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package backends
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default time to cache the result for an IP, if 'dnsbl_cache_ttl' not present in config
+	dnsblCacheTTL = time.Minute * 10
+	// default time to wait for the zones, if 'dnsbl_timeout' not present in config
+	dnsblTimeout = time.Second * 2
+	// maximum number of IPs kept in a cache
+	dnsblCacheMax = 10000
+
+	dnsblActionReject = "reject"
+	dnsblActionDefer  = "defer"
+	dnsblActionIgnore = "ignore"
+)
+
+// dnsblLookupHost can be changed for testing
+var dnsblLookupHost = net.LookupHost
+
+// dnsblCaches holds the caches shared by the dnsbl processors of all workers,
+// there is one cache for each set of zones
+var dnsblCaches = struct {
+	sync.Mutex
+	m map[string]*dnsblCache
+}{m: make(map[string]*dnsblCache)}
+
+type DNSBLConfig struct {
+	// DNSBLZones is a comma separated list of the zones to check, eg. "zen.spamhaus.org, bl.spamcop.net"
+	DNSBLZones string `json:"dnsbl_zones"`
+	// DNSWLZones is a comma separated list of allowlist zones, an IP listed there is not checked
+	DNSWLZones string `json:"dnswl_zones,omitempty"`
+	// DNSBLActions maps the results to actions, eg. "127.0.0.2=reject, 127.0.0.11=defer, 127.0.0.10=ignore"
+	DNSBLActions string `json:"dnsbl_actions,omitempty"`
+	// DNSBLTimeout is how long to wait for the zones to answer, eg "2s"
+	DNSBLTimeout string `json:"dnsbl_timeout,omitempty"`
+	// DNSBLCacheTTL is how long to remember the result for an IP, eg "10m"
+	DNSBLCacheTTL string `json:"dnsbl_cache_ttl,omitempty"`
+}
+
+type dnsblResult struct {
+	// the reply to the RCPT, empty if the IP is not blocked
+	reply   string
+	expires time.Time
+}
+
+// dnsblCache remembers the results for the IPs that were checked
+type dnsblCache struct {
+	sync.Mutex
+	results map[string]dnsblResult
+}
+
+func (c *dnsblCache) get(ip string) (reply string, found bool) {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.results[ip]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(r.expires) {
+		delete(c.results, ip)
+		return "", false
+	}
+	return r.reply, true
+}
+
+func (c *dnsblCache) set(ip string, reply string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if len(c.results) >= dnsblCacheMax {
+		// sweep the expired results
+		for key, r := range c.results {
+			if now.After(r.expires) {
+				delete(c.results, key)
+			}
+		}
+		// still full, make room by dropping any result
+		for key := range c.results {
+			if len(c.results) < dnsblCacheMax {
+				break
+			}
+			delete(c.results, key)
+		}
+	}
+	c.results[ip] = dnsblResult{reply: reply, expires: now.Add(ttl)}
+}
+
+// sharedDNSBLCache returns the cache for the config, so that all workers use the same cache
+func sharedDNSBLCache(config *DNSBLConfig) *dnsblCache {
+	dnsblCaches.Lock()
+	defer dnsblCaches.Unlock()
+	key := strings.ToLower(config.DNSBLZones + "|" + config.DNSWLZones + "|" + config.DNSBLActions)
+	c, ok := dnsblCaches.m[key]
+	if !ok {
+		c = &dnsblCache{results: make(map[string]dnsblResult)}
+		dnsblCaches.m[key] = c
+	}
+	return c
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dnsbl
+// ----------------------------------------------------------------------------------
+// Description   : Checks the IP of the client against DNS blocklists (RBL), eg.
+//               : zen.spamhaus.org, and rejects the recipients if it is listed.
+//               : IPs listed on an allowlist zone (DNSWL) are not checked. The zones are
+//               : queried at once, a zone that does not answer in time is skipped.
+//               : Results are cached, unless a zone was skipped
+// ----------------------------------------------------------------------------------
+// Config Options: dnsbl_zones string - comma separated list of the blocklist zones
+//               : dnswl_zones string - comma separated list of the allowlist zones
+//               : dnsbl_actions string - what to do for each result, eg.
+//               : "127.0.0.2=reject, 127.0.0.11=defer, 127.0.0.10=ignore". Results not
+//               : listed are rejected, results outside of 127.0.0.0/8 are ignored
+//               : dnsbl_timeout string - how long to wait for the zones, default "2s"
+//               : dnsbl_cache_ttl string - how long to cache results, default "10m"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP
+// ----------------------------------------------------------------------------------
+// Output        : RcptReply error with a 554 reply ("reject") or a 451 reply ("defer")
+//               : if the IP is listed
+//               : To be used in the validate_process chain
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dnsbl"] = func() Decorator {
+		return DNSBL()
+	}
+}
+
+func DNSBL() Decorator {
+
+	var (
+		blZones []string
+		wlZones []string
+		actions map[string]string
+		timeout time.Duration
+		ttl     time.Duration
+		cache   *dnsblCache
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&DNSBLConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*DNSBLConfig)
+		blZones = splitList(config.DNSBLZones)
+		wlZones = splitList(config.DNSWLZones)
+		if len(blZones) == 0 {
+			return errors.New("dnsbl_zones cannot be empty")
+		}
+		actions = make(map[string]string)
+		for _, item := range splitList(config.DNSBLActions) {
+			kv := strings.SplitN(item, "=", 2)
+			var result net.IP
+			if len(kv) == 2 {
+				result = net.ParseIP(strings.TrimSpace(kv[0]))
+			}
+			if result == nil {
+				return errors.New("invalid dnsbl_actions: " + item)
+			}
+			action := strings.ToLower(strings.TrimSpace(kv[1]))
+			switch action {
+			case dnsblActionReject, dnsblActionDefer, dnsblActionIgnore:
+			default:
+				return errors.New("invalid action in dnsbl_actions: " + action)
+			}
+			actions[result.String()] = action
+		}
+		timeout = dnsblTimeout
+		if config.DNSBLTimeout != "" {
+			if timeout, err = time.ParseDuration(config.DNSBLTimeout); err != nil {
+				return err
+			}
+		}
+		ttl = dnsblCacheTTL
+		if config.DNSBLCacheTTL != "" {
+			if ttl, err = time.ParseDuration(config.DNSBLCacheTTL); err != nil {
+				return err
+			}
+		}
+		cache = sharedDNSBLCache(config)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt {
+				reply, found := cache.get(e.RemoteIP)
+				if !found {
+					var complete bool
+					reply, complete = dnsblCheck(e.RemoteIP, blZones, wlZones, actions, timeout)
+					// a zone that timed out may list the IP, ask again next time
+					if complete {
+						cache.set(e.RemoteIP, reply, ttl)
+					}
+				}
+				if reply != "" {
+					return NewResult(reply), RcptReply(reply)
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// dnsblReverse returns the labels for ip to prepend to a zone, eg. "4.3.2.1" for 1.2.3.4,
+// or the nibbles in reverse for an IPv6 address. Returns "" if ip is not valid
+func dnsblReverse(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return net.IPv4(v4[3], v4[2], v4[1], v4[0]).String()
+	}
+	const hex = "0123456789abcdef"
+	labels := make([]byte, 0, 64)
+	for i := len(addr) - 1; i >= 0; i-- {
+		labels = append(labels, hex[addr[i]&0xf], '.', hex[addr[i]>>4], '.')
+	}
+	return string(labels[:len(labels)-1])
+}
+
+// dnsblListed queries the zones at once, and returns the results of each zone where the IP
+// is listed. Zones that don't answer before the deadline are left out, complete is false then
+func dnsblListed(reversed string, zones []string, deadline time.Time) (listed map[string][]string, complete bool) {
+	type answer struct {
+		zone  string
+		addrs []string
+	}
+	// buffered, so that the lookups that come too late don't block
+	answers := make(chan answer, len(zones))
+	// the lookups may outlive the deadline, they use a copy of dnsblLookupHost
+	lookup := dnsblLookupHost
+	for _, zone := range zones {
+		go func(zone string) {
+			addrs, err := lookup(reversed + "." + zone)
+			if err != nil {
+				// not listed, or the zone is not working
+				addrs = nil
+			}
+			answers <- answer{zone, addrs}
+		}(zone)
+	}
+	listed = make(map[string][]string)
+	expired := time.After(deadline.Sub(time.Now()))
+	for range zones {
+		select {
+		case a := <-answers:
+			if len(a.addrs) > 0 {
+				listed[a.zone] = a.addrs
+			}
+		case <-expired:
+			Log().WithField("query", reversed).Debug("dnsbl zones did not answer in time")
+			return listed, false
+		}
+	}
+	return listed, true
+}
+
+// dnsblCheck returns the reply for an IP that is blocked, or "" if the IP is allowed.
+// complete is false if a zone did not answer in time, the reply should not be cached then
+func dnsblCheck(ip string, blZones, wlZones []string, actions map[string]string, timeout time.Duration) (reply string, complete bool) {
+	reversed := dnsblReverse(ip)
+	if reversed == "" {
+		return "", true
+	}
+	// the allowlist & the blocklist share the timeout
+	deadline := time.Now().Add(timeout)
+	complete = true
+	if len(wlZones) > 0 {
+		allowed, wlComplete := dnsblListed(reversed, wlZones, deadline)
+		if len(allowed) > 0 {
+			return "", true
+		}
+		complete = wlComplete
+	}
+	listed, blComplete := dnsblListed(reversed, blZones, deadline)
+	complete = complete && blComplete
+	// in the order of the config, a rejection wins over a deferral
+	for _, zone := range blZones {
+		for _, addr := range listed[zone] {
+			result := net.ParseIP(addr)
+			if result == nil || result.To4() == nil || result.To4()[0] != 127 {
+				// not a listing, eg. an error code
+				continue
+			}
+			action, ok := actions[result.String()]
+			if !ok {
+				action = dnsblActionReject
+			}
+			switch action {
+			case dnsblActionReject:
+				Log().WithField("ip", ip).WithField("zone", zone).Info("blocked by dnsbl: ", addr)
+				return response.Canned.FailBlocklisted + " " + zone, complete
+			case dnsblActionDefer:
+				if reply == "" {
+					reply = response.Canned.ErrorBlocklisted + " " + zone
+				}
+			}
+		}
+	}
+	if reply != "" {
+		Log().WithField("ip", ip).Info("deferred by dnsbl: ", reply)
+	}
+	return reply, complete
+}
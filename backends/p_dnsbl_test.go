@@ -0,0 +1,152 @@
+package backends
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// mockDNSBL returns a lookup with canned A records, and counts the queries
+func mockDNSBL(records map[string][]string, queries *int32) func(string) ([]string, error) {
+	return func(host string) ([]string, error) {
+		atomic.AddInt32(queries, 1)
+		if host == "2.0.0.127.slow.example.org" {
+			time.Sleep(time.Second)
+		}
+		if addrs, ok := records[host]; ok {
+			return addrs, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+}
+
+func newDNSBLProcessor(t *testing.T, c BackendConfig) Processor {
+	// start with empty caches
+	dnsblCaches.m = make(map[string]*dnsblCache)
+	return newTestProcessor(t, c, DNSBL)
+}
+
+func newDNSBLEnvelope(ip string) *mail.Envelope {
+	e := mail.NewEnvelope(ip, 1)
+	e.RcptTo = []mail.Address{{User: "bob", Host: "example.com"}}
+	return e
+}
+
+func TestDNSBLReverse(t *testing.T) {
+	if r := dnsblReverse("203.0.113.5"); r != "5.113.0.203" {
+		t.Error("unexpected reversed IPv4:", r)
+	}
+	if r := dnsblReverse("2001:db8::1"); r != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2" {
+		t.Error("unexpected reversed IPv6:", r)
+	}
+	if r := dnsblReverse("not an ip"); r != "" {
+		t.Error("expecting nothing for an invalid IP, got:", r)
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	var queries int32
+	defer func(lookup func(string) ([]string, error)) {
+		dnsblLookupHost = lookup
+	}(dnsblLookupHost)
+	dnsblLookupHost = mockDNSBL(map[string][]string{
+		"5.113.0.203.bl.example.org":   {"127.0.0.2"},
+		"6.113.0.203.bl.example.org":   {"127.0.0.10"},
+		"7.113.0.203.bl.example.org":   {"127.0.0.11"},
+		"8.113.0.203.bl.example.org":   {"127.255.255.254"},
+		"9.113.0.203.bl.example.org":   {"127.0.0.2"},
+		"9.113.0.203.wl.example.org":   {"127.0.10.1"},
+		"10.113.0.203.bl2.example.org": {"127.0.0.4"},
+	}, &queries)
+	p := newDNSBLProcessor(t, BackendConfig{
+		"dnsbl_zones":   "bl.example.org, bl2.example.org",
+		"dnswl_zones":   "wl.example.org",
+		"dnsbl_actions": "127.0.0.10=ignore, 127.0.0.11=defer, 127.255.255.254=ignore",
+	})
+	for ip, expected := range map[string]string{
+		"203.0.113.5":  "554 5.7.1 Error: blocked by bl.example.org",
+		"203.0.113.6":  "",
+		"203.0.113.7":  "451 4.7.1 Error: temporarily blocked by bl.example.org",
+		"203.0.113.8":  "",
+		"203.0.113.9":  "",
+		"203.0.113.10": "554 5.7.1 Error: blocked by bl2.example.org",
+		"203.0.113.11": "",
+	} {
+		_, err := p.Process(newDNSBLEnvelope(ip), TaskValidateRcpt)
+		if expected == "" && err != nil {
+			t.Error("expecting", ip, "to pass, got:", err)
+		} else if reply, ok := err.(RcptReply); expected != "" && (!ok || string(reply) != expected) {
+			t.Error("expecting", ip, "to get", expected, "got:", err)
+		}
+	}
+
+	// the result is cached
+	atomic.StoreInt32(&queries, 0)
+	if _, err := p.Process(newDNSBLEnvelope("203.0.113.5"), TaskValidateRcpt); err == nil {
+		t.Error("expecting the cached result to block")
+	}
+	if n := atomic.LoadInt32(&queries); n != 0 {
+		t.Error("expecting no queries for a cached result, got:", n)
+	}
+	// other tasks are not checked
+	if _, err := p.Process(newDNSBLEnvelope("203.0.113.5"), TaskSaveMail); err != nil {
+		t.Error("expecting the message to be saved, got:", err)
+	}
+}
+
+func TestDNSBLTimeout(t *testing.T) {
+	var queries int32
+	defer func(lookup func(string) ([]string, error)) {
+		dnsblLookupHost = lookup
+	}(dnsblLookupHost)
+	dnsblLookupHost = mockDNSBL(map[string][]string{
+		"2.0.0.127.slow.example.org": {"127.0.0.2"},
+	}, &queries)
+	p := newDNSBLProcessor(t, BackendConfig{"dnsbl_zones": "slow.example.org", "dnsbl_timeout": "100ms"})
+	start := time.Now()
+	if _, err := p.Process(newDNSBLEnvelope("127.0.0.2"), TaskValidateRcpt); err != nil {
+		t.Error("expecting the slow zone to be skipped, got:", err)
+	}
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Error("expecting the check to give up after the timeout, took:", d)
+	}
+	// the slow zone may list the IP, the result is not cached
+	cached := func() bool {
+		dnsblCaches.Lock()
+		defer dnsblCaches.Unlock()
+		for _, c := range dnsblCaches.m {
+			if _, found := c.get("127.0.0.2"); found {
+				return true
+			}
+		}
+		return false
+	}
+	if cached() {
+		t.Error("expecting the result to not be cached after a timeout")
+	}
+
+	// the allowlist used up the timeout
+	p = newDNSBLProcessor(t, BackendConfig{"dnsbl_zones": "bl.example.org", "dnswl_zones": "slow.example.org", "dnsbl_timeout": "100ms"})
+	if _, err := p.Process(newDNSBLEnvelope("127.0.0.2"), TaskValidateRcpt); err != nil {
+		t.Error("expecting the IP to be allowed, got:", err)
+	}
+	if cached() {
+		t.Error("expecting the result to not be cached after the allowlist timed out")
+	}
+}
+
+func TestDNSBLConfig(t *testing.T) {
+	for _, c := range []BackendConfig{
+		{"dnsbl_zones": ""},
+		{"dnsbl_zones": "bl.example.org", "dnsbl_actions": "127.0.0.2=drop"},
+		{"dnsbl_zones": "bl.example.org", "dnsbl_actions": "listed=reject"},
+		{"dnsbl_zones": "bl.example.org", "dnsbl_timeout": "soon"},
+	} {
+		if _, errs := initTestProcessor(c, DNSBL); errs == nil {
+			t.Error("expecting an error for", c)
+		}
+	}
+}
@@ -12,7 +12,9 @@ import (
 // ----------------------------------------------------------------------------------
 // Processor Name: dumper
 // ----------------------------------------------------------------------------------
-// Description   : Dumps received emails into files
+// Description   : Dumps received emails into files. A message quarantined by the
+//               : contentfilter, the spamd or the clamav processor is dumped into its
+//               : quarantine directory
 // ----------------------------------------------------------------------------------
 func init() {
 	processors["dumper"] = func() Decorator {
@@ -41,7 +43,11 @@ func Dumper() Decorator {
 			if task == TaskSaveMail {
 				uuid, _ := newUUID()
 				file := uuid + ".eml"
-				err := ioutil.WriteFile(config.DumperDir+"/"+file, e.Data.Bytes(), 0644)
+				dir := config.DumperDir
+				if quarantine, ok := e.Values[ValueQuarantineDir].(string); ok {
+					dir = quarantine
+				}
+				err := ioutil.WriteFile(dir+"/"+file, e.Data.Bytes(), 0644)
 
 				if err != nil {
 					Log().Errorf("Could not dump message to a file - %s", err.Error())
@@ -0,0 +1,598 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	netmail "net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default index, if 'elasticsearch_index' not present in config
+	elasticsearchIndex = "mail-{date}"
+	// default number of documents in a bulk request, if 'elasticsearch_batch_size' not present in config
+	elasticsearchBatchSize = 100
+	// default time to wait for more documents, if 'elasticsearch_flush_interval' not present in config
+	elasticsearchFlushInterval = time.Millisecond * 200
+	// default time to wait for a bulk request, if 'elasticsearch_timeout' not present in config
+	elasticsearchTimeout = time.Second * 10
+	// default size of the text that is indexed, if 'elasticsearch_max_text_kb' not present in config
+	elasticsearchMaxTextKB = 1024
+	// how deep to look into nested multipart messages
+	elasticsearchMaxDepth = 5
+)
+
+type ElasticsearchConfig struct {
+	// ElasticsearchURL are the nodes, separated by commas, eg. "https://es1.example.com:9200"
+	ElasticsearchURL string `json:"elasticsearch_url"`
+	// ElasticsearchIndex is the index of the documents, {date}, {month} & {year} are replaced
+	// with the time the message was received, in UTC
+	ElasticsearchIndex string `json:"elasticsearch_index,omitempty"`
+	// ElasticsearchTemplate is the name of the index template installed when starting, none if empty
+	ElasticsearchTemplate string `json:"elasticsearch_template,omitempty"`
+	// ElasticsearchTemplateFile is a JSON file with the index template, the built-in one if empty
+	ElasticsearchTemplateFile string `json:"elasticsearch_template_file,omitempty"`
+	// ElasticsearchUser & ElasticsearchPass are sent with basic authentication
+	ElasticsearchUser string `json:"elasticsearch_user,omitempty"`
+	ElasticsearchPass string `json:"elasticsearch_pass,omitempty"`
+	// ElasticsearchAPIKey is sent as "Authorization: ApiKey <key>", the base64 encoded id:key
+	ElasticsearchAPIKey string `json:"elasticsearch_api_key,omitempty"`
+	// ElasticsearchBatchSize is the most documents sent in a bulk request
+	ElasticsearchBatchSize int `json:"elasticsearch_batch_size,omitempty"`
+	// ElasticsearchFlushInterval is how long to wait for more documents to fill a bulk request, eg. "200ms"
+	ElasticsearchFlushInterval string `json:"elasticsearch_flush_interval,omitempty"`
+	// ElasticsearchTimeout is how long to wait for a bulk request, eg. "10s"
+	ElasticsearchTimeout string `json:"elasticsearch_timeout,omitempty"`
+	// ElasticsearchMaxTextKB is the size of the text body that is indexed, the rest is cut
+	ElasticsearchMaxTextKB int `json:"elasticsearch_max_text_kb,omitempty"`
+	// ElasticsearchTLSCAFile is a PEM file of the CAs that the certificates of the nodes are
+	// verified with, the system CAs by default
+	ElasticsearchTLSCAFile string `json:"elasticsearch_tls_ca_file,omitempty"`
+	// ElasticsearchTLSSkipVerify accepts any certificate of the nodes
+	ElasticsearchTLSSkipVerify bool `json:"elasticsearch_tls_skip_verify,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: elasticsearch
+// ----------------------------------------------------------------------------------
+// Description   : Indexes the message into Elasticsearch or OpenSearch, to archive the
+//               : mail where it can be searched. The document has the from, to, cc,
+//               : subject & date headers, the text body & the names of the attachments,
+//               : with the envelope's sender, recipients, remote ip & queued id. The text
+//               : is taken from the text/plain parts, or the text/html parts without the
+//               : tags if there are none, decoded to UTF-8.
+//               : The documents of the messages that are saved at the same time are sent
+//               : together with the bulk API, when the batch is full or after the flush
+//               : interval. The save waits for its document: the message is failed with a
+//               : 451 if it could not be indexed, or a 554 if it was refused, eg. by the
+//               : mapping. The id of the document is the queued id, so that indexing it
+//               : again replaces it.
+//               : The index template is installed when starting if its name is set,
+//               : matching the index with its placeholders replaced by *.
+// ----------------------------------------------------------------------------------
+// Config Options: elasticsearch_url string - the nodes, separated by commas, tried in order
+//               : elasticsearch_index string - default "mail-{date}", {date}, {month} &
+//               : {year} are replaced with eg. 2006.01.02, 2006.01 & 2006
+//               : elasticsearch_template string - name of the index template to install
+//               : elasticsearch_template_file string - JSON file of the index template,
+//               : without "index_patterns", the built-in mappings by default
+//               : elasticsearch_user, elasticsearch_pass string - basic authentication
+//               : elasticsearch_api_key string - API key, the base64 encoded id:key
+//               : elasticsearch_batch_size int - most documents in a bulk request, default 100
+//               : elasticsearch_flush_interval string - default "200ms"
+//               : elasticsearch_timeout string - default "10s"
+//               : elasticsearch_max_text_kb int - size of the indexed text, default 1024
+//               : elasticsearch_tls_ca_file string - PEM file of the CAs of the nodes
+//               : elasticsearch_tls_skip_verify bool - do not verify the nodes' certificates
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.MailFrom, e.RcptTo & e.RemoteIP
+// ----------------------------------------------------------------------------------
+// Output        : the documents in the index
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["elasticsearch"] = func() Decorator {
+		return Elasticsearch()
+	}
+}
+
+// elasticsearchDocument is the document of a message
+type elasticsearchDocument struct {
+	Timestamp   time.Time  `json:"@timestamp"`
+	QueuedId    string     `json:"queued_id"`
+	MessageId   string     `json:"message_id,omitempty"`
+	From        string     `json:"from"`
+	To          []string   `json:"to"`
+	Cc          []string   `json:"cc,omitempty"`
+	Subject     string     `json:"subject"`
+	Date        *time.Time `json:"date,omitempty"`
+	Text        string     `json:"text"`
+	Attachments []string   `json:"attachments,omitempty"`
+	MailFrom    string     `json:"mail_from"`
+	RcptTo      []string   `json:"rcpt_to"`
+	RemoteIP    string     `json:"remote_ip"`
+	Size        int        `json:"size"`
+}
+
+// elasticsearchMappings are the mappings of the built-in index template
+const elasticsearchMappings = `{
+	"properties": {
+		"@timestamp": {"type": "date"},
+		"queued_id": {"type": "keyword"},
+		"message_id": {"type": "keyword"},
+		"from": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+		"to": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+		"cc": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+		"subject": {"type": "text"},
+		"date": {"type": "date"},
+		"text": {"type": "text"},
+		"attachments": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+		"mail_from": {"type": "keyword"},
+		"rcpt_to": {"type": "keyword"},
+		"remote_ip": {"type": "ip"},
+		"size": {"type": "long"}
+	}
+}`
+
+// elasticsearchError is an error of a document, or of a bulk request
+type elasticsearchError struct {
+	Status int
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (e *elasticsearchError) Error() string {
+	return fmt.Sprintf("elasticsearch status %d: %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// temporary returns true if indexing the document again may work
+func (e *elasticsearchError) temporary() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// elasticsearchBulkResponse is the response of the bulk API, the items are in the order of the documents
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int                 `json:"status"`
+		Error  *elasticsearchError `json:"error"`
+	} `json:"items"`
+}
+
+// elasticsearchItem is a document waiting in the batch
+type elasticsearchItem struct {
+	index  string
+	id     string
+	doc    []byte
+	result chan error
+}
+
+// elasticsearchClient sends the documents to the nodes in bulk requests
+type elasticsearchClient struct {
+	nodes    []string
+	config   *ElasticsearchConfig
+	client   *http.Client
+	size     int
+	interval time.Duration
+	items    chan *elasticsearchItem
+	wg       sync.WaitGroup
+	// next is the node to try first
+	next int
+}
+
+// do sends a request to the nodes, in turn until one replies without a 5xx
+func (c *elasticsearchClient) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for i := range c.nodes {
+		node := c.nodes[(c.next+i)%len(c.nodes)]
+		req, err := http.NewRequest(method, node+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if c.config.ElasticsearchAPIKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+c.config.ElasticsearchAPIKey)
+		} else if c.config.ElasticsearchUser != "" {
+			req.SetBasicAuth(c.config.ElasticsearchUser, c.config.ElasticsearchPass)
+		}
+		resp, err := c.client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			c.next = (c.next + i) % len(c.nodes)
+			return resp, nil
+		}
+		if err == nil {
+			b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			err = &elasticsearchError{Status: resp.StatusCode, Type: "http_error", Reason: strings.TrimSpace(string(b))}
+		}
+		Log().WithError(err).Warn("elasticsearch node failed: ", node)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// installTemplate puts the index template, matching the index with its placeholders replaced by *
+func (c *elasticsearchClient) installTemplate() error {
+	template := map[string]json.RawMessage{}
+	if c.config.ElasticsearchTemplateFile != "" {
+		b, err := ioutil.ReadFile(c.config.ElasticsearchTemplateFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &template); err != nil {
+			return fmt.Errorf("invalid elasticsearch_template_file: %s", err)
+		}
+	} else {
+		template["template"] = json.RawMessage(`{"mappings": ` + elasticsearchMappings + `}`)
+	}
+	pattern := regexp.MustCompile(`\{[a-z]+\}`).ReplaceAllString(c.config.ElasticsearchIndex, "*")
+	template["index_patterns"], _ = json.Marshal([]string{pattern})
+	body, _ := json.Marshal(template)
+	resp, err := c.do(http.MethodPut, "/_index_template/"+url.PathEscape(c.config.ElasticsearchTemplate), "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("could not install the elasticsearch index template, status %d: %s", resp.StatusCode, b)
+	}
+	return nil
+}
+
+// run collects the documents into batches, and sends a batch when it is full or it waited for
+// the flush interval. Returns when the items are closed, after the last batch
+func (c *elasticsearchClient) run() {
+	defer c.wg.Done()
+	var batch []*elasticsearchItem
+	var flush <-chan time.Time
+	for {
+		select {
+		case item, ok := <-c.items:
+			if !ok {
+				if len(batch) > 0 {
+					c.bulk(batch)
+				}
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) == 1 {
+				flush = time.After(c.interval)
+			}
+			if len(batch) >= c.size {
+				c.bulk(batch)
+				batch, flush = nil, nil
+			}
+		case <-flush:
+			c.bulk(batch)
+			batch, flush = nil, nil
+		}
+	}
+}
+
+// bulk indexes the batch, and sends the result of each document to its item
+func (c *elasticsearchClient) bulk(batch []*elasticsearchItem) {
+	var body bytes.Buffer
+	for _, item := range batch {
+		action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": item.index, "_id": item.id}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(item.doc)
+		body.WriteByte('\n')
+	}
+	fail := func(err error) {
+		for _, item := range batch {
+			item.result <- err
+		}
+	}
+	resp, err := c.do(http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		fail(&elasticsearchError{Status: resp.StatusCode, Type: "http_error", Reason: strings.TrimSpace(string(b))})
+		return
+	}
+	var result elasticsearchBulkResponse
+	if err := json.Unmarshal(b, &result); err != nil || len(result.Items) != len(batch) {
+		fail(fmt.Errorf("unexpected response from the elasticsearch bulk API: %.200s", b))
+		return
+	}
+	for i, item := range batch {
+		for _, r := range result.Items[i] {
+			if r.Error != nil {
+				r.Error.Status = r.Status
+				item.result <- r.Error
+			} else if r.Status/100 != 2 {
+				item.result <- &elasticsearchError{Status: r.Status, Type: "status", Reason: http.StatusText(r.Status)}
+			} else {
+				item.result <- nil
+			}
+			break
+		}
+	}
+}
+
+// index adds the document to the batch, and waits for it to be indexed
+func (c *elasticsearchClient) index(index, id string, doc []byte) error {
+	item := &elasticsearchItem{index: index, id: id, doc: doc, result: make(chan error, 1)}
+	c.items <- item
+	return <-item.result
+}
+
+// elasticsearchIndexName replaces the placeholders of the index with the date t
+func elasticsearchIndexName(index string, t time.Time) string {
+	t = t.UTC()
+	return strings.NewReplacer(
+		"{date}", t.Format("2006.01.02"),
+		"{month}", t.Format("2006.01"),
+		"{year}", t.Format("2006"),
+	).Replace(index)
+}
+
+// elasticsearchAddresses returns the addresses of a header as "Name <user@host>", or the
+// decoded header if it cannot be parsed
+func elasticsearchAddresses(value string) []string {
+	if value == "" {
+		return nil
+	}
+	list, err := netmail.ParseAddressList(value)
+	if err != nil {
+		return []string{mail.DecodeHeader(value)}
+	}
+	addresses := make([]string, 0, len(list))
+	for _, a := range list {
+		if a.Name != "" {
+			addresses = append(addresses, a.Name+" <"+a.Address+">")
+		} else {
+			addresses = append(addresses, a.Address)
+		}
+	}
+	return addresses
+}
+
+var (
+	htmlHiddenRegex = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>`)
+	htmlTagRegex    = regexp.MustCompile(`(?s)<[^>]*>`)
+	spaceRegex      = regexp.MustCompile(`[ \t\r\n]+`)
+)
+
+// htmlText returns the text of an HTML part, without the tags & the entities decoded
+func htmlText(s string) string {
+	s = htmlHiddenRegex.ReplaceAllString(s, " ")
+	s = htmlTagRegex.ReplaceAllString(s, " ")
+	return strings.TrimSpace(spaceRegex.ReplaceAllString(html.UnescapeString(s), " "))
+}
+
+// elasticsearchContent is the text & the attachments found in the parts of a message
+type elasticsearchContent struct {
+	plain, html []string
+	attachments []string
+}
+
+// walk collects the text of the text parts & the names of the attachments, walking through
+// multipart messages
+func (c *elasticsearchContent) walk(header textproto.MIMEHeader, body io.Reader, depth int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// no content type, the default is text/plain
+		mediaType, params = "text/plain", nil
+	}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if disposition == "attachment" || filename != "" {
+		if filename != "" {
+			c.attachments = append(c.attachments, mail.DecodeHeader(filename))
+		}
+		return
+	}
+	switch {
+	case mediaType == "text/plain" || mediaType == "text/html":
+		text, err := ioutil.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+		if err != nil && len(text) == 0 {
+			return
+		}
+		s := mail.MailTransportDecode(string(text), "", params["charset"])
+		if mediaType == "text/plain" {
+			c.plain = append(c.plain, strings.TrimSpace(s))
+		} else {
+			c.html = append(c.html, htmlText(s))
+		}
+	case strings.HasPrefix(mediaType, "multipart/") && depth < elasticsearchMaxDepth:
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			c.walk(part.Header, part, depth+1)
+		}
+	}
+}
+
+// text returns the text of the text/plain parts, or of the text/html parts if there are none,
+// cut to max bytes
+func (c *elasticsearchContent) text(max int) string {
+	text := strings.Join(c.plain, "\n\n")
+	if text == "" {
+		text = strings.Join(c.html, "\n\n")
+	}
+	if len(text) > max {
+		// do not split a character
+		for max > 0 && !utf8.RuneStart(text[max]) {
+			max--
+		}
+		text = text[:max]
+	}
+	return text
+}
+
+// elasticsearchDoc makes the document of the message in e, received at now
+func elasticsearchDoc(e *mail.Envelope, now time.Time, maxText int) *elasticsearchDocument {
+	doc := &elasticsearchDocument{
+		Timestamp: now,
+		QueuedId:  e.QueuedId,
+		RemoteIP:  e.RemoteIP,
+		Size:      e.Len(),
+	}
+	if !e.MailFrom.IsEmpty() {
+		doc.MailFrom = e.MailFrom.String()
+	}
+	for _, rcpt := range e.RcptTo {
+		doc.RcptTo = append(doc.RcptTo, rcpt.String())
+	}
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(e.Data.Bytes())))
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return doc
+	}
+	if from := elasticsearchAddresses(header.Get("From")); len(from) > 0 {
+		doc.From = from[0]
+	}
+	doc.To = elasticsearchAddresses(header.Get("To"))
+	doc.Cc = elasticsearchAddresses(header.Get("Cc"))
+	doc.Subject = mail.DecodeHeader(header.Get("Subject"))
+	doc.MessageId = strings.Trim(header.Get("Message-Id"), "<> ")
+	if date, err := netmail.ParseDate(header.Get("Date")); err == nil {
+		doc.Date = &date
+	}
+	content := &elasticsearchContent{}
+	content.walk(header, r.R, 0)
+	doc.Text = content.text(maxText)
+	doc.Attachments = content.attachments
+	return doc
+}
+
+func Elasticsearch() Decorator {
+
+	var (
+		config *ElasticsearchConfig
+		client *elasticsearchClient
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ElasticsearchConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*ElasticsearchConfig)
+		x := &elasticsearchClient{
+			config:   c,
+			size:     elasticsearchBatchSize,
+			interval: elasticsearchFlushInterval,
+		}
+		for _, node := range splitList(c.ElasticsearchURL) {
+			u, err := url.Parse(node)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid elasticsearch_url, expecting http:// or https://: %s", node)
+			}
+			x.nodes = append(x.nodes, strings.TrimSuffix(node, "/"))
+		}
+		if len(x.nodes) == 0 {
+			return errors.New("elasticsearch_url cannot be empty")
+		}
+		if c.ElasticsearchIndex == "" {
+			c.ElasticsearchIndex = elasticsearchIndex
+		}
+		if c.ElasticsearchBatchSize < 0 {
+			return errors.New("elasticsearch_batch_size cannot be negative")
+		} else if c.ElasticsearchBatchSize > 0 {
+			x.size = c.ElasticsearchBatchSize
+		}
+		if c.ElasticsearchMaxTextKB <= 0 {
+			c.ElasticsearchMaxTextKB = elasticsearchMaxTextKB
+		}
+		if c.ElasticsearchFlushInterval != "" {
+			if x.interval, err = time.ParseDuration(c.ElasticsearchFlushInterval); err != nil {
+				return err
+			}
+		}
+		timeout := elasticsearchTimeout
+		if c.ElasticsearchTimeout != "" {
+			if timeout, err = time.ParseDuration(c.ElasticsearchTimeout); err != nil {
+				return err
+			}
+		}
+		tlsConfig, err := clientTLSConfig(c.ElasticsearchTLSCAFile, c.ElasticsearchTLSSkipVerify, "elasticsearch_tls_ca_file")
+		if err != nil {
+			return err
+		}
+		x.client = &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		}
+		if c.ElasticsearchTemplate != "" {
+			if err := x.installTemplate(); err != nil {
+				return err
+			}
+		}
+		x.items = make(chan *elasticsearchItem)
+		x.wg.Add(1)
+		go x.run()
+		config, client = c, x
+		return nil
+	}))
+
+	// shutdown sends the last batch
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if client != nil {
+			close(client.items)
+			client.wg.Wait()
+			client = nil
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				now := time.Now()
+				doc, err := json.Marshal(elasticsearchDoc(e, now, config.ElasticsearchMaxTextKB*1024))
+				if err != nil {
+					return NewResult(response.Canned.FailBackendTransaction), err
+				}
+				index := elasticsearchIndexName(config.ElasticsearchIndex, now)
+				if err := client.index(index, e.QueuedId, doc); err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not index the message in ", index)
+					if esErr, ok := err.(*elasticsearchError); ok && !esErr.temporary() {
+						return NewResult(response.Canned.FailBackendTransaction + "elasticsearch refused the message"), err
+					}
+					return NewResult(response.Canned.ErrorBackendTransaction + "elasticsearch index failed"), NewRetryableError(err)
+				}
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// elasticsearchTestServer is a node that keeps the documents of the bulk requests. Documents
+// with "refuse" in their subject fail the mapping, with "busy" they are rejected with a 429
+type elasticsearchTestServer struct {
+	*httptest.Server
+	docs      map[string]elasticsearchDocument
+	bulks     []int
+	templates map[string]map[string]interface{}
+	down      bool
+	sync.Mutex
+}
+
+func newElasticsearchTestServer() *elasticsearchTestServer {
+	s := &elasticsearchTestServer{
+		docs:      make(map[string]elasticsearchDocument),
+		templates: make(map[string]map[string]interface{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+		if s.down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if user, pass, _ := r.BasicAuth(); user != "elastic" || pass != "changeme" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+			var template map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&template)
+			s.templates[strings.TrimPrefix(r.URL.Path, "/_index_template/")] = template
+			w.Write([]byte(`{"acknowledged":true}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+			var items []string
+			scanner := bufio.NewScanner(r.Body)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+				var action map[string]map[string]string
+				json.Unmarshal(scanner.Bytes(), &action)
+				scanner.Scan()
+				var doc elasticsearchDocument
+				json.Unmarshal(scanner.Bytes(), &doc)
+				switch {
+				case strings.Contains(doc.Subject, "refuse"):
+					items = append(items, `{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}`)
+				case strings.Contains(doc.Subject, "busy"):
+					items = append(items, `{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}`)
+				default:
+					s.docs[action["index"]["_index"]+"/"+action["index"]["_id"]] = doc
+					items = append(items, `{"index":{"status":201}}`)
+				}
+			}
+			s.bulks = append(s.bulks, len(items))
+			w.Write([]byte(`{"took":1,"errors":false,"items":[` + strings.Join(items, ",") + `]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+const elasticsearchTestMessage = "From: =?UTF-8?Q?Ren=C3=A9e?= <renee@example.com>\r\n" +
+	"To: bob@example.org, Carol <carol@example.net>\r\n" +
+	"Subject: =?UTF-8?B?UXVhcnRlcmx5IHJlcG9ydA==?=\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n" +
+	"Message-Id: <1234@example.com>\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"The numbers are in, caf=C3=A9 sales are up.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>The numbers are in</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--outer--\r\n"
+
+func TestElasticsearch(t *testing.T) {
+	down := newElasticsearchTestServer()
+	down.down = true
+	defer down.Close()
+	s := newElasticsearchTestServer()
+	defer s.Close()
+	p := newTestProcessor(t, BackendConfig{
+		"elasticsearch_url":            down.URL + "," + s.URL,
+		"elasticsearch_user":           "elastic",
+		"elasticsearch_pass":           "changeme",
+		"elasticsearch_template":       "mail",
+		"elasticsearch_batch_size":     2,
+		"elasticsearch_flush_interval": "10s",
+	}, Elasticsearch)
+	s.Lock()
+	if patterns := s.templates["mail"]["index_patterns"]; len(patterns.([]interface{})) != 1 || patterns.([]interface{})[0] != "mail-*" {
+		t.Error("unexpected index template:", s.templates)
+	}
+	s.Unlock()
+
+	// the two messages fill a batch
+	e1 := newAccountingEnvelope("renee@example.com", elasticsearchTestMessage, "bob@example.org", "carol@example.net")
+	e2 := newAccountingEnvelope("", "Subject: bounce\nContent-Type: text/html\n\n<html><style>p {}</style><p>Tom &amp; Jerry</p></html>\n", "bob@example.org")
+	e2.QueuedId += "2"
+	var wg sync.WaitGroup
+	for _, e := range []*mail.Envelope{e1, e2} {
+		wg.Add(1)
+		go func(e *mail.Envelope) {
+			defer wg.Done()
+			if _, err := p.Process(e, TaskSaveMail); err != nil {
+				t.Error("the message should be indexed, got:", err)
+			}
+		}(e)
+	}
+	wg.Wait()
+	s.Lock()
+	if len(s.bulks) != 1 || s.bulks[0] != 2 {
+		t.Error("expecting a bulk request with both messages, got:", s.bulks)
+	}
+	index := "mail-" + time.Now().UTC().Format("2006.01.02")
+	doc := s.docs[index+"/"+e1.QueuedId]
+	s.Unlock()
+	if doc.From != "Renée <renee@example.com>" || len(doc.To) != 2 || doc.To[1] != "Carol <carol@example.net>" ||
+		doc.Subject != "Quarterly report" || doc.MessageId != "1234@example.com" || doc.Date == nil || doc.Date.Year() != 2006 {
+		t.Error("unexpected headers:", doc)
+	}
+	if doc.Text != "The numbers are in, café sales are up." || len(doc.Attachments) != 1 || doc.Attachments[0] != "résumé.pdf" {
+		t.Error("unexpected content:", doc.Text, doc.Attachments)
+	}
+	if doc.MailFrom != "renee@example.com" || len(doc.RcptTo) != 2 || doc.RemoteIP != "203.0.113.5" {
+		t.Error("unexpected envelope:", doc)
+	}
+	s.Lock()
+	doc = s.docs[index+"/"+e2.QueuedId]
+	s.Unlock()
+	if doc.Text != "Tom & Jerry" || doc.MailFrom != "" {
+		t.Error("expecting the text of the html, got:", doc.Text)
+	}
+
+	// refused by the mapping, and busy
+	e := newAccountingEnvelope("alice@example.com", "Subject: refuse\n\nhi\n", "bob@example.org")
+	go p.Process(newAccountingEnvelope("alice@example.com", "Subject: fill\n\nhi\n", "bob@example.org"), TaskSaveMail)
+	result, err := p.Process(e, TaskSaveMail)
+	if err == nil || isRetryable(err) || resultCode(result) != 554 {
+		t.Error("expecting the message to be refused, got:", result, err)
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestElasticsearchUnavailable(t *testing.T) {
+	s := newElasticsearchTestServer()
+	defer s.Close()
+	p := newTestProcessor(t, BackendConfig{
+		"elasticsearch_url":            s.URL,
+		"elasticsearch_user":           "elastic",
+		"elasticsearch_pass":           "changeme",
+		"elasticsearch_index":          "archive-{month}",
+		"elasticsearch_flush_interval": "1ms",
+	}, Elasticsearch)
+	// rejected with a 429, the message is retried
+	e := newAccountingEnvelope("alice@example.com", "Subject: busy\n\nhi\n", "bob@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	s.Lock()
+	s.down = true
+	s.Unlock()
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	result, err = p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	s.Lock()
+	s.down = false
+	s.Unlock()
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be indexed, got:", err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.docs["archive-"+time.Now().UTC().Format("2006.01")+"/"+e.QueuedId]; !ok {
+		t.Error("expecting the message in the monthly index, got:", s.docs)
+	}
+}
+
+func TestElasticsearchText(t *testing.T) {
+	content := &elasticsearchContent{plain: []string{"caf" + strings.Repeat("é", 4)}}
+	if text := content.text(6); text != "café" {
+		t.Error("expecting the text to be cut before a character, got:", text)
+	}
+	if text := htmlText("<head><title>x</title></head><body>a<br>b &lt;c&gt;</body>"); text != "a b <c>" {
+		t.Error("unexpected text:", text)
+	}
+	e := newAccountingEnvelope("alice@example.com", "Subject: no type\n\nplain\n", "bob@example.org")
+	if doc := elasticsearchDoc(e, time.Now(), 1024); doc.Text != "plain" || doc.Subject != "no type" {
+		t.Error("unexpected document:", doc)
+	}
+}
+
+func TestElasticsearchConfig(t *testing.T) {
+	s := newElasticsearchTestServer()
+	defer s.Close()
+	template, _ := ioutil.TempFile("", "template")
+	template.WriteString("{not json")
+	template.Close()
+	defer os.Remove(template.Name())
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"elasticsearch_url": ""}, "elasticsearch_url cannot be empty"},
+		{BackendConfig{"elasticsearch_url": "localhost:9200"}, "invalid elasticsearch_url"},
+		{BackendConfig{"elasticsearch_url": s.URL, "elasticsearch_batch_size": -1}, "cannot be negative"},
+		{BackendConfig{"elasticsearch_url": s.URL, "elasticsearch_flush_interval": "soon"}, "invalid duration"},
+		{BackendConfig{"elasticsearch_url": s.URL, "elasticsearch_template": "mail"}, "status 401"},
+		{BackendConfig{"elasticsearch_url": s.URL, "elasticsearch_template": "mail", "elasticsearch_template_file": template.Name()},
+			"invalid elasticsearch_template_file"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, Elasticsearch)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"mime"
+	"net/textproto"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ValueEncrypted is the e.Values key set to true when the message is encrypted (S/MIME or PGP/MIME).
+// Processors that scan the content skip encrypted messages
+const ValueEncrypted = "encrypted"
+
+const (
+	// encrypted messages are let through, only flagged
+	encryptedPolicyAccept = "accept"
+	// encrypted messages are only accepted if the sender passed authentication
+	encryptedPolicyAuthenticated = "authenticated"
+	// encrypted messages are rejected
+	encryptedPolicyReject = "reject"
+)
+
+var errEncryptedRejected = errors.New("encrypted message rejected by policy")
+
+type EncryptedConfig struct {
+	// EncryptedPolicy is "accept" (default), "authenticated" or "reject"
+	EncryptedPolicy string `json:"encrypted_policy,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: encrypted
+// ----------------------------------------------------------------------------------
+// Description   : Detects S/MIME (application/pkcs7-mime) and PGP/MIME (multipart/encrypted)
+//               : messages. Their content is ciphertext, so processors that scan the
+//               : content (eg. calendar) skip them. Place before those processors.
+//               : Since the content can't be scanned, a stricter policy may be applied
+// ----------------------------------------------------------------------------------
+// Config Options: encrypted_policy string - "accept" (default) lets them through,
+//               : "authenticated" rejects them unless the sender passed authentication,
+//               : "reject" rejects them
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header (Content-Type) if the headersparser processor is before this one,
+//               : otherwise the headers are read from e.Data
+//               : e.Values[ValueSenderAuthenticated]
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["encrypted"] is set to true, 550 if rejected
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["encrypted"] = func() Decorator {
+		return Encrypted()
+	}
+}
+
+func Encrypted() Decorator {
+
+	var policy string
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&EncryptedConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		policy = strings.ToLower(bcfg.(*EncryptedConfig).EncryptedPolicy)
+		switch policy {
+		case "":
+			policy = encryptedPolicyAccept
+		case encryptedPolicyAccept, encryptedPolicyAuthenticated, encryptedPolicyReject:
+		default:
+			return errors.New("invalid encrypted_policy: " + policy)
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if !isEncrypted(e) {
+					return p.Process(e, task)
+				}
+				e.Values[ValueEncrypted] = true
+				authenticated, _ := e.Values[ValueSenderAuthenticated].(bool)
+				if policy == encryptedPolicyReject ||
+					(policy == encryptedPolicyAuthenticated && !authenticated) {
+					Log().WithField("ip", e.RemoteIP).WithField("policy", policy).Info("rejected encrypted message")
+					return NewResult(response.Canned.FailEncryptedMessage), errEncryptedRejected
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// isEncrypted returns true if the Content-Type of the message is S/MIME or PGP/MIME encrypted
+func isEncrypted(e *mail.Envelope) bool {
+	contentType := e.Header.Get("Content-Type")
+	if e.Header == nil {
+		r := textproto.NewReader(bufio.NewReader(bytes.NewReader(e.Data.Bytes())))
+		header, _ := r.ReadMIMEHeader()
+		contentType = header.Get("Content-Type")
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		// a certs-only message has no content to hide
+		return !strings.EqualFold(params["smime-type"], "certs-only")
+	case "multipart/encrypted":
+		return true
+	}
+	return false
+}
+
+// encrypted returns true if the encrypted processor flagged e
+func encrypted(e *mail.Envelope) bool {
+	enc, _ := e.Values[ValueEncrypted].(bool)
+	return enc
+}
@@ -0,0 +1,106 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const testSMIME = `From: alice@example.com
+To: bob@example.com
+Subject: secret
+MIME-Version: 1.0
+Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name="smime.p7m"
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="smime.p7m"
+
+MIAGCSqGSIb3DQEHA6CAMIACAQAxggFOMIIBSgIBADAyMCYxEjAQBgNVBAoTCUV4YW1wbGUg
+`
+
+const testPGPMIME = `From: alice@example.com
+To: bob@example.com
+Subject: secret
+MIME-Version: 1.0
+Content-Type: multipart/encrypted; protocol="application/pgp-encrypted"; boundary="foo"
+
+--foo
+Content-Type: application/pgp-encrypted
+
+Version: 1
+
+--foo
+Content-Type: application/octet-stream
+
+-----BEGIN PGP MESSAGE-----
+hQEMA0UJRK0y5Yz1AQf/Y3Vyc2VkIGJlIHRoZSBvbmUgd2hvIHJlYWRzIHRoaXM=
+-----END PGP MESSAGE-----
+--foo--
+`
+
+func newEncryptedEnvelope(data string, parseHeaders bool) *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.Data.WriteString(data)
+	if parseHeaders {
+		e.ParseHeaders()
+	}
+	return e
+}
+
+func TestEncryptedDetect(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"calendar_enabled": true}, Encrypted, CalendarParser)
+	for name, data := range map[string]string{"S/MIME": testSMIME, "PGP/MIME": testPGPMIME} {
+		for _, parsed := range []bool{false, true} {
+			e := newEncryptedEnvelope(data, parsed)
+			if _, err := p.Process(e, TaskSaveMail); err != nil {
+				t.Error(name, "should be accepted, got:", err)
+			}
+			if enc, _ := e.Values[ValueEncrypted].(bool); !enc {
+				t.Error(name, "should be detected as encrypted, headers parsed:", parsed)
+			}
+		}
+	}
+	// not encrypted
+	for _, data := range []string{
+		testMeetingRequest,
+		"Subject: hi\n\nhello\n",
+		"Content-Type: application/pkcs7-mime; smime-type=certs-only\n\nMIAGCSqGSIb3\n",
+	} {
+		e := newEncryptedEnvelope(data, false)
+		p.Process(e, TaskSaveMail)
+		if _, ok := e.Values[ValueEncrypted]; ok {
+			t.Error("message should not be detected as encrypted:", data)
+		}
+	}
+	// the calendar processor skips encrypted messages
+	e := newEncryptedEnvelope("Content-Type: multipart/encrypted; boundary=x\n\n--x\n"+
+		"Content-Type: text/calendar\n\nBEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:1\nEND:VEVENT\nEND:VCALENDAR\n--x--\n", false)
+	p.Process(e, TaskSaveMail)
+	if _, ok := e.Values[ValueCalendar]; ok {
+		t.Error("the calendar processor should skip an encrypted message")
+	}
+}
+
+func TestEncryptedPolicy(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"calendar_enabled": false, "encrypted_policy": "authenticated"}, Encrypted, CalendarParser)
+	result, err := p.Process(newEncryptedEnvelope(testPGPMIME, false), TaskSaveMail)
+	if err != errEncryptedRejected || result.Code() != 550 {
+		t.Error("expecting an unauthenticated encrypted message to be rejected, got:", result, err)
+	}
+	e := newEncryptedEnvelope(testPGPMIME, false)
+	e.Values[ValueSenderAuthenticated] = true
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting an authenticated encrypted message to be accepted, got:", err)
+	}
+	if _, err := p.Process(newEncryptedEnvelope(testMeetingRequest, false), TaskSaveMail); err != nil {
+		t.Error("a message that is not encrypted should be accepted, got:", err)
+	}
+
+	p = newTestProcessor(t, BackendConfig{"calendar_enabled": false, "encrypted_policy": "reject"}, Encrypted, CalendarParser)
+	if _, err := p.Process(e, TaskSaveMail); err != errEncryptedRejected {
+		t.Error("expecting an encrypted message to be rejected, got:", err)
+	}
+
+	if _, errs := initTestProcessor(BackendConfig{"encrypted_policy": "maybe"}, Encrypted); errs == nil {
+		t.Error("expecting an error for an invalid encrypted_policy")
+	}
+}
@@ -0,0 +1,309 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const (
+	// default interval of the migration, if 'fallback_migrate_interval' not present in config
+	fallbackMigrateInterval = time.Minute
+	// extension of the spooled messages
+	fallbackSpoolExt = ".json"
+	// extension of the spooled messages that were rejected when migrating
+	fallbackFailedExt = ".failed"
+)
+
+// fallbackSpoolLocks makes sure that only one processor migrates a spool dir at a time,
+// there is one fallback processor for each worker
+var fallbackSpoolLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// fallbackSeq keeps the names of the spooled messages unique
+var fallbackSeq uint64
+
+type FallbackConfig struct {
+	// FallbackSpoolDir is where the messages are written when the storage fails
+	FallbackSpoolDir string `json:"fallback_spool_dir"`
+	// FallbackMigrateInterval is how often to try saving the spooled messages again, eg "1m"
+	FallbackMigrateInterval string `json:"fallback_migrate_interval,omitempty"`
+}
+
+// spooledEnvelope is what is written to the spool, the fields of the envelope that the
+// processors before the fallback may have set
+type spooledEnvelope struct {
+	RemoteIP       string
+	Helo           string
+	MailFrom       mail.Address
+	RcptTo         []mail.Address
+	Data           []byte
+	Subject        string
+	TLS            bool
+	TLSInfo        *mail.TLSInfo
+	Header         map[string][]string
+	Hashes         []string
+	DeliveryHeader string
+	QueuedId       string
+	// Values has the string and bool values only
+	Values map[string]interface{}
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: fallback
+// ----------------------------------------------------------------------------------
+// Description   : Keeps messages safe when the storage is down. When the processors after
+//               : this one fail with a storage error (eg. the database is down), the message
+//               : is written to a spool dir on the disk and the client still gets a 250.
+//               : The spooled messages are given to the processors after this one again,
+//               : at each interval, until the storage is back.
+//               : Place before the storage processors in save_process,
+//               : eg. "HeadersParser|Fallback|MySQL".
+//               : Only the string & bool e.Values are kept in the spool
+// ----------------------------------------------------------------------------------
+// Config Options: fallback_spool_dir string - dir for the spooled messages
+//               : fallback_migrate_interval string - how often to migrate the spooled
+//               : messages to the storage, default "1m"
+// --------------:-------------------------------------------------------------------
+// Input         : StorageError from the next processors
+// ----------------------------------------------------------------------------------
+// Output        : Messages that could not be migrated because they were rejected are
+//               : renamed to *.failed in the spool dir
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["fallback"] = func() Decorator {
+		return Fallback()
+	}
+}
+
+func Fallback() Decorator {
+
+	var (
+		config *FallbackConfig
+		// the processors after this one
+		nextP Processor
+		stop  chan bool
+		done  chan bool
+		// the migration and the worker take turns to use the next processors
+		next sync.Mutex
+	)
+
+	// process gives e to the next processors
+	process := func(e *mail.Envelope) (Result, error) {
+		next.Lock()
+		defer next.Unlock()
+		return nextP.Process(e, TaskSaveMail)
+	}
+
+	// migrate tries to save the spooled messages, until the storage fails again
+	migrate := func() {
+		lock := fallbackSpoolLock(config.FallbackSpoolDir)
+		lock.Lock()
+		defer lock.Unlock()
+		files, err := filepath.Glob(filepath.Join(config.FallbackSpoolDir, "*"+fallbackSpoolExt))
+		if err != nil {
+			Log().WithError(err).Error("could not read the fallback spool")
+			return
+		}
+		// oldest first
+		sort.Strings(files)
+		for _, file := range files {
+			e, err := readSpooled(file)
+			if err != nil {
+				Log().WithError(err).WithField("file", file).Error("could not read a spooled message")
+				continue
+			}
+			_, err = process(e)
+			if err == StorageError {
+				// still down
+				return
+			}
+			if err != nil {
+				Log().WithError(err).WithField("queued_id", e.QueuedId).Error("spooled message was rejected")
+				os.Rename(file, strings.TrimSuffix(file, fallbackSpoolExt)+fallbackFailedExt)
+				continue
+			}
+			if err := os.Remove(file); err != nil {
+				Log().WithError(err).WithField("file", file).Error("could not remove a migrated message")
+				return
+			}
+			Log().WithField("queued_id", e.QueuedId).Info("migrated a spooled message to the storage")
+		}
+	}
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&FallbackConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*FallbackConfig)
+		if config.FallbackSpoolDir == "" {
+			return errors.New("fallback_spool_dir cannot be empty")
+		}
+		if err := os.MkdirAll(config.FallbackSpoolDir, 0700); err != nil {
+			return err
+		}
+		interval := fallbackMigrateInterval
+		if config.FallbackMigrateInterval != "" {
+			if interval, err = time.ParseDuration(config.FallbackMigrateInterval); err != nil {
+				return err
+			}
+		}
+		stop, done = make(chan bool), make(chan bool)
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					migrate()
+				case <-stop:
+					return
+				}
+			}
+		}()
+		return nil
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if stop != nil {
+			close(stop)
+			<-done
+			stop = nil
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		nextP = p
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				result, err := process(e)
+				if err != StorageError {
+					return result, err
+				}
+				if spoolErr := spool(config.FallbackSpoolDir, e); spoolErr != nil {
+					Log().WithError(spoolErr).WithField("queued_id", e.QueuedId).Error("could not spool the message")
+					return result, err
+				}
+				Log().WithField("queued_id", e.QueuedId).Warn("storage failed, message spooled")
+				return BackendResultOK, nil
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// fallbackSpoolLock returns the lock for the spool dir, shared by all the processors
+func fallbackSpoolLock(dir string) *sync.Mutex {
+	fallbackSpoolLocks.Lock()
+	defer fallbackSpoolLocks.Unlock()
+	dir = filepath.Clean(dir)
+	l, ok := fallbackSpoolLocks.m[dir]
+	if !ok {
+		l = &sync.Mutex{}
+		fallbackSpoolLocks.m[dir] = l
+	}
+	return l
+}
+
+// spool writes e to the spool dir. The file is renamed when complete, so that the
+// migration never reads half a message
+func spool(dir string, e *mail.Envelope) error {
+	b, err := json.Marshal(newSpooledEnvelope(e))
+	if err != nil {
+		return err
+	}
+	return writeSpoolFile(dir, b, fallbackSpoolExt)
+}
+
+// newSpooledEnvelope copies the fields of e that are kept in a spool
+func newSpooledEnvelope(e *mail.Envelope) *spooledEnvelope {
+	s := &spooledEnvelope{
+		RemoteIP:       e.RemoteIP,
+		Helo:           e.Helo,
+		MailFrom:       e.MailFrom,
+		RcptTo:         e.RcptTo,
+		Data:           e.Data.Bytes(),
+		Subject:        e.Subject,
+		TLS:            e.TLS,
+		TLSInfo:        e.TLSInfo,
+		Header:         e.Header,
+		Hashes:         e.Hashes,
+		DeliveryHeader: e.DeliveryHeader,
+		QueuedId:       e.QueuedId,
+		Values:         make(map[string]interface{}),
+	}
+	for key, v := range e.Values {
+		if key == valueFailedProcessor {
+			// only about this attempt
+			continue
+		}
+		switch v.(type) {
+		case string, bool:
+			s.Values[key] = v
+		}
+	}
+	return s
+}
+
+// writeSpoolFile writes b to a new file in dir with the ext extension. The file gets its
+// name when it is complete, so that it is never read half written
+func writeSpoolFile(dir string, b []byte, ext string) error {
+	name := filepath.Join(dir, fmt.Sprintf("%020d-%d", time.Now().UnixNano(), atomic.AddUint64(&fallbackSeq, 1)))
+	if err := ioutil.WriteFile(name+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name+ext)
+}
+
+// readSpooled reads an envelope from the spool
+func readSpooled(file string) (*mail.Envelope, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s spooledEnvelope
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return s.envelope(), nil
+}
+
+// envelope returns the envelope that s was spooled from
+func (s *spooledEnvelope) envelope() *mail.Envelope {
+	e := mail.NewEnvelope(s.RemoteIP, 0)
+	e.Helo = s.Helo
+	e.MailFrom = s.MailFrom
+	e.RcptTo = s.RcptTo
+	e.Data.Write(s.Data)
+	e.Subject = s.Subject
+	e.TLS = s.TLS
+	e.TLSInfo = s.TLSInfo
+	if s.Header != nil {
+		e.Header = textproto.MIMEHeader(s.Header)
+	}
+	e.Hashes = s.Hashes
+	e.DeliveryHeader = s.DeliveryHeader
+	e.QueuedId = s.QueuedId
+	for key, v := range s.Values {
+		e.Values[key] = v
+	}
+	return e
+}
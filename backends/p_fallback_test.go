@@ -0,0 +1,160 @@
+package backends
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// testStorage fails with a StorageError while down, and keeps the saved envelopes
+type testStorage struct {
+	sync.Mutex
+	down   bool
+	reject bool
+	saved  []*mail.Envelope
+}
+
+func (s *testStorage) set(down, reject bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.down, s.reject = down, reject
+}
+
+func (s *testStorage) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.saved)
+}
+
+func (s *testStorage) decorator() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			s.Lock()
+			defer s.Unlock()
+			if s.down {
+				return NewResult("554 Error: could not save email"), StorageError
+			}
+			if s.reject {
+				return NewResult("554 Error: rejected"), errors.New("rejected")
+			}
+			s.saved = append(s.saved, e)
+			return p.Process(e, task)
+		})
+	}
+}
+
+func spooledFiles(t *testing.T, dir, ext string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestFallbackSpoolAndMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := &testStorage{down: true}
+	p := newTestProcessor(t, BackendConfig{
+		"fallback_spool_dir":        dir,
+		"fallback_migrate_interval": "10ms",
+	}, storage.decorator, Fallback)
+	defer Svc.shutdown()
+
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.MailFrom, _ = mail.NewAddress("alice@example.com")
+	e.RcptTo = []mail.Address{{User: "bob", Host: "example.com"}}
+	e.QueuedId = "abc123"
+	e.Values["spam_score"] = "2.5"
+	e.Data.WriteString("Subject: hi\n\nhello\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("expecting the message to be accepted when the storage is down, got:", err)
+	}
+	if files := spooledFiles(t, dir, fallbackSpoolExt); len(files) != 1 {
+		t.Fatal("expecting the message to be spooled, got:", files)
+	}
+
+	// the storage is back
+	storage.set(false, false)
+	for i := 0; i < 200 && storage.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if storage.count() != 1 {
+		t.Fatal("expecting the spooled message to be migrated")
+	}
+	storage.Lock()
+	migrated := storage.saved[0]
+	storage.Unlock()
+	if migrated.MailFrom.String() != "alice@example.com" || len(migrated.RcptTo) != 1 ||
+		migrated.RcptTo[0].String() != "bob@example.com" || migrated.QueuedId != "abc123" ||
+		migrated.Data.String() != "Subject: hi\n\nhello\n" || migrated.Values["spam_score"] != "2.5" {
+		t.Error("the migrated message is not the same as the spooled one:", migrated)
+	}
+	for i := 0; i < 200 && len(spooledFiles(t, dir, fallbackSpoolExt)) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files := spooledFiles(t, dir, fallbackSpoolExt); len(files) != 0 {
+		t.Error("expecting the migrated message to be removed from the spool, got:", files)
+	}
+
+	// when the storage works, nothing is spooled
+	if _, err := p.Process(mail.NewEnvelope("203.0.113.5", 2), TaskSaveMail); err != nil {
+		t.Error("expecting the message to be saved, got:", err)
+	}
+	if storage.count() != 2 || len(spooledFiles(t, dir, fallbackSpoolExt)) != 0 {
+		t.Error("expecting the message to go to the storage only")
+	}
+}
+
+func TestFallbackRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := &testStorage{down: true}
+	p := newTestProcessor(t, BackendConfig{
+		"fallback_spool_dir":        dir,
+		"fallback_migrate_interval": "10ms",
+	}, storage.decorator, Fallback)
+	defer Svc.shutdown()
+	if _, err := p.Process(mail.NewEnvelope("203.0.113.5", 1), TaskSaveMail); err != nil {
+		t.Fatal("expecting the message to be spooled, got:", err)
+	}
+	// errors that are not storage errors are not spooled
+	storage.set(false, true)
+	if _, err := p.Process(mail.NewEnvelope("203.0.113.5", 2), TaskSaveMail); err == nil {
+		t.Error("expecting the rejection to be returned")
+	}
+	// a spooled message that is rejected when migrating is kept as .failed
+	for i := 0; i < 200 && len(spooledFiles(t, dir, fallbackFailedExt)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files := spooledFiles(t, dir, fallbackFailedExt); len(files) != 1 {
+		t.Error("expecting the rejected message to be renamed, got:", files)
+	}
+	if files := spooledFiles(t, dir, fallbackSpoolExt); len(files) != 0 {
+		t.Error("expecting no spooled messages left, got:", files)
+	}
+}
+
+func TestFallbackConfig(t *testing.T) {
+	if _, errs := initTestProcessor(BackendConfig{}, Fallback); errs == nil {
+		t.Error("expecting an error when fallback_spool_dir is empty")
+	}
+	if _, errs := initTestProcessor(BackendConfig{
+		"fallback_spool_dir":        os.TempDir(),
+		"fallback_migrate_interval": "soon",
+	}, Fallback); errs == nil {
+		t.Error("expecting an error for an invalid fallback_migrate_interval")
+	}
+}
@@ -0,0 +1,194 @@
+package backends
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// ValuePTRName is the e.Values key set to the name the IP of the client resolves to,
+	// the forward-confirmed name if there is one
+	ValuePTRName = "ptr_name"
+	// ValueFCrDNS is the e.Values key set to the result of the forward-confirmed reverse DNS check,
+	// one of the fcrdns* results
+	ValueFCrDNS = "fcrdns"
+	// ValueHeloMatchesPTR is the e.Values key set to true if the HELO is one of the PTR names
+	ValueHeloMatchesPTR = "helo_matches_ptr"
+)
+
+const (
+	// a name of the IP resolves back to the IP
+	FCrDNSPass = "pass"
+	// none of the names of the IP resolve back to it
+	FCrDNSFail = "fail"
+	// the IP has no PTR record
+	FCrDNSNone = "none"
+	// the lookup failed or timed out
+	FCrDNSTempError = "temperror"
+
+	// default time to wait for the lookups, if 'fcrdns_timeout' not present in config
+	fcrdnsTimeout = time.Second * 3
+	// the most PTR names to check
+	fcrdnsMaxNames = 10
+)
+
+var (
+	// fcrdnsLookupAddr and fcrdnsLookupHost can be changed for testing
+	fcrdnsLookupAddr = net.LookupAddr
+	fcrdnsLookupHost = net.LookupHost
+)
+
+var errNoPTR = errors.New("no PTR record for the client's IP")
+
+type FCrDNSConfig struct {
+	// FCrDNSRejectNoPTR rejects the messages from IPs without a PTR record
+	FCrDNSRejectNoPTR bool `json:"fcrdns_reject_no_ptr,omitempty"`
+	// FCrDNSTimeout is how long to wait for the lookups, eg. "3s"
+	FCrDNSTimeout string `json:"fcrdns_timeout,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: fcrdns
+// ----------------------------------------------------------------------------------
+// Description   : Forward-confirmed reverse DNS. Looks up the PTR names of the client's
+//               : IP, and checks that one of them resolves back to the IP. Also checks
+//               : if the HELO is one of the names. The header processor adds the result
+//               : to the Received header
+// ----------------------------------------------------------------------------------
+// Config Options: fcrdns_reject_no_ptr bool - reject the message with a 550 if the IP
+//               : has no PTR record
+//               : fcrdns_timeout string - how long to wait for the lookups, default "3s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP
+//               : e.Helo
+// ----------------------------------------------------------------------------------
+// Output        : e.Values[ValuePTRName], e.Values[ValueFCrDNS] and
+//               : e.Values[ValueHeloMatchesPTR] are set (place before the header processor)
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["fcrdns"] = func() Decorator {
+		return FCrDNS()
+	}
+}
+
+func FCrDNS() Decorator {
+
+	var (
+		config  *FCrDNSConfig
+		timeout time.Duration
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&FCrDNSConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*FCrDNSConfig)
+		timeout = fcrdnsTimeout
+		if config.FCrDNSTimeout != "" {
+			if timeout, err = time.ParseDuration(config.FCrDNSTimeout); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				names, result := fcrdns(e.RemoteIP, timeout)
+				if result == FCrDNSNone && config.FCrDNSRejectNoPTR {
+					Log().WithField("ip", e.RemoteIP).WithField("queued_id", e.QueuedId).
+						Info("rejected message from an IP without a PTR record")
+					return NewResult(response.Canned.FailNoPTR), errNoPTR
+				}
+				e.Values[ValueFCrDNS] = result
+				if len(names) > 0 {
+					e.Values[ValuePTRName] = names[0]
+				}
+				matches := false
+				helo := strings.TrimSuffix(strings.ToLower(e.Helo), ".")
+				for _, name := range names {
+					if name == helo {
+						matches = true
+						break
+					}
+				}
+				e.Values[ValueHeloMatchesPTR] = matches
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// fcrdns returns the PTR names of ip, lowercase & without the trailing dot, and the result
+// of the check. When the check passes, the first name is the one that resolved back to ip
+func fcrdns(ip string, timeout time.Duration) ([]string, string) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, FCrDNSNone
+	}
+	type answer struct {
+		names  []string
+		result string
+	}
+	// buffered, so that the lookup can finish after the timeout
+	done := make(chan answer, 1)
+	go func() {
+		names, result := forwardConfirm(addr)
+		done <- answer{names, result}
+	}()
+	select {
+	case a := <-done:
+		return a.names, a.result
+	case <-time.After(timeout):
+		Log().WithField("ip", ip).Debug("fcrdns lookup timed out")
+		return nil, FCrDNSTempError
+	}
+}
+
+// forwardConfirm looks up the PTR names of addr, then resolves them until one has addr
+func forwardConfirm(addr net.IP) ([]string, string) {
+	ptrs, err := fcrdnsLookupAddr(addr.String())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && (dnsErr.Timeout() || dnsErr.Temporary()) {
+			return nil, FCrDNSTempError
+		}
+		return nil, FCrDNSNone
+	}
+	var names []string
+	for _, ptr := range ptrs {
+		if name := strings.TrimSuffix(strings.ToLower(ptr), "."); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, FCrDNSNone
+	}
+	if len(names) > fcrdnsMaxNames {
+		names = names[:fcrdnsMaxNames]
+	}
+	for i, name := range names {
+		ips, err := fcrdnsLookupHost(name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if addr.Equal(net.ParseIP(ip)) {
+				// the confirmed name goes first
+				names[0], names[i] = names[i], names[0]
+				return names, FCrDNSPass
+			}
+		}
+	}
+	return names, FCrDNSFail
+}
@@ -0,0 +1,106 @@
+package backends
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// mockFCrDNS replaces the resolver with canned records, call the returned func to restore it
+func mockFCrDNS() func() {
+	lookupAddr, lookupHost := fcrdnsLookupAddr, fcrdnsLookupHost
+	ptrs := map[string][]string{
+		"203.0.113.5": {"Mail.Example.com."},
+		"203.0.113.6": {"dsl-6.isp.example.net.", "relay.example.org."},
+		"203.0.113.7": {"forged.example.com."},
+	}
+	hosts := map[string][]string{
+		"mail.example.com":      {"203.0.113.5"},
+		"dsl-6.isp.example.net": {"198.51.100.1"},
+		"relay.example.org":     {"198.51.100.2", "203.0.113.6"},
+		"forged.example.com":    {"198.51.100.3"},
+	}
+	fcrdnsLookupAddr = func(addr string) ([]string, error) {
+		if names, ok := ptrs[addr]; ok {
+			return names, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: addr}
+	}
+	fcrdnsLookupHost = func(host string) ([]string, error) {
+		if ips, ok := hosts[host]; ok {
+			return ips, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	return func() {
+		fcrdnsLookupAddr, fcrdnsLookupHost = lookupAddr, lookupHost
+	}
+}
+
+func newFCrDNSEnvelope(ip, helo string) *mail.Envelope {
+	e := mail.NewEnvelope(ip, 1)
+	e.Helo = helo
+	e.RcptTo = []mail.Address{{User: "bob", Host: "example.org"}}
+	return e
+}
+
+func TestFCrDNS(t *testing.T) {
+	defer mockFCrDNS()()
+	// fcrdns goes first, then the header
+	p := newTestProcessor(t, BackendConfig{"primary_mail_host": "example.org"}, Header, FCrDNS)
+	for _, test := range []struct {
+		ip, helo, ptr, result, received string
+		matches                         bool
+	}{
+		{"203.0.113.5", "mail.example.com", "mail.example.com", FCrDNSPass,
+			"Received: from mail.example.com (mail.example.com [203.0.113.5]; fcrdns=pass)", true},
+		{"203.0.113.6", "relay.example.org", "relay.example.org", FCrDNSPass,
+			"Received: from relay.example.org (relay.example.org [203.0.113.6]; fcrdns=pass)", true},
+		{"203.0.113.7", "mail.example.com", "forged.example.com", FCrDNSFail,
+			"Received: from mail.example.com (unknown [203.0.113.7]; fcrdns=fail)", false},
+		{"203.0.113.8", "mail.example.com", "", FCrDNSNone,
+			"Received: from mail.example.com (unknown [203.0.113.8]; fcrdns=none)", false},
+	} {
+		e := newFCrDNSEnvelope(test.ip, test.helo)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error("expecting", test.ip, "to pass, got:", err)
+			continue
+		}
+		if e.Values[ValueFCrDNS] != test.result {
+			t.Error("expecting", test.result, "for", test.ip, "got:", e.Values[ValueFCrDNS])
+		}
+		if ptr, _ := e.Values[ValuePTRName].(string); ptr != test.ptr {
+			t.Error("expecting the PTR name", test.ptr, "for", test.ip, "got:", ptr)
+		}
+		if e.Values[ValueHeloMatchesPTR] != test.matches {
+			t.Error("unexpected HELO match for", test.ip, e.Values[ValueHeloMatchesPTR])
+		}
+		if !strings.Contains(e.DeliveryHeader, test.received+"\n") {
+			t.Error("expecting the result in the Received header, got:", e.DeliveryHeader)
+		}
+	}
+}
+
+func TestFCrDNSRejectNoPTR(t *testing.T) {
+	defer mockFCrDNS()()
+	p := newTestProcessor(t, BackendConfig{"primary_mail_host": "example.org", "fcrdns_reject_no_ptr": true}, Header, FCrDNS)
+	result, err := p.Process(newFCrDNSEnvelope("203.0.113.8", "mail.example.com"), TaskSaveMail)
+	if err != errNoPTR || result.Code() != 550 {
+		t.Error("expecting an IP without a PTR to be rejected, got:", result, err)
+	}
+	// a PTR that isn't confirmed is not rejected
+	if _, err := p.Process(newFCrDNSEnvelope("203.0.113.7", "mail.example.com"), TaskSaveMail); err != nil {
+		t.Error("expecting an IP with a PTR to pass, got:", err)
+	}
+
+	// a lookup that fails for a while is not rejected
+	fcrdnsLookupAddr = func(addr string) ([]string, error) {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: addr, IsTimeout: true}
+	}
+	e := newFCrDNSEnvelope("203.0.113.8", "mail.example.com")
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.Values[ValueFCrDNS] != FCrDNSTempError {
+		t.Error("expecting a temporary error to pass, got:", err, e.Values[ValueFCrDNS])
+	}
+}
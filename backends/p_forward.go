@@ -0,0 +1,614 @@
+package backends
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default time to wait for each reply, if 'forward_timeout' not present in config
+	forwardTimeout = time.Second * 30
+	// default delay before the first retry, if 'forward_retry_interval' not present in config
+	forwardRetryInterval = time.Minute * 5
+	// default longest delay between retries, if 'forward_retry_max_interval' not present in config
+	forwardRetryMaxInterval = time.Hour * 4
+	// default time a message is retried before it is bounced, if 'forward_max_queue_time' not present in config
+	forwardMaxQueueTime = time.Hour * 24 * 5
+	// extension of the queued messages
+	forwardQueueExt = ".fwd"
+)
+
+// the forward_starttls values
+const (
+	forwardTLSOpportunistic = "opportunistic"
+	forwardTLSRequired      = "required"
+	forwardTLSOff           = "off"
+)
+
+var (
+	// forwardLookupMX, forwardPort and forwardIsLocal can be changed for testing
+	forwardLookupMX = net.LookupMX
+	forwardPort     = "25"
+	forwardIsLocal  = isLocalHost
+	// forwardQueueTick is how often the queue is checked for messages to retry
+	forwardQueueTick = time.Second * 30
+)
+
+var errForwardNoTLS = errors.New("the server does not offer STARTTLS")
+
+type ForwardConfig struct {
+	// ForwardQueueDir is where the messages wait until they are delivered
+	ForwardQueueDir string `json:"forward_queue_dir"`
+	// ForwardHosts are the upstream servers, "host:port" separated by commas, tried in order
+	ForwardHosts string `json:"forward_hosts,omitempty"`
+	// ForwardMX delivers to the MX of the domain of each recipient, in place of the ForwardHosts
+	ForwardMX bool `json:"forward_mx,omitempty"`
+	// ForwardHelo is the name sent with EHLO, and the Reporting-MTA of the bounces. The hostname by default
+	ForwardHelo string `json:"forward_helo,omitempty"`
+	// ForwardStartTLS is "opportunistic", "required" or "off"
+	ForwardStartTLS string `json:"forward_starttls,omitempty"`
+	// ForwardTLSSkipVerify accepts any certificate of the server
+	ForwardTLSSkipVerify bool `json:"forward_tls_skip_verify,omitempty"`
+	// ForwardAuthUser & ForwardAuthPass log in with AUTH PLAIN, only over TLS
+	ForwardAuthUser string `json:"forward_auth_user,omitempty"`
+	ForwardAuthPass string `json:"forward_auth_pass,omitempty"`
+	// ForwardTimeout is how long to wait to connect & for each reply, eg. "30s"
+	ForwardTimeout string `json:"forward_timeout,omitempty"`
+	// ForwardRetryInterval is the delay before the first retry, doubled after each retry, eg. "5m"
+	ForwardRetryInterval string `json:"forward_retry_interval,omitempty"`
+	// ForwardRetryMaxInterval is the longest delay between retries, eg. "4h"
+	ForwardRetryMaxInterval string `json:"forward_retry_max_interval,omitempty"`
+	// ForwardMaxQueueTime is how long a message is retried before it is bounced, eg. "120h"
+	ForwardMaxQueueTime string `json:"forward_max_queue_time,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: forward
+// ----------------------------------------------------------------------------------
+// Description   : Relays the message to upstream SMTP servers, store & forward. The
+//               : message is written to a queue dir & the client gets a 250, then it is
+//               : delivered to the forward_hosts, or to the MX of each recipient's
+//               : domain. STARTTLS is used when offered, & AUTH PLAIN if a user is set.
+//               : Recipients that got a temporary failure are retried, with a delay
+//               : that doubles after each try. Recipients that were rejected, or still
+//               : failing after forward_max_queue_time, are bounced to the sender with
+//               : a DSN, which is queued & delivered the same way
+// ----------------------------------------------------------------------------------
+// Config Options: forward_queue_dir string - dir of the queued messages
+//               : forward_hosts string - upstream "host:port" list, tried in order,
+//               : eg. "smtp.example.com:587,backup.example.com:25"
+//               : forward_mx bool - deliver to the MX of the recipients' domains, in
+//               : place of forward_hosts
+//               : forward_helo string - the EHLO name & the Reporting-MTA of the
+//               : bounces, default the hostname
+//               : forward_starttls string - "opportunistic" (default), "required" or "off"
+//               : forward_tls_skip_verify bool - do not verify the server's certificate
+//               : forward_auth_user string - log in with AUTH PLAIN, over TLS only
+//               : forward_auth_pass string
+//               : forward_timeout string - time to wait for each reply, default "30s"
+//               : forward_retry_interval string - delay before the first retry, default "5m"
+//               : forward_retry_max_interval string - longest delay between retries,
+//               : default "4h"
+//               : forward_max_queue_time string - how long to retry before bouncing,
+//               : default "120h"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.MailFrom & e.RcptTo
+//               : the DSN parameters of the recipients, to decide what to bounce
+// ----------------------------------------------------------------------------------
+// Output        : the message written to the queue, a 451 if it could not be
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["forward"] = func() Decorator {
+		return Forward()
+	}
+}
+
+// forwardQueued is a message in the queue, RcptTo are the recipients still to be delivered
+type forwardQueued struct {
+	spooledEnvelope
+	// DSN are the DSN parameters of the recipients, by address
+	DSN map[string]DSNRcpt `json:",omitempty"`
+	// LastReply is the last temporary failure of each recipient, by address
+	LastReply   map[string]string `json:",omitempty"`
+	QueuedAt    int64
+	Attempts    int
+	NextAttempt int64
+}
+
+// forwarder delivers the messages in a queue dir
+type forwarder struct {
+	dir           string
+	hosts         []string
+	mx            bool
+	helo          string
+	startTLS      string
+	skipVerify    bool
+	authUser      string
+	authPass      string
+	timeout       time.Duration
+	retryInterval time.Duration
+	retryMax      time.Duration
+	maxQueueTime  time.Duration
+}
+
+// forwardRoute is where a group of recipients is delivered to
+type forwardRoute struct {
+	hosts []string
+	rcpts []int
+	// err is the failure of all the rcpts, if no host was found
+	err Result
+}
+
+// newForwarder returns a forwarder for config
+func newForwarder(config *ForwardConfig) (*forwarder, error) {
+	f := &forwarder{
+		dir:           config.ForwardQueueDir,
+		mx:            config.ForwardMX,
+		helo:          config.ForwardHelo,
+		startTLS:      strings.ToLower(config.ForwardStartTLS),
+		skipVerify:    config.ForwardTLSSkipVerify,
+		authUser:      config.ForwardAuthUser,
+		authPass:      config.ForwardAuthPass,
+		timeout:       forwardTimeout,
+		retryInterval: forwardRetryInterval,
+		retryMax:      forwardRetryMaxInterval,
+		maxQueueTime:  forwardMaxQueueTime,
+	}
+	if f.dir == "" {
+		return nil, errors.New("forward_queue_dir cannot be empty")
+	}
+	for _, host := range strings.Split(config.ForwardHosts, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return nil, fmt.Errorf("invalid forward_hosts: %s", err)
+		}
+		f.hosts = append(f.hosts, host)
+	}
+	if (len(f.hosts) == 0) != f.mx {
+		return nil, errors.New("either forward_hosts or forward_mx must be set")
+	}
+	switch f.startTLS {
+	case "":
+		f.startTLS = forwardTLSOpportunistic
+	case forwardTLSOpportunistic, forwardTLSRequired, forwardTLSOff:
+	default:
+		return nil, fmt.Errorf("invalid forward_starttls: %s", config.ForwardStartTLS)
+	}
+	for _, d := range []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{config.ForwardTimeout, &f.timeout},
+		{config.ForwardRetryInterval, &f.retryInterval},
+		{config.ForwardRetryMaxInterval, &f.retryMax},
+		{config.ForwardMaxQueueTime, &f.maxQueueTime},
+	} {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		if *d.dst, err = time.ParseDuration(d.value); err != nil {
+			return nil, err
+		}
+	}
+	if f.helo == "" {
+		var err error
+		if f.helo, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// enqueue writes e to the queue, to be delivered by the next run
+func (f *forwarder) enqueue(e *mail.Envelope, now time.Time) error {
+	q := forwardQueued{
+		spooledEnvelope: *newSpooledEnvelope(e),
+		QueuedAt:        now.Unix(),
+	}
+	q.DSN, _ = e.Values[ValueDSNRcpts].(map[string]DSNRcpt)
+	b, err := json.Marshal(&q)
+	if err != nil {
+		return err
+	}
+	return writeSpoolFile(f.dir, b, forwardQueueExt)
+}
+
+// backoff returns the delay after the attempts failed tries
+func (f *forwarder) backoff(attempts int) time.Duration {
+	d := f.retryInterval
+	for i := 1; i < attempts && d < f.retryMax; i++ {
+		d *= 2
+	}
+	if d > f.retryMax {
+		d = f.retryMax
+	}
+	return d
+}
+
+// run delivers the queued messages that are due at now
+func (f *forwarder) run(now time.Time) {
+	lock := fallbackSpoolLock(f.dir)
+	lock.Lock()
+	defer lock.Unlock()
+	files, err := filepath.Glob(filepath.Join(f.dir, "*"+forwardQueueExt))
+	if err != nil {
+		Log().WithError(err).Error("could not read the forward queue")
+		return
+	}
+	// oldest first
+	sort.Strings(files)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			Log().WithError(err).WithField("file", file).Error("could not read a queued message")
+			continue
+		}
+		var q forwardQueued
+		if err := json.Unmarshal(b, &q); err != nil {
+			Log().WithError(err).WithField("file", file).Error("could not read a queued message")
+			continue
+		}
+		if q.NextAttempt > now.Unix() {
+			continue
+		}
+		f.process(file, &q, now)
+	}
+}
+
+// process tries to deliver q, then bounces its failed recipients & requeues the others
+func (f *forwarder) process(file string, q *forwardQueued, now time.Time) {
+	e := q.envelope()
+	results := f.deliver(e)
+	var (
+		pending []mail.Address
+		failed  []dsnFailure
+	)
+	if q.LastReply == nil {
+		q.LastReply = make(map[string]string)
+	}
+	expired := now.Sub(time.Unix(q.QueuedAt, 0)) >= f.maxQueueTime
+	for i, rcpt := range e.RcptTo {
+		r := results[i]
+		switch code := r.Code(); {
+		case code >= 200 && code < 300:
+			Log().WithField("queued_id", e.QueuedId).Info("forwarded to ", rcpt.String())
+			delete(q.LastReply, rcpt.String())
+			continue
+		case code >= 500, expired:
+		default:
+			q.LastReply[rcpt.String()] = r.String()
+			pending = append(pending, rcpt)
+			continue
+		}
+		Log().WithField("queued_id", e.QueuedId).Info("could not forward to ", rcpt.String(), ": ", r.String())
+		failed = append(failed, dsnFailure{rcpt: rcpt, dsn: q.DSN[rcpt.String()], result: r})
+	}
+	if len(failed) > 0 {
+		f.bounce(e, failed, now)
+	}
+	if len(pending) == 0 {
+		if err := os.Remove(file); err != nil {
+			Log().WithError(err).WithField("file", file).Error("could not remove a forwarded message")
+		}
+		return
+	}
+	q.RcptTo = pending
+	q.Attempts++
+	q.NextAttempt = now.Add(f.backoff(q.Attempts)).Unix()
+	b, err := json.Marshal(q)
+	if err == nil {
+		// replaced when complete, so that it is never read half written
+		if err = ioutil.WriteFile(file+".tmp", b, 0600); err == nil {
+			err = os.Rename(file+".tmp", file)
+		}
+	}
+	if err != nil {
+		Log().WithError(err).WithField("file", file).Error("could not requeue a message")
+	}
+}
+
+// bounce queues a DSN to the sender of e for the failed recipients that asked for one
+func (f *forwarder) bounce(e *mail.Envelope, failed []dsnFailure, now time.Time) {
+	if e.MailFrom.IsEmpty() {
+		// never bounce a bounce
+		return
+	}
+	var notify []dsnFailure
+	for _, fail := range failed {
+		if fail.dsn.notifies(DSNNotifyFailure) {
+			notify = append(notify, fail)
+		}
+	}
+	if len(notify) == 0 {
+		return
+	}
+	msg, err := newDSN(e, f.helo, notify)
+	if err == nil {
+		b := mail.NewEnvelope("127.0.0.1", 0)
+		b.QueuedId = e.QueuedId + ".dsn"
+		b.RcptTo = []mail.Address{e.MailFrom}
+		b.Data.Write(msg)
+		err = f.enqueue(b, now)
+	}
+	if err != nil {
+		Log().WithError(err).Error("could not queue the bounce of message ", e.QueuedId)
+	}
+}
+
+// routes groups the recipients of e by where they are delivered to
+func (f *forwarder) routes(e *mail.Envelope) []*forwardRoute {
+	if !f.mx {
+		route := &forwardRoute{hosts: f.hosts}
+		for i := range e.RcptTo {
+			route.rcpts = append(route.rcpts, i)
+		}
+		return []*forwardRoute{route}
+	}
+	var routes []*forwardRoute
+	byDomain := make(map[string]*forwardRoute)
+	for i, rcpt := range e.RcptTo {
+		domain := strings.ToLower(rcpt.Host)
+		route, ok := byDomain[domain]
+		if !ok {
+			route = f.lookupRoute(domain)
+			byDomain[domain] = route
+			routes = append(routes, route)
+		}
+		route.rcpts = append(route.rcpts, i)
+	}
+	return routes
+}
+
+// lookupRoute finds the MX hosts of domain, or the domain itself if it has no MX
+func (f *forwarder) lookupRoute(domain string) *forwardRoute {
+	route := &forwardRoute{}
+	mxs, err := forwardLookupMX(domain)
+	if err != nil {
+		// without an MX, the domain itself is the host, RFC 5321 5.1
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			route.err = NewResult("451 4.4.3 Could not look up the MX of " + domain)
+			return route
+		}
+		mxs = nil
+	}
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		// a null MX, RFC 7505
+		route.err = NewResult("556 5.1.10 Domain does not accept mail: " + domain)
+		return route
+	}
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if forwardIsLocal(host) {
+			// delivering to ourselves would loop
+			route.err = NewResult("554 5.4.6 Mail for " + domain + " loops back to myself")
+			return route
+		}
+		route.hosts = append(route.hosts, net.JoinHostPort(host, forwardPort))
+	}
+	if len(route.hosts) == 0 {
+		route.hosts = []string{net.JoinHostPort(domain, forwardPort)}
+	}
+	return route
+}
+
+// deliver sends e to its routes, and returns the reply of each recipient
+func (f *forwarder) deliver(e *mail.Envelope) []Result {
+	results := make([]Result, len(e.RcptTo))
+	for _, route := range f.routes(e) {
+		var (
+			routeResults []Result
+			err          error
+		)
+		if route.err == nil {
+			// the next host is tried if one can't be reached
+			for _, host := range route.hosts {
+				if routeResults, err = f.send(host, e, route.rcpts); err == nil {
+					break
+				}
+				Log().WithError(err).WithField("queued_id", e.QueuedId).Warn("could not forward to ", host)
+			}
+		}
+		for n, i := range route.rcpts {
+			switch {
+			case route.err != nil:
+				results[i] = route.err
+			case err != nil:
+				results[i] = NewResult("451 4.4.1 " + err.Error())
+			default:
+				results[i] = routeResults[n]
+			}
+		}
+	}
+	return results
+}
+
+// send delivers e to the rcpts of e at host, and returns the reply of each.
+// Returns an error if the connection failed before the server replied for the rcpts
+func (f *forwarder) send(host string, e *mail.Envelope, rcpts []int) ([]Result, error) {
+	conn, err := net.DialTimeout("tcp", host, f.timeout)
+	if err != nil {
+		return nil, err
+	}
+	deadline := func() {
+		conn.SetDeadline(time.Now().Add(f.timeout))
+	}
+	deadline()
+	name, _, _ := net.SplitHostPort(host)
+	c, err := smtp.NewClient(conn, name)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+	if err = c.Hello(f.helo); err != nil {
+		return nil, err
+	}
+	if f.startTLS != forwardTLSOff {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			deadline()
+			if err = c.StartTLS(&tls.Config{ServerName: name, InsecureSkipVerify: f.skipVerify}); err != nil {
+				return nil, err
+			}
+		} else if f.startTLS == forwardTLSRequired {
+			return nil, errForwardNoTLS
+		}
+	}
+	if f.authUser != "" {
+		deadline()
+		if err = c.Auth(smtp.PlainAuth("", f.authUser, f.authPass, name)); err != nil {
+			return nil, err
+		}
+	}
+	results := make([]Result, len(rcpts))
+	// all the rcpts get the reply of a refused MAIL or DATA
+	all := func(indexes []int, r Result) []Result {
+		for _, n := range indexes {
+			results[n] = r
+		}
+		return results
+	}
+	var everyone []int
+	for n := range rcpts {
+		everyone = append(everyone, n)
+	}
+	deadline()
+	from := ""
+	if !e.MailFrom.IsEmpty() {
+		from = e.MailFrom.String()
+	}
+	if err = c.Mail(from); err != nil {
+		if r := smtpReply(err); r != nil {
+			return all(everyone, r), nil
+		}
+		return nil, err
+	}
+	var accepted []int
+	for n, i := range rcpts {
+		deadline()
+		if err = c.Rcpt(e.RcptTo[i].String()); err != nil {
+			if results[n] = smtpReply(err); results[n] == nil {
+				return nil, err
+			}
+			continue
+		}
+		accepted = append(accepted, n)
+	}
+	if len(accepted) == 0 {
+		c.Reset()
+		c.Quit()
+		return results, nil
+	}
+	deadline()
+	w, err := c.Data()
+	if err != nil {
+		if r := smtpReply(err); r != nil {
+			return all(accepted, r), nil
+		}
+		return nil, err
+	}
+	// a second more for each KB, so that a big message isn't cut off
+	conn.SetDeadline(time.Now().Add(f.timeout + time.Duration(e.Data.Len()/1024)*time.Second))
+	_, err = w.Write([]byte(e.DeliveryHeader))
+	if err == nil {
+		_, err = w.Write(e.Data.Bytes())
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if r := smtpReply(err); r != nil {
+			return all(accepted, r), nil
+		}
+		return nil, err
+	}
+	c.Quit()
+	return all(accepted, BackendResultOK), nil
+}
+
+func Forward() Decorator {
+
+	var (
+		f    *forwarder
+		kick chan bool
+		stop chan bool
+		done chan bool
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ForwardConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		if f, err = newForwarder(bcfg.(*ForwardConfig)); err != nil {
+			return err
+		}
+		kick, stop, done = make(chan bool, 1), make(chan bool), make(chan bool)
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(forwardQueueTick)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-kick:
+				case <-stop:
+					return
+				}
+				f.run(time.Now())
+			}
+		}()
+		return nil
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if stop != nil {
+			close(stop)
+			<-done
+			stop = nil
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if err := f.enqueue(e, time.Now()); err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not queue the message for forwarding")
+					return NewResult(response.Canned.ErrorBackendTransaction + "forward queue failed"), NewRetryableError(err)
+				}
+				Log().WithField("queued_id", e.QueuedId).Info("queued for forwarding")
+				// deliver it now, without waiting for the tick
+				select {
+				case kick <- true:
+				default:
+				}
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forwardTestServer refuses nobody@ & defers busy@ at the RCPT, and keeps the messages
+type forwardTestServer struct {
+	l        net.Listener
+	messages []forwardTestMessage
+	sync.Mutex
+}
+
+type forwardTestMessage struct {
+	from  string
+	rcpts []string
+	data  string
+}
+
+func newForwardTestServer(t *testing.T) *forwardTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &forwardTestServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *forwardTestServer) serve(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	defer text.Close()
+	var msg forwardTestMessage
+	text.PrintfLine("220 smtp.example.com ESMTP ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case cmd == "EHLO":
+			text.PrintfLine("250-smtp.example.com")
+			text.PrintfLine("250 8BITMIME")
+		case cmd == "MAIL":
+			msg = forwardTestMessage{from: strings.Fields(line[len("MAIL FROM:"):])[0]}
+			text.PrintfLine("250 2.1.0 Ok")
+		case cmd == "RCPT" && strings.Contains(line, "<nobody@"):
+			text.PrintfLine("550 5.1.1 User doesn't exist")
+		case cmd == "RCPT" && strings.Contains(line, "<busy@"):
+			text.PrintfLine("451 4.2.1 Try again later")
+		case cmd == "RCPT":
+			msg.rcpts = append(msg.rcpts, line[len("RCPT TO:"):])
+			text.PrintfLine("250 2.1.5 Ok")
+		case cmd == "DATA":
+			text.PrintfLine("354 OK")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.Lock()
+			s.messages = append(s.messages, msg)
+			s.Unlock()
+			text.PrintfLine("250 2.0.0 Queued")
+		case cmd == "RSET":
+			text.PrintfLine("250 2.0.0 Ok")
+		case cmd == "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("500 5.5.1 Unknown command")
+		}
+	}
+}
+
+func (s *forwardTestServer) received() []forwardTestMessage {
+	s.Lock()
+	defer s.Unlock()
+	return append([]forwardTestMessage(nil), s.messages...)
+}
+
+// readForwardQueue returns the messages in the queue dir
+func readForwardQueue(t *testing.T, dir string) []forwardQueued {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+forwardQueueExt))
+	var queue []forwardQueued
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q forwardQueued
+		if err := json.Unmarshal(b, &q); err != nil {
+			t.Fatal(err)
+		}
+		queue = append(queue, q)
+	}
+	return queue
+}
+
+func TestForward(t *testing.T) {
+	s := newForwardTestServer(t)
+	defer s.l.Close()
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := newTestProcessor(t, BackendConfig{
+		"forward_queue_dir": dir,
+		"forward_hosts":     "127.0.0.1:1," + s.l.Addr().String(),
+		"forward_timeout":   "1s",
+	}, Forward)
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	e.DeliveryHeader = "Received: from mx.example.com\n"
+	if result, err := p.Process(e, TaskSaveMail); err != nil || resultCode(result) != 200 {
+		t.Fatal("the message should be queued, got:", result, err)
+	}
+	// delivered by the queue, to the host that is up
+	for i := 0; i < 50 && len(s.received()) == 0; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	messages := s.received()
+	if len(messages) != 1 || messages[0].from != "<alice@example.com>" || messages[0].rcpts[0] != "<bob@example.org>" ||
+		messages[0].data != "Received: from mx.example.com\nSubject: hello\n\nhi\n" {
+		t.Error("unexpected messages:", messages)
+	}
+	if queue := readForwardQueue(t, dir); len(queue) != 0 {
+		t.Error("expecting the queue to be empty, got:", queue)
+	}
+}
+
+func TestForwardRetryBounce(t *testing.T) {
+	s := newForwardTestServer(t)
+	defer s.l.Close()
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := newForwarder(&ForwardConfig{
+		ForwardQueueDir:      dir,
+		ForwardHosts:         s.l.Addr().String(),
+		ForwardHelo:          "relay.example.com",
+		ForwardTimeout:       "1s",
+		ForwardRetryInterval: "1m",
+		ForwardMaxQueueTime:  "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n",
+		"bob@example.org", "nobody@example.org", "busy@example.org")
+	if err := f.enqueue(e, now); err != nil {
+		t.Fatal(err)
+	}
+	f.run(now)
+	if messages := s.received(); len(messages) != 1 || len(messages[0].rcpts) != 1 {
+		t.Fatal("expecting the message to be delivered to bob, got:", messages)
+	}
+	// busy is retried, the bounce of nobody is queued
+	queue := readForwardQueue(t, dir)
+	if len(queue) != 2 {
+		t.Fatal("expecting 2 queued messages, got:", queue)
+	}
+	q := queue[0]
+	if len(q.RcptTo) != 1 || q.RcptTo[0].String() != "busy@example.org" || q.Attempts != 1 ||
+		q.NextAttempt != now.Add(time.Minute).Unix() || q.LastReply["busy@example.org"] != "451 4.2.1 Try again later" {
+		t.Error("unexpected queued message:", q.RcptTo, q.Attempts, q.NextAttempt, q.LastReply)
+	}
+
+	// the bounce is delivered, busy is not due yet
+	f.run(now)
+	messages := s.received()
+	if len(messages) != 2 || messages[1].from != "<>" || messages[1].rcpts[0] != "<alice@example.com>" ||
+		!strings.Contains(messages[1].data, "Final-Recipient: rfc822; nobody@example.org") ||
+		!strings.Contains(messages[1].data, "Status: 5.1.1") ||
+		!strings.Contains(messages[1].data, "Reporting-MTA: dns; relay.example.com") {
+		t.Fatal("expecting the bounce of nobody, got:", messages)
+	}
+
+	// the delay doubles
+	f.run(now.Add(time.Minute))
+	if queue = readForwardQueue(t, dir); len(queue) != 1 || queue[0].Attempts != 2 ||
+		queue[0].NextAttempt != now.Add(time.Minute*3).Unix() {
+		t.Error("expecting busy to be retried after 2m, got:", queue)
+	}
+
+	// too old, busy is bounced
+	f.run(now.Add(time.Hour))
+	f.run(now.Add(time.Hour))
+	messages = s.received()
+	if len(messages) != 3 || !strings.Contains(messages[2].data, "Final-Recipient: rfc822; busy@example.org") ||
+		!strings.Contains(messages[2].data, "Status: 4.2.1") {
+		t.Error("expecting the bounce of busy, got:", messages)
+	}
+	if queue = readForwardQueue(t, dir); len(queue) != 0 {
+		t.Error("expecting the queue to be empty, got:", queue)
+	}
+
+	// a bounce is never bounced
+	e = newAccountingEnvelope("", "Subject: bounce\n\nhi\n", "nobody@example.org")
+	if err := f.enqueue(e, now); err != nil {
+		t.Fatal(err)
+	}
+	f.run(now)
+	if queue = readForwardQueue(t, dir); len(queue) != 0 {
+		t.Error("expecting the queue to be empty, got:", queue)
+	}
+}
+
+func TestForwardMX(t *testing.T) {
+	s := newForwardTestServer(t)
+	defer s.l.Close()
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, port, _ := net.SplitHostPort(s.l.Addr().String())
+	defer func(lookup func(string) ([]*net.MX, error), port string, isLocal func(string) bool) {
+		forwardLookupMX, forwardPort, forwardIsLocal = lookup, port, isLocal
+	}(forwardLookupMX, forwardPort, forwardIsLocal)
+	forwardPort = port
+	forwardIsLocal = func(host string) bool { return host == "mx.example.com" }
+	forwardLookupMX = func(domain string) ([]*net.MX, error) {
+		switch domain {
+		case "example.org":
+			return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+		case "example.net":
+			return []*net.MX{{Host: ".", Pref: 0}}, nil
+		case "example.com":
+			return []*net.MX{{Host: "mx.example.com.", Pref: 10}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	f, err := newForwarder(&ForwardConfig{ForwardQueueDir: dir, ForwardMX: true, ForwardTimeout: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n",
+		"bob@Example.org", "carol@example.net", "dave@example.com")
+	results := f.deliver(e)
+	if len(results) != 3 || resultCode(results[0]) != 200 || resultCode(results[1]) != 556 || resultCode(results[2]) != 554 {
+		t.Error("unexpected results:", results)
+	}
+	if messages := s.received(); len(messages) != 1 || messages[0].rcpts[0] != "<bob@Example.org>" {
+		t.Error("expecting the message to be delivered to the MX of example.org, got:", messages)
+	}
+}
+
+func TestForwardRequireTLS(t *testing.T) {
+	s := newForwardTestServer(t)
+	defer s.l.Close()
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := newForwarder(&ForwardConfig{
+		ForwardQueueDir: dir, ForwardHosts: s.l.Addr().String(), ForwardStartTLS: "required", ForwardTimeout: "1s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	results := f.deliver(e)
+	if len(results) != 1 || resultCode(results[0]) != 451 || !strings.Contains(results[0].String(), "STARTTLS") {
+		t.Error("expecting the message to be deferred, got:", results)
+	}
+	if messages := s.received(); len(messages) != 0 {
+		t.Error("nothing should be delivered without TLS, got:", messages)
+	}
+}
+
+func TestForwardConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"forward_queue_dir": "", "forward_mx": true}, "forward_queue_dir cannot be empty"},
+		{BackendConfig{"forward_queue_dir": dir}, "either forward_hosts or forward_mx"},
+		{BackendConfig{"forward_queue_dir": dir, "forward_hosts": "smtp.example.com:25", "forward_mx": true},
+			"either forward_hosts or forward_mx"},
+		{BackendConfig{"forward_queue_dir": dir, "forward_hosts": "smtp.example.com"}, "invalid forward_hosts"},
+		{BackendConfig{"forward_queue_dir": dir, "forward_mx": true, "forward_starttls": "always"}, "invalid forward_starttls"},
+		{BackendConfig{"forward_queue_dir": dir, "forward_mx": true, "forward_retry_interval": "soon"}, "invalid duration"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, Forward)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
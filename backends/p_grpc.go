@@ -0,0 +1,514 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default deadline of SaveMail, if 'grpc_timeout' not present in config
+	grpcTimeout = time.Second * 10
+	// default size of the chunks of the message, if 'grpc_chunk_size_kb' not present in config
+	grpcChunkSizeKB = 64
+	// the chunks must be under the default 4MB limit of the messages that a server receives
+	grpcMaxChunkSizeKB = 4000
+
+	// the methods of the Backend service, see proto/backend.proto
+	grpcMethodValidateRcpt = "/guerrilla.backend.v1.Backend/ValidateRcpt"
+	grpcMethodSaveMail     = "/guerrilla.backend.v1.Backend/SaveMail"
+)
+
+var (
+	errGRPCRejected = errors.New("rejected by the grpc service")
+	errGRPCDeferred = errors.New("deferred by the grpc service")
+	errProtoInvalid = errors.New("invalid protobuf message")
+)
+
+// grpcConn is a connection to the service
+type grpcConn interface {
+	// Call calls the unary method with the encoded request, and returns the encoded reply
+	Call(ctx context.Context, method string, req []byte) ([]byte, error)
+	// Stream calls the client streaming method, sending the requests returned by next
+	// until it returns io.EOF, and returns the encoded reply
+	Stream(ctx context.Context, method string, next func() ([]byte, error)) ([]byte, error)
+	Close() error
+}
+
+// newGRPCConn connects to the target, without TLS if tlsConfig is nil. It is set by grpc_client.go
+// when built with -tags grpc. Changed for testing
+var newGRPCConn func(target string, tlsConfig *tls.Config) (grpcConn, error)
+
+type GRPCConfig struct {
+	// GRPCTarget is the address of the service, eg. "mailstore.internal:7000" or "dns:///mailstore:7000"
+	GRPCTarget string `json:"grpc_target"`
+	// GRPCTLS connects with TLS
+	GRPCTLS bool `json:"grpc_tls,omitempty"`
+	// GRPCTLSCAFile is a PEM file of the CAs that the service's certificate is verified with,
+	// the system CAs by default
+	GRPCTLSCAFile string `json:"grpc_tls_ca_file,omitempty"`
+	// GRPCTLSCertFile & GRPCTLSKeyFile are the client certificate, for mTLS
+	GRPCTLSCertFile string `json:"grpc_tls_cert_file,omitempty"`
+	GRPCTLSKeyFile  string `json:"grpc_tls_key_file,omitempty"`
+	// GRPCTLSServerName is the name in the service's certificate, the host of the target by default
+	GRPCTLSServerName string `json:"grpc_tls_server_name,omitempty"`
+	// GRPCTLSSkipVerify accepts any certificate of the service
+	GRPCTLSSkipVerify bool `json:"grpc_tls_skip_verify,omitempty"`
+	// GRPCTimeout is the deadline of SaveMail, eg. "10s"
+	GRPCTimeout string `json:"grpc_timeout,omitempty"`
+	// GRPCValidateTimeout is the deadline of ValidateRcpt, eg. "2s"
+	GRPCValidateTimeout string `json:"grpc_validate_timeout,omitempty"`
+	// GRPCChunkSizeKB is the size of the chunks that the message is streamed in
+	GRPCChunkSizeKB int `json:"grpc_chunk_size_kb,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: grpc
+// ----------------------------------------------------------------------------------
+// Description   : Calls a gRPC service that validates the recipients & saves the mail,
+//               : so that they can be implemented in any language. The service is
+//               : defined in backends/proto/backend.proto.
+//               : During TaskValidateRcpt, ValidateRcpt is called with the envelope &
+//               : the recipient. A 4xx or 5xx reply is the reply to the RCPT command.
+//               : During TaskSaveMail, SaveMail is called with a stream of the envelope
+//               : followed by the message in chunks, so that a large message is not
+//               : sent in one request. A 4xx reply fails the message with a retryable
+//               : error, a 5xx reply rejects it. The reply can fail some recipients
+//               : only, they get their reply by SetRcptResult.
+//               : If the service could not be called before the deadline, the recipient
+//               : or the message get a 451. The deadline of ValidateRcpt is under the
+//               : gw_val_rcpt_timeout of the gateway, so that the service's reply is
+//               : not too late.
+//               : Must be built with the grpc tag: go build -tags grpc
+// ----------------------------------------------------------------------------------
+// Config Options: grpc_target string - the address of the service, eg. "localhost:7000"
+//               : grpc_tls bool - connect with TLS
+//               : grpc_tls_ca_file string - PEM file of the CAs of the service's certificate
+//               : grpc_tls_cert_file string - PEM file of the client certificate, for mTLS
+//               : grpc_tls_key_file string - PEM file of the key of the client certificate
+//               : grpc_tls_server_name string - the name in the service's certificate
+//               : grpc_tls_skip_verify bool - do not verify the service's certificate
+//               : grpc_timeout string - deadline of SaveMail, default "10s"
+//               : grpc_validate_timeout string - deadline of ValidateRcpt, default and
+//               : at most 4/5 of gw_val_rcpt_timeout
+//               : grpc_chunk_size_kb int - size of the chunks of the message, default 64
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.Subject parsed by the HeadersParser processor
+//               : e.QueuedId, e.MailFrom, e.RcptTo, e.RemoteIP, e.Helo & e.TLS
+// ----------------------------------------------------------------------------------
+// Output        : RcptReply error with the reply of the service during TaskValidateRcpt
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["grpc"] = func() Decorator {
+		return GRPC()
+	}
+}
+
+// the wire types of protobuf
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoAppendVarint appends v as a varint
+func protoAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// protoAppendUint appends the varint field num, unless v is 0, the default value
+func protoAppendUint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protoAppendVarint(b, uint64(num)<<3|protoVarint)
+	return protoAppendVarint(b, v)
+}
+
+// protoAppendBytes appends the length delimited field num
+func protoAppendBytes(b []byte, num int, data []byte) []byte {
+	b = protoAppendVarint(b, uint64(num)<<3|protoBytes)
+	b = protoAppendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// protoAppendString appends the string field num, unless s is empty, the default value
+func protoAppendString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return protoAppendBytes(b, num, []byte(s))
+}
+
+// protoField is a field of a message, v is the value of the varint & fixed fields, data
+// of the length delimited fields
+type protoField struct {
+	num  int
+	wire int
+	v    uint64
+	data []byte
+}
+
+// protoFields calls f with each field of the message b, in order
+func protoFields(b []byte, f func(field protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoInvalid
+		}
+		b = b[n:]
+		field := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch field.wire {
+		case protoVarint:
+			if field.v, n = binary.Uvarint(b); n <= 0 {
+				return errProtoInvalid
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errProtoInvalid
+			}
+			field.v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return errProtoInvalid
+			}
+			field.v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errProtoInvalid
+			}
+			field.data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return errProtoInvalid
+		}
+		if err := f(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grpcEnvelope encodes the Envelope of e, size is the size of the message, 0 if not known
+func grpcEnvelope(e *mail.Envelope, size int) []byte {
+	var b []byte
+	b = protoAppendString(b, 1, e.QueuedId)
+	b = protoAppendString(b, 2, e.RemoteIP)
+	b = protoAppendString(b, 3, e.Helo)
+	if !e.MailFrom.IsEmpty() {
+		b = protoAppendString(b, 4, e.MailFrom.String())
+	}
+	for _, rcpt := range e.RcptTo {
+		b = protoAppendBytes(b, 5, []byte(rcpt.String()))
+	}
+	if e.TLS {
+		b = protoAppendUint(b, 6, 1)
+	}
+	b = protoAppendString(b, 7, e.Subject)
+	return protoAppendUint(b, 8, uint64(size))
+}
+
+// grpcRcptReply is the reply of the service for a recipient
+type grpcRcptReply struct {
+	rcpt    string
+	code    uint32
+	message string
+}
+
+// grpcReply is the reply of the service
+type grpcReply struct {
+	code    uint32
+	message string
+	rcpts   []grpcRcptReply
+}
+
+// parseGRPCReply decodes a Reply
+func parseGRPCReply(b []byte) (*grpcReply, error) {
+	reply := &grpcReply{}
+	err := protoFields(b, func(field protoField) error {
+		switch {
+		case field.num == 1 && field.wire == protoVarint:
+			reply.code = uint32(field.v)
+		case field.num == 2 && field.wire == protoBytes:
+			reply.message = string(field.data)
+		case field.num == 3 && field.wire == protoBytes:
+			var rcpt grpcRcptReply
+			if err := protoFields(field.data, func(field protoField) error {
+				switch {
+				case field.num == 1 && field.wire == protoBytes:
+					rcpt.rcpt = string(field.data)
+				case field.num == 2 && field.wire == protoVarint:
+					rcpt.code = uint32(field.v)
+				case field.num == 3 && field.wire == protoBytes:
+					rcpt.message = string(field.data)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			reply.rcpts = append(reply.rcpts, rcpt)
+		}
+		// the fields added to the service later are skipped
+		return nil
+	})
+	return reply, err
+}
+
+// grpcResult returns the SMTP reply of code & message, a code of 0 is a 250
+func grpcResult(code uint32, message string) (Result, error) {
+	if code == 0 {
+		code = 250
+	}
+	class := code / 100
+	if class != 2 && class != 4 && class != 5 || code > 599 {
+		return nil, fmt.Errorf("invalid reply code %d from the grpc service", code)
+	}
+	if message == "" {
+		switch class {
+		case 2:
+			message = "2.0.0 OK"
+		case 4:
+			message = "4.0.0 Error: " + errGRPCDeferred.Error()
+		default:
+			message = "5.0.0 Error: " + errGRPCRejected.Error()
+		}
+	}
+	return NewResult(fmt.Sprintf("%d %s", code, message)), nil
+}
+
+// grpcValidateTimeout returns the grpc_validate_timeout, or 4/5 of the gateway's validate
+// timeout if it is not set or longer, so that the reply is in time for the RCPT command
+func grpcValidateTimeout(config *GRPCConfig, gwConfig *GatewayConfig) (time.Duration, error) {
+	gwTimeout := validateRcptTimeout
+	if gwConfig.TimeoutValidateRcpt != "" {
+		var err error
+		if gwTimeout, err = time.ParseDuration(gwConfig.TimeoutValidateRcpt); err != nil {
+			return 0, err
+		}
+	}
+	limit := gwTimeout * 4 / 5
+	if config.GRPCValidateTimeout == "" {
+		return limit, nil
+	}
+	timeout, err := time.ParseDuration(config.GRPCValidateTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if timeout > limit {
+		Log().Warnf("grpc_validate_timeout %s is too long for gw_val_rcpt_timeout %s, using %s", timeout, gwTimeout, limit)
+		timeout = limit
+	}
+	return timeout, nil
+}
+
+// grpcTLSConfig returns the TLS config of the connection, nil without grpc_tls
+func grpcTLSConfig(config *GRPCConfig) (*tls.Config, error) {
+	if !config.GRPCTLS {
+		if config.GRPCTLSCAFile != "" || config.GRPCTLSCertFile != "" || config.GRPCTLSKeyFile != "" {
+			return nil, errors.New("the grpc_tls_* files are set but grpc_tls is false")
+		}
+		return nil, nil
+	}
+	tlsConfig, err := clientTLSConfig(config.GRPCTLSCAFile, config.GRPCTLSSkipVerify, "grpc_tls_ca_file")
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = config.GRPCTLSServerName
+	if config.GRPCTLSCertFile != "" || config.GRPCTLSKeyFile != "" {
+		if config.GRPCTLSCertFile == "" || config.GRPCTLSKeyFile == "" {
+			return nil, errors.New("grpc_tls_cert_file & grpc_tls_key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.GRPCTLSCertFile, config.GRPCTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// grpcSaveRequests returns the next function of the SaveMail stream: the envelope, then the
+// message in chunks of size
+func grpcSaveRequests(e *mail.Envelope, size int) func() ([]byte, error) {
+	r := e.NewReader()
+	buf := make([]byte, size)
+	sent := false
+	return func() ([]byte, error) {
+		if !sent {
+			sent = true
+			return protoAppendBytes(nil, 1, grpcEnvelope(e, e.Len())), nil
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			return protoAppendBytes(nil, 2, buf[:n]), nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+}
+
+func GRPC() Decorator {
+
+	var (
+		conn            grpcConn
+		timeout         time.Duration
+		validateTimeout time.Duration
+		chunkSize       int
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&GRPCConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*GRPCConfig)
+		if c.GRPCTarget == "" {
+			return errors.New("grpc_target cannot be empty")
+		}
+		timeout = grpcTimeout
+		if c.GRPCTimeout != "" {
+			if timeout, err = time.ParseDuration(c.GRPCTimeout); err != nil {
+				return err
+			}
+		}
+		gwConfig, err := Svc.ExtractConfig(backendConfig, BaseConfig(&GatewayConfig{}))
+		if err != nil {
+			return err
+		}
+		if validateTimeout, err = grpcValidateTimeout(c, gwConfig.(*GatewayConfig)); err != nil {
+			return err
+		}
+		if c.GRPCChunkSizeKB < 0 {
+			return errors.New("grpc_chunk_size_kb cannot be negative")
+		} else if c.GRPCChunkSizeKB > grpcMaxChunkSizeKB {
+			return fmt.Errorf("grpc_chunk_size_kb cannot be more than %d", grpcMaxChunkSizeKB)
+		} else if c.GRPCChunkSizeKB == 0 {
+			c.GRPCChunkSizeKB = grpcChunkSizeKB
+		}
+		chunkSize = c.GRPCChunkSizeKB * 1024
+		tlsConfig, err := grpcTLSConfig(c)
+		if err != nil {
+			return err
+		}
+		if newGRPCConn == nil {
+			return errors.New("grpc is not available, was the binary built with -tags grpc?")
+		}
+		conn, err = newGRPCConn(c.GRPCTarget, tlsConfig)
+		return err
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if conn != nil {
+			err := conn.Close()
+			conn = nil
+			return err
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt && len(e.RcptTo) > 0 {
+				rcpt := e.RcptTo[len(e.RcptTo)-1].String()
+				req := protoAppendBytes(nil, 1, grpcEnvelope(e, 0))
+				req = protoAppendString(req, 2, rcpt)
+				ctx, cancel := context.WithTimeout(e.Context(), validateTimeout)
+				defer cancel()
+				b, err := conn.Call(ctx, grpcMethodValidateRcpt, req)
+				var reply *grpcReply
+				if err == nil {
+					reply, err = parseGRPCReply(b)
+				}
+				var result Result
+				if err == nil {
+					result, err = grpcResult(reply.code, reply.message)
+				}
+				if err != nil {
+					Log().WithError(err).WithField("rcpt", rcpt).Warn("could not validate the recipient with the grpc service")
+					result = NewResult(response.Canned.ErrorBackendTransaction + "grpc validation failed")
+					return result, RcptReply(result.String())
+				}
+				if result.Code() >= 400 {
+					return result, RcptReply(result.String())
+				}
+				// next processor
+				return p.Process(e, task)
+			} else if task == TaskSaveMail {
+				ctx, cancel := context.WithTimeout(e.Context(), timeout)
+				defer cancel()
+				b, err := conn.Stream(ctx, grpcMethodSaveMail, grpcSaveRequests(e, chunkSize))
+				var reply *grpcReply
+				if err == nil {
+					reply, err = parseGRPCReply(b)
+				}
+				var result Result
+				if err == nil {
+					result, err = grpcResult(reply.code, reply.message)
+				}
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not save the message with the grpc service")
+					return NewResult(response.Canned.ErrorBackendTransaction + "grpc save failed"), NewRetryableError(err)
+				}
+				if code := result.Code(); code >= 500 {
+					Log().WithField("queued_id", e.QueuedId).Info("grpc service rejected the message: ", result.String())
+					return result, errGRPCRejected
+				} else if code >= 400 {
+					Log().WithField("queued_id", e.QueuedId).Info("grpc service deferred the message: ", result.String())
+					return result, NewRetryableError(errGRPCDeferred)
+				}
+				var failed Result
+				refused := make(map[string]bool, len(reply.rcpts))
+				for _, r := range reply.rcpts {
+					rcptResult, err := grpcResult(r.code, r.message)
+					if err != nil {
+						Log().WithError(err).WithField("queued_id", e.QueuedId).Warn("ignored the reply for ", r.rcpt)
+						continue
+					}
+					if rcptResult.Code() < 400 {
+						continue
+					}
+					for _, rcpt := range e.RcptTo {
+						if addr := strings.ToLower(rcpt.String()); addr == strings.ToLower(r.rcpt) && !refused[addr] {
+							Log().WithField("queued_id", e.QueuedId).Info("grpc service refused ", addr, ": ", rcptResult.String())
+							SetRcptResult(e, rcpt, rcptResult)
+							refused[addr] = true
+							if failed == nil {
+								failed = rcptResult
+							}
+						}
+					}
+				}
+				if failed != nil && len(refused) == len(e.RcptTo) {
+					// none of the recipients were saved
+					if failed.Code() < 500 {
+						return failed, NewRetryableError(errGRPCDeferred)
+					}
+					return failed, errGRPCRejected
+				}
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// grpcTestConn is a service that keeps the requests, and replies with reply or fails with err
+type grpcTestConn struct {
+	target    string
+	tlsConfig *tls.Config
+	rcpts     []string
+	envelope  map[int]string
+	flags     map[int]uint64
+	chunks    []int
+	message   []byte
+	deadline  time.Duration
+	reply     []byte
+	err       error
+	closed    bool
+}
+
+func (c *grpcTestConn) Call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	if method != grpcMethodValidateRcpt {
+		return nil, errors.New("unknown method " + method)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.deadline = time.Until(deadline)
+	}
+	protoFields(req, func(field protoField) error {
+		if field.num == 2 {
+			c.rcpts = append(c.rcpts, string(field.data))
+		}
+		return nil
+	})
+	return c.reply, c.err
+}
+
+func (c *grpcTestConn) Stream(ctx context.Context, method string, next func() ([]byte, error)) ([]byte, error) {
+	if method != grpcMethodSaveMail {
+		return nil, errors.New("unknown method " + method)
+	}
+	c.envelope, c.flags = make(map[int]string), make(map[int]uint64)
+	c.chunks, c.message = nil, nil
+	for {
+		req, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		protoFields(req, func(field protoField) error {
+			if field.num == 1 {
+				return protoFields(field.data, func(field protoField) error {
+					if field.wire == protoBytes {
+						c.envelope[field.num] = string(field.data)
+					} else {
+						c.flags[field.num] = field.v
+					}
+					return nil
+				})
+			}
+			c.chunks = append(c.chunks, len(field.data))
+			c.message = append(c.message, field.data...)
+			return nil
+		})
+	}
+	return c.reply, c.err
+}
+
+func (c *grpcTestConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// grpcTestReply encodes a Reply
+func grpcTestReply(code uint32, message string, rcpts ...grpcRcptReply) []byte {
+	b := protoAppendUint(nil, 1, uint64(code))
+	b = protoAppendString(b, 2, message)
+	for _, rcpt := range rcpts {
+		r := protoAppendString(nil, 1, rcpt.rcpt)
+		r = protoAppendUint(r, 2, uint64(rcpt.code))
+		r = protoAppendString(r, 3, rcpt.message)
+		b = protoAppendBytes(b, 3, r)
+	}
+	return b
+}
+
+func newGRPCProcessor(config BackendConfig, conn *grpcTestConn) (Processor, []error) {
+	newGRPCConn = func(target string, tlsConfig *tls.Config) (grpcConn, error) {
+		conn.target, conn.tlsConfig = target, tlsConfig
+		return conn, nil
+	}
+	return initTestProcessor(config, GRPC)
+}
+
+func TestGRPCSaveMail(t *testing.T) {
+	defer func(f func(string, *tls.Config) (grpcConn, error)) {
+		newGRPCConn = f
+	}(newGRPCConn)
+	conn := &grpcTestConn{}
+	p, errs := newGRPCProcessor(BackendConfig{
+		"grpc_target":        "localhost:7000",
+		"grpc_chunk_size_kb": 1,
+	}, conn)
+	if errs != nil {
+		t.Fatal("grpc did not initialize:", errs)
+	}
+	if conn.target != "localhost:7000" || conn.tlsConfig != nil {
+		t.Error("unexpected connection:", conn.target, conn.tlsConfig)
+	}
+
+	data := "Subject: hello\n\n" + strings.Repeat("x", 2500)
+	e := newAccountingEnvelope("alice@example.com", data, "bob@example.org", "carol@example.org")
+	e.Helo, e.TLS, e.DeliveryHeader = "mx.example.com", true, "Received: from mx.example.com\n"
+	conn.reply = grpcTestReply(0, "")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be saved, got:", err)
+	}
+	if string(conn.message) != e.DeliveryHeader+data || len(conn.chunks) != 3 || conn.chunks[0] != 1024 {
+		t.Error("expecting the message in chunks of 1KB, got:", conn.chunks)
+	}
+	if conn.envelope[1] != e.QueuedId || conn.envelope[4] != "alice@example.com" || conn.envelope[5] != "carol@example.org" ||
+		conn.flags[6] != 1 || conn.flags[8] != uint64(e.Len()) {
+		t.Error("unexpected envelope:", conn.envelope, conn.flags)
+	}
+
+	// carol was refused
+	e.QueuedId += "2"
+	conn.reply = grpcTestReply(250, "2.0.0 saved", grpcRcptReply{"Carol@example.org", 550, "5.1.1 no such mailbox"})
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be saved, got:", err)
+	}
+	results := envelopeRcptResults(e, e.RcptTo, NewResult("250 OK"))
+	if results == nil || results[0].Code() != 250 || results[1].String() != "550 5.1.1 no such mailbox" {
+		t.Error("expecting carol to be refused, got:", results)
+	}
+
+	// all the recipients were refused
+	e = newAccountingEnvelope("alice@example.com", data, "bob@example.org")
+	e.QueuedId += "3"
+	conn.reply = grpcTestReply(250, "", grpcRcptReply{"bob@example.org", 452, ""})
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || result.String() != "452 4.0.0 Error: deferred by the grpc service" {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+
+	// rejected, deferred & failed
+	conn.reply = grpcTestReply(554, "5.7.1 message refused")
+	result, err = p.Process(e, TaskSaveMail)
+	if err == nil || isRetryable(err) || result.String() != "554 5.7.1 message refused" {
+		t.Error("expecting the message to be rejected, got:", result, err)
+	}
+	conn.reply = grpcTestReply(421, "")
+	if result, err = p.Process(e, TaskSaveMail); !isRetryable(err) || resultCode(result) != 421 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	conn.reply = grpcTestReply(302, "")
+	if result, err = p.Process(e, TaskSaveMail); !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting an invalid code to be retried, got:", result, err)
+	}
+	conn.reply, conn.err = nil, errors.New("rpc error: code = DeadlineExceeded desc = context deadline exceeded")
+	if result, err = p.Process(e, TaskSaveMail); !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.closed {
+		t.Error("expecting the connection to be closed")
+	}
+}
+
+func TestGRPCValidateRcpt(t *testing.T) {
+	defer func(f func(string, *tls.Config) (grpcConn, error)) {
+		newGRPCConn = f
+	}(newGRPCConn)
+	conn := &grpcTestConn{}
+	p, errs := newGRPCProcessor(BackendConfig{
+		"grpc_target":           "localhost:7000",
+		"gw_val_rcpt_timeout":   "5s",
+		"grpc_validate_timeout": "30s",
+	}, conn)
+	if errs != nil {
+		t.Fatal("grpc did not initialize:", errs)
+	}
+	e := newAccountingEnvelope("alice@example.com", "", "bob@example.org")
+	conn.reply = grpcTestReply(250, "")
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Error("expecting bob to be accepted, got:", err)
+	}
+	if len(conn.rcpts) != 1 || conn.rcpts[0] != "bob@example.org" {
+		t.Error("unexpected recipients:", conn.rcpts)
+	}
+	if conn.deadline <= 0 || conn.deadline > time.Second*4 {
+		t.Error("expecting the deadline to be cut to 4s, got:", conn.deadline)
+	}
+	conn.reply = grpcTestReply(550, "5.1.1 unknown user")
+	_, err := p.Process(e, TaskValidateRcpt)
+	if reply, ok := err.(RcptReply); !ok || reply != "550 5.1.1 unknown user" {
+		t.Error("expecting the reply of the service, got:", err)
+	}
+	conn.err = errors.New("rpc error: code = Unavailable desc = connection refused")
+	_, err = p.Process(e, TaskValidateRcpt)
+	if reply, ok := err.(RcptReply); !ok || !strings.HasPrefix(string(reply), "451") {
+		t.Error("expecting the recipient to be deferred, got:", err)
+	}
+}
+
+func TestGRPCReply(t *testing.T) {
+	b := grpcTestReply(250, "2.0.0 ok", grpcRcptReply{rcpt: "bob@example.org", code: 550})
+	// the fields that are not known are skipped
+	b = protoAppendString(b, 15, "added later")
+	b = append(protoAppendVarint(b, 16<<3|protoFixed32), 1, 2, 3, 4)
+	reply, err := parseGRPCReply(b)
+	if err != nil || reply.code != 250 || reply.message != "2.0.0 ok" || len(reply.rcpts) != 1 ||
+		reply.rcpts[0].rcpt != "bob@example.org" || reply.rcpts[0].code != 550 {
+		t.Error("unexpected reply:", reply, err)
+	}
+	if _, err := parseGRPCReply(b[:len(b)-2]); err == nil {
+		t.Error("expecting a truncated reply to fail")
+	}
+}
+
+func TestGRPCConfig(t *testing.T) {
+	defer func(f func(string, *tls.Config) (grpcConn, error)) {
+		newGRPCConn = f
+	}(newGRPCConn)
+	conn := &grpcTestConn{}
+	if _, errs := newGRPCProcessor(BackendConfig{
+		"grpc_target":          "mailstore.internal:7000",
+		"grpc_tls":             true,
+		"grpc_tls_server_name": "mailstore",
+	}, conn); errs != nil {
+		t.Fatal("grpc did not initialize:", errs)
+	}
+	if conn.tlsConfig == nil || conn.tlsConfig.ServerName != "mailstore" {
+		t.Error("expecting TLS, got:", conn.tlsConfig)
+	}
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"grpc_target": ""}, "grpc_target cannot be empty"},
+		{BackendConfig{"grpc_target": "localhost:7000", "grpc_timeout": "soon"}, "invalid duration"},
+		{BackendConfig{"grpc_target": "localhost:7000", "grpc_validate_timeout": "soon"}, "invalid duration"},
+		{BackendConfig{"grpc_target": "localhost:7000", "grpc_chunk_size_kb": -1}, "cannot be negative"},
+		{BackendConfig{"grpc_target": "localhost:7000", "grpc_chunk_size_kb": 8192}, "cannot be more than"},
+		{BackendConfig{"grpc_target": "localhost:7000", "grpc_tls_ca_file": "ca.pem"}, "grpc_tls is false"},
+		{BackendConfig{"grpc_target": "localhost:7000", "grpc_tls": true, "grpc_tls_cert_file": "client.pem"}, "must be set together"},
+		{BackendConfig{"grpc_target": "localhost:7000", "grpc_tls": true, "grpc_tls_ca_file": "/no/such/ca.pem"}, "no such file"},
+	}
+	for _, test := range tests {
+		_, errs := newGRPCProcessor(test.config, &grpcTestConn{})
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+	// without -tags grpc
+	newGRPCConn = nil
+	_, errs := initTestProcessor(BackendConfig{"grpc_target": "localhost:7000"}, GRPC)
+	if errs == nil || !strings.Contains(errs[0].Error(), "-tags grpc") {
+		t.Error("expecting the grpc tag to be asked for, got:", errs)
+	}
+}
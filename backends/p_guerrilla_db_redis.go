@@ -415,6 +415,10 @@ func GuerrillaDbReddis() Decorator {
 		return nil
 	}))
 
+	Svc.AddPinger(PingWith(func() error {
+		return db.Ping()
+	}))
+
 	var vals []interface{}
 	data := newCompressedData()
 
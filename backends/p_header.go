@@ -1,13 +1,31 @@
 package backends
 
 import (
-	"github.com/flashmob/go-guerrilla/mail"
+	"bufio"
+	"bytes"
+	"net/textproto"
 	"strings"
 	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const (
+	// ValueProtocol is the e.Values key that the server sets to the protocol of the transaction,
+	// as named in the Received header, eg. "ESMTPS" (see RFC 3848)
+	ValueProtocol = "protocol"
+	// ValueTLSVersion is the e.Values key that the server sets to the TLS version, eg. "TLSv1.2"
+	ValueTLSVersion = "tls_version"
+	// ValueTLSCipher is the e.Values key that the server sets to the name of the TLS cipher suite
+	ValueTLSCipher = "tls_cipher"
 )
 
 type HeaderConfig struct {
 	PrimaryHost string `json:"primary_mail_host"`
+	// Hostname names this server in the Received header, the primary_mail_host if not set
+	Hostname string `json:"header_hostname,omitempty"`
+	// MessageID adds a Message-ID header to the messages that don't have one
+	MessageID bool `json:"header_message_id,omitempty"`
 }
 
 // ----------------------------------------------------------------------------------
@@ -15,12 +33,18 @@ type HeaderConfig struct {
 // ----------------------------------------------------------------------------------
 // Description   : Adds delivery information headers to e.DeliveryHeader
 // ----------------------------------------------------------------------------------
-// Config Options: none
+// Config Options: header_hostname string - the name of this server in the Received
+//               : header, the primary_mail_host if not set
+//               : header_message_id bool - adds a Message-ID to the messages
+//               : without one, <queued id@primary_mail_host>
 // --------------:-------------------------------------------------------------------
 // Input         : e.Helo
 //               : e.RemoteAddress
+//               : e.Values[ValueFCrDNS] & e.Values[ValuePTRName], if the fcrdns processor is used
+//               : e.Values[ValueProtocol], e.Values[ValueTLSVersion] & e.Values[ValueTLSCipher]
 //               : e.RcptTo
 //               : e.Hashes
+//               : e.Data, for the Message-ID
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.DeliveryHeader with additional delivery info
 // ----------------------------------------------------------------------------------
@@ -30,6 +54,66 @@ func init() {
 	}
 }
 
+// hasHeader returns true if the header of the message in data has the field name
+func hasHeader(data []byte, name string) bool {
+	end := headerEnd(data)
+	if end == -1 {
+		end = len(data)
+	}
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data[:end]))).ReadMIMEHeader()
+	_, ok := header[textproto.CanonicalMIMEHeaderKey(name)]
+	return ok
+}
+
+// receivedHeader returns the Received header of e, see RFC 5321 section 4.4
+func receivedHeader(e *mail.Envelope, host string) string {
+	// the address literal of the client
+	literal := "[" + e.RemoteIP + "]"
+	if strings.Contains(e.RemoteIP, ":") {
+		literal = "[IPv6:" + e.RemoteIP + "]"
+	}
+	helo := e.Helo
+	if helo == "" {
+		helo = literal
+	}
+	remote := e.Helo + " " + literal
+	if result, ok := e.Values[ValueFCrDNS].(string); ok {
+		// checked by the fcrdns processor, name the client by its verified PTR
+		name := "unknown"
+		if ptr, ok := e.Values[ValuePTRName].(string); ok && result == FCrDNSPass {
+			name = ptr
+		}
+		remote = name + " " + literal + "; fcrdns=" + result
+	} else if e.Helo == "" {
+		remote = "unknown " + literal
+	}
+	received := "Received: from " + helo + " (" + remote + ")\n"
+	if version, ok := e.Values[ValueTLSVersion].(string); ok {
+		received += "	(using " + version
+		if cipher, ok := e.Values[ValueTLSCipher].(string); ok {
+			received += " with cipher " + cipher
+		}
+		received += ")\n"
+	}
+	protocol, ok := e.Values[ValueProtocol].(string)
+	if !ok {
+		protocol = "SMTP"
+		if e.TLS {
+			protocol = "ESMTPS"
+		}
+	}
+	hash := "unknown"
+	if len(e.Hashes) > 0 {
+		hash = e.Hashes[0]
+	}
+	received += "	by " + host + " with " + protocol + " id " + hash
+	if len(e.RcptTo) == 1 {
+		// the recipients are not disclosed to each other
+		received += "\n	for <" + e.RcptTo[0].String() + ">"
+	}
+	return received + ";\n	" + time.Now().Format(time.RFC1123Z) + "\n"
+}
+
 // Generate the MTA delivery header
 // Sets e.DeliveryHeader part of the envelope with the generated header
 func Header() Decorator {
@@ -43,24 +127,24 @@ func Header() Decorator {
 			return err
 		}
 		config = bcfg.(*HeaderConfig)
+		if config.Hostname == "" {
+			config.Hostname = config.PrimaryHost
+		}
 		return nil
 	}))
 
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
-				to := strings.TrimSpace(e.RcptTo[0].User) + "@" + config.PrimaryHost
-				hash := "unknown"
-				if len(e.Hashes) > 0 {
-					hash = e.Hashes[0]
-				}
 				var addHead string
-				addHead += "Delivered-To: " + to + "\n"
-				addHead += "Received: from " + e.Helo + " (" + e.Helo + "  [" + e.RemoteIP + "])\n"
 				if len(e.RcptTo) > 0 {
-					addHead += "	by " + e.RcptTo[0].Host + " with SMTP id " + hash + "@" + e.RcptTo[0].Host + ";\n"
+					to := strings.TrimSpace(e.RcptTo[0].User) + "@" + config.PrimaryHost
+					addHead += "Delivered-To: " + to + "\n"
+				}
+				addHead += receivedHeader(e, config.Hostname)
+				if config.MessageID && !hasHeader(e.Data.Bytes(), "Message-ID") {
+					addHead += "Message-ID: <" + e.QueuedId + "@" + config.PrimaryHost + ">\n"
 				}
-				addHead += "	" + time.Now().Format(time.RFC1123Z) + "\n"
 				// save the result
 				e.DeliveryHeader = addHead
 				// next processor
@@ -0,0 +1,100 @@
+package backends
+
+import (
+	netmail "net/mail"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func newHeaderEnvelope(ip string, data string, rcpts ...string) *mail.Envelope {
+	e := mail.NewEnvelope(ip, 1)
+	e.QueuedId = "a1b2c3"
+	e.Helo = "mail.example.com"
+	e.Hashes = []string{"f00d"}
+	for _, r := range rcpts {
+		a, _ := mail.NewAddress(r)
+		e.RcptTo = append(e.RcptTo, a)
+	}
+	e.Data.WriteString(data)
+	return e
+}
+
+// readHeader parses the delivered message, and returns its Received header split at the date
+func readHeader(t *testing.T, e *mail.Envelope) (*netmail.Message, string) {
+	msg, err := netmail.ReadMessage(strings.NewReader(e.DeliveryHeader + e.Data.String()))
+	if err != nil {
+		t.Fatal("the header did not parse:", err, e.DeliveryHeader)
+	}
+	received := msg.Header.Get("Received")
+	i := strings.LastIndex(received, ";")
+	if i == -1 {
+		t.Fatal("no date in the Received header:", received)
+	}
+	if _, err := netmail.ParseDate(strings.TrimSpace(received[i+1:])); err != nil {
+		t.Error("the date of the Received header did not parse:", err)
+	}
+	return msg, received[:i]
+}
+
+func TestHeaderReceived(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"primary_mail_host": "example.org", "header_hostname": "mx.example.org"}, Header)
+	e := newHeaderEnvelope("203.0.113.5", "Subject: hi\n\nhello\n", "bob@example.org")
+	e.Values[ValueProtocol] = "ESMTPSA"
+	e.Values[ValueTLSVersion] = "TLSv1.2"
+	e.Values[ValueTLSCipher] = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	msg, received := readHeader(t, e)
+	expect := "from mail.example.com (mail.example.com [203.0.113.5]) " +
+		"(using TLSv1.2 with cipher TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) " +
+		"by mx.example.org with ESMTPSA id f00d for <bob@example.org>"
+	if received != expect {
+		t.Errorf("unexpected Received header:\n%q\nexpecting:\n%q", received, expect)
+	}
+	if to := msg.Header.Get("Delivered-To"); to != "bob@example.org" {
+		t.Error("unexpected Delivered-To:", to)
+	}
+	// not added unless configured
+	if id := msg.Header.Get("Message-ID"); id != "" {
+		t.Error("unexpected Message-ID:", id)
+	}
+
+	// IPv6, several recipients, and no protocol from the server
+	e = newHeaderEnvelope("2001:db8::1", "Subject: hi\n\nhello\n", "bob@example.org", "carol@example.org")
+	e.Helo = ""
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	_, received = readHeader(t, e)
+	expect = "from [IPv6:2001:db8::1] (unknown [IPv6:2001:db8::1]) by mx.example.org with SMTP id f00d"
+	if received != expect {
+		t.Errorf("unexpected Received header:\n%q\nexpecting:\n%q", received, expect)
+	}
+}
+
+func TestHeaderMessageID(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"primary_mail_host": "example.org", "header_message_id": true}, Header)
+	e := newHeaderEnvelope("203.0.113.5", "Subject: hi\n\nhello\n", "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	msg, received := readHeader(t, e)
+	if !strings.Contains(received, " by example.org with SMTP id f00d") {
+		t.Error("expecting the primary_mail_host in the Received header, got:", received)
+	}
+	id, err := msg.Header.AddressList("Message-ID")
+	if err != nil || len(id) != 1 || id[0].Address != "a1b2c3@example.org" {
+		t.Error("unexpected Message-ID:", msg.Header.Get("Message-ID"), err)
+	}
+	// the message has one already
+	e = newHeaderEnvelope("203.0.113.5", "Message-Id: <1@example.com>\nSubject: hi\n\nhello\n", "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ = readHeader(t, e); len(msg.Header["Message-Id"]) != 1 || msg.Header.Get("Message-Id") != "<1@example.com>" {
+		t.Error("unexpected Message-ID:", msg.Header["Message-Id"])
+	}
+}
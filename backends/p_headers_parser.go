@@ -14,6 +14,7 @@ import (
 // Input         : envelope
 // ----------------------------------------------------------------------------------
 // Output        : Headers will be populated in e.Header
+//               : e.Subject will be set to the decoded Subject, the raw value stays in e.Header
 // ----------------------------------------------------------------------------------
 func init() {
 	processors["headersparser"] = func() Decorator {
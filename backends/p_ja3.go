@@ -0,0 +1,181 @@
+package backends
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ValueJA3 is the e.Values key of the JA3 fingerprint of the TLS client, set by the server
+// after the TLS handshake
+const ValueJA3 = "ja3"
+
+const (
+	// default window of the rate limit, if 'ja3_rate_window' not present in config
+	ja3RateWindow = time.Minute
+	// maximum number of fingerprints counted by a rate limiter
+	ja3RateMax = 10000
+)
+
+var (
+	errJA3Blocked     = errors.New("tls client blocked")
+	errJA3RateLimited = errors.New("tls client rate limited")
+)
+
+// ja3Limiters holds the rate limiters shared by the ja3 processors of all workers,
+// there is one limiter for each ja3_rate_limit & ja3_rate_window pair
+var ja3Limiters = struct {
+	sync.Mutex
+	m map[string]*ja3Limiter
+}{m: make(map[string]*ja3Limiter)}
+
+type JA3Config struct {
+	// JA3Blocklist is a comma separated list of fingerprints to reject
+	JA3Blocklist string `json:"ja3_blocklist,omitempty"`
+	// JA3RateLimit is the number of messages a fingerprint may send in the window, 0 for no limit
+	JA3RateLimit int `json:"ja3_rate_limit,omitempty"`
+	// JA3RateWindow is the duration of the rate limit window, eg "1m"
+	JA3RateWindow string `json:"ja3_rate_window,omitempty"`
+}
+
+type ja3Count struct {
+	n       int
+	expires time.Time
+}
+
+// ja3Limiter counts the messages of each fingerprint in a fixed window
+type ja3Limiter struct {
+	sync.Mutex
+	counts map[string]ja3Count
+	limit  int
+	window time.Duration
+}
+
+// allow counts a message from fp, returns false if fp went over the limit
+func (l *ja3Limiter) allow(fp string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	c, ok := l.counts[fp]
+	if !ok || now.After(c.expires) {
+		if !ok && len(l.counts) >= ja3RateMax {
+			l.sweep(now)
+		}
+		c = ja3Count{expires: now.Add(l.window)}
+	}
+	c.n++
+	l.counts[fp] = c
+	return c.n <= l.limit
+}
+
+// sweep removes the expired counts, or any counts if there are no expired ones
+func (l *ja3Limiter) sweep(now time.Time) {
+	for key, c := range l.counts {
+		if now.After(c.expires) {
+			delete(l.counts, key)
+		}
+	}
+	for key := range l.counts {
+		if len(l.counts) < ja3RateMax {
+			break
+		}
+		delete(l.counts, key)
+	}
+}
+
+// sharedJA3Limiter returns the limiter for the limit and window, so that all workers use the same counts
+func sharedJA3Limiter(limit int, window time.Duration) *ja3Limiter {
+	ja3Limiters.Lock()
+	defer ja3Limiters.Unlock()
+	key := strconv.Itoa(limit) + "|" + window.String()
+	l, ok := ja3Limiters.m[key]
+	if !ok {
+		l = &ja3Limiter{counts: make(map[string]ja3Count), limit: limit, window: window}
+		ja3Limiters.m[key] = l
+	}
+	return l
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: ja3
+// ----------------------------------------------------------------------------------
+// Description   : Rejects or throttles clients by the JA3 fingerprint of their TLS
+//               : ClientHello, so that bots can be held back even when they change
+//               : their IP address. Blocklisted fingerprints are rejected in both the
+//               : validate_process and save_process chains. The rate limit counts the
+//               : messages of each fingerprint, in the save_process chain.
+//               : Clients that did not use TLS have no fingerprint and are let through
+// ----------------------------------------------------------------------------------
+// Config Options: ja3_blocklist string - comma separated fingerprints (md5 hex) to reject
+//               : ja3_rate_limit int - messages allowed per fingerprint in the window,
+//               : default 0 - no limit
+//               : ja3_rate_window string - duration of the window, default "1m"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Values["ja3"] - set by the server after the TLS handshake
+// ----------------------------------------------------------------------------------
+// Output        : 550 if blocklisted, 451 if over the rate limit
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["ja3"] = func() Decorator {
+		return JA3()
+	}
+}
+
+func JA3() Decorator {
+
+	var (
+		blocklist map[string]bool
+		limiter   *ja3Limiter
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&JA3Config{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*JA3Config)
+		blocklist = make(map[string]bool)
+		for _, fp := range splitList(config.JA3Blocklist) {
+			blocklist[strings.ToLower(fp)] = true
+		}
+		limiter = nil
+		if config.JA3RateLimit > 0 {
+			window := ja3RateWindow
+			if config.JA3RateWindow != "" {
+				if window, err = time.ParseDuration(config.JA3RateWindow); err != nil {
+					return err
+				}
+			}
+			limiter = sharedJA3Limiter(config.JA3RateLimit, window)
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			fp, _ := e.Values[ValueJA3].(string)
+			if fp == "" {
+				return p.Process(e, task)
+			}
+			if blocklist[fp] {
+				Log().WithField("ip", e.RemoteIP).WithField("ja3", fp).Info("rejected blocklisted TLS client")
+				if task == TaskValidateRcpt {
+					return NewResult(response.Canned.FailRcptCmd), errJA3Blocked
+				}
+				return NewResult(response.Canned.FailTLSClientBlocked), errJA3Blocked
+			}
+			if task == TaskSaveMail && limiter != nil && !limiter.allow(fp) {
+				Log().WithField("ip", e.RemoteIP).WithField("ja3", fp).Info("deferred TLS client over the rate limit")
+				return NewResult(response.Canned.ErrorTLSClientRateLimit), errJA3RateLimited
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const (
+	testJA3Bot    = "e7d705a3286e19ea42f587b344ee6865"
+	testJA3Client = "b32309a26951912be7dba376398abc3b"
+)
+
+func newJA3Processor(t *testing.T, c BackendConfig) Processor {
+	// start with no counts
+	ja3Limiters.m = make(map[string]*ja3Limiter)
+	return newTestProcessor(t, c, JA3)
+}
+
+func newJA3Envelope(fp string) *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	if fp != "" {
+		e.Values[ValueJA3] = fp
+	}
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	return e
+}
+
+func TestJA3Blocklist(t *testing.T) {
+	p := newJA3Processor(t, BackendConfig{"ja3_blocklist": "0000, " + testJA3Bot})
+	for _, task := range []SelectTask{TaskValidateRcpt, TaskSaveMail} {
+		if _, err := p.Process(newJA3Envelope(testJA3Bot), task); err != errJA3Blocked {
+			t.Error("blocklisted fingerprint should be rejected, got:", err)
+		}
+		if result, err := p.Process(newJA3Envelope(testJA3Client), task); err != nil || result.Code() != 200 {
+			t.Error("fingerprint is not blocklisted, got:", result, err)
+		}
+		// no TLS
+		if _, err := p.Process(newJA3Envelope(""), task); err != nil {
+			t.Error("client without a fingerprint should pass, got:", err)
+		}
+	}
+	result, _ := p.Process(newJA3Envelope(testJA3Bot), TaskSaveMail)
+	if result.Code() != 550 {
+		t.Error("expecting 550, got:", result)
+	}
+}
+
+func TestJA3RateLimit(t *testing.T) {
+	p := newJA3Processor(t, BackendConfig{
+		"ja3_rate_limit":  2,
+		"ja3_rate_window": "1h",
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := p.Process(newJA3Envelope(testJA3Bot), TaskSaveMail); err != nil {
+			t.Error("message should be under the rate limit, got:", err)
+		}
+		// recipients are not counted
+		if _, err := p.Process(newJA3Envelope(testJA3Bot), TaskValidateRcpt); err != nil {
+			t.Error("recipient should pass, got:", err)
+		}
+	}
+	result, err := p.Process(newJA3Envelope(testJA3Bot), TaskSaveMail)
+	if err != errJA3RateLimited || result.Code() != 451 {
+		t.Error("expecting the 3rd message to be deferred with 451, got:", result, err)
+	}
+	// other fingerprints have their own count
+	if _, err := p.Process(newJA3Envelope(testJA3Client), TaskSaveMail); err != nil {
+		t.Error("another fingerprint should not be limited, got:", err)
+	}
+
+	// the count starts again in a new window
+	l := sharedJA3Limiter(1, time.Millisecond)
+	l.allow(testJA3Bot)
+	time.Sleep(time.Millisecond * 5)
+	if !l.allow(testJA3Bot) {
+		t.Error("the window expired, the fingerprint should be allowed")
+	}
+}
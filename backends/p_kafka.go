@@ -0,0 +1,183 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default time to wait for the delivery report, if 'kafka_timeout' not present in config
+	kafkaTimeout = time.Second * 30
+	// default client id, if 'kafka_client_id' not present in config
+	kafkaClientID = "go-guerrilla"
+)
+
+// kafkaProducer publishes records to Kafka
+type kafkaProducer interface {
+	// Produce publishes a record, and waits for its delivery report
+	Produce(topic string, key, value []byte, headers map[string]string) error
+	// Close delivers the records that are still queued & disconnects
+	Close()
+}
+
+// newKafkaProducer connects a producer, it is set by kafka_producer.go when built with -tags kafka.
+// Changed for testing
+var newKafkaProducer func(brokers []string, clientID string, timeout time.Duration) (kafkaProducer, error)
+
+type KafkaConfig struct {
+	// KafkaBrokers are the bootstrap brokers, "host:port" separated by commas
+	KafkaBrokers string `json:"kafka_brokers"`
+	// KafkaTopic is the topic that the messages are published to
+	KafkaTopic string `json:"kafka_topic"`
+	// KafkaFormat is the value of the records, "json" with the metadata & headers, or "raw"
+	KafkaFormat string `json:"kafka_format,omitempty"`
+	// KafkaClientID identifies the producer to the brokers
+	KafkaClientID string `json:"kafka_client_id,omitempty"`
+	// KafkaTimeout is how long to wait for the delivery report of a record, eg. "30s"
+	KafkaTimeout string `json:"kafka_timeout,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: kafka
+// ----------------------------------------------------------------------------------
+// Description   : Publishes the message to a Kafka topic. A record is published for
+//               : each recipient domain, keyed by the domain so that the mail of a
+//               : domain stays in one partition, in order. The producer is idempotent:
+//               : the brokers drop the duplicates of its retries. The save waits for
+//               : the delivery report of each record; the recipients of a record that
+//               : failed get a 451 by SetRcptResult, the message is failed with a 451
+//               : if none were published. The records have the queued_id, mail_from,
+//               : rcpt_to & remote_ip headers.
+//               : Uses librdkafka, it must be built with the kafka tag:
+//               : go build -tags kafka
+// ----------------------------------------------------------------------------------
+// Config Options: kafka_brokers string - bootstrap brokers, eg. "kafka1:9092,kafka2:9092"
+//               : kafka_topic string - the topic to publish to
+//               : kafka_format string - "json" (default), the metadata, the headers &
+//               : the message base64 encoded, or "raw", the RFC822 message
+//               : kafka_client_id string - default "go-guerrilla"
+//               : kafka_timeout string - how long to wait for a delivery report,
+//               : default "30s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.Header & e.Subject parsed by the HeadersParser processor
+//               : e.MailFrom & e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : the records in the topic
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["kafka"] = func() Decorator {
+		return Kafka()
+	}
+}
+
+func Kafka() Decorator {
+
+	var (
+		config   *KafkaConfig
+		producer kafkaProducer
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&KafkaConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*KafkaConfig)
+		brokers := splitList(c.KafkaBrokers)
+		if len(brokers) == 0 {
+			return errors.New("kafka_brokers cannot be empty")
+		}
+		if c.KafkaTopic == "" {
+			return errors.New("kafka_topic cannot be empty")
+		}
+		switch c.KafkaFormat {
+		case "":
+			c.KafkaFormat = messageFormatJSON
+		case messageFormatJSON, messageFormatRaw:
+		default:
+			return fmt.Errorf("invalid kafka_format: %s", c.KafkaFormat)
+		}
+		if c.KafkaClientID == "" {
+			c.KafkaClientID = kafkaClientID
+		}
+		timeout := kafkaTimeout
+		if c.KafkaTimeout != "" {
+			if timeout, err = time.ParseDuration(c.KafkaTimeout); err != nil {
+				return err
+			}
+		}
+		if newKafkaProducer == nil {
+			return errors.New("kafka is not available, was the binary built with -tags kafka?")
+		}
+		if producer, err = newKafkaProducer(brokers, c.KafkaClientID, timeout); err != nil {
+			return err
+		}
+		config = c
+		return nil
+	}))
+
+	// shutdown delivers the queued records
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if producer != nil {
+			producer.Close()
+			producer = nil
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				from := ""
+				if !e.MailFrom.IsEmpty() {
+					from = e.MailFrom.String()
+				}
+				domains, byDomain := groupRcpts(e.RcptTo, func(rcpt mail.Address) string {
+					return strings.ToLower(rcpt.Host)
+				})
+				var failed []int
+				var lastErr error
+				for _, domain := range domains {
+					rcpts := make([]string, 0, len(byDomain[domain]))
+					for _, i := range byDomain[domain] {
+						rcpts = append(rcpts, e.RcptTo[i].String())
+					}
+					value, err := messageValue(e, config.KafkaFormat, from, rcpts)
+					if err != nil {
+						return NewResult(response.Canned.FailBackendTransaction), err
+					}
+					headers := map[string]string{
+						"queued_id": e.QueuedId,
+						"mail_from": from,
+						"rcpt_to":   strings.Join(rcpts, ","),
+						"remote_ip": e.RemoteIP,
+					}
+					if err := producer.Produce(config.KafkaTopic, []byte(domain), value, headers); err != nil {
+						Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not publish to kafka for ", domain)
+						failed = append(failed, byDomain[domain]...)
+						lastErr = err
+					}
+				}
+				if len(failed) == len(e.RcptTo) && len(failed) > 0 {
+					return NewResult(response.Canned.ErrorBackendTransaction + "kafka publish failed"), NewRetryableError(lastErr)
+				}
+				for _, i := range failed {
+					// the others were published, the client retries these alone
+					SetRcptResult(e, e.RcptTo[i], NewResult(response.Canned.ErrorBackendTransaction+"kafka publish failed"))
+				}
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kafkaTestProducer keeps the records, and fails the records keyed by its fail domain
+type kafkaTestProducer struct {
+	brokers []string
+	records []kafkaTestRecord
+	fail    string
+	closed  bool
+	sync.Mutex
+}
+
+type kafkaTestRecord struct {
+	topic   string
+	key     string
+	value   []byte
+	headers map[string]string
+}
+
+func (k *kafkaTestProducer) Produce(topic string, key, value []byte, headers map[string]string) error {
+	k.Lock()
+	defer k.Unlock()
+	if string(key) == k.fail {
+		return errors.New("Local: Message timed out")
+	}
+	k.records = append(k.records, kafkaTestRecord{topic: topic, key: string(key), value: value, headers: headers})
+	return nil
+}
+
+func (k *kafkaTestProducer) Close() {
+	k.closed = true
+}
+
+func newKafkaProcessor(config BackendConfig, producer *kafkaTestProducer) (Processor, []error) {
+	newKafkaProducer = func(brokers []string, clientID string, timeout time.Duration) (kafkaProducer, error) {
+		producer.brokers = brokers
+		return producer, nil
+	}
+	return initTestProcessor(config, Kafka)
+}
+
+func TestKafka(t *testing.T) {
+	defer func(f func([]string, string, time.Duration) (kafkaProducer, error)) {
+		newKafkaProducer = f
+	}(newKafkaProducer)
+	producer := &kafkaTestProducer{}
+	p, errs := newKafkaProcessor(BackendConfig{"kafka_brokers": "kafka1:9092, kafka2:9092", "kafka_topic": "mail"}, producer)
+	if errs != nil {
+		t.Fatal("kafka did not initialize:", errs)
+	}
+	if len(producer.brokers) != 2 || producer.brokers[1] != "kafka2:9092" {
+		t.Error("unexpected brokers:", producer.brokers)
+	}
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n",
+		"bob@Example.org", "carol@example.net", "dave@example.org")
+	e.DeliveryHeader = "Received: from mx.example.com\n"
+	e.Subject = "hello"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be published, got:", err)
+	}
+	// a record for each domain, in the order of the recipients
+	if len(producer.records) != 2 || producer.records[0].key != "example.org" || producer.records[1].key != "example.net" {
+		t.Fatal("expecting a record for each domain, got:", producer.records)
+	}
+	r := producer.records[0]
+	if r.topic != "mail" || r.headers["queued_id"] != e.QueuedId || r.headers["rcpt_to"] != "bob@Example.org,dave@example.org" ||
+		r.headers["mail_from"] != "alice@example.com" {
+		t.Error("unexpected record:", r.topic, r.headers)
+	}
+	var msg messageRecord
+	if err := json.Unmarshal(r.value, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.QueuedId != e.QueuedId || len(msg.To) != 2 || msg.Subject != "hello" || msg.RemoteIP != "203.0.113.5" ||
+		string(msg.Body) != "Received: from mx.example.com\nSubject: hello\n\nhi\n" {
+		t.Error("unexpected value:", string(r.value))
+	}
+
+	// example.net could not be published
+	producer.fail = "example.net"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be published to example.org, got:", err)
+	}
+	results := envelopeRcptResults(e, e.RcptTo, BackendResultOK)
+	if len(results) != 3 || resultCode(results[0]) != 200 || resultCode(results[1]) != 451 || resultCode(results[2]) != 200 {
+		t.Error("expecting carol to be failed with a 451, got:", results)
+	}
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "carol@example.net")
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if !producer.closed {
+		t.Error("expecting the producer to be closed")
+	}
+}
+
+func TestKafkaRaw(t *testing.T) {
+	defer func(f func([]string, string, time.Duration) (kafkaProducer, error)) {
+		newKafkaProducer = f
+	}(newKafkaProducer)
+	producer := &kafkaTestProducer{}
+	p, errs := newKafkaProcessor(BackendConfig{"kafka_brokers": "kafka1:9092", "kafka_topic": "mail", "kafka_format": "raw"}, producer)
+	if errs != nil {
+		t.Fatal("kafka did not initialize:", errs)
+	}
+	e := newAccountingEnvelope("", "Subject: bounce\n\nhi\n", "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be published, got:", err)
+	}
+	if len(producer.records) != 1 || string(producer.records[0].value) != "Subject: bounce\n\nhi\n" ||
+		producer.records[0].headers["mail_from"] != "" {
+		t.Error("unexpected records:", producer.records)
+	}
+}
+
+func TestKafkaConfig(t *testing.T) {
+	defer func(f func([]string, string, time.Duration) (kafkaProducer, error)) {
+		newKafkaProducer = f
+	}(newKafkaProducer)
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"kafka_brokers": "", "kafka_topic": "mail"}, "kafka_brokers cannot be empty"},
+		{BackendConfig{"kafka_brokers": "kafka1:9092", "kafka_topic": ""}, "kafka_topic cannot be empty"},
+		{BackendConfig{"kafka_brokers": "kafka1:9092", "kafka_topic": "mail", "kafka_format": "avro"}, "invalid kafka_format"},
+		{BackendConfig{"kafka_brokers": "kafka1:9092", "kafka_topic": "mail", "kafka_timeout": "soon"}, "invalid duration"},
+	}
+	for _, test := range tests {
+		_, errs := newKafkaProcessor(test.config, &kafkaTestProducer{})
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+	// without -tags kafka
+	newKafkaProducer = nil
+	_, errs := initTestProcessor(BackendConfig{"kafka_brokers": "kafka1:9092", "kafka_topic": "mail"}, Kafka)
+	if errs == nil || !strings.Contains(errs[0].Error(), "-tags kafka") {
+		t.Error("expecting the kafka tag to be asked for, got:", errs)
+	}
+}
@@ -0,0 +1,273 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ValueLongLine is the e.Values key set to the length of the longest line when the linelength
+// processor in "flag" mode finds a line that is too long
+const ValueLongLine = "long_line"
+
+const (
+	// the most octets a line may have, not counting the CRLF (RFC 5322 2.1.1)
+	maxLineLength = 998
+	// how deep to look into nested multipart messages for long lines
+	lineLengthMaxDepth = 5
+)
+
+const (
+	lineLengthModeFlag   = "flag"
+	lineLengthModeReject = "reject"
+	lineLengthModeRewrap = "rewrap"
+)
+
+var errLineTooLong = errors.New("message has a line longer than 998 characters")
+
+type LineLengthConfig struct {
+	// LineLengthMode is "flag" (default), "reject" or "rewrap"
+	LineLengthMode string `json:"line_length_mode,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: linelength
+// ----------------------------------------------------------------------------------
+// Description   : Finds lines longer than 998 characters in the text parts of the message
+//               : (RFC 5322), which break many systems down the line. Other parts, such as
+//               : images, are not checked
+// ----------------------------------------------------------------------------------
+// Config Options: line_length_mode string - "flag" (default) lets the message through
+//               : with a X-Long-Line header, "reject" rejects it, "rewrap" breaks the
+//               : long lines: at a space for 7bit & 8bit parts, with a soft line break
+//               : for quoted-printable parts
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : In "flag" mode, e.Values[ValueLongLine] is set and a header is
+//               : appended to e.DeliveryHeader (place after the header processor).
+//               : In "rewrap" mode, e.Data is rewritten
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["linelength"] = func() Decorator {
+		return LineLength()
+	}
+}
+
+func LineLength() Decorator {
+
+	var mode string
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&LineLengthConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		mode = strings.ToLower(bcfg.(*LineLengthConfig).LineLengthMode)
+		switch mode {
+		case "":
+			mode = lineLengthModeFlag
+		case lineLengthModeFlag, lineLengthModeReject, lineLengthModeRewrap:
+		default:
+			return errors.New("invalid line_length_mode: " + mode)
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				data, longest := checkLineLength(e.Data.Bytes(), mode == lineLengthModeRewrap, 0)
+				if longest > maxLineLength {
+					switch mode {
+					case lineLengthModeReject:
+						Log().WithField("ip", e.RemoteIP).WithField("queued_id", e.QueuedId).
+							Info("rejected message with a line of ", longest, " characters")
+						return NewResult(response.Canned.FailBodyLineTooLong), errLineTooLong
+					case lineLengthModeFlag:
+						e.Values[ValueLongLine] = longest
+						e.DeliveryHeader += "X-Long-Line: " + strconv.Itoa(longest) + "\n"
+					case lineLengthModeRewrap:
+						e.Data.Reset()
+						e.Data.Write(data)
+					}
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// checkLineLength returns the length of the longest line in the text parts of the entity (a message
+// or a part of it) in data. When rewrap is true, the entity is returned with the long lines broken
+func checkLineLength(data []byte, rewrap bool, depth int) ([]byte, int) {
+	bodyStart := headerEnd(data)
+	if bodyStart == -1 {
+		return data, 0
+	}
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data[:bodyStart]))).ReadMIMEHeader()
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// no content type, the default is text/plain
+		mediaType = "text/plain"
+	}
+	body := data[bodyStart:]
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+		longest := 0
+		var out []byte
+		if rewrap {
+			out = make([]byte, 0, len(data)+len(data)/maxLineLength*3)
+			out = append(out, data[:bodyStart]...)
+		}
+		eachLine(body, func(line []byte) {
+			if n := len(bytes.TrimRight(line, "\r\n")); n > longest {
+				longest = n
+			}
+			if rewrap {
+				out = wrapLine(out, line, encoding)
+			}
+		})
+		if !rewrap || longest <= maxLineLength {
+			return data, longest
+		}
+		return out, longest
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < lineLengthMaxDepth:
+		delimiter := []byte("--" + params["boundary"])
+		var out []byte
+		if rewrap {
+			out = append(out, data[:bodyStart]...)
+		}
+		longest := 0
+		// the start of the current part, -1 before the first delimiter & after the last one
+		start := -1
+		pos := bodyStart
+		eachLine(body, func(line []byte) {
+			lineStart := pos
+			pos += len(line)
+			if !bytes.HasPrefix(line, delimiter) {
+				if start == -1 && rewrap {
+					// the preamble & the epilogue are kept as they are
+					out = append(out, line...)
+				}
+				return
+			}
+			if start != -1 {
+				part, n := checkLineLength(data[start:lineStart], rewrap, depth+1)
+				if n > longest {
+					longest = n
+				}
+				if rewrap {
+					out = append(out, part...)
+				}
+			}
+			if rewrap {
+				out = append(out, line...)
+			}
+			start = pos
+			if bytes.HasPrefix(bytes.TrimSpace(line[len(delimiter):]), []byte("--")) {
+				// closing delimiter
+				start = -1
+			}
+		})
+		if start != -1 {
+			// no closing delimiter
+			part, n := checkLineLength(data[start:], rewrap, depth+1)
+			if n > longest {
+				longest = n
+			}
+			if rewrap {
+				out = append(out, part...)
+			}
+		}
+		if !rewrap || longest <= maxLineLength {
+			return data, longest
+		}
+		return out, longest
+	}
+	return data, 0
+}
+
+// headerEnd returns where the body of the entity in data starts, after the blank line,
+// or -1 if there is no blank line
+func headerEnd(data []byte) int {
+	if bytes.HasPrefix(data, []byte("\n")) {
+		return 1
+	}
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		return 2
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i != -1 {
+		if j := bytes.Index(data, []byte("\r\n\r\n")); j != -1 && j < i {
+			return j + 4
+		}
+		return i + 2
+	}
+	if j := bytes.Index(data, []byte("\r\n\r\n")); j != -1 {
+		return j + 4
+	}
+	return -1
+}
+
+// eachLine calls fn with each line of data, including the line break
+func eachLine(data []byte, fn func(line []byte)) {
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		fn(data[:end])
+		data = data[end:]
+	}
+}
+
+// wrapLine appends line to out, broken into lines of at most 998 characters. Quoted-printable lines
+// are broken with a soft line break, base64 lines anywhere, and other lines at the last space if possible
+func wrapLine(out, line []byte, encoding string) []byte {
+	content := bytes.TrimRight(line, "\r\n")
+	lineBreak := line[len(content):]
+	for len(content) > maxLineLength {
+		var cut int
+		switch encoding {
+		case "quoted-printable":
+			// room for the =, without splitting an =XX escape
+			cut = maxLineLength - 1
+			if i := bytes.LastIndexByte(content[cut-2:cut], '='); i != -1 {
+				cut = cut - 2 + i
+			}
+			out = append(out, content[:cut]...)
+			out = append(out, '=')
+		case "base64":
+			cut = maxLineLength
+			out = append(out, content[:cut]...)
+		default:
+			cut = bytes.LastIndexAny(content[:maxLineLength], " \t") + 1
+			if cut == 0 {
+				// no space, break the word
+				cut = maxLineLength
+			}
+			out = append(out, content[:cut]...)
+		}
+		if len(lineBreak) == 0 {
+			// the last line of the data
+			out = append(out, '\n')
+		} else {
+			out = append(out, lineBreak...)
+		}
+		content = content[cut:]
+	}
+	out = append(out, content...)
+	return append(out, line[len(line)-len(lineBreak):]...)
+}
@@ -0,0 +1,134 @@
+package backends
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func newLineLengthEnvelope(data string) *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.Data.WriteString(data)
+	return e
+}
+
+// longWords returns a line of n words, 1200 characters for n = 200
+func longWords(n int) string {
+	return strings.TrimSpace(strings.Repeat("lorem ", n))
+}
+
+func testLongLineMessage() string {
+	return "Subject: report\nContent-Type: text/plain\n\nfirst line\n" + longWords(200) + "\nlast line\n"
+}
+
+// maxLine returns the length of the longest line in data
+func maxLine(data []byte) int {
+	longest := 0
+	eachLine(data, func(line []byte) {
+		if n := len(bytes.TrimRight(line, "\r\n")); n > longest {
+			longest = n
+		}
+	})
+	return longest
+}
+
+func TestLineLengthFlag(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{}, LineLength)
+	e := newLineLengthEnvelope(testLongLineMessage())
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be flagged only, got:", err)
+	}
+	if e.Values[ValueLongLine] != 1199 {
+		t.Error("expecting the message to be flagged with 1199, got:", e.Values[ValueLongLine])
+	}
+	if e.DeliveryHeader != "X-Long-Line: 1199\n" {
+		t.Error("expecting a X-Long-Line header, got:", e.DeliveryHeader)
+	}
+	if e.Data.String() != testLongLineMessage() {
+		t.Error("the message should not be changed")
+	}
+
+	e = newLineLengthEnvelope("Subject: hi\n\nshort\r\nlines\r\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	if _, ok := e.Values[ValueLongLine]; ok || e.DeliveryHeader != "" {
+		t.Error("a normal message should not be flagged")
+	}
+}
+
+func TestLineLengthReject(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"line_length_mode": "reject"}, LineLength)
+	result, err := p.Process(newLineLengthEnvelope(testLongLineMessage()), TaskSaveMail)
+	if err != errLineTooLong || result.Code() != 550 {
+		t.Error("expecting the message to be rejected, got:", result, err)
+	}
+	// a line of exactly 998 is allowed
+	msg := "Subject: report\n\n" + strings.Repeat("x", maxLineLength) + "\n"
+	if _, err := p.Process(newLineLengthEnvelope(msg), TaskSaveMail); err != nil {
+		t.Error("expecting a line at the limit to pass, got:", err)
+	}
+	// only text parts are checked
+	msg = "Subject: logo\nContent-Type: image/png\nContent-Transfer-Encoding: base64\n\n" +
+		strings.Repeat("QUJD", 400) + "\n"
+	if _, err := p.Process(newLineLengthEnvelope(msg), TaskSaveMail); err != nil {
+		t.Error("expecting a message that is not text to pass, got:", err)
+	}
+
+	if _, errs := initTestProcessor(BackendConfig{"line_length_mode": "truncate"}, LineLength); errs == nil {
+		t.Error("expecting an error for an invalid line_length_mode")
+	}
+}
+
+func TestLineLengthRewrap(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"line_length_mode": "rewrap"}, LineLength)
+	e := newLineLengthEnvelope(testLongLineMessage())
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be rewrapped, got:", err)
+	}
+	data := e.Data.String()
+	if n := maxLine(e.Data.Bytes()); n > maxLineLength {
+		t.Error("expecting all the lines to be rewrapped, the longest has", n)
+	}
+	if !strings.HasPrefix(data, "Subject: report\nContent-Type: text/plain\n\nfirst line\n") ||
+		!strings.HasSuffix(data, "\nlast line\n") {
+		t.Error("the rest of the message should not be changed, got:", data)
+	}
+	if strings.Replace(data, " \n", " ", -1) != testLongLineMessage() {
+		t.Error("expecting the long line to be broken at a space, got:", data)
+	}
+
+	image := strings.Repeat("QUJD", 400)
+	qp := strings.Repeat("caf=C3=A9 ", 150)
+	msg := "Subject: mixed\r\nContent-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n" +
+		"--b1\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		qp + "\r\n" +
+		"--b1\r\nContent-Type: image/png\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		image + "\r\n" +
+		"--b1--\r\n"
+	e = newLineLengthEnvelope(msg)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be rewrapped, got:", err)
+	}
+	data = e.Data.String()
+	if !strings.Contains(data, "\r\n"+image+"\r\n") {
+		t.Error("the image should not be changed")
+	}
+	if strings.Count(data, "=\r\n") != 1 {
+		t.Error("expecting one soft line break, got:", data)
+	}
+	if strings.Replace(data, "=\r\n", "", -1) != msg {
+		t.Error("expecting only a soft line break to be added, got:", data)
+	}
+	// the soft line break does not split an escape
+	for _, line := range strings.Split(data, "\r\n") {
+		if strings.HasSuffix(line, "=") && len(line) > maxLineLength {
+			t.Error("expecting the soft break to fit in the line, got a line of", len(line))
+		}
+		if i := strings.LastIndex(line, "="); i != -1 && i > len(line)-3 && i != len(line)-1 {
+			t.Error("an escape was split:", line[i:])
+		}
+	}
+}
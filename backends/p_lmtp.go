@@ -0,0 +1,366 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default time to wait to connect, if 'lmtp_connect_timeout' not present in config
+	lmtpConnectTimeout = time.Second * 5
+	// default time to wait for each reply, if 'lmtp_timeout' not present in config
+	lmtpTimeout = time.Second * 30
+	// default idle connections kept, if 'lmtp_max_idle' not present in config
+	lmtpMaxIdle = 2
+)
+
+var (
+	errLMTPRejected = errors.New("rejected by the lmtp server")
+	errLMTPDeferred = errors.New("deferred by the lmtp server")
+)
+
+type LMTPConfig struct {
+	// LMTPAddress is the LMTP server's socket, "host:port" or "unix:/path/to/socket"
+	LMTPAddress string `json:"lmtp_address"`
+	// LMTPLhlo is the name sent with LHLO, the hostname by default
+	LMTPLhlo string `json:"lmtp_lhlo,omitempty"`
+	// LMTPConnectTimeout is how long to wait to connect, eg. "5s"
+	LMTPConnectTimeout string `json:"lmtp_connect_timeout,omitempty"`
+	// LMTPTimeout is how long to wait for each reply of the server, eg. "30s"
+	LMTPTimeout string `json:"lmtp_timeout,omitempty"`
+	// LMTPMaxIdle is the most connections kept open to be reused, -1 for none
+	LMTPMaxIdle int `json:"lmtp_max_idle,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: lmtp
+// ----------------------------------------------------------------------------------
+// Description   : Delivers the message to an LMTP server, eg. Dovecot, which replies
+//               : for each recipient after the DATA. A recipient that the server
+//               : refused, at the RCPT or after the DATA, is failed with the server's
+//               : reply by SetRcptResult. The message is failed with the first reply
+//               : if no recipient was delivered. The connections are reused, checked
+//               : with a RSET before each message
+// ----------------------------------------------------------------------------------
+// Config Options: lmtp_address string - "host:port", or "unix:/path/to/socket"
+//               : lmtp_lhlo string - the name sent with LHLO, default the hostname
+//               : lmtp_connect_timeout string - how long to wait to connect, default "5s"
+//               : lmtp_timeout string - how long to wait for each reply, default "30s"
+//               : lmtp_max_idle int - the most idle connections kept to be reused,
+//               : default 2, -1 to close each connection after its message
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.MailFrom & e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : the replies of the failed recipients in e.Values[ValueRcptResults].
+//               : If the server could not be reached, or the connection failed before
+//               : the DATA was accepted, replies with a 451 so that the save is retried
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["lmtp"] = func() Decorator {
+		return LMTP()
+	}
+}
+
+// lmtpConn is a connection to the LMTP server, after the LHLO
+type lmtpConn struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	timeout time.Duration
+}
+
+// lmtpPool dials the LMTP server and keeps the idle connections
+type lmtpPool struct {
+	network, address string
+	lhlo             string
+	connectTimeout   time.Duration
+	timeout          time.Duration
+	idle             chan *lmtpConn
+	// closed when the pool is shut down
+	closed bool
+	sync.Mutex
+}
+
+// smtpReply returns the SMTP or LMTP reply of err as a Result, or nil if err isn't a reply of the server
+func smtpReply(err error) Result {
+	if tpErr, ok := err.(*textproto.Error); ok {
+		// the first line of a multi-line reply
+		msg := strings.SplitN(tpErr.Msg, "\n", 2)[0]
+		return NewResult(fmt.Sprintf("%d %s", tpErr.Code, msg))
+	}
+	return nil
+}
+
+// cmd sends a command & reads its reply, which must have the code expect
+func (c *lmtpConn) cmd(expect int, format string, args ...interface{}) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	_, _, err = c.text.ReadResponse(expect)
+	return err
+}
+
+func (c *lmtpConn) close() {
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	c.text.Cmd("QUIT")
+	c.text.Close()
+}
+
+// dial connects to the server & greets it
+func (p *lmtpPool) dial() (*lmtpConn, error) {
+	conn, err := net.DialTimeout(p.network, p.address, p.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &lmtpConn{conn: conn, text: textproto.NewConn(conn), timeout: p.timeout}
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	if _, _, err = c.text.ReadResponse(220); err == nil {
+		err = c.cmd(250, "LHLO %s", p.lhlo)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// get returns an idle connection that still works, or a new one
+func (p *lmtpPool) get() (*lmtpConn, error) {
+	for {
+		select {
+		case c := <-p.idle:
+			if err := c.cmd(250, "RSET"); err != nil {
+				// timed out by the server
+				c.text.Close()
+				continue
+			}
+			return c, nil
+		default:
+			return p.dial()
+		}
+	}
+}
+
+// put keeps c for the next message, or closes it if enough are kept
+func (p *lmtpPool) put(c *lmtpConn) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.closed {
+		select {
+		case p.idle <- c:
+			return
+		default:
+		}
+	}
+	c.close()
+}
+
+// shutdown closes the idle connections
+func (p *lmtpPool) shutdown() {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	for {
+		select {
+		case c := <-p.idle:
+			c.close()
+		default:
+			return
+		}
+	}
+}
+
+// deliver sends e over c, and returns the reply of each recipient. Returns an error if the
+// connection failed before the server took the message, c can't be reused after an error
+func (c *lmtpConn) deliver(e *mail.Envelope) ([]Result, error) {
+	from := ""
+	if !e.MailFrom.IsEmpty() {
+		from = e.MailFrom.String()
+	}
+	results := make([]Result, len(e.RcptTo))
+	if err := c.cmd(250, "MAIL FROM:<%s>", from); err != nil {
+		if r := smtpReply(err); r != nil {
+			// refused, for all the recipients
+			for i := range results {
+				results[i] = r
+			}
+			return results, nil
+		}
+		return nil, err
+	}
+	// the recipients accepted at the RCPT reply after the DATA, in order
+	var accepted []int
+	for i := range e.RcptTo {
+		if err := c.cmd(25, "RCPT TO:<%s>", e.RcptTo[i].String()); err != nil {
+			if results[i] = smtpReply(err); results[i] == nil {
+				return nil, err
+			}
+			continue
+		}
+		accepted = append(accepted, i)
+	}
+	if len(accepted) == 0 {
+		return results, c.cmd(250, "RSET")
+	}
+	if err := c.cmd(354, "DATA"); err != nil {
+		r := smtpReply(err)
+		if r == nil {
+			return nil, err
+		}
+		for _, i := range accepted {
+			results[i] = r
+		}
+		return results, nil
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	w := c.text.DotWriter()
+	_, err := w.Write([]byte(e.DeliveryHeader))
+	if err == nil {
+		_, err = w.Write(e.Data.Bytes())
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	for n, i := range accepted {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		if _, _, err := c.text.ReadResponse(25); err != nil {
+			if results[i] = smtpReply(err); results[i] == nil {
+				if n == 0 {
+					return nil, err
+				}
+				// the server may have delivered to the rest, retrying them alone may duplicate
+				for _, j := range accepted[n:] {
+					results[j] = NewResult(response.Canned.ErrorBackendTransaction + "lmtp delivery failed")
+				}
+				return results, err
+			}
+			continue
+		}
+		results[i] = BackendResultOK
+	}
+	return results, nil
+}
+
+func LMTP() Decorator {
+
+	var pool *lmtpPool
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&LMTPConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*LMTPConfig)
+		if config.LMTPAddress == "" {
+			return errors.New("lmtp_address cannot be empty")
+		}
+		p := &lmtpPool{
+			network:        "tcp",
+			address:        config.LMTPAddress,
+			lhlo:           config.LMTPLhlo,
+			connectTimeout: lmtpConnectTimeout,
+			timeout:        lmtpTimeout,
+		}
+		if strings.HasPrefix(p.address, "unix:") {
+			p.network, p.address = "unix", strings.TrimPrefix(p.address, "unix:")
+		} else {
+			p.address = strings.TrimPrefix(p.address, "tcp:")
+		}
+		if p.lhlo == "" {
+			if p.lhlo, err = os.Hostname(); err != nil {
+				return err
+			}
+		}
+		if config.LMTPConnectTimeout != "" {
+			if p.connectTimeout, err = time.ParseDuration(config.LMTPConnectTimeout); err != nil {
+				return err
+			}
+		}
+		if config.LMTPTimeout != "" {
+			if p.timeout, err = time.ParseDuration(config.LMTPTimeout); err != nil {
+				return err
+			}
+		}
+		switch {
+		case config.LMTPMaxIdle == 0:
+			p.idle = make(chan *lmtpConn, lmtpMaxIdle)
+		case config.LMTPMaxIdle > 0:
+			p.idle = make(chan *lmtpConn, config.LMTPMaxIdle)
+		default:
+			p.idle = make(chan *lmtpConn)
+		}
+		pool = p
+		return nil
+	}))
+
+	// shutdown will close the idle connections
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if pool != nil {
+			pool.shutdown()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				c, err := pool.get()
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not connect to the lmtp server")
+					return NewResult(response.Canned.ErrorBackendTransaction + "lmtp delivery failed"), NewRetryableError(err)
+				}
+				results, err := c.deliver(e)
+				if err != nil {
+					c.text.Close()
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("lmtp delivery failed")
+					if results == nil {
+						return NewResult(response.Canned.ErrorBackendTransaction + "lmtp delivery failed"), NewRetryableError(err)
+					}
+				} else {
+					pool.put(c)
+				}
+				var failed Result
+				delivered := false
+				for i, r := range results {
+					if r.Code() < 300 {
+						delivered = true
+						continue
+					}
+					Log().WithField("queued_id", e.QueuedId).Info("lmtp refused ", e.RcptTo[i].String(), ": ", r.String())
+					if failed == nil {
+						failed = r
+					}
+					SetRcptResult(e, e.RcptTo[i], r)
+				}
+				if !delivered && failed != nil {
+					if failed.Code() < 500 {
+						return failed, errLMTPDeferred
+					}
+					return failed, errLMTPRejected
+				}
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package backends
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lmtpTestServer refuses nobody@ at the RCPT & full@ after the DATA, and keeps the messages
+type lmtpTestServer struct {
+	l        net.Listener
+	conns    int
+	messages []string
+	commands []string
+	sync.Mutex
+}
+
+func newLMTPTestServer(t *testing.T) *lmtpTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &lmtpTestServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.conns++
+			s.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *lmtpTestServer) serve(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	defer text.Close()
+	var rcpts []string
+	text.PrintfLine("220 lmtp.example.com LMTP ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		s.commands = append(s.commands, line)
+		s.Unlock()
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case cmd == "LHLO":
+			text.PrintfLine("250-lmtp.example.com")
+			text.PrintfLine("250 PIPELINING")
+		case cmd == "MAIL":
+			rcpts = nil
+			text.PrintfLine("250 2.1.0 Ok")
+		case cmd == "RCPT" && strings.Contains(line, "<nobody@"):
+			text.PrintfLine("550 5.1.1 User doesn't exist")
+		case cmd == "RCPT":
+			rcpts = append(rcpts, line)
+			text.PrintfLine("250 2.1.5 Ok")
+		case cmd == "DATA":
+			text.PrintfLine("354 OK")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.messages = append(s.messages, string(data))
+			s.Unlock()
+			for _, rcpt := range rcpts {
+				if strings.Contains(rcpt, "<full@") {
+					text.PrintfLine("452 4.2.2 Mailbox is full")
+				} else {
+					text.PrintfLine("250 2.0.0 Saved")
+				}
+			}
+		case cmd == "RSET":
+			text.PrintfLine("250 2.0.0 Ok")
+		case cmd == "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("500 5.5.1 Unknown command")
+		}
+	}
+}
+
+func TestLMTP(t *testing.T) {
+	s := newLMTPTestServer(t)
+	defer s.l.Close()
+	p := newTestProcessor(t, BackendConfig{"lmtp_address": s.l.Addr().String(), "lmtp_lhlo": "mx.example.com"}, LMTP)
+
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\n.hi\n",
+		"bob@example.org", "nobody@example.org", "full@example.org")
+	e.DeliveryHeader = "Received: from mx.example.com\n"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be delivered to bob, got:", err)
+	}
+	results := envelopeRcptResults(e, e.RcptTo, BackendResultOK)
+	if len(results) != 3 || resultCode(results[0]) != 200 ||
+		results[1].String() != "550 5.1.1 User doesn't exist" || results[2].String() != "452 4.2.2 Mailbox is full" {
+		t.Error("expecting the reply of each recipient, got:", results)
+	}
+	if len(s.messages) != 1 || s.messages[0] != "Received: from mx.example.com\nSubject: hello\n\n.hi\n" {
+		t.Error("unexpected message:", s.messages)
+	}
+
+	// none delivered, on the same connection
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "nobody@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if err != errLMTPRejected || result.String() != "550 5.1.1 User doesn't exist" {
+		t.Error("expecting the message to be rejected, got:", result, err)
+	}
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "full@example.org")
+	result, err = p.Process(e, TaskSaveMail)
+	if err != errLMTPDeferred || resultCode(result) != 452 {
+		t.Error("expecting the message to be deferred, got:", result, err)
+	}
+	if s.conns != 1 {
+		t.Error("expecting the connection to be reused, got:", s.conns)
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.commands[0] != "LHLO mx.example.com" || s.commands[1] != "MAIL FROM:<alice@example.com>" {
+		t.Error("unexpected commands:", s.commands)
+	}
+}
+
+func TestLMTPUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	p := newTestProcessor(t, BackendConfig{"lmtp_address": addr, "lmtp_connect_timeout": "1s"}, LMTP)
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+}
+
+func TestLMTPConfig(t *testing.T) {
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"lmtp_address": ""}, "lmtp_address cannot be empty"},
+		{BackendConfig{"lmtp_address": "unix:/run/dovecot/lmtp", "lmtp_timeout": "soon"}, "invalid duration"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, LMTP)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// default maildir of a recipient, if 'maildir_layout' not present in config
+const maildirLayout = "{domain}/{user}"
+
+type MaildirConfig struct {
+	// MaildirPath is the directory that the maildirs are in, eg. /var/vmail
+	MaildirPath string `json:"maildir_path"`
+	// MaildirLayout is the maildir of a recipient under the MaildirPath, where {user} & {domain}
+	// are replaced with the local part & the domain of the address, eg. "{domain}/{user}/Maildir"
+	MaildirLayout string `json:"maildir_layout,omitempty"`
+	// MaildirUserMap maps an address, or a domain as "@example.com", to its maildir under the
+	// MaildirPath, in place of the MaildirLayout
+	MaildirUserMap map[string]string `json:"maildir_user_map,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: maildir
+// ----------------------------------------------------------------------------------
+// Description   : Delivers the message into the Maildir of each recipient, for Dovecot
+//               : or a mail client to read, so that go-guerrilla can be used as a local
+//               : MDA. The message is written to tmp/ under a unique name, synced to
+//               : the disk, then moved to new/. The maildir & its tmp, new & cur
+//               : directories are created if they do not exist. Return-Path &
+//               : Delivered-To headers are added
+// ----------------------------------------------------------------------------------
+// Config Options: maildir_path string - the directory the maildirs are in, eg. /var/vmail
+//               : maildir_layout string - the maildir of a recipient under maildir_path,
+//               : {user} & {domain} are replaced with the parts of the address, in
+//               : lower case, default "{domain}/{user}"
+//               : maildir_user_map object - maildirs by address or by "@domain", in
+//               : place of the layout, eg. {"postmaster@example.com": "example.com/admin",
+//               : "@example.org": "example.org/catchall"}
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.MailFrom & e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : a file in the new/ directory of each maildir. A recipient that could
+//               : not be delivered is failed with a 451 by SetRcptResult, the message is
+//               : failed if none could be
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["maildir"] = func() Decorator {
+		return Maildir()
+	}
+}
+
+// maildirDelivered counts the deliveries of this process, for the unique names of the files
+var maildirDelivered uint64
+
+// maildirHostname is the hostname part of the unique names
+var maildirHostname = func() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	// the separators of the name & its info are escaped, as the maildir spec says
+	return strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+}()
+
+// maildirName returns a unique name for a message of size bytes,
+// eg. 1700000000.M123456P42Q7.mx.example.com,S=1024
+func maildirName(now time.Time, size int) string {
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&maildirDelivered, 1), maildirHostname, size)
+}
+
+// mailbox returns the maildir of rcpt, or an error if its address can't be a directory name
+func (c *MaildirConfig) mailbox(rcpt mail.Address) (string, error) {
+	user, domain := strings.ToLower(rcpt.User), strings.ToLower(rcpt.Host)
+	dir, ok := c.MaildirUserMap[user+"@"+domain]
+	if !ok {
+		dir, ok = c.MaildirUserMap["@"+domain]
+	}
+	if !ok {
+		var err error
+		if dir, err = expandMailboxLayout(c.MaildirLayout, rcpt); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(c.MaildirPath, filepath.FromSlash(dir)), nil
+}
+
+// expandMailboxLayout replaces {user} & {domain} in layout with the parts of rcpt, in lower case.
+// Returns an error if a part can't be a file name
+func expandMailboxLayout(layout string, rcpt mail.Address) (string, error) {
+	user, domain := strings.ToLower(rcpt.User), strings.ToLower(rcpt.Host)
+	for _, part := range []string{user, domain} {
+		if part == "" || strings.ContainsAny(part, `/\`) || strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("invalid mailbox name: %s", part)
+		}
+	}
+	return strings.NewReplacer("{user}", user, "{domain}", domain).Replace(layout), nil
+}
+
+// deliverMaildir writes data to a new file in the maildir dir
+func deliverMaildir(dir string, data []byte, now time.Time) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	name := maildirName(now, len(data))
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, "new", name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// the rename is durable once the directory is synced
+	if d, err := os.Open(filepath.Join(dir, "new")); err == nil {
+		err = d.Sync()
+		d.Close()
+		return err
+	}
+	return nil
+}
+
+func Maildir() Decorator {
+
+	var config *MaildirConfig
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MaildirConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*MaildirConfig)
+		if err := configValue(backendConfig, "maildir_user_map", &c.MaildirUserMap); err != nil {
+			return err
+		}
+		if c.MaildirPath == "" {
+			return errors.New("maildir_path cannot be empty")
+		}
+		if info, err := os.Stat(c.MaildirPath); err != nil || !info.IsDir() {
+			return fmt.Errorf("maildir_path is not a directory: %s", c.MaildirPath)
+		}
+		if c.MaildirLayout == "" {
+			c.MaildirLayout = maildirLayout
+		}
+		if !strings.Contains(c.MaildirLayout, "{user}") {
+			// every recipient would get the same maildir
+			return errors.New("maildir_layout must contain {user}: " + c.MaildirLayout)
+		}
+		userMap := make(map[string]string, len(c.MaildirUserMap))
+		for addr, dir := range c.MaildirUserMap {
+			if dir == "" || filepath.IsAbs(dir) || strings.HasPrefix(filepath.Clean(dir), "..") {
+				return fmt.Errorf("maildir of %s must be under maildir_path: %s", addr, dir)
+			}
+			userMap[strings.ToLower(addr)] = dir
+		}
+		c.MaildirUserMap = userMap
+		config = c
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				var failed []mail.Address
+				var lastErr error
+				now := time.Now()
+				for _, rcpt := range e.RcptTo {
+					header := "Return-Path: <" + e.MailFrom.String() + ">\n" +
+						"Delivered-To: " + rcpt.String() + "\n" + e.DeliveryHeader
+					data := make([]byte, 0, len(header)+e.Data.Len())
+					data = append(append(data, header...), e.Data.Bytes()...)
+					dir, err := config.mailbox(rcpt)
+					if err == nil {
+						err = deliverMaildir(dir, data, now)
+					}
+					if err != nil {
+						Log().WithError(err).WithField("queued_id", e.QueuedId).
+							Error("could not deliver to the maildir of ", rcpt.String())
+						failed = append(failed, rcpt)
+						lastErr = err
+					}
+				}
+				if len(failed) == len(e.RcptTo) && len(failed) > 0 {
+					return NewResult(response.Canned.ErrorBackendTransaction + "maildir delivery failed"), NewRetryableError(lastErr)
+				}
+				for _, rcpt := range failed {
+					// the others were delivered, the client retries this one alone
+					SetRcptResult(e, rcpt, NewResult(response.Canned.ErrorBackendTransaction+"maildir delivery failed"))
+				}
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
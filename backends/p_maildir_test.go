@@ -0,0 +1,145 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// readMaildir returns the messages in the new/ directory of the maildir dir
+func readMaildir(t *testing.T, dir string) map[string]string {
+	files, _ := filepath.Glob(filepath.Join(dir, "new", "*"))
+	messages := make(map[string]string)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages[filepath.Base(file)] = string(b)
+	}
+	return messages
+}
+
+func TestMaildir(t *testing.T) {
+	base, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	p := newTestProcessor(t, BackendConfig{
+		"maildir_path":   base,
+		"maildir_layout": "{domain}/{user}/Maildir",
+		"maildir_user_map": map[string]interface{}{
+			"Postmaster@example.com": "example.com/admin/Maildir",
+			"@example.net":           "example.net/catchall",
+		},
+	}, Maildir)
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n",
+		"Bob@Example.org", "postmaster@example.com", "carol@example.net")
+	e.DeliveryHeader = "Received: from mx.example.com\n"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be delivered, got:", err)
+	}
+
+	name := regexp.MustCompile(`^\d+\.M\d+P\d+Q\d+\.[^/:]+,S=\d+$`)
+	for rcpt, dir := range map[string]string{
+		"Bob@Example.org":        "example.org/bob/Maildir",
+		"postmaster@example.com": "example.com/admin/Maildir",
+		"carol@example.net":      "example.net/catchall",
+	} {
+		dir = filepath.Join(base, dir)
+		messages := readMaildir(t, dir)
+		if len(messages) != 1 {
+			t.Error("expecting a message in", dir, "got:", messages)
+			continue
+		}
+		for file, data := range messages {
+			if !name.MatchString(file) {
+				t.Error("unexpected file name:", file)
+			}
+			expect := "Return-Path: <alice@example.com>\nDelivered-To: " + rcpt +
+				"\nReceived: from mx.example.com\nSubject: hello\n\nhi\n"
+			if data != expect {
+				t.Error("unexpected message:", data)
+			}
+			if !strings.HasSuffix(file, ",S="+strconv.Itoa(len(data))) {
+				t.Error("expecting the size in the name of", file)
+			}
+		}
+		for _, sub := range []string{"tmp", "cur"} {
+			if files, err := ioutil.ReadDir(filepath.Join(dir, sub)); err != nil || len(files) != 0 {
+				t.Error("expecting an empty", sub, "directory, got:", files, err)
+			}
+		}
+	}
+}
+
+func TestMaildirFailed(t *testing.T) {
+	base, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	p := newTestProcessor(t, BackendConfig{"maildir_path": base}, Maildir)
+	// a file is in the way of the maildir of bob
+	if err := os.Mkdir(filepath.Join(base, "example.org"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(base, "example.org", "bob"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n",
+		"bob@example.org", "carol@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be delivered to carol, got:", err)
+	}
+	if len(readMaildir(t, filepath.Join(base, "example.org", "carol"))) != 1 {
+		t.Error("expecting the message to be delivered to carol")
+	}
+	results := envelopeRcptResults(e, e.RcptTo, BackendResultOK)
+	if len(results) != 2 || resultCode(results[0]) != 451 || resultCode(results[1]) != 200 {
+		t.Error("expecting bob to be failed with a 451, got:", results)
+	}
+
+	// none could be delivered
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	e.RcptTo = append(e.RcptTo, mail.Address{User: "..", Host: "example.org"})
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "new")); err == nil {
+		t.Error("the maildir of .. should not be created")
+	}
+}
+
+func TestMaildirConfig(t *testing.T) {
+	base, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"maildir_path": ""}, "maildir_path cannot be empty"},
+		{BackendConfig{"maildir_path": filepath.Join(base, "none")}, "not a directory"},
+		{BackendConfig{"maildir_path": base, "maildir_layout": "{domain}"}, "must contain {user}"},
+		{BackendConfig{"maildir_path": base, "maildir_user_map": map[string]interface{}{"@example.com": "../x"}},
+			"must be under maildir_path"},
+		{BackendConfig{"maildir_path": base, "maildir_user_map": "example.com"}, "invalid maildir_user_map"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, Maildir)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
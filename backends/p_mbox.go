@@ -0,0 +1,190 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// default mbox of a recipient, if 'mbox_layout' not present in config
+const mboxLayout = "{domain}/{user}"
+
+type MboxConfig struct {
+	// MboxFile is a single mbox that all the messages are appended to, eg. an archive
+	MboxFile string `json:"mbox_file,omitempty"`
+	// MboxPath is the directory of the mboxes of the recipients, in place of the MboxFile
+	MboxPath string `json:"mbox_path,omitempty"`
+	// MboxLayout is the mbox of a recipient under the MboxPath, where {user} & {domain} are
+	// replaced with the local part & the domain of the address
+	MboxLayout string `json:"mbox_layout,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: mbox
+// ----------------------------------------------------------------------------------
+// Description   : Appends the message to an mbox file, in the mboxrd format: a From_
+//               : line with the sender & the time, then the message with the lines
+//               : starting with "From " (after any '>') quoted with another '>', and
+//               : a blank line. The line endings are written as LF. The file is locked
+//               : with flock while appending, the lock that mutt, Dovecot & procmail
+//               : honour, and it is truncated back if the message could not be written
+// ----------------------------------------------------------------------------------
+// Config Options: mbox_file string - a single mbox for all the messages, eg. an archive
+//               : mbox_path string - the directory of an mbox for each recipient, in
+//               : place of mbox_file. A Delivered-To header is added to each copy
+//               : mbox_layout string - the mbox of a recipient under mbox_path,
+//               : {user} & {domain} are replaced with the parts of the address, in
+//               : lower case, default "{domain}/{user}"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.MailFrom & e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : the message appended to the mbox. With mbox_path, a recipient that
+//               : could not be delivered is failed with a 451 by SetRcptResult, the
+//               : message is failed if none could be
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["mbox"] = func() Decorator {
+		return Mbox()
+	}
+}
+
+// mboxMessage returns the message as an mbox entry, from sender at now
+func mboxMessage(from mail.Address, header string, data []byte, now time.Time) []byte {
+	// for the null reverse-path of a bounce
+	sender := "MAILER-DAEMON"
+	if !from.IsEmpty() {
+		sender = from.String()
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(header) + len(data) + 128)
+	buf.WriteString("From " + sender + " " + now.UTC().Format(time.ANSIC) + "\n")
+	msg := append([]byte(header), data...)
+	for len(msg) > 0 {
+		line := msg
+		if i := bytes.IndexByte(msg, '\n'); i != -1 {
+			line, msg = msg[:i], msg[i+1:]
+		} else {
+			msg = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	// the blank line that separates the entries
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// appendMbox appends the entry to the mbox at path, holding an exclusive flock on it
+func appendMbox(path string, entry []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(entry)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// don't leave half a message for the next one to be appended to
+		f.Truncate(info.Size())
+	}
+	return err
+}
+
+func Mbox() Decorator {
+
+	var config *MboxConfig
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MboxConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*MboxConfig)
+		if (c.MboxFile == "") == (c.MboxPath == "") {
+			return errors.New("either mbox_file or mbox_path must be set")
+		}
+		if c.MboxPath != "" {
+			if info, err := os.Stat(c.MboxPath); err != nil || !info.IsDir() {
+				return errors.New("mbox_path is not a directory: " + c.MboxPath)
+			}
+		}
+		if c.MboxLayout == "" {
+			c.MboxLayout = mboxLayout
+		}
+		if !strings.Contains(c.MboxLayout, "{user}") {
+			// every recipient would get the same mbox
+			return errors.New("mbox_layout must contain {user}: " + c.MboxLayout)
+		}
+		config = c
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				now := time.Now()
+				if config.MboxFile != "" {
+					if err := appendMbox(config.MboxFile, mboxMessage(e.MailFrom, e.DeliveryHeader, e.Data.Bytes(), now)); err != nil {
+						Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not append to the mbox")
+						return NewResult(response.Canned.ErrorBackendTransaction + "mbox delivery failed"), NewRetryableError(err)
+					}
+					return p.Process(e, task)
+				}
+				var failed []mail.Address
+				var lastErr error
+				for _, rcpt := range e.RcptTo {
+					file, err := expandMailboxLayout(config.MboxLayout, rcpt)
+					if err == nil {
+						header := "Delivered-To: " + rcpt.String() + "\n" + e.DeliveryHeader
+						err = appendMbox(filepath.Join(config.MboxPath, filepath.FromSlash(file)),
+							mboxMessage(e.MailFrom, header, e.Data.Bytes(), now))
+					}
+					if err != nil {
+						Log().WithError(err).WithField("queued_id", e.QueuedId).
+							Error("could not append to the mbox of ", rcpt.String())
+						failed = append(failed, rcpt)
+						lastErr = err
+					}
+				}
+				if len(failed) == len(e.RcptTo) && len(failed) > 0 {
+					return NewResult(response.Canned.ErrorBackendTransaction + "mbox delivery failed"), NewRetryableError(lastErr)
+				}
+				for _, rcpt := range failed {
+					// the others were delivered, the client retries this one alone
+					SetRcptResult(e, rcpt, NewResult(response.Canned.ErrorBackendTransaction+"mbox delivery failed"))
+				}
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestMboxMessage(t *testing.T) {
+	now := time.Date(2017, 3, 4, 15, 4, 5, 0, time.UTC)
+	from := mail.Address{User: "alice", Host: "example.com"}
+	data := "Subject: hi\r\n\r\nFrom here on\r\n>From the start\r\nnot From\r\n>>From x"
+	entry := string(mboxMessage(from, "Received: from mx\n", []byte(data), now))
+	expect := "From alice@example.com Sat Mar  4 15:04:05 2017\n" +
+		"Received: from mx\n" +
+		"Subject: hi\n" +
+		"\n" +
+		">From here on\n" +
+		">>From the start\n" +
+		"not From\n" +
+		">>>From x\n" +
+		"\n"
+	if entry != expect {
+		t.Errorf("unexpected entry:\n%q\nexpecting:\n%q", entry, expect)
+	}
+	if entry := string(mboxMessage(mail.Address{}, "", []byte("hi\n"), now)); !strings.HasPrefix(entry, "From MAILER-DAEMON ") {
+		t.Error("expecting a bounce to be from MAILER-DAEMON, got:", entry)
+	}
+}
+
+func TestMboxFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archive.mbox")
+	p := newTestProcessor(t, BackendConfig{"mbox_file": path}, Mbox)
+	// appended at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\n"+strings.Repeat("x", 10000)+"\n",
+				"bob@example.org", "carol@example.org")
+			if _, err := p.Process(e, TaskSaveMail); err != nil {
+				t.Error("the message should be appended, got:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := regexp.MustCompile(`(?m)^From alice@example\.com .+\nSubject: hello\n\n` + strings.Repeat("x", 10000) + `\n\n`)
+	if n := len(entry.FindAll(b, -1)); n != 10 || len(entry.ReplaceAll(b, nil)) != 0 {
+		t.Error("expecting 10 whole entries, got:", n)
+	}
+}
+
+func TestMboxPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := newTestProcessor(t, BackendConfig{"mbox_path": dir, "mbox_layout": "{domain}/{user}.mbox"}, Mbox)
+	// a directory is in the way of the mbox of bob
+	if err := os.MkdirAll(filepath.Join(dir, "example.org", "bob.mbox"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org", "Carol@Example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be delivered to carol, got:", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "example.org", "carol.mbox"))
+	if err != nil {
+		t.Fatal("expecting the mbox of carol, got:", err)
+	}
+	if !regexp.MustCompile(`^From alice@example\.com .+\nDelivered-To: Carol@Example\.org\nSubject: hello\n\nhi\n\n$`).Match(b) {
+		t.Error("unexpected mbox:", string(b))
+	}
+	results := envelopeRcptResults(e, e.RcptTo, BackendResultOK)
+	if len(results) != 2 || resultCode(results[0]) != 451 || resultCode(results[1]) != 200 {
+		t.Error("expecting bob to be failed with a 451, got:", results)
+	}
+
+	// none could be delivered
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+}
+
+func TestMboxConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{}, "either mbox_file or mbox_path"},
+		{BackendConfig{"mbox_file": filepath.Join(dir, "a"), "mbox_path": dir}, "either mbox_file or mbox_path"},
+		{BackendConfig{"mbox_path": filepath.Join(dir, "none")}, "not a directory"},
+		{BackendConfig{"mbox_path": dir, "mbox_layout": "{domain}"}, "must contain {user}"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, Mbox)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
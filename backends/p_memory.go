@@ -0,0 +1,173 @@
+package backends
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// default most messages kept, if 'memory_max_messages' not present in config
+const memoryMaxMessages = 100
+
+type MemoryConfig struct {
+	// MaxMessages is how many messages are kept, the oldest are dropped after that
+	MaxMessages int `json:"memory_max_messages,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: memory
+// ----------------------------------------------------------------------------------
+// Description   : Stores the messages in memory, for testing & development without
+//               : a database. The messages can be read back from backends.Memory,
+//               : by their queued id. The memory is bounded, when it is full the
+//               : oldest message is dropped. The messages are lost on exit
+// ----------------------------------------------------------------------------------
+// Config Options: memory_max_messages int - how many messages are kept, default 100
+// --------------:-------------------------------------------------------------------
+// Input         : e.QueuedId, e.MailFrom, e.RcptTo, e.RemoteIP
+//               : e.DeliveryHeader & e.Data
+// ----------------------------------------------------------------------------------
+// Output        : the message is stored in backends.Memory
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["memory"] = func() Decorator {
+		return MemoryStorage()
+	}
+}
+
+// StoredMessage is a message kept by the memory processor
+type StoredMessage struct {
+	QueuedId string
+	RemoteIP string
+	MailFrom string
+	RcptTo   []string
+	// Data is the message, with the header added by the processors
+	Data []byte
+	Time time.Time
+}
+
+// MemoryStore is a ring buffer of the messages stored by the memory processor
+type MemoryStore struct {
+	// the messages, ring[next] is the oldest once the ring is full
+	ring []*StoredMessage
+	next int
+	// the index in the ring, by queued id
+	index map[string]int
+	sync.RWMutex
+}
+
+// Memory has the messages of the memory processors, all the workers store to it
+var Memory = &MemoryStore{index: make(map[string]int)}
+
+// GetStored returns the message with the queued id, false if it is not stored
+func (m *MemoryStore) GetStored(id string) (StoredMessage, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	i, ok := m.index[id]
+	if !ok {
+		return StoredMessage{}, false
+	}
+	return *m.ring[i], true
+}
+
+// List returns the stored messages, the oldest first
+func (m *MemoryStore) List() []StoredMessage {
+	m.RLock()
+	defer m.RUnlock()
+	list := make([]StoredMessage, 0, len(m.index))
+	for i := range m.ring {
+		if msg := m.ring[(m.next+i)%len(m.ring)]; msg != nil {
+			list = append(list, *msg)
+		}
+	}
+	return list
+}
+
+// Reset drops all the messages
+func (m *MemoryStore) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.ring = make([]*StoredMessage, len(m.ring))
+	m.next = 0
+	m.index = make(map[string]int)
+}
+
+// setMax changes how many messages are kept, the newest are kept if there are more
+func (m *MemoryStore) setMax(max int) {
+	m.Lock()
+	defer m.Unlock()
+	if max == len(m.ring) {
+		return
+	}
+	old, oldNext := m.ring, m.next
+	m.ring = make([]*StoredMessage, max)
+	m.next = 0
+	m.index = make(map[string]int)
+	for i := range old {
+		if msg := old[(oldNext+i)%len(old)]; msg != nil {
+			m.add(msg)
+		}
+	}
+}
+
+// store adds the message, dropping the oldest one if full
+func (m *MemoryStore) store(msg *StoredMessage) {
+	m.Lock()
+	defer m.Unlock()
+	m.add(msg)
+}
+
+// add is store, with the lock held
+func (m *MemoryStore) add(msg *StoredMessage) {
+	if oldest := m.ring[m.next]; oldest != nil && m.index[oldest.QueuedId] == m.next {
+		delete(m.index, oldest.QueuedId)
+	}
+	m.ring[m.next] = msg
+	m.index[msg.QueuedId] = m.next
+	m.next = (m.next + 1) % len(m.ring)
+}
+
+func MemoryStorage() Decorator {
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MemoryConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*MemoryConfig)
+		if config.MaxMessages < 0 {
+			return errors.New("memory_max_messages cannot be negative")
+		}
+		if config.MaxMessages == 0 {
+			config.MaxMessages = memoryMaxMessages
+		}
+		Memory.setMax(config.MaxMessages)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				// the envelope is reused after the processors are done, so copy it
+				msg := &StoredMessage{
+					QueuedId: e.QueuedId,
+					RemoteIP: e.RemoteIP,
+					MailFrom: e.MailFrom.String(),
+					Data:     append([]byte(e.DeliveryHeader), e.Data.Bytes()...),
+					Time:     time.Now(),
+				}
+				for i := range e.RcptTo {
+					msg.RcptTo = append(msg.RcptTo, e.RcptTo[i].String())
+				}
+				Memory.store(msg)
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
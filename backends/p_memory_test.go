@@ -0,0 +1,74 @@
+package backends
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// memoryDeliver saves a message with the queued id id
+func memoryDeliver(t *testing.T, p Processor, id string) {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = id
+	e.MailFrom = mail.Address{User: "alice", Host: "example.com"}
+	e.PushRcpt(mail.Address{User: "bob", Host: "example.com"})
+	e.DeliveryHeader = "Received: from test\n"
+	e.Data.WriteString("Subject: " + id + "\n\nHello\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("expecting the message to be saved, got:", err)
+	}
+	// reused
+	e.ResetTransaction()
+}
+
+func TestMemory(t *testing.T) {
+	defer Memory.Reset()
+	p := newTestProcessor(t, BackendConfig{"memory_max_messages": 3}, MemoryStorage)
+	for i := 1; i <= 2; i++ {
+		memoryDeliver(t, p, fmt.Sprint("id", i))
+	}
+	msg, ok := Memory.GetStored("id2")
+	if !ok {
+		t.Fatal("expecting id2 to be stored")
+	}
+	if msg.MailFrom != "alice@example.com" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "bob@example.com" ||
+		string(msg.Data) != "Received: from test\nSubject: id2\n\nHello\n" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	if list := Memory.List(); len(list) != 2 || list[0].QueuedId != "id1" {
+		t.Error("expecting 2 messages, the oldest first, got:", list)
+	}
+
+	// the oldest are dropped
+	for i := 3; i <= 5; i++ {
+		memoryDeliver(t, p, fmt.Sprint("id", i))
+	}
+	if _, ok := Memory.GetStored("id2"); ok {
+		t.Error("expecting id2 to be dropped")
+	}
+	list := Memory.List()
+	if len(list) != 3 || list[0].QueuedId != "id3" || list[2].QueuedId != "id5" {
+		t.Error("expecting id3 to id5, got:", list)
+	}
+
+	// smaller after a reload, the newest are kept
+	p = newTestProcessor(t, BackendConfig{"memory_max_messages": 2}, MemoryStorage)
+	list = Memory.List()
+	if len(list) != 2 || list[0].QueuedId != "id4" || list[1].QueuedId != "id5" {
+		t.Error("expecting id4 & id5, got:", list)
+	}
+	if _, ok := Memory.GetStored("id3"); ok {
+		t.Error("expecting id3 to be dropped")
+	}
+	memoryDeliver(t, p, "id6")
+	if _, ok := Memory.GetStored("id6"); !ok {
+		t.Error("expecting id6 to be stored")
+	}
+}
+
+func TestMemoryConfig(t *testing.T) {
+	if _, errs := initTestProcessor(BackendConfig{"memory_max_messages": -1}, MemoryStorage); errs == nil {
+		t.Error("expecting a negative memory_max_messages to fail")
+	}
+}
@@ -0,0 +1,669 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// the commands sent to the milter
+const (
+	milterCmdBody    = 'B'
+	milterCmdConnect = 'C'
+	milterCmdMacro   = 'D'
+	milterCmdEOB     = 'E'
+	milterCmdHelo    = 'H'
+	milterCmdHeader  = 'L'
+	milterCmdMail    = 'M'
+	milterCmdEOH     = 'N'
+	milterCmdOptNeg  = 'O'
+	milterCmdQuit    = 'Q'
+	milterCmdRcpt    = 'R'
+	milterCmdData    = 'T'
+)
+
+// the replies of the milter
+const (
+	milterReplyAccept     = 'a'
+	milterReplyContinue   = 'c'
+	milterReplyDiscard    = 'd'
+	milterReplyAddHeader  = 'h'
+	milterReplyInsHeader  = 'i'
+	milterReplyChgHeader  = 'm'
+	milterReplyProgress   = 'p'
+	milterReplyQuarantine = 'q'
+	milterReplyReject     = 'r'
+	milterReplySkip       = 's'
+	milterReplyTempFail   = 't'
+	milterReplyReplyCode  = 'y'
+)
+
+// the actions that the milter may take, the ones supported are applied to the envelope
+const (
+	milterActionAddHeaders = 0x01
+	milterActionChgHeaders = 0x10
+	milterActionQuarantine = 0x20
+
+	milterSupportedActions = milterActionAddHeaders | milterActionChgHeaders | milterActionQuarantine
+)
+
+// the protocol flags, the steps the milter does not want, or does not reply to
+const (
+	milterNoConnect  = 0x01
+	milterNoHelo     = 0x02
+	milterNoMail     = 0x04
+	milterNoRcpt     = 0x08
+	milterNoBody     = 0x10
+	milterNoHeaders  = 0x20
+	milterNoEOH      = 0x40
+	milterNRHeader   = 0x80
+	milterNoUnknown  = 0x100
+	milterNoData     = 0x200
+	milterSkip       = 0x400
+	milterNRConnect  = 0x1000
+	milterNRHelo     = 0x2000
+	milterNRMail     = 0x4000
+	milterNRRcpt     = 0x8000
+	milterNRData     = 0x10000
+	milterNRUnknown  = 0x20000
+	milterNREOH      = 0x40000
+	milterNRBody     = 0x80000
+	milterHeaderLead = 0x100000
+
+	milterSupportedProtocol = milterNoConnect | milterNoHelo | milterNoMail | milterNoRcpt | milterNoBody |
+		milterNoHeaders | milterNoEOH | milterNRHeader | milterNoUnknown | milterNoData | milterSkip |
+		milterNRConnect | milterNRHelo | milterNRMail | milterNRRcpt | milterNRData | milterNRUnknown |
+		milterNREOH | milterNRBody | milterHeaderLead
+)
+
+const (
+	// the version of the milter protocol spoken
+	milterVersion = 6
+	// the largest body chunk
+	milterChunkSize = 65535
+	// the largest packet read from the milter
+	milterMaxPacket = 1 << 20
+
+	// default time to wait to connect, if 'milter_connect_timeout' not present in config
+	milterConnectTimeout = time.Second * 5
+	// default time to wait for each reply, if 'milter_timeout' not present in config
+	milterTimeout = time.Second * 10
+
+	milterOnErrorTempFail = "tempfail"
+	milterOnErrorAccept   = "accept"
+	milterOnErrorReject   = "reject"
+)
+
+// ValueMilterQuarantine is the e.Values key set to the reason, when the milter asks to quarantine the message
+const ValueMilterQuarantine = "milter_quarantine"
+
+var (
+	errMilterRejected = errors.New("rejected by the milter")
+	errMilterTempFail = errors.New("deferred by the milter")
+)
+
+type MilterConfig struct {
+	// MilterAddress is the milter's socket, "host:port" or "unix:/path/to/socket"
+	MilterAddress string `json:"milter_address"`
+	// MilterProtocol are the protocol flags offered to the milter, 0 for all the supported ones
+	MilterProtocol int `json:"milter_protocol,omitempty"`
+	// MilterActions are the actions the milter may take, 0 for all the supported ones
+	MilterActions int `json:"milter_actions,omitempty"`
+	// MilterConnectTimeout is how long to wait to connect, eg. "5s"
+	MilterConnectTimeout string `json:"milter_connect_timeout,omitempty"`
+	// MilterTimeout is how long to wait for each reply of the milter, eg. "10s"
+	MilterTimeout string `json:"milter_timeout,omitempty"`
+	// MilterOnError is what to do when the milter fails: "tempfail" (default), "accept" or "reject"
+	MilterOnError string `json:"milter_on_error,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: milter
+// ----------------------------------------------------------------------------------
+// Description   : Passes the message to a Sendmail milter, eg. OpenDKIM or rspamd, and
+//               : follows its verdict. A reject is a 550, a tempfail is a 451, a
+//               : discarded message is accepted but goes no further. The headers that
+//               : the milter adds, changes or deletes are applied to e.Data.
+//               : A recipient rejected by the milter rejects the message
+// ----------------------------------------------------------------------------------
+// Config Options: milter_address string - "host:port", or "unix:/path/to/socket"
+//               : milter_protocol int - the protocol flags (SMFIP_*) to offer, 0 for
+//               : all the supported ones
+//               : milter_actions int - the actions (SMFIF_*) the milter may take, 0 for
+//               : all the supported ones: add headers (0x01), change headers (0x10) and
+//               : quarantine (0x20)
+//               : milter_connect_timeout string - how long to wait to connect, default "5s"
+//               : milter_timeout string - how long to wait for each reply, default "10s"
+//               : milter_on_error string - when the milter cannot be reached or fails,
+//               : "tempfail" (default), "accept" or "reject" the message
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP, e.Helo, e.MailFrom, e.RcptTo, e.Data
+//               : e.Values[ValuePTRName] set by the fcrdns processor, if present
+// ----------------------------------------------------------------------------------
+// Output        : e.Data with the headers modified by the milter, e.Header is parsed
+//               : again if it was. e.Values[ValueMilterQuarantine] if quarantined
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["milter"] = func() Decorator {
+		return Milter()
+	}
+}
+
+// milterHeader is a header of the message, value is as it is in the message without the
+// line break at the end, folded lines included
+type milterHeader struct {
+	name  string
+	value string
+}
+
+// milterVerdict is the outcome of a milter session
+type milterVerdict struct {
+	reply byte
+	// the SMTP reply for milterReplyReplyCode
+	smtpReply string
+	// the modifications, milterReplyAddHeader, milterReplyInsHeader or milterReplyChgHeader
+	mods []milterMod
+	// the reason of a milterReplyQuarantine
+	quarantine string
+}
+
+type milterMod struct {
+	action byte
+	index  uint32
+	header milterHeader
+}
+
+// milterSession is a connection to the milter for a message
+type milterSession struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	// negotiated with the milter
+	actions  uint32
+	protocol uint32
+}
+
+func Milter() Decorator {
+
+	var (
+		config         *MilterConfig
+		connectTimeout time.Duration
+		timeout        time.Duration
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MilterConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*MilterConfig)
+		if config.MilterAddress == "" {
+			return errors.New("milter_address cannot be empty")
+		}
+		if config.MilterProtocol&^milterSupportedProtocol != 0 {
+			return fmt.Errorf("milter_protocol has unsupported flags: %#x", config.MilterProtocol&^milterSupportedProtocol)
+		}
+		if config.MilterActions&^milterSupportedActions != 0 {
+			return fmt.Errorf("milter_actions has unsupported actions: %#x", config.MilterActions&^milterSupportedActions)
+		}
+		switch config.MilterOnError {
+		case "":
+			config.MilterOnError = milterOnErrorTempFail
+		case milterOnErrorTempFail, milterOnErrorAccept, milterOnErrorReject:
+		default:
+			return errors.New("invalid milter_on_error: " + config.MilterOnError)
+		}
+		connectTimeout = milterConnectTimeout
+		if config.MilterConnectTimeout != "" {
+			if connectTimeout, err = time.ParseDuration(config.MilterConnectTimeout); err != nil {
+				return err
+			}
+		}
+		timeout = milterTimeout
+		if config.MilterTimeout != "" {
+			if timeout, err = time.ParseDuration(config.MilterTimeout); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				verdict, err := milterCheck(e, config, connectTimeout, timeout)
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("milter failed")
+					switch config.MilterOnError {
+					case milterOnErrorAccept:
+						return p.Process(e, task)
+					case milterOnErrorReject:
+						return NewResult(response.Canned.FailMilterRejected), err
+					default:
+						return NewResult(response.Canned.ErrorMilterTempFail), err
+					}
+				}
+				switch verdict.reply {
+				case milterReplyReject:
+					Log().WithField("queued_id", e.QueuedId).Info("message rejected by the milter")
+					return NewResult(response.Canned.FailMilterRejected), errMilterRejected
+				case milterReplyTempFail:
+					Log().WithField("queued_id", e.QueuedId).Info("message deferred by the milter")
+					return NewResult(response.Canned.ErrorMilterTempFail), errMilterTempFail
+				case milterReplyReplyCode:
+					Log().WithField("queued_id", e.QueuedId).Info("message refused by the milter: ", verdict.smtpReply)
+					if strings.HasPrefix(verdict.smtpReply, "4") {
+						return NewResult(verdict.smtpReply), errMilterTempFail
+					}
+					return NewResult(verdict.smtpReply), errMilterRejected
+				case milterReplyDiscard:
+					// accepted, but it goes no further
+					Log().WithField("queued_id", e.QueuedId).Info("message discarded by the milter")
+					return NewResult(response.Canned.SuccessMessageQueued + e.QueuedId), nil
+				}
+				if verdict.quarantine != "" {
+					e.Values[ValueMilterQuarantine] = verdict.quarantine
+				}
+				if len(verdict.mods) > 0 {
+					milterApply(e, verdict.mods)
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// milterCheck runs a milter session for e, and returns the verdict of the milter
+func milterCheck(e *mail.Envelope, config *MilterConfig, connectTimeout, timeout time.Duration) (*milterVerdict, error) {
+	network, address := "tcp", config.MilterAddress
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	} else {
+		address = strings.TrimPrefix(address, "tcp:")
+	}
+	conn, err := net.DialTimeout(network, address, connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &milterSession{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+	defer func() {
+		s.send(milterCmdQuit, nil)
+		conn.Close()
+	}()
+	protocol := uint32(config.MilterProtocol)
+	if protocol == 0 {
+		protocol = milterSupportedProtocol
+	}
+	actions := uint32(config.MilterActions)
+	if actions == 0 {
+		actions = milterSupportedActions
+	}
+	if err := s.negotiate(actions, protocol); err != nil {
+		return nil, err
+	}
+	return s.run(e)
+}
+
+// send writes a packet to the milter
+func (s *milterSession) send(cmd byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = cmd
+	packet = append(packet, data...)
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	_, err := s.conn.Write(packet)
+	return err
+}
+
+// read reads a packet from the milter
+func (s *milterSession) read() (byte, []byte, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	var size uint32
+	if err := binary.Read(s.r, binary.BigEndian, &size); err != nil {
+		return 0, nil, err
+	}
+	if size == 0 || size > milterMaxPacket {
+		return 0, nil, fmt.Errorf("invalid milter packet size: %d", size)
+	}
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(s.r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// negotiate agrees on the version, actions and protocol with the milter
+func (s *milterSession) negotiate(actions, protocol uint32) error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, milterVersion)
+	binary.BigEndian.PutUint32(data[4:], actions)
+	binary.BigEndian.PutUint32(data[8:], protocol)
+	if err := s.send(milterCmdOptNeg, data); err != nil {
+		return err
+	}
+	cmd, data, err := s.read()
+	if err != nil {
+		return err
+	}
+	if cmd != milterCmdOptNeg || len(data) < 12 {
+		return fmt.Errorf("unexpected milter negotiation reply: %q", cmd)
+	}
+	if version := binary.BigEndian.Uint32(data); version < 2 {
+		return fmt.Errorf("unsupported milter version: %d", version)
+	}
+	// the milter may not ask for more than what was offered
+	s.actions = binary.BigEndian.Uint32(data[4:]) & actions
+	s.protocol = binary.BigEndian.Uint32(data[8:]) & protocol
+	return nil
+}
+
+// step sends a command, and reads the reply unless the milter said it does not reply to it.
+// Returns milterReplyContinue when there was no reply
+func (s *milterSession) step(cmd byte, data []byte, noReply uint32) (byte, []byte, error) {
+	if err := s.send(cmd, data); err != nil {
+		return 0, nil, err
+	}
+	if s.protocol&noReply != 0 {
+		return milterReplyContinue, nil, nil
+	}
+	for {
+		reply, data, err := s.read()
+		if err != nil {
+			return 0, nil, err
+		}
+		if reply == milterReplyProgress {
+			// still working on it
+			continue
+		}
+		return reply, data, nil
+	}
+}
+
+// macros sends macros, the milter doesn't reply to them
+func (s *milterSession) macros(cmd byte, nameValues ...string) error {
+	return s.send(milterCmdMacro, append([]byte{cmd}, milterStrings(nameValues...)...))
+}
+
+// run goes through the steps of the SMTP transaction, until the milter gives a verdict
+func (s *milterSession) run(e *mail.Envelope) (*milterVerdict, error) {
+	type step struct {
+		cmd     byte
+		data    []byte
+		skip    uint32
+		noReply uint32
+	}
+	hostname := "[" + e.RemoteIP + "]"
+	if ptr, ok := e.Values[ValuePTRName].(string); ok && ptr != "" {
+		hostname = ptr
+	}
+	connect := milterStrings(hostname)
+	if ip := net.ParseIP(e.RemoteIP); ip == nil {
+		connect = append(connect, 'U')
+	} else {
+		family := byte('4')
+		if ip.To4() == nil {
+			family = '6'
+		}
+		// the port is not known
+		connect = append(connect, family, 0, 0)
+		connect = append(connect, milterStrings(e.RemoteIP)...)
+	}
+	steps := []step{
+		{milterCmdConnect, connect, milterNoConnect, milterNRConnect},
+		{milterCmdHelo, milterStrings(e.Helo), milterNoHelo, milterNRHelo},
+		{milterCmdMail, milterStrings("<" + milterAddress(&e.MailFrom) + ">"), milterNoMail, milterNRMail},
+	}
+	for i := range e.RcptTo {
+		steps = append(steps, step{milterCmdRcpt, milterStrings("<" + milterAddress(&e.RcptTo[i]) + ">"), milterNoRcpt, milterNRRcpt})
+	}
+	steps = append(steps, step{milterCmdData, nil, milterNoData, milterNRData})
+	data := e.Data.Bytes()
+	headers, body := milterParseHeaders(data)
+	for _, h := range headers {
+		value := h.value
+		if s.protocol&milterHeaderLead == 0 {
+			value = strings.TrimLeft(value, " \t")
+		}
+		steps = append(steps, step{milterCmdHeader, milterStrings(h.name, value), milterNoHeaders, milterNRHeader})
+	}
+	steps = append(steps, step{milterCmdEOH, nil, milterNoEOH, milterNREOH})
+	// the body is sent with CRLF line endings
+	body = bytes.Replace(bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+	for len(body) > 0 {
+		n := len(body)
+		if n > milterChunkSize {
+			n = milterChunkSize
+		}
+		steps = append(steps, step{milterCmdBody, body[:n], milterNoBody, milterNRBody})
+		body = body[n:]
+	}
+
+	for _, st := range steps {
+		if s.protocol&st.skip != 0 {
+			continue
+		}
+		var err error
+		switch st.cmd {
+		case milterCmdConnect:
+			err = s.macros(st.cmd, "{daemon_name}", "guerrilla", "{client_addr}", e.RemoteIP)
+		case milterCmdMail:
+			nameValues := []string{"i", e.QueuedId, "{mail_addr}", milterAddress(&e.MailFrom)}
+			if login, ok := e.Values[ValueAuthLogin].(string); ok && login != "" {
+				nameValues = append(nameValues, "{auth_authen}", login)
+			}
+			err = s.macros(st.cmd, nameValues...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		reply, data, err := s.step(st.cmd, st.data, st.noReply)
+		if err != nil {
+			return nil, err
+		}
+		switch reply {
+		case milterReplyContinue:
+		case milterReplySkip:
+			if st.cmd != milterCmdBody {
+				return nil, fmt.Errorf("unexpected milter skip reply to %q", st.cmd)
+			}
+			// the rest of the body is not wanted
+			return s.endOfBody()
+		case milterReplyAccept, milterReplyReject, milterReplyTempFail, milterReplyDiscard, milterReplyReplyCode:
+			return milterFinal(reply, data), nil
+		default:
+			return nil, fmt.Errorf("unexpected milter reply %q to %q", reply, st.cmd)
+		}
+	}
+	return s.endOfBody()
+}
+
+// endOfBody sends the end of the body, and reads the modifications until the verdict
+func (s *milterSession) endOfBody() (*milterVerdict, error) {
+	if err := s.send(milterCmdEOB, nil); err != nil {
+		return nil, err
+	}
+	var (
+		mods       []milterMod
+		quarantine string
+	)
+	for {
+		reply, data, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+		switch reply {
+		case milterReplyProgress:
+		case milterReplyAddHeader, milterReplyInsHeader, milterReplyChgHeader:
+			if s.actions&milterActionChgHeaders == 0 && reply == milterReplyChgHeader ||
+				s.actions&milterActionAddHeaders == 0 && reply != milterReplyChgHeader {
+				Log().Warnf("milter modified the headers without permission, ignored: %q", reply)
+				continue
+			}
+			mod := milterMod{action: reply}
+			if reply != milterReplyAddHeader {
+				if len(data) < 4 {
+					return nil, errors.New("invalid milter header modification")
+				}
+				mod.index = binary.BigEndian.Uint32(data)
+				data = data[4:]
+			}
+			fields := bytes.SplitN(data, []byte{0}, 3)
+			if len(fields) < 2 || len(fields[0]) == 0 {
+				return nil, errors.New("invalid milter header modification")
+			}
+			mod.header = milterHeader{name: string(fields[0]), value: string(fields[1])}
+			if s.protocol&milterHeaderLead == 0 && mod.header.value != "" {
+				mod.header.value = " " + mod.header.value
+			}
+			mods = append(mods, mod)
+		case milterReplyQuarantine:
+			if s.actions&milterActionQuarantine != 0 {
+				quarantine = strings.TrimRight(string(data), "\x00")
+				if quarantine == "" {
+					quarantine = "quarantined by the milter"
+				}
+			}
+		case milterReplyAccept, milterReplyContinue, milterReplyReject, milterReplyTempFail,
+			milterReplyDiscard, milterReplyReplyCode:
+			verdict := milterFinal(reply, data)
+			verdict.mods = mods
+			verdict.quarantine = quarantine
+			return verdict, nil
+		default:
+			// eg. a change of the recipients or of the body, which were not negotiated
+			Log().Warnf("unsupported milter modification, ignored: %q", reply)
+		}
+	}
+}
+
+// milterFinal returns the verdict for a final reply
+func milterFinal(reply byte, data []byte) *milterVerdict {
+	verdict := &milterVerdict{reply: reply}
+	if reply == milterReplyReplyCode {
+		verdict.smtpReply = strings.TrimRight(string(data), "\x00")
+		if code := resultCode(NewResult(verdict.smtpReply)); code < 400 || code >= 600 {
+			// not a refusal, treat it as a reject
+			verdict.reply = milterReplyReject
+		}
+	}
+	return verdict
+}
+
+// milterParseHeaders splits the message in its headers and body
+func milterParseHeaders(data []byte) ([]milterHeader, []byte) {
+	end := headerEnd(data)
+	if end == -1 {
+		// no body
+		end = len(data)
+	}
+	var headers []milterHeader
+	eachLine(data[:end], func(line []byte) {
+		text := strings.TrimRight(string(line), "\r\n")
+		if text == "" {
+			return
+		}
+		if (text[0] == ' ' || text[0] == '\t') && len(headers) > 0 {
+			// folded
+			last := &headers[len(headers)-1]
+			last.value += "\n" + text
+			return
+		}
+		if i := strings.IndexByte(text, ':'); i > 0 {
+			headers = append(headers, milterHeader{name: text[:i], value: text[i+1:]})
+		}
+	})
+	return headers, data[end:]
+}
+
+// milterApply applies the header modifications to e.Data
+func milterApply(e *mail.Envelope, mods []milterMod) {
+	data := e.Data.Bytes()
+	headers, body := milterParseHeaders(data)
+	lineEnd := "\n"
+	if bytes.Contains(data[:len(data)-len(body)], []byte("\r\n")) {
+		lineEnd = "\r\n"
+	}
+	for _, mod := range mods {
+		switch mod.action {
+		case milterReplyAddHeader:
+			headers = append(headers, mod.header)
+		case milterReplyInsHeader:
+			i := int(mod.index)
+			if i > len(headers) {
+				i = len(headers)
+			}
+			headers = append(headers, milterHeader{})
+			copy(headers[i+1:], headers[i:])
+			headers[i] = mod.header
+		case milterReplyChgHeader:
+			// the index counts the headers with that name, from 1
+			found := false
+			n := uint32(0)
+			for i := range headers {
+				if !strings.EqualFold(headers[i].name, mod.header.name) {
+					continue
+				}
+				if n++; n == mod.index || mod.index == 0 {
+					if mod.header.value == "" {
+						headers = append(headers[:i], headers[i+1:]...)
+					} else {
+						headers[i].value = mod.header.value
+					}
+					found = true
+					break
+				}
+			}
+			if !found && mod.header.value != "" {
+				headers = append(headers, mod.header)
+			}
+		}
+	}
+	var b bytes.Buffer
+	for _, h := range headers {
+		value := strings.Replace(strings.Replace(h.value, "\r\n", "\n", -1), "\n", lineEnd, -1)
+		b.WriteString(h.name + ":" + value + lineEnd)
+	}
+	// the blank line that ends the headers
+	b.WriteString(lineEnd)
+	b.Write(body)
+	e.Data.Reset()
+	e.Data.Write(b.Bytes())
+	if e.Header != nil {
+		// parsed by the HeadersParser processor, parse it again
+		e.Header = nil
+		if err := e.ParseHeaders(); err != nil {
+			Log().WithError(err).WithField("queued_id", e.QueuedId).Warn("could not parse the headers changed by the milter")
+		}
+	}
+}
+
+// milterAddress returns the address for the MAIL & RCPT commands, "" for the null sender
+func milterAddress(a *mail.Address) string {
+	if a.IsEmpty() {
+		return ""
+	}
+	return a.String()
+}
+
+// milterStrings returns the strings, each terminated by a NUL
+func milterStrings(ss ...string) []byte {
+	var b []byte
+	for _, s := range ss {
+		b = append(b, s...)
+		b = append(b, 0)
+	}
+	return b
+}
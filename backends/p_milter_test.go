@@ -0,0 +1,259 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// stubMilter is a milter that replies with a continue to each step, unless replies
+// has another reply for the command. eob are the packets sent at the end of the body
+type stubMilter struct {
+	ln       net.Listener
+	protocol uint32
+	replies  map[byte][]byte
+	eob      [][]byte
+	sync.Mutex
+	// the commands received, and the headers
+	cmds    []byte
+	headers []string
+	body    string
+}
+
+func newStubMilter(t *testing.T) *stubMilter {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &stubMilter{ln: ln, replies: make(map[byte][]byte)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *stubMilter) close() {
+	m.ln.Close()
+}
+
+func (m *stubMilter) send(w io.Writer, packet []byte) {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(packet)))
+	w.Write(append(size, packet...))
+}
+
+func (m *stubMilter) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		packet := make([]byte, size)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return
+		}
+		cmd, data := packet[0], packet[1:]
+		m.Lock()
+		m.cmds = append(m.cmds, cmd)
+		switch cmd {
+		case milterCmdHeader:
+			m.headers = append(m.headers, strings.Replace(string(data), "\x00", "|", -1))
+		case milterCmdBody:
+			m.body += string(data)
+		}
+		reply, eob := m.replies[cmd], m.eob
+		m.Unlock()
+		switch cmd {
+		case milterCmdOptNeg:
+			neg := make([]byte, 12)
+			binary.BigEndian.PutUint32(neg, milterVersion)
+			binary.BigEndian.PutUint32(neg[4:], milterSupportedActions)
+			binary.BigEndian.PutUint32(neg[8:], m.protocol)
+			m.send(conn, append([]byte{milterCmdOptNeg}, neg...))
+		case milterCmdMacro:
+		case milterCmdQuit:
+			return
+		case milterCmdRcpt:
+			if reply == nil && m.protocol&milterNRRcpt != 0 {
+				// no reply wanted
+				continue
+			}
+			if reply == nil {
+				reply = []byte{milterReplyContinue}
+			}
+			m.send(conn, reply)
+		case milterCmdEOB:
+			for _, p := range eob {
+				m.send(conn, p)
+			}
+			if reply == nil {
+				reply = []byte{milterReplyAccept}
+			}
+			m.send(conn, reply)
+		default:
+			if reply == nil {
+				reply = []byte{milterReplyContinue}
+			}
+			m.send(conn, reply)
+		}
+	}
+}
+
+func newMilterEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.QueuedId = "q1"
+	e.Helo = "mx.example.com"
+	e.MailFrom, _ = mail.NewAddress("alice@example.com")
+	a, _ := mail.NewAddress("bob@example.org")
+	e.RcptTo = append(e.RcptTo, a)
+	e.Data.WriteString("Subject: hello\r\nX-Spam: yes\r\nTo: bob@example.org,\r\n carol@example.org\r\n\r\nthe body\n")
+	return e
+}
+
+func milterString(cmd byte, index uint32, ss ...string) []byte {
+	packet := []byte{cmd}
+	if cmd != milterReplyAddHeader {
+		i := make([]byte, 4)
+		binary.BigEndian.PutUint32(i, index)
+		packet = append(packet, i...)
+	}
+	return append(packet, milterStrings(ss...)...)
+}
+
+func TestMilterHeaders(t *testing.T) {
+	m := newStubMilter(t)
+	defer m.close()
+	m.eob = [][]byte{
+		milterString(milterReplyAddHeader, 0, "X-Milter", "checked"),
+		milterString(milterReplyChgHeader, 1, "Subject", "[ok] hello"),
+		milterString(milterReplyChgHeader, 1, "X-Spam", ""),
+		milterString(milterReplyInsHeader, 0, "X-First", "top"),
+		append([]byte{milterReplyQuarantine}, milterStrings("suspicious")...),
+	}
+	p := newTestProcessor(t, BackendConfig{"milter_address": m.ln.Addr().String()}, Milter)
+	e := newMilterEnvelope()
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	expect := "X-First: top\r\nSubject: [ok] hello\r\nTo: bob@example.org,\r\n carol@example.org\r\n" +
+		"X-Milter: checked\r\n\r\nthe body\n"
+	if e.Data.String() != expect {
+		t.Errorf("unexpected message:\n%q\nexpecting:\n%q", e.Data.String(), expect)
+	}
+	if e.Values[ValueMilterQuarantine] != "suspicious" {
+		t.Error("expecting the message to be quarantined, got:", e.Values[ValueMilterQuarantine])
+	}
+	m.Lock()
+	defer m.Unlock()
+	// the QUIT may not be there yet
+	if cmds := string(m.cmds); !strings.HasPrefix(cmds, "ODCHDMRTLLLNBE") {
+		t.Error("unexpected commands:", cmds)
+	}
+	if len(m.headers) != 3 || m.headers[0] != "Subject|hello|" || m.headers[2] != "To|bob@example.org,\n carol@example.org|" {
+		t.Error("unexpected headers:", m.headers)
+	}
+	if m.body != "the body\r\n" {
+		t.Errorf("unexpected body: %q", m.body)
+	}
+}
+
+func TestMilterProtocol(t *testing.T) {
+	m := newStubMilter(t)
+	defer m.close()
+	// no HELO, no headers, no reply to the recipients
+	m.protocol = milterNoHelo | milterNoHeaders | milterNRRcpt
+	p := newTestProcessor(t, BackendConfig{"milter_address": "tcp:" + m.ln.Addr().String()}, Milter)
+	if _, err := p.Process(newMilterEnvelope(), TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if cmds := string(m.cmds); !strings.HasPrefix(cmds, "ODCDMRTNBE") {
+		t.Error("unexpected commands:", cmds)
+	}
+}
+
+func TestMilterVerdicts(t *testing.T) {
+	tests := []struct {
+		cmd    byte
+		reply  []byte
+		code   int
+		passed bool
+	}{
+		{milterCmdEOB, []byte{milterReplyReject}, 550, false},
+		{milterCmdEOB, []byte{milterReplyTempFail}, 451, false},
+		{milterCmdRcpt, []byte{milterReplyReject}, 550, false},
+		{milterCmdMail, append([]byte{milterReplyReplyCode}, milterStrings("554 5.7.1 go away")...), 554, false},
+		{milterCmdConnect, []byte{milterReplyAccept}, 200, true},
+		{milterCmdEOB, []byte{milterReplyDiscard}, 250, false},
+	}
+	for _, test := range tests {
+		m := newStubMilter(t)
+		m.replies[test.cmd] = test.reply
+		passed := false
+		// the processor after the milter
+		next := func() Decorator {
+			return func(p Processor) Processor {
+				return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+					passed = true
+					return p.Process(e, task)
+				})
+			}
+		}
+		p := newTestProcessor(t, BackendConfig{"milter_address": m.ln.Addr().String()}, next, Milter)
+		result, err := p.Process(newMilterEnvelope(), TaskSaveMail)
+		if result.Code() != test.code {
+			t.Errorf("expecting %d for %q to %q, got: %s", test.code, test.reply[0], test.cmd, result)
+		}
+		if (err == nil) != (test.code < 300) {
+			t.Errorf("unexpected error for %q to %q: %v", test.reply[0], test.cmd, err)
+		}
+		if passed != test.passed {
+			t.Errorf("expecting the next processor to be called: %v, for %q to %q", test.passed, test.reply[0], test.cmd)
+		}
+		m.close()
+	}
+}
+
+func TestMilterOnError(t *testing.T) {
+	// nothing listens there
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	for onError, code := range map[string]int{"": 451, "tempfail": 451, "reject": 550, "accept": 200} {
+		p := newTestProcessor(t, BackendConfig{"milter_address": addr, "milter_on_error": onError}, Milter)
+		if result, _ := p.Process(newMilterEnvelope(), TaskSaveMail); result.Code() != code {
+			t.Errorf("expecting %d when milter_on_error is %q, got: %s", code, onError, result)
+		}
+	}
+}
+
+func TestMilterConfig(t *testing.T) {
+	for _, config := range []BackendConfig{
+		{},
+		{"milter_address": ""},
+		{"milter_address": "127.0.0.1:8891", "milter_protocol": 0x80000000},
+		{"milter_address": "127.0.0.1:8891", "milter_actions": 0x2},
+		{"milter_address": "127.0.0.1:8891", "milter_timeout": "soon"},
+		{"milter_address": "127.0.0.1:8891", "milter_connect_timeout": "soon"},
+		{"milter_address": "127.0.0.1:8891", "milter_on_error": "ignore"},
+	} {
+		if _, errs := initTestProcessor(config, Milter); errs == nil {
+			t.Error("expecting the config to fail:", config)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mongoTestDatabase keeps the documents & the GridFS files, and fails the inserts if fail is set
+type mongoTestDatabase struct {
+	uri      string
+	wc       *mongoWriteConcern
+	docs     map[string]*mongoDocument
+	files    map[string][]byte
+	ttl      time.Duration
+	ttlField string
+	fail     bool
+	closed   bool
+}
+
+func (m *mongoTestDatabase) Insert(ctx context.Context, collection string, doc *mongoDocument) error {
+	if m.fail {
+		return errors.New("server selection error: context deadline exceeded")
+	}
+	m.docs[collection+"/"+doc.ID] = doc
+	return nil
+}
+
+func (m *mongoTestDatabase) Upload(ctx context.Context, bucket, id, filename string, data []byte) error {
+	m.files[bucket+"/"+id] = data
+	return nil
+}
+
+func (m *mongoTestDatabase) Delete(ctx context.Context, bucket, id string) error {
+	delete(m.files, bucket+"/"+id)
+	return nil
+}
+
+func (m *mongoTestDatabase) EnsureTTLIndex(ctx context.Context, collection, field string, ttl time.Duration) error {
+	m.ttlField, m.ttl = collection+"."+field, ttl
+	return nil
+}
+
+func (m *mongoTestDatabase) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *mongoTestDatabase) Close() error {
+	m.closed = true
+	return nil
+}
+
+func newMongoDBProcessor(config BackendConfig, db *mongoTestDatabase) (Processor, []error) {
+	db.docs, db.files = make(map[string]*mongoDocument), make(map[string][]byte)
+	newMongoDatabase = func(uri, database string, wc *mongoWriteConcern, timeout time.Duration) (mongoDatabase, error) {
+		db.uri, db.wc = uri+"/"+database, wc
+		return db, nil
+	}
+	return initTestProcessor(config, MongoDB)
+}
+
+func TestMongoDB(t *testing.T) {
+	defer func(f func(string, string, *mongoWriteConcern, time.Duration) (mongoDatabase, error)) {
+		newMongoDatabase = f
+	}(newMongoDatabase)
+	db := &mongoTestDatabase{}
+	p, errs := newMongoDBProcessor(BackendConfig{
+		"mongodb_uri":                 "mongodb://localhost:27017",
+		"mongodb_collection":          "inbox",
+		"mongodb_write_concern":       "2",
+		"mongodb_journal":             true,
+		"mongodb_ttl":                 "720h",
+		"mongodb_gridfs_threshold_kb": 1,
+	}, db)
+	if errs != nil {
+		t.Fatal("mongodb did not initialize:", errs)
+	}
+	if db.uri != "mongodb://localhost:27017/mail" || db.wc.W != "2" || !db.wc.Journal ||
+		db.ttlField != "inbox.created_at" || db.ttl != time.Hour*720 {
+		t.Error("unexpected database:", db.uri, db.wc, db.ttlField, db.ttl)
+	}
+	for _, pinger := range Svc.takePingers() {
+		if err := pinger.Ping(); err != nil {
+			t.Error("expecting the database to be reachable, got:", err)
+		}
+	}
+
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\nX-Mailer.Version: 1\n\nhi\n", "bob@example.org")
+	e.Helo, e.TLS = "mx.example.com", true
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be saved, got:", err)
+	}
+	doc := db.docs["inbox/"+e.QueuedId]
+	if doc == nil {
+		t.Fatal("expecting the document, got:", db.docs)
+	}
+	if doc.MailFrom != "alice@example.com" || doc.RcptTo[0] != "bob@example.org" || doc.Subject != "hello" ||
+		doc.Helo != "mx.example.com" || !doc.TLS || string(doc.Body) != "Subject: hello\nX-Mailer.Version: 1\n\nhi\n" {
+		t.Error("unexpected document:", doc)
+	}
+	if v := doc.Headers["X-Mailer_version"]; len(v) != 1 || v[0] != "1" {
+		t.Error("expecting the dots to be replaced in the header names, got:", doc.Headers)
+	}
+
+	// a large message is saved in GridFS
+	e = newAccountingEnvelope("alice@example.com", "Subject: big\n\n"+strings.Repeat("x", 2048), "bob@example.org")
+	e.QueuedId += "2"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be saved, got:", err)
+	}
+	doc = db.docs["inbox/"+e.QueuedId]
+	if doc.Body != nil || doc.BodyFileID != e.QueuedId || len(db.files["fs/"+e.QueuedId]) != e.Len() {
+		t.Error("expecting the message in GridFS, got:", doc.BodyFileID, len(db.files))
+	}
+
+	// the insert failed, the GridFS file is removed
+	db.fail = true
+	e.QueuedId += "3"
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	if _, ok := db.files["fs/"+e.QueuedId]; ok {
+		t.Error("expecting the GridFS file to be removed")
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if !db.closed {
+		t.Error("expecting the database to be closed")
+	}
+}
+
+func TestMongoDBConfig(t *testing.T) {
+	defer func(f func(string, string, *mongoWriteConcern, time.Duration) (mongoDatabase, error)) {
+		newMongoDatabase = f
+	}(newMongoDatabase)
+	db := &mongoTestDatabase{}
+	if _, errs := newMongoDBProcessor(BackendConfig{"mongodb_uri": "mongodb+srv://cluster0.example.net"}, db); errs != nil {
+		t.Fatal("mongodb did not initialize:", errs)
+	}
+	if db.wc.W != "majority" || db.ttlField != "" {
+		t.Error("expecting the default write concern without a ttl index, got:", db.wc, db.ttlField)
+	}
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"mongodb_uri": "localhost:27017"}, "invalid mongodb_uri"},
+		{BackendConfig{"mongodb_uri": "mongodb://localhost", "mongodb_write_concern": "0"}, "invalid mongodb_write_concern"},
+		{BackendConfig{"mongodb_uri": "mongodb://localhost", "mongodb_ttl": "1ms"}, "at least 1s"},
+		{BackendConfig{"mongodb_uri": "mongodb://localhost", "mongodb_timeout": "soon"}, "invalid duration"},
+		{BackendConfig{"mongodb_uri": "mongodb://localhost", "mongodb_gridfs_threshold_kb": -1}, "cannot be negative"},
+	}
+	for _, test := range tests {
+		_, errs := newMongoDBProcessor(test.config, &mongoTestDatabase{})
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+	// without -tags mongodb
+	newMongoDatabase = nil
+	_, errs := initTestProcessor(BackendConfig{"mongodb_uri": "mongodb://localhost"}, MongoDB)
+	if errs == nil || !strings.Contains(errs[0].Error(), "-tags mongodb") {
+		t.Error("expecting the mongodb tag to be asked for, got:", errs)
+	}
+}
@@ -2,13 +2,16 @@ package backends
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	netmail "net/mail"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/flashmob/go-guerrilla/mail"
@@ -33,6 +36,10 @@ import (
 //               : mysql_host string - mysql host name, eg. 127.0.0.1
 //               : mysql_pass string - mysql password
 //               : mysql_user string - mysql username
+//               : mysql_conn_max_lifetime int - seconds a connection is reused for,
+//               : 0 (default) for ever
+//               : mysql_max_open_conns int - most open connections, 0 for no limit
+//               : mysql_max_idle_conns int - most idle connections, default 2
 //               : primary_mail_host string - primary host name
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
@@ -41,6 +48,8 @@ import (
 //               : e.Subject - generated by by ParseHeader() processor
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.QueuedId with the first item fromHashes[0]
+//               : If the connection is lost when saving, eg. the server restarted,
+//               : it reconnects & tries once more, then replies with a 451
 // ----------------------------------------------------------------------------------
 func init() {
 	processors["mysql"] = func() Decorator {
@@ -48,6 +57,9 @@ func init() {
 	}
 }
 
+// mysqlDriverName can be changed for testing
+var mysqlDriverName = "mysql"
+
 const procMySQLReadTimeout = time.Second * 10
 const procMySQLWriteTimeout = time.Second * 10
 
@@ -60,11 +72,20 @@ type MysqlProcessorConfig struct {
 	MysqlPass            string `json:"mysql_pass"`
 	MysqlUser            string `json:"mysql_user"`
 	PrimaryHost          string `json:"primary_mail_host"`
+	// MysqlConnMaxLifetime is how many seconds a connection may be reused for, 0 for ever
+	MysqlConnMaxLifetime int `json:"mysql_conn_max_lifetime,omitempty"`
+	// MysqlMaxOpenConns is the most open connections, 0 for no limit
+	MysqlMaxOpenConns int `json:"mysql_max_open_conns,omitempty"`
+	// MysqlMaxIdleConns is the most idle connections, 0 for the default of database/sql
+	MysqlMaxIdleConns int `json:"mysql_max_idle_conns,omitempty"`
 }
 
 type MysqlProcessor struct {
 	cache  stmtCache
 	config *MysqlProcessorConfig
+	// db is replaced when reconnecting, the cache with it
+	db *sql.DB
+	sync.Mutex
 }
 
 func (m *MysqlProcessor) connect(config *MysqlProcessorConfig) (*sql.DB, error) {
@@ -80,32 +101,83 @@ func (m *MysqlProcessor) connect(config *MysqlProcessorConfig) (*sql.DB, error)
 		WriteTimeout: procMySQLWriteTimeout,
 		Params:       map[string]string{"collation": "utf8_general_ci", "parseTime": "1"},
 	}
-	if db, err = sql.Open("mysql", conf.FormatDSN()); err != nil {
+	if db, err = sql.Open(mysqlDriverName, conf.FormatDSN()); err != nil {
 		Log().Error("cannot open mysql", err)
 		return nil, err
 	}
+	if config.MysqlConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(config.MysqlConnMaxLifetime) * time.Second)
+	}
+	if config.MysqlMaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MysqlMaxOpenConns)
+	}
+	if config.MysqlMaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MysqlMaxIdleConns)
+	}
 	// do we have permission to access the table?
-	_, err = db.Query("SELECT * FROM " + m.config.MysqlTable + " LIMIT 1")
+	rows, err := db.Query("SELECT * FROM " + m.config.MysqlTable + " LIMIT 1")
 	if err != nil {
 		//Log().Error("cannot select table", err)
+		db.Close()
 		return nil, err
 	}
+	rows.Close()
 	Log().Info("connected to mysql on tcp ", config.MysqlHost)
 	return db, err
 }
 
+// conn returns the database
+func (m *MysqlProcessor) conn() *sql.DB {
+	m.Lock()
+	defer m.Unlock()
+	return m.db
+}
+
+// reconnect replaces the database with a new connection, the cached statements of the old one
+// are dropped
+func (m *MysqlProcessor) reconnect() error {
+	m.Lock()
+	defer m.Unlock()
+	for i := range m.cache {
+		if m.cache[i] != nil {
+			m.cache[i].Close()
+			m.cache[i] = nil
+		}
+	}
+	if m.db != nil {
+		m.db.Close()
+	}
+	db, err := m.connect(m.config)
+	m.db = db
+	return err
+}
+
+// isConnError returns true if err is because the connection to the server is gone,
+// eg. it restarted
+func isConnError(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection refused")
+}
+
 // prepares the sql query with the number of rows that can be batched with it
-func (g *MysqlProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
+func (g *MysqlProcessor) prepareInsertQuery(rows int, db *sql.DB) (*sql.Stmt, error) {
 	if rows == 0 {
 		panic("rows argument cannot be 0")
 	}
+	g.Lock()
+	defer g.Unlock()
 	if g.cache[rows-1] != nil {
-		return g.cache[rows-1]
+		return g.cache[rows-1], nil
 	}
 	sqlstr := "INSERT INTO " + g.config.MysqlTable + " "
 	sqlstr += "(`nid`, `time_taken`, `datetime`, `guid`, `body`, `header`, `received_time`, `bounce`)"
 	sqlstr += " VALUES "
-	values := "(?, ?, ?, ?, ? , ?, ?, ?)"
+	values := "(?, ?, ?, ?, ? , ?, NOW(), ?)"
 	// add more rows
 	comma := ""
 	for i := 0; i < rows; i++ {
@@ -116,11 +188,12 @@ func (g *MysqlProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 	}
 	stmt, sqlErr := db.Prepare(sqlstr)
 	if sqlErr != nil {
-		Log().WithError(sqlErr).Panic("failed while db.Prepare(INSERT...)")
+		Log().WithError(sqlErr).Error("failed while db.Prepare(INSERT...)")
+		return nil, sqlErr
 	}
 	// cache it
 	g.cache[rows-1] = stmt
-	return stmt
+	return stmt, nil
 }
 
 func (g *MysqlProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]interface{}) (execErr error) {
@@ -138,7 +211,9 @@ func (g *MysqlProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *
 		}
 	}()
 	// prepare the query used to insert when rows reaches batchMax
-	insertStmt = g.prepareInsertQuery(c, db)
+	if insertStmt, execErr = g.prepareInsertQuery(c, db); execErr != nil {
+		return
+	}
 	_, execErr = insertStmt.Exec(*vals...)
 	if execErr != nil {
 		Log().WithError(execErr).Error("There was a problem the insert")
@@ -146,23 +221,27 @@ func (g *MysqlProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *
 	return
 }
 
-func insertPing(db *sql.DB, table string, nid, timeTaken int, dateTime time.Time, guid, body, header string, bounce bool) error {
-	sql := "INSERT INTO " + table
-	sql += " (`nid`, `time_taken`, `datetime`, `guid`, `body`, `header`, `received_time`, `bounce`)"
-	sql += " VALUES (?, ?, ?, ?, ? , ?, NOW(), ?)"
-
-	_, err := db.Exec(sql, nid, timeTaken, dateTime, guid, body, header, bounce)
-
-	if err != nil {
-		return err
+// insertPing inserts a row with the cached statement. If the connection is gone, it reconnects
+// and tries once more
+func (g *MysqlProcessor) insertPing(ctx context.Context, nid, timeTaken int, dateTime time.Time, guid, body, header string, bounce bool) error {
+	for attempt := 0; ; attempt++ {
+		stmt, err := g.prepareInsertQuery(1, g.conn())
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, nid, timeTaken, dateTime, guid, body, header, bounce)
+		}
+		if err == nil || attempt > 0 || ctx.Err() != nil || !isConnError(err) {
+			return err
+		}
+		Log().WithError(err).Warn("lost the mysql connection, reconnecting")
+		if err := g.reconnect(); err != nil {
+			return err
+		}
 	}
-
-	return nil
 }
 
-func updateLog(db *sql.DB, table string, seen int, guid string) error {
+func updateLog(ctx context.Context, db *sql.DB, table string, seen int, guid string) error {
 	sql := "UPDATE " + table + " SET seen=? WHERE guid=?"
-	_, err := db.Exec(sql, seen, guid)
+	_, err := db.ExecContext(ctx, sql, seen, guid)
 
 	if err != nil {
 		return err
@@ -198,7 +277,6 @@ func MySql() Decorator {
 
 	var config *MysqlProcessorConfig
 	var vals []interface{}
-	var db *sql.DB
 	m := &MysqlProcessor{}
 
 	// open the database connection (it will also check if we can select the table)
@@ -210,21 +288,33 @@ func MySql() Decorator {
 		}
 		config = bcfg.(*MysqlProcessorConfig)
 		m.config = config
-		db, err = m.connect(config)
+		db, err := m.connect(config)
 		if err != nil {
 			return err
 		}
+		m.Lock()
+		m.db = db
+		m.Unlock()
 		return nil
 	}))
 
 	// shutdown will close the database connection
 	Svc.AddShutdowner(ShutdownWith(func() error {
-		if db != nil {
+		if db := m.conn(); db != nil {
 			return db.Close()
 		}
 		return nil
 	}))
 
+	// the readiness check pings the database
+	Svc.AddPinger(PingWith(func() error {
+		db := m.conn()
+		if db == nil {
+			return errors.New("mysql is not connected")
+		}
+		return db.Ping()
+	}))
+
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
@@ -250,21 +340,29 @@ func MySql() Decorator {
 				header, body, err := parseHeaderAndBody(e.String())
 
 				if err != nil {
-					Log().WithError(err).Errorf("Could not parse header and body of e-mail with GUID: %s", guid)
+					Log().WithError(err).WithField("guid", guid).Error("Could not parse header and body of e-mail")
 					return p.Process(e, task)
 				}
 
-				err = db.QueryRow("SELECT mid, senttime, seen"+
+				// the queries are cancelled if the client goes away, or on shutdown
+				ctx := e.Context()
+				db := m.conn()
+				err = db.QueryRowContext(ctx, "SELECT mid, senttime, seen"+
 					" FROM "+m.config.MysqlGUIDLookupTable+
 					" WHERE guid=?", guid).Scan(&mid, &senttime, &seen)
 
 				if err == sql.ErrNoRows {
-					Log().Infof("GUID %s not found", guid)
+					Log().WithField("guid", guid).Info("GUID not found")
 					return p.Process(e, task)
 				}
 
+				if ctx.Err() != nil {
+					Log().WithError(ctx.Err()).WithField("guid", guid).Warn("GUID lookup cancelled")
+					return NewResult(response.Canned.FailBackendTransaction), ctx.Err()
+				}
+
 				if err != nil {
-					Log().WithError(err).Errorf("Failed to lookup GUID - %s", guid)
+					Log().WithError(err).WithField("guid", guid).Error("Failed to lookup GUID")
 					return p.Process(e, task)
 				}
 
@@ -272,18 +370,23 @@ func MySql() Decorator {
 					wasBounce := 0
 
 					// check "bounce" flag with the matching GUID in "pings"
-					err = db.QueryRow("SELECT bounce"+
+					err = db.QueryRowContext(ctx, "SELECT bounce"+
 						" FROM "+m.config.MysqlTable+
 						" WHERE guid=?", guid).Scan(&wasBounce)
 
 					// if nothing found then report this GUID as already seen
 					if err == sql.ErrNoRows {
-						Log().Infof("GUID %s is already seen", guid)
+						Log().WithField("guid", guid).Info("GUID is already seen")
 						return p.Process(e, task)
 					}
 
+					if ctx.Err() != nil {
+						Log().WithError(ctx.Err()).WithField("guid", guid).Warn("GUID lookup cancelled")
+						return NewResult(response.Canned.FailBackendTransaction), ctx.Err()
+					}
+
 					if err != nil {
-						Log().WithError(err).Errorf("Failed to lookup GUID %s in %s table", guid, m.config.MysqlTable)
+						Log().WithError(err).WithField("guid", guid).WithField("table", m.config.MysqlTable).Error("Failed to lookup GUID")
 						return p.Process(e, task)
 					}
 
@@ -293,20 +396,25 @@ func MySql() Decorator {
 						afterBounce = true
 					} else {
 						// otherwise report it as already seen
-						Log().Infof("GUID %s is already seen", guid)
+						Log().WithField("guid", guid).Info("GUID is already seen")
 						return p.Process(e, task)
 					}
 				}
 
 				delay := calculateDelay([]byte(e.String()))
-				err = updateLog(db, m.config.MysqlGUIDLookupTable, 1, guid)
+				err = updateLog(ctx, db, m.config.MysqlGUIDLookupTable, 1, guid)
+
+				if ctx.Err() != nil {
+					Log().WithError(ctx.Err()).WithField("guid", guid).Warn("update cancelled")
+					return NewResult(response.Canned.FailBackendTransaction), ctx.Err()
+				}
 
 				if err != nil {
-					Log().WithError(err).Errorf("Could not update %s table", m.config.MysqlGUIDLookupTable)
+					Log().WithError(err).WithField("table", m.config.MysqlGUIDLookupTable).Error("Could not update table")
 					return p.Process(e, task)
 				}
 
-				Log().Infof(`Updated "seen" flag for GUID %s`, guid)
+				Log().WithField("guid", guid).WithField("delay", delay).Info(`Updated "seen" flag`)
 
 				if len(e.Hashes) > 0 {
 					e.QueuedId = e.Hashes[0]
@@ -325,14 +433,17 @@ func MySql() Decorator {
 						body = ""
 					}
 
-					err := insertPing(db, m.config.MysqlTable, nid, timeTaken, datetime, guid, body, header, bounce)
+					err := m.insertPing(ctx, nid, timeTaken, datetime, guid, body, header, bounce)
 
-					if err != nil {
+					if err != nil && isConnError(err) {
+						Log().WithError(err).WithField("guid", guid).Error("Could not save email, mysql is not available")
+						return NewResult(response.Canned.ErrorBackendTransaction + "storage not available"), StorageNotAvailable
+					} else if err != nil {
 						return NewResult(fmt.Sprint("554 Error: could not save email")), StorageError
 					}
 
 					if afterBounce {
-						Log().Infof("Message with GUID %s arrived after bounce - stored as a regular one", guid)
+						Log().WithField("guid", guid).Info("Message arrived after bounce - stored as a regular one")
 					}
 				}
 
@@ -0,0 +1,266 @@
+package backends
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/go-sql-driver/mysql"
+)
+
+// blockingQueries gets the queries of the blocking driver, which block until they are cancelled
+var blockingQueries = make(chan string, 10)
+
+func init() {
+	sql.Register("blocking", blockingDriver{})
+}
+
+type blockingDriver struct{}
+
+func (blockingDriver) Open(name string) (driver.Conn, error) {
+	return blockingConn{}, nil
+}
+
+type blockingConn struct{}
+
+func (blockingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (blockingConn) Close() error { return nil }
+
+func (blockingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (blockingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasSuffix(query, "LIMIT 1") {
+		// the check when connecting
+		return emptyRows{}, nil
+	}
+	blockingQueries <- query
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	blockingQueries <- query
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return []string{} }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestMySqlCancel(t *testing.T) {
+	defer func(name string) {
+		mysqlDriverName = name
+	}(mysqlDriverName)
+	mysqlDriverName = "blocking"
+
+	p := newTestProcessor(t, BackendConfig{
+		"mysql_mail_table":        "pings",
+		"mysql_guid_lookup_table": "guids",
+		"mysql_bounce_address":    "bounce@example.com",
+		"mysql_db":                "test",
+		"mysql_host":              "127.0.0.1:3306",
+		"mysql_pass":              "",
+		"mysql_user":              "test",
+		"primary_mail_host":       "example.com",
+	}, MySql)
+	defer Svc.shutdown()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	rcpt, _ := mail.NewAddress("test@example.com")
+	e.RcptTo = append(e.RcptTo, rcpt)
+	e.Subject = "guid: abc123"
+	e.Data.WriteString("Subject: guid: abc123\n\nhello\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	e.SetContext(ctx)
+
+	type result struct {
+		res Result
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := p.Process(e, TaskSaveMail)
+		done <- result{res, err}
+	}()
+	select {
+	case query := <-blockingQueries:
+		if !strings.Contains(query, "FROM guids") {
+			t.Error("expecting the GUID lookup, got:", query)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("the query did not start")
+	}
+	// the client went away
+	cancel()
+	select {
+	case r := <-done:
+		if r.err != context.Canceled || r.res.Code() < 400 {
+			t.Error("expecting the save to be cancelled, got:", r.res, r.err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("the query was not aborted")
+	}
+}
+
+// the flaky driver loses the connection on the next flakyFailures inserts
+var (
+	flakyFailures int
+	flakyOpens    int
+	flakyPrepares int
+	flakyInserts  int
+)
+
+func init() {
+	sql.Register("flaky", flakyDriver{})
+}
+
+type flakyDriver struct{}
+
+func (flakyDriver) Open(name string) (driver.Conn, error) {
+	flakyOpens++
+	return &flakyConn{}, nil
+}
+
+type flakyConn struct {
+	lost bool
+}
+
+func (c *flakyConn) Prepare(query string) (driver.Stmt, error) {
+	if c.lost {
+		return nil, driver.ErrBadConn
+	}
+	flakyPrepares++
+	return &flakyStmt{conn: c}, nil
+}
+
+func (*flakyConn) Close() error { return nil }
+
+func (*flakyConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *flakyConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasSuffix(query, "LIMIT 1") {
+		// the check when connecting
+		return emptyRows{}, nil
+	}
+	// the GUID lookup
+	return &flakyRows{values: []driver.Value{int64(1), time.Now(), int64(0)}}, nil
+}
+
+func (c *flakyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	// the seen flag
+	return driver.RowsAffected(1), nil
+}
+
+type flakyStmt struct {
+	conn *flakyConn
+}
+
+func (*flakyStmt) Close() error  { return nil }
+func (*flakyStmt) NumInput() int { return -1 }
+
+func (s *flakyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.conn.lost {
+		return nil, driver.ErrBadConn
+	}
+	if flakyFailures > 0 {
+		flakyFailures--
+		// the server went away, database/sql doesn't retry this
+		s.conn.lost = true
+		return nil, mysql.ErrInvalidConn
+	}
+	flakyInserts++
+	return driver.RowsAffected(1), nil
+}
+
+func (*flakyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+type flakyRows struct {
+	values []driver.Value
+}
+
+func (*flakyRows) Columns() []string { return []string{"mid", "senttime", "seen"} }
+func (*flakyRows) Close() error      { return nil }
+func (r *flakyRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
+
+func TestMySqlReconnect(t *testing.T) {
+	defer func(name string) {
+		mysqlDriverName = name
+	}(mysqlDriverName)
+	mysqlDriverName = "flaky"
+	flakyFailures, flakyOpens, flakyPrepares, flakyInserts = 0, 0, 0, 0
+
+	p := newTestProcessor(t, BackendConfig{
+		"mysql_mail_table":        "pings",
+		"mysql_guid_lookup_table": "guids",
+		"mysql_bounce_address":    "bounce@example.com",
+		"mysql_db":                "test",
+		"mysql_host":              "127.0.0.1:3306",
+		"mysql_pass":              "",
+		"mysql_user":              "test",
+		"primary_mail_host":       "example.com",
+		"mysql_conn_max_lifetime": 60,
+		"mysql_max_open_conns":    1,
+	}, MySql)
+	defer Svc.shutdown()
+
+	save := func() (Result, error) {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		rcpt, _ := mail.NewAddress("test@example.com")
+		e.RcptTo = append(e.RcptTo, rcpt)
+		e.Subject = "guid: abc123"
+		e.Data.WriteString("Subject: guid: abc123\n\nhello\n")
+		return p.Process(e, TaskSaveMail)
+	}
+	if _, err := save(); err != nil || flakyInserts != 1 || flakyPrepares != 1 {
+		t.Fatal("expecting the message to be saved, got:", err, flakyInserts, flakyPrepares)
+	}
+	// the statement is cached
+	save()
+	if flakyPrepares != 1 {
+		t.Error("expecting the statement to be prepared once, got:", flakyPrepares)
+	}
+
+	// the connection is lost once, the insert is tried again with a new connection
+	flakyFailures = 1
+	opens := flakyOpens
+	if res, err := save(); err != nil || res.Code() >= 300 {
+		t.Error("expecting the message to be saved after reconnecting, got:", res, err)
+	}
+	if flakyOpens != opens+1 || flakyPrepares != 2 || flakyInserts != 3 {
+		t.Error("expecting a new connection & statement, got:", flakyOpens-opens, flakyPrepares, flakyInserts)
+	}
+
+	// the connection keeps being lost
+	flakyFailures = 2
+	if res, err := save(); err == nil || res.Code() != 451 {
+		t.Error("expecting a tempfail, got:", res, err)
+	}
+	if flakyInserts != 3 {
+		t.Error("expecting no insert, got:", flakyInserts)
+	}
+}
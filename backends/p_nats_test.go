@@ -0,0 +1,226 @@
+package backends
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// natsTestServer is a NATS server with a JetStream stream bound to "mail.>", except
+// "mail.example.net". It keeps the messages that it stored
+type natsTestServer struct {
+	ln       net.Listener
+	messages []natsTestMessage
+	connects []natsConnectOptions
+	// drop closes the connection instead of acking the next message
+	drop bool
+	sync.Mutex
+}
+
+type natsTestMessage struct {
+	subject string
+	headers string
+	payload string
+}
+
+func newNATSTestServer(t *testing.T) *natsTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &natsTestServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *natsTestServer) url() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+func (s *natsTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":true,\"max_payload\":4096}\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "CONNECT":
+			var options natsConnectOptions
+			json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &options)
+			s.Lock()
+			s.connects = append(s.connects, options)
+			s.Unlock()
+			if options.User != "" && options.Pass != "secret" {
+				io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "HPUB":
+			hdrSize, _ := strconv.Atoi(args[3])
+			size, _ := strconv.Atoi(args[4])
+			data := make([]byte, size+2)
+			io.ReadFull(r, data)
+			subject, reply := args[1], args[2]
+			s.Lock()
+			if s.drop {
+				s.drop = false
+				s.Unlock()
+				return
+			}
+			if !strings.HasPrefix(subject, "mail.") || subject == "mail.example.net" {
+				s.Unlock()
+				fmt.Fprintf(conn, "HMSG %s 1 16 16\r\nNATS/1.0 503\r\n\r\n\r\n", reply)
+				continue
+			}
+			duplicate := false
+			for _, m := range s.messages {
+				if m.headers == string(data[:hdrSize]) {
+					duplicate = true
+				}
+			}
+			if !duplicate {
+				s.messages = append(s.messages, natsTestMessage{subject, string(data[:hdrSize]), string(data[hdrSize:size])})
+			}
+			ack := fmt.Sprintf(`{"stream":"MAIL","seq":%d,"duplicate":%v}`, len(s.messages), duplicate)
+			s.Unlock()
+			// the server may ping before the ack
+			fmt.Fprintf(conn, "PING\r\nMSG %s 1 %d\r\n%s\r\n", reply, len(ack), ack)
+		}
+	}
+}
+
+func TestNATS(t *testing.T) {
+	s := newNATSTestServer(t)
+	defer s.ln.Close()
+	p := newTestProcessor(t, BackendConfig{
+		"nats_url":     "nats://mail:secret@" + s.ln.Addr().String(),
+		"nats_subject": "mail.{rcpt_domain}",
+	}, NATS)
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n",
+		"bob@Example.org", "carol@example.net", "dave@example.org")
+	e.DeliveryHeader = "Received: from mx.example.com\n"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be published to example.org, got:", err)
+	}
+	s.Lock()
+	if len(s.connects) != 1 || s.connects[0].User != "mail" || !s.connects[0].Headers || !s.connects[0].NoResponders {
+		t.Error("unexpected CONNECT:", s.connects)
+	}
+	if len(s.messages) != 1 || s.messages[0].subject != "mail.example.org" {
+		t.Fatal("expecting a message to mail.example.org, got:", s.messages)
+	}
+	m := s.messages[0]
+	s.Unlock()
+	if !strings.Contains(m.headers, "Nats-Msg-Id: "+e.QueuedId+".mail.example.org\r\n") ||
+		!strings.Contains(m.headers, "Rcpt-To: bob@Example.org,dave@example.org\r\n") {
+		t.Error("unexpected headers:", m.headers)
+	}
+	var record messageRecord
+	if err := json.Unmarshal([]byte(m.payload), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.QueuedId != e.QueuedId || len(record.To) != 2 ||
+		string(record.Body) != "Received: from mx.example.com\nSubject: hello\n\nhi\n" {
+		t.Error("unexpected payload:", m.payload)
+	}
+	// no stream for example.net
+	results := envelopeRcptResults(e, e.RcptTo, BackendResultOK)
+	if len(results) != 3 || resultCode(results[0]) != 200 || resultCode(results[1]) != 451 || resultCode(results[2]) != 200 {
+		t.Error("expecting carol to be failed with a 451, got:", results)
+	}
+
+	// the connection is lost before the ack, it is dialed again & the message published once more
+	s.Lock()
+	s.drop = true
+	s.Unlock()
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be published after reconnecting, got:", err)
+	}
+	s.Lock()
+	if len(s.connects) != 2 || len(s.messages) != 2 {
+		t.Error("expecting the server to be dialed again, got:", s.connects, s.messages)
+	}
+	s.Unlock()
+
+	// too large for the server
+	e = newAccountingEnvelope("alice@example.com", "Subject: big\n\n"+strings.Repeat("x", 8192), "bob@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if err == nil || resultCode(result) != 554 {
+		t.Error("expecting the message to be rejected, got:", result, err)
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNATSUnavailable(t *testing.T) {
+	s := newNATSTestServer(t)
+	s.ln.Close()
+	// the first server is down, the second has no stream for the subject
+	s2 := newNATSTestServer(t)
+	defer s2.ln.Close()
+	p := newTestProcessor(t, BackendConfig{"nats_url": s.url() + "," + s2.url(), "nats_subject": "inbound.{rcpt_domain}"}, NATS)
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 || err.Error() != errNATSNoResponders.Error() {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	s2.ln.Close()
+	Svc.shutdown()
+
+	// all servers are down
+	p = newTestProcessor(t, BackendConfig{"nats_url": s.url(), "nats_format": "raw"}, NATS)
+	result, err = p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	// an invalid subject
+	p = newTestProcessor(t, BackendConfig{"nats_url": s.url(), "nats_subject": "mail.{rcpt_user}"}, NATS)
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob*@example.org")
+	result, err = p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 || !strings.Contains(err.Error(), "invalid nats subject") {
+		t.Error("expecting the subject to be invalid, got:", result, err)
+	}
+}
+
+func TestNATSConfig(t *testing.T) {
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"nats_url": ""}, "nats_url cannot be empty"},
+		{BackendConfig{"nats_url": "http://localhost"}, "invalid nats_url"},
+		{BackendConfig{"nats_url": "nats://localhost", "nats_format": "xml"}, "invalid nats_format"},
+		{BackendConfig{"nats_url": "nats://localhost", "nats_timeout": "soon"}, "invalid duration"},
+		{BackendConfig{"nats_url": "tls://localhost", "nats_tls_ca_file": "/nonexistent/ca.pem"}, "no such file"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, NATS)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
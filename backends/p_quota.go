@@ -0,0 +1,310 @@
+package backends
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// defaults of the table & its columns, if not present in config
+	quotaTable         = "quotas"
+	quotaAddressColumn = "address"
+	quotaUsedColumn    = "used_bytes"
+	quotaLimitColumn   = "limit_bytes"
+)
+
+// the statements of the quota processor, by their index in its stmtCache
+const (
+	quotaStmtSelect = iota
+	quotaStmtLock
+	quotaStmtUpdate
+	quotaStmtInsert
+)
+
+// quotaNameRegex is what a table or column name may be, they can't be given as query parameters
+var quotaNameRegex = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+type QuotaConfig struct {
+	// QuotaMySQLDSN is the data source name of the store, eg. "user:pass@tcp(127.0.0.1:3306)/mail"
+	QuotaMySQLDSN string `json:"quota_mysql_dsn"`
+	// QuotaTable has a row for each mailbox, with its address, usage & limit
+	QuotaTable string `json:"quota_table,omitempty"`
+	// QuotaAddressColumn has the address of the mailbox, in lower case
+	QuotaAddressColumn string `json:"quota_address_column,omitempty"`
+	// QuotaUsedColumn has the bytes stored in the mailbox
+	QuotaUsedColumn string `json:"quota_used_column,omitempty"`
+	// QuotaLimitColumn has the most bytes the mailbox can store, NULL for the default limit
+	QuotaLimitColumn string `json:"quota_limit_column,omitempty"`
+	// QuotaDefaultLimit is the limit of the mailboxes that are not in the table, or have no limit
+	// set, in bytes. 0 means that they are not limited
+	QuotaDefaultLimit int `json:"quota_default_limit,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: quota
+// ----------------------------------------------------------------------------------
+// Description   : Rejects the recipients whose mailbox is full. During TaskValidateRcpt
+//               : the last recipient is rejected with a 552 if its usage reached its
+//               : limit. During TaskSaveMail the size of the message is added to the
+//               : usage of each recipient, in a transaction that locks their rows, so
+//               : that messages saved at the same time can't go over the limit. A
+//               : recipient that the message doesn't fit in anymore is failed with
+//               : SetRcptResult, the message is rejected if it fits in none of them
+// ----------------------------------------------------------------------------------
+// Config Options: quota_mysql_dsn string - data source name of the MySQL store
+//               : quota_table string - the table, default "quotas"
+//               : quota_address_column string - default "address"
+//               : quota_used_column string - usage in bytes, default "used_bytes"
+//               : quota_limit_column string - limit in bytes, default "limit_bytes",
+//               : a NULL limit is the default limit, 0 is not limited
+//               : quota_default_limit int - the limit of the mailboxes that are not
+//               : in the table, in bytes, 0 (default) for not limited
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo
+//               : e.Data & e.DeliveryHeader, for the size of the message
+// ----------------------------------------------------------------------------------
+// Output        : the usage of the recipients is increased, a row is added for the
+//               : recipients that are not in the table
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["quota"] = func() Decorator {
+		return Quota()
+	}
+}
+
+// quotaStore keeps the usage & limits of the mailboxes in a MySQL table
+type quotaStore struct {
+	db     *sql.DB
+	config *QuotaConfig
+	// cache prepared queries, by the quotaStmt* index
+	cache stmtCache
+	sync.Mutex
+}
+
+// prepare returns the statement i, prepared the first time it is used
+func (q *quotaStore) prepare(i int) (*sql.Stmt, error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.cache[i] != nil {
+		return q.cache[i], nil
+	}
+	c := q.config
+	query := "SELECT `" + c.QuotaUsedColumn + "`, `" + c.QuotaLimitColumn + "` FROM " + c.QuotaTable +
+		" WHERE `" + c.QuotaAddressColumn + "` = ?"
+	switch i {
+	case quotaStmtLock:
+		query += " FOR UPDATE"
+	case quotaStmtUpdate:
+		query = "UPDATE " + c.QuotaTable + " SET `" + c.QuotaUsedColumn + "` = `" + c.QuotaUsedColumn + "` + ?" +
+			" WHERE `" + c.QuotaAddressColumn + "` = ?"
+	case quotaStmtInsert:
+		query = "INSERT INTO " + c.QuotaTable + " (`" + c.QuotaAddressColumn + "`, `" + c.QuotaUsedColumn + "`) VALUES (?, ?)"
+	}
+	stmt, err := q.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	// cache it
+	q.cache[i] = stmt
+	return stmt, nil
+}
+
+// lookup returns the usage & the limit of the mailbox addr, using the select statement i.
+// The limit is 0 if it is not limited, found is false if there is no row for it
+func (q *quotaStore) lookup(ctx context.Context, tx *sql.Tx, i int, addr string) (used, limit int64, found bool, err error) {
+	stmt, err := q.prepare(i)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if tx != nil {
+		stmt = tx.StmtContext(ctx, stmt)
+	}
+	var nullLimit sql.NullInt64
+	err = stmt.QueryRowContext(ctx, addr).Scan(&used, &nullLimit)
+	if err == sql.ErrNoRows {
+		return 0, int64(q.config.QuotaDefaultLimit), false, nil
+	} else if err != nil {
+		return 0, 0, false, err
+	}
+	limit = int64(q.config.QuotaDefaultLimit)
+	if nullLimit.Valid {
+		limit = nullLimit.Int64
+	}
+	return used, limit, true, nil
+}
+
+// full returns true if the mailbox addr reached its limit
+func (q *quotaStore) full(ctx context.Context, addr string) (bool, error) {
+	used, limit, _, err := q.lookup(ctx, nil, quotaStmtSelect, addr)
+	if err != nil {
+		return false, err
+	}
+	return limit > 0 && used >= limit, nil
+}
+
+// add adds size to the usage of each of rcpts, in a transaction. Returns the recipients
+// that the message doesn't fit in, their usage is left as it is
+func (q *quotaStore) add(ctx context.Context, rcpts []mail.Address, size int64) (full []mail.Address, err error) {
+	update, err := q.prepare(quotaStmtUpdate)
+	if err != nil {
+		return nil, err
+	}
+	insert, err := q.prepare(quotaStmtInsert)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(rcpts))
+	for _, rcpt := range rcpts {
+		addr := strings.ToLower(rcpt.String())
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		// locks the row until the commit
+		used, limit, found, err := q.lookup(ctx, tx, quotaStmtLock, addr)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if limit > 0 && used+size > limit {
+			full = append(full, rcpt)
+			continue
+		}
+		if found {
+			_, err = tx.StmtContext(ctx, update).ExecContext(ctx, size, addr)
+		} else {
+			_, err = tx.StmtContext(ctx, insert).ExecContext(ctx, addr, size)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return full, tx.Commit()
+}
+
+// loadConfig sets the defaults of config, and checks it
+func (c *QuotaConfig) loadConfig() error {
+	if c.QuotaMySQLDSN == "" {
+		return errors.New("quota_mysql_dsn is required")
+	}
+	for _, name := range []*string{&c.QuotaTable, &c.QuotaAddressColumn, &c.QuotaUsedColumn, &c.QuotaLimitColumn} {
+		if *name == "" {
+			continue
+		}
+		if !quotaNameRegex.MatchString(*name) {
+			return fmt.Errorf("invalid quota table or column name: %s", *name)
+		}
+	}
+	if c.QuotaTable == "" {
+		c.QuotaTable = quotaTable
+	}
+	if c.QuotaAddressColumn == "" {
+		c.QuotaAddressColumn = quotaAddressColumn
+	}
+	if c.QuotaUsedColumn == "" {
+		c.QuotaUsedColumn = quotaUsedColumn
+	}
+	if c.QuotaLimitColumn == "" {
+		c.QuotaLimitColumn = quotaLimitColumn
+	}
+	if c.QuotaDefaultLimit < 0 {
+		return errors.New("quota_default_limit cannot be negative")
+	}
+	return nil
+}
+
+func Quota() Decorator {
+
+	q := &quotaStore{}
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&QuotaConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*QuotaConfig)
+		if err := config.loadConfig(); err != nil {
+			return err
+		}
+		db, err := sql.Open(mysqlDriverName, config.QuotaMySQLDSN)
+		if err != nil {
+			return err
+		}
+		q.config = config
+		q.db = db
+		// do we have permission to access the table?
+		if _, err := q.prepare(quotaStmtSelect); err != nil {
+			return fmt.Errorf("cannot use the quota table: %s", err)
+		}
+		return nil
+	}))
+
+	// shutdown will close the database connection
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if q.db != nil {
+			return q.db.Close()
+		}
+		return nil
+	}))
+
+	// the readiness check pings the database
+	Svc.AddPinger(PingWith(func() error {
+		if q.db == nil {
+			return errors.New("quota store is not connected")
+		}
+		return q.db.Ping()
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt && len(e.RcptTo) > 0 {
+				// since this is called each time a recipient is added
+				// validate only the _last_ recipient that was appended
+				rcpt := e.RcptTo[len(e.RcptTo)-1]
+				full, err := q.full(e.Context(), strings.ToLower(rcpt.String()))
+				if err != nil {
+					Log().WithError(err).WithField("rcpt", rcpt.String()).Error("could not look up the quota")
+					reply := response.Canned.ErrorBackendTransaction + "quota lookup failed"
+					return NewResult(reply), RcptReply(reply)
+				}
+				if full {
+					Log().WithField("rcpt", rcpt.String()).Info("mailbox over quota")
+					return NewResult(response.Canned.FailMailboxFull), RcptReply(response.Canned.FailMailboxFull)
+				}
+				return p.Process(e, task)
+			} else if task == TaskSaveMail {
+				size := int64(e.Data.Len() + len(e.DeliveryHeader))
+				full, err := q.add(e.Context(), e.RcptTo, size)
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not update the quotas")
+					return NewResult(response.Canned.ErrorBackendTransaction + "quota update failed"), NewRetryableError(err)
+				}
+				if len(full) == len(e.RcptTo) && len(full) > 0 {
+					return NewResult(response.Canned.FailMailboxFull), QuotaExceeded
+				}
+				for _, rcpt := range full {
+					Log().WithField("queued_id", e.QueuedId).Info("mailbox over quota: ", rcpt.String())
+					SetRcptResult(e, rcpt, NewResult(response.Canned.FailMailboxFull))
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
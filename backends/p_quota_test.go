@@ -0,0 +1,197 @@
+package backends
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// quotaTestRow is a row of the quota driver, limit is nil for NULL
+type quotaTestRow struct {
+	used  int64
+	limit driver.Value
+}
+
+// the quota driver keeps its table in quotaTestRows
+var (
+	quotaTestRows    map[string]*quotaTestRow
+	quotaTestCommits int
+	quotaTestMu      sync.Mutex
+)
+
+func init() {
+	sql.Register("quota", quotaDriver{})
+}
+
+type quotaDriver struct{}
+
+func (quotaDriver) Open(name string) (driver.Conn, error) {
+	return quotaConn{}, nil
+}
+
+type quotaConn struct{}
+
+func (quotaConn) Prepare(query string) (driver.Stmt, error) {
+	if !strings.Contains(query, " quotas ") {
+		return nil, errors.New("no such table")
+	}
+	return quotaStmt(query), nil
+}
+
+func (quotaConn) Close() error { return nil }
+
+func (quotaConn) Begin() (driver.Tx, error) {
+	return quotaTx{}, nil
+}
+
+type quotaTx struct{}
+
+func (quotaTx) Commit() error {
+	quotaTestMu.Lock()
+	defer quotaTestMu.Unlock()
+	quotaTestCommits++
+	return nil
+}
+
+func (quotaTx) Rollback() error { return nil }
+
+type quotaStmt string
+
+func (quotaStmt) Close() error  { return nil }
+func (quotaStmt) NumInput() int { return -1 }
+
+func (s quotaStmt) Exec(args []driver.Value) (driver.Result, error) {
+	quotaTestMu.Lock()
+	defer quotaTestMu.Unlock()
+	if strings.HasPrefix(string(s), "UPDATE") {
+		quotaTestRows[args[1].(string)].used += args[0].(int64)
+	} else {
+		quotaTestRows[args[0].(string)] = &quotaTestRow{used: args[1].(int64)}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s quotaStmt) Query(args []driver.Value) (driver.Rows, error) {
+	quotaTestMu.Lock()
+	defer quotaTestMu.Unlock()
+	row, ok := quotaTestRows[args[0].(string)]
+	if !ok {
+		return &quotaRows{}, nil
+	}
+	return &quotaRows{values: []driver.Value{row.used, row.limit}}, nil
+}
+
+type quotaRows struct {
+	values []driver.Value
+}
+
+func (r *quotaRows) Columns() []string { return []string{"used_bytes", "limit_bytes"} }
+func (r *quotaRows) Close() error      { return nil }
+func (r *quotaRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
+
+func newQuotaEnvelope(rcpts ...string) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	for _, rcpt := range rcpts {
+		a, _ := mail.NewAddress(rcpt)
+		e.PushRcpt(a)
+	}
+	// 100 bytes
+	e.Data.WriteString("Subject: quota\n\n" + strings.Repeat("x", 83) + "\n")
+	return e
+}
+
+func TestQuota(t *testing.T) {
+	defer func(name string) {
+		mysqlDriverName = name
+	}(mysqlDriverName)
+	mysqlDriverName = "quota"
+	quotaTestRows = map[string]*quotaTestRow{
+		"under@example.com":   {used: 100, limit: int64(1000)},
+		"at@example.com":      {used: 1000, limit: int64(1000)},
+		"over@example.com":    {used: 2000, limit: int64(1000)},
+		"almost@example.com":  {used: 950, limit: int64(1000)},
+		"default@example.com": {used: 350},
+		"nolimit@example.com": {used: 5000, limit: int64(0)},
+	}
+	quotaTestCommits = 0
+	p := newTestProcessor(t, BackendConfig{
+		"quota_mysql_dsn":     "user:pass@tcp(127.0.0.1:3306)/mail",
+		"quota_default_limit": 500,
+	}, Quota)
+
+	for rcpt, full := range map[string]bool{
+		"under@example.com":   false,
+		"at@example.com":      true,
+		"over@example.com":    true,
+		"Over@Example.com":    true,
+		"default@example.com": false,
+		"nolimit@example.com": false,
+		"unknown@example.com": false,
+	} {
+		_, err := p.Process(newQuotaEnvelope(rcpt), TaskValidateRcpt)
+		if full && (err == nil || !strings.HasPrefix(err.Error(), "552 5.2.2 Mailbox full")) {
+			t.Error("expecting", rcpt, "to be over quota, got:", err)
+		} else if !full && err != nil {
+			t.Error("expecting", rcpt, "to pass, got:", err)
+		}
+	}
+
+	// the message fits in some of the mailboxes
+	e := newQuotaEnvelope("under@example.com", "almost@example.com", "default@example.com", "unknown@example.com")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("expecting the message to be saved, got:", err)
+	}
+	for addr, used := range map[string]int64{
+		"under@example.com":   200,
+		"almost@example.com":  950,
+		"default@example.com": 450,
+		"unknown@example.com": 100,
+	} {
+		if row := quotaTestRows[addr]; row == nil || row.used != used {
+			t.Error("expecting", addr, "to use", used, "got:", row)
+		}
+	}
+	results, _ := e.Values[ValueRcptResults].(map[string]Result)
+	if len(results) != 1 || results["almost@example.com"].Code() != 552 {
+		t.Error("expecting almost@example.com to be over quota, got:", results)
+	}
+	if quotaTestCommits != 1 {
+		t.Error("expecting the usage to be added in a transaction, got commits:", quotaTestCommits)
+	}
+
+	// the message fits in none of them
+	e = newQuotaEnvelope("at@example.com", "almost@example.com")
+	if res, err := p.Process(e, TaskSaveMail); err != QuotaExceeded || res.Code() != 552 {
+		t.Error("expecting the message to be rejected, got:", res, err)
+	}
+}
+
+func TestQuotaConfig(t *testing.T) {
+	defer func(name string) {
+		mysqlDriverName = name
+	}(mysqlDriverName)
+	mysqlDriverName = "quota"
+	for _, config := range []BackendConfig{
+		{},
+		{"quota_mysql_dsn": "dsn", "quota_table": "missing"},
+		{"quota_mysql_dsn": "dsn", "quota_used_column": "used; DROP TABLE quotas"},
+		{"quota_mysql_dsn": "dsn", "quota_default_limit": -1},
+	} {
+		if _, errs := initTestProcessor(config, Quota); errs == nil {
+			t.Error("expecting the config to fail:", config)
+		}
+	}
+}
@@ -1,7 +1,14 @@
 package backends
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/response"
@@ -17,11 +24,25 @@ import (
 //               : e.Hashes
 // ----------------------------------------------------------------------------------
 // Config Options: redis_expire_seconds int - how many seconds to expiry
+//               : redis_ttl int - how many seconds to expiry, replaces redis_expire_seconds.
+//               : The value doesn't expire if both are 0
 //               : redis_interface string - <host>:<port> eg, 127.0.0.1:6379
+//               : redis_mode string - "standalone" (default), "sentinel" or "cluster"
+//               : redis_sentinels string - comma separated <host>:<port> of the sentinels
+//               : redis_master_name string - name of the master the sentinels watch
+//               : redis_cluster_nodes string - comma separated <host>:<port> of some of
+//               : the nodes of the cluster, redis_interface if empty
+//               : redis_key_prefix string - prepended to the keys, eg. "mail:"
+//               : redis_key_pattern string - template of the keys, with the fields
+//               : {{.QueuedId}}, {{.Hash}}, {{.MailFrom}}, {{.RcptTo}} (the first recipient),
+//               : {{.RemoteIP}} and {{.Helo}}. Default is the hash
+//               : codec string - if set, the whole envelope is saved, serialized with
+//               : this codec (gob, json or msgpack) instead of the raw message
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
 //               : e.DeliveryHeader generated by Header() processor
-//               :
+//               : e.Values["zlib-compressor"] set by the compressor processor,
+//               : not used when the codec is set
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.QueuedId with the first item fromHashes[0]
 // ----------------------------------------------------------------------------------
@@ -32,9 +53,55 @@ func init() {
 	}
 }
 
+const (
+	// how long the readiness check waits for redis
+	redisPingTimeout = time.Second * 2
+	// how long to wait for a sentinel, or for a node of the cluster
+	redisDialTimeout = time.Second * 5
+	// how many times a command may be redirected to another node of the cluster
+	redisMaxRedirects = 5
+
+	redisModeStandalone = "standalone"
+	redisModeSentinel   = "sentinel"
+	redisModeCluster    = "cluster"
+)
+
 type RedisProcessorConfig struct {
-	RedisExpireSeconds int    `json:"redis_expire_seconds"`
+	RedisExpireSeconds int    `json:"redis_expire_seconds,omitempty"`
 	RedisInterface     string `json:"redis_interface"`
+	Codec              string `json:"codec,omitempty"`
+	// RedisTTL is how many seconds until the value expires, replaces RedisExpireSeconds
+	RedisTTL int `json:"redis_ttl,omitempty"`
+	// RedisMode is "standalone" (default), "sentinel" or "cluster"
+	RedisMode string `json:"redis_mode,omitempty"`
+	// RedisSentinels is a comma separated list of the sentinels, for the "sentinel" mode
+	RedisSentinels string `json:"redis_sentinels,omitempty"`
+	// RedisMasterName is the name of the master, for the "sentinel" mode
+	RedisMasterName string `json:"redis_master_name,omitempty"`
+	// RedisClusterNodes is a comma separated list of nodes to connect to, for the "cluster" mode
+	RedisClusterNodes string `json:"redis_cluster_nodes,omitempty"`
+	// RedisKeyPrefix is prepended to the keys
+	RedisKeyPrefix string `json:"redis_key_prefix,omitempty"`
+	// RedisKeyPattern is a template for the keys, eg. "{{.QueuedId}}:{{.MailFrom}}"
+	RedisKeyPattern string `json:"redis_key_pattern,omitempty"`
+}
+
+// ttl returns the seconds until the value expires, 0 for never
+func (c *RedisProcessorConfig) ttl() int {
+	if c.RedisTTL > 0 {
+		return c.RedisTTL
+	}
+	return c.RedisExpireSeconds
+}
+
+// redisKeyData are the fields that redis_key_pattern may use
+type redisKeyData struct {
+	QueuedId string
+	Hash     string
+	MailFrom string
+	RcptTo   string
+	RemoteIP string
+	Helo     string
 }
 
 type RedisProcessor struct {
@@ -42,9 +109,9 @@ type RedisProcessor struct {
 	conn        redis.Conn
 }
 
-func (r *RedisProcessor) redisConnection(redisInterface string) (err error) {
+func (r *RedisProcessor) redisConnection(config *RedisProcessorConfig) (err error) {
 	if r.isConnected == false {
-		r.conn, err = redis.Dial("tcp", redisInterface)
+		r.conn, err = redisDial(config, redisDialTimeout)
 		if err != nil {
 			// handle error
 			return err
@@ -54,11 +121,156 @@ func (r *RedisProcessor) redisConnection(redisInterface string) (err error) {
 	return nil
 }
 
+// close drops the connection, so that the next command connects again
+func (r *RedisProcessor) close() error {
+	if !r.isConnected {
+		return nil
+	}
+	r.isConnected = false
+	return r.conn.Close()
+}
+
+// do sends a command to redis. In the "cluster" mode, the command follows the redirections
+// to the node that has the key
+func (r *RedisProcessor) do(config *RedisProcessorConfig, cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := r.conn.Do(cmd, args...)
+	for i := 0; i < redisMaxRedirects && config.RedisMode == redisModeCluster; i++ {
+		addr, asking := redisRedirect(err)
+		if addr == "" {
+			break
+		}
+		conn, dialErr := redis.Dial("tcp", addr,
+			redis.DialConnectTimeout(redisDialTimeout), redis.DialReadTimeout(redisDialTimeout))
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		if asking {
+			// only this command goes to the other node, the slot is being migrated
+			defer conn.Close()
+			if _, err = conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+		} else {
+			// the slot moved, keep talking to the node that has it now
+			r.conn.Close()
+			r.conn = conn
+		}
+		reply, err = conn.Do(cmd, args...)
+	}
+	return reply, err
+}
+
+// redisRedirect returns the address of the node from a MOVED or ASK error of a cluster,
+// and whether it was an ASK. The address is empty if err is not a redirection
+func redisRedirect(err error) (string, bool) {
+	redisErr, ok := err.(redis.Error)
+	if !ok {
+		return "", false
+	}
+	// eg. "MOVED 3999 127.0.0.1:6381"
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", false
+	}
+	return fields[2], fields[0] == "ASK"
+}
+
+// redisDial connects to redis, to the master in the "sentinel" mode,
+// or to the first node that answers in the "cluster" mode
+func redisDial(config *RedisProcessorConfig, timeout time.Duration) (redis.Conn, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(timeout),
+		redis.DialReadTimeout(timeout),
+		redis.DialWriteTimeout(timeout),
+	}
+	switch config.RedisMode {
+	case redisModeSentinel:
+		addr, err := redisSentinelMaster(config, options)
+		if err != nil {
+			return nil, err
+		}
+		return redis.Dial("tcp", addr, options...)
+	case redisModeCluster:
+		nodes := splitList(config.RedisClusterNodes)
+		if len(nodes) == 0 {
+			nodes = []string{config.RedisInterface}
+		}
+		var err error
+		for _, node := range nodes {
+			var conn redis.Conn
+			if conn, err = redis.Dial("tcp", node, options...); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	default:
+		return redis.Dial("tcp", config.RedisInterface, options...)
+	}
+}
+
+// redisSentinelMaster asks the sentinels for the address of the master
+func redisSentinelMaster(config *RedisProcessorConfig, options []redis.DialOption) (string, error) {
+	err := errors.New("no sentinel knows the master " + config.RedisMasterName)
+	for _, sentinel := range splitList(config.RedisSentinels) {
+		conn, dialErr := redis.Dial("tcp", sentinel, options...)
+		if dialErr != nil {
+			err = dialErr
+			continue
+		}
+		master, doErr := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", config.RedisMasterName))
+		conn.Close()
+		if doErr == nil && len(master) == 2 {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+		if doErr != nil && doErr != redis.ErrNil {
+			err = doErr
+		}
+	}
+	return "", err
+}
+
+// parseRedisKeyPattern parses the redis_key_pattern, and checks that it only uses the fields of redisKeyData
+func parseRedisKeyPattern(pattern string) (*template.Template, error) {
+	keyTemplate, err := template.New("key").Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err = keyTemplate.Execute(ioutil.Discard, &redisKeyData{}); err != nil {
+		return nil, err
+	}
+	return keyTemplate, nil
+}
+
+// redisKey returns the key to store e under
+func redisKey(config *RedisProcessorConfig, keyTemplate *template.Template, e *mail.Envelope, hash string) (string, error) {
+	if keyTemplate == nil {
+		return config.RedisKeyPrefix + hash, nil
+	}
+	data := redisKeyData{
+		QueuedId: e.QueuedId,
+		Hash:     hash,
+		MailFrom: e.MailFrom.String(),
+		RemoteIP: e.RemoteIP,
+		Helo:     e.Helo,
+	}
+	if len(e.RcptTo) > 0 {
+		data.RcptTo = e.RcptTo[0].String()
+	}
+	var key bytes.Buffer
+	if err := keyTemplate.Execute(&key, &data); err != nil {
+		return "", err
+	}
+	return config.RedisKeyPrefix + key.String(), nil
+}
+
 // The redis decorator stores the email data in redis
 
 func Redis() Decorator {
 
-	var config *RedisProcessorConfig
+	var (
+		config      *RedisProcessorConfig
+		keyTemplate *template.Template
+	)
 	redisClient := &RedisProcessor{}
 	// read the config into RedisProcessorConfig
 	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
@@ -68,7 +280,29 @@ func Redis() Decorator {
 			return err
 		}
 		config = bcfg.(*RedisProcessorConfig)
-		if redisErr := redisClient.redisConnection(config.RedisInterface); redisErr != nil {
+		if config.Codec != "" {
+			if _, err := mail.GetCodec(config.Codec); err != nil {
+				return err
+			}
+		}
+		switch config.RedisMode {
+		case "":
+			config.RedisMode = redisModeStandalone
+		case redisModeStandalone, redisModeCluster:
+		case redisModeSentinel:
+			if config.RedisSentinels == "" || config.RedisMasterName == "" {
+				return errors.New("redis_sentinels and redis_master_name are needed for the sentinel mode")
+			}
+		default:
+			return errors.New("invalid redis_mode: " + config.RedisMode)
+		}
+		keyTemplate = nil
+		if config.RedisKeyPattern != "" {
+			if keyTemplate, err = parseRedisKeyPattern(config.RedisKeyPattern); err != nil {
+				return fmt.Errorf("invalid redis_key_pattern: %s", err)
+			}
+		}
+		if redisErr := redisClient.redisConnection(config); redisErr != nil {
 			err := fmt.Errorf("Redis cannot connect, check your settings: %s", redisErr)
 			return err
 		}
@@ -76,10 +310,18 @@ func Redis() Decorator {
 	}))
 	// When shutting down
 	Svc.AddShutdowner(ShutdownWith(func() error {
-		if redisClient.isConnected {
-			return redisClient.conn.Close()
+		return redisClient.close()
+	}))
+	// the connection is not shared with the workers, so the readiness check pings
+	// redis using a connection of its own
+	Svc.AddPinger(PingWith(func() error {
+		conn, err := redisDial(config, redisPingTimeout)
+		if err != nil {
+			return err
 		}
-		return nil
+		defer conn.Close()
+		_, err = conn.Do("PING")
+		return err
 	}))
 
 	var redisErr error
@@ -89,29 +331,55 @@ func Redis() Decorator {
 
 			if task == TaskSaveMail {
 				hash := ""
-				if len(e.Hashes) > 0 {
-					e.QueuedId = e.Hashes[0]
-					hash = e.Hashes[0]
-					var stringer fmt.Stringer
-					// a compressor was set
-					if c, ok := e.Values["zlib-compressor"]; ok {
-						stringer = c.(*compressor)
+				if len(e.Hashes) > 0 || keyTemplate != nil {
+					if len(e.Hashes) > 0 {
+						e.QueuedId = e.Hashes[0]
+						hash = e.Hashes[0]
+					}
+					key, err := redisKey(config, keyTemplate, e, hash)
+					if err != nil {
+						Log().WithError(err).Error("Error while making the redis key")
+						result := NewResult(response.Canned.FailBackendTransaction)
+						return result, err
+					}
+					var value interface{}
+					if config.Codec != "" {
+						data, err := mail.MarshalEnvelope(e, config.Codec)
+						if err != nil {
+							Log().WithError(err).Error("Error while marshaling the envelope")
+							result := NewResult(response.Canned.FailBackendTransaction)
+							return result, err
+						}
+						value = data
+					} else if c, ok := e.Values["zlib-compressor"]; ok {
+						// a compressor was set
+						value = c.(*compressor)
 					} else {
-						stringer = e
+						value = e
 					}
-					redisErr = redisClient.redisConnection(config.RedisInterface)
+					redisErr = redisClient.redisConnection(config)
 					if redisErr != nil {
 						Log().WithError(redisErr).Warn("Error while connecting to redis")
 						result := NewResult(response.Canned.FailBackendTransaction)
 						return result, redisErr
 					}
-					_, doErr := redisClient.conn.Do("SETEX", hash, config.RedisExpireSeconds, stringer)
+					var doErr error
+					if ttl := config.ttl(); ttl > 0 {
+						_, doErr = redisClient.do(config, "SETEX", key, ttl, value)
+					} else {
+						_, doErr = redisClient.do(config, "SET", key, value)
+					}
 					if doErr != nil {
 						Log().WithError(doErr).Warn("Error while SETEX to redis")
+						if _, ok := doErr.(redis.Error); !ok {
+							// the connection is broken, connect again next time
+							redisClient.close()
+						}
 						result := NewResult(response.Canned.FailBackendTransaction)
-						return result, redisErr
+						return result, doErr
 					}
 					e.Values["redis"] = "redis" // the next processor will know to look in redis for the message data
+					e.Values["redis_key"] = key
 				} else {
 					Log().Error("Redis needs a Hash() process before it")
 					result := NewResult(response.Canned.FailBackendTransaction)
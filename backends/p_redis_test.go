@@ -0,0 +1,133 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/garyburd/redigo/redis"
+)
+
+func newRedisEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.MailFrom, _ = mail.NewAddress("alice@example.com")
+	rcpt, _ := mail.NewAddress("bob@example.org")
+	e.RcptTo = append(e.RcptTo, rcpt)
+	e.Hashes = append(e.Hashes, "a1b2c3")
+	e.Data.WriteString("Subject: hi\n\nhello\n")
+	return e
+}
+
+func TestRedisKeyAndTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	p := newTestProcessor(t, BackendConfig{
+		"redis_interface":   s.Addr(),
+		"redis_key_prefix":  "mail:",
+		"redis_key_pattern": "{{.QueuedId}}:{{.MailFrom}}",
+		"redis_ttl":         60,
+	}, Redis)
+	defer Svc.shutdown()
+	for _, pinger := range Svc.takePingers() {
+		if err := pinger.Ping(); err != nil {
+			t.Error("expecting the ping to pass, got:", err)
+		}
+	}
+
+	e := newRedisEnvelope()
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be saved, got:", err)
+	}
+	key := "mail:a1b2c3:alice@example.com"
+	if e.Values["redis_key"] != key {
+		t.Error("expecting the key", key, "got:", e.Values["redis_key"])
+	}
+	value, err := s.Get(key)
+	if err != nil || !strings.Contains(value, "hello") {
+		t.Error("expecting the message under", key, "got:", value, err)
+	}
+	if ttl := s.TTL(key); ttl != 60*time.Second {
+		t.Error("expecting a ttl of 60s, got:", ttl)
+	}
+	s.FastForward(61 * time.Second)
+	if s.Exists(key) {
+		t.Error("expecting the key to expire")
+	}
+}
+
+func TestRedisNoTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	p := newTestProcessor(t, BackendConfig{
+		"redis_interface": s.Addr(),
+	}, Redis)
+	defer Svc.shutdown()
+
+	e := newRedisEnvelope()
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be saved, got:", err)
+	}
+	// the default key is the hash
+	if !s.Exists("a1b2c3") {
+		t.Error("expecting the message under the hash, got:", s.Keys())
+	}
+	if ttl := s.TTL("a1b2c3"); ttl != 0 {
+		t.Error("expecting no ttl, got:", ttl)
+	}
+}
+
+func TestRedisKey(t *testing.T) {
+	e := newRedisEnvelope()
+	e.QueuedId = "q1"
+	e.Helo = "mx.example.com"
+	config := &RedisProcessorConfig{RedisKeyPrefix: "p:"}
+	if key, _ := redisKey(config, nil, e, "h1"); key != "p:h1" {
+		t.Error("expecting the prefixed hash, got:", key)
+	}
+	tmpl, err := parseRedisKeyPattern("{{.RemoteIP}}/{{.Helo}}/{{.RcptTo}}/{{.Hash}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := redisKey(config, tmpl, e, "h1")
+	if err != nil || key != "p:203.0.113.5/mx.example.com/bob@example.org/h1" {
+		t.Error("unexpected key:", key, err)
+	}
+	if _, err := parseRedisKeyPattern("{{.Subject}}"); err == nil {
+		t.Error("expecting an error for an unknown field")
+	}
+}
+
+func TestRedisRedirect(t *testing.T) {
+	if addr, asking := redisRedirect(redis.Error("MOVED 3999 127.0.0.1:6381")); addr != "127.0.0.1:6381" || asking {
+		t.Error("expecting a MOVED, got:", addr, asking)
+	}
+	if addr, asking := redisRedirect(redis.Error("ASK 3999 127.0.0.1:6382")); addr != "127.0.0.1:6382" || !asking {
+		t.Error("expecting an ASK, got:", addr, asking)
+	}
+	if addr, _ := redisRedirect(redis.Error("ERR wrong number of arguments")); addr != "" {
+		t.Error("expecting no redirection, got:", addr)
+	}
+}
+
+func TestRedisConfig(t *testing.T) {
+	for _, c := range []BackendConfig{
+		{"redis_interface": "127.0.0.1:1", "redis_mode": "ring"},
+		{"redis_interface": "127.0.0.1:1", "redis_mode": "sentinel"},
+		{"redis_interface": "127.0.0.1:1", "redis_key_pattern": "{{.QueuedId"},
+	} {
+		if _, errs := initTestProcessor(c, Redis); errs == nil {
+			t.Error("expecting an error for", c)
+			Svc.shutdown()
+		}
+	}
+}
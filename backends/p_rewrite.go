@@ -0,0 +1,420 @@
+package backends
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	rewriteSourceFile  = "file"
+	rewriteSourceMySQL = "mysql"
+
+	// default table, if 'rewrite_table' not present in config
+	rewriteTable = "rewrites"
+	// default most aliases followed for an address, if 'rewrite_max_depth' not present in config
+	rewriteMaxDepth = 10
+)
+
+// ValueRewrites is the e.Values key of the []Rewrite made to the envelope
+const ValueRewrites = "rewrites"
+
+// Rewrite is an address changed by the rewrite processor
+type Rewrite struct {
+	// Field is "from" or "rcpt"
+	Field string   `json:"field"`
+	From  string   `json:"from"`
+	To    []string `json:"to"`
+}
+
+type RewriteConfig struct {
+	// RewriteSource is where the rules come from, "file" (default) or "mysql"
+	RewriteSource string `json:"rewrite_source,omitempty"`
+	// RewriteFile has a rule per line: the address, "@domain" or "/regex/", then the targets
+	RewriteFile string `json:"rewrite_file,omitempty"`
+	// RewriteMySQLDSN is the data source name of the "mysql" source, eg. "user:pass@tcp(127.0.0.1:3306)/mail"
+	RewriteMySQLDSN string `json:"rewrite_mysql_dsn,omitempty"`
+	// RewriteTable is the table of the "mysql" source, with a `pattern` & a `targets` column
+	RewriteTable string `json:"rewrite_table,omitempty"`
+	// RewriteSender also rewrites the MAIL FROM, with the rules that have one target
+	RewriteSender bool `json:"rewrite_sender,omitempty"`
+	// RewriteMaxDepth is how many aliases are followed for an address, to stop alias loops
+	RewriteMaxDepth int `json:"rewrite_max_depth,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: rewrite
+// ----------------------------------------------------------------------------------
+// Description   : Rewrites the recipients, and optionally the sender, like the
+//               : canonical & virtual alias tables of Postfix. An alias with several
+//               : targets fans the recipient out to all of them. Aliases are followed
+//               : until no rule matches, an alias that includes itself keeps the address.
+//               : Works during TaskValidateRcpt (the last recipient) & TaskSaveMail
+// ----------------------------------------------------------------------------------
+// Config Options: rewrite_source string - "file" (default) or "mysql"
+//               : rewrite_file string - the rules, one per line, eg.
+//               :   alice@example.com          alice@example.org
+//               :   team@example.com           alice@example.com, bob@example.com
+//               :   @example.net               @example.com
+//               :   /^(.+)\.old@example\.com$/ $1@example.com
+//               : an exact address is tried first, then the domain catch-all, then
+//               : the regexes in order. A target "@domain" keeps the local part,
+//               : $1 etc. are the groups of a regex. Lines starting with # are ignored
+//               : rewrite_mysql_dsn string - data source name for the "mysql" source
+//               : rewrite_table string - table for the "mysql" source, default
+//               : "rewrites", the `pattern` & `targets` columns are like a line
+//               : rewrite_sender bool - also rewrite the MAIL FROM
+//               : rewrite_max_depth int - most aliases followed, default 10, a
+//               : recipient that goes over is rejected as a loop
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : e.MailFrom, e.RcptTo rewritten
+//               : e.Values[ValueRewrites] the []Rewrite made
+//               : a recipient in an alias loop is removed during TaskSaveMail, and
+//               : failed with SetRcptResult
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["rewrite"] = func() Decorator {
+		return Rewriter()
+	}
+}
+
+// rewriteRegex is a regex rule, its targets are templates
+type rewriteRegex struct {
+	regex   *regexp.Regexp
+	targets []string
+}
+
+// rewriteMap has the rules, by kind
+type rewriteMap struct {
+	exact   map[string][]string
+	domains map[string][]string
+	regexes []rewriteRegex
+}
+
+func newRewriteMap() *rewriteMap {
+	return &rewriteMap{
+		exact:   make(map[string][]string),
+		domains: make(map[string][]string),
+	}
+}
+
+// add adds a rule. targets is a comma separated list
+func (m *rewriteMap) add(pattern, targets string) error {
+	list := splitList(targets)
+	if len(list) == 0 {
+		return errors.New("no targets for " + pattern)
+	}
+	switch {
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return err
+		}
+		m.regexes = append(m.regexes, rewriteRegex{regex: re, targets: list})
+		return nil
+	}
+	// the targets of the other rules can be checked now
+	for _, t := range list {
+		if strings.HasPrefix(t, "@") {
+			if len(t) == 1 {
+				return errors.New("invalid target: " + t)
+			}
+		} else if _, err := mail.NewAddress(t); err != nil {
+			return fmt.Errorf("invalid target %s: %s", t, err)
+		}
+	}
+	switch {
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "@"):
+		m.domains[strings.ToLower(pattern[1:])] = list
+	case strings.Contains(pattern, "@"):
+		m.exact[strings.ToLower(pattern)] = list
+	default:
+		return errors.New("invalid pattern: " + pattern)
+	}
+	return nil
+}
+
+// load reads the rules from a file, one per line
+func (m *rewriteMap) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if err := m.add(fields[0], strings.Join(fields[1:], " ")); err != nil {
+			return fmt.Errorf("%s line %d: %s", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadMySQL reads the rules from a table
+func (m *rewriteMap) loadMySQL(dsn, table string) error {
+	db, err := sql.Open(mysqlDriverName, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT `pattern`, `targets` FROM " + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pattern, targets string
+		if err := rows.Scan(&pattern, &targets); err != nil {
+			return err
+		}
+		if err := m.add(strings.TrimSpace(pattern), targets); err != nil {
+			return fmt.Errorf("%s: %s", table, err)
+		}
+	}
+	return rows.Err()
+}
+
+// lookup returns the targets of the first rule that matches a
+func (m *rewriteMap) lookup(a mail.Address) ([]mail.Address, bool, error) {
+	addr := a.String()
+	targets, ok := m.exact[strings.ToLower(addr)]
+	if !ok {
+		targets, ok = m.domains[strings.ToLower(a.Host)]
+	}
+	if !ok {
+		for _, r := range m.regexes {
+			match := r.regex.FindStringSubmatchIndex(addr)
+			if match == nil {
+				continue
+			}
+			targets = make([]string, 0, len(r.targets))
+			for _, t := range r.targets {
+				targets = append(targets, string(r.regex.ExpandString(nil, t, addr, match)))
+			}
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	addresses := make([]mail.Address, 0, len(targets))
+	for _, t := range targets {
+		if strings.HasPrefix(t, "@") {
+			// keeps the local part
+			t = a.User + t
+		}
+		target, err := mail.NewAddress(t)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid rewrite of %s to %s: %s", addr, t, err)
+		}
+		addresses = append(addresses, target)
+	}
+	return addresses, true, nil
+}
+
+// resolve follows the aliases of a, until no rule matches. A target that is a or one of
+// the aliases that led to it is kept as it is, eg. to keep a copy when forwarding
+func (m *rewriteMap) resolve(a mail.Address, maxDepth int, ancestors []string) ([]mail.Address, error) {
+	targets, ok, err := m.lookup(a)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []mail.Address{a}, nil
+	}
+	if len(ancestors) >= maxDepth {
+		return nil, fmt.Errorf("more than %d rewrites of %s, is there an alias loop?", maxDepth, a.String())
+	}
+	ancestors = append(ancestors, strings.ToLower(a.String()))
+	var resolved []mail.Address
+	for _, t := range targets {
+		key := strings.ToLower(t.String())
+		seen := false
+		for _, k := range ancestors {
+			if k == key {
+				seen = true
+				break
+			}
+		}
+		if seen {
+			resolved = append(resolved, t)
+			continue
+		}
+		r, err := m.resolve(t, maxDepth, ancestors)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, r...)
+	}
+	return resolved, nil
+}
+
+// addRewrite adds to the e.Values[ValueRewrites]
+func addRewrite(e *mail.Envelope, field string, from mail.Address, to []mail.Address) {
+	rw := Rewrite{Field: field, From: from.String()}
+	for i := range to {
+		rw.To = append(rw.To, to[i].String())
+	}
+	rewrites, _ := e.Values[ValueRewrites].([]Rewrite)
+	e.Values[ValueRewrites] = append(rewrites, rw)
+}
+
+// resolved returns true if a is a target of a rewrite made earlier, eg. during the validation
+func resolved(e *mail.Envelope, a mail.Address) bool {
+	rewrites, _ := e.Values[ValueRewrites].([]Rewrite)
+	for i := range rewrites {
+		if rewrites[i].Field != "rcpt" {
+			continue
+		}
+		for _, to := range rewrites[i].To {
+			if strings.EqualFold(to, a.String()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rewritten returns true if the address was rewritten to to
+func rewritten(from mail.Address, to []mail.Address) bool {
+	return len(to) != 1 || !strings.EqualFold(from.String(), to[0].String())
+}
+
+// appendRcpts appends the recipients that are not in rcpts yet
+func appendRcpts(rcpts []mail.Address, add ...mail.Address) []mail.Address {
+	for _, a := range add {
+		dup := false
+		for i := range rcpts {
+			if strings.EqualFold(rcpts[i].String(), a.String()) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			rcpts = append(rcpts, a)
+		}
+	}
+	return rcpts
+}
+
+func Rewriter() Decorator {
+
+	var (
+		config *RewriteConfig
+		rules  *rewriteMap
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&RewriteConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*RewriteConfig)
+		if config.RewriteMaxDepth == 0 {
+			config.RewriteMaxDepth = rewriteMaxDepth
+		} else if config.RewriteMaxDepth < 0 {
+			return errors.New("rewrite_max_depth cannot be negative")
+		}
+		m := newRewriteMap()
+		switch config.RewriteSource {
+		case "", rewriteSourceFile:
+			if config.RewriteFile == "" {
+				return errors.New("rewrite_file cannot be empty")
+			}
+			err = m.load(config.RewriteFile)
+		case rewriteSourceMySQL:
+			if config.RewriteMySQLDSN == "" {
+				return errors.New("rewrite_mysql_dsn cannot be empty")
+			}
+			table := config.RewriteTable
+			if table == "" {
+				table = rewriteTable
+			}
+			err = m.loadMySQL(config.RewriteMySQLDSN, table)
+		default:
+			return errors.New("invalid rewrite_source: " + config.RewriteSource)
+		}
+		if err != nil {
+			return err
+		}
+		rules = m
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskValidateRcpt && len(e.RcptTo) > 0 {
+				rcpt := e.RcptTo[len(e.RcptTo)-1]
+				to, err := rules.resolve(rcpt, config.RewriteMaxDepth, nil)
+				if err != nil {
+					Log().WithError(err).WithField("rcpt", rcpt.String()).Warn("could not rewrite the recipient")
+					return NewResult(response.Canned.FailAliasLoop), RcptReply(response.Canned.FailAliasLoop)
+				}
+				if rewritten(rcpt, to) {
+					e.RcptTo = appendRcpts(e.RcptTo[:len(e.RcptTo)-1], to...)
+					addRewrite(e, "rcpt", rcpt, to)
+				}
+				// next processor
+				return p.Process(e, task)
+			} else if task == TaskSaveMail {
+				if config.RewriteSender && !e.MailFrom.IsEmpty() {
+					to, err := rules.resolve(e.MailFrom, config.RewriteMaxDepth, nil)
+					if err != nil {
+						Log().WithError(err).WithField("queued_id", e.QueuedId).Warn("could not rewrite the sender")
+						return NewResult(response.Canned.FailAliasLoop), err
+					}
+					if len(to) == 1 && rewritten(e.MailFrom, to) {
+						addRewrite(e, "from", e.MailFrom, to)
+						e.MailFrom = to[0]
+					}
+				}
+				rcpts := make([]mail.Address, 0, len(e.RcptTo))
+				var loopErr error
+				for _, rcpt := range e.RcptTo {
+					if resolved(e, rcpt) {
+						rcpts = appendRcpts(rcpts, rcpt)
+						continue
+					}
+					to, err := rules.resolve(rcpt, config.RewriteMaxDepth, nil)
+					if err != nil {
+						// only this recipient fails
+						Log().WithError(err).WithField("queued_id", e.QueuedId).Warn("could not rewrite recipient ", rcpt.String())
+						SetRcptResult(e, rcpt, NewResult(response.Canned.FailAliasLoop))
+						loopErr = err
+						continue
+					}
+					if rewritten(rcpt, to) {
+						addRewrite(e, "rcpt", rcpt, to)
+					}
+					rcpts = appendRcpts(rcpts, to...)
+				}
+				if loopErr != nil && len(rcpts) == 0 {
+					return NewResult(response.Canned.FailAliasLoop), loopErr
+				}
+				e.RcptTo = rcpts
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
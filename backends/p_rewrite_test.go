@@ -0,0 +1,176 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+const rewriteRules = `
+# exact
+alice@example.com     alice@example.org
+# multi-target, the list keeps a copy
+team@example.com      team@example.com, bob@example.com, alice@example.com
+# catch-all, keeps the local part
+@example.net          @example.com
+@old.example.com      postmaster@example.com
+/^(.+)\.sales@example\.org$/  $1@sales.example.org
+# loops
+/^(.+)@loop\.test$/   x$1@loop.test
+`
+
+func writeRewriteRules(t *testing.T, rules string) string {
+	f, err := ioutil.TempFile("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(rules); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func rewriteEnvelope(from string, rcpts ...string) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom, _ = mail.NewAddress(from)
+	for _, r := range rcpts {
+		a, _ := mail.NewAddress(r)
+		e.RcptTo = append(e.RcptTo, a)
+	}
+	return e
+}
+
+func rcptList(e *mail.Envelope) string {
+	var list []string
+	for i := range e.RcptTo {
+		list = append(list, e.RcptTo[i].String())
+	}
+	return strings.Join(list, ",")
+}
+
+func TestRewriteSave(t *testing.T) {
+	path := writeRewriteRules(t, rewriteRules)
+	defer os.Remove(path)
+	p := newTestProcessor(t, BackendConfig{"rewrite_file": path, "rewrite_sender": true}, Rewriter)
+
+	tests := []struct {
+		rcpts    []string
+		expected string
+	}{
+		// exact
+		{[]string{"Alice@Example.com"}, "alice@example.org"},
+		// catch-all
+		{[]string{"carol@example.net"}, "carol@example.com"},
+		{[]string{"anyone@old.example.com"}, "postmaster@example.com"},
+		// regex
+		{[]string{"dave.sales@example.org"}, "dave@sales.example.org"},
+		// multi-target, followed to the end, without duplicates
+		{[]string{"team@example.com", "bob@example.com"}, "team@example.com,bob@example.com,alice@example.org"},
+		// no rule
+		{[]string{"erin@example.org"}, "erin@example.org"},
+	}
+	for _, test := range tests {
+		e := rewriteEnvelope("alice@example.com", test.rcpts...)
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Error("expecting the message to pass, got:", err)
+		}
+		if got := rcptList(e); got != test.expected {
+			t.Error("expecting", test.rcpts, "to be rewritten to", test.expected, "got:", got)
+		}
+		if e.MailFrom.String() != "alice@example.org" {
+			t.Error("expecting the sender to be rewritten, got:", e.MailFrom.String())
+		}
+	}
+
+	// the audit trail
+	e := rewriteEnvelope("nobody@example.org", "team@example.com", "erin@example.org")
+	p.Process(e, TaskSaveMail)
+	rewrites, _ := e.Values[ValueRewrites].([]Rewrite)
+	if len(rewrites) != 1 || rewrites[0].Field != "rcpt" || rewrites[0].From != "team@example.com" ||
+		strings.Join(rewrites[0].To, ",") != "team@example.com,bob@example.com,alice@example.org" {
+		t.Error("unexpected rewrites:", rewrites)
+	}
+
+	// a loop is rejected
+	e = rewriteEnvelope("nobody@example.org", "a@loop.test")
+	if result, err := p.Process(e, TaskSaveMail); err == nil || result.Code() != 554 {
+		t.Error("expecting the loop to be rejected, got:", result, err)
+	}
+	// only the recipient in the loop fails when there are others
+	e = rewriteEnvelope("nobody@example.org", "a@loop.test", "alice@example.com")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("expecting the message to pass, got:", err)
+	}
+	if got := rcptList(e); got != "alice@example.org" {
+		t.Error("unexpected recipients:", got)
+	}
+	if results, _ := e.Values[ValueRcptResults].(map[string]Result); len(results) != 1 || results["a@loop.test"].Code() != 554 {
+		t.Error("expecting the loop to fail its recipient, got:", results)
+	}
+}
+
+func TestRewriteValidate(t *testing.T) {
+	path := writeRewriteRules(t, rewriteRules)
+	defer os.Remove(path)
+	p := newTestProcessor(t, BackendConfig{"rewrite_file": path}, Rewriter)
+
+	e := rewriteEnvelope("alice@example.com", "bob@example.com", "team@example.com")
+	if _, err := p.Process(e, TaskValidateRcpt); err != nil {
+		t.Fatal("expecting the recipient to pass, got:", err)
+	}
+	// the last recipient is expanded, bob was there already
+	if got := rcptList(e); got != "bob@example.com,team@example.com,alice@example.org" {
+		t.Error("unexpected recipients:", got)
+	}
+	// not rewritten again when saving
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("expecting the message to pass, got:", err)
+	}
+	if got := rcptList(e); got != "bob@example.com,team@example.com,alice@example.org" {
+		t.Error("unexpected recipients:", got)
+	}
+	if rewrites, _ := e.Values[ValueRewrites].([]Rewrite); len(rewrites) != 1 {
+		t.Error("expecting one rewrite, got:", rewrites)
+	}
+	// the sender is not rewritten unless rewrite_sender
+	if e.MailFrom.String() != "alice@example.com" {
+		t.Error("the sender should not be rewritten, got:", e.MailFrom.String())
+	}
+
+	e = rewriteEnvelope("alice@example.com", "a@loop.test")
+	if _, err := p.Process(e, TaskValidateRcpt); err == nil {
+		t.Error("expecting the loop to be rejected")
+	} else if _, ok := err.(RcptReply); !ok || !strings.HasPrefix(err.Error(), "554 5.4.6") {
+		t.Error("expecting a 554 5.4.6 reply, got:", err)
+	}
+}
+
+func TestRewriteConfig(t *testing.T) {
+	for _, rules := range []string{
+		"alice@example.com",
+		"alice example.com",
+		"@example.com not-an-address",
+		"/(/ a@example.com",
+	} {
+		path := writeRewriteRules(t, rules)
+		if _, errs := initTestProcessor(BackendConfig{"rewrite_file": path}, Rewriter); errs == nil {
+			t.Error("expecting the rules to fail:", rules)
+		}
+		os.Remove(path)
+	}
+	for _, config := range []BackendConfig{
+		{},
+		{"rewrite_file": "/does/not/exist"},
+		{"rewrite_source": "mysql"},
+		{"rewrite_source": "ldap"},
+		{"rewrite_file": os.DevNull, "rewrite_max_depth": -1},
+	} {
+		if _, errs := initTestProcessor(config, Rewriter); errs == nil {
+			t.Error("expecting the config to fail:", config)
+		}
+	}
+}
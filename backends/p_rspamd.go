@@ -0,0 +1,351 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default url of rspamd's normal worker, if 'rspamd_url' not present in config
+	rspamdURL = "http://localhost:11333"
+	// default time to wait for the scan, if 'rspamd_timeout' not present in config
+	rspamdTimeout = time.Second * 15
+	// default header of the "add header" action, if 'rspamd_spam_header' not present in config
+	rspamdSpamHeader = "X-Spam"
+	// the subject of the "rewrite subject" action when rspamd does not give it
+	rspamdSpamSubject = "***SPAM*** "
+)
+
+// the actions of rspamd
+const (
+	rspamdActionReject         = "reject"
+	rspamdActionSoftReject     = "soft reject"
+	rspamdActionGreylist       = "greylist"
+	rspamdActionAddHeader      = "add header"
+	rspamdActionRewriteSubject = "rewrite subject"
+)
+
+// what to do when rspamd fails
+const (
+	rspamdOnErrorAccept   = "accept"
+	rspamdOnErrorTempFail = "tempfail"
+)
+
+var errRspamdDeferred = errors.New("deferred by rspamd")
+
+type RspamdConfig struct {
+	// RspamdURL is the url of rspamd's normal worker or proxy, eg. "http://localhost:11333"
+	RspamdURL string `json:"rspamd_url,omitempty"`
+	// RspamdPassword is sent in the Password header, for a controller that needs one
+	RspamdPassword string `json:"rspamd_password,omitempty"`
+	// RspamdTimeout is how long to wait for the scan, eg. "15s"
+	RspamdTimeout string `json:"rspamd_timeout,omitempty"`
+	// RspamdSpamHeader is the header added with "Yes" by the "add header" action
+	RspamdSpamHeader string `json:"rspamd_spam_header,omitempty"`
+	// RspamdOnError is what to do when rspamd fails: "accept" (default) or "tempfail"
+	RspamdOnError string `json:"rspamd_on_error,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: rspamd
+// ----------------------------------------------------------------------------------
+// Description   : Scans the message with rspamd, with the checkv2 request of its HTTP
+//               : protocol, and follows the action of its verdict. The client's IP,
+//               : HELO, the envelope addresses, the queued id & the authenticated user
+//               : are passed as the request headers.
+//               : reject: the message is rejected with a 550, the smtp_message of
+//               : rspamd if it gave one.
+//               : soft reject & greylist: the message is deferred with a 451.
+//               : add header: the rspamd_spam_header is added with "Yes".
+//               : rewrite subject: the Subject is replaced with the one of rspamd.
+//               : The headers that rspamd adds or removes in its milter block are
+//               : applied to e.Data. When rspamd cannot be reached or fails, the message
+//               : is accepted as it is, or deferred with rspamd_on_error
+// ----------------------------------------------------------------------------------
+// Config Options: rspamd_url string - the url of the normal worker or the proxy,
+//               : default "http://localhost:11333"
+//               : rspamd_password string - the Password header, if needed
+//               : rspamd_timeout string - how long to wait for the scan, default "15s"
+//               : rspamd_spam_header string - the header of the "add header" action,
+//               : default "X-Spam"
+//               : rspamd_on_error string - when rspamd fails, "accept" (default) or
+//               : "tempfail" the message
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.RemoteIP, e.Helo, e.MailFrom, e.RcptTo & e.QueuedId
+//               : e.Values[ValueAuthLogin] & e.Values[ValuePTRName], if present
+// ----------------------------------------------------------------------------------
+// Output        : e.Values[ValueSpamScore], e.Data with the headers modified by rspamd,
+//               : e.Header is parsed again if it was
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["rspamd"] = func() Decorator {
+		return Rspamd()
+	}
+}
+
+// rspamdReply is the reply of rspamd to checkv2, the fields that are used
+type rspamdReply struct {
+	Action        string  `json:"action"`
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	// Subject is the rewritten subject of the "rewrite subject" action
+	Subject  string `json:"subject"`
+	Messages struct {
+		SMTPMessage string `json:"smtp_message"`
+	} `json:"messages"`
+	Milter struct {
+		// AddHeaders values are a string, a {"value": "", "order": 0} object, or an array of them
+		AddHeaders map[string]json.RawMessage `json:"add_headers"`
+		// RemoveHeaders values are the index of the header to remove, from 1, or 0 for all
+		RemoveHeaders map[string]int `json:"remove_headers"`
+	} `json:"milter"`
+}
+
+// rspamdHeaderValue is a value of the add_headers of rspamd
+type rspamdHeaderValue struct {
+	Value string `json:"value"`
+	Order int    `json:"order"`
+}
+
+// rspamdHeaderValues decodes a value of the add_headers
+func rspamdHeaderValues(raw json.RawMessage) ([]rspamdHeaderValue, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []rspamdHeaderValue{{Value: s}}, nil
+	}
+	var v rspamdHeaderValue
+	if err := json.Unmarshal(raw, &v); err == nil {
+		return []rspamdHeaderValue{v}, nil
+	}
+	var list []rspamdHeaderValue
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// rspamdAddedHeaders sorts the headers added by rspamd, order is the order that rspamd gave each
+type rspamdAddedHeaders struct {
+	mods  []milterMod
+	order []int
+}
+
+func (h rspamdAddedHeaders) Len() int {
+	return len(h.mods)
+}
+
+func (h rspamdAddedHeaders) Less(i, j int) bool {
+	if h.order[i] != h.order[j] {
+		return h.order[i] < h.order[j]
+	}
+	return h.mods[i].header.name < h.mods[j].header.name
+}
+
+func (h rspamdAddedHeaders) Swap(i, j int) {
+	h.mods[i], h.mods[j] = h.mods[j], h.mods[i]
+	h.order[i], h.order[j] = h.order[j], h.order[i]
+}
+
+// rspamdHeaderMods returns the modifications of the headers asked for by reply
+func rspamdHeaderMods(e *mail.Envelope, reply *rspamdReply, config *RspamdConfig) []milterMod {
+	var mods []milterMod
+	names := make([]string, 0, len(reply.Milter.RemoveHeaders))
+	for name := range reply.Milter.RemoveHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		index := reply.Milter.RemoveHeaders[name]
+		if index > 0 {
+			mods = append(mods, milterMod{action: milterReplyChgHeader, index: uint32(index), header: milterHeader{name: name}})
+			continue
+		} else if index < 0 {
+			continue
+		}
+		// all of them, the first is removed each time
+		headers, _ := milterParseHeaders(e.Data.Bytes())
+		for _, h := range headers {
+			if strings.EqualFold(h.name, name) {
+				mods = append(mods, milterMod{action: milterReplyChgHeader, index: 1, header: milterHeader{name: name}})
+			}
+		}
+	}
+	var added []milterMod
+	var order []int
+	for name, raw := range reply.Milter.AddHeaders {
+		values, err := rspamdHeaderValues(raw)
+		if err != nil {
+			Log().WithError(err).WithField("queued_id", e.QueuedId).Warn("ignored the rspamd header ", name)
+			continue
+		}
+		for _, v := range values {
+			order = append(order, v.Order)
+			added = append(added, milterMod{action: milterReplyAddHeader, header: milterHeader{name: name, value: " " + v.Value}})
+		}
+	}
+	// by their order, then by name
+	sort.Stable(rspamdAddedHeaders{added, order})
+	mods = append(mods, added...)
+	switch reply.Action {
+	case rspamdActionAddHeader:
+		if _, ok := reply.Milter.AddHeaders[config.RspamdSpamHeader]; !ok {
+			mods = append(mods, milterMod{action: milterReplyAddHeader, header: milterHeader{name: config.RspamdSpamHeader, value: " Yes"}})
+		}
+	case rspamdActionRewriteSubject:
+		subject := reply.Subject
+		if subject == "" {
+			if e.Header == nil {
+				e.ParseHeaders()
+			}
+			subject = rspamdSpamSubject + e.Subject
+		}
+		// the subject is decoded, encoded again if it is not ASCII
+		subject = mime.QEncoding.Encode("utf-8", subject)
+		mods = append(mods, milterMod{action: milterReplyChgHeader, index: 1, header: milterHeader{name: "Subject", value: " " + subject}})
+	}
+	return mods
+}
+
+func Rspamd() Decorator {
+
+	var (
+		config *RspamdConfig
+		client *http.Client
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&RspamdConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*RspamdConfig)
+		if c.RspamdURL == "" {
+			c.RspamdURL = rspamdURL
+		}
+		if u, err := url.Parse(c.RspamdURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid rspamd_url, expecting http:// or https://: " + c.RspamdURL)
+		}
+		c.RspamdURL = strings.TrimSuffix(c.RspamdURL, "/")
+		if c.RspamdSpamHeader == "" {
+			c.RspamdSpamHeader = rspamdSpamHeader
+		}
+		switch c.RspamdOnError {
+		case "":
+			c.RspamdOnError = rspamdOnErrorAccept
+		case rspamdOnErrorAccept, rspamdOnErrorTempFail:
+		default:
+			return errors.New("invalid rspamd_on_error: " + c.RspamdOnError)
+		}
+		timeout := rspamdTimeout
+		if c.RspamdTimeout != "" {
+			if timeout, err = time.ParseDuration(c.RspamdTimeout); err != nil {
+				return err
+			}
+		}
+		config, client = c, &http.Client{Timeout: timeout}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				reply, err := rspamdCheck(e, config, client)
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("rspamd failed")
+					if config.RspamdOnError == rspamdOnErrorTempFail {
+						return NewResult(response.Canned.ErrorBackendTransaction + "spam scan failed"), NewRetryableError(err)
+					}
+					return p.Process(e, task)
+				}
+				e.Values[ValueSpamScore] = reply.Score
+				switch reply.Action {
+				case rspamdActionReject:
+					Log().WithField("ip", e.RemoteIP).WithField("queued_id", e.QueuedId).
+						Infof("message rejected by rspamd, score %.2f", reply.Score)
+					if reply.Messages.SMTPMessage != "" {
+						return NewResult("550 5.7.1 " + reply.Messages.SMTPMessage), errSpamRejected
+					}
+					return NewResult(response.Canned.FailSpamRejected), errSpamRejected
+				case rspamdActionSoftReject:
+					Log().WithField("queued_id", e.QueuedId).Infof("message deferred by rspamd, score %.2f", reply.Score)
+					if reply.Messages.SMTPMessage != "" {
+						return NewResult("451 4.7.1 " + reply.Messages.SMTPMessage), errRspamdDeferred
+					}
+					return NewResult(response.Canned.ErrorMilterTempFail), errRspamdDeferred
+				case rspamdActionGreylist:
+					Log().WithField("queued_id", e.QueuedId).Infof("message greylisted by rspamd, score %.2f", reply.Score)
+					return NewResult(response.Canned.ErrorGreylisted), errRspamdDeferred
+				}
+				if mods := rspamdHeaderMods(e, reply, config); len(mods) > 0 {
+					milterApply(e, mods)
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// rspamdCheck posts e to rspamd's checkv2, and returns its reply
+func rspamdCheck(e *mail.Envelope, config *RspamdConfig, client *http.Client) (*rspamdReply, error) {
+	req, err := http.NewRequest(http.MethodPost, config.RspamdURL+"/checkv2", e.NewReader())
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(e.Context())
+	req.ContentLength = int64(e.Len())
+	req.Header.Set("Queue-Id", e.QueuedId)
+	req.Header.Set("IP", e.RemoteIP)
+	if e.Helo != "" {
+		req.Header.Set("Helo", e.Helo)
+	}
+	if !e.MailFrom.IsEmpty() {
+		req.Header.Set("From", e.MailFrom.String())
+	}
+	for _, rcpt := range e.RcptTo {
+		req.Header.Add("Rcpt", rcpt.String())
+	}
+	if ptr, ok := e.Values[ValuePTRName].(string); ok && ptr != "" {
+		req.Header.Set("Hostname", ptr)
+	}
+	if login, ok := e.Values[ValueAuthLogin].(string); ok && login != "" {
+		req.Header.Set("User", login)
+	}
+	if config.RspamdPassword != "" {
+		req.Header.Set("Password", config.RspamdPassword)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("rspamd replied with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	reply := &rspamdReply{}
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return nil, err
+	}
+	if reply.Action == "" {
+		return nil, errors.New("no action in the reply of rspamd")
+	}
+	return reply, nil
+}
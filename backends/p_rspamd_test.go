@@ -0,0 +1,160 @@
+package backends
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// rspamdTestServer replies to checkv2 with reply, and keeps the headers & the message of the request
+type rspamdTestServer struct {
+	*httptest.Server
+	reply   string
+	header  http.Header
+	message string
+	sync.Mutex
+}
+
+func newRspamdTestServer() *rspamdTestServer {
+	s := &rspamdTestServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+		if r.Method != http.MethodPost || r.URL.Path != "/checkv2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.header, s.message = r.Header, string(body)
+		if s.reply == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"cannot scan"}`))
+			return
+		}
+		w.Write([]byte(s.reply))
+	}))
+	return s
+}
+
+func (s *rspamdTestServer) setReply(reply string) {
+	s.Lock()
+	s.reply = reply
+	s.Unlock()
+}
+
+func TestRspamd(t *testing.T) {
+	s := newRspamdTestServer()
+	defer s.Close()
+	p := newTestProcessor(t, BackendConfig{
+		"rspamd_url":      s.URL + "/",
+		"rspamd_password": "secret",
+	}, Rspamd)
+	const message = "Subject: hello\nX-Spam: old\n\nhi\n"
+
+	s.setReply(`{"action":"no action","score":1.5,"required_score":15}`)
+	e := newAccountingEnvelope("alice@example.com", message, "bob@example.org", "carol@example.org")
+	e.Helo, e.DeliveryHeader = "mx.example.com", "Received: from mx.example.com\n"
+	e.Values[ValueAuthLogin] = "alice"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be accepted, got:", err)
+	}
+	s.Lock()
+	if h := s.header; h.Get("IP") != "203.0.113.5" || h.Get("Helo") != "mx.example.com" || h.Get("From") != "alice@example.com" ||
+		len(h["Rcpt"]) != 2 || h["Rcpt"][1] != "carol@example.org" || h.Get("Queue-Id") != e.QueuedId ||
+		h.Get("User") != "alice" || h.Get("Password") != "secret" {
+		t.Error("unexpected request headers:", h)
+	}
+	if s.message != e.DeliveryHeader+message {
+		t.Error("unexpected message:", s.message)
+	}
+	s.Unlock()
+	if e.Values[ValueSpamScore] != 1.5 || e.Data.String() != message {
+		t.Error("expecting the message as it was, with the score, got:", e.Values[ValueSpamScore], e.Data.String())
+	}
+
+	// add header, with the headers of the milter block
+	s.setReply(`{"action":"add header","score":7,"milter":{"remove_headers":{"X-Spam":0},` +
+		`"add_headers":{"X-Spamd-Result":{"value":"default: False [7.00 / 15.00]","order":1},"X-Rspamd-Server":"scan1"}}}`)
+	e = newAccountingEnvelope("alice@example.com", message, "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be accepted, got:", err)
+	}
+	if data := e.Data.String(); data != "Subject: hello\nX-Rspamd-Server: scan1\nX-Spamd-Result: default: False [7.00 / 15.00]\nX-Spam: Yes\n\nhi\n" {
+		t.Errorf("unexpected headers: %q", data)
+	}
+
+	// rewrite subject
+	s.setReply(`{"action":"rewrite subject","score":9,"subject":"[SPAM] héllo"}`)
+	e = newAccountingEnvelope("alice@example.com", message, "bob@example.org")
+	e.ParseHeaders()
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be accepted, got:", err)
+	}
+	if !strings.HasPrefix(e.Data.String(), "Subject: =?utf-8?q?[SPAM]_h=C3=A9llo?=\n") || e.Subject != "[SPAM] héllo" {
+		t.Errorf("expecting the subject to be rewritten, got: %q %q", e.Data.String(), e.Subject)
+	}
+
+	tests := []struct {
+		reply  string
+		result string
+	}{
+		{`{"action":"reject","score":20}`, response.Canned.FailSpamRejected},
+		{`{"action":"reject","score":20,"messages":{"smtp_message":"Spam message rejected"}}`, "550 5.7.1 Spam message rejected"},
+		{`{"action":"soft reject","score":0}`, response.Canned.ErrorMilterTempFail},
+		{`{"action":"greylist","score":5}`, response.Canned.ErrorGreylisted},
+	}
+	for _, test := range tests {
+		s.setReply(test.reply)
+		e = newAccountingEnvelope("alice@example.com", message, "bob@example.org")
+		result, err := p.Process(e, TaskSaveMail)
+		if err == nil || isRetryable(err) || result.String() != test.result {
+			t.Errorf("expecting %q from %s, got: %v %v", test.result, test.reply, result, err)
+		}
+	}
+
+	// rspamd failed, the message is accepted
+	s.setReply("")
+	e = newAccountingEnvelope("alice@example.com", message, "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.Values[ValueSpamScore] != nil {
+		t.Error("expecting the message to be accepted, got:", err)
+	}
+}
+
+func TestRspamdOnError(t *testing.T) {
+	s := newRspamdTestServer()
+	defer s.Close()
+	p := newTestProcessor(t, BackendConfig{
+		"rspamd_url":      s.URL,
+		"rspamd_on_error": "tempfail",
+	}, Rspamd)
+	for _, reply := range []string{"", `{"score":1}`, "{not json"} {
+		s.setReply(reply)
+		e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+		result, err := p.Process(e, TaskSaveMail)
+		if !isRetryable(err) || resultCode(result) != 451 {
+			t.Errorf("expecting the message to be retried after %q, got: %v %v", reply, result, err)
+		}
+	}
+}
+
+func TestRspamdConfig(t *testing.T) {
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"rspamd_url": "localhost:11333"}, "invalid rspamd_url"},
+		{BackendConfig{"rspamd_on_error": "reject"}, "invalid rspamd_on_error"},
+		{BackendConfig{"rspamd_timeout": "soon"}, "invalid duration"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, Rspamd)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
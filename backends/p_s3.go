@@ -0,0 +1,440 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// ValueS3Key is the e.Values key set to the key of the object that the s3 processor saved
+	// the message to, so that the processors after it can reference it
+	ValueS3Key = "s3_key"
+)
+
+const (
+	// default region, if 's3_region' not present in config
+	s3Region = "us-east-1"
+	// default time to wait for each request, if 's3_timeout' not present in config
+	s3Timeout = time.Second * 60
+	// default size of the parts of a multipart upload in MB, if 's3_part_size_mb' not present in config
+	s3PartSizeMB = 8
+	// the smallest part that S3 accepts, in MB
+	s3MinPartSizeMB = 5
+	// the SigV4 algorithm & service
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	s3Service   = "s3"
+)
+
+type S3Config struct {
+	// S3Bucket is the bucket that the messages are saved to
+	S3Bucket string `json:"s3_bucket"`
+	// S3Endpoint is the URL of the service, for S3-compatible storage such as MinIO,
+	// eg. "http://localhost:9000". The AWS endpoint of the region by default
+	S3Endpoint string `json:"s3_endpoint,omitempty"`
+	// S3Region is the region that the requests are signed for, eg. "eu-west-1"
+	S3Region string `json:"s3_region,omitempty"`
+	// S3PathStyle puts the bucket in the path of the URL, instead of the host name
+	S3PathStyle bool `json:"s3_path_style,omitempty"`
+	// S3Prefix is put before the QueuedId in the key of the objects, eg. "mail/"
+	S3Prefix string `json:"s3_prefix,omitempty"`
+	// S3AccessKey & S3SecretKey are the credentials, AWS_ACCESS_KEY_ID & AWS_SECRET_ACCESS_KEY by default
+	S3AccessKey string `json:"s3_access_key,omitempty"`
+	S3SecretKey string `json:"s3_secret_key,omitempty"`
+	// S3SSE is the server side encryption, "AES256" or "aws:kms"
+	S3SSE string `json:"s3_sse,omitempty"`
+	// S3SSEKMSKeyID is the KMS key used with "aws:kms", the default key of the account if empty
+	S3SSEKMSKeyID string `json:"s3_sse_kms_key_id,omitempty"`
+	// S3PartSizeMB is the size of the parts of messages that are uploaded in parts
+	S3PartSizeMB int `json:"s3_part_size_mb,omitempty"`
+	// S3Timeout is how long to wait for each request, eg. "60s"
+	S3Timeout string `json:"s3_timeout,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: s3
+// ----------------------------------------------------------------------------------
+// Description   : Saves the raw message to S3, or S3-compatible object storage such as
+//               : MinIO or Ceph, as an object keyed by the QueuedId. The requests are
+//               : signed with AWS Signature Version 4. Messages bigger than the part
+//               : size are sent with a multipart upload, which is aborted if it fails.
+//               : The key of the object is put in e.Values for the processors after
+//               : this one, eg. to save it to a database row
+// ----------------------------------------------------------------------------------
+// Config Options: s3_bucket string - the bucket to save to
+//               : s3_endpoint string - URL of the service, default the AWS endpoint of
+//               : the region, eg. "http://localhost:9000" for MinIO
+//               : s3_region string - default "us-east-1"
+//               : s3_path_style bool - the bucket goes in the path of the URL, for
+//               : most S3-compatible services
+//               : s3_prefix string - put before the QueuedId in the key, eg. "mail/"
+//               : s3_access_key string - default the AWS_ACCESS_KEY_ID environment var
+//               : s3_secret_key string - default the AWS_SECRET_ACCESS_KEY environment
+//               : var. AWS_SESSION_TOKEN is sent if it is set
+//               : s3_sse string - server side encryption, "AES256" or "aws:kms"
+//               : s3_sse_kms_key_id string - the KMS key of "aws:kms"
+//               : s3_part_size_mb int - bigger messages are uploaded in parts of this
+//               : size, at least 5, default 8
+//               : s3_timeout string - how long to wait for each request, default "60s"
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.QueuedId
+// ----------------------------------------------------------------------------------
+// Output        : the key of the object, eg. "mail/<QueuedId>.eml", in
+//               : e.Values[ValueS3Key]. A 451 if it could not be saved
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["s3"] = func() Decorator {
+		return S3()
+	}
+}
+
+// s3Client sends the signed requests to a bucket
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	pathStyle bool
+	accessKey string
+	secretKey string
+	token     string
+	sse       string
+	kmsKeyID  string
+	partSize  int
+	client    *http.Client
+}
+
+// s3ErrorResponse is the XML body of a failed request
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3Escape encodes s as SigV4 wants, everything but the unreserved characters. Slashes are
+// kept if path is true
+func s3Escape(s string, path bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+// s3Query returns the canonical query string of query, sorted by name
+func s3Query(query map[string]string) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, s3Escape(name, false)+"="+s3Escape(query[name], false))
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Sign adds the SigV4 Authorization header to req, signing the host & the headers that are set
+func s3Sign(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + s3Service + "/aws4_request"
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + s3Hash([]byte(canonicalRequest))
+
+	key := s3HMAC([]byte("AWS4"+secretKey), day)
+	key = s3HMAC(key, region)
+	key = s3HMAC(key, s3Service)
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", s3Algorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// url returns the URL of the object key, or of the bucket if key is empty
+func (c *s3Client) url(key string, query map[string]string) string {
+	u := *c.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if c.pathStyle {
+		path += "/" + s3Escape(c.bucket, false)
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	if key != "" || !c.pathStyle {
+		path += "/" + s3Escape(key, true)
+	}
+	s := u.Scheme + "://" + u.Host + path
+	if len(query) > 0 {
+		s += "?" + s3Query(query)
+	}
+	return s
+}
+
+// do sends a signed request, and returns the body of the reply. Returns an error if the
+// reply isn't a 2xx, or if the 200 of a completed multipart upload has an error
+func (c *s3Client) do(method, key string, query map[string]string, header http.Header, body []byte) (http.Header, []byte, error) {
+	req, err := http.NewRequest(method, c.url(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+	s3Sign(req, s3Hash(body), c.accessKey, c.secretKey, c.region, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 || bytes.Contains(b, []byte("<Error>")) {
+		var e s3ErrorResponse
+		xml.Unmarshal(b, &e)
+		return nil, nil, fmt.Errorf("s3 replied %s: %s %s", resp.Status, e.Code, e.Message)
+	}
+	return resp.Header, b, nil
+}
+
+// encryption returns the headers of the server side encryption of a new object
+func (c *s3Client) encryption() http.Header {
+	header := make(http.Header)
+	if c.sse != "" {
+		header.Set("X-Amz-Server-Side-Encryption", c.sse)
+		if c.kmsKeyID != "" {
+			header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", c.kmsKeyID)
+		}
+	}
+	return header
+}
+
+// put saves data to the object key, in parts if it is bigger than the part size
+func (c *s3Client) put(key string, data []byte) error {
+	header := c.encryption()
+	header.Set("Content-Type", "message/rfc822")
+	if len(data) <= c.partSize {
+		_, _, err := c.do(http.MethodPut, key, nil, header, data)
+		return err
+	}
+	_, b, err := c.do(http.MethodPost, key, map[string]string{"uploads": ""}, header, nil)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(b, &upload); err != nil || upload.UploadId == "" {
+		return fmt.Errorf("invalid reply to the multipart upload: %s", b)
+	}
+	err = c.putParts(key, upload.UploadId, data)
+	if err != nil {
+		// the parts are kept, and billed, until the upload is aborted
+		if _, _, abortErr := c.do(http.MethodDelete, key, map[string]string{"uploadId": upload.UploadId}, nil, nil); abortErr != nil {
+			Log().WithError(abortErr).Warn("could not abort the s3 upload of ", key)
+		}
+	}
+	return err
+}
+
+// s3Part is a part of a completed multipart upload
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// putParts uploads data in parts, then completes the upload
+func (c *s3Client) putParts(key, uploadID string, data []byte) error {
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{}
+	for n := 1; len(data) > 0; n++ {
+		part := data
+		if len(part) > c.partSize {
+			part = data[:c.partSize]
+		}
+		data = data[len(part):]
+		query := map[string]string{"partNumber": strconv.Itoa(n), "uploadId": uploadID}
+		header, _, err := c.do(http.MethodPut, key, query, nil, part)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: n, ETag: header.Get("ETag")})
+	}
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(http.MethodPost, key, map[string]string{"uploadId": uploadID}, nil, body)
+	return err
+}
+
+// newS3Client returns a client for the bucket of config
+func newS3Client(config *S3Config) (*s3Client, error) {
+	c := &s3Client{
+		bucket:    config.S3Bucket,
+		region:    config.S3Region,
+		pathStyle: config.S3PathStyle,
+		accessKey: config.S3AccessKey,
+		secretKey: config.S3SecretKey,
+		sse:       config.S3SSE,
+		kmsKeyID:  config.S3SSEKMSKeyID,
+		partSize:  s3PartSizeMB << 20,
+	}
+	if c.bucket == "" {
+		return nil, errors.New("s3_bucket cannot be empty")
+	}
+	if c.region == "" {
+		c.region = s3Region
+	}
+	endpoint := config.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.region + ".amazonaws.com"
+	}
+	var err error
+	if c.endpoint, err = url.Parse(endpoint); err != nil || (c.endpoint.Scheme != "http" && c.endpoint.Scheme != "https") {
+		return nil, errors.New("invalid s3_endpoint: " + endpoint)
+	}
+	if c.accessKey == "" && c.secretKey == "" {
+		c.accessKey, c.secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("s3_access_key and s3_secret_key must be set")
+	}
+	switch c.sse {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, errors.New("invalid s3_sse: " + c.sse)
+	}
+	if config.S3PartSizeMB != 0 {
+		if config.S3PartSizeMB < s3MinPartSizeMB {
+			return nil, fmt.Errorf("s3_part_size_mb must be at least %d", s3MinPartSizeMB)
+		}
+		c.partSize = config.S3PartSizeMB << 20
+	}
+	timeout := s3Timeout
+	if config.S3Timeout != "" {
+		if timeout, err = time.ParseDuration(config.S3Timeout); err != nil {
+			return nil, err
+		}
+	}
+	// shared by the workers, it keeps the connections alive
+	c.client = &http.Client{Timeout: timeout}
+	return c, nil
+}
+
+func S3() Decorator {
+
+	var (
+		client *s3Client
+		prefix string
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&S3Config{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*S3Config)
+		if client, err = newS3Client(config); err != nil {
+			return err
+		}
+		prefix = config.S3Prefix
+		return nil
+	}))
+
+	// the bucket can be reached with the credentials
+	Svc.AddPinger(PingWith(func() error {
+		if client == nil {
+			return errors.New("s3 is not initialized")
+		}
+		_, _, err := client.do(http.MethodHead, "", nil, nil, nil)
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				key := prefix + e.QueuedId + ".eml"
+				data := make([]byte, 0, len(e.DeliveryHeader)+e.Data.Len())
+				data = append(append(data, e.DeliveryHeader...), e.Data.Bytes()...)
+				if err := client.put(key, data); err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not save the message to s3")
+					return NewResult(response.Canned.ErrorBackendTransaction + "s3 save failed"), NewRetryableError(err)
+				}
+				e.Values[ValueS3Key] = key
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
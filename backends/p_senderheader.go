@@ -0,0 +1,167 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ValueSenderMismatch is the e.Values key set to the envelope sender when the senderheader
+// processor in "flag" mode finds that the Sender header is missing or does not match
+const ValueSenderMismatch = "sender_mismatch"
+
+const (
+	// a missing Sender header is added
+	senderModeAdd = "add"
+	// a missing Sender header is added, one that does not match is replaced
+	senderModeFix = "fix"
+	// the message is only flagged
+	senderModeFlag = "flag"
+)
+
+type SenderHeaderConfig struct {
+	// SenderHeaderMode is "add" (default), "fix" or "flag"
+	SenderHeaderMode string `json:"sender_header_mode,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: senderheader
+// ----------------------------------------------------------------------------------
+// Description   : Makes sure that mailing list & automated mail has a Sender header that
+//               : matches the envelope sender, when the From header is someone else,
+//               : eg. the poster of a list message (RFC 5322 3.6.2). A message is list or
+//               : automated mail if it has a List-Id header, a Precedence of list, bulk
+//               : or junk, or an Auto-Submitted header other than "no".
+//               : Bounces (null sender) are skipped
+// ----------------------------------------------------------------------------------
+// Config Options: sender_header_mode string - "add" (default) adds a missing Sender,
+//               : "fix" also replaces a Sender that does not match the envelope sender,
+//               : "flag" only adds a X-Sender-Mismatch header
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom
+//               : e.Header, use the headersparser processor before this one
+// ----------------------------------------------------------------------------------
+// Output        : The Sender is added to e.DeliveryHeader (place after the header processor).
+//               : In "fix" mode, the old Sender is removed from e.Data.
+//               : In "flag" mode, e.Values[ValueSenderMismatch] is set
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["senderheader"] = func() Decorator {
+		return SenderHeader()
+	}
+}
+
+func SenderHeader() Decorator {
+
+	var mode string
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SenderHeaderConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		mode = strings.ToLower(bcfg.(*SenderHeaderConfig).SenderHeaderMode)
+		switch mode {
+		case "":
+			mode = senderModeAdd
+		case senderModeAdd, senderModeFix, senderModeFlag:
+		default:
+			return errors.New("invalid sender_header_mode: " + mode)
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if e.MailFrom.IsEmpty() || e.Header == nil || !isListMail(e) {
+					return p.Process(e, task)
+				}
+				envelopeSender := e.MailFrom.String()
+				if fromIs(e.Header.Get("From"), envelopeSender) {
+					// the author sent it, no Sender needed
+					return p.Process(e, task)
+				}
+				sender := e.Header.Get("Sender")
+				if sender != "" && fromIs(sender, envelopeSender) {
+					return p.Process(e, task)
+				}
+				switch {
+				case mode == senderModeFlag:
+					e.Values[ValueSenderMismatch] = envelopeSender
+					e.DeliveryHeader += "X-Sender-Mismatch: " + envelopeSender + "\n"
+				case sender == "":
+					e.Header.Set("Sender", envelopeSender)
+					e.DeliveryHeader += "Sender: " + envelopeSender + "\n"
+				case mode == senderModeFix:
+					Log().WithField("queued_id", e.QueuedId).WithField("sender", sender).
+						Debug("replaced the Sender header with ", envelopeSender)
+					data := removeHeader(e.Data.Bytes(), "Sender")
+					e.Data.Reset()
+					e.Data.Write(data)
+					e.Header.Set("Sender", envelopeSender)
+					e.DeliveryHeader += "Sender: " + envelopeSender + "\n"
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// isListMail returns true if the headers show that e is from a mailing list or is automated
+func isListMail(e *mail.Envelope) bool {
+	if e.Header.Get("List-Id") != "" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(e.Header.Get("Precedence"))) {
+	case "list", "bulk", "junk":
+		return true
+	}
+	auto := strings.ToLower(strings.TrimSpace(e.Header.Get("Auto-Submitted")))
+	return auto != "" && auto != "no"
+}
+
+// fromIs returns true if header has a single address, which is addr
+func fromIs(header, addr string) bool {
+	list, err := mail.NewAddressList(header)
+	if err != nil || len(list) != 1 {
+		return false
+	}
+	return strings.EqualFold(list[0].String(), addr)
+}
+
+// removeHeader returns data without the header called name, including its folded lines
+func removeHeader(data []byte, name string) []byte {
+	out := make([]byte, 0, len(data))
+	prefix := []byte(strings.ToLower(name) + ":")
+	skipping := false
+	pos := 0
+	for pos < len(data) {
+		end := bytes.IndexByte(data[pos:], '\n')
+		if end == -1 {
+			end = len(data)
+		} else {
+			end += pos + 1
+		}
+		line := data[pos:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// end of the headers
+			return append(out, data[pos:]...)
+		}
+		folded := line[0] == ' ' || line[0] == '\t'
+		if !folded {
+			skipping = len(line) >= len(prefix) && bytes.Equal(bytes.ToLower(line[:len(prefix)]), prefix)
+		}
+		if !skipping {
+			out = append(out, line...)
+		}
+		pos = end
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func processSenderHeader(t *testing.T, p Processor, mailFrom, headers string) *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.MailFrom, _ = mail.NewAddress(mailFrom)
+	e.Data.WriteString(headers + "\nhello\n")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("senderheader failed:", err)
+	}
+	return e
+}
+
+func TestSenderHeaderAdd(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{}, SenderHeader, HeadersParser)
+	list := "List-Id: <dev.lists.example.org>\nFrom: Alice <alice@example.com>\n"
+
+	e := processSenderHeader(t, p, "dev-bounces@lists.example.org", list)
+	if e.DeliveryHeader != "Sender: dev-bounces@lists.example.org\n" {
+		t.Error("expecting the Sender to be added, got:", e.DeliveryHeader)
+	}
+	// a Sender that does not match is only replaced in fix mode
+	e = processSenderHeader(t, p, "dev-bounces@lists.example.org", list+"Sender: alice@example.com\n")
+	if e.DeliveryHeader != "" {
+		t.Error("expecting the Sender to be kept, got:", e.DeliveryHeader)
+	}
+	// the author sent it
+	if e = processSenderHeader(t, p, "alice@example.com", "List-Id: dev\nFrom: Alice <Alice@example.com>\n"); e.DeliveryHeader != "" {
+		t.Error("expecting no Sender when the author sent it, got:", e.DeliveryHeader)
+	}
+	for _, headers := range []string{
+		// already has the right Sender
+		list + "Sender: <dev-bounces@lists.example.org>\n",
+		// not list mail
+		"From: Alice <alice@example.com>\n",
+		"Precedence: normal\nAuto-Submitted: no\nFrom: Alice <alice@example.com>\n",
+	} {
+		if e = processSenderHeader(t, p, "dev-bounces@lists.example.org", headers); e.DeliveryHeader != "" {
+			t.Error("expecting no Sender for", headers, "got:", e.DeliveryHeader)
+		}
+	}
+	e = processSenderHeader(t, p, "noreply@example.net", "Auto-Submitted: auto-generated\nFrom: a@example.com, b@example.com\n")
+	if e.DeliveryHeader != "Sender: noreply@example.net\n" {
+		t.Error("expecting the Sender to be added for automated mail, got:", e.DeliveryHeader)
+	}
+}
+
+func TestSenderHeaderFix(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"sender_header_mode": "fix"}, SenderHeader, HeadersParser)
+	headers := "Precedence: list\nSender: Alice\n <alice@example.com>\nFrom: Alice <alice@example.com>\n"
+	e := processSenderHeader(t, p, "dev-bounces@lists.example.org", headers)
+	if e.DeliveryHeader != "Sender: dev-bounces@lists.example.org\n" {
+		t.Error("expecting the Sender to be replaced, got:", e.DeliveryHeader)
+	}
+	data := e.Data.String()
+	if strings.Contains(data, "Sender") || strings.Contains(data, " <alice@example.com>\nFrom") {
+		t.Error("expecting the old Sender to be removed, got:", data)
+	}
+	if data != "Precedence: list\nFrom: Alice <alice@example.com>\n\nhello\n" {
+		t.Error("expecting the other headers and the body to be kept, got:", data)
+	}
+	if e.Header.Get("Sender") != "dev-bounces@lists.example.org" {
+		t.Error("expecting e.Header to have the new Sender, got:", e.Header.Get("Sender"))
+	}
+}
+
+func TestSenderHeaderFlag(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"sender_header_mode": "flag"}, SenderHeader, HeadersParser)
+	e := processSenderHeader(t, p, "dev-bounces@lists.example.org", "List-Id: dev\nFrom: alice@example.com\n")
+	if e.Values[ValueSenderMismatch] != "dev-bounces@lists.example.org" {
+		t.Error("expecting the message to be flagged, got:", e.Values)
+	}
+	if e.DeliveryHeader != "X-Sender-Mismatch: dev-bounces@lists.example.org\n" {
+		t.Error("expecting a X-Sender-Mismatch header, got:", e.DeliveryHeader)
+	}
+
+	if _, errs := initTestProcessor(BackendConfig{"sender_header_mode": "remove"}, SenderHeader); errs == nil {
+		t.Error("expecting an error for an invalid sender_header_mode")
+	}
+}
@@ -0,0 +1,338 @@
+package backends
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default address of spamd, if 'spamd_address' not present in config
+	spamdAddress = "localhost:783"
+	// default time to wait to connect, if 'spamd_connect_timeout' not present in config
+	spamdConnectTimeout = time.Second * 5
+	// default time to wait for the scan, if 'spamd_timeout' not present in config
+	spamdTimeout = time.Second * 30
+	// default size of the largest message scanned, if 'spamd_max_size_kb' not present in config.
+	// The default of spamc
+	spamdMaxSizeKB = 500
+	// the most stars in X-Spam-Level
+	spamdMaxLevel = 50
+)
+
+// what to do when spamd fails
+const (
+	spamdOnErrorAccept   = "accept"
+	spamdOnErrorTempFail = "tempfail"
+)
+
+// ValueSpamScore is the e.Values key set to the score of the message given by spamd, a float64
+const ValueSpamScore = "spam_score"
+
+var errSpamRejected = errors.New("message rejected as spam")
+
+type SpamdConfig struct {
+	// SpamdAddress is spamd's socket, "host:port" or "unix:/path/to/socket"
+	SpamdAddress string `json:"spamd_address,omitempty"`
+	// SpamdUser is the user whose preferences spamd scans with, spamd's default if empty
+	SpamdUser string `json:"spamd_user,omitempty"`
+	// SpamdConnectTimeout is how long to wait to connect, eg. "5s"
+	SpamdConnectTimeout string `json:"spamd_connect_timeout,omitempty"`
+	// SpamdTimeout is how long to wait for the scan, eg. "30s"
+	SpamdTimeout string `json:"spamd_timeout,omitempty"`
+	// SpamdMaxSizeKB is the size of the largest message scanned, the larger ones are not
+	SpamdMaxSizeKB int `json:"spamd_max_size_kb,omitempty"`
+	// SpamdTagScore is the score from which the message is tagged as spam, the required
+	// score of spamd if 0
+	SpamdTagScore float64 `json:"spamd_tag_score,omitempty"`
+	// SpamdQuarantineScore is the score from which the message is quarantined, 0 to not quarantine
+	SpamdQuarantineScore float64 `json:"spamd_quarantine_score,omitempty"`
+	// SpamdQuarantineDir is the directory that the quarantined messages are saved to
+	SpamdQuarantineDir string `json:"spamd_quarantine_dir,omitempty"`
+	// SpamdRejectScore is the score from which the message is rejected, 0 to not reject
+	SpamdRejectScore float64 `json:"spamd_reject_score,omitempty"`
+	// SpamdOnError is what to do when spamd fails: "accept" (default) or "tempfail"
+	SpamdOnError string `json:"spamd_on_error,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: spamd
+// ----------------------------------------------------------------------------------
+// Description   : Scans the message with SpamAssassin's spamd, with the SPAMC protocol.
+//               : The score of the message is compared with the thresholds: from the
+//               : reject score, the message is rejected with a 550. From the
+//               : quarantine score, it is saved to the quarantine directory instead,
+//               : see the dumper. From the tag score, X-Spam-Flag: YES is added.
+//               : The X-Spam-Score, X-Spam-Level & X-Spam-Status headers are added to
+//               : each message scanned. Messages larger than spamd_max_size_kb are
+//               : not scanned. When spamd cannot be reached or fails, the message is
+//               : accepted without the headers, or deferred with spamd_on_error
+// ----------------------------------------------------------------------------------
+// Config Options: spamd_address string - "host:port", or "unix:/path/to/socket",
+//               : default "localhost:783"
+//               : spamd_user string - the user whose preferences are used
+//               : spamd_connect_timeout string - how long to wait to connect, default "5s"
+//               : spamd_timeout string - how long to wait for the scan, default "30s"
+//               : spamd_max_size_kb int - larger messages are not scanned, default 500
+//               : spamd_tag_score float - tag from this score, default the required
+//               : score of spamd
+//               : spamd_quarantine_score float - quarantine from this score, 0 to not
+//               : spamd_quarantine_dir string - where the quarantined messages are
+//               : saved, needed by spamd_quarantine_score
+//               : spamd_reject_score float - reject from this score, 0 to not
+//               : spamd_on_error string - when spamd fails, "accept" (default) or
+//               : "tempfail" the message
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+// ----------------------------------------------------------------------------------
+// Output        : e.Values[ValueSpamScore] and the X-Spam-* headers are appended to
+//               : e.DeliveryHeader (place after the header processor)
+//               : e.Values[ValueQuarantineDir] if quarantined
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["spamd"] = func() Decorator {
+		return Spamd()
+	}
+}
+
+// spamdReport is spamd's verdict on a message
+type spamdReport struct {
+	spam     bool
+	score    float64
+	required float64
+	// the names of the rules that matched
+	symbols []string
+}
+
+// loadConfig checks the config & sets the defaults
+func (c *SpamdConfig) loadConfig() error {
+	if c.SpamdAddress == "" {
+		c.SpamdAddress = spamdAddress
+	}
+	if c.SpamdMaxSizeKB < 0 {
+		return errors.New("spamd_max_size_kb cannot be negative")
+	} else if c.SpamdMaxSizeKB == 0 {
+		c.SpamdMaxSizeKB = spamdMaxSizeKB
+	}
+	if c.SpamdQuarantineScore != 0 && c.SpamdQuarantineDir == "" {
+		return errors.New("spamd_quarantine_score is set, spamd_quarantine_dir is required")
+	}
+	if c.SpamdQuarantineScore != 0 && c.SpamdRejectScore != 0 && c.SpamdQuarantineScore >= c.SpamdRejectScore {
+		return errors.New("spamd_quarantine_score must be under spamd_reject_score")
+	}
+	switch c.SpamdOnError {
+	case "":
+		c.SpamdOnError = spamdOnErrorAccept
+	case spamdOnErrorAccept, spamdOnErrorTempFail:
+	default:
+		return errors.New("invalid spamd_on_error: " + c.SpamdOnError)
+	}
+	return nil
+}
+
+// headers returns the X-Spam-* headers of the report, tagged if the score is from tagScore
+func (r *spamdReport) headers(tagScore float64) string {
+	var h strings.Builder
+	status := "No"
+	if r.score >= tagScore {
+		status = "Yes"
+		h.WriteString("X-Spam-Flag: YES\n")
+	}
+	fmt.Fprintf(&h, "X-Spam-Score: %.1f\n", r.score)
+	if level := int(r.score); level > 0 {
+		if level > spamdMaxLevel {
+			level = spamdMaxLevel
+		}
+		h.WriteString("X-Spam-Level: " + strings.Repeat("*", level) + "\n")
+	}
+	fmt.Fprintf(&h, "X-Spam-Status: %s, score=%.1f required=%.1f tests=%s\n",
+		status, r.score, tagScore, strings.Join(r.symbols, ","))
+	return h.String()
+}
+
+func Spamd() Decorator {
+
+	var (
+		config         *SpamdConfig
+		connectTimeout time.Duration
+		timeout        time.Duration
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SpamdConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		c := bcfg.(*SpamdConfig)
+		if err := c.loadConfig(); err != nil {
+			return err
+		}
+		connectTimeout = spamdConnectTimeout
+		if c.SpamdConnectTimeout != "" {
+			if connectTimeout, err = time.ParseDuration(c.SpamdConnectTimeout); err != nil {
+				return err
+			}
+		}
+		timeout = spamdTimeout
+		if c.SpamdTimeout != "" {
+			if timeout, err = time.ParseDuration(c.SpamdTimeout); err != nil {
+				return err
+			}
+		}
+		config = c
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if e.Len() > config.SpamdMaxSizeKB*1024 {
+					Log().WithField("queued_id", e.QueuedId).Debug("message too large for spamd, not scanned")
+					return p.Process(e, task)
+				}
+				report, err := spamdCheck(e, config, connectTimeout, timeout)
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("spamd failed")
+					if config.SpamdOnError == spamdOnErrorTempFail {
+						return NewResult(response.Canned.ErrorBackendTransaction + "spam scan failed"), NewRetryableError(err)
+					}
+					return p.Process(e, task)
+				}
+				if config.SpamdRejectScore != 0 && report.score >= config.SpamdRejectScore {
+					Log().WithField("ip", e.RemoteIP).WithField("queued_id", e.QueuedId).
+						Infof("message rejected by spamd, score %.1f", report.score)
+					return NewResult(response.Canned.FailSpamRejected), errSpamRejected
+				}
+				tagScore := config.SpamdTagScore
+				if tagScore == 0 {
+					tagScore = report.required
+				}
+				e.Values[ValueSpamScore] = report.score
+				e.DeliveryHeader += report.headers(tagScore)
+				if config.SpamdQuarantineScore != 0 && report.score >= config.SpamdQuarantineScore {
+					Log().WithField("queued_id", e.QueuedId).Infof("message quarantined by spamd, score %.1f", report.score)
+					e.Values[ValueQuarantineDir] = config.SpamdQuarantineDir
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// spamdCheck sends e to spamd with the SYMBOLS command, and returns its report
+func spamdCheck(e *mail.Envelope, config *SpamdConfig, connectTimeout, timeout time.Duration) (*spamdReport, error) {
+	network, address := "tcp", config.SpamdAddress
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	dialer := net.Dialer{Timeout: connectTimeout}
+	conn, err := dialer.DialContext(e.Context(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := e.Context().Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", e.Len())
+	if config.SpamdUser != "" {
+		fmt.Fprintf(w, "User: %s\r\n", config.SpamdUser)
+	}
+	w.WriteString("\r\n")
+	if _, err := io.Copy(w, e.NewReader()); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readSpamdReport(bufio.NewReader(conn))
+}
+
+// readSpamdReport reads the reply of spamd to the SYMBOLS command, eg.
+// SPAMD/1.1 0 EX_OK
+// Content-length: 24
+// Spam: True ; 15.3 / 5.0
+//
+// BAYES_99,URIBL_BLOCKED
+func readSpamdReport(r *bufio.Reader) (*spamdReport, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	status := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(status) < 2 || !strings.HasPrefix(status[0], "SPAMD/") {
+		return nil, errors.New("invalid reply from spamd: " + strings.TrimSpace(line))
+	}
+	if status[1] != "0" {
+		return nil, errors.New("spamd error: " + strings.Join(status[1:], " "))
+	}
+	report := &spamdReport{}
+	found := false
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid header from spamd: " + line)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "content-length":
+			if length, err = strconv.Atoi(strings.TrimSpace(kv[1])); err != nil {
+				return nil, errors.New("invalid header from spamd: " + line)
+			}
+		case "spam":
+			// True ; 15.3 / 5.0
+			var flag string
+			if _, err := fmt.Sscanf(strings.TrimSpace(kv[1]), "%s ; %g / %g", &flag, &report.score, &report.required); err != nil {
+				return nil, errors.New("invalid header from spamd: " + line)
+			}
+			report.spam = strings.EqualFold(flag, "true") || strings.EqualFold(flag, "yes")
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("no Spam header in the reply from spamd")
+	}
+	var body []byte
+	if length >= 0 {
+		body = make([]byte, length)
+		_, err = io.ReadFull(r, body)
+	} else {
+		body, err = ioutil.ReadAll(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, symbol := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			report.symbols = append(report.symbols, symbol)
+		}
+	}
+	return report, nil
+}
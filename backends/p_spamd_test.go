@@ -0,0 +1,195 @@
+package backends
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// spamdTestServer is a spamd that scores the messages with the number after "score=" in
+// their subject, and replies with an error to the messages without one
+type spamdTestServer struct {
+	net.Listener
+	users    []string
+	messages []string
+	sync.Mutex
+}
+
+func newSpamdTestServer(t *testing.T) *spamdTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &spamdTestServer{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *spamdTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if line, _ := r.ReadString('\n'); line != "SYMBOLS SPAMC/1.5\r\n" {
+		fmt.Fprintf(conn, "SPAMD/1.5 76 Bad header line: %s", line)
+		return
+	}
+	length, user := 0, ""
+	for {
+		line, _ := r.ReadString('\n')
+		if line == "\r\n" || line == "" {
+			break
+		}
+		kv := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+		switch kv[0] {
+		case "Content-length":
+			length, _ = strconv.Atoi(kv[1])
+		case "User":
+			user = kv[1]
+		}
+	}
+	message := make([]byte, length)
+	io.ReadFull(r, message)
+	s.Lock()
+	s.users, s.messages = append(s.users, user), append(s.messages, string(message))
+	s.Unlock()
+	i := strings.Index(string(message), "score=")
+	if i == -1 {
+		conn.Write([]byte("SPAMD/1.5 74 EX_NOUSER\r\n\r\n"))
+		return
+	}
+	score := strings.Fields(string(message[i+6:]))[0]
+	symbols := "BAYES_99,URIBL_BLOCKED"
+	fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: False ; %s / 5.0\r\n\r\n%s", len(symbols), score, symbols)
+}
+
+func TestSpamd(t *testing.T) {
+	s := newSpamdTestServer(t)
+	defer s.Close()
+	p := newTestProcessor(t, BackendConfig{
+		"spamd_address":          s.Addr().String(),
+		"spamd_user":             "mail",
+		"spamd_quarantine_score": 10,
+		"spamd_quarantine_dir":   "/var/spool/quarantine",
+		"spamd_reject_score":     15.5,
+	}, Spamd)
+	tests := []struct {
+		score      string
+		headers    string
+		quarantine bool
+	}{
+		{"-1.2", "X-Spam-Score: -1.2\nX-Spam-Status: No, score=-1.2 required=5.0 tests=BAYES_99,URIBL_BLOCKED\n", false},
+		{"6.3", "X-Spam-Flag: YES\nX-Spam-Score: 6.3\nX-Spam-Level: ******\n" +
+			"X-Spam-Status: Yes, score=6.3 required=5.0 tests=BAYES_99,URIBL_BLOCKED\n", false},
+		{"12", "X-Spam-Flag: YES\nX-Spam-Score: 12.0\nX-Spam-Level: ************\n" +
+			"X-Spam-Status: Yes, score=12.0 required=5.0 tests=BAYES_99,URIBL_BLOCKED\n", true},
+	}
+	for _, test := range tests {
+		e := newAccountingEnvelope("alice@example.com", "Subject: score="+test.score+"\n\nhi\n", "bob@example.org")
+		e.DeliveryHeader = "Received: from mx.example.com\n"
+		if _, err := p.Process(e, TaskSaveMail); err != nil {
+			t.Fatal("the message should be accepted, got:", err)
+		}
+		if e.DeliveryHeader != "Received: from mx.example.com\n"+test.headers {
+			t.Errorf("score %s: unexpected headers: %q", test.score, e.DeliveryHeader)
+		}
+		if score, _ := strconv.ParseFloat(test.score, 64); e.Values[ValueSpamScore] != score {
+			t.Errorf("score %s: unexpected score: %v", test.score, e.Values[ValueSpamScore])
+		}
+		if _, ok := e.Values[ValueQuarantineDir]; ok != test.quarantine {
+			t.Errorf("score %s: expecting quarantine to be %v", test.score, test.quarantine)
+		}
+	}
+	s.Lock()
+	if len(s.users) != 3 || s.users[0] != "mail" || !strings.HasPrefix(s.messages[0], "Received: from mx.example.com\nSubject:") {
+		t.Error("unexpected requests:", s.users, s.messages)
+	}
+	s.Unlock()
+
+	e := newAccountingEnvelope("alice@example.com", "Subject: score=20.1\n\nhi\n", "bob@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if err == nil || result.String() != response.Canned.FailSpamRejected {
+		t.Error("expecting the message to be rejected, got:", result, err)
+	}
+	// spamd failed, the message is accepted without the headers
+	e = newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil || e.DeliveryHeader != "" {
+		t.Error("expecting the message to be accepted, got:", err, e.DeliveryHeader)
+	}
+}
+
+func TestSpamdOnError(t *testing.T) {
+	s := newSpamdTestServer(t)
+	s.Close()
+	p := newTestProcessor(t, BackendConfig{
+		"spamd_address":     s.Addr().String(),
+		"spamd_on_error":    "tempfail",
+		"spamd_max_size_kb": 1,
+	}, Spamd)
+	e := newAccountingEnvelope("alice@example.com", "Subject: score=1\n\nhi\n", "bob@example.org")
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the message to be retried, got:", result, err)
+	}
+	// too large to be scanned
+	e = newAccountingEnvelope("alice@example.com", "Subject: score=1\n\n"+strings.Repeat("x", 2048), "bob@example.org")
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Error("expecting the message to be accepted, got:", err)
+	}
+}
+
+func TestSpamdReport(t *testing.T) {
+	tests := []struct {
+		reply string
+		err   string
+	}{
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: Yes ; 3.5 / 2.0\r\n\r\nA, B\r\n", ""},
+		{"SPAMD/1.1 0 EX_OK\r\n\r\n", "no Spam header"},
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: maybe\r\n\r\n", "invalid header"},
+		{"SPAMD/1.5 76 Bad header line\r\n", "spamd error: 76 Bad header line"},
+		{"HTTP/1.1 400 Bad Request\r\n", "invalid reply"},
+	}
+	for _, test := range tests {
+		report, err := readSpamdReport(bufio.NewReader(strings.NewReader(test.reply)))
+		if test.err == "" {
+			if err != nil || !report.spam || report.score != 3.5 || report.required != 2 ||
+				len(report.symbols) != 2 || report.symbols[1] != "B" {
+				t.Error("unexpected report:", report, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expecting %q from %q, got: %v", test.err, test.reply, err)
+		}
+	}
+}
+
+func TestSpamdConfig(t *testing.T) {
+	tests := []struct {
+		config BackendConfig
+		err    string
+	}{
+		{BackendConfig{"spamd_max_size_kb": -1}, "cannot be negative"},
+		{BackendConfig{"spamd_quarantine_score": 8}, "spamd_quarantine_dir is required"},
+		{BackendConfig{"spamd_quarantine_score": 8, "spamd_quarantine_dir": "/tmp", "spamd_reject_score": 8}, "must be under"},
+		{BackendConfig{"spamd_on_error": "reject"}, "invalid spamd_on_error"},
+		{BackendConfig{"spamd_timeout": "soon"}, "invalid duration"},
+	}
+	for _, test := range tests {
+		_, errs := initTestProcessor(test.config, Spamd)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package backends
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ValueSenderAuthenticated is the e.Values key that processors which authenticate the sender
+// (eg. SPF, DKIM or DMARC checks) set to true when the sender passed authentication
+const ValueSenderAuthenticated = "sender_authenticated"
+
+// ValueSpoofedDomain is the e.Values key set to the spoofed internal domain when the spoofcheck
+// processor flags a message, or to SpoofInvalidFrom if the From header could not be parsed
+const ValueSpoofedDomain = "spoofed_internal_domain"
+
+// SpoofInvalidFrom is reported instead of a domain when the From header could not be parsed
+const SpoofInvalidFrom = "invalid-from"
+
+const (
+	spoofModeReject = "reject"
+	spoofModeFlag   = "flag"
+)
+
+type SpoofCheckConfig struct {
+	// comma separated list of our own (hosted) domains
+	InternalDomains string `json:"spoof_internal_domains"`
+	// comma separated list of IPs / CIDRs that are considered internal sources
+	TrustedNetworks string `json:"spoof_trusted_networks,omitempty"`
+	// comma separated list of sender addresses, IPs or CIDRs allowed to use our domains from outside
+	AllowedSenders string `json:"spoof_allowed_senders,omitempty"`
+	// "reject" (default) or "flag"
+	Mode string `json:"spoof_mode,omitempty"`
+}
+
+// spoofChecker holds the parsed SpoofCheckConfig
+type spoofChecker struct {
+	domains        []string
+	trusted        []*net.IPNet
+	allowedIPs     []*net.IPNet
+	allowedSenders map[string]bool
+	flag           bool
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: spoofcheck
+// ----------------------------------------------------------------------------------
+// Description   : Detects external messages claiming to be from one of our own domains
+//               : in the MAIL FROM or the From header, without passing authentication.
+//               : A From header that cannot be parsed is treated as spoofed
+// ----------------------------------------------------------------------------------
+// Config Options: spoof_internal_domains string - comma separated list of our domains
+//               : spoof_trusted_networks string - comma separated IPs/CIDRs of internal sources
+//               : spoof_allowed_senders string - comma separated addresses/IPs/CIDRs exempt from the check
+//               : spoof_mode string - "reject" (default) rejects the message,
+//               : "flag" lets it through with a X-Spoofed-Sender header
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP
+//               : e.MailFrom
+//               : e.Header (From), use the headersparser processor before this one
+//               : e.Values[ValueSenderAuthenticated]
+// ----------------------------------------------------------------------------------
+// Output        : In "flag" mode, e.Values[ValueSpoofedDomain] is set and a header is
+//               : appended to e.DeliveryHeader (place after the header processor)
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["spoofcheck"] = func() Decorator {
+		return SpoofCheck()
+	}
+}
+
+// newSpoofChecker parses the config
+func newSpoofChecker(config *SpoofCheckConfig) (*spoofChecker, error) {
+	s := &spoofChecker{allowedSenders: make(map[string]bool)}
+	for _, d := range splitList(config.InternalDomains) {
+		host, err := mail.ASCIIHost(d)
+		if err != nil {
+			return nil, err
+		}
+		s.domains = append(s.domains, strings.ToLower(host))
+	}
+	if len(s.domains) == 0 {
+		return nil, errors.New("spoof_internal_domains cannot be empty")
+	}
+	for _, n := range splitList(config.TrustedNetworks) {
+		ipNet, err := parseNetwork(n)
+		if err != nil {
+			return nil, err
+		}
+		s.trusted = append(s.trusted, ipNet)
+	}
+	for _, a := range splitList(config.AllowedSenders) {
+		if strings.Contains(a, "@") {
+			s.allowedSenders[strings.ToLower(a)] = true
+			continue
+		}
+		ipNet, err := parseNetwork(a)
+		if err != nil {
+			return nil, err
+		}
+		s.allowedIPs = append(s.allowedIPs, ipNet)
+	}
+	switch strings.ToLower(config.Mode) {
+	case "", spoofModeReject:
+		s.flag = false
+	case spoofModeFlag:
+		s.flag = true
+	default:
+		return nil, errors.New("invalid spoof_mode: " + config.Mode)
+	}
+	return s, nil
+}
+
+// internalDomain returns the internal domain that host belongs to, or an empty string
+func (s *spoofChecker) internalDomain(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range s.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return d
+		}
+	}
+	return ""
+}
+
+// check returns the internal domain being spoofed, SpoofInvalidFrom if the From header
+// cannot be parsed, or an empty string if e is fine
+func (s *spoofChecker) check(e *mail.Envelope) string {
+	ip := net.ParseIP(e.RemoteIP)
+	if ip != nil && (inNetworks(ip, s.trusted) || inNetworks(ip, s.allowedIPs)) {
+		return ""
+	}
+	if authenticated, ok := e.Values[ValueSenderAuthenticated].(bool); ok && authenticated {
+		return ""
+	}
+	senders := make([]mail.Address, 0, 2)
+	if !e.MailFrom.IsEmpty() {
+		senders = append(senders, e.MailFrom)
+	}
+	if from := e.Header.Get("From"); from != "" {
+		// the From header may have several addresses, all of them are checked
+		list, err := mail.NewAddressList(from)
+		if err != nil {
+			return SpoofInvalidFrom
+		}
+		senders = append(senders, list...)
+	}
+	for i := range senders {
+		if s.allowedSenders[strings.ToLower(senders[i].String())] {
+			continue
+		}
+		if d := s.internalDomain(senders[i].Host); d != "" {
+			return d
+		}
+	}
+	return ""
+}
+
+func SpoofCheck() Decorator {
+
+	var checker *spoofChecker
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SpoofCheckConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		checker, err = newSpoofChecker(bcfg.(*SpoofCheckConfig))
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				if domain := checker.check(e); domain != "" {
+					if !checker.flag {
+						Log().WithField("ip", e.RemoteIP).Info("rejected spoofed message: ", domain)
+						return NewResult(response.Canned.FailSpoofedSender), errors.New("spoofed internal domain: " + domain)
+					}
+					e.Values[ValueSpoofedDomain] = domain
+					e.DeliveryHeader += "X-Spoofed-Sender: " + domain + "\n"
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// splitList splits a comma separated config value, skipping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseNetwork parses a CIDR, or a single IP which is converted to a /32 (or /128) network
+func parseNetwork(n string) (*net.IPNet, error) {
+	if !strings.Contains(n, "/") {
+		ip := net.ParseIP(n)
+		if ip == nil {
+			return nil, errors.New("invalid IP address: " + n)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(n)
+	return ipNet, err
+}
+
+// inNetworks returns true if ip is in any of the networks
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
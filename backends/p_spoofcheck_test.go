@@ -0,0 +1,101 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func newSpoofCheckEnvelope(ip, mailFrom, headers string) *mail.Envelope {
+	e := mail.NewEnvelope(ip, 1)
+	if mailFrom != "" {
+		e.MailFrom, _ = mail.NewAddress(mailFrom)
+	}
+	e.Data.WriteString(headers + "\nhello\n")
+	return e
+}
+
+func TestSpoofCheckReject(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{
+		"spoof_internal_domains": "example.com, example.org",
+		"spoof_trusted_networks": "10.0.0.0/8",
+		"spoof_allowed_senders":  "alerts@example.com, 192.0.2.10",
+	}, SpoofCheck, HeadersParser)
+
+	// external message with our domain in the From header
+	e := newSpoofCheckEnvelope("203.0.113.5", "ceo@evil.test", "From: CEO <ceo@Example.com>\n")
+	result, err := p.Process(e, TaskSaveMail)
+	if err == nil || result.Code() != 550 {
+		t.Error("expected message to be rejected with 550, got:", result, err)
+	}
+	// subdomain in MAIL FROM
+	e = newSpoofCheckEnvelope("203.0.113.5", "ceo@mail.example.org", "From: ceo@evil.test\n")
+	if result, _ := p.Process(e, TaskSaveMail); result.Code() != 550 {
+		t.Error("expected subdomain to be rejected with 550, got:", result)
+	}
+
+	// internal source
+	e = newSpoofCheckEnvelope("10.1.2.3", "ceo@example.com", "From: ceo@example.com\n")
+	if result, err := p.Process(e, TaskSaveMail); err != nil || result.Code() != 200 {
+		t.Error("internal message should pass, got:", result, err)
+	}
+	// authenticated sender
+	e = newSpoofCheckEnvelope("203.0.113.5", "ceo@example.com", "From: ceo@example.com\n")
+	e.Values[ValueSenderAuthenticated] = true
+	if result, err := p.Process(e, TaskSaveMail); err != nil || result.Code() != 200 {
+		t.Error("authenticated message should pass, got:", result, err)
+	}
+	// exceptions by address and by ip
+	e = newSpoofCheckEnvelope("203.0.113.5", "alerts@example.com", "From: alerts@example.com\n")
+	if result, err := p.Process(e, TaskSaveMail); err != nil || result.Code() != 200 {
+		t.Error("allowed sender should pass, got:", result, err)
+	}
+	e = newSpoofCheckEnvelope("192.0.2.10", "news@example.com", "From: news@example.com\n")
+	if result, err := p.Process(e, TaskSaveMail); err != nil || result.Code() != 200 {
+		t.Error("allowed ip should pass, got:", result, err)
+	}
+	// not our domain
+	e = newSpoofCheckEnvelope("203.0.113.5", "someone@notexample.com", "From: someone@notexample.com\n")
+	if result, err := p.Process(e, TaskSaveMail); err != nil || result.Code() != 200 {
+		t.Error("external domain should pass, got:", result, err)
+	}
+	// our domain hidden behind another address in the From header
+	e = newSpoofCheckEnvelope("203.0.113.5", "ceo@evil.test", "From: Someone <someone@evil.test>, CEO <ceo@example.com>\n")
+	if result, _ := p.Process(e, TaskSaveMail); result.Code() != 550 {
+		t.Error("expected multi-address From to be rejected with 550, got:", result)
+	}
+	e = newSpoofCheckEnvelope("203.0.113.5", "a@evil.test", "From: a@evil.test, b@notexample.com\n")
+	if result, err := p.Process(e, TaskSaveMail); err != nil || result.Code() != 200 {
+		t.Error("multi-address From with external domains should pass, got:", result, err)
+	}
+	// unparseable From header
+	e = newSpoofCheckEnvelope("203.0.113.5", "ceo@evil.test", "From: ceo@example.com <<broken\n")
+	if result, _ := p.Process(e, TaskSaveMail); result.Code() != 550 {
+		t.Error("expected unparseable From to be rejected with 550, got:", result)
+	}
+}
+
+func TestSpoofCheckFlag(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{
+		"spoof_internal_domains": "example.com",
+		"spoof_mode":             "flag",
+	}, SpoofCheck, HeadersParser)
+	e := newSpoofCheckEnvelope("203.0.113.5", "ceo@evil.test", "From: ceo@example.com\n")
+	if result, err := p.Process(e, TaskSaveMail); err != nil || result.Code() != 200 {
+		t.Error("flagged message should pass, got:", result, err)
+	}
+	if e.Values[ValueSpoofedDomain] != "example.com" {
+		t.Error("expected", ValueSpoofedDomain, "to be example.com, got:", e.Values[ValueSpoofedDomain])
+	}
+	if !strings.Contains(e.DeliveryHeader, "X-Spoofed-Sender: example.com") {
+		t.Error("expected X-Spoofed-Sender header, got:", e.DeliveryHeader)
+	}
+	e = newSpoofCheckEnvelope("203.0.113.5", "ceo@evil.test", "From: <<broken\n")
+	if result, err := p.Process(e, TaskSaveMail); err != nil || result.Code() != 200 {
+		t.Error("flagged message should pass, got:", result, err)
+	}
+	if e.Values[ValueSpoofedDomain] != SpoofInvalidFrom {
+		t.Error("expected", ValueSpoofedDomain, "to be", SpoofInvalidFrom, "got:", e.Values[ValueSpoofedDomain])
+	}
+}
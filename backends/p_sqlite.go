@@ -0,0 +1,226 @@
+package backends
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: sqlite
+// ----------------------------------------------------------------------------------
+// Description   : Saves the e.Data (email data) and e.DeliveryHeader together in a local
+//               : SQLite file, for single-node & development installs that don't have
+//               : a database server. The file is opened in WAL mode, and the schema is
+//               : created or migrated when the backend starts, versioned by the
+//               : user_version of the file. The SQLite driver needs cgo, the binary
+//               : must be built with the sqlite tag: go build -tags sqlite
+// ----------------------------------------------------------------------------------
+// Config Options: sqlite_path string - the database file, eg. /var/lib/guerrilla/mail.db,
+//               : created if it does not exist
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.DeliveryHeader generated by the header processor
+//               : e.MailFrom, e.RcptTo, e.RemoteIP, e.Helo
+//               : e.Subject, parsed if the headersparser processor didn't
+// ----------------------------------------------------------------------------------
+// Output        : a row in the messages table. If the file is locked or can't be
+//               : written, replies with a 451 so that the save is retried
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["sqlite"] = func() Decorator {
+		return SQLite()
+	}
+}
+
+// sqliteDriverName can be changed for testing
+var sqliteDriverName = "sqlite3"
+
+// milliseconds a statement waits for the lock of another connection to the file
+const sqliteBusyTimeout = 5000
+
+// sqliteMigrations are the changes to the schema, in order. The user_version of the file is
+// the number of the migrations that were applied to it. Append new ones, never change them
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		queued_id TEXT NOT NULL,
+		received_at INTEGER NOT NULL,
+		remote_ip TEXT NOT NULL,
+		helo TEXT NOT NULL,
+		mail_from TEXT NOT NULL,
+		rcpt_to TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		data BLOB NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS messages_queued_id ON messages (queued_id);`,
+}
+
+const sqliteInsert = "INSERT INTO messages " +
+	"(queued_id, received_at, remote_ip, helo, mail_from, rcpt_to, subject, data) " +
+	"VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+
+type SQLiteConfig struct {
+	// SQLitePath is the database file
+	SQLitePath string `json:"sqlite_path"`
+}
+
+// openSQLite opens the database at path in WAL mode, and migrates its schema
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open sqlite, was the binary built with -tags sqlite? %s", err)
+	}
+	// SQLite has a single writer, the connections would only wait for each other's locks
+	db.SetMaxOpenConns(1)
+	var mode string
+	if err = db.QueryRow("PRAGMA journal_mode=WAL").Scan(&mode); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open sqlite_path %s: %s", path, err)
+	}
+	if !strings.EqualFold(mode, "wal") {
+		Log().WithField("path", path).Warn("sqlite did not switch to WAL mode, the journal mode is ", mode)
+	}
+	if _, err = db.Exec("PRAGMA busy_timeout=" + strconv.Itoa(sqliteBusyTimeout)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot migrate sqlite_path %s: %s", path, err)
+	}
+	return db, nil
+}
+
+// migrateSQLite applies the sqliteMigrations that the file doesn't have yet, each in a transaction
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("the schema version %d is newer than this build knows (%d)", version, len(sqliteMigrations))
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqliteMigrations[version]); err == nil {
+			// a pragma does not take arguments
+			_, err = tx.Exec("PRAGMA user_version=" + strconv.Itoa(version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %s", version+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		Log().Info("migrated the sqlite schema to version ", version+1)
+	}
+	return nil
+}
+
+func SQLite() Decorator {
+
+	var (
+		db *sql.DB
+		// guards db
+		mu sync.Mutex
+	)
+
+	conn := func() *sql.DB {
+		mu.Lock()
+		defer mu.Unlock()
+		return db
+	}
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SQLiteConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*SQLiteConfig)
+		if config.SQLitePath == "" {
+			return errors.New("sqlite_path cannot be empty")
+		}
+		d, err := openSQLite(config.SQLitePath)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		db = d
+		mu.Unlock()
+		Log().Info("opened sqlite ", config.SQLitePath)
+		return nil
+	}))
+
+	// shutdown will close the database
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if db == nil {
+			return nil
+		}
+		err := db.Close()
+		db = nil
+		return err
+	}))
+
+	// the readiness check pings the database
+	Svc.AddPinger(PingWith(func() error {
+		d := conn()
+		if d == nil {
+			return errors.New("sqlite is not open")
+		}
+		return d.Ping()
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				d := conn()
+				if d == nil {
+					return NewResult(response.Canned.ErrorBackendTransaction + "storage not available"), StorageNotAvailable
+				}
+				if e.Header == nil {
+					// the subject is not parsed yet
+					e.ParseHeaders()
+				}
+				rcpts := make([]string, len(e.RcptTo))
+				for i := range e.RcptTo {
+					rcpts[i] = e.RcptTo[i].String()
+				}
+				data := make([]byte, 0, len(e.DeliveryHeader)+e.Data.Len())
+				data = append(append(data, e.DeliveryHeader...), e.Data.Bytes()...)
+				_, err := d.ExecContext(e.Context(), sqliteInsert,
+					e.QueuedId,
+					time.Now().Unix(),
+					e.RemoteIP,
+					e.Helo,
+					e.MailFrom.String(),
+					strings.Join(rcpts, ","),
+					e.Subject,
+					data,
+				)
+				if err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Error("could not save email to sqlite")
+					return NewResult(response.Canned.ErrorBackendTransaction + "storage not available"), NewRetryableError(err)
+				}
+				// continue to the next Processor in the decorator chain
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package backends
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// the sqlite driver keeps the statements it ran, and the user_version of its file
+var (
+	sqliteTestExecs   []string
+	sqliteTestArgs    [][]driver.Value
+	sqliteTestVersion int64
+	sqliteTestFail    error
+	sqliteTestMu      sync.Mutex
+)
+
+func init() {
+	sql.Register("sqlitetest", sqliteTestDriver{})
+}
+
+type sqliteTestDriver struct{}
+
+func (sqliteTestDriver) Open(name string) (driver.Conn, error) {
+	return sqliteTestConn{}, nil
+}
+
+type sqliteTestConn struct{}
+
+func (sqliteTestConn) Prepare(query string) (driver.Stmt, error) {
+	return sqliteTestStmt(query), nil
+}
+
+func (sqliteTestConn) Close() error { return nil }
+
+func (sqliteTestConn) Begin() (driver.Tx, error) {
+	return sqliteTestTx{}, nil
+}
+
+type sqliteTestTx struct{}
+
+func (sqliteTestTx) Commit() error   { return nil }
+func (sqliteTestTx) Rollback() error { return nil }
+
+type sqliteTestStmt string
+
+func (sqliteTestStmt) Close() error  { return nil }
+func (sqliteTestStmt) NumInput() int { return -1 }
+
+func (s sqliteTestStmt) Exec(args []driver.Value) (driver.Result, error) {
+	sqliteTestMu.Lock()
+	defer sqliteTestMu.Unlock()
+	query := string(s)
+	if strings.HasPrefix(query, "INSERT") && sqliteTestFail != nil {
+		return nil, sqliteTestFail
+	}
+	if strings.HasPrefix(query, "PRAGMA user_version=") {
+		sqliteTestVersion, _ = strconv.ParseInt(strings.TrimPrefix(query, "PRAGMA user_version="), 10, 64)
+	}
+	sqliteTestExecs = append(sqliteTestExecs, query)
+	sqliteTestArgs = append(sqliteTestArgs, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s sqliteTestStmt) Query(args []driver.Value) (driver.Rows, error) {
+	sqliteTestMu.Lock()
+	defer sqliteTestMu.Unlock()
+	switch string(s) {
+	case "PRAGMA journal_mode=WAL":
+		return &sqliteTestRows{value: "wal"}, nil
+	case "PRAGMA user_version":
+		return &sqliteTestRows{value: sqliteTestVersion}, nil
+	}
+	return nil, errors.New("unexpected query: " + string(s))
+}
+
+// sqliteTestRows is the single row of a pragma
+type sqliteTestRows struct {
+	value driver.Value
+	read  bool
+}
+
+func (r *sqliteTestRows) Columns() []string { return []string{"pragma"} }
+func (r *sqliteTestRows) Close() error      { return nil }
+func (r *sqliteTestRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	dest[0], r.read = r.value, true
+	return nil
+}
+
+// resetSQLiteTest empties the file of the sqlite driver
+func resetSQLiteTest() {
+	sqliteTestExecs, sqliteTestArgs = nil, nil
+	sqliteTestVersion, sqliteTestFail = 0, nil
+}
+
+func TestSQLite(t *testing.T) {
+	defer func(name string) {
+		sqliteDriverName = name
+	}(sqliteDriverName)
+	sqliteDriverName = "sqlitetest"
+	resetSQLiteTest()
+
+	p := newTestProcessor(t, BackendConfig{"sqlite_path": "mail.db"}, SQLite)
+	if len(sqliteTestExecs) != 3 || sqliteTestExecs[0] != "PRAGMA busy_timeout=5000" ||
+		sqliteTestExecs[1] != sqliteMigrations[0] || sqliteTestExecs[2] != "PRAGMA user_version=1" {
+		t.Fatal("expecting the busy timeout & the schema to be set, got:", sqliteTestExecs)
+	}
+
+	e := newAccountingEnvelope("alice@example.com", "Subject: hello\n\nhi\n", "bob@example.org", "carol@example.org")
+	e.QueuedId = "q1"
+	e.Helo = "mx.example.com"
+	e.DeliveryHeader = "Received: from mx.example.com\n"
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be saved, got:", err)
+	}
+	if len(sqliteTestExecs) != 4 || sqliteTestExecs[3] != sqliteInsert {
+		t.Fatal("expecting the message to be inserted, got:", sqliteTestExecs)
+	}
+	args := sqliteTestArgs[3]
+	if args[0] != "q1" || args[2] != "203.0.113.5" || args[3] != "mx.example.com" ||
+		args[4] != "alice@example.com" || args[5] != "bob@example.org,carol@example.org" || args[6] != "hello" {
+		t.Error("unexpected row:", args)
+	}
+	if received, ok := args[1].(int64); !ok || received <= 0 {
+		t.Error("expecting the time received, got:", args[1])
+	}
+	if data, _ := args[7].([]byte); string(data) != "Received: from mx.example.com\nSubject: hello\n\nhi\n" {
+		t.Error("expecting the delivery header & the message, got:", string(data))
+	}
+
+	// the file is locked
+	sqliteTestFail = errors.New("database is locked")
+	result, err := p.Process(e, TaskSaveMail)
+	if !isRetryable(err) || resultCode(result) != 451 {
+		t.Error("expecting the save to be retried, got:", result, err)
+	}
+	if err := Svc.shutdown(); err != nil {
+		t.Fatal("shutdown failed:", err)
+	}
+
+	// opened again, the schema is up to date
+	sqliteTestExecs, sqliteTestFail = nil, nil
+	newTestProcessor(t, BackendConfig{"sqlite_path": "mail.db"}, SQLite)
+	if len(sqliteTestExecs) != 1 {
+		t.Error("expecting no migration, got:", sqliteTestExecs)
+	}
+	Svc.shutdown()
+}
+
+func TestSQLiteConfig(t *testing.T) {
+	defer func(name string) {
+		sqliteDriverName = name
+	}(sqliteDriverName)
+	sqliteDriverName = "sqlitetest"
+	resetSQLiteTest()
+	// made by a newer build
+	sqliteTestVersion = int64(len(sqliteMigrations) + 1)
+	tests := []struct {
+		driver string
+		config BackendConfig
+		err    string
+	}{
+		{"sqlitetest", BackendConfig{}, "sqlite_path"},
+		{"sqlitetest", BackendConfig{"sqlite_path": "mail.db"}, "is newer than this build"},
+		{"nosuchdriver", BackendConfig{"sqlite_path": "mail.db"}, "-tags sqlite"},
+	}
+	for _, test := range tests {
+		sqliteDriverName = test.driver
+		_, errs := initTestProcessor(test.config, SQLite)
+		if errs == nil || !strings.Contains(errs[0].Error(), test.err) {
+			t.Errorf("expecting %q from %v, got: %v", test.err, test.config, errs)
+		}
+	}
+}
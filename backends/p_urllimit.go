@@ -0,0 +1,110 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ValueLinkFarm is the e.Values key set to a description of the counts, eg. "urls=30, domains=12",
+// when the urllimit processor in "flag" mode finds too many links
+const ValueLinkFarm = "link_farm"
+
+const (
+	urlLimitModeFlag   = "flag"
+	urlLimitModeReject = "reject"
+)
+
+var errTooManyLinks = errors.New("too many links")
+
+type URLLimitConfig struct {
+	// MaxURLs is the most URLs a message may have, 0 for no limit
+	MaxURLs int `json:"max_urls,omitempty"`
+	// MaxLinkDomains is the most distinct host names the URLs may link to, 0 for no limit
+	MaxLinkDomains int `json:"max_link_domains,omitempty"`
+	// Mode is "flag" (default) or "reject"
+	Mode string `json:"url_limit_mode,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: urllimit
+// ----------------------------------------------------------------------------------
+// Description   : Counts the URLs and the distinct domains they link to in the text
+//               : parts of the message. Messages with more than the maximum are flagged
+//               : or rejected, many links is a sign of spam from link farms.
+//               : Encrypted messages are skipped
+// ----------------------------------------------------------------------------------
+// Config Options: max_urls int - most URLs allowed, 0 for no limit
+//               : max_link_domains int - most distinct link domains allowed, 0 for no limit
+//               : url_limit_mode string - "flag" (default) lets the message through with
+//               : a X-Link-Farm header, "reject" rejects it
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+//               : e.Values["encrypted"]
+// ----------------------------------------------------------------------------------
+// Output        : In "flag" mode, e.Values[ValueLinkFarm] is set and a header is
+//               : appended to e.DeliveryHeader (place after the header processor)
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["urllimit"] = func() Decorator {
+		return URLLimit()
+	}
+}
+
+func URLLimit() Decorator {
+
+	var config *URLLimitConfig
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&URLLimitConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*URLLimitConfig)
+		config.Mode = strings.ToLower(config.Mode)
+		switch config.Mode {
+		case "":
+			config.Mode = urlLimitModeFlag
+		case urlLimitModeFlag, urlLimitModeReject:
+		default:
+			return errors.New("invalid url_limit_mode: " + config.Mode)
+		}
+		if config.MaxURLs < 0 || config.MaxLinkDomains < 0 {
+			return errors.New("max_urls and max_link_domains cannot be negative")
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail && (config.MaxURLs > 0 || config.MaxLinkDomains > 0) && !encrypted(e) {
+				urls := findURLs(e.Data.Bytes())
+				domains := make(map[string]bool)
+				for _, link := range urls {
+					if host := urlHost(link); host != "" {
+						domains[host] = true
+					}
+				}
+				if (config.MaxURLs > 0 && len(urls) > config.MaxURLs) ||
+					(config.MaxLinkDomains > 0 && len(domains) > config.MaxLinkDomains) {
+					counts := fmt.Sprintf("urls=%d, domains=%d", len(urls), len(domains))
+					if config.Mode == urlLimitModeReject {
+						Log().WithField("ip", e.RemoteIP).WithField("queued_id", e.QueuedId).
+							Info("rejected message with too many links: ", counts)
+						return NewResult(response.Canned.FailTooManyLinks), errTooManyLinks
+					}
+					e.Values[ValueLinkFarm] = counts
+					e.DeliveryHeader += "X-Link-Farm: " + counts + "\n"
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
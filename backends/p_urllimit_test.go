@@ -0,0 +1,100 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func newURLLimitEnvelope(data string) *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.Data.WriteString(data)
+	return e
+}
+
+// linkFarm returns a message linking to n different domains
+func linkFarm(n int) string {
+	var body string
+	for i := 0; i < n; i++ {
+		body += fmt.Sprintf("Cheap pills <a href=\"http://shop%d.example.net/buy?id=%d\">here</a>\n", i, i)
+	}
+	return "Subject: deals\nContent-Type: text/html\n\n" + body
+}
+
+const testNormalLinks = `Subject: meeting notes
+Content-Type: multipart/mixed; boundary="b1"
+
+--b1
+Content-Type: text/plain
+Content-Transfer-Encoding: quoted-printable
+
+The notes are at https://wiki.example.com/notes/2017-05-04, and the =
+slides at www.example.com/slides.
+See https://wiki.example.com/notes/2017-05-04#actions too.
+--b1
+Content-Type: text/plain
+Content-Disposition: attachment; filename="links.txt"
+
+http://a.example.org http://b.example.org http://c.example.org http://d.example.org
+--b1--
+`
+
+func TestFindURLs(t *testing.T) {
+	urls := findURLs([]byte(testNormalLinks))
+	expected := []string{
+		"https://wiki.example.com/notes/2017-05-04",
+		"www.example.com/slides",
+		"https://wiki.example.com/notes/2017-05-04#actions",
+	}
+	if strings.Join(urls, " ") != strings.Join(expected, " ") {
+		t.Error("expected", expected, "got:", urls)
+	}
+	for link, host := range map[string]string{
+		"https://Wiki.Example.com:8443/notes": "wiki.example.com",
+		"www.example.com/slides":              "www.example.com",
+		"http://example.com./":                "example.com",
+	} {
+		if h := urlHost(link); h != host {
+			t.Error("expected host", host, "for", link, "got:", h)
+		}
+	}
+}
+
+func TestURLLimitFlag(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"max_urls": 10, "max_link_domains": 5}, URLLimit)
+	e := newURLLimitEnvelope(linkFarm(8))
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should be flagged only, got:", err)
+	}
+	if e.Values[ValueLinkFarm] != "urls=8, domains=8" {
+		t.Error("expecting the link heavy message to be flagged, got:", e.Values[ValueLinkFarm])
+	}
+	if e.DeliveryHeader != "X-Link-Farm: urls=8, domains=8\n" {
+		t.Error("expecting a X-Link-Farm header, got:", e.DeliveryHeader)
+	}
+
+	e = newURLLimitEnvelope(testNormalLinks)
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	if _, ok := e.Values[ValueLinkFarm]; ok || e.DeliveryHeader != "" {
+		t.Error("a normal message should not be flagged")
+	}
+}
+
+func TestURLLimitReject(t *testing.T) {
+	p := newTestProcessor(t, BackendConfig{"max_urls": 5, "url_limit_mode": "reject"}, URLLimit)
+	result, err := p.Process(newURLLimitEnvelope(linkFarm(6)), TaskSaveMail)
+	if err != errTooManyLinks || result.Code() != 550 {
+		t.Error("expecting the link heavy message to be rejected, got:", result, err)
+	}
+	if _, err := p.Process(newURLLimitEnvelope(linkFarm(5)), TaskSaveMail); err != nil {
+		t.Error("expecting a message at the limit to pass, got:", err)
+	}
+
+	if _, errs := initTestProcessor(BackendConfig{"url_limit_mode": "drop"}, URLLimit); errs == nil {
+		t.Error("expecting an error for an invalid url_limit_mode")
+	}
+}
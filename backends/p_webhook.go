@@ -0,0 +1,325 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+const (
+	// default time to wait for the endpoint, if 'webhook_timeout' not present in config
+	webhookTimeout = time.Second * 10
+	// the body of the POST, if 'webhook_format' not present in config
+	webhookFormatJSON = "json"
+	// the body is the message, with the metadata in the headers
+	webhookFormatRaw = "raw"
+	// the SMTP code of the replies that are not mapped by webhook_status_map
+	webhookDefaultCode = 451
+)
+
+// webhookRetryDelay is how long to wait before retrying, times the attempt, if 'webhook_retry_delay'
+// not present in config. Changed for testing
+var webhookRetryDelay = time.Millisecond * 500
+
+type WebhookConfig struct {
+	// WebhookURL is where to POST, eg. "https://example.com/hooks/mail"
+	WebhookURL string `json:"webhook_url"`
+	// WebhookFormat is "json" for the metadata as JSON, or "raw" for the message
+	WebhookFormat string `json:"webhook_format,omitempty"`
+	// WebhookIncludeBody adds the raw message to the JSON, base64 encoded
+	WebhookIncludeBody bool `json:"webhook_include_body,omitempty"`
+	// WebhookHeaders is a comma separated list of headers to send, eg. "Authorization: Bearer token"
+	WebhookHeaders string `json:"webhook_headers,omitempty"`
+	// WebhookSecret signs the requests with HMAC-SHA256, they are not signed if empty
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	// WebhookTimeout is how long to wait for each request, eg. "10s"
+	WebhookTimeout string `json:"webhook_timeout,omitempty"`
+	// WebhookRetries is how many times to retry when the endpoint replies with a 5xx or a 429
+	WebhookRetries int `json:"webhook_retries,omitempty"`
+	// WebhookRetryDelay is how long to wait before retrying, times the attempt, eg. "500ms"
+	WebhookRetryDelay string `json:"webhook_retry_delay,omitempty"`
+	// WebhookStatusMap maps the HTTP status of the replies to SMTP codes, eg. "5xx=554, 410=550"
+	WebhookStatusMap string `json:"webhook_status_map,omitempty"`
+}
+// webhookPayload is the JSON body of the POST
+type webhookPayload struct {
+	QueuedId string   `json:"queued_id"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject"`
+	RemoteIP string   `json:"remote_ip"`
+	// Body is base64 encoded by encoding/json
+	Body []byte `json:"body,omitempty"`
+}
+
+// ----------------------------------------------------------------------------------
+// Processor Name: webhook
+// ----------------------------------------------------------------------------------
+// Description   : POSTs the metadata of the message, and optionally the message, as JSON
+//               : to an HTTP endpoint, or the message as message/rfc822 with the metadata
+//               : in the X-Queued-Id, X-Mail-From, X-Rcpt-To & X-Remote-Ip headers.
+//               : The message is deferred with a 451 if the endpoint does not reply with
+//               : a 2xx. webhook_status_map gives other SMTP codes to the HTTP statuses,
+//               : so that the endpoint can reject the message, eg. "5xx=554" bounces it
+//               : when the endpoint fails. The replies mapped to a 5xx are not retried.
+//               : With a secret, each request is signed: X-Webhook-Timestamp is the unix
+//               : time, and X-Webhook-Signature is "sha256=" & the hex HMAC-SHA256 of the
+//               : timestamp, a "." and the body, keyed by the secret
+// ----------------------------------------------------------------------------------
+// Config Options: webhook_url string - the URL to POST to
+//               : webhook_format string - "json" (default) or "raw", the message
+//               : webhook_include_body bool - add the raw message to the JSON, base64 encoded
+//               : webhook_headers string - comma separated list of headers to add to the
+//               : request, eg. "Authorization: Bearer secret, X-Source: guerrilla"
+//               : webhook_secret string - sign the requests with this key
+//               : webhook_timeout string - how long to wait for each request, default "10s"
+//               : webhook_retries int - how many times to retry if the reply is a 5xx or
+//               : a 429, or the request failed
+//               : webhook_retry_delay string - wait this, times the attempt, before
+//               : retrying, default "500ms"
+//               : webhook_status_map string - comma separated HTTP status or class=SMTP
+//               : code, eg. "5xx=554, 410=550, 429=452", the others get a 451
+// --------------:-------------------------------------------------------------------
+// Input         : e.QueuedId, e.MailFrom, e.RcptTo, e.RemoteIP
+//               : e.Subject - generated by the HeadersParser processor
+//               : e.Data & e.DeliveryHeader if webhook_include_body is set, or the
+//               : format is raw
+// ----------------------------------------------------------------------------------
+// Output        : none
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["webhook"] = func() Decorator {
+		return Webhook()
+	}
+}
+
+// webhookStatusMap maps an HTTP status, or its class such as "5xx", to an SMTP code
+type webhookStatusMap map[string]int
+
+// parseWebhookStatusMap parses the comma separated status=code pairs, eg. "5xx=554, 410=550"
+func parseWebhookStatusMap(list string) (webhookStatusMap, error) {
+	m := make(webhookStatusMap)
+	for _, item := range splitList(list) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid webhook_status_map, expecting status=code: " + item)
+		}
+		status := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(status) != 3 || status[0] < '1' || status[0] > '5' || status[0] == '2' {
+			return nil, errors.New("invalid HTTP status in webhook_status_map: " + item)
+		}
+		if status[1:] != "xx" {
+			if n, err := strconv.Atoi(status); err != nil || n < 100 {
+				return nil, errors.New("invalid HTTP status in webhook_status_map: " + item)
+			}
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || code < 400 || code > 599 {
+			return nil, errors.New("invalid SMTP code in webhook_status_map, expecting 4xx or 5xx: " + item)
+		}
+		m[status] = code
+	}
+	return m, nil
+}
+
+// code returns the SMTP code of the HTTP status, by the status then by its class
+func (m webhookStatusMap) code(status int) int {
+	if code, ok := m[strconv.Itoa(status)]; ok {
+		return code
+	}
+	if code, ok := m[strconv.Itoa(status/100)+"xx"]; ok {
+		return code
+	}
+	return webhookDefaultCode
+}
+
+// webhookClient POSTs the messages to the endpoint
+type webhookClient struct {
+	config     *WebhookConfig
+	client     *http.Client
+	headers    http.Header
+	statuses   webhookStatusMap
+	retryDelay time.Duration
+}
+
+// webhookSignature is the hex HMAC-SHA256 of the timestamp, a "." & the body
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func Webhook() Decorator {
+
+	var (
+		config *WebhookConfig
+		client *webhookClient
+	)
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&WebhookConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*WebhookConfig)
+		if u, err := url.Parse(config.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("invalid webhook_url: " + config.WebhookURL)
+		}
+		switch config.WebhookFormat {
+		case "":
+			config.WebhookFormat = webhookFormatJSON
+		case webhookFormatJSON, webhookFormatRaw:
+		default:
+			return errors.New("invalid webhook_format: " + config.WebhookFormat)
+		}
+		if config.WebhookRetries < 0 {
+			return errors.New("webhook_retries cannot be negative")
+		}
+		c := &webhookClient{config: config, headers: make(http.Header), retryDelay: webhookRetryDelay}
+		for _, item := range splitList(config.WebhookHeaders) {
+			kv := strings.SplitN(item, ":", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return errors.New("invalid header in webhook_headers: " + item)
+			}
+			c.headers.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+		if c.statuses, err = parseWebhookStatusMap(config.WebhookStatusMap); err != nil {
+			return err
+		}
+		timeout := webhookTimeout
+		if config.WebhookTimeout != "" {
+			if timeout, err = time.ParseDuration(config.WebhookTimeout); err != nil {
+				return err
+			}
+		}
+		if config.WebhookRetryDelay != "" {
+			if c.retryDelay, err = time.ParseDuration(config.WebhookRetryDelay); err != nil {
+				return err
+			}
+		}
+		// shared by the workers, it keeps the connections alive
+		c.client = &http.Client{Timeout: timeout}
+		client = c
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				to := make([]string, 0, len(e.RcptTo))
+				for i := range e.RcptTo {
+					to = append(to, e.RcptTo[i].String())
+				}
+				var body []byte
+				contentType := "application/json"
+				if config.WebhookFormat == webhookFormatRaw {
+					body, contentType = []byte(e.String()), "message/rfc822"
+				} else {
+					payload := webhookPayload{
+						QueuedId: e.QueuedId,
+						From:     e.MailFrom.String(),
+						To:       to,
+						Subject:  e.Subject,
+						RemoteIP: e.RemoteIP,
+					}
+					if config.WebhookIncludeBody {
+						payload.Body = []byte(e.String())
+					}
+					var err error
+					if body, err = json.Marshal(&payload); err != nil {
+						return NewResult(response.Canned.FailBackendTransaction), err
+					}
+				}
+				if result, err := client.post(e, to, contentType, body); err != nil {
+					Log().WithError(err).WithField("queued_id", e.QueuedId).Warn("webhook failed")
+					return result, err
+				}
+				// next processor
+				return p.Process(e, task)
+			} else {
+				return p.Process(e, task)
+			}
+		})
+	}
+}
+
+// post POSTs body to the webhook_url, retrying if the request fails or the reply is a 5xx or a
+// 429 that is not mapped to a 5xx. Returns the result of the reply if it is not a 2xx
+func (c *webhookClient) post(e *mail.Envelope, to []string, contentType string, body []byte) (Result, error) {
+	code := webhookDefaultCode
+	var err error
+	for attempt := 0; attempt <= c.config.WebhookRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(c.retryDelay * time.Duration(attempt))
+		}
+		var status int
+		if status, err = c.request(e, to, contentType, body); err == nil {
+			if status >= 200 && status < 300 {
+				return nil, nil
+			}
+			err = fmt.Errorf("webhook replied %d %s", status, http.StatusText(status))
+			if code = c.statuses.code(status); code >= 500 {
+				return NewResult(fmt.Sprintf("%d 5.3.0 Error: %s", code, err)), err
+			}
+			if status < 500 && status != http.StatusTooManyRequests {
+				break
+			}
+		}
+		if e.Context().Err() != nil {
+			// nobody is waiting for the reply any more
+			break
+		}
+	}
+	if code == webhookDefaultCode {
+		return NewResult(response.Canned.ErrorBackendTransaction + "webhook failed"), NewRetryableError(err)
+	}
+	return NewResult(fmt.Sprintf("%d 4.3.0 Error: %s", code, err)), NewRetryableError(err)
+}
+
+// request makes one request, and returns the status of the reply
+func (c *webhookClient) request(e *mail.Envelope, to []string, contentType string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", c.config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(e.Context())
+	for key, values := range c.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.config.WebhookFormat == webhookFormatRaw {
+		req.Header.Set("X-Queued-Id", e.QueuedId)
+		req.Header.Set("X-Mail-From", e.MailFrom.String())
+		req.Header.Set("X-Rcpt-To", strings.Join(to, ","))
+		req.Header.Set("X-Remote-Ip", e.RemoteIP)
+	}
+	if c.config.WebhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(c.config.WebhookSecret, timestamp, body))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// read the rest, so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,227 @@
+package backends
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func newWebhookEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("203.0.113.5", 1)
+	e.QueuedId = "q1"
+	e.Subject = "hello"
+	e.MailFrom, _ = mail.NewAddress("alice@example.com")
+	for _, r := range []string{"bob@example.org", "carol@example.org"} {
+		a, _ := mail.NewAddress(r)
+		e.RcptTo = append(e.RcptTo, a)
+	}
+	e.DeliveryHeader = "Received: from mx.example.com\n"
+	e.Data.WriteString("Subject: hello\n\nthe body\n")
+	return e
+}
+
+func TestWebhookPayload(t *testing.T) {
+	var (
+		got     map[string]interface{}
+		headers http.Header
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		b, _ := ioutil.ReadAll(r.Body)
+		got = nil
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Error("invalid JSON:", string(b))
+		}
+	}))
+	defer ts.Close()
+
+	p := newTestProcessor(t, BackendConfig{
+		"webhook_url":          ts.URL,
+		"webhook_include_body": true,
+		"webhook_headers":      "Authorization: Bearer secret, X-Source: guerrilla",
+	}, Webhook)
+	if _, err := p.Process(newWebhookEnvelope(), TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	if got["queued_id"] != "q1" || got["from"] != "alice@example.com" || got["subject"] != "hello" ||
+		got["remote_ip"] != "203.0.113.5" {
+		t.Error("unexpected payload:", got)
+	}
+	if to, ok := got["to"].([]interface{}); !ok || len(to) != 2 || to[0] != "bob@example.org" || to[1] != "carol@example.org" {
+		t.Error("unexpected recipients:", got["to"])
+	}
+	body, _ := got["body"].(string)
+	if b, err := base64.StdEncoding.DecodeString(body); err != nil ||
+		string(b) != "Received: from mx.example.com\nSubject: hello\n\nthe body\n" {
+		t.Error("unexpected body:", string(b), err)
+	}
+	if headers.Get("Authorization") != "Bearer secret" || headers.Get("X-Source") != "guerrilla" ||
+		headers.Get("Content-Type") != "application/json" {
+		t.Error("unexpected headers:", headers)
+	}
+
+	// without the body
+	p = newTestProcessor(t, BackendConfig{"webhook_url": ts.URL}, Webhook)
+	if _, err := p.Process(newWebhookEnvelope(), TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	if _, ok := got["body"]; ok {
+		t.Error("expecting no body, got:", got)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	defer func(d time.Duration) {
+		webhookRetryDelay = d
+	}(webhookRetryDelay)
+	webhookRetryDelay = 0
+
+	var requests, failures int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("X-Status") == "400" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		failures int32
+		retries  int
+		header   string
+		requests int32
+		ok       bool
+	}{
+		{2, 2, "", 3, true},
+		{3, 2, "", 3, false},
+		{0, 2, "X-Status: 400", 1, false},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failures, c.failures)
+		p := newTestProcessor(t, BackendConfig{
+			"webhook_url":     ts.URL,
+			"webhook_retries": c.retries,
+			"webhook_headers": c.header,
+		}, Webhook)
+		res, err := p.Process(newWebhookEnvelope(), TaskSaveMail)
+		if c.ok && err != nil {
+			t.Error("expecting the message to pass, got:", err)
+		}
+		if !c.ok && (err == nil || !strings.HasPrefix(res.String(), "451")) {
+			t.Error("expecting a 451, got:", res, err)
+		}
+		if n := atomic.LoadInt32(&requests); n != c.requests {
+			t.Error("expecting", c.requests, "requests, got:", n)
+		}
+	}
+}
+
+func TestWebhookRaw(t *testing.T) {
+	var (
+		got     []byte
+		headers http.Header
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		got, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	p := newTestProcessor(t, BackendConfig{
+		"webhook_url":    ts.URL,
+		"webhook_format": "raw",
+		"webhook_secret": "s3cret",
+	}, Webhook)
+	if _, err := p.Process(newWebhookEnvelope(), TaskSaveMail); err != nil {
+		t.Fatal("the message should pass, got:", err)
+	}
+	if string(got) != "Received: from mx.example.com\nSubject: hello\n\nthe body\n" {
+		t.Error("unexpected body:", string(got))
+	}
+	if headers.Get("Content-Type") != "message/rfc822" || headers.Get("X-Queued-Id") != "q1" ||
+		headers.Get("X-Rcpt-To") != "bob@example.org,carol@example.org" || headers.Get("X-Mail-From") != "alice@example.com" {
+		t.Error("unexpected headers:", headers)
+	}
+	timestamp := headers.Get("X-Webhook-Timestamp")
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(got)
+	if expect := "sha256=" + hex.EncodeToString(mac.Sum(nil)); timestamp == "" || headers.Get("X-Webhook-Signature") != expect {
+		t.Error("unexpected signature:", headers.Get("X-Webhook-Signature"), "expecting", expect)
+	}
+}
+
+func TestWebhookStatusMap(t *testing.T) {
+	defer func(d time.Duration) {
+		webhookRetryDelay = d
+	}(webhookRetryDelay)
+	webhookRetryDelay = 0
+
+	var requests, status int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer ts.Close()
+
+	p := newTestProcessor(t, BackendConfig{
+		"webhook_url":        ts.URL,
+		"webhook_retries":    2,
+		"webhook_status_map": "5xx=554, 503=451, 410=550, 429=452",
+	}, Webhook)
+	for _, c := range []struct {
+		status    int32
+		code      int
+		requests  int32
+		retryable bool
+	}{
+		{500, 554, 1, false},
+		{410, 550, 1, false},
+		{503, 451, 3, true},
+		{429, 452, 3, true},
+		{404, 451, 1, true},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&status, c.status)
+		res, err := p.Process(newWebhookEnvelope(), TaskSaveMail)
+		if resultCode(res) != c.code || isRetryable(err) != c.retryable {
+			t.Error("expecting", c.code, "for", c.status, "got:", res, err)
+		}
+		if n := atomic.LoadInt32(&requests); n != c.requests {
+			t.Error("expecting", c.requests, "requests for", c.status, "got:", n)
+		}
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	for _, c := range []BackendConfig{
+		{"webhook_url": "ftp://example.com"},
+		{"webhook_url": "http://example.com", "webhook_headers": "Authorization"},
+		{"webhook_url": "http://example.com", "webhook_timeout": "soon"},
+		{"webhook_url": "http://example.com", "webhook_retries": -1},
+		{"webhook_url": "http://example.com", "webhook_format": "xml"},
+		{"webhook_url": "http://example.com", "webhook_retry_delay": "soon"},
+		{"webhook_url": "http://example.com", "webhook_status_map": "5xx"},
+		{"webhook_url": "http://example.com", "webhook_status_map": "2xx=554"},
+		{"webhook_url": "http://example.com", "webhook_status_map": "500=250"},
+	} {
+		if _, errs := initTestProcessor(c, Webhook); errs == nil {
+			t.Error("expecting an error for", c)
+		}
+	}
+}
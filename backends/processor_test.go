@@ -0,0 +1,35 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+// initTestProcessor resets the service & returns the processors made by each of
+// decorators, in a chain after the DefaultProcessor, the last one processes first.
+// They are initialized with config, the errors of their initializers are returned
+func initTestProcessor(config BackendConfig, decorators ...func() Decorator) (Processor, []error) {
+	Svc.reset()
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	// made after the reset, since they add their initializers to Svc
+	d := make([]Decorator, 0, len(decorators))
+	for _, decorator := range decorators {
+		d = append(d, decorator())
+	}
+	p := Decorate(DefaultProcessor{}, d...)
+	if errs := Svc.initialize(config); errs != nil {
+		return p, errs
+	}
+	return p, nil
+}
+
+// newTestProcessor is initTestProcessor for a config that is expected to be valid
+func newTestProcessor(t *testing.T, config BackendConfig, decorators ...func() Decorator) Processor {
+	p, errs := initTestProcessor(config, decorators...)
+	if errs != nil {
+		t.Fatal("the processor did not initialize:", errs)
+	}
+	return p
+}
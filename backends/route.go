@@ -0,0 +1,169 @@
+package backends
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// DefaultChain is the name of the save_process chain, which saves the recipients that match none of the gw_routes
+const DefaultChain = "default"
+
+// RouteMatcher decides if a recipient of e goes to the chain of a route, for the rules that
+// can't be expressed with domains or a regex. Added with Svc.AddRouteMatcher
+type RouteMatcher func(e *mail.Envelope, rcpt mail.Address) bool
+
+// the matchers that the gw_routes can use, by name
+var routeMatchers = make(map[string]RouteMatcher)
+
+// RouteConfig is a rule of gw_routes. The recipients that match it are saved by its chain, one of
+// the save_chains. A rule with several criteria matches if all of them match
+type RouteConfig struct {
+	// Domains is a comma separated list of the recipient domains that match
+	Domains string `json:"domains,omitempty"`
+	// Regex matches the recipient's address, eg. "^[^@]+@archive\\."
+	Regex string `json:"regex,omitempty"`
+	// Matcher is the name of a RouteMatcher, added with Svc.AddRouteMatcher
+	Matcher string `json:"matcher,omitempty"`
+	// Chain is the name of a chain in save_chains, or "default" for the save_process
+	Chain string `json:"chain"`
+}
+
+// route is a RouteConfig ready to match
+type route struct {
+	domains map[string]bool
+	regex   *regexp.Regexp
+	matcher RouteMatcher
+	chain   string
+}
+
+// routeGroup are the recipients that go to a chain, by their index in e.RcptTo
+type routeGroup struct {
+	chain string
+	rcpts []int
+}
+
+// AddRouteMatcher adds a RouteMatcher, which becomes available to the "matcher" of the
+// backend_config.gw_routes option
+func (s *service) AddRouteMatcher(name string, m RouteMatcher) {
+	s.Lock()
+	defer s.Unlock()
+	routeMatchers[strings.ToLower(name)] = m
+}
+
+// routeMatcher returns the RouteMatcher added with the name
+func (s *service) routeMatcher(name string) (RouteMatcher, bool) {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := routeMatchers[strings.ToLower(name)]
+	return m, ok
+}
+
+// configValue decodes the value of key, for the values that ExtractConfig doesn't support,
+// eg. objects & arrays. v is left as is if the key is not present
+func configValue(cfg BackendConfig, key string, v interface{}) error {
+	value, ok := cfg[key]
+	if !ok || value == nil {
+		return nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", key, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return nil
+}
+
+// newRoutes checks the gw_routes, their chains must be in chains
+func newRoutes(configs []RouteConfig, chains map[string]string) ([]route, error) {
+	routes := make([]route, 0, len(configs))
+	for i, c := range configs {
+		r := route{chain: strings.ToLower(strings.TrimSpace(c.Chain))}
+		if _, ok := chains[r.chain]; !ok && r.chain != DefaultChain {
+			return nil, fmt.Errorf("gw_routes #%d: chain [%s] not found in save_chains", i+1, c.Chain)
+		}
+		if domains := splitList(c.Domains); len(domains) > 0 {
+			r.domains = make(map[string]bool, len(domains))
+			for _, d := range domains {
+				r.domains[strings.ToLower(d)] = true
+			}
+		}
+		if c.Regex != "" {
+			var err error
+			if r.regex, err = regexp.Compile(c.Regex); err != nil {
+				return nil, fmt.Errorf("gw_routes #%d: %s", i+1, err)
+			}
+		}
+		if c.Matcher != "" {
+			var ok bool
+			if r.matcher, ok = Svc.routeMatcher(c.Matcher); !ok {
+				return nil, fmt.Errorf("gw_routes #%d: matcher [%s] not found", i+1, c.Matcher)
+			}
+		}
+		if r.domains == nil && r.regex == nil && r.matcher == nil {
+			return nil, fmt.Errorf("gw_routes #%d: needs domains, a regex or a matcher", i+1)
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// checkChains checks the names of the save_chains
+func checkChains(chains map[string]string) error {
+	for name := range chains {
+		if name == DefaultChain {
+			return errors.New("save_chains cannot have a chain named " + DefaultChain + ", it is the save_process")
+		}
+		if name == "" || name != strings.ToLower(strings.TrimSpace(name)) {
+			return errors.New("invalid name in save_chains: [" + name + "], must be lower case")
+		}
+	}
+	return nil
+}
+
+// match returns true if the recipient matches all the criteria of the route
+func (r *route) match(e *mail.Envelope, rcpt mail.Address) bool {
+	if r.domains != nil && !r.domains[strings.ToLower(rcpt.Host)] {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(rcpt.String()) {
+		return false
+	}
+	if r.matcher != nil && !r.matcher(e, rcpt) {
+		return false
+	}
+	return true
+}
+
+// routeRcpts groups the recipients of e by the chain of the first route that they match,
+// in the order of e.RcptTo. There is one group for the DefaultChain if there are no routes
+func routeRcpts(routes []route, e *mail.Envelope) []routeGroup {
+	if len(routes) == 0 || len(e.RcptTo) == 0 {
+		return []routeGroup{{chain: DefaultChain}}
+	}
+	var groups []routeGroup
+	index := make(map[string]int)
+	for i := range e.RcptTo {
+		chain := DefaultChain
+		for j := range routes {
+			if routes[j].match(e, e.RcptTo[i]) {
+				chain = routes[j].chain
+				break
+			}
+		}
+		g, ok := index[chain]
+		if !ok {
+			g = len(groups)
+			index[chain] = g
+			groups = append(groups, routeGroup{chain: chain})
+		}
+		groups[g].rcpts = append(groups[g].rcpts, i)
+	}
+	return groups
+}
@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package backends
+
+// the driver of the sqlite processor, it needs cgo so it is only built with -tags sqlite
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,83 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// how deep to look into nested multipart messages for URLs
+const urlMaxDepth = 5
+
+// urlRegex matches the links in the text of a message, with or without a scheme
+var urlRegex = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"'()\[\]{}]+`)
+
+// findURLs returns the URLs in the text parts of the message in data, in the order they appear.
+// The text/plain & text/html parts are decoded first, other parts such as attachments are skipped
+func findURLs(data []byte) []string {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil
+	}
+	var urls []string
+	findURLsInPart(header, r.R, 0, &urls)
+	return urls
+}
+
+// findURLsInPart appends the URLs in a text part to urls, walking through multipart messages
+func findURLsInPart(header textproto.MIMEHeader, body io.Reader, depth int, urls *[]string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// no content type, the default is text/plain
+		mediaType = "text/plain"
+	}
+	switch {
+	case mediaType == "text/plain" || mediaType == "text/html":
+		if strings.HasPrefix(strings.ToLower(header.Get("Content-Disposition")), "attachment") {
+			return
+		}
+		text, err := ioutil.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+		if err != nil && len(text) == 0 {
+			return
+		}
+		for _, link := range urlRegex.FindAllString(string(text), -1) {
+			// punctuation at the end belongs to the sentence
+			*urls = append(*urls, strings.TrimRight(link, ".,;:!?"))
+		}
+	case strings.HasPrefix(mediaType, "multipart/") && depth < urlMaxDepth:
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			findURLsInPart(part.Header, part, depth+1, urls)
+		}
+	}
+}
+
+// urlHost returns the host name of a URL returned by findURLs, lowercase & without the port.
+// Returns "" if the URL cannot be parsed
+func urlHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -4,11 +4,18 @@ import (
 	"bytes"
 	"compress/zlib"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/textproto"
 	"regexp"
 	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
 )
 
 // First capturing group is header name, second is header value.
@@ -59,3 +66,82 @@ func Compress(stringArguments ...string) string {
 	w.Close()
 	return b.String()
 }
+
+// the formats of the messages that the kafka & amqp processors publish
+const (
+	messageFormatJSON = "json"
+	messageFormatRaw  = "raw"
+)
+
+// messageRecord is a message published with the json format
+type messageRecord struct {
+	QueuedId string              `json:"queued_id"`
+	From     string              `json:"from"`
+	To       []string            `json:"to"`
+	Subject  string              `json:"subject"`
+	RemoteIP string              `json:"remote_ip"`
+	Helo     string              `json:"helo"`
+	TLS      bool                `json:"tls"`
+	Header   map[string][]string `json:"header,omitempty"`
+	// Body is the raw message, base64 encoded by encoding/json
+	Body []byte `json:"body"`
+}
+
+// messageValue returns e in the format, from the sender from, for the recipients rcpts
+func messageValue(e *mail.Envelope, format string, from string, rcpts []string) ([]byte, error) {
+	if format == messageFormatRaw {
+		return []byte(e.String()), nil
+	}
+	return json.Marshal(&messageRecord{
+		QueuedId: e.QueuedId,
+		From:     from,
+		To:       rcpts,
+		Subject:  e.Subject,
+		RemoteIP: e.RemoteIP,
+		Helo:     e.Helo,
+		TLS:      e.TLS,
+		Header:   e.Header,
+		Body:     []byte(e.String()),
+	})
+}
+
+// groupRcpts groups the indexes of the recipients by their key, in the order of the keys
+func groupRcpts(rcpts []mail.Address, key func(rcpt mail.Address) string) (keys []string, byKey map[string][]int) {
+	byKey = make(map[string][]int)
+	for i := range rcpts {
+		k := key(rcpts[i])
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], i)
+	}
+	return keys, byKey
+}
+
+// messageTemplate replaces {rcpt_domain}, {rcpt_user}, {from_domain} & {queued_id} in template
+// with the parts of e & its recipient rcpt, the addresses in lower case
+func messageTemplate(template string, e *mail.Envelope, rcpt mail.Address) string {
+	return strings.NewReplacer(
+		"{rcpt_domain}", strings.ToLower(rcpt.Host),
+		"{rcpt_user}", strings.ToLower(rcpt.User),
+		"{from_domain}", strings.ToLower(e.MailFrom.Host),
+		"{queued_id}", e.QueuedId,
+	).Replace(template)
+}
+
+// clientTLSConfig returns the TLS config of a connection to a server, verified with the CAs
+// in the PEM caFile if set, the system CAs otherwise. option is the config option of the caFile
+func clientTLSConfig(caFile string, skipVerify bool, option string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + option + ": " + caFile)
+		}
+	}
+	return tlsConfig, nil
+}
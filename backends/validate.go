@@ -15,3 +15,11 @@ var (
 	UserSuspended       = RcptError(errors.New("user suspended"))
 	StorageError        = RcptError(errors.New("storage error"))
 )
+
+// RcptReply is a RcptError with its own reply to the RCPT command, for rejections that are not
+// about the mailbox, eg. when the client is blocklisted. Other errors get a 550 user unknown reply
+type RcptReply string
+
+func (r RcptReply) Error() string {
+	return string(r)
+}
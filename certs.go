@@ -0,0 +1,258 @@
+package guerrilla
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// TLSCertificate is a certificate & key pair, in addition to the server's default
+// PublicKeyFile & PrivateKeyFile, see ServerConfig.Certificates
+type TLSCertificate struct {
+	// PrivateKeyFile path to cert private key in PEM format
+	PrivateKeyFile string `json:"private_key_file"`
+	// PublicKeyFile path to cert (public key) chain in PEM format
+	PublicKeyFile string `json:"public_key_file"`
+}
+
+// tlsVersions are the values of ServerConfig.TLSMinVersion
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// tlsCiphers are the names of the cipher suites that can be used in ServerConfig.TLSCiphers
+var tlsCiphers = map[string]uint16{
+	"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+}
+
+// tls13Ciphers are the names of the TLS 1.3 cipher suites, which can't be configured
+var tls13Ciphers = map[uint16]string{
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// tlsVersionName returns the name of a TLS version for the Received header, eg. "TLSv1.2"
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLSv" + name
+		}
+	}
+	if version == 0x0304 {
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("TLS 0x%04x", version)
+}
+
+// tlsCipherName returns the name of a cipher suite for the Received header
+func tlsCipherName(id uint16) string {
+	for name, suite := range tlsCiphers {
+		if suite == id {
+			return name
+		}
+	}
+	if name, ok := tls13Ciphers[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
+
+// newTLSInfo returns the details of a TLS connection for the envelope
+func newTLSInfo(state tls.ConnectionState) *mail.TLSInfo {
+	info := &mail.TLSInfo{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tlsCipherName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.ClientCert = true
+		info.ClientSubject = state.PeerCertificates[0].Subject.String()
+	}
+	return info
+}
+
+// tlsMinVersion returns the version for ServerConfig.TLSMinVersion, 0 if not set
+func tlsMinVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, errors.New("invalid tls_min_version: " + version)
+}
+
+// tlsCipherSuites returns the cipher suites for ServerConfig.TLSCiphers, nil if not set
+func tlsCipherSuites(list string) ([]uint16, error) {
+	var suites []uint16
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.ToUpper(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		id, ok := tlsCiphers[name]
+		if !ok {
+			return nil, errors.New("unknown cipher suite in tls_ciphers: " + name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// values for ServerConfig.ClientAuth
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// tlsClientAuth returns the policy for ServerConfig.ClientAuth
+func tlsClientAuth(clientAuth string) (tls.ClientAuthType, error) {
+	switch clientAuth {
+	case "", ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, errors.New("invalid client_auth: " + clientAuth)
+}
+
+// loadClientCAs reads the CAs of ServerConfig.ClientCAFile, nil for the system's CAs if not set
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read client_ca_file: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in client_ca_file " + file)
+	}
+	return pool, nil
+}
+
+// ClientCertMapper returns the identity of a client that presented a verified certificate,
+// eg. its user name. The client is not authenticated if it returns ""
+type ClientCertMapper func(cert *x509.Certificate) string
+
+// clientCertMapper is the ClientCertMapper of all the servers, stores ClientCertMapper
+var clientCertMapper atomic.Value
+
+// DefaultClientCertMapper maps a certificate to the common name of its subject, or to its first
+// DNS or email subject alternative name if it has no common name
+func DefaultClientCertMapper(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// setClientCertMapper sets the mapper of the client certificates, nil for DefaultClientCertMapper
+func setClientCertMapper(m ClientCertMapper) {
+	if m == nil {
+		m = DefaultClientCertMapper
+	}
+	clientCertMapper.Store(m)
+}
+
+// clientCertIdentity returns the identity of a verified client certificate
+func clientCertIdentity(cert *x509.Certificate) string {
+	if m, ok := clientCertMapper.Load().(ClientCertMapper); ok {
+		return m(cert)
+	}
+	return DefaultClientCertMapper(cert)
+}
+
+// certStore selects a certificate by the server name (SNI) the client asked for
+type certStore struct {
+	// byName maps the names of the certificates to them, including wildcards such as *.example.com
+	byName map[string]*tls.Certificate
+	// fallback is the server's default certificate, used when no other one matches
+	fallback *tls.Certificate
+}
+
+// newCertStore loads the default certificate & the ServerConfig.Certificates
+func newCertStore(sc *ServerConfig) (*certStore, error) {
+	store := &certStore{byName: make(map[string]*tls.Certificate)}
+	pairs := append([]TLSCertificate{{PublicKeyFile: sc.PublicKeyFile, PrivateKeyFile: sc.PrivateKeyFile}},
+		sc.Certificates...)
+	for i := range pairs {
+		cert, err := tls.LoadX509KeyPair(pairs[i].PublicKeyFile, pairs[i].PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading the certificate %s: %s", pairs[i].PublicKeyFile, err)
+		}
+		if i == 0 {
+			store.fallback = &cert
+			// the default is only used when nothing else matches
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing the certificate %s: %s", pairs[i].PublicKeyFile, err)
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := store.byName[name]; !ok {
+				// the first certificate listed for a name is used
+				store.byName[name] = &cert
+			}
+		}
+	}
+	return store, nil
+}
+
+// getCertificate is the tls.Config.GetCertificate callback
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return s.fallback, nil
+	}
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	// try a wildcard, eg. mail.example.com matches *.example.com
+	if dot := strings.Index(name, "."); dot != -1 {
+		if cert, ok := s.byName["*"+name[dot:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.fallback, nil
+}
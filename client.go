@@ -5,10 +5,12 @@ import (
 	"bytes"
 	"crypto/tls"
 	"fmt"
+	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
 	"net"
-	"net/textproto"
+	"strings"
 	"sync"
 	"time"
 )
@@ -39,15 +41,33 @@ type client struct {
 	state        ClientState
 	messagesSent int
 	// Response to be written to the client
-	response   bytes.Buffer
-	conn       net.Conn
-	bufin      *smtpBufferedReader
-	bufout     *bufio.Writer
-	smtpReader *textproto.Reader
-	ar         *adjustableLimitedReader
+	response bytes.Buffer
+	conn     net.Conn
+	bufin    *smtpBufferedReader
+	bufout   *bufio.Writer
+	ar       *adjustableLimitedReader
 	// guards access to conn
 	connGuard sync.Mutex
 	log       log.Logger
+	// Message-IDs of the messages received during this connection
+	messageIDs map[string]bool
+	// JA3 fingerprint of the TLS client, set after the TLS handshake
+	ja3 string
+	// login of the user, if authenticated by a proxy (XCLIENT LOGIN)
+	authLogin string
+	// sessionLogin is the login that the session is counted for, see ServerConfig.MaxSessionsPerUser
+	sessionLogin string
+	// esmtp is true if the client greeted with EHLO (or LHLO)
+	esmtp bool
+	// bytes received from the client during the connection, commands & messages
+	bytesReceived int64
+	// number of 5xx replies sent to the client during the connection
+	failures int
+	// number of RCPT TO commands accepted during the transaction, there may be more recipients
+	// if the backend expanded an alias. LMTP replies to the DATA for each of them
+	rcptCmds int
+	// number of RCPT TO commands accepted during the connection, see ServerConfig.MaxRcptsPerConnection
+	rcptsReceived int
 }
 
 // NewClient allocates a new client.
@@ -63,42 +83,36 @@ func NewClient(conn net.Conn, clientID uint64, logger log.Logger, envelope *mail
 		ID:          clientID,
 		log:         logger,
 	}
-
-	// used for reading the DATA state
-	c.smtpReader = textproto.NewReader(c.bufin.Reader)
 	return c
 }
 
-// setResponse adds a response to be written on the next turn
+// setResponse adds a response to be written on the next turn. The responses to pipelined
+// commands are added after each other, until they are flushed
 func (c *client) sendResponse(r ...interface{}) {
-	c.bufout.Reset(c.conn)
-	if c.log.IsDebug() {
+	if c.log.IsDebug() && c.bufout.Buffered() == 0 {
 		// us additional buffer so that we can log the response in debug mode only
 		c.response.Reset()
 	}
-	for _, item := range r {
+	for i, item := range r {
+		var s string
 		switch v := item.(type) {
 		case string:
-			if _, err := c.bufout.WriteString(v); err != nil {
-				c.log.WithError(err).Error("could not write to c.bufout")
-			}
-			if c.log.IsDebug() {
-				c.response.WriteString(v)
-			}
+			s = v
 		case error:
-			if _, err := c.bufout.WriteString(v.Error()); err != nil {
-				c.log.WithError(err).Error("could not write to c.bufout")
-			}
-			if c.log.IsDebug() {
-				c.response.WriteString(v.Error())
-			}
+			s = v.Error()
 		case fmt.Stringer:
-			if _, err := c.bufout.WriteString(v.String()); err != nil {
-				c.log.WithError(err).Error("could not write to c.bufout")
-			}
-			if c.log.IsDebug() {
-				c.response.WriteString(v.String())
-			}
+			s = v.String()
+		default:
+			continue
+		}
+		if i == 0 && strings.HasPrefix(s, "5") {
+			c.failures++
+		}
+		if _, err := c.bufout.WriteString(s); err != nil {
+			c.log.WithError(err).Error("could not write to c.bufout")
+		}
+		if c.log.IsDebug() {
+			c.response.WriteString(s)
 		}
 	}
 	c.bufout.WriteString("\r\n")
@@ -114,6 +128,63 @@ func (c *client) sendResponse(r ...interface{}) {
 // TLS handhsake
 func (c *client) resetTransaction() {
 	c.Envelope.ResetTransaction()
+	c.rcptCmds = 0
+	if c.ja3 != "" {
+		// the fingerprint stays for the whole connection
+		c.Values[backends.ValueJA3] = c.ja3
+	}
+}
+
+// rcptMark is the length of the recipients & of the rewrites of the envelope, taken before a
+// recipient is validated, see client.rejectRcpt
+type rcptMark struct {
+	rcpts    int
+	rewrites int
+}
+
+// markRcpts returns the rcptMark of the envelope now
+func (c *client) markRcpts() rcptMark {
+	rewrites, _ := c.Values[backends.ValueRewrites].([]backends.Rewrite)
+	return rcptMark{rcpts: len(c.RcptTo), rewrites: len(rewrites)}
+}
+
+// rejectRcpt removes the recipient that was pushed after m, and the recipients that the
+// backend expanded it to during the validation, eg. the targets of an alias, with their rewrites
+func (c *client) rejectRcpt(m rcptMark) {
+	if len(c.RcptTo) > m.rcpts {
+		c.RcptTo = c.RcptTo[:m.rcpts]
+	}
+	if rewrites, ok := c.Values[backends.ValueRewrites].([]backends.Rewrite); ok && len(rewrites) > m.rewrites {
+		c.Values[backends.ValueRewrites] = rewrites[:m.rewrites]
+	}
+}
+
+// setDSNRcpt keeps the DSN parameters of the recipient to, for the bounces
+func (c *client) setDSNRcpt(to mail.Address, dsn backends.DSNRcpt) {
+	rcpts, ok := c.Values[backends.ValueDSNRcpts].(map[string]backends.DSNRcpt)
+	if !ok {
+		rcpts = make(map[string]backends.DSNRcpt)
+		c.Values[backends.ValueDSNRcpts] = rcpts
+	}
+	rcpts[to.String()] = dsn
+}
+
+// protocol returns the name of the protocol of the transaction for the Received header,
+// eg. ESMTPSA for ESMTP with TLS and an authenticated client, see RFC 3848
+func (c *client) protocol(lmtp bool) string {
+	protocol := "SMTP"
+	if lmtp {
+		protocol = "LMTP"
+	} else if c.esmtp || c.TLS || c.authLogin != "" {
+		protocol = "ESMTP"
+	}
+	if c.TLS {
+		protocol += "S"
+	}
+	if c.authLogin != "" {
+		protocol += "A"
+	}
+	return protocol
 }
 
 // isInTransaction returns true if the connection is inside a transaction.
@@ -146,6 +217,15 @@ func (c *client) setTimeout(t time.Duration) {
 	}
 }
 
+// setDeadline sets the deadline of the connection, goroutine safe
+func (c *client) setDeadline(t time.Time) {
+	defer c.connGuard.Unlock()
+	c.connGuard.Lock()
+	if c.conn != nil {
+		c.conn.SetDeadline(t)
+	}
+}
+
 // closeConn closes a client connection, , goroutine safe
 func (c *client) closeConn() {
 	defer c.connGuard.Unlock()
@@ -154,6 +234,19 @@ func (c *client) closeConn() {
 	c.conn = nil
 }
 
+// forceClose tells the client that the service is shutting down and closes the connection,
+// goroutine safe. Used when the client did not finish in time
+func (c *client) forceClose() {
+	defer c.connGuard.Unlock()
+	c.connGuard.Lock()
+	if c.conn != nil {
+		c.conn.SetDeadline(time.Now().Add(time.Second))
+		c.conn.Write([]byte(response.Canned.ErrorShutdownTimeout + "\r\n"))
+		// closeConn will be called when the client's goroutine notices
+		c.conn.Close()
+	}
+}
+
 // init is called after the client is borrowed from the pool, to get it ready for the connection
 func (c *client) init(conn net.Conn, clientID uint64, ep *mail.Pool) {
 	c.conn = conn
@@ -166,10 +259,25 @@ func (c *client) init(conn net.Conn, clientID uint64, ep *mail.Pool) {
 	c.ConnectedAt = time.Now()
 	c.ID = clientID
 	c.errors = 0
+	c.messageIDs = nil
+	c.ja3 = ""
+	c.authLogin = ""
+	c.esmtp = false
+	c.bytesReceived = 0
+	c.failures = 0
+	c.messagesSent = 0
+	c.rcptsReceived = 0
 	// borrow an envelope from the envelope pool
 	c.Envelope = ep.Borrow(getRemoteAddr(conn), clientID)
 }
 
+// countBytes adds n to the bytes received from the client.
+// Returns false if they are over the limit, a limit of 0 means no limit
+func (c *client) countBytes(n int64, limit int64) bool {
+	c.bytesReceived += n
+	return limit <= 0 || c.bytesReceived <= limit
+}
+
 // getID returns the client's unique ID
 func (c *client) getID() uint64 {
 	return c.ID
@@ -178,22 +286,51 @@ func (c *client) getID() uint64 {
 // UpgradeToTLS upgrades a client connection to TLS
 func (client *client) upgradeToTLS(tlsConfig *tls.Config) error {
 	var tlsConn *tls.Conn
+	// record the ClientHello to fingerprint the client
+	recorder := &helloRecorder{Conn: client.conn}
 	// load the config thread-safely
-	tlsConn = tls.Server(client.conn, tlsConfig)
+	tlsConn = tls.Server(recorder, tlsConfig)
 	// Call handshake here to get any handshake error before reading starts
 	err := tlsConn.Handshake()
 	if err != nil {
 		return err
 	}
+	if fp, err := recorder.ja3(); err == nil {
+		client.ja3 = fp
+		client.Values[backends.ValueJA3] = fp
+	} else {
+		client.log.WithError(err).Debugf("[%s] could not fingerprint the TLS client", client.RemoteIP)
+	}
+	recorder.done, recorder.record = true, nil
 	// convert tlsConn to net.Conn
 	client.conn = net.Conn(tlsConn)
 	client.bufout.Reset(client.conn)
 	client.bufin.Reset(client.conn)
 	client.TLS = true
+	client.TLSInfo = newTLSInfo(tlsConn.ConnectionState())
+	subject, _ := client.TLSClientSubject()
+	client.log.WithField("tls_version", client.TLSInfo.Version).
+		WithField("tls_cipher", client.TLSInfo.CipherSuite).
+		WithField("tls_server_name", client.TLSInfo.ServerName).
+		WithField("tls_client_cert", client.TLSInfo.ClientCert).
+		WithField("tls_client_subject", subject).
+		Infof("[%s] TLS established, id: %d", client.RemoteIP, client.ID)
 	return err
 }
 
+// unixRemoteIP is the RemoteIP of the clients connected to a unix socket, they are on this host
+const unixRemoteIP = "127.0.0.1"
+
+// isUnixConn returns true if the client connected to a unix socket
+func isUnixConn(conn net.Conn) bool {
+	_, ok := conn.(*net.UnixConn)
+	return ok
+}
+
 func getRemoteAddr(conn net.Conn) string {
+	if isUnixConn(conn) {
+		return unixRemoteIP
+	}
 	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
 		// we just want the IP (not the port)
 		return addr.IP.String()
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/response"
 	"os"
 	"reflect"
+	"regexp"
 	"strings"
 )
 
@@ -27,8 +29,14 @@ type AppConfig struct {
 	// LogLevel controls the lowest level we log.
 	// "info", "debug", "error", "panic". Default "info"
 	LogLevel string `json:"log_level,omitempty"`
+	// LogFormat is the format of the log entries, "text" or "json". Default "text"
+	LogFormat string `json:"log_format,omitempty"`
 	// BackendConfig configures the email envelope processing backend
 	BackendConfig backends.BackendConfig `json:"backend_config"`
+	// ShutdownTimeout is how many seconds to wait for clients and in-flight saves when shutting down.
+	// After that, the remaining clients are disconnected and the backend's tasks are cancelled.
+	// 0 waits until everything is done
+	ShutdownTimeout int `json:"shutdown_timeout,omitempty"`
 }
 
 // ServerConfig specifies config options for a single server
@@ -48,38 +56,184 @@ type ServerConfig struct {
 	PublicKeyFile string `json:"public_key_file"`
 	// Timeout specifies the connection timeout in seconds. Defaults to 30
 	Timeout int `json:"timeout"`
+	// TimeoutCommand is how many seconds to wait for the next command. Defaults to 300,
+	// the minimum of RFC 5321 section 4.5.3.2
+	TimeoutCommand int `json:"timeout_command,omitempty"`
+	// TimeoutData is how many seconds to wait for more of the message after DATA. Defaults to 180
+	TimeoutData int `json:"timeout_data,omitempty"`
+	// TimeoutDataTermination is how many seconds the client has to send the whole message,
+	// up to the "." that ends it. Defaults to 600
+	TimeoutDataTermination int `json:"timeout_data_termination,omitempty"`
+	// StrictCRLF rejects the messages with a bare CR or LF with a 550. Otherwise a bare LF is kept as
+	// a line break, and a bare CR is removed. Either way, only CRLF.CRLF ends a message
+	StrictCRLF bool `json:"strict_crlf,omitempty"`
 	// Listen interface specified in <ip>:<port> - defaults to 127.0.0.1:2525
+	// or unix:<path> to listen on a unix socket, eg. "unix:/var/run/guerrilla/lmtp.sock"
 	ListenInterface string `json:"listen_interface"`
+	// SocketMode is the permissions of the unix socket, in octal, eg. "0660". Only the clients that
+	// may write to the socket can connect, the allowed_nets & denied_nets don't apply to them.
+	// Left as created, depending on the umask, if empty
+	SocketMode string `json:"socket_mode,omitempty"`
 	// StartTLSOn should we offer STARTTLS command. Cert must be valid.
 	// False by default
 	StartTLSOn bool `json:"start_tls_on,omitempty"`
 	// TLSAlwaysOn run this server as a pure TLS server, i.e. SMTPS
 	TLSAlwaysOn bool `json:"tls_always_on,omitempty"`
+	// RequireTLS refuses MAIL, RCPT, DATA and the other sensitive commands with a 530
+	// until the client has issued STARTTLS, so that no mail is accepted in cleartext.
+	// Needs StartTLSOn
+	RequireTLS bool `json:"require_tls,omitempty"`
+	// Certificates are more certificates for the TLS handshake, for serving several domains.
+	// The certificate is selected by the server name (SNI) the client asks for, matching
+	// the names in the certificate. The PublicKeyFile & PrivateKeyFile pair is the default,
+	// used when none of the names match
+	Certificates []TLSCertificate `json:"certificates,omitempty"`
+	// ACME gets the certificates of the hosts from an ACME CA such as Let's Encrypt, and renews them
+	// in the background. The TLS-ALPN-01 challenge is used, the CA connects to port 443, so a server
+	// with tls_always_on must listen there, using the same cache_dir. The PublicKeyFile &
+	// PrivateKeyFile are optional, they are used for other names & when the CA fails. Off if empty
+	ACME *ACMEConfig `json:"acme,omitempty"`
+	// TLSMinVersion is the lowest TLS version accepted, "1.0", "1.1" or "1.2". Go's default if empty
+	TLSMinVersion string `json:"tls_min_version,omitempty"`
+	// TLSCiphers is a comma separated list of the cipher suites to use, in order of preference,
+	// eg. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Go's default if empty
+	TLSCiphers string `json:"tls_ciphers,omitempty"`
+	// ClientAuth asks the clients for a certificate, "none", "request" or "require". A certificate
+	// that is presented must be signed by the ClientCAFile. With "require", the handshake fails
+	// without one, and the sensitive commands are refused until the client has issued STARTTLS.
+	// A client with a verified certificate is authenticated as its identity, see ClientCertMapper.
+	// A certificate is verified if the client presents one when empty
+	ClientAuth string `json:"client_auth,omitempty"`
+	// ClientCAFile is a PEM bundle of the CAs that sign the client certificates.
+	// The system's CAs if empty
+	ClientCAFile string `json:"client_ca_file,omitempty"`
 	// MaxClients controls how many maxiumum clients we can handle at once.
 	// Defaults to 100
 	MaxClients int `json:"max_clients"`
-	// LogFile is where the logs go. Use path to file, or "stderr", "stdout" or "off".
+	// EnvelopePoolSize is the most envelopes kept for reuse after their connection closed,
+	// the others are left to the garbage collector. Defaults to MaxClients
+	EnvelopePoolSize int `json:"envelope_pool_size,omitempty"`
+	// LogFile is where the connection & transaction logs of this server go.
+	// Use path to file, or "stderr", "stdout" or "off".
 	// defaults to AppConfig.Log file setting
 	LogFile string `json:"log_file,omitempty"`
 	// XClientOn when using a proxy such as Nginx, XCLIENT command is used to pass the
 	// original client's IP address & client's HELO
 	XClientOn bool `json:"xclient_on,omitempty"`
+	// MaxConcurrentHandshakes limits how many TLS handshakes can be in progress at once.
+	// Handshakes over the limit wait briefly for a free slot, after that STARTTLS gets a 454
+	// reply and TLSAlwaysOn connections are dropped. 0 means no limit
+	MaxConcurrentHandshakes int `json:"max_concurrent_handshakes,omitempty"`
+	// DuplicateMessageID controls what to do when a client sends more than one message with the same
+	// Message-ID during a connection. "rewrite" gives the message a new unique Message-ID,
+	// "reject" rejects the message. Off if empty
+	DuplicateMessageID string `json:"duplicate_message_id,omitempty"`
+	// SenderDomainsFile is a file that lists the domains each authenticated user may use in the
+	// MAIL FROM, one user per line: "<login> <domain>,<domain>...". A user that is not listed may
+	// only use the domain of their login, if the login is an address. Other domains get a 550.
+	// Users are authenticated by a proxy, which passes the LOGIN with XCLIENT. Off if empty
+	SenderDomainsFile string `json:"sender_domains_file,omitempty"`
+	// EnableVRFY lets VRFY check an address with the backend's recipient validation.
+	// When off, VRFY always gets a 252 reply, so that the existence of addresses isn't leaked
+	EnableVRFY bool `json:"enable_vrfy,omitempty"`
+	// EnableEXPN turns on EXPN, which expands a list if the backend implements backends.ListExpander,
+	// otherwise gets a 252 reply. When off, EXPN gets a 502 reply
+	EnableEXPN bool `json:"enable_expn,omitempty"`
+	// MaxRecipients is the most recipients a transaction may have. The RCPT TO commands over it
+	// get a 452 reply, the recipients already accepted are kept. 0 means no limit
+	MaxRecipients int `json:"max_recipients,omitempty"`
+	// MaxMessagesPerConnection is the most messages a client may deliver during a connection. The
+	// MAIL FROM after them gets a 421 reply and the connection is closed. 0 means no limit
+	MaxMessagesPerConnection int `json:"max_messages_per_connection,omitempty"`
+	// MaxRcptsPerConnection is the most recipients a client may give during a connection, counting
+	// the recipients of all its transactions. The RCPT TO commands over it get a 452 reply, like
+	// for the MaxRecipients. 0 means no limit
+	MaxRcptsPerConnection int `json:"max_rcpts_per_connection,omitempty"`
+	// MaxConnectionBytes is the most a client may send during a connection, counting the commands
+	// and the messages of all the transactions. The connection is closed with a 421 reply when
+	// it goes over, the message that went over is not accepted. 0 means no limit
+	MaxConnectionBytes int64 `json:"max_connection_bytes,omitempty"`
+	// GreetingDelay is how many seconds to wait before the 220 greeting. A client that talks before
+	// the greeting doesn't follow the protocol, most likely it is spam software, and is disconnected
+	// with a 554 reply. 0 means no delay
+	GreetingDelay int `json:"greeting_delay,omitempty"`
+	// ErrorDelay is how many seconds to wait before replying with a 5xx, multiplied by the number of
+	// 5xx replies the client got during the connection, to slow down abusive clients. The delay is
+	// never longer than the timeout. 0 means no delay
+	ErrorDelay int `json:"error_delay,omitempty"`
+	// Protocol is "smtp" (default) or "lmtp". An LMTP server, eg. for delivering to Dovecot, greets
+	// with LHLO instead of HELO/EHLO, and replies for each recipient after DATA
+	Protocol string `json:"protocol,omitempty"`
+	// HeloValidation checks the name given with HELO, EHLO or LHLO. "syntax" rejects the names that
+	// are not a fully qualified domain name or an address literal with a 501, "resolvable" also
+	// rejects the domain names without an A or AAAA record with a 550. "none" (default) doesn't check
+	HeloValidation string `json:"helo_validation,omitempty"`
+	// Greeting replaces the text after the host name in the 220 greeting, which names the
+	// software and its version by default, eg. "ESMTP ready"
+	Greeting string `json:"greeting,omitempty"`
+	// Responses replace the canned responses of the server, by their name in response.Responses,
+	// eg. {"FailRcptCmd": "550 5.1.1 No such user here"}. The enhanced code may be left out to
+	// only change the text, see response.Responses.Override
+	Responses map[string]string `json:"responses,omitempty"`
+	// AllowedNets are the networks that may connect, in CIDR notation, eg. "192.0.2.0/24" or
+	// "2001:db8::/32". Clients from other networks are disconnected before the greeting.
+	// All networks may connect if empty
+	AllowedNets []string `json:"allowed_nets,omitempty"`
+	// DeniedNets are the networks that may not connect, even if they are in the AllowedNets
+	DeniedNets []string `json:"denied_nets,omitempty"`
+	// DeniedNetsReply sends a 554 reply to the clients that may not connect, before disconnecting
+	// them. Otherwise the connection is closed without a reply
+	DeniedNetsReply bool `json:"denied_nets_reply,omitempty"`
+	// MaxSessionsPerUser is the most sessions an authenticated user may have at once, counting the
+	// sessions on all the servers. A session over it is closed with a 421 reply when the user is
+	// authenticated (XCLIENT LOGIN). 0 means no limit
+	MaxSessionsPerUser int `json:"max_sessions_per_user,omitempty"`
 
 	// The following used to watch certificate changes so that the TLS can be reloaded
 	_privateKeyFile_mtime int
 	_publicKeyFile_mtime  int
+	// the files & modification times of the Certificates
+	_certificates_mtime string
 }
 
+// values for ServerConfig.Protocol
+const (
+	ProtocolSMTP = "smtp"
+	ProtocolLMTP = "lmtp"
+)
+
+// values for ServerConfig.DuplicateMessageID
+const (
+	DuplicateMessageIDRewrite = "rewrite"
+	DuplicateMessageIDReject  = "reject"
+)
+
 // Unmarshalls json data into AppConfig struct and any other initialization of the struct
 // also does validation, returns error if validation failed or something went wrong
+// ${ENV_VAR} references in the string values are substituted
 func (c *AppConfig) Load(jsonBytes []byte) error {
+	return c.load(jsonBytes, true)
+}
+
+// load is like Load, expand is false when the values were substituted already,
+// so that a value containing ${ is not substituted twice
+func (c *AppConfig) load(jsonBytes []byte, expand bool) error {
 	err := json.Unmarshal(jsonBytes, c)
 	if err != nil {
 		return fmt.Errorf("could not parse config file: %s", err)
 	}
+	if expand {
+		// substitute ${ENV_VAR} references in the string values
+		if err = expandEnv(reflect.ValueOf(c)); err != nil {
+			return err
+		}
+	}
 	if err = c.setDefaults(); err != nil {
 		return err
 	}
+	if err = log.ValidateFormat(c.LogFormat); err != nil {
+		return err
+	}
 	if err = c.setBackendDefaults(); err != nil {
 		return err
 	}
@@ -124,6 +278,10 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	if strings.Compare(oldConfig.LogLevel, c.LogLevel) != 0 {
 		app.Publish(EventConfigLogLevel, c)
 	}
+	// has log format changed?
+	if strings.Compare(oldConfig.LogFormat, c.LogFormat) != 0 {
+		app.Publish(EventConfigLogFormat, c)
+	}
 	// server config changes
 	oldServers := oldConfig.getServers()
 	for iface, newServer := range c.getServers() {
@@ -323,6 +481,11 @@ func (sc *ServerConfig) emitChangeEvents(oldServer *ServerConfig, app Guerrilla)
 		if _, ok := changes["TLSAlwaysOn"]; ok {
 			return true
 		}
+		for _, key := range []string{"Certificates", "TLSMinVersion", "TLSCiphers", "ACME", "ClientAuth", "ClientCAFile"} {
+			if _, ok := changes[key]; ok {
+				return true
+			}
+		}
 		return false
 	}(); ok {
 		app.Publish(EventConfigServerTLSConfig, sc)
@@ -348,6 +511,16 @@ func (sc *ServerConfig) loadTlsKeyTimestamps() error {
 	} else {
 		return statErr(sc.ListenInterface, err)
 	}
+	sc._certificates_mtime = ""
+	for _, c := range sc.Certificates {
+		for _, file := range []string{c.PublicKeyFile, c.PrivateKeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return statErr(sc.ListenInterface, err)
+			}
+			sc._certificates_mtime += fmt.Sprintf("%s:%d;", file, info.ModTime().UnixNano())
+		}
+	}
 	return nil
 }
 
@@ -357,11 +530,21 @@ func (sc *ServerConfig) getTlsKeyTimestamps() (int, int) {
 	return sc._privateKeyFile_mtime, sc._publicKeyFile_mtime
 }
 
+// envelopePoolSize returns the envelope_pool_size, or the max_clients if not set
+func (sc *ServerConfig) envelopePoolSize() int {
+	if sc.EnvelopePoolSize > 0 {
+		return sc.EnvelopePoolSize
+	}
+	return sc.MaxClients
+}
+
 // Validate validates the server's configuration.
 func (sc *ServerConfig) Validate() error {
 	var errs Errors
 
-	if sc.StartTLSOn || sc.TLSAlwaysOn {
+	// with ACME, the static certificates are optional
+	staticCerts := sc.ACME == nil || sc.PublicKeyFile != "" || sc.PrivateKeyFile != ""
+	if (sc.StartTLSOn || sc.TLSAlwaysOn) && staticCerts {
 		if sc.PublicKeyFile == "" {
 			errs = append(errs, errors.New("PublicKeyFile is empty"))
 		}
@@ -373,6 +556,87 @@ func (sc *ServerConfig) Validate() error {
 				errors.New(fmt.Sprintf("cannot use TLS config for [%s], %v", sc.ListenInterface, err)))
 		}
 	}
+	if sc.StartTLSOn || sc.TLSAlwaysOn {
+		for _, c := range sc.Certificates {
+			if _, err := tls.LoadX509KeyPair(c.PublicKeyFile, c.PrivateKeyFile); err != nil {
+				errs = append(errs,
+					errors.New(fmt.Sprintf("cannot use certificate %s for [%s], %v", c.PublicKeyFile, sc.ListenInterface, err)))
+			}
+		}
+		if _, err := tlsMinVersion(sc.TLSMinVersion); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("cannot use TLS config for [%s], %v", sc.ListenInterface, err)))
+		}
+		if _, err := tlsCipherSuites(sc.TLSCiphers); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("cannot use TLS config for [%s], %v", sc.ListenInterface, err)))
+		}
+		if _, err := tlsClientAuth(sc.ClientAuth); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("cannot use TLS config for [%s], %v", sc.ListenInterface, err)))
+		}
+		if _, err := loadClientCAs(sc.ClientCAFile); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("cannot use TLS config for [%s], %v", sc.ListenInterface, err)))
+		}
+	}
+	if sc.ACME != nil {
+		if err := sc.ACME.validate(); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("cannot use TLS config for [%s], %v", sc.ListenInterface, err)))
+		}
+	}
+	if sc.RequireTLS && !sc.StartTLSOn && !sc.TLSAlwaysOn {
+		errs = append(errs,
+			errors.New(fmt.Sprintf("require_tls for [%s] needs start_tls_on", sc.ListenInterface)))
+	}
+	if sc.ClientAuth == ClientAuthRequire && !sc.StartTLSOn && !sc.TLSAlwaysOn {
+		errs = append(errs,
+			errors.New(fmt.Sprintf("client_auth require for [%s] needs start_tls_on", sc.ListenInterface)))
+	}
+	switch sc.Protocol {
+	case "", ProtocolSMTP, ProtocolLMTP:
+	default:
+		errs = append(errs,
+			errors.New(fmt.Sprintf("invalid protocol for [%s]: %s", sc.ListenInterface, sc.Protocol)))
+	}
+	switch sc.DuplicateMessageID {
+	case "", DuplicateMessageIDRewrite, DuplicateMessageIDReject:
+	default:
+		errs = append(errs,
+			errors.New(fmt.Sprintf("invalid duplicate_message_id for [%s]: %s", sc.ListenInterface, sc.DuplicateMessageID)))
+	}
+	if strings.ContainsAny(sc.Greeting, "\r\n") {
+		errs = append(errs,
+			errors.New(fmt.Sprintf("greeting for [%s] must be a single line", sc.ListenInterface)))
+	}
+	if _, err := response.Canned.Override(sc.Responses); err != nil {
+		errs = append(errs,
+			errors.New(fmt.Sprintf("cannot use responses for [%s], %v", sc.ListenInterface, err)))
+	}
+	for _, nets := range [][]string{sc.AllowedNets, sc.DeniedNets} {
+		if _, err := parseNets(nets); err != nil {
+			errs = append(errs,
+				errors.New(fmt.Sprintf("cannot use allowed_nets or denied_nets for [%s], %v", sc.ListenInterface, err)))
+		}
+	}
+	switch sc.HeloValidation {
+	case "", HeloValidationNone, HeloValidationSyntax, HeloValidationResolvable:
+	default:
+		errs = append(errs,
+			errors.New(fmt.Sprintf("invalid helo_validation for [%s]: %s", sc.ListenInterface, sc.HeloValidation)))
+	}
+	if sc.EnvelopePoolSize < 0 {
+		errs = append(errs,
+			errors.New(fmt.Sprintf("envelope_pool_size for [%s] cannot be negative", sc.ListenInterface)))
+	}
+	if sc.SocketMode != "" {
+		if _, err := parseSocketMode(sc.SocketMode); err != nil {
+			errs = append(errs,
+				errors.New(fmt.Sprintf("invalid socket_mode for [%s]: %s", sc.ListenInterface, sc.SocketMode)))
+		}
+	}
+	if sc.SenderDomainsFile != "" {
+		if _, err := loadSenderDomains(sc.SenderDomainsFile); err != nil {
+			errs = append(errs,
+				errors.New(fmt.Sprintf("cannot use sender_domains_file for [%s], %v", sc.ListenInterface, err)))
+		}
+	}
 	if len(errs) > 0 {
 		return errs
 	}
@@ -403,6 +667,21 @@ func getDiff(a interface{}, b interface{}) map[string]interface{} {
 			if t2 != t4 {
 				ret["PublicKeyFile"] = newServer.PublicKeyFile
 			}
+			if oldServer._certificates_mtime != newServer._certificates_mtime {
+				ret["Certificates"] = newServer._certificates_mtime
+			}
+			if !reflect.DeepEqual(oldServer.ACME, newServer.ACME) {
+				ret["ACME"] = newServer.ACME
+			}
+			if !reflect.DeepEqual(oldServer.Responses, newServer.Responses) {
+				ret["Responses"] = newServer.Responses
+			}
+			if !reflect.DeepEqual(oldServer.AllowedNets, newServer.AllowedNets) {
+				ret["AllowedNets"] = newServer.AllowedNets
+			}
+			if !reflect.DeepEqual(oldServer.DeniedNets, newServer.DeniedNets) {
+				ret["DeniedNets"] = newServer.DeniedNets
+			}
 		}
 	}
 	return ret
@@ -432,3 +711,95 @@ func structtomap(obj interface{}) map[string]interface{} {
 	}
 	return ret
 }
+
+// matches ${ENV_VAR} and ${ENV_VAR:-default}
+var envVarRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnvString replaces ${ENV_VAR} with the value of the environment variable, or with
+// the default when using ${ENV_VAR:-default} and the variable is unset or empty.
+// A $ that is not part of a valid reference is left as it is.
+// Returns an error if a variable without a default is not set
+func expandEnvString(str string) (string, error) {
+	var err error
+	expanded := envVarRegex.ReplaceAllStringFunc(str, func(ref string) string {
+		m := envVarRegex.FindStringSubmatch(ref)
+		val, ok := os.LookupEnv(m[1])
+		if m[2] != "" {
+			if val == "" {
+				return m[3]
+			}
+			return val
+		}
+		if !ok && err == nil {
+			err = fmt.Errorf("config references environment variable ${%s} which is not set", m[1])
+		}
+		return val
+	})
+	return expanded, err
+}
+
+// expandEnv walks through v and calls expandEnvString on every string it can set,
+// including strings nested in structs, slices and maps such as the backend config
+func expandEnv(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Kind() == reflect.Interface && v.Elem().Kind() == reflect.String {
+			if !v.CanSet() {
+				return nil
+			}
+			str, err := expandEnvString(v.Elem().String())
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(str))
+			return nil
+		}
+		return expandEnv(v.Elem())
+	case reflect.String:
+		if !v.CanSet() {
+			return nil
+		}
+		str, err := expandEnvString(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(str)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				if err := expandEnv(v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnv(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// map values cannot be set in place, strings need to be put back with SetMapIndex
+			val := v.MapIndex(key)
+			if val.Kind() == reflect.Interface && !val.IsNil() {
+				val = val.Elem()
+			}
+			if val.Kind() != reflect.String {
+				if err := expandEnv(val); err != nil {
+					return err
+				}
+				continue
+			}
+			str, err := expandEnvString(val.String())
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, reflect.ValueOf(str).Convert(val.Type()))
+		}
+	}
+	return nil
+}
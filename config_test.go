@@ -174,6 +174,77 @@ func TestConfigLoad(t *testing.T) {
 	}
 }
 
+var configJsonEnv = `
+{
+    "log_file" : "${GG_TEST_LOG_FILE:-./tests/testlog}",
+    "allowed_hosts": ["${GG_TEST_HOST}", "pa$$word.com", "$GG_TEST_HOST", "${1GG}"],
+    "backend_config" :
+        {
+            "save_process" : "HeadersParser|Debugger",
+            "mysql_pass" : "${GG_TEST_MYSQL_PASS}",
+            "nested" : {"list" : ["${GG_TEST_HOST}", 1, {"deeper" : "x${GG_TEST_HOST}x"}]}
+        },
+    "servers" : [
+        {
+            "is_enabled" : true,
+            "host_name":"${GG_TEST_HOST}",
+            "max_size": 100017,
+            "private_key_file":"${GG_TEST_CERT_DIR}/mail2.guerrillamail.com.key.pem",
+            "public_key_file":"${GG_TEST_CERT_DIR}/mail2.guerrillamail.com.cert.pem",
+            "timeout":160,
+            "listen_interface":"127.0.0.1:2526",
+            "max_clients": 2
+        }
+    ]
+}
+`
+
+func TestConfigLoadEnv(t *testing.T) {
+	os.Setenv("GG_TEST_HOST", "grr.la")
+	os.Setenv("GG_TEST_MYSQL_PASS", "s3cr$t")
+	os.Setenv("GG_TEST_CERT_DIR", "./tests")
+	os.Unsetenv("GG_TEST_LOG_FILE")
+	defer func() {
+		os.Unsetenv("GG_TEST_HOST")
+		os.Unsetenv("GG_TEST_MYSQL_PASS")
+		os.Unsetenv("GG_TEST_CERT_DIR")
+	}()
+	ac := &AppConfig{}
+	if err := ac.Load([]byte(configJsonEnv)); err != nil {
+		t.Error("Cannot load config |", err)
+		t.FailNow()
+	}
+	if ac.LogFile != "./tests/testlog" {
+		t.Error("expecting the default log file, got:", ac.LogFile)
+	}
+	expectedHosts := []string{"grr.la", "pa$$word.com", "$GG_TEST_HOST", "${1GG}"}
+	for i := range expectedHosts {
+		if ac.AllowedHosts[i] != expectedHosts[i] {
+			t.Error("expecting allowed host", expectedHosts[i], "got:", ac.AllowedHosts[i])
+		}
+	}
+	if ac.BackendConfig["mysql_pass"] != "s3cr$t" {
+		t.Error("expecting mysql_pass s3cr$t, got:", ac.BackendConfig["mysql_pass"])
+	}
+	list := ac.BackendConfig["nested"].(map[string]interface{})["list"].([]interface{})
+	if list[0] != "grr.la" || list[1] != float64(1) {
+		t.Error("nested list was not expanded, got:", list)
+	}
+	if deeper := list[2].(map[string]interface{})["deeper"]; deeper != "xgrr.lax" {
+		t.Error("expecting xgrr.lax, got:", deeper)
+	}
+	if ac.Servers[0].Hostname != "grr.la" || ac.Servers[0].PrivateKeyFile != "./tests/mail2.guerrillamail.com.key.pem" {
+		t.Error("server config was not expanded, got:", ac.Servers[0].Hostname, ac.Servers[0].PrivateKeyFile)
+	}
+
+	// a variable without a default must be set
+	os.Unsetenv("GG_TEST_MYSQL_PASS")
+	ac = &AppConfig{}
+	if err := ac.Load([]byte(configJsonEnv)); err == nil || strings.Index(err.Error(), "GG_TEST_MYSQL_PASS") < 0 {
+		t.Error("expecting an error about GG_TEST_MYSQL_PASS not being set, got:", err)
+	}
+}
+
 // Test the sample config to make sure a valid one is given!
 func TestSampleConfig(t *testing.T) {
 	fileName := "goguerrilla.conf.sample"
@@ -275,3 +346,31 @@ func TestConfigChangeEvents(t *testing.T) {
 	// don't forget to reset
 	os.Truncate(oldconf.LogFile, 0)
 }
+
+// Test that rotated or removed SNI certificates are detected as a TLS change
+func TestConfigCertificatesChange(t *testing.T) {
+	sc := ServerConfig{
+		PublicKeyFile:  "./tests/mail2.guerrillamail.com.cert.pem",
+		PrivateKeyFile: "./tests/mail2.guerrillamail.com.key.pem",
+		Certificates: []TLSCertificate{{
+			PublicKeyFile:  "./tests/mail2.guerrillamail.com.cert.pem",
+			PrivateKeyFile: "./tests/mail2.guerrillamail.com.key.pem",
+		}},
+	}
+	if err := sc.loadTlsKeyTimestamps(); err != nil {
+		t.Fatal(err)
+	}
+	rotated := sc
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(sc.Certificates[0].PrivateKeyFile, later, later)
+	rotated.loadTlsKeyTimestamps()
+	if _, ok := getDiff(sc, rotated)["Certificates"]; !ok {
+		t.Error("expecting the rotated certificate to be detected")
+	}
+	removed := rotated
+	removed.Certificates = nil
+	removed.loadTlsKeyTimestamps()
+	if _, ok := getDiff(rotated, removed)["Certificates"]; !ok {
+		t.Error("expecting the removed certificate to be detected")
+	}
+}
@@ -1,7 +1,11 @@
 package guerrilla
 
 import (
+	"sync"
+
 	evbus "github.com/asaskevich/EventBus"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
 )
 
 type Event int
@@ -19,6 +23,8 @@ const (
 	EventConfigLogReopen
 	// when log level changed
 	EventConfigLogLevel
+	// when log format changed
+	EventConfigLogFormat
 	// when the backend's config changed
 	EventConfigBackendConfig
 	// when a new server was added
@@ -41,6 +47,12 @@ const (
 	EventConfigServerMaxClients
 	// when a server's TLS config changed
 	EventConfigServerTLSConfig
+	// when the DATA of a message was received, before it is passed to the backend
+	EventMailReceived
+	// when the backend accepted a received message
+	EventMailAccepted
+	// when a received message was rejected, by the backend or by the server
+	EventMailRejected
 )
 
 var eventList = [...]string{
@@ -50,6 +62,7 @@ var eventList = [...]string{
 	"config_change:log_file",
 	"config_change:reopen_log_file",
 	"config_change:log_level",
+	"config_change:log_format",
 	"config_change:backend_config",
 	"server_change:new_server",
 	"server_change:remove_server",
@@ -61,8 +74,14 @@ var eventList = [...]string{
 	"server_change:timeout",
 	"server_change:max_clients",
 	"server_change:tls_config",
+	"mail:received",
+	"mail:accepted",
+	"mail:rejected",
 }
 
+// how many mail events can wait for the subscribers, the events that come when it's full are dropped
+const mailEventQueueSize = 1000
+
 func (e Event) String() string {
 	return eventList[e]
 }
@@ -85,3 +104,60 @@ func (h *EventHandler) Publish(topic Event, args ...interface{}) {
 func (h *EventHandler) Unsubscribe(topic Event, handler interface{}) error {
 	return h.Bus.Unsubscribe(topic.String(), handler)
 }
+
+type mailEvent struct {
+	topic Event
+	e     *mail.Envelope
+}
+
+// mailEvents publishes the mail events from a worker, so that the subscribers don't hold up
+// the SMTP conversation. The subscribers of the mail events are called with a copy of the
+// envelope, one event at a time, in the order the events were published. So for a message,
+// EventMailReceived always comes before its EventMailAccepted or EventMailRejected.
+// Events still in the queue at shutdown are delivered after it
+type mailEvents struct {
+	h       *EventHandler
+	mainlog func() log.Logger
+	queue   chan mailEvent
+	start   sync.Once
+}
+
+func newMailEvents(h *EventHandler, mainlog func() log.Logger) *mailEvents {
+	return &mailEvents{
+		h:       h,
+		mainlog: mainlog,
+		queue:   make(chan mailEvent, mailEventQueueSize),
+	}
+}
+
+// publish queues the event, if anyone subscribed to it. It never blocks
+func (m *mailEvents) publish(topic Event, e *mail.Envelope) {
+	if m == nil || m.h.Bus == nil || !m.h.Bus.HasCallback(topic.String()) {
+		return
+	}
+	m.start.Do(func() {
+		go m.deliver()
+	})
+	select {
+	case m.queue <- mailEvent{topic: topic, e: e.Copy()}:
+	default:
+		m.mainlog().WithField("queued_id", e.QueuedId).Warnf("mail event queue full, %s dropped", topic)
+	}
+}
+
+// deliver calls the subscribers for each event in the queue
+func (m *mailEvents) deliver() {
+	for ev := range m.queue {
+		m.call(ev)
+	}
+}
+
+// call publishes ev, a panic of a subscriber is logged
+func (m *mailEvents) call(ev mailEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.mainlog().WithField("queued_id", ev.e.QueuedId).Errorf("subscriber of %s panicked: %v", ev.topic, r)
+		}
+	}()
+	m.h.Publish(ev.topic, ev.e)
+}
@@ -5,11 +5,18 @@ import (
 	"fmt"
 	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// ErrShutdownTimeout is returned by Shutdown when it did not complete within the shutdown_timeout
+var ErrShutdownTimeout = errors.New("shutdown timed out, remaining connections were closed")
+
 const (
 	// server has just been created
 	GuerrillaStateNew = iota
@@ -36,7 +43,7 @@ func (e Errors) Error() string {
 
 type Guerrilla interface {
 	Start() error
-	Shutdown()
+	Shutdown() error
 	Subscribe(topic Event, fn interface{}) error
 	Publish(topic Event, args ...interface{})
 	Unsubscribe(topic Event, handler interface{}) error
@@ -52,6 +59,10 @@ type guerrilla struct {
 	EventHandler
 	logStore
 	backendStore
+	// mailEvents publishes the mail events of the servers
+	mailEvents *mailEvents
+	// sessions counts the sessions of the authenticated users on all the servers
+	sessions *userSessions
 }
 
 type logStore struct {
@@ -84,6 +95,11 @@ func New(ac *AppConfig, b backends.Backend, l log.Logger) (Guerrilla, error) {
 	}
 	g.backendStore.Store(b)
 	g.setMainlog(l)
+	g.mailEvents = newMailEvents(&g.EventHandler, g.mainlog)
+	g.sessions = newUserSessions()
+	if err := log.SetFormat(ac.LogFormat); err != nil {
+		return g, err
+	}
 
 	if ac.LogLevel != "" {
 		if h, ok := l.(*log.HookedLogger); ok {
@@ -130,6 +146,8 @@ func (g *guerrilla) makeServers() error {
 				errs = append(errs, err)
 			}
 			if server != nil {
+				server.mailEvents = g.mailEvents
+				server.sessions = g.sessions
 				g.servers[sc.ListenInterface] = server
 				server.setAllowedHosts(g.Config.AllowedHosts)
 			}
@@ -233,12 +251,25 @@ func (g *guerrilla) subscribeEvents() {
 		if err == nil {
 			g.logStore.Store(l)
 			g.mapServers(func(server *server) {
-				server.logStore.Store(l)
+				server.mainlogStore.Store(l)
+				// servers may have their own log file
+				if sl, err := log.GetLogger(server.log().GetLogDest(), c.LogLevel); err == nil {
+					server.logStore.Store(sl)
+				}
 			})
 			g.mainlog().Infof("log level changed to [%s]", c.LogLevel)
 		}
 	})
 
+	// when log format changes, it applies to all the logs
+	g.Subscribe(EventConfigLogFormat, func(c *AppConfig) {
+		if err := log.SetFormat(c.LogFormat); err != nil {
+			g.mainlog().WithError(err).Error("log format change failed")
+			return
+		}
+		g.mainlog().WithField("format", log.GetFormat()).Info("log format changed")
+	})
+
 	// write out our pid whenever the file name changes in the config
 	g.Subscribe(EventConfigPidFile, func(ac *AppConfig) {
 		g.writePid()
@@ -329,8 +360,6 @@ func (g *guerrilla) subscribeEvents() {
 			var l log.Logger
 			level := g.mainlog().GetLevel()
 			if l, err = log.GetLogger(sc.LogFile, level); err == nil {
-				g.setMainlog(l)
-				backends.Svc.SetMainlog(l)
 				// it will change to the new logger on the next accepted client
 				server.logStore.Store(l)
 				g.mainlog().Infof("Server [%s] changed, new clients will log to: [%s]",
@@ -356,33 +385,25 @@ func (g *guerrilla) subscribeEvents() {
 	// when the backend changes
 	g.Subscribe(EventConfigBackendConfig, func(appConfig *AppConfig) {
 		logger, _ := log.GetLogger(appConfig.LogFile, appConfig.LogLevel)
-		// shutdown the backend first.
-		var err error
-		if err = g.backend().Shutdown(); err != nil {
-			logger.WithError(err).Warn("Backend failed to shutdown")
-			return
-		}
-		// init a new backend, Revert to old backend config if it fails
-		if newBackend, newErr := backends.New(appConfig.BackendConfig, logger); newErr != nil {
-			logger.WithError(newErr).Error("Error while loading the backend")
-			err = g.backend().Reinitialize()
-			if err != nil {
-				logger.WithError(err).Fatal("failed to revert to old backend config")
-				return
-			}
-			err = g.backend().Start()
-			if err != nil {
-				logger.WithError(err).Fatal("failed to start backend with old config")
-				return
+		// init & start the new backend first, so that the servers can be swapped to it
+		// without a moment where there's no backend running. Keep the old backend if it fails
+		newBackend, err := backends.New(appConfig.BackendConfig, logger)
+		if err == nil {
+			if err = newBackend.Start(); err != nil {
+				newBackend.Shutdown()
 			}
+		}
+		if err != nil {
+			logger.WithError(err).Error("Error while loading the backend")
 			logger.Info("reverted to old backend config")
-		} else {
-			// swap to the bew backend (assuming old backend was shutdown so it can be safely swapped)
-			if err := newBackend.Start(); err != nil {
-				logger.WithError(err).Error("backend could not start")
-			}
-			logger.Info("new backend started")
-			g.storeBackend(newBackend)
+			return
+		}
+		oldBackend := g.backend()
+		g.storeBackend(newBackend)
+		logger.Info("new backend started")
+		// the old backend will complete any saves that are in-flight before shutting down
+		if err = oldBackend.Shutdown(); err != nil {
+			logger.WithError(err).Warn("Old backend failed to shutdown")
 		}
 	})
 
@@ -402,6 +423,53 @@ func (g *guerrilla) backend() backends.Backend {
 	return nil
 }
 
+// deliver validates the recipients of e, then saves it with the backend, like a server does with
+// the messages it receives. The error is not nil if the message was not accepted.
+// Like server.process, the envelope is handed to the new backend if the backend was swapped
+func (g *guerrilla) deliver(e *mail.Envelope) (backends.Result, error) {
+	if len(e.RcptTo) == 0 {
+		return backends.NewResult(response.Canned.FailNoRecipientsDataCmd), errors.New("no recipients")
+	}
+	for {
+		b := g.backend()
+		if b == nil {
+			return backends.NewResult(response.Canned.FailBackendNotRunning), errors.New("backend not configured")
+		}
+		// the recipients are validated one by one, as if each was added with RCPT TO
+		rcpts := e.RcptTo
+		e.RcptTo = make([]mail.Address, 0, len(rcpts))
+		for i := range rcpts {
+			e.PushRcpt(rcpts[i])
+			if err := b.ValidateRcpt(e); err == backends.StorageNotAvailable && b != g.backend() {
+				break
+			} else if err != nil {
+				e.RcptTo = rcpts
+				reply := response.Canned.FailRcptCmd + " " + err.Error()
+				if r, ok := err.(backends.RcptReply); ok {
+					reply = string(r)
+				}
+				return backends.NewResult(reply), fmt.Errorf("recipient %s rejected: %s", rcpts[i].String(), err)
+			}
+		}
+		if len(e.RcptTo) < len(rcpts) {
+			// swapped during the validation
+			e.RcptTo = rcpts
+			continue
+		}
+		g.mailEvents.publish(EventMailReceived, e)
+		res := b.Process(e)
+		if strings.HasPrefix(res.String(), response.Canned.FailBackendNotRunning) && b != g.backend() {
+			continue
+		}
+		if res.Code() >= 300 {
+			g.mailEvents.publish(EventMailRejected, e)
+			return res, errors.New("message not accepted: " + res.String())
+		}
+		g.mailEvents.publish(EventMailAccepted, e)
+		return res, nil
+	}
+}
+
 // Entry point for the application. Starts all servers.
 func (g *guerrilla) Start() error {
 	var startErrors Errors
@@ -456,26 +524,117 @@ func (g *guerrilla) Start() error {
 	return nil
 }
 
-func (g *guerrilla) Shutdown() {
-
-	// shut down the servers first
+// Shutdown shuts down the servers, then the backend.
+// If Config.ShutdownTimeout is set and shutting down takes longer, the clients that are still
+// connected get a 421 reply and are disconnected, and the backend's in-flight tasks are cancelled.
+// Returns ErrShutdownTimeout if that happened
+func (g *guerrilla) Shutdown() error {
+	var timeout <-chan time.Time
+	if g.Config.ShutdownTimeout > 0 {
+		timer := time.NewTimer(time.Duration(g.Config.ShutdownTimeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	servers := make([]*server, 0)
 	g.mapServers(func(s *server) {
 		if s.state == ServerStateRunning {
+			servers = append(servers, s)
+		}
+	})
+	hammer := func() {
+		err = ErrShutdownTimeout
+		g.mainlog().Warn("Shutdown timed out, closing the remaining connections")
+		for _, s := range servers {
+			s.closeClients()
+		}
+		if a, ok := g.backend().(backends.Aborter); ok {
+			a.Abort()
+		}
+	}
+
+	// shut down the servers first
+	done := make(chan bool)
+	go func() {
+		for _, s := range servers {
 			s.Shutdown()
 			g.mainlog().Infof("shutdown completed for [%s]", s.listenInterface)
 		}
-	})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-timeout:
+		hammer()
+		<-done
+	}
 
 	g.guard.Lock()
 	defer func() {
 		g.state = GuerrillaStateStopped
 		defer g.guard.Unlock()
 	}()
-	if err := g.backend().Shutdown(); err != nil {
-		g.mainlog().WithError(err).Warn("Backend failed to shutdown")
+	backendDone := make(chan error, 1)
+	go func() {
+		backendDone <- g.backend().Shutdown()
+	}()
+	var backendErr error
+	select {
+	case backendErr = <-backendDone:
+	case <-timeout:
+		hammer()
+		backendErr = <-backendDone
+	}
+	if backendErr != nil {
+		g.mainlog().WithError(backendErr).Warn("Backend failed to shutdown")
 	} else {
 		g.mainlog().Infof("Backend shutdown completed")
 	}
+	return err
+}
+
+// unhealthy checks that the enabled servers are listening and that the backend is healthy.
+// Returns the components that are not, with the reason
+func (g *guerrilla) unhealthy() map[string]string {
+	problems := make(map[string]string)
+	g.mapServers(func(s *server) {
+		if s.isEnabled() && s.state != ServerStateRunning {
+			problems["server "+s.listenInterface] = "not listening"
+		}
+	})
+	b := g.backend()
+	if b == nil {
+		problems["backend"] = "not configured"
+		return problems
+	}
+	if p, ok := b.(backends.Pinger); ok {
+		result := make(chan error, 1)
+		go func() {
+			result <- p.Ping()
+		}()
+		select {
+		case err := <-result:
+			if err != nil {
+				problems["backend"] = strings.TrimSpace(err.Error())
+			}
+		case <-time.After(healthCheckTimeout):
+			problems["backend"] = "ping timed out"
+		}
+	}
+	return problems
+}
+
+// envelopeStats returns the counters of the envelope pools of all the servers, added up
+func (g *guerrilla) envelopeStats() mail.PoolStats {
+	var total mail.PoolStats
+	g.mapServers(func(s *server) {
+		stats := s.envelopePool.Stats()
+		total.Gets += stats.Gets
+		total.Puts += stats.Puts
+		total.News += stats.News
+		total.InUse += stats.InUse
+	})
+	return total
 }
 
 // SetLogger sets the logger for the app and propagates it to sub-packages (eg.
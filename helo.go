@@ -0,0 +1,126 @@
+package guerrilla
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// values for ServerConfig.HeloValidation
+const (
+	HeloValidationNone       = "none"
+	HeloValidationSyntax     = "syntax"
+	HeloValidationResolvable = "resolvable"
+)
+
+const (
+	// how long a HELO name that does not resolve is remembered
+	heloFailureTTL = time.Minute
+	// how long to wait for the lookup of a HELO name
+	heloLookupTimeout = time.Second * 5
+)
+
+// heloLookupHost resolves the HELO names, can be changed for testing
+var heloLookupHost = net.DefaultResolver.LookupHost
+
+// a label of a domain name, see RFC 1035 section 2.3.1
+var heloLabelRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// validHeloSyntax returns true if helo is a fully qualified domain name or an address literal,
+// eg. "mail.example.com", "[192.0.2.1]" or "[IPv6:2001:db8::1]", see RFC 5321 section 4.1.3
+func validHeloSyntax(helo string) bool {
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		literal := helo[1 : len(helo)-1]
+		if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+			return strings.Contains(literal[5:], ":") && net.ParseIP(literal[5:]) != nil
+		}
+		return !strings.Contains(literal, ":") && net.ParseIP(literal) != nil
+	}
+	name := strings.TrimSuffix(helo, ".")
+	if len(name) > 253 {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if !heloLabelRegex.MatchString(label) {
+			return false
+		}
+	}
+	// a top-level domain is never all digits, eg. an IP without the brackets
+	return strings.Trim(labels[len(labels)-1], "0123456789") != ""
+}
+
+// heloFailures remembers the HELO names that did not resolve, so that a client that keeps
+// sending the same one isn't looked up each time
+type heloFailures struct {
+	// when each name is forgotten
+	expires map[string]time.Time
+	sync.Mutex
+}
+
+func newHeloFailures() *heloFailures {
+	return &heloFailures{expires: make(map[string]time.Time)}
+}
+
+// failed returns true if the name did not resolve during the last heloFailureTTL
+func (h *heloFailures) failed(name string) bool {
+	h.Lock()
+	defer h.Unlock()
+	expires, ok := h.expires[name]
+	if ok && time.Now().After(expires) {
+		delete(h.expires, name)
+		return false
+	}
+	return ok
+}
+
+// add remembers that the name did not resolve, the names that expired are forgotten
+func (h *heloFailures) add(name string) {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	for n, expires := range h.expires {
+		if now.After(expires) {
+			delete(h.expires, n)
+		}
+	}
+	h.expires[name] = now.Add(heloFailureTTL)
+}
+
+// checkHelo validates the HELO/EHLO name as set by the helo_validation. Returns the reply
+// if it is not valid, or "" if it is. A name that couldn't be looked up because of a
+// temporary DNS error is accepted
+func (server *server) checkHelo(helo string, validation string, canned *response.Responses) string {
+	if validation != HeloValidationSyntax && validation != HeloValidationResolvable {
+		return ""
+	}
+	if !validHeloSyntax(helo) {
+		return canned.FailHeloSyntax
+	}
+	if validation == HeloValidationSyntax || strings.HasPrefix(helo, "[") {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimSuffix(helo, "."))
+	if server.heloFailures.failed(name) {
+		return canned.FailHeloNotResolvable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), heloLookupTimeout)
+	defer cancel()
+	if _, err := heloLookupHost(ctx, name); err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Temporary() {
+			server.log().WithError(err).Warnf("could not look up the HELO name %s", name)
+			return ""
+		}
+		server.heloFailures.add(name)
+		return canned.FailHeloNotResolvable
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+package guerrilla
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TLS record header: content type, version, length
+	tlsRecordHeaderLen = 5
+	// the largest TLS record, a ClientHello that doesn't fit is not fingerprinted
+	tlsMaxRecordLen      = 16384
+	tlsRecordHandshake   = 22
+	tlsHandshakeHello    = 1
+	tlsExtSupportedCurve = 10
+	tlsExtPointFormats   = 11
+)
+
+var errClientHelloMalformed = errors.New("malformed ClientHello")
+
+// helloRecorder wraps a connection to keep a copy of the first TLS record read
+// from it, which is the client's ClientHello. Used to fingerprint the client
+type helloRecorder struct {
+	net.Conn
+	record []byte
+	done   bool
+}
+
+func (r *helloRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if !r.done && n > 0 {
+		r.record = append(r.record, b[:n]...)
+		if len(r.record) >= tlsRecordHeaderLen {
+			size := tlsRecordHeaderLen + (int(r.record[3])<<8 | int(r.record[4]))
+			if len(r.record) >= size {
+				r.record = r.record[:size]
+				r.done = true
+			} else if size > tlsRecordHeaderLen+tlsMaxRecordLen {
+				r.done = true
+			}
+		}
+	}
+	return n, err
+}
+
+// ja3 returns the JA3 fingerprint of the ClientHello that was recorded, that's the md5 of
+// "version,ciphers,extensions,curves,point formats", see https://github.com/salesforce/ja3
+func (r *helloRecorder) ja3() (string, error) {
+	s, err := ja3String(r.record)
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ja3String builds the JA3 string from a TLS record holding a ClientHello
+func ja3String(record []byte) (string, error) {
+	if len(record) < tlsRecordHeaderLen || record[0] != tlsRecordHandshake {
+		return "", errClientHelloMalformed
+	}
+	p := helloParser{data: record[tlsRecordHeaderLen:]}
+	if p.uint8() != tlsHandshakeHello {
+		return "", errClientHelloMalformed
+	}
+	p.data = p.bytes(int(p.uint8())<<16 | int(p.uint16()))
+	version := p.uint16()
+	p.bytes(32)             // random
+	p.bytes(int(p.uint8())) // session id
+	ciphers := helloParser{data: p.bytes(int(p.uint16()))}
+	p.bytes(int(p.uint8())) // compression methods
+	if p.bad {
+		return "", errClientHelloMalformed
+	}
+	var cipherList, extList, curveList, pointList []string
+	for len(ciphers.data) >= 2 {
+		if c := ciphers.uint16(); !isGrease(c) {
+			cipherList = append(cipherList, strconv.Itoa(int(c)))
+		}
+	}
+	// the extensions are optional
+	exts := helloParser{data: p.bytes(int(p.uint16()))}
+	for len(exts.data) >= 4 {
+		extType := exts.uint16()
+		ext := helloParser{data: exts.bytes(int(exts.uint16()))}
+		if isGrease(extType) {
+			continue
+		}
+		extList = append(extList, strconv.Itoa(int(extType)))
+		switch extType {
+		case tlsExtSupportedCurve:
+			curves := helloParser{data: ext.bytes(int(ext.uint16()))}
+			for len(curves.data) >= 2 {
+				if c := curves.uint16(); !isGrease(c) {
+					curveList = append(curveList, strconv.Itoa(int(c)))
+				}
+			}
+		case tlsExtPointFormats:
+			for _, f := range ext.bytes(int(ext.uint8())) {
+				pointList = append(pointList, strconv.Itoa(int(f)))
+			}
+		}
+		if ext.bad {
+			return "", errClientHelloMalformed
+		}
+	}
+	if exts.bad {
+		return "", errClientHelloMalformed
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		strings.Join(cipherList, "-"),
+		strings.Join(extList, "-"),
+		strings.Join(curveList, "-"),
+		strings.Join(pointList, "-"),
+	}, ","), nil
+}
+
+// isGrease returns true for the GREASE values (RFC 8701), which JA3 ignores
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloParser reads the fields of a ClientHello, bad is set if data is too short
+type helloParser struct {
+	data []byte
+	bad  bool
+}
+
+func (p *helloParser) bytes(n int) []byte {
+	if n > len(p.data) {
+		p.bad = true
+		p.data = nil
+		return nil
+	}
+	b := p.data[:n]
+	p.data = p.data[n:]
+	return b
+}
+
+func (p *helloParser) uint8() uint8 {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *helloParser) uint16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
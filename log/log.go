@@ -1,12 +1,14 @@
 package log
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 // The following are taken from logrus
@@ -31,6 +33,14 @@ const (
 
 type Level uint8
 
+// Log formats, see SetFormat
+const (
+	// FormatText writes human readable lines, the default
+	FormatText = "text"
+	// FormatJSON writes each entry as a JSON object with the level, msg, time and any fields
+	FormatJSON = "json"
+)
+
 // Convert the Level to a string. E.g. PanicLevel becomes "panic".
 func (level Level) String() string {
 	switch level {
@@ -165,7 +175,7 @@ func newLogrus(o OutputOption, level string) (*log.Logger, error) {
 
 	logger := &log.Logger{
 		Out:       out,
-		Formatter: new(log.TextFormatter),
+		Formatter: formatter,
 		Hooks:     make(log.LevelHooks),
 		Level:     logLevel,
 	}
@@ -173,6 +183,52 @@ func newLogrus(o OutputOption, level string) (*log.Logger, error) {
 	return logger, nil
 }
 
+// formatter is the formatter of all loggers, it formats entries using the current format
+var formatter = &switchFormatter{
+	text: new(log.TextFormatter),
+	json: new(log.JSONFormatter),
+}
+
+// switchFormatter formats entries as text or JSON, depending on the format set by SetFormat
+type switchFormatter struct {
+	isJSON atomic.Value
+	text   log.Formatter
+	json   log.Formatter
+}
+
+func (f *switchFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if isJSON, _ := f.isJSON.Load().(bool); isJSON {
+		return f.json.Format(entry)
+	}
+	return f.text.Format(entry)
+}
+
+// ValidateFormat returns an error if format is not "text" or "json". Empty is the same as "text"
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid log format [%s], must be %s or %s", format, FormatText, FormatJSON)
+}
+
+// SetFormat sets the format of all loggers, FormatText or FormatJSON. Empty is the same as FormatText
+func SetFormat(format string) error {
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	formatter.isJSON.Store(format == FormatJSON)
+	return nil
+}
+
+// GetFormat returns the current log format
+func GetFormat() string {
+	if isJSON, _ := formatter.isJSON.Load().(bool); isJSON {
+		return FormatJSON
+	}
+	return FormatText
+}
+
 // AddHook adds a new logrus hook
 func (l *HookedLogger) AddHook(h log.Hook) {
 	log.AddHook(h)
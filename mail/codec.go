@@ -0,0 +1,201 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Codec IDs of the built-in codecs. The ID is written as the first byte of a marshaled envelope
+// so that consumers can detect which codec to use when unmarshaling
+const (
+	CodecIDGob     byte = 1
+	CodecIDJSON    byte = 2
+	CodecIDMsgpack byte = 3
+)
+
+// DefaultCodec is the name of the codec used when none is configured
+const DefaultCodec = "gob"
+
+// Codec serializes envelopes for persisting them to queues
+type Codec interface {
+	// ID identifies the codec in the format header byte, must be unique
+	ID() byte
+	// Name is the name used to select the codec in the config, eg "json"
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// envelopeRecord holds the envelope fields that get serialized
+// Envelope.Values is not serialized since it may hold anything, eg. a compressor
+type envelopeRecord struct {
+	QueuedId       string              `json:"queued_id" msgpack:"queued_id"`
+	RemoteIP       string              `json:"remote_ip" msgpack:"remote_ip"`
+	Helo           string              `json:"helo" msgpack:"helo"`
+	MailFrom       Address             `json:"mail_from" msgpack:"mail_from"`
+	RcptTo         []Address           `json:"rcpt_to" msgpack:"rcpt_to"`
+	TLS            bool                `json:"tls" msgpack:"tls"`
+	TLSInfo        *TLSInfo            `json:"tls_info,omitempty" msgpack:"tls_info,omitempty"`
+	Subject        string              `json:"subject" msgpack:"subject"`
+	Header         map[string][]string `json:"header,omitempty" msgpack:"header,omitempty"`
+	Hashes         []string            `json:"hashes,omitempty" msgpack:"hashes,omitempty"`
+	DeliveryHeader string              `json:"delivery_header" msgpack:"delivery_header"`
+	Data           []byte              `json:"data" msgpack:"data"`
+}
+
+var (
+	codecsMu     sync.RWMutex
+	codecsByID   = make(map[byte]Codec)
+	codecsByName = make(map[string]Codec)
+)
+
+func init() {
+	for _, c := range []Codec{gobCodec{}, jsonCodec{}, msgpackCodec{}} {
+		if err := RegisterCodec(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterCodec adds a codec to the registry so that it can be selected by name.
+// Returns an error if the codec's ID or name is already taken
+func RegisterCodec(c Codec) error {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	name := strings.ToLower(c.Name())
+	if _, ok := codecsByID[c.ID()]; ok {
+		return fmt.Errorf("codec id %d already registered", c.ID())
+	}
+	if _, ok := codecsByName[name]; ok {
+		return fmt.Errorf("codec [%s] already registered", name)
+	}
+	codecsByID[c.ID()] = c
+	codecsByName[name] = c
+	return nil
+}
+
+// GetCodec returns the codec registered under name, an empty name returns the DefaultCodec
+func GetCodec(name string) (Codec, error) {
+	if name == "" {
+		name = DefaultCodec
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if c, ok := codecsByName[strings.ToLower(name)]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("codec [%s] not found", name)
+}
+
+// MarshalEnvelope serializes the envelope using the named codec
+// The first byte of the result is the codec ID
+func MarshalEnvelope(e *Envelope, codec string) ([]byte, error) {
+	c, err := GetCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	r := envelopeRecord{
+		QueuedId:       e.QueuedId,
+		RemoteIP:       e.RemoteIP,
+		Helo:           e.Helo,
+		MailFrom:       e.MailFrom,
+		RcptTo:         e.RcptTo,
+		TLS:            e.TLS,
+		TLSInfo:        e.TLSInfo,
+		Subject:        e.Subject,
+		Header:         e.Header,
+		Hashes:         e.Hashes,
+		DeliveryHeader: e.DeliveryHeader,
+		Data:           e.Data.Bytes(),
+	}
+	data, err := c.Marshal(&r)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{c.ID()}, data...), nil
+}
+
+// UnmarshalEnvelope deserializes an envelope created by MarshalEnvelope
+// The codec is detected from the first byte
+func UnmarshalEnvelope(data []byte) (*Envelope, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no envelope data")
+	}
+	codecsMu.RLock()
+	c, ok := codecsByID[data[0]]
+	codecsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown codec id %d", data[0])
+	}
+	var r envelopeRecord
+	if err := c.Unmarshal(data[1:], &r); err != nil {
+		return nil, err
+	}
+	e := &Envelope{
+		QueuedId:       r.QueuedId,
+		RemoteIP:       r.RemoteIP,
+		Helo:           r.Helo,
+		MailFrom:       r.MailFrom,
+		RcptTo:         r.RcptTo,
+		TLS:            r.TLS,
+		TLSInfo:        r.TLSInfo,
+		Subject:        r.Subject,
+		Hashes:         r.Hashes,
+		DeliveryHeader: r.DeliveryHeader,
+		Values:         make(map[string]interface{}),
+	}
+	if r.Header != nil {
+		e.Header = textproto.MIMEHeader(r.Header)
+	}
+	e.Data.Write(r.Data)
+	return e, nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte     { return CodecIDGob }
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte     { return CodecIDJSON }
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() byte     { return CodecIDMsgpack }
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
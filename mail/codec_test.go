@@ -0,0 +1,107 @@
+package mail
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testCodecs = []string{"gob", "json", "msgpack"}
+
+func newCodecTestEnvelope() *Envelope {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.Helo = "helo.example.com"
+	e.MailFrom = Address{User: "test", Host: "example.com"}
+	e.PushRcpt(Address{User: "one", Host: "example.com"})
+	e.PushRcpt(Address{User: "two", Host: "xn--mnchen-3ya.example"})
+	e.TLS = true
+	e.TLSInfo = &TLSInfo{Version: "TLSv1.3", CipherSuite: "TLS_AES_128_GCM_SHA256", ServerName: "mx.example.com"}
+	e.Hashes = []string{"abc123"}
+	e.DeliveryHeader = "Delivered-To: one@example.com\n"
+	e.Data.WriteString("Subject: =?UTF-8?Q?caf=C3=A9?=\nFrom: test@example.com\n\n" + strings.Repeat("This is a test. ", 100))
+	e.ParseHeaders()
+	return e
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	e := newCodecTestEnvelope()
+	for _, name := range testCodecs {
+		data, err := MarshalEnvelope(e, name)
+		if err != nil {
+			t.Error(name, "marshal failed:", err)
+			continue
+		}
+		c, _ := GetCodec(name)
+		if data[0] != c.ID() {
+			t.Error(name, "expecting header byte", c.ID(), "got", data[0])
+		}
+		got, err := UnmarshalEnvelope(data)
+		if err != nil {
+			t.Error(name, "unmarshal failed:", err)
+			continue
+		}
+		if got.QueuedId != e.QueuedId || got.RemoteIP != e.RemoteIP || got.Helo != e.Helo ||
+			got.TLS != e.TLS || got.Subject != e.Subject || got.DeliveryHeader != e.DeliveryHeader {
+			t.Error(name, "fields did not match after round trip:", got)
+		}
+		if !reflect.DeepEqual(got.TLSInfo, e.TLSInfo) {
+			t.Error(name, "TLS info did not match after round trip:", got.TLSInfo)
+		}
+		if got.MailFrom != e.MailFrom || !reflect.DeepEqual(got.RcptTo, e.RcptTo) {
+			t.Error(name, "addresses did not match after round trip:", got.MailFrom, got.RcptTo)
+		}
+		if !reflect.DeepEqual(got.Hashes, e.Hashes) || !reflect.DeepEqual(got.Header, e.Header) {
+			t.Error(name, "hashes or header did not match after round trip:", got.Hashes, got.Header)
+		}
+		if got.Data.String() != e.Data.String() {
+			t.Error(name, "data did not match after round trip")
+		}
+		if got.Values == nil {
+			t.Error(name, "Values should be initialized")
+		}
+	}
+}
+
+func TestCodecRegistry(t *testing.T) {
+	if c, err := GetCodec(""); err != nil || c.Name() != DefaultCodec {
+		t.Error("expecting the default codec, got:", c, err)
+	}
+	if _, err := GetCodec("JSON"); err != nil {
+		t.Error("codec names should not be case sensitive:", err)
+	}
+	if _, err := GetCodec("nope"); err == nil {
+		t.Error("expecting error for unknown codec")
+	}
+	if err := RegisterCodec(jsonCodec{}); err == nil {
+		t.Error("expecting error when registering a codec twice")
+	}
+	if _, err := UnmarshalEnvelope([]byte{0xff, 1, 2}); err == nil {
+		t.Error("expecting error for unknown codec id")
+	}
+	if _, err := UnmarshalEnvelope(nil); err == nil {
+		t.Error("expecting error for empty data")
+	}
+}
+
+func benchmarkCodecMarshal(b *testing.B, codec string) {
+	e := newCodecTestEnvelope()
+	for i := 0; i < b.N; i++ {
+		MarshalEnvelope(e, codec)
+	}
+}
+
+func benchmarkCodecUnmarshal(b *testing.B, codec string) {
+	data, _ := MarshalEnvelope(newCodecTestEnvelope(), codec)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		UnmarshalEnvelope(data)
+	}
+}
+
+func BenchmarkCodecMarshalGob(b *testing.B)       { benchmarkCodecMarshal(b, "gob") }
+func BenchmarkCodecMarshalJSON(b *testing.B)      { benchmarkCodecMarshal(b, "json") }
+func BenchmarkCodecMarshalMsgpack(b *testing.B)   { benchmarkCodecMarshal(b, "msgpack") }
+func BenchmarkCodecUnmarshalGob(b *testing.B)     { benchmarkCodecUnmarshal(b, "gob") }
+func BenchmarkCodecUnmarshalJSON(b *testing.B)    { benchmarkCodecUnmarshal(b, "json") }
+func BenchmarkCodecUnmarshalMsgpack(b *testing.B) { benchmarkCodecUnmarshal(b, "msgpack") }
@@ -3,6 +3,7 @@ package mail
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"errors"
@@ -15,8 +16,11 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"golang.org/x/net/idna"
 	"gopkg.in/iconv.v1"
 )
 
@@ -25,11 +29,13 @@ import (
 const maxHeaderChunk = 1 + (30 << 10) // 30KB
 
 // Address encodes an email address of the form `<user@host>`
+// Internationalized hosts are kept in their ASCII (punycode) form, see ASCIIHost
 type Address struct {
 	User string
 	Host string
 }
 
+// String returns the address with the host in its ASCII (punycode) form
 func (ep *Address) String() string {
 	return fmt.Sprintf("%s@%s", ep.User, ep.Host)
 }
@@ -38,6 +44,26 @@ func (ep *Address) IsEmpty() bool {
 	return ep.User == "" && ep.Host == ""
 }
 
+// HostUnicode returns the host converted to Unicode, eg. xn--mnchen-3ya.example becomes münchen.example
+// If the host cannot be converted, it is returned as-is
+func (ep *Address) HostUnicode() string {
+	if h, err := idna.Lookup.ToUnicode(ep.Host); err == nil {
+		return h
+	}
+	return ep.Host
+}
+
+// ASCIIHost converts an internationalized domain name to its ASCII (A-label) form using IDNA 2008,
+// which is the form needed for DNS lookups. Hosts that are already ASCII are returned unchanged.
+func ASCIIHost(host string) (string, error) {
+	for i := 0; i < len(host); i++ {
+		if host[i] >= utf8.RuneSelf {
+			return idna.Lookup.ToASCII(host)
+		}
+	}
+	return host, nil
+}
+
 var ap = mail.AddressParser{}
 
 // NewAddress takes a string of an RFC 5322 address of the
@@ -47,17 +73,39 @@ func NewAddress(str string) (Address, error) {
 	if err != nil {
 		return Address{}, err
 	}
-	pos := strings.Index(a.Address, "@")
+	pos := strings.LastIndex(a.Address, "@")
 	if pos > 0 {
+		host, err := ASCIIHost(a.Address[pos+1:])
+		if err != nil {
+			return Address{}, err
+		}
 		return Address{
 				User: a.Address[0:pos],
-				Host: a.Address[pos+1:],
+				Host: host,
 			},
 			nil
 	}
 	return Address{}, errors.New("invalid address")
 }
 
+// NewAddressList parses a list of RFC 5322 addresses, such as the value of a From header,
+// eg. "Gogh Fir <gf@example.com>, foo@example.com"
+func NewAddressList(str string) ([]Address, error) {
+	list, err := ap.ParseList(str)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]Address, 0, len(list))
+	for i := range list {
+		addr, err := NewAddress("<" + list[i].Address + ">")
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, addr)
+	}
+	return addresses, nil
+}
+
 // Email represents a single SMTP message.
 type Envelope struct {
 	// Remote IP address
@@ -74,6 +122,8 @@ type Envelope struct {
 	Subject string
 	// TLS is true if the email was received using a TLS connection
 	TLS bool
+	// TLSInfo has the details of the TLS connection, nil if TLS is false
+	TLSInfo *TLSInfo
 	// Header stores the results from ParseHeaders()
 	Header textproto.MIMEHeader
 	// Values hold the values generated when processing the envelope by the backend
@@ -86,6 +136,8 @@ type Envelope struct {
 	QueuedId string
 	// When locked, it means that the envelope is being processed by the backend
 	sync.Mutex
+	// ctx is the context of the transaction, see Context
+	ctx context.Context
 }
 
 func NewEnvelope(remoteAddr string, clientID uint64) *Envelope {
@@ -103,7 +155,8 @@ func queuedID(clientID uint64) string {
 // ParseHeaders parses the headers into Header field of the Envelope struct.
 // Data buffer must be full before calling.
 // It assumes that at most 30kb of email data can be a header
-// Decoding of encoding to UTF is only done on the Subject, where the result is assigned to the Subject field
+// Decoding of encoding to UTF is only done on the Subject, where the result is assigned to the Subject field.
+// The raw (encoded) Subject is kept in the Header field
 func (e *Envelope) ParseHeaders() error {
 	var err error
 	if e.Header != nil {
@@ -120,13 +173,13 @@ func (e *Envelope) ParseHeaders() error {
 	buf.Read(chunk)
 	headerEnd := strings.Index(string(chunk), "\n\n") // the first two new-lines chars are the End Of Header
 	if headerEnd > -1 {
-		header := chunk[0:headerEnd]
+		header := chunk[0 : headerEnd+2]
 		headerReader := textproto.NewReader(bufio.NewReader(bytes.NewBuffer(header)))
 		e.Header, err = headerReader.ReadMIMEHeader()
-		if err != nil {
-			// decode the subject
+		if err == nil {
+			// decode the subject, the raw value stays in e.Header
 			if subject, ok := e.Header["Subject"]; ok {
-				e.Subject = MimeHeaderDecode(subject[0])
+				e.Subject = DecodeHeader(subject[0])
 			}
 		}
 	} else {
@@ -167,6 +220,62 @@ func (e *Envelope) ResetTransaction() {
 	e.Hashes = make([]string, 0)
 	e.DeliveryHeader = ""
 	e.Values = make(map[string]interface{})
+	e.ctx = nil
+}
+
+// Context returns the context of the transaction. The server cancels it when the client's
+// connection drops, or when the connection is closed on shutdown, so that processors can
+// stop their work, eg. pass it to a database query. Never nil
+func (e *Envelope) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// SetContext sets the context returned by Context, until the transaction is reset
+func (e *Envelope) SetContext(ctx context.Context) {
+	e.ctx = ctx
+}
+
+// Copy returns a copy of e that can be used after e is reused for the next message.
+// The Values are copied one level deep, the context is not copied
+func (e *Envelope) Copy() *Envelope {
+	c := &Envelope{
+		RemoteIP:       e.RemoteIP,
+		Helo:           e.Helo,
+		MailFrom:       e.MailFrom,
+		RcptTo:         append([]Address(nil), e.RcptTo...),
+		Subject:        e.Subject,
+		TLS:            e.TLS,
+		TLSInfo:        e.TLSInfo,
+		Hashes:         append([]string(nil), e.Hashes...),
+		DeliveryHeader: e.DeliveryHeader,
+		QueuedId:       e.QueuedId,
+		Values:         make(map[string]interface{}, len(e.Values)),
+	}
+	c.Data.Write(e.Data.Bytes())
+	if e.Header != nil {
+		c.Header = make(textproto.MIMEHeader, len(e.Header))
+		for key, v := range e.Header {
+			c.Header[key] = append([]string(nil), v...)
+		}
+	}
+	for key, v := range e.Values {
+		c.Values[key] = v
+	}
+	return c
+}
+
+// reset clears all the fields of the envelope, before it is reused for another connection.
+// The data buffer stays allocated
+func (e *Envelope) reset() {
+	e.ResetTransaction()
+	e.RemoteIP = ""
+	e.Helo = ""
+	e.TLS = false
+	e.TLSInfo = nil
+	e.QueuedId = ""
 }
 
 // Seed is called when used with a new connection, once it's accepted
@@ -175,6 +284,7 @@ func (e *Envelope) Reseed(RemoteIP string, clientID uint64) {
 	e.QueuedId = queuedID(clientID)
 	e.Helo = ""
 	e.TLS = false
+	e.TLSInfo = nil
 }
 
 // PushRcpt adds a recipient email address to the envelope
@@ -189,39 +299,11 @@ func (e *Envelope) PopRcpt() Address {
 	return ret
 }
 
-var mimeRegex, _ = regexp.Compile(`=\?(.+?)\?([QBqp])\?(.+?)\?=`)
-
 // Decode strings in Mime header format
 // eg. =?ISO-2022-JP?B?GyRCIVo9dztSOWJAOCVBJWMbKEI=?=
-// This function uses GNU iconv under the hood, for more charset support than in Go's library
+// Deprecated: use DecodeHeader
 func MimeHeaderDecode(str string) string {
-
-	matched := mimeRegex.FindAllStringSubmatch(str, -1)
-	var charset, encoding, payload string
-	if matched != nil {
-		for i := 0; i < len(matched); i++ {
-			if len(matched[i]) > 2 {
-				charset = matched[i][1]
-				encoding = strings.ToUpper(matched[i][2])
-				payload = matched[i][3]
-				switch encoding {
-				case "B":
-					str = strings.Replace(
-						str,
-						matched[i][0],
-						MailTransportDecode(payload, "base64", charset),
-						1)
-				case "Q":
-					str = strings.Replace(
-						str,
-						matched[i][0],
-						MailTransportDecode(payload, "quoted-printable", charset),
-						1)
-				}
-			}
-		}
-	}
-	return str
+	return DecodeHeader(str)
 }
 
 // decode from 7bit to 8bit UTF-8
@@ -295,15 +377,35 @@ func fixCharset(charset string) string {
 // Envelopes have their own pool
 
 type Pool struct {
+	// the counters of Stats, first for the alignment of the atomic operations
+	gets, puts, news, inUse int64
 	// envelopes that are ready to be borrowed
 	pool chan *Envelope
 	// semaphore to control number of maximum borrowed envelopes
 	sem chan bool
 }
 
+// PoolStats are the counters of a Pool, see Pool.Stats
+type PoolStats struct {
+	// Gets is how many envelopes were borrowed
+	Gets int64
+	// Puts is how many were put back in the pool after they were returned
+	Puts int64
+	// News is how many were allocated because the pool was empty
+	News int64
+	// InUse is how many are borrowed at the moment
+	InUse int64
+}
+
 func NewPool(poolSize int) *Pool {
+	return NewPoolWithMax(poolSize, poolSize)
+}
+
+// NewPoolWithMax creates a pool that lends up to poolSize envelopes at once, and keeps up to
+// maxPooled of the returned envelopes for reuse, the others are left to the garbage collector
+func NewPoolWithMax(poolSize int, maxPooled int) *Pool {
 	return &Pool{
-		pool: make(chan *Envelope, poolSize),
+		pool: make(chan *Envelope, maxPooled),
 		sem:  make(chan bool, poolSize),
 	}
 }
@@ -311,10 +413,13 @@ func NewPool(poolSize int) *Pool {
 func (p *Pool) Borrow(remoteAddr string, clientID uint64) *Envelope {
 	var e *Envelope
 	p.sem <- true // block the envelope until more room
+	atomic.AddInt64(&p.gets, 1)
+	atomic.AddInt64(&p.inUse, 1)
 	select {
 	case e = <-p.pool:
 		e.Reseed(remoteAddr, clientID)
 	default:
+		atomic.AddInt64(&p.news, 1)
 		e = NewEnvelope(remoteAddr, clientID)
 	}
 	return e
@@ -322,7 +427,8 @@ func (p *Pool) Borrow(remoteAddr string, clientID uint64) *Envelope {
 
 // Return returns an envelope back to the envelope pool
 // Note that an envelope will not be recycled while it still is
-// processing
+// processing. It is reset before it is put back, so that nothing is
+// left for the next borrower
 func (p *Pool) Return(e *Envelope) {
 	// we down't want to recycle an envelope that may still be processing
 	isUnlocked := func() <-chan bool {
@@ -345,13 +451,26 @@ func (p *Pool) Return(e *Envelope) {
 	case <-isUnlocked:
 		// The envelope was _unlocked_, it finished processing
 		// put back in the pool or destroy
+		e.reset()
 		select {
 		case p.pool <- e:
 			//placed envelope back in pool
+			atomic.AddInt64(&p.puts, 1)
 		default:
 			// pool is full, don't return
 		}
 	}
+	atomic.AddInt64(&p.inUse, -1)
 	// take a value off the semaphore to make room for more envelopes
 	<-p.sem
 }
+
+// Stats returns the counters of the pool
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Gets:  atomic.LoadInt64(&p.gets),
+		Puts:  atomic.LoadInt64(&p.puts),
+		News:  atomic.LoadInt64(&p.news),
+		InUse: atomic.LoadInt64(&p.inUse),
+	}
+}
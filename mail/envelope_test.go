@@ -1,7 +1,9 @@
 package mail
 
 import (
+	"context"
 	"io/ioutil"
+	"net/textproto"
 	"strings"
 	"testing"
 )
@@ -59,3 +61,119 @@ func TestEnvelope(t *testing.T) {
 	}
 
 }
+
+func TestAddressIDN(t *testing.T) {
+	addr, err := NewAddress("user@münchen.example")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if addr.Host != "xn--mnchen-3ya.example" {
+		t.Error("expecting host xn--mnchen-3ya.example, got:", addr.Host)
+	}
+	if addr.String() != "user@xn--mnchen-3ya.example" {
+		t.Error("expecting user@xn--mnchen-3ya.example, got:", addr.String())
+	}
+	if addr.HostUnicode() != "münchen.example" {
+		t.Error("expecting münchen.example, got:", addr.HostUnicode())
+	}
+
+	// already in punycode, stays as it is
+	addr, err = NewAddress("Gogh Fir <user@xn--mnchen-3ya.example>")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if addr.Host != "xn--mnchen-3ya.example" {
+		t.Error("expecting host xn--mnchen-3ya.example, got:", addr.Host)
+	}
+	if addr.HostUnicode() != "münchen.example" {
+		t.Error("expecting münchen.example, got:", addr.HostUnicode())
+	}
+
+	// labels in different scripts
+	addr, err = NewAddress("user@bücher.例え.jp")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	}
+	if addr.Host != "xn--bcher-kva.xn--r8jz45g.jp" {
+		t.Error("expecting host xn--bcher-kva.xn--r8jz45g.jp, got:", addr.Host)
+	}
+	if addr.HostUnicode() != "bücher.例え.jp" {
+		t.Error("expecting bücher.例え.jp, got:", addr.HostUnicode())
+	}
+
+	// plain ascii hosts are untouched
+	if h, err := ASCIIHost("Example.com"); err != nil || h != "Example.com" {
+		t.Error("expecting Example.com, got:", h, err)
+	}
+}
+
+func TestNewAddressList(t *testing.T) {
+	list, err := NewAddressList("Gogh Fir <gf@example.com>, foo@MÜNCHEN.example")
+	if err != nil {
+		t.Error("there should be no error:", err)
+	} else if len(list) != 2 || list[0].String() != "gf@example.com" || list[1].Host != "xn--mnchen-3ya.example" {
+		t.Error("unexpected addresses:", list)
+	}
+	if _, err = NewAddressList("gf@example.com <<broken"); err == nil {
+		t.Error("there should be an error")
+	}
+}
+
+// use sets all the fields of e, like a connection does
+func use(e *Envelope) {
+	e.Helo = "example.com"
+	e.MailFrom = Address{User: "test", Host: "example.com"}
+	e.PushRcpt(Address{User: "rcpt", Host: "grr.la"})
+	e.Data.WriteString("Subject: test\n\nhello\n")
+	e.Subject = "test"
+	e.TLS = true
+	e.Header = textproto.MIMEHeader{"Subject": {"test"}}
+	e.Values["auth_login"] = "alice"
+	e.Hashes = append(e.Hashes, "abc")
+	e.DeliveryHeader = "Received: from example.com\n"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.SetContext(ctx)
+}
+
+func TestPool(t *testing.T) {
+	pool := NewPoolWithMax(4, 2)
+	// fill
+	borrowed := make([]*Envelope, 4)
+	for i := range borrowed {
+		borrowed[i] = pool.Borrow("127.0.0.1", uint64(i))
+		use(borrowed[i])
+	}
+	if stats := pool.Stats(); stats != (PoolStats{Gets: 4, News: 4, InUse: 4}) {
+		t.Error("expecting 4 new envelopes in use, got:", stats)
+	}
+	// drain, only 2 are kept
+	for _, e := range borrowed {
+		pool.Return(e)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{Gets: 4, Puts: 2, News: 4, InUse: 0}) {
+		t.Error("expecting 2 envelopes put back, got:", stats)
+	}
+	// the envelopes that are reused have nothing of the previous connection
+	for i := range borrowed {
+		e := pool.Borrow("192.0.2.1", uint64(10+i))
+		if e.RemoteIP != "192.0.2.1" || e.QueuedId == "" {
+			t.Error("expecting the envelope to be seeded, got:", e.RemoteIP, e.QueuedId)
+		}
+		if e.Helo != "" || !e.MailFrom.IsEmpty() || len(e.RcptTo) != 0 || e.Data.Len() != 0 ||
+			e.Subject != "" || e.TLS || e.Header != nil || len(e.Values) != 0 || len(e.Hashes) != 0 ||
+			e.DeliveryHeader != "" || e.Context() != context.Background() {
+			t.Errorf("expecting the envelope to be reset, got: %+v", e)
+		}
+		borrowed[i] = e
+	}
+	if stats := pool.Stats(); stats != (PoolStats{Gets: 8, Puts: 2, News: 6, InUse: 4}) {
+		t.Error("expecting 2 envelopes to be reused, got:", stats)
+	}
+	for _, e := range borrowed {
+		pool.Return(e)
+	}
+	if stats := pool.Stats(); stats.InUse != 0 {
+		t.Error("expecting no envelopes in use, got:", stats)
+	}
+}
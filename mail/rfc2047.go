@@ -0,0 +1,94 @@
+package mail
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"gopkg.in/iconv.v1"
+)
+
+// maxHeaderLineLen is the line length headers are folded at, as recommended by RFC 5322
+const maxHeaderLineLen = 78
+
+// headerDecoder decodes RFC 2047 encoded-words. Charsets not known to the mime package are converted using iconv
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		cd, err := iconv.Open("UTF-8", fixCharset(strings.ToLower(charset)))
+		if err != nil {
+			return nil, err
+		}
+		defer cd.Close()
+		b, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(cd.ConvString(string(b))), nil
+	},
+}
+
+// DecodeHeader decodes a header value containing RFC 2047 encoded-words to UTF-8
+// eg. =?UTF-8?B?wqFIb2xhLCBzZcOxb3Ih?= becomes ¡Hola, señor!
+// Both B and Q encodings are supported. The whitespace between adjacent encoded-words is removed.
+// If the value cannot be decoded, it is returned unchanged
+func DecodeHeader(str string) string {
+	if !strings.Contains(str, "=?") {
+		return str
+	}
+	decoded, err := headerDecoder.DecodeHeader(str)
+	if err != nil {
+		return str
+	}
+	return decoded
+}
+
+// EncodeHeader returns a header field `name: value` terminated by a new-line, ready to be
+// added to e.DeliveryHeader.
+// Values that contain non-ASCII characters are encoded as UTF-8 encoded-words using whichever
+// of the B or Q encodings is shorter. Long values are folded at 78 columns.
+func EncodeHeader(name, value string) string {
+	// values that are printable ASCII are returned as they are
+	if q := mime.QEncoding.Encode("UTF-8", value); q != value {
+		if b := mime.BEncoding.Encode("UTF-8", value); len(b) < len(q) {
+			value = b
+		} else {
+			value = q
+		}
+	}
+	return foldHeader(name, value)
+}
+
+// foldHeader folds the value at whitespace so that the lines do not exceed maxHeaderLineLen.
+// The whitespace of the value is kept as it is, so removing the new-lines unfolds the header.
+// The first word always stays on the line with the field name, and words that are longer
+// than a line are not split
+func foldHeader(name, value string) string {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteString(":")
+	lineLen := len(name) + 1
+	if value != "" && value[0] != ' ' && value[0] != '\t' {
+		value = " " + value
+	}
+	for first := true; value != ""; first = false {
+		// each segment is a run of whitespace followed by a word
+		end := 0
+		for end < len(value) && (value[end] == ' ' || value[end] == '\t') {
+			end++
+		}
+		for end < len(value) && value[end] != ' ' && value[end] != '\t' {
+			end++
+		}
+		if !first && lineLen+end > maxHeaderLineLen {
+			buf.WriteString("\n")
+			lineLen = 0
+		}
+		buf.WriteString(value[:end])
+		lineLen += end
+		value = value[end:]
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
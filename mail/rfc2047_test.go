@@ -0,0 +1,94 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	tests := map[string]string{
+		// B encoding
+		"=?UTF-8?B?wqFIb2xhLCBzZcOxb3Ih?=": "¡Hola, señor!",
+		// Q encoding, lowercase
+		"=?iso-8859-1?q?Andr=E9?= Pirard <PIRARD@vm1.ulg.ac.be>": "André Pirard <PIRARD@vm1.ulg.ac.be>",
+		// adjacent encoded-words, the whitespace between them is removed
+		"=?UTF-8?Q?caf=C3=A9?= =?UTF-8?B?IHRpbWU=?=": "café time",
+		"=?UTF-8?Q?a?=\r\n =?UTF-8?Q?b?= c":          "ab c",
+		"Re: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?= from home":  "Re: Grüße from home",
+		// invalid encoded-words are passed through
+		"=?UTF-8?X?abc?=":                "=?UTF-8?X?abc?=",
+		"=?UTF-8?B?not base64!?=":        "=?UTF-8?B?not base64!?=",
+		"=?UNKNOWN-CHARSET-1?Q?abc?= hi": "=?UNKNOWN-CHARSET-1?Q?abc?= hi",
+		"plain subject":                  "plain subject",
+	}
+	for in, expect := range tests {
+		if got := DecodeHeader(in); got != expect {
+			t.Error("decoding", in, "expecting", expect, "got:", got)
+		}
+	}
+}
+
+func TestEncodeHeader(t *testing.T) {
+	if h := EncodeHeader("Subject", "hello world"); h != "Subject: hello world\n" {
+		t.Error("expecting plain header, got:", h)
+	}
+	// mostly ASCII is Q encoded
+	h := EncodeHeader("Subject", "Re: the café meeting tomorrow")
+	if !strings.HasPrefix(h, "Subject: =?UTF-8?q?") {
+		t.Error("expecting Q encoding, got:", h)
+	}
+	// mostly non-ASCII is B encoded
+	h = EncodeHeader("Subject", "【女子高生チャ")
+	if !strings.HasPrefix(h, "Subject: =?UTF-8?b?") {
+		t.Error("expecting B encoding, got:", h)
+	}
+
+	long := strings.Repeat("ünïcödé text ", 20)
+	h = EncodeHeader("Subject", long)
+	checkFolded(t, h)
+	unfolded := strings.Replace(strings.TrimPrefix(h, "Subject:"), "\n", "", -1)
+	if decoded := DecodeHeader(strings.TrimSpace(unfolded)); decoded != long {
+		t.Error("round trip failed, got:", decoded)
+	}
+
+	long = strings.Repeat("plain text ", 20)
+	h = EncodeHeader("X-Long", long)
+	checkFolded(t, h)
+	if strings.Replace(h, "\n", "", -1) != "X-Long: "+long {
+		t.Error("unfolding did not match, got:", h)
+	}
+
+	// whitespace is kept when folding
+	long = strings.Repeat("tabs\tand  double  spaces ", 8)
+	h = EncodeHeader("X-Long", long)
+	checkFolded(t, h)
+	if strings.Replace(h, "\n", "", -1) != "X-Long: "+long {
+		t.Error("unfolding did not keep the whitespace, got:", h)
+	}
+
+	// the first word stays on the field name line, even when too long
+	word := strings.Repeat("x", 80)
+	if h = EncodeHeader("X-Long", word+" y"); h != "X-Long: "+word+"\n y\n" {
+		t.Error("expecting the first word on the field name line, got:", h)
+	}
+}
+
+func checkFolded(t *testing.T, h string) {
+	if !strings.HasSuffix(h, "\n") {
+		t.Error("header should end with a new-line:", h)
+	}
+	lines := strings.Split(strings.TrimSuffix(h, "\n"), "\n")
+	if len(lines) < 2 {
+		t.Error("expecting header to be folded, got:", h)
+	}
+	for i, line := range lines {
+		// a word longer than a line cannot be folded, and the first word stays with the name
+		words := len(strings.Fields(line))
+		if len(line) > maxHeaderLineLen && words > 1 && !(i == 0 && words == 2) {
+			t.Error("line longer than", maxHeaderLineLen, ":", line)
+		}
+		if i > 0 && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			t.Error("folded line should begin with whitespace:", line)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package mail
+
+// TLSInfo describes the TLS connection that a message was received over
+type TLSInfo struct {
+	// Version is the negotiated version, eg. "TLSv1.3"
+	Version string `json:"version" msgpack:"version"`
+	// CipherSuite is the name of the negotiated cipher suite, eg. "TLS_AES_128_GCM_SHA256"
+	CipherSuite string `json:"cipher_suite" msgpack:"cipher_suite"`
+	// ServerName is the name that the client asked for with SNI, empty if it didn't
+	ServerName string `json:"server_name,omitempty" msgpack:"server_name,omitempty"`
+	// ClientCert is true if the client presented a certificate
+	ClientCert bool `json:"client_cert" msgpack:"client_cert"`
+	// ClientSubject is the subject of the client's certificate, eg. "CN=mx.example.com,O=Example"
+	ClientSubject string `json:"client_subject,omitempty" msgpack:"client_subject,omitempty"`
+}
+
+// TLSVersion returns the negotiated TLS version, or "" if the message wasn't received over TLS
+func (e *Envelope) TLSVersion() string {
+	if e.TLSInfo == nil {
+		return ""
+	}
+	return e.TLSInfo.Version
+}
+
+// TLSCipherSuite returns the name of the negotiated cipher suite, or "" if the message wasn't
+// received over TLS
+func (e *Envelope) TLSCipherSuite() string {
+	if e.TLSInfo == nil {
+		return ""
+	}
+	return e.TLSInfo.CipherSuite
+}
+
+// TLSServerName returns the name that the client asked for with SNI, or "" if none
+func (e *Envelope) TLSServerName() string {
+	if e.TLSInfo == nil {
+		return ""
+	}
+	return e.TLSInfo.ServerName
+}
+
+// TLSClientSubject returns the subject of the client's certificate, and false if the client
+// didn't present one
+func (e *Envelope) TLSClientSubject() (string, bool) {
+	if e.TLSInfo == nil || !e.TLSInfo.ClientCert {
+		return "", false
+	}
+	return e.TLSInfo.ClientSubject, true
+}
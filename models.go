@@ -62,3 +62,95 @@ func newSMTPBufferedReader(rd io.Reader) *smtpBufferedReader {
 	s := &smtpBufferedReader{bufio.NewReader(alr), alr}
 	return s
 }
+
+// ErrBareLineBreak is returned at the end of a message that has a bare CR or LF, when not allowed
+var ErrBareLineBreak = errors.New("bare <CR> or <LF> received")
+
+// states of the dotReader
+const (
+	dotBeginLine = iota // at the start of a line, after a CRLF
+	dotData             // in a line
+	dotCR               // after a CR
+	dotDot              // after the dot at the start of a line
+	dotDotCR            // after the dot and a CR
+)
+
+// dotReader reads the message after DATA, up to the "." line that ends it (RFC 5321 section 4.5.2).
+// Only CRLF.CRLF ends the message, and the leading dot is only taken off the lines that follow
+// a CRLF, so that a bare LF or CR can't end the message early (SMTP smuggling).
+// The lines of the message end with LF. A bare LF is kept as a line break, and a bare CR is removed.
+// If strict, a message with a bare CR or LF is read to its end, then ErrBareLineBreak is returned
+type dotReader struct {
+	r      *bufio.Reader
+	strict bool
+	state  int
+	// bare is set when a bare CR or LF was read
+	bare bool
+	done bool
+}
+
+func newDotReader(r *bufio.Reader, strict bool) *dotReader {
+	return &dotReader{r: r, strict: strict}
+}
+
+func (d *dotReader) Read(b []byte) (n int, err error) {
+	for n < len(b) && !d.done {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		switch d.state {
+		case dotBeginLine:
+			if c == '.' {
+				d.state = dotDot
+				continue
+			}
+		case dotDot:
+			if c == '\r' {
+				d.state = dotDotCR
+				continue
+			}
+			// else, the dot was stuffed
+		case dotDotCR:
+			if c == '\n' {
+				d.done = true
+				continue
+			}
+			// the CR is removed
+			d.bare = true
+		case dotCR:
+			if c == '\n' {
+				b[n] = '\n'
+				n++
+				d.state = dotBeginLine
+				continue
+			}
+			// the CR is removed
+			d.bare = true
+		}
+		switch c {
+		case '\r':
+			d.state = dotCR
+		case '\n':
+			// a line break, but not the start of a line that can end the message
+			d.bare = true
+			b[n] = '\n'
+			n++
+			d.state = dotData
+		default:
+			b[n] = c
+			n++
+			d.state = dotData
+		}
+	}
+	if d.done {
+		if d.strict && d.bare {
+			return n, ErrBareLineBreak
+		}
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -135,17 +135,57 @@ type Responses struct {
 	FailBackendTransaction       string
 	FailBackendTimeout           string
 	FailRcptCmd                  string
+	FailSpoofedSender            string
+	FailDuplicateMessageID       string
+	FailTLSClientBlocked         string
+	FailSenderNotOwned           string
+	FailEncryptedMessage         string
+	FailVerifyCmd                string
+	FailExpandCmd                string
+	FailCmdNotImplemented        string
+	FailMustStartTLS             string
+	FailTooManyLinks             string
+	FailBodyLineTooLong          string
+	FailTalkedEarly              string
+	FailBlocklisted              string
+	ErrorBlocklisted             string
+	FailNoPTR                    string
+	FailMilterRejected           string
+	ErrorMilterTempFail          string
+	FailWrongProtocolCmd         string
+	FailAliasLoop                string
+	FailDKIMRejected             string
+	FailInvalidDSNParam          string
+	FailNetDenied                string
+	FailBareLineBreak            string
+	FailMailboxFull              string
+	FailHeloSyntax               string
+	FailHeloNotResolvable        string
+	FailContentRejected          string
+	FailSpamRejected             string
+	FailVirusFound               string
+	ErrorBackendTransaction      string
+	ErrorBackendBusy             string
+	ErrorGreylisted              string
 
 	// The 400's
-	ErrorTooManyRecipients string
-	ErrorRelayDenied       string
-	ErrorShutdown          string
+	ErrorTooManyRecipients  string
+	ErrorRelayDenied        string
+	ErrorShutdown           string
+	ErrorShutdownTimeout    string
+	ErrorTLSNotAvailable    string
+	ErrorTLSClientRateLimit string
+	ErrorConnectionBytes    string
+	ErrorTimeout            string
+	ErrorTooManySessions    string
+	ErrorTooManyMessages    string
 
 	// The 200's
 	SuccessMailCmd       string
 	SuccessRcptCmd       string
 	SuccessResetCmd      string
 	SuccessVerifyCmd     string
+	SuccessVerifiedCmd   string
 	SuccessNoopCmd       string
 	SuccessQuitCmd       string
 	SuccessDataCmd       string
@@ -195,6 +235,40 @@ func init() {
 		Comment:      "Cannot verify user",
 	}).String()
 
+	Canned.SuccessVerifiedCmd = (&Response{
+		EnhancedCode: DestinationMailboxAddressValid,
+		BasicCode:    250,
+		Class:        ClassSuccess,
+	}).String()
+
+	Canned.FailVerifyCmd = (&Response{
+		EnhancedCode: BadDestinationMailboxAddress,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: User unknown",
+	}).String()
+
+	Canned.FailExpandCmd = (&Response{
+		EnhancedCode: MailingListExpansionProblem,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: Cannot expand list",
+	}).String()
+
+	Canned.FailCmdNotImplemented = (&Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    502,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: Command not implemented",
+	}).String()
+
+	Canned.FailMustStartTLS = (&Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    530,
+		Class:        ClassPermanentFailure,
+		Comment:      "Must issue a STARTTLS command first",
+	}).String()
+
 	Canned.ErrorTooManyRecipients = (&Response{
 		EnhancedCode: TooManyRecipients,
 		BasicCode:    452,
@@ -260,6 +334,34 @@ func init() {
 		Comment:      "Server is shutting down. Please try again later. Sayonara!",
 	}).String()
 
+	Canned.ErrorShutdownTimeout = (&Response{
+		EnhancedCode: SystemNotAcceptingNetworkMessages,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Service shutting down",
+	}).String()
+
+	Canned.ErrorConnectionBytes = (&Response{
+		EnhancedCode: SystemNotAcceptingNetworkMessages,
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Too much data sent during this connection, try again later",
+	}).String()
+
+	Canned.ErrorTLSNotAvailable = (&Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    454,
+		Class:        ClassTransientFailure,
+		Comment:      "TLS not available due to temporary reason",
+	}).String()
+
+	Canned.ErrorTLSClientRateLimit = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: too many messages from this TLS client, try again later",
+	}).String()
+
 	Canned.FailReadLimitExceededDataCmd = (&Response{
 		EnhancedCode: SyntaxError,
 		BasicCode:    550,
@@ -323,6 +425,223 @@ func init() {
 		Comment:      "Error: ",
 	}).String()
 
+	Canned.FailSpoofedSender = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Sender address rejected: unauthenticated use of internal domain",
+	}).String()
+
+	Canned.FailDuplicateMessageID = (&Response{
+		EnhancedCode: OtherOrUndefinedMediaError,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: duplicate Message-ID",
+	}).String()
+
+	Canned.FailTLSClientBlocked = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: TLS client blocked",
+	}).String()
+
+	Canned.FailSenderNotOwned = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Sender address rejected: not owned by authenticated user",
+	}).String()
+
+	Canned.FailEncryptedMessage = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: encrypted message rejected by policy",
+	}).String()
+
+	Canned.FailTooManyLinks = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: message has too many links",
+	}).String()
+
+	Canned.FailBodyLineTooLong = (&Response{
+		EnhancedCode: OtherOrUndefinedMediaError,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: message has a line longer than 998 characters",
+	}).String()
+
+	Canned.FailTalkedEarly = (&Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: talked before the greeting",
+	}).String()
+
+	Canned.FailBlocklisted = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: blocked by",
+	}).String()
+
+	Canned.ErrorBlocklisted = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: temporarily blocked by",
+	}).String()
+
+	Canned.FailNoPTR = (&Response{
+		EnhancedCode: ".7.25",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: no reverse DNS for your IP",
+	}).String()
+
+	Canned.FailMilterRejected = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: rejected by the content filter",
+	}).String()
+
+	Canned.ErrorMilterTempFail = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: deferred by the content filter, try again later",
+	}).String()
+
+	Canned.FailWrongProtocolCmd = (&Response{
+		EnhancedCode: InvalidCommand,
+		BasicCode:    500,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: use LHLO for LMTP, EHLO or HELO for SMTP",
+	}).String()
+
+	Canned.FailAliasLoop = (&Response{
+		EnhancedCode: ".4.6",
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: alias loop detected",
+	}).String()
+
+	Canned.FailDKIMRejected = (&Response{
+		EnhancedCode: ".7.20",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: DKIM signature verification failed",
+	}).String()
+
+	Canned.FailInvalidDSNParam = (&Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: invalid DSN parameter",
+	}).String()
+
+	Canned.FailNetDenied = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: connections from your network are not allowed",
+	}).String()
+
+	Canned.FailBareLineBreak = (&Response{
+		EnhancedCode: ".5.2",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: bare <CR> or <LF> received",
+	}).String()
+
+	Canned.FailMailboxFull = (&Response{
+		EnhancedCode: MailboxFull,
+		BasicCode:    552,
+		Class:        ClassPermanentFailure,
+		Comment:      "Mailbox full",
+	}).String()
+
+	Canned.FailHeloSyntax = (&Response{
+		EnhancedCode: SyntaxError,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: HELO/EHLO must be a fully qualified domain name or an address literal",
+	}).String()
+
+	Canned.FailHeloNotResolvable = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: HELO/EHLO hostname does not resolve",
+	}).String()
+
+	Canned.FailContentRejected = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: message content rejected",
+	}).String()
+
+	Canned.FailSpamRejected = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: message rejected as spam",
+	}).String()
+
+	Canned.FailVirusFound = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error: message infected by",
+	}).String()
+
+	Canned.ErrorBackendTransaction = (&Response{
+		EnhancedCode: OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: temporary failure, try again later: ",
+	}).String()
+
+	Canned.ErrorBackendBusy = (&Response{
+		EnhancedCode: ".3.2",
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: system busy, try again later",
+	}).String()
+
+	Canned.ErrorGreylisted = (&Response{
+		EnhancedCode: ".7.1",
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: greylisted, try again later",
+	}).String()
+
+	Canned.ErrorTimeout = (&Response{
+		EnhancedCode: ".4.2",
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: timeout exceeded",
+	}).String()
+
+	Canned.ErrorTooManySessions = (&Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "too many sessions for user",
+	}).String()
+
+	Canned.ErrorTooManyMessages = (&Response{
+		EnhancedCode: ".7.0",
+		BasicCode:    421,
+		Class:        ClassTransientFailure,
+		Comment:      "Error: too many messages during this connection, try again later",
+	}).String()
+
 	Canned.SuccessMessageQueued = (&Response{
 		EnhancedCode: OtherStatus,
 		BasicCode:    250,
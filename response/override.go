@@ -0,0 +1,54 @@
+package response
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+var (
+	// the basic code at the start of a response
+	basicCodeRegex = regexp.MustCompile(`^([2-5])[0-9][0-9]( |$)`)
+	// the enhanced code after the basic code
+	enhancedCodeRegex = regexp.MustCompile(`^([245])\.[0-9]{1,3}\.[0-9]{1,3}( |$)`)
+)
+
+// Override returns a copy of r with some of its responses replaced, texts has the new
+// responses by the name of their field, eg. "FailRcptCmd": "550 5.1.1 No such user here".
+// A response must start with a 3-digit code of the same class as the one it replaces. If the
+// enhanced code is left out, the one of the replaced response is kept, so that only the text
+// can be changed, eg. "550 No such user here"
+func (r Responses) Override(texts map[string]string) (*Responses, error) {
+	v := reflect.ValueOf(&r).Elem()
+	for name, text := range texts {
+		f := v.FieldByName(name)
+		if !f.IsValid() || f.Kind() != reflect.String {
+			return nil, fmt.Errorf("unknown response %s", name)
+		}
+		if strings.ContainsAny(text, "\r\n") {
+			return nil, fmt.Errorf("response %s must be a single line", name)
+		}
+		old := f.String()
+		m := basicCodeRegex.FindStringSubmatch(text)
+		if m == nil || m[1] != old[:1] {
+			return nil, fmt.Errorf("response %s must start with a %sxx code, got: %q", name, old[:1], text)
+		}
+		code, rest := text[:3], strings.TrimPrefix(text[3:], " ")
+		if m := enhancedCodeRegex.FindStringSubmatch(rest); m != nil {
+			if m[1] != old[:1] {
+				return nil, fmt.Errorf("response %s has an enhanced code of another class, got: %q", name, text)
+			}
+		} else if enhanced := enhancedCodeRegex.FindString(old[4:]); enhanced != "" {
+			// keep the enhanced code of the replaced response
+			rest = strings.TrimSpace(enhanced) + " " + rest
+		}
+		text = code + " " + rest
+		if strings.HasSuffix(old, " ") && !strings.HasSuffix(text, " ") {
+			// something is appended to the response, eg. the queued id
+			text += " "
+		}
+		f.SetString(text)
+	}
+	return &r, nil
+}
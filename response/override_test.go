@@ -0,0 +1,32 @@
+package response
+
+import "testing"
+
+func TestOverride(t *testing.T) {
+	r, err := Canned.Override(map[string]string{
+		"FailRcptCmd":          "550 No such user here",
+		"FailBlocklisted":      "554 5.7.1 Blocked by",
+		"SuccessMessageQueued": "250 Queued as",
+		"SuccessDataCmd":       "354 Go ahead",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ got, expected string }{
+		{r.FailRcptCmd, "550 5.1.1 No such user here"},
+		{r.FailBlocklisted, "554 5.7.1 Blocked by"},
+		{r.SuccessMessageQueued, "250 2.0.0 Queued as "},
+		{r.SuccessDataCmd, "354 Go ahead"},
+		{r.SuccessQuitCmd, Canned.SuccessQuitCmd},
+	} {
+		if test.got != test.expected {
+			t.Errorf("expecting %q, got: %q", test.expected, test.got)
+		}
+	}
+	if Canned.FailRcptCmd != "550 5.1.1 User unknown in local recipient table" {
+		t.Error("Canned should not change, got:", Canned.FailRcptCmd)
+	}
+	if _, err := Canned.Override(map[string]string{"SuccessQuitCmd": "421 Bye"}); err == nil {
+		t.Error("expecting an error for a response of another class")
+	}
+}
@@ -1,11 +1,14 @@
 package guerrilla
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,6 +18,7 @@ import (
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/response"
+	"golang.org/x/crypto/acme"
 )
 
 const (
@@ -30,6 +34,8 @@ const (
 	RFC2821LimitDomain = 255
 	// The minimum total number of recipients that must be buffered is 100
 	RFC2821LimitRecipients = 100
+	// How long to wait for a free TLS handshake slot when MaxConcurrentHandshakes is reached
+	HandshakeQueueTimeout = time.Second * 3
 )
 
 const (
@@ -55,11 +61,58 @@ type server struct {
 	closedListener  chan (bool)
 	hosts           allowedHosts // stores map[string]bool for faster lookup
 	state           int
-	// If log changed after a config reload, newLogStore stores the value here until it's safe to change it
-	logStore     atomic.Value
+	// logStore is the server's own log, see ServerConfig.LogFile. Clients take it when accepted
+	logStore atomic.Value
+	// mainlogStore is the main log of the daemon
 	mainlogStore atomic.Value
 	backendStore atomic.Value
 	envelopePool *mail.Pool
+	// handshakeSem limits the TLS handshakes in progress, stores chan bool
+	handshakeSem atomic.Value
+	// handshakeWait is how long to queue for a handshake slot
+	handshakeWait time.Duration
+	// senderDomains stores map[string][]string, the domains each login may send from
+	senderDomains atomic.Value
+	// cannedStore stores the *response.Responses of the server, see ServerConfig.Responses
+	cannedStore atomic.Value
+	// netsStore stores the *netFilter of the AllowedNets & DeniedNets
+	netsStore atomic.Value
+	// mailEvents publishes the mail events, nil if the server is not run by guerrilla
+	mailEvents *mailEvents
+	// sessions counts the sessions of the authenticated users, shared by the servers of a daemon
+	sessions *userSessions
+	// the HELO names that did not resolve, see ServerConfig.HeloValidation
+	heloFailures *heloFailures
+}
+
+// userSessions counts the sessions of each authenticated user
+type userSessions struct {
+	count map[string]int
+	sync.Mutex
+}
+
+func newUserSessions() *userSessions {
+	return &userSessions{count: make(map[string]int)}
+}
+
+// acquire counts a session for login, unless it has max sessions already
+func (u *userSessions) acquire(login string, max int) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.count[login] >= max {
+		return false
+	}
+	u.count[login]++
+	return true
+}
+
+// release uncounts a session of login
+func (u *userSessions) release(login string) {
+	u.Lock()
+	defer u.Unlock()
+	if u.count[login]--; u.count[login] <= 0 {
+		delete(u.count, login)
+	}
 }
 
 type allowedHosts struct {
@@ -74,20 +127,23 @@ func newServer(sc *ServerConfig, b backends.Backend, l log.Logger) (*server, err
 		closedListener:  make(chan (bool), 1),
 		listenInterface: sc.ListenInterface,
 		state:           ServerStateNew,
-		envelopePool:    mail.NewPool(sc.MaxClients),
+		envelopePool:    mail.NewPoolWithMax(sc.MaxClients, sc.envelopePoolSize()),
+		handshakeWait:   HandshakeQueueTimeout,
+		sessions:        newUserSessions(),
+		heloFailures:    newHeloFailures(),
 	}
-	server.logStore.Store(l)
+	server.mainlogStore.Store(l)
 	server.backendStore.Store(b)
 	logFile := sc.LogFile
 	if logFile == "" {
 		// none set, use the same log file as mainlog
-		logFile = server.mainlog().GetLogDest()
+		logFile = l.GetLogDest()
 	}
 	// set level to same level as mainlog level
-	mainlog, logOpenError := log.GetLogger(logFile, server.mainlog().GetLevel())
-	server.mainlogStore.Store(mainlog)
+	serverLog, logOpenError := log.GetLogger(logFile, l.GetLevel())
+	server.logStore.Store(serverLog)
 	if logOpenError != nil {
-		server.log().WithError(logOpenError).Errorf("Failed creating a logger for server [%s]", sc.ListenInterface)
+		server.mainlog().WithError(logOpenError).Errorf("Failed creating a logger for server [%s]", sc.ListenInterface)
 	}
 
 	server.setConfig(sc)
@@ -101,14 +157,50 @@ func newServer(sc *ServerConfig, b backends.Backend, l log.Logger) (*server, err
 func (s *server) configureSSL() error {
 	sConfig := s.configStore.Load().(ServerConfig)
 	if sConfig.TLSAlwaysOn || sConfig.StartTLSOn {
-		cert, err := tls.LoadX509KeyPair(sConfig.PublicKeyFile, sConfig.PrivateKeyFile)
+		var certs *certStore
+		// with ACME, the static certificates are optional
+		if sConfig.ACME == nil || sConfig.PublicKeyFile != "" {
+			var err error
+			if certs, err = newCertStore(&sConfig); err != nil {
+				return err
+			}
+		}
+		minVersion, err := tlsMinVersion(sConfig.TLSMinVersion)
+		if err != nil {
+			return err
+		}
+		ciphers, err := tlsCipherSuites(sConfig.TLSCiphers)
+		if err != nil {
+			return err
+		}
+		clientAuth, err := tlsClientAuth(sConfig.ClientAuth)
+		if err != nil {
+			return err
+		}
+		clientCAs, err := loadClientCAs(sConfig.ClientCAFile)
 		if err != nil {
-			return fmt.Errorf("error while loading the certificate: %s", err)
+			return err
 		}
 		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.VerifyClientCertIfGiven,
-			ServerName:   sConfig.Hostname,
+			ClientAuth:               clientAuth,
+			ClientCAs:                clientCAs,
+			ServerName:               sConfig.Hostname,
+			MinVersion:               minVersion,
+			CipherSuites:             ciphers,
+			PreferServerCipherSuites: len(ciphers) > 0,
+		}
+		if certs != nil {
+			tlsConfig.Certificates = []tls.Certificate{*certs.fallback}
+			// select the certificate by SNI
+			tlsConfig.GetCertificate = certs.getCertificate
+		}
+		if sConfig.ACME != nil {
+			m := getACMEManager(sConfig.ACME)
+			tlsConfig.GetCertificate = m.getCertificate(sConfig.ACME.Hosts, certs, s.mainlog)
+			// answer the TLS-ALPN-01 challenges of the CA
+			tlsConfig.NextProtos = []string{acme.ALPNProto}
+			// a CA that fails does not stop the server, the certificates are obtained in the background
+			go m.obtain(sConfig.ACME.Hosts, s.mainlog)
 		}
 		tlsConfig.Rand = rand.Reader
 		s.tlsConfigStore.Store(tlsConfig)
@@ -129,6 +221,149 @@ func (s *server) backend() backends.Backend {
 	return nil
 }
 
+// process saves the envelope using the current backend. If the backend was swapped while
+// the envelope was waiting for the old one to accept it (eg. a config reload), then the
+// envelope is handed to the new backend instead of failing
+func (s *server) process(e *mail.Envelope) backends.Result {
+	for {
+		b := s.backend()
+		res := b.Process(e)
+		if !strings.HasPrefix(res.String(), response.Canned.FailBackendNotRunning) || b == s.backend() {
+			return res
+		}
+	}
+}
+
+// acquireSession counts the session of the client for its login, when MaxSessionsPerUser is max.
+// Returns false if the user has max sessions already
+func (s *server) acquireSession(client *client, max int) bool {
+	if client.authLogin == client.sessionLogin {
+		return true
+	}
+	s.releaseSession(client)
+	if max <= 0 || client.authLogin == "" {
+		return true
+	}
+	if !s.sessions.acquire(client.authLogin, max) {
+		return false
+	}
+	client.sessionLogin = client.authLogin
+	return true
+}
+
+// authenticateClientCert authenticates the client as the identity of its certificate, if it
+// presented one that was verified. Returns false if the user has max sessions already
+func (s *server) authenticateClientCert(client *client, max int) bool {
+	tlsConn, ok := client.conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return true
+	}
+	identity := clientCertIdentity(state.PeerCertificates[0])
+	if identity == "" {
+		return true
+	}
+	client.authLogin = identity
+	s.log().Infof("[%s] authenticated as %s by the client certificate", client.RemoteIP, identity)
+	return s.acquireSession(client, max)
+}
+
+// releaseSession uncounts the session of the client, if it was counted
+func (s *server) releaseSession(client *client) {
+	if client.sessionLogin != "" {
+		s.sessions.release(client.sessionLogin)
+		client.sessionLogin = ""
+	}
+}
+
+// validateRcpt validates the last recipient using the current backend, retrying with the
+// new backend if it was swapped during the validation, like process
+func (s *server) validateRcpt(e *mail.Envelope) backends.RcptError {
+	for {
+		b := s.backend()
+		err := b.ValidateRcpt(e)
+		if err != backends.StorageNotAvailable || b == s.backend() {
+			return err
+		}
+	}
+}
+
+// tlsRequiredCmds are refused before STARTTLS when ServerConfig.RequireTLS is on
+var tlsRequiredCmds = []string{"MAIL FROM:", "RCPT TO:", "DATA", "VRFY", "EXPN", "AUTH"}
+
+// tlsRequired returns true if cmd is one of the tlsRequiredCmds
+func tlsRequired(cmd string) bool {
+	for _, c := range tlsRequiredCmds {
+		if strings.Index(cmd, c) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pipeliningSyncCmds must be the last command of a pipelined group (RFC 2920, RFC 3030 for BDAT),
+// the replies are sent after them without waiting for the rest of the group
+var pipeliningSyncCmds = []string{"EHLO", "HELO", "LHLO", "DATA", "BDAT", "VRFY", "EXPN", "NOOP", "QUIT", "STARTTLS", "AUTH"}
+
+// pipeliningSync returns true if cmd is one of the pipeliningSyncCmds
+func pipeliningSync(cmd string) bool {
+	for _, c := range pipeliningSyncCmds {
+		if strings.Index(cmd, c) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// verify replies to VRFY, the address is checked like a RCPT TO, without adding it to the transaction
+func (server *server) verify(client *client, addr string) {
+	canned := server.canned()
+	to, err := extractEmail(addr, canned)
+	if err != nil {
+		client.sendResponse(err)
+		return
+	}
+	if !server.allowsHost(to.Host) {
+		client.sendResponse(canned.FailVerifyCmd)
+		return
+	}
+	mark := client.markRcpts()
+	client.PushRcpt(to)
+	rcptError := server.validateRcpt(client.Envelope)
+	client.rejectRcpt(mark)
+	if rcptError != nil {
+		client.sendResponse(canned.FailVerifyCmd)
+		return
+	}
+	client.sendResponse(canned.SuccessVerifiedCmd, "<", to.String(), ">")
+}
+
+// expand replies to EXPN with the members of the list, if the backend can expand lists
+func (server *server) expand(client *client, list string) {
+	canned := server.canned()
+	expander, ok := server.backend().(backends.ListExpander)
+	if !ok {
+		client.sendResponse(canned.SuccessVerifyCmd)
+		return
+	}
+	members, err := expander.ExpandList(list)
+	if err != nil || len(members) == 0 {
+		client.sendResponse(canned.FailExpandCmd)
+		return
+	}
+	// multi-line reply, "250-" on all lines but the last
+	reply := canned.SuccessVerifiedCmd
+	var lines []string
+	for i := range members {
+		lines = append(lines, reply[:3]+"-"+reply[4:]+"<"+members[i].String()+">")
+	}
+	lines[len(lines)-1] = reply + lines[len(lines)-1][len(reply):]
+	client.sendResponse(strings.Join(lines, "\r\n"))
+}
+
 // Set the timeout for the server and all clients
 func (server *server) setTimeout(seconds int) {
 	duration := time.Duration(int64(seconds))
@@ -139,6 +374,145 @@ func (server *server) setTimeout(seconds int) {
 // goroutine safe config store
 func (server *server) setConfig(sc *ServerConfig) {
 	server.configStore.Store(*sc)
+	server.setHandshakeLimit(sc.MaxConcurrentHandshakes)
+	server.setSenderDomains(sc.SenderDomainsFile)
+	server.setResponses(sc.Responses)
+	server.setNets(sc.AllowedNets, sc.DeniedNets)
+}
+
+// netFilter has the networks that may connect, see ServerConfig.AllowedNets
+type netFilter struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// setNets parses the allowed_nets & denied_nets. The previous networks are kept if they are not valid
+func (server *server) setNets(allowed, denied []string) {
+	var (
+		f   netFilter
+		err error
+	)
+	if f.allowed, err = parseNets(allowed); err == nil {
+		f.denied, err = parseNets(denied)
+	}
+	if err != nil {
+		server.log().WithError(err).Error("Failed to parse the allowed_nets or denied_nets")
+		return
+	}
+	server.netsStore.Store(&f)
+}
+
+// netAllowed returns false if ip is in one of the denied networks, or if there are allowed
+// networks and ip is in none of them
+func (server *server) netAllowed(ip string) bool {
+	f, ok := server.netsStore.Load().(*netFilter)
+	if !ok || (len(f.allowed) == 0 && len(f.denied) == 0) {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if netsContain(f.denied, addr) {
+		return false
+	}
+	return len(f.allowed) == 0 || netsContain(f.allowed, addr)
+}
+
+// setResponses overrides the canned responses with the responses of the config.
+// The previous responses are kept if they are not valid
+func (server *server) setResponses(texts map[string]string) {
+	canned, err := response.Canned.Override(texts)
+	if err != nil {
+		server.log().WithError(err).Error("Failed to override the responses")
+		return
+	}
+	server.cannedStore.Store(canned)
+}
+
+// canned returns the responses of the server
+func (server *server) canned() *response.Responses {
+	if canned, ok := server.cannedStore.Load().(*response.Responses); ok {
+		return canned
+	}
+	return &response.Canned
+}
+
+// setSenderDomains loads the sender_domains_file. The previous domains are kept if it can't be read
+func (server *server) setSenderDomains(path string) {
+	if path == "" {
+		server.senderDomains.Store(map[string][]string(nil))
+		return
+	}
+	domains, err := loadSenderDomains(path)
+	if err != nil {
+		server.log().WithError(err).Errorf("Failed to load sender_domains_file [%s]", path)
+		return
+	}
+	server.senderDomains.Store(domains)
+}
+
+// senderAllowed returns false if the client is authenticated and from is not
+// in one of the domains of the client's login, see ServerConfig.SenderDomainsFile
+func (server *server) senderAllowed(client *client, from mail.Address) bool {
+	domains, _ := server.senderDomains.Load().(map[string][]string)
+	if domains == nil || client.authLogin == "" || from.IsEmpty() {
+		return true
+	}
+	login := strings.ToLower(client.authLogin)
+	allowed, ok := domains[login]
+	if !ok {
+		if at := strings.LastIndex(login, "@"); at != -1 {
+			allowed = []string{login[at+1:]}
+		}
+	}
+	host, err := mail.ASCIIHost(from.Host)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range allowed {
+		if host == d {
+			return true
+		}
+	}
+	return false
+}
+
+// setHandshakeLimit sets the maximum number of TLS handshakes that can be in progress.
+// Handshakes holding a slot of the previous limit will release it there
+func (server *server) setHandshakeLimit(max int) {
+	if sem, ok := server.handshakeSem.Load().(chan bool); ok && cap(sem) == max {
+		return
+	}
+	var sem chan bool
+	if max > 0 {
+		sem = make(chan bool, max)
+	}
+	server.handshakeSem.Store(sem)
+}
+
+// acquireHandshake reserves a slot for a TLS handshake, queueing for up to handshakeWait.
+// Returns the semaphore to pass to releaseHandshake, and false if no slot became free
+func (server *server) acquireHandshake() (chan bool, bool) {
+	sem, _ := server.handshakeSem.Load().(chan bool)
+	if sem == nil {
+		// no limit
+		return nil, true
+	}
+	select {
+	case sem <- true:
+		return sem, true
+	case <-time.After(server.handshakeWait):
+		return nil, false
+	}
+}
+
+// releaseHandshake frees the slot reserved by acquireHandshake
+func releaseHandshake(sem chan bool) {
+	if sem != nil {
+		<-sem
+	}
 }
 
 // goroutine safe
@@ -153,6 +527,10 @@ func (server *server) setAllowedHosts(allowedHosts []string) {
 	defer server.hosts.Unlock()
 	server.hosts.table = make(map[string]bool, len(allowedHosts))
 	for _, h := range allowedHosts {
+		// internationalized domains are matched in their ASCII (punycode) form
+		if ascii, err := mail.ASCIIHost(h); err == nil {
+			h = ascii
+		}
 		server.hosts.table[strings.ToLower(h)] = true
 	}
 }
@@ -162,7 +540,20 @@ func (server *server) Start(startWG *sync.WaitGroup) error {
 	var clientID uint64
 	clientID = 0
 
-	listener, err := net.Listen("tcp", server.listenInterface)
+	network, address := listenAddress(server.listenInterface)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			server.log().WithError(err).Warnf("[%s] Cannot remove the stale socket", server.listenInterface)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err == nil && network == "unix" {
+		if err = server.chmodSocket(address); err != nil {
+			// also removes the socket
+			listener.Close()
+			listener = nil
+		}
+	}
 	server.listener = listener
 	if err != nil {
 		startWG.Done() // don't wait for me
@@ -170,7 +561,12 @@ func (server *server) Start(startWG *sync.WaitGroup) error {
 		return fmt.Errorf("[%s] Cannot listen on port: %s ", server.listenInterface, err.Error())
 	}
 
-	server.log().Infof("Listening on TCP %s", server.listenInterface)
+	if network == "unix" {
+		// the listener removes the socket when it is closed
+		server.log().Infof("Listening on Unix socket %s", address)
+	} else {
+		server.log().Infof("Listening on TCP %s", server.listenInterface)
+	}
 	server.state = ServerStateRunning
 	startWG.Done() // start successful, don't wait for me
 
@@ -189,14 +585,20 @@ func (server *server) Start(startWG *sync.WaitGroup) error {
 				server.closedListener <- true
 				return nil
 			}
-			server.mainlog().WithError(err).Info("Temporary error accepting client")
+			server.log().WithError(err).Info("Temporary error accepting client")
 			continue
 		}
 		go func(p Poolable, borrow_err error) {
 			c := p.(*client)
 			if borrow_err == nil {
 				server.handleClient(c)
-				server.envelopePool.Return(c.Envelope)
+				if server.isShuttingDown() {
+					// the envelope may still be processing if the backend was aborted,
+					// don't make the shutdown wait for it
+					go server.envelopePool.Return(c.Envelope)
+				} else {
+					server.envelopePool.Return(c.Envelope)
+				}
 				server.clientPool.Return(c)
 			} else {
 				server.log().WithError(borrow_err).Info("couldn't borrow a new client")
@@ -211,6 +613,19 @@ func (server *server) Start(startWG *sync.WaitGroup) error {
 	}
 }
 
+// chmodSocket sets the permissions of the unix socket at path to the socket_mode, if set
+func (server *server) chmodSocket(path string) error {
+	sc := server.configStore.Load().(ServerConfig)
+	if sc.SocketMode == "" {
+		return nil
+	}
+	mode, err := parseSocketMode(sc.SocketMode)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
 func (server *server) Shutdown() {
 	if server.listener != nil {
 		// This will cause Start function to return, by causing an error on listener.Accept
@@ -226,6 +641,15 @@ func (server *server) Shutdown() {
 	}
 }
 
+// closeClients disconnects the clients that are still connected, with a 421 reply
+func (server *server) closeClients() {
+	server.clientPool.activeClients.mapAll(func(p Poolable) {
+		if c, ok := p.(*client); ok {
+			c.forceClose()
+		}
+	})
+}
+
 func (server *server) GetActiveClientsCount() int {
 	return server.clientPool.GetActiveClientsCount()
 }
@@ -246,15 +670,48 @@ func (server *server) allowsHost(host string) bool {
 	return false
 }
 
+// the timeouts of RFC 5321 section 4.5.3.2, in seconds, used when the ServerConfig doesn't set them
+const (
+	defaultTimeoutCommand         = 300
+	defaultTimeoutData            = 180
+	defaultTimeoutDataTermination = 600
+)
+
+// timeoutOrDefault returns the timeout in seconds, or def if not set
+func timeoutOrDefault(seconds int, def int) time.Duration {
+	if seconds <= 0 {
+		return time.Duration(def)
+	}
+	return time.Duration(seconds)
+}
+
+// dataReader reads the message after DATA, the client must send more of it within the data timeout,
+// and all of it before the termination deadline
+type dataReader struct {
+	r        io.Reader
+	client   *client
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(d.timeout * time.Second)
+	if deadline.After(d.deadline) {
+		deadline = d.deadline
+	}
+	d.client.setDeadline(deadline)
+	return d.r.Read(p)
+}
+
 // Reads from the client until a terminating sequence is encountered,
-// or until a timeout occurs.
-func (server *server) readCommand(client *client, maxSize int64) (string, error) {
+// or until the timeout occurs.
+func (server *server) readCommand(client *client, maxSize int64, timeout time.Duration) (string, error) {
 	var input, reply string
 	var err error
 	// In command state, stop reading at line breaks
 	suffix := "\r\n"
 	for {
-		client.setTimeout(server.timeout.Load().(time.Duration))
+		client.setTimeout(timeout)
 		reply, err = client.bufin.ReadString('\n')
 		input = input + reply
 		if err != nil {
@@ -269,6 +726,65 @@ func (server *server) readCommand(client *client, maxSize int64) (string, error)
 	return input, err
 }
 
+// talksEarly waits for the greeting delay and returns true if the client sent something meanwhile.
+// The error is not nil if the connection failed
+func (server *server) talksEarly(client *client, delay int) (bool, error) {
+	client.setTimeout(time.Duration(delay))
+	_, err := client.bufin.Peek(1)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		// kept quiet
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// watchConn returns a context that is cancelled when the client's connection drops, eg. the
+// client went away or the connection was closed on shutdown, while the backend processes its
+// message. stop must be called before reading from the client again
+func (server *server) watchConn(client *client) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client.connGuard.Lock()
+	conn := client.conn
+	client.connGuard.Unlock()
+	switch conn.(type) {
+	case *net.TCPConn, *tls.Conn:
+	default:
+		// the Peek could not be unblocked with a deadline, eg. a mock connection
+		return ctx, cancel
+	}
+	// wait for as long as the backend takes
+	conn.SetReadDeadline(time.Time{})
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		_, err := client.bufin.Peek(1)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// stopped
+			return
+		}
+		if err != nil {
+			cancel()
+		}
+		// else, the client sent its next command already
+	}()
+	return ctx, func() {
+		// unblock the Peek
+		conn.SetReadDeadline(time.Now())
+		<-done
+		cancel()
+	}
+}
+
+// tarpit sleeps before sending the replies to a client that got its nth 5xx reply,
+// the delay grows with each one, up to the timeout
+func (server *server) tarpit(n int, delay int) {
+	d := time.Duration(n*delay) * time.Second
+	if timeout := server.timeout.Load().(time.Duration) * time.Second; d > timeout {
+		d = timeout
+	}
+	time.Sleep(d)
+}
+
 // flushResponse a response to the client. Flushes the client.bufout buffer to the connection
 func (server *server) flushResponse(client *client) error {
 	client.setTimeout(server.timeout.Load().(time.Duration))
@@ -282,13 +798,35 @@ func (server *server) isShuttingDown() bool {
 // Handles an entire client SMTP exchange
 func (server *server) handleClient(client *client) {
 	defer client.closeConn()
+	// however the session ends
+	defer server.releaseSession(client)
 	sc := server.configStore.Load().(ServerConfig)
+	canned := server.canned()
 	server.log().Infof("Handle client [%s], id: %d", client.RemoteIP, client.ID)
 
+	// the clients of a unix socket are allowed by its permissions
+	if !isUnixConn(client.conn) && !server.netAllowed(client.RemoteIP) {
+		server.log().Infof("[%s] Client's network is not allowed, dropping", client.RemoteIP)
+		if sc.DeniedNetsReply && !sc.TLSAlwaysOn {
+			client.sendResponse(canned.FailNetDenied)
+			server.flushResponse(client)
+		}
+		return
+	}
+
+	lmtp := sc.Protocol == ProtocolLMTP
+	commandTimeout := timeoutOrDefault(sc.TimeoutCommand, defaultTimeoutCommand)
+	protocol := "SMTP"
+	if lmtp {
+		protocol = "LMTP"
+	}
 	// Initial greeting
-	greeting := fmt.Sprintf("220 %s SMTP Guerrilla(%s) #%d (%d) %s",
-		sc.Hostname, Version, client.ID,
+	greeting := fmt.Sprintf("220 %s %s Guerrilla(%s) #%d (%d) %s",
+		sc.Hostname, protocol, Version, client.ID,
 		server.clientPool.GetActiveClientsCount(), time.Now().Format(time.RFC3339))
+	if sc.Greeting != "" {
+		greeting = "220 " + sc.Hostname + " " + sc.Greeting
+	}
 
 	helo := fmt.Sprintf("250 %s Hello", sc.Hostname)
 	// ehlo is a multi-line reply and need additional \r\n at the end
@@ -299,17 +837,37 @@ func (server *server) handleClient(client *client) {
 	pipelining := "250-PIPELINING\r\n"
 	advertiseTLS := "250-STARTTLS\r\n"
 	advertiseEnhancedStatusCodes := "250-ENHANCEDSTATUSCODES\r\n"
+	advertiseDSN := "250-DSN\r\n"
 	// The last line doesn't need \r\n since string will be printed as a new line.
 	// Also, Last line has no dash -
 	help := "250 HELP"
 
+	// the number of 5xx replies already delayed by the error_delay
+	delayed := 0
+
+	// slot reserved for a STARTTLS handshake, released after the handshake
+	var tlsSlot chan bool
+	defer func() {
+		releaseHandshake(tlsSlot)
+	}()
+
 	if sc.TLSAlwaysOn {
 		tlsConfig, ok := server.tlsConfigStore.Load().(*tls.Config)
 		if !ok {
 			server.mainlog().Error("Failed to load *tls.Config")
+		} else if sem, ok := server.acquireHandshake(); !ok {
+			server.log().Warnf("[%s] Too many TLS handshakes in progress, dropping", client.RemoteIP)
+			client.kill()
 		} else if err := client.upgradeToTLS(tlsConfig); err == nil {
+			releaseHandshake(sem)
 			advertiseTLS = ""
+			if !server.authenticateClientCert(client, sc.MaxSessionsPerUser) {
+				server.log().Warnf("[%s] Too many sessions for user %s, dropping", client.RemoteIP, client.authLogin)
+				client.sendResponse(canned.ErrorTooManySessions)
+				client.kill()
+			}
 		} else {
+			releaseHandshake(sem)
 			server.log().WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
 			// server requires TLS, but can't handshake
 			client.kill()
@@ -321,22 +879,38 @@ func (server *server) handleClient(client *client) {
 	}
 
 	for client.isAlive() {
+		// the replies to a pipelined group of commands are sent together
+		syncCmd := true
 		switch client.state {
 		case ClientGreeting:
+			if sc.GreetingDelay > 0 {
+				talked, err := server.talksEarly(client, sc.GreetingDelay)
+				if talked {
+					server.log().Warnf("[%s] Client talked before the greeting, dropping", client.RemoteIP)
+					client.sendResponse(canned.FailTalkedEarly)
+					client.kill()
+					break
+				} else if err != nil {
+					server.log().WithError(err).Warnf("Client closed the connection: %s", client.RemoteIP)
+					return
+				}
+			}
 			client.sendResponse(greeting)
 			client.state = ClientCmd
 		case ClientCmd:
 			client.bufin.setLimit(CommandLineMaxLength)
-			input, err := server.readCommand(client, sc.MaxSize)
+			input, err := server.readCommand(client, sc.MaxSize, commandTimeout)
 			server.log().Debugf("Client sent: %s", input)
 			if err == io.EOF {
 				server.log().WithError(err).Warnf("Client closed the connection: %s", client.RemoteIP)
 				return
 			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				server.log().WithError(err).Warnf("Timeout: %s", client.RemoteIP)
+				client.sendResponse(canned.ErrorTimeout)
+				server.flushResponse(client)
 				return
 			} else if err == LineLimitExceeded {
-				client.sendResponse(response.Canned.FailLineTooLong)
+				client.sendResponse(canned.FailLineTooLong)
 				client.kill()
 				break
 			} else if err != nil {
@@ -348,6 +922,13 @@ func (server *server) handleClient(client *client) {
 				client.state = ClientShutdown
 				continue
 			}
+			// the line break was taken off
+			if !client.countBytes(int64(len(input))+2, sc.MaxConnectionBytes) {
+				server.log().Warnf("[%s] max_connection_bytes exceeded, dropping", client.RemoteIP)
+				client.sendResponse(canned.ErrorConnectionBytes)
+				client.kill()
+				break
+			}
 
 			input = strings.Trim(input, " \r\n")
 			cmdLen := len(input)
@@ -355,20 +936,44 @@ func (server *server) handleClient(client *client) {
 				cmdLen = CommandVerbMaxLength
 			}
 			cmd := strings.ToUpper(input[:cmdLen])
+			syncCmd = pipeliningSync(cmd)
+			if (sc.RequireTLS || sc.ClientAuth == ClientAuthRequire) && !client.TLS && tlsRequired(cmd) {
+				client.sendResponse(canned.FailMustStartTLS)
+				break
+			}
 			switch {
+			case !lmtp && strings.Index(cmd, "LHLO") == 0,
+				lmtp && (strings.Index(cmd, "HELO") == 0 || strings.Index(cmd, "EHLO") == 0):
+				client.sendResponse(canned.FailWrongProtocolCmd)
+
 			case strings.Index(cmd, "HELO") == 0:
-				client.Helo = strings.Trim(input[4:], " ")
+				name := strings.Trim(input[4:], " ")
+				if reply := server.checkHelo(name, sc.HeloValidation, canned); reply != "" {
+					server.log().Infof("[%s] rejected HELO %q", client.RemoteIP, name)
+					client.sendResponse(reply)
+					break
+				}
+				client.Helo = name
+				client.esmtp = false
 				client.resetTransaction()
 				client.sendResponse(helo)
 
-			case strings.Index(cmd, "EHLO") == 0:
-				client.Helo = strings.Trim(input[4:], " ")
+			case strings.Index(cmd, "EHLO") == 0 || strings.Index(cmd, "LHLO") == 0:
+				name := strings.Trim(input[4:], " ")
+				if reply := server.checkHelo(name, sc.HeloValidation, canned); reply != "" {
+					server.log().Infof("[%s] rejected %s %q", client.RemoteIP, cmd[:4], name)
+					client.sendResponse(reply)
+					break
+				}
+				client.Helo = name
+				client.esmtp = true
 				client.resetTransaction()
 				client.sendResponse(ehlo,
 					messageSize,
 					pipelining,
 					advertiseTLS,
 					advertiseEnhancedStatusCodes,
+					advertiseDSN,
 					help)
 
 			case strings.Index(cmd, "HELP") == 0:
@@ -389,22 +994,48 @@ func (server *server) handleClient(client *client) {
 							if vals[0] == "HELO" {
 								client.Helo = vals[1]
 							}
+							if vals[0] == "LOGIN" {
+								// the proxy authenticated the client
+								client.authLogin = vals[1]
+							}
 						}
 					}
 				}
-				client.sendResponse(response.Canned.SuccessMailCmd)
+				if !server.acquireSession(client, sc.MaxSessionsPerUser) {
+					server.log().Warnf("[%s] Too many sessions for user %s, dropping", client.RemoteIP, client.authLogin)
+					client.sendResponse(canned.ErrorTooManySessions)
+					client.kill()
+					break
+				}
+				client.sendResponse(canned.SuccessMailCmd)
 			case strings.Index(cmd, "MAIL FROM:") == 0:
 				if client.isInTransaction() {
-					client.sendResponse(response.Canned.FailNestedMailCmd)
+					client.sendResponse(canned.FailNestedMailCmd)
+					break
+				}
+				if sc.MaxMessagesPerConnection > 0 && client.messagesSent >= sc.MaxMessagesPerConnection {
+					server.log().Warnf("[%s] max_messages_per_connection reached, dropping", client.RemoteIP)
+					client.sendResponse(canned.ErrorTooManyMessages)
+					client.kill()
 					break
 				}
 				addr := input[10:]
+				ret, envID, err := dsnMailParams(esmtpParams(addr))
+				if err != nil {
+					client.sendResponse(canned.FailInvalidDSNParam)
+					break
+				}
 				if !(strings.Index(addr, "<>") == 0) &&
 					!(strings.Index(addr, " <>") == 0) {
 					// Not Bounce, extract mail.
-					if from, err := extractEmail(addr); err != nil {
+					if from, err := extractEmail(addr, canned); err != nil {
 						client.sendResponse(err)
 						break
+					} else if !server.senderAllowed(client, from) {
+						server.log().Infof("[%s] rejected MAIL FROM %s, not a domain of %s",
+							client.RemoteIP, from.String(), client.authLogin)
+						client.sendResponse(canned.FailSenderNotOwned)
+						break
 					} else {
 						client.MailFrom = from
 					}
@@ -413,70 +1044,108 @@ func (server *server) handleClient(client *client) {
 					// bounce has empty from address
 					client.MailFrom = mail.Address{}
 				}
-				client.sendResponse(response.Canned.SuccessMailCmd)
+				if ret != "" {
+					client.Values[backends.ValueDSNRet] = ret
+				}
+				if envID != "" {
+					client.Values[backends.ValueDSNEnvID] = envID
+				}
+				client.sendResponse(canned.SuccessMailCmd)
 
 			case strings.Index(cmd, "RCPT TO:") == 0:
-				if len(client.RcptTo) > RFC2821LimitRecipients {
-					client.sendResponse(response.Canned.ErrorTooManyRecipients)
+				// the accepted RCPT commands are counted, the backend may expand a recipient to several
+				if client.rcptCmds > RFC2821LimitRecipients ||
+					(sc.MaxRecipients > 0 && client.rcptCmds >= sc.MaxRecipients) ||
+					(sc.MaxRcptsPerConnection > 0 && client.rcptsReceived >= sc.MaxRcptsPerConnection) {
+					client.sendResponse(canned.ErrorTooManyRecipients)
 					break
 				}
-				to, err := extractEmail(input[8:])
+				to, err := extractEmail(input[8:], canned)
+				dsn, dsnErr := dsnRcptParams(esmtpParams(input[8:]))
 				if err != nil {
 					client.sendResponse(err.Error())
+				} else if dsnErr != nil {
+					client.sendResponse(canned.FailInvalidDSNParam)
 				} else {
 					if !server.allowsHost(to.Host) {
-						client.sendResponse(response.Canned.ErrorRelayDenied, to.Host)
+						client.sendResponse(canned.ErrorRelayDenied, to.Host)
 					} else {
+						mark := client.markRcpts()
 						client.PushRcpt(to)
-						rcptError := server.backend().ValidateRcpt(client.Envelope)
-						if rcptError != nil {
-							client.PopRcpt()
-							client.sendResponse(response.Canned.FailRcptCmd + " " + rcptError.Error())
+						rcptError := server.validateRcpt(client.Envelope)
+						if reply, ok := rcptError.(backends.RcptReply); ok {
+							client.rejectRcpt(mark)
+							client.sendResponse(string(reply))
+						} else if rcptError != nil {
+							client.rejectRcpt(mark)
+							client.sendResponse(canned.FailRcptCmd + " " + rcptError.Error())
 						} else {
-							client.sendResponse(response.Canned.SuccessRcptCmd)
+							client.rcptCmds++
+							client.rcptsReceived++
+							if len(dsn.Notify) > 0 || dsn.ORCPT != "" {
+								client.setDSNRcpt(to, dsn)
+							}
+							client.sendResponse(canned.SuccessRcptCmd)
 						}
 					}
 				}
 
 			case strings.Index(cmd, "RSET") == 0:
 				client.resetTransaction()
-				client.sendResponse(response.Canned.SuccessResetCmd)
+				client.sendResponse(canned.SuccessResetCmd)
 
 			case strings.Index(cmd, "VRFY") == 0:
-				client.sendResponse(response.Canned.SuccessVerifyCmd)
+				if !sc.EnableVRFY {
+					client.sendResponse(canned.SuccessVerifyCmd)
+					break
+				}
+				server.verify(client, input[4:])
+
+			case strings.Index(cmd, "EXPN") == 0:
+				if !sc.EnableEXPN {
+					client.sendResponse(canned.FailCmdNotImplemented)
+					break
+				}
+				server.expand(client, strings.Trim(input[4:], " <>"))
 
 			case strings.Index(cmd, "NOOP") == 0:
-				client.sendResponse(response.Canned.SuccessNoopCmd)
+				client.sendResponse(canned.SuccessNoopCmd)
 
 			case strings.Index(cmd, "QUIT") == 0:
-				client.sendResponse(response.Canned.SuccessQuitCmd)
+				client.sendResponse(canned.SuccessQuitCmd)
 				client.kill()
 
 			case strings.Index(cmd, "DATA") == 0:
 				// !!! Temporarily disabled for compatibility with bounce messages !!!
 				// if client.MailFrom.IsEmpty() {
-				// 	client.sendResponse(response.Canned.FailNoSenderDataCmd)
+				// 	client.sendResponse(canned.FailNoSenderDataCmd)
 				// 	break
 				// }
 				// !!! Temporarily disabled for compatibility with bounce messages !!!
 				if len(client.RcptTo) == 0 {
-					client.sendResponse(response.Canned.FailNoRecipientsDataCmd)
+					client.sendResponse(canned.FailNoRecipientsDataCmd)
 					break
 				}
-				client.sendResponse(response.Canned.SuccessDataCmd)
+				client.sendResponse(canned.SuccessDataCmd)
 				client.state = ClientData
 
 			case sc.StartTLSOn && strings.Index(cmd, "STARTTLS") == 0:
-
-				client.sendResponse(response.Canned.SuccessStartTLSCmd)
+				sem, ok := server.acquireHandshake()
+				if !ok {
+					server.log().Warnf("[%s] Too many TLS handshakes in progress", client.RemoteIP)
+					client.sendResponse(canned.ErrorTLSNotAvailable)
+					break
+				}
+				tlsSlot = sem
+				client.sendResponse(canned.SuccessStartTLSCmd)
 				client.state = ClientStartTLS
 			default:
 				client.errors++
 				if client.errors >= MaxUnrecognizedCommands {
-					client.sendResponse(response.Canned.FailMaxUnrecognizedCmd)
+					client.sendResponse(canned.FailMaxUnrecognizedCmd)
 					client.kill()
 				} else {
-					client.sendResponse(response.Canned.FailUnrecognizedCmd)
+					client.sendResponse(canned.FailUnrecognizedCmd)
 				}
 			}
 
@@ -486,31 +1155,87 @@ func (server *server) handleClient(client *client) {
 			// if the client goes a little over. Anything above will err
 			client.bufin.setLimit(int64(sc.MaxSize) + 1024000) // This a hard limit.
 
-			n, err := client.Data.ReadFrom(client.smtpReader.DotReader())
+			n, err := client.Data.ReadFrom(&dataReader{
+				r:        newDotReader(client.bufin.Reader, sc.StrictCRLF),
+				client:   client,
+				timeout:  timeoutOrDefault(sc.TimeoutData, defaultTimeoutData),
+				deadline: time.Now().Add(timeoutOrDefault(sc.TimeoutDataTermination, defaultTimeoutDataTermination) * time.Second),
+			})
 			if n > sc.MaxSize {
 				err = fmt.Errorf("Maximum DATA size exceeded (%d)", sc.MaxSize)
 			}
 			if err != nil {
-				if err == LineLimitExceeded {
-					client.sendResponse(response.Canned.FailReadLimitExceededDataCmd, LineLimitExceeded.Error())
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					server.log().WithError(err).Warnf("Timeout during DATA: %s", client.RemoteIP)
+					client.sendResponse(canned.ErrorTimeout)
+					client.kill()
+				} else if err == ErrBareLineBreak {
+					// the whole message was read, the client may go on
+					server.log().Infof("[%s] rejected message with a bare <CR> or <LF>", client.RemoteIP)
+					client.sendResponse(canned.FailBareLineBreak)
+					client.state = ClientCmd
+				} else if err == LineLimitExceeded {
+					client.sendResponse(canned.FailReadLimitExceededDataCmd, LineLimitExceeded.Error())
 					client.kill()
 				} else if err == MessageSizeExceeded {
-					client.sendResponse(response.Canned.FailMessageSizeExceeded, MessageSizeExceeded.Error())
+					client.sendResponse(canned.FailMessageSizeExceeded, MessageSizeExceeded.Error())
 					client.kill()
 				} else {
-					client.sendResponse(response.Canned.FailReadErrorDataCmd, err.Error())
+					client.sendResponse(canned.FailReadErrorDataCmd, err.Error())
 					client.kill()
 				}
 				server.log().WithError(err).Warn("Error reading data")
 				client.resetTransaction()
 				break
 			}
+			if !client.countBytes(n, sc.MaxConnectionBytes) {
+				server.log().Warnf("[%s] max_connection_bytes exceeded, message dropped", client.RemoteIP)
+				client.sendResponse(canned.ErrorConnectionBytes)
+				client.kill()
+				client.resetTransaction()
+				break
+			}
 
-			res := server.backend().Process(client.Envelope)
+			var messageID string
+			if sc.DuplicateMessageID != "" {
+				var ok bool
+				if messageID, ok = server.checkMessageID(client, sc.DuplicateMessageID); !ok {
+					server.mailEvents.publish(EventMailReceived, client.Envelope)
+					server.mailEvents.publish(EventMailRejected, client.Envelope)
+					server.dataResponse(client, lmtp, backends.NewResult(canned.FailDuplicateMessageID))
+					client.state = ClientCmd
+					client.resetTransaction()
+					break
+				}
+			}
+
+			if client.authLogin != "" {
+				client.Values[backends.ValueAuthLogin] = client.authLogin
+			}
+			client.Values[backends.ValueProtocol] = client.protocol(lmtp)
+			if client.TLSInfo != nil {
+				client.Values[backends.ValueTLSVersion] = client.TLSInfo.Version
+				client.Values[backends.ValueTLSCipher] = client.TLSInfo.CipherSuite
+			}
+			server.mailEvents.publish(EventMailReceived, client.Envelope)
+			ctx, stop := server.watchConn(client)
+			client.SetContext(ctx)
+			res := server.process(client.Envelope)
+			stop()
 			if res.Code() < 300 {
+				server.mailEvents.publish(EventMailAccepted, client.Envelope)
 				client.messagesSent++
+				if messageID != "" {
+					// only the Message-IDs of accepted messages count as used
+					if client.messageIDs == nil {
+						client.messageIDs = make(map[string]bool)
+					}
+					client.messageIDs[messageID] = true
+				}
+			} else {
+				server.mailEvents.publish(EventMailRejected, client.Envelope)
 			}
-			client.sendResponse(res.String())
+			server.dataResponse(client, lmtp, res)
 			client.state = ClientCmd
 			if server.isShuttingDown() {
 				client.state = ClientShutdown
@@ -525,20 +1250,36 @@ func (server *server) handleClient(client *client) {
 				} else if err := client.upgradeToTLS(tlsConfig); err == nil {
 					advertiseTLS = ""
 					client.resetTransaction()
+					if !server.authenticateClientCert(client, sc.MaxSessionsPerUser) {
+						server.log().Warnf("[%s] Too many sessions for user %s, dropping", client.RemoteIP, client.authLogin)
+						client.sendResponse(canned.ErrorTooManySessions)
+						client.kill()
+					}
+				} else if sc.ClientAuth == ClientAuthRequire {
+					server.log().WithError(err).Warnf("[%s] Failed TLS handshake, a client certificate is required", client.RemoteIP)
+					client.kill()
 				} else {
 					server.log().WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
 					// Don't disconnect, let the client decide if it wants to continue
 				}
 			}
+			releaseHandshake(tlsSlot)
+			tlsSlot = nil
 			// change to command state
 			client.state = ClientCmd
 		case ClientShutdown:
 			// shutdown state
-			client.sendResponse(response.Canned.ErrorShutdown)
+			client.sendResponse(canned.ErrorShutdown)
 			client.kill()
 		}
 
-		if client.bufout.Buffered() > 0 {
+		// more commands of the group are waiting to be read, reply to them all at once
+		pipelined := !syncCmd && client.state == ClientCmd && client.isAlive() && client.bufin.Buffered() > 0
+		if client.bufout.Buffered() > 0 && !pipelined {
+			if sc.ErrorDelay > 0 && client.failures > delayed {
+				delayed = client.failures
+				server.tarpit(client.failures, sc.ErrorDelay)
+			}
 			if server.log().IsDebug() {
 				server.log().Debugf("Writing response to client: \n%s", client.response.String())
 			}
@@ -552,6 +1293,43 @@ func (server *server) handleClient(client *client) {
 	}
 }
 
+// dataResponse replies to the message sent with DATA. LMTP replies for each recipient,
+// in the order of the RCPT TO commands (RFC 2033). The reply of the message is used for all
+// of them if the backend expanded the recipients
+func (server *server) dataResponse(client *client, lmtp bool, res backends.Result) {
+	if !lmtp {
+		client.sendResponse(res.String())
+		return
+	}
+	for _, r := range backends.ResultsForRcpts(res, client.rcptCmds) {
+		client.sendResponse(r.String())
+	}
+}
+
+// checkMessageID detects a Message-ID that the client already used during the connection.
+// Returns the Message-ID of the message, and false if the message is to be rejected.
+// In "rewrite" mode, the duplicate is replaced with a new Message-ID, which is returned
+func (s *server) checkMessageID(client *client, mode string) (string, bool) {
+	id, start, end := findMessageID(client.Data.Bytes())
+	if id == "" || !client.messageIDs[id] {
+		return id, true
+	}
+	if mode == DuplicateMessageIDReject {
+		s.log().Infof("[%s] rejected message with duplicate Message-ID %s", client.RemoteIP, id)
+		return id, false
+	}
+	newID := fmt.Sprintf("<%s.%s>", strconv.FormatInt(time.Now().UnixNano(), 36), strings.Trim(id, "<>"))
+	data := client.Data.Bytes()
+	rewritten := make([]byte, 0, len(data)+len(newID))
+	rewritten = append(rewritten, data[:start]...)
+	rewritten = append(rewritten, " "+newID...)
+	rewritten = append(rewritten, data[end:]...)
+	client.Data.Reset()
+	client.Data.Write(rewritten)
+	s.log().Infof("[%s] duplicate Message-ID %s rewritten to %s", client.RemoteIP, id, newID)
+	return newID, true
+}
+
 func (s *server) log() log.Logger {
 	if l, ok := s.logStore.Load().(log.Logger); ok {
 		return l
@@ -4,14 +4,36 @@ import (
 	"testing"
 
 	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/textproto"
+	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/mocks"
+	"github.com/flashmob/go-guerrilla/response"
+	"github.com/flashmob/go-guerrilla/tests/testcert"
 )
 
 // getMockServerConfig gets a mock ServerConfig struct used for creating a new server
@@ -144,5 +166,2039 @@ func TestXClient(t *testing.T) {
 	wg.Wait() // wait for handleClient to exit
 }
 
+// Test that an authenticated client may only use MAIL FROM in its own domains
+func TestSenderDomains(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	f, err := ioutil.TempFile("", "sender_domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# login domains\nbob example.org, Example.NET\n")
+	f.Close()
+	sc := getMockServerConfig()
+	sc.XClientOn = true
+	sc.SenderDomainsFile = f.Name()
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	w.PrintfLine("HELO test.test.com")
+	line, _ = r.ReadLine()
+
+	expect := func(cmd, expected string) {
+		w.PrintfLine(cmd)
+		line, _ = r.ReadLine()
+		if strings.Index(line, expected) != 0 {
+			t.Error(cmd, "expected", expected, "but got:", line)
+		}
+	}
+	// not authenticated, any domain
+	expect("MAIL FROM:<test@example.com>", "250")
+	expect("RSET", "250")
+	// the domain of the login
+	expect("XCLIENT LOGIN=alice@example.com", "250")
+	expect("MAIL FROM:<alice@EXAMPLE.com>", "250")
+	expect("RSET", "250")
+	// cross-domain
+	expect("MAIL FROM:<alice@example.org>", "550 5.7.1")
+	// the domains listed in the file
+	expect("XCLIENT LOGIN=BOB", "250")
+	expect("MAIL FROM:<bob@example.net>", "250")
+	expect("RSET", "250")
+	expect("MAIL FROM:<bob@example.com>", "550 5.7.1")
+	// the null sender is allowed
+	expect("MAIL FROM:<>", "250")
+
+	w.PrintfLine("QUIT")
+	line, _ = r.ReadLine()
+	wg.Wait() // wait for handleClient to exit
+}
+
+// rcptBackend rejects the "nobody" recipient, for testing VRFY
+type rcptBackend struct {
+	backends.Backend
+}
+
+func (b *rcptBackend) ValidateRcpt(e *mail.Envelope) backends.RcptError {
+	if e.RcptTo[len(e.RcptTo)-1].User == "nobody" {
+		return backends.NoSuchUser
+	}
+	return nil
+}
+
+// listBackend can also expand lists, for testing EXPN
+type listBackend struct {
+	rcptBackend
+	lists map[string][]mail.Address
+}
+
+func (b *listBackend) ExpandList(list string) ([]mail.Address, error) {
+	if members, ok := b.lists[list]; ok {
+		return members, nil
+	}
+	return nil, errors.New("no such list")
+}
+
+func TestVRFYAndEXPN(t *testing.T) {
+	for _, test := range []struct{ enabled, lists bool }{{false, false}, {true, false}, {true, true}} {
+		sc := getMockServerConfig()
+		sc.EnableVRFY = test.enabled
+		sc.EnableEXPN = test.enabled
+		sc.StartTLSOn = false
+		mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+		if logOpenError != nil {
+			mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+		}
+		conn, server := getMockServerConn(sc, t)
+		// a backend that validates the recipients without being started
+		var b backends.Backend = &rcptBackend{server.backend()}
+		if test.lists {
+			b = &listBackend{
+				rcptBackend: rcptBackend{server.backend()},
+				lists: map[string][]mail.Address{
+					"staff": {{User: "alice", Host: "test.com"}, {User: "bob", Host: "test.com"}},
+				},
+			}
+		}
+		server, err := newServer(sc, b, mainlog)
+		if err != nil {
+			t.Fatal("new server failed because:", err)
+		}
+		server.setAllowedHosts([]string{"test.com"})
+		client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			server.handleClient(client)
+			wg.Done()
+		}()
+		r := textproto.NewReader(bufio.NewReader(conn.Client))
+		line, _ := r.ReadLine()
+		w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+		w.PrintfLine("HELO test.test.com")
+		line, _ = r.ReadLine()
+
+		expect := func(cmd, expected string) {
+			w.PrintfLine(cmd)
+			line, _ = r.ReadLine()
+			if strings.Index(line, expected) != 0 {
+				t.Error(cmd, test, "expected", expected, "but got:", line)
+			}
+		}
+		switch {
+		case !test.enabled:
+			// nothing is leaked
+			expect("VRFY <test@test.com>", "252 2.5.0")
+			expect("VRFY nobody@example.com", "252 2.5.0")
+			expect("EXPN staff", "502 5.5.1")
+		case !test.lists:
+			// the backend can't expand lists
+			expect("EXPN staff", "252 2.5.0")
+			expect("VRFY <test@test.com>", "250 2.1.5 <test@test.com>")
+			// not one of our hosts
+			expect("VRFY test@example.com", "550 5.1.1")
+		default:
+			expect("VRFY nobody@test.com", "550 5.1.1")
+			expect("EXPN <staff>", "250-2.1.5 <alice@test.com>")
+			if line, _ = r.ReadLine(); line != "250 2.1.5 <bob@test.com>" {
+				t.Error("expected the last line of the list, but got:", line)
+			}
+			expect("EXPN nolist", "550 5.2.4")
+			// VRFY did not add recipients to the transaction
+			expect("VRFY <test@test.com>", "250 2.1.5")
+			expect("DATA", "503 5.5.1")
+		}
+		w.PrintfLine("QUIT")
+		line, _ = r.ReadLine()
+		wg.Wait() // wait for handleClient to exit
+	}
+}
+
+// Test that a connection is dropped after sending more than max_connection_bytes
+func TestMaxConnectionBytes(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.MaxConnectionBytes = 300
+	sc.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal("backend did not start:", err)
+	}
+	defer server.backend().Shutdown()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	w.PrintfLine("HELO test.test.com")
+	line, _ = r.ReadLine()
+
+	body := strings.Repeat("0123456789", 10)
+	for i := 0; i < 2; i++ {
+		w.PrintfLine("MAIL FROM:<test@example.com>")
+		line, _ = r.ReadLine()
+		w.PrintfLine("RCPT TO:<test@test.com>")
+		line, _ = r.ReadLine()
+		w.PrintfLine("DATA")
+		line, _ = r.ReadLine()
+		w.PrintfLine("Subject: test\r\n\r\n%s\r\n.", body)
+		line, _ = r.ReadLine()
+		if i == 0 && strings.Index(line, "250") != 0 {
+			t.Error("expected the first message to be accepted, but got:", line)
+		}
+	}
+	// the second message went over
+	expected := "421 4.3.2"
+	if strings.Index(line, expected) != 0 {
+		t.Error("expected", expected, "but got:", line)
+	}
+	if client.bytesReceived <= sc.MaxConnectionBytes {
+		t.Error("expecting more than", sc.MaxConnectionBytes, "bytes, got:", client.bytesReceived)
+	}
+	// the connection was dropped
+	if _, err := r.ReadLine(); err == nil {
+		t.Error("expecting the connection to be closed")
+	}
+	wg.Wait() // wait for handleClient to exit
+}
+
+// writeCounter counts the writes to a connection
+type writeCounter struct {
+	net.Conn
+	writes int32
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// Test that the replies to a pipelined group of commands are sent together, in order
+func TestPipelining(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal("backend did not start:", err)
+	}
+	defer server.backend().Shutdown()
+	serverConn := &writeCounter{Conn: conn.Server}
+	client := NewClient(serverConn, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	w.PrintfLine("EHLO test.test.com")
+	lines, _ := r.ReadLine()
+	for line = lines; strings.Index(line, "250-") == 0; line, _ = r.ReadLine() {
+		lines += "\n" + line
+	}
+	if !strings.Contains(lines, "250-PIPELINING") {
+		t.Error("expected PIPELINING to be advertised, but got:", lines)
+	}
+
+	expect := func(expected ...string) {
+		for _, e := range expected {
+			if line, _ = r.ReadLine(); strings.Index(line, e) != 0 {
+				t.Error("expected", e, "but got:", line)
+			}
+		}
+	}
+	writes := atomic.LoadInt32(&serverConn.writes)
+	// the whole group in one write
+	if _, err := conn.Client.Write([]byte("MAIL FROM:<test@example.com>\r\n" +
+		"RCPT TO:<test@test.com>\r\n" +
+		"RCPT TO:<test@not-allowed.com>\r\n" +
+		"DATA\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("250 2.1.0", "250 2.1.5", "454 4.1.1", "354")
+	if n := atomic.LoadInt32(&serverConn.writes) - writes; n != 1 {
+		t.Error("expecting the replies of the group to be sent in one write, got:", n)
+	}
+	// QUIT right after the message
+	if _, err := conn.Client.Write([]byte("Subject: test\r\n\r\nhello\r\n.\r\nQUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("250 2.0.0 OK : queued as", "221")
+	wg.Wait() // wait for handleClient to exit
+}
+
+// Test that the RCPT TO commands over max_recipients are refused, without ending the transaction
+func TestMaxRecipients(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.MaxRecipients = 2
+	sc.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal("backend did not start:", err)
+	}
+	defer server.backend().Shutdown()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	expect := func(expected ...string) {
+		for _, e := range expected {
+			if line, _ = r.ReadLine(); strings.Index(line, e) != 0 {
+				t.Error("expected", e, "but got:", line)
+			}
+		}
+	}
+	w.PrintfLine("HELO test.test.com")
+	expect("250")
+	// pipelined, one past the limit
+	if _, err := conn.Client.Write([]byte("MAIL FROM:<test@example.com>\r\n" +
+		"RCPT TO:<test1@test.com>\r\n" +
+		"RCPT TO:<test2@test.com>\r\n" +
+		"RCPT TO:<test3@test.com>\r\n" +
+		"DATA\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("250 2.1.0", "250 2.1.5", "250 2.1.5", "452 4.5.3 Too many recipients", "354")
+	w.PrintfLine("Subject: test\r\n\r\nhello\r\n.")
+	expect("250 2.0.0 OK : queued as")
+	if n := len(client.RcptTo); n != 0 {
+		t.Error("expecting the recipients to be reset after the message, got:", n)
+	}
+
+	// the count starts again after the message and after RSET
+	for i := 0; i < 2; i++ {
+		w.PrintfLine("MAIL FROM:<test@example.com>")
+		expect("250")
+		w.PrintfLine("RCPT TO:<test1@test.com>")
+		expect("250")
+		w.PrintfLine("RCPT TO:<test2@test.com>")
+		expect("250")
+		w.PrintfLine("RSET")
+		expect("250")
+	}
+	w.PrintfLine("QUIT")
+	expect("221")
+	wg.Wait() // wait for handleClient to exit
+}
+
+// aliasBackend expands the aliases like the rewrite processor does during the validation,
+// then rejects the targets of the "closed" alias, as a validator after it would
+type aliasBackend struct {
+	backends.Backend
+	aliases map[string][]mail.Address
+}
+
+func (b *aliasBackend) ValidateRcpt(e *mail.Envelope) backends.RcptError {
+	rcpt := e.RcptTo[len(e.RcptTo)-1]
+	to, ok := b.aliases[rcpt.User]
+	if !ok {
+		return nil
+	}
+	e.RcptTo = append(e.RcptTo[:len(e.RcptTo)-1], to...)
+	rewrites, _ := e.Values[backends.ValueRewrites].([]backends.Rewrite)
+	e.Values[backends.ValueRewrites] = append(rewrites, backends.Rewrite{Field: "rcpt", From: rcpt.String()})
+	if rcpt.User == "closed" {
+		return backends.RcptReply("550 5.7.1 Closed list")
+	}
+	return nil
+}
+
+// Test that a rejected recipient leaves none of the addresses it was expanded to, and that
+// max_recipients counts the RCPT commands, not the expanded recipients
+func TestRcptExpansion(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.MaxRecipients = 3
+	sc.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	staff := []mail.Address{{User: "alice", Host: "test.com"}, {User: "bob", Host: "test.com"}, {User: "carol", Host: "test.com"}}
+	b := &aliasBackend{server.backend(), map[string][]mail.Address{"staff": staff, "closed": staff}}
+	server, err := newServer(sc, b, mainlog)
+	if err != nil {
+		t.Fatal("new server failed because:", err)
+	}
+	server.setAllowedHosts([]string{"test.com"})
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	expect := func(cmd, expected string) {
+		w.PrintfLine(cmd)
+		if line, _ = r.ReadLine(); strings.Index(line, expected) != 0 {
+			t.Error(cmd, "expected", expected, "but got:", line)
+		}
+	}
+	expect("HELO test.test.com", "250")
+	expect("MAIL FROM:<test@example.com>", "250")
+	expect("RCPT TO:<test1@test.com>", "250")
+	expect("RCPT TO:<closed@test.com>", "550 5.7.1 Closed list")
+	if n := len(client.RcptTo); n != 1 {
+		t.Error("expecting the expansion of the rejected recipient to be removed, got:", client.RcptTo)
+	}
+	if rewrites, _ := client.Values[backends.ValueRewrites].([]backends.Rewrite); len(rewrites) != 0 {
+		t.Error("expecting the rewrite of the rejected recipient to be removed, got:", rewrites)
+	}
+	// 4 recipients after the 2nd RCPT command, still under the limit
+	expect("RCPT TO:<staff@test.com>", "250")
+	expect("RCPT TO:<test2@test.com>", "250")
+	expect("RCPT TO:<test3@test.com>", "452 4.5.3 Too many recipients")
+	if n := len(client.RcptTo); n != 5 {
+		t.Error("expecting 5 recipients, got:", client.RcptTo)
+	}
+	expect("QUIT", "221")
+	wg.Wait() // wait for handleClient to exit
+}
+
+// Test that the max_rcpts_per_connection counts the recipients of all the transactions, and
+// that the MAIL FROM after max_messages_per_connection messages ends the connection
+func TestMaxPerConnection(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.MaxRcptsPerConnection = 3
+	sc.MaxMessagesPerConnection = 2
+	sc.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal("backend did not start:", err)
+	}
+	defer server.backend().Shutdown()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	expect := func(expected ...string) {
+		for _, e := range expected {
+			if line, _ = r.ReadLine(); strings.Index(line, e) != 0 {
+				t.Error("expected", e, "but got:", line)
+			}
+		}
+	}
+	w.PrintfLine("HELO test.test.com")
+	expect("250")
+	w.PrintfLine("MAIL FROM:<test@example.com>")
+	expect("250")
+	w.PrintfLine("RCPT TO:<test1@test.com>")
+	expect("250")
+	w.PrintfLine("DATA")
+	expect("354")
+	w.PrintfLine("Subject: test\r\n\r\nhello\r\n.")
+	expect("250 2.0.0 OK : queued as")
+	// the recipients of a transaction that was reset still count
+	w.PrintfLine("MAIL FROM:<test@example.com>")
+	expect("250")
+	w.PrintfLine("RCPT TO:<test2@test.com>")
+	expect("250")
+	w.PrintfLine("RSET")
+	expect("250")
+	// pipelined, one past the limit
+	if _, err := conn.Client.Write([]byte("MAIL FROM:<test@example.com>\r\n" +
+		"RCPT TO:<test3@test.com>\r\n" +
+		"RCPT TO:<test4@test.com>\r\n" +
+		"DATA\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("250 2.1.0", "250 2.1.5", "452 4.5.3 Too many recipients", "354")
+	w.PrintfLine("Subject: test\r\n\r\nhello\r\n.")
+	expect("250 2.0.0 OK : queued as")
+	// a third message
+	w.PrintfLine("MAIL FROM:<test@example.com>")
+	expect("421 4.7.0")
+	wg.Wait() // wait for handleClient to exit
+	if _, err := r.ReadLine(); err == nil {
+		t.Error("expecting the connection to be closed")
+	}
+}
+
+// Test that no mail is accepted before STARTTLS when require_tls is on
+func TestRequireTLS(t *testing.T) {
+	testcert.GenerateCert("mail.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	sc := getMockServerConfig()
+	sc.RequireTLS = true
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+
+	// STARTTLS is still offered
+	w.PrintfLine("EHLO test.test.com")
+	lines, _ := r.ReadLine()
+	for line = lines; strings.Index(line, "250-") == 0; line, _ = r.ReadLine() {
+		lines += "\n" + line
+	}
+	if !strings.Contains(lines, "250-STARTTLS") {
+		t.Error("expected STARTTLS to be advertised, but got:", lines)
+	}
+	expect := func(cmd, expected string) {
+		w.PrintfLine(cmd)
+		line, _ = r.ReadLine()
+		if strings.Index(line, expected) != 0 {
+			t.Error(cmd, "expected", expected, "but got:", line)
+		}
+	}
+	for _, cmd := range []string{"MAIL FROM:<test@example.com>", "RCPT TO:<test@test.com>", "DATA", "VRFY test@test.com", "AUTH PLAIN"} {
+		expect(cmd, "530 5.7.0 Must issue a STARTTLS command first")
+	}
+	expect("RSET", "250")
+	expect("STARTTLS", "220")
+
+	tlsConn := tls.Client(conn.Client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal("handshake failed:", err)
+	}
+	r = textproto.NewReader(bufio.NewReader(tlsConn))
+	w = textproto.NewWriter(bufio.NewWriter(tlsConn))
+	expect("EHLO test.test.com", "250-")
+	for strings.Index(line, "250-") == 0 {
+		if line, _ = r.ReadLine(); strings.Contains(line, "STARTTLS") {
+			t.Error("STARTTLS should not be offered after the upgrade")
+		}
+	}
+	expect("MAIL FROM:<test@example.com>", "250")
+
+	w.PrintfLine("QUIT")
+	line, _ = r.ReadLine()
+	// don't wait for the server's close_notify
+	conn.Client.Close()
+	wg.Wait() // wait for handleClient to exit
+}
+
+// handshake connects to the server's TLS config with the server name (SNI),
+// returns the certificate the server sent
+func handshake(server *server, serverName string, clientConfig *tls.Config) (*x509.Certificate, error) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go tls.Server(serverConn, server.tlsConfigStore.Load().(*tls.Config)).Handshake()
+	clientConfig.ServerName = serverName
+	clientConfig.InsecureSkipVerify = true
+	tlsClient := tls.Client(clientConn, clientConfig)
+	if err := tlsClient.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsClient.ConnectionState().PeerCertificates[0], nil
+}
+
+// Test that the certificate is selected by SNI
+func TestSNICertificates(t *testing.T) {
+	testcert.GenerateCert("mail.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	testcert.GenerateCert("mail2.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	testcert.GenerateCert("example.org,*.example.org", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	sc := getMockServerConfig()
+	sc.Certificates = []TLSCertificate{
+		{
+			PublicKeyFile:  "./tests/mail2.guerrillamail.com.cert.pem",
+			PrivateKeyFile: "./tests/mail2.guerrillamail.com.key.pem",
+		},
+		{
+			PublicKeyFile:  "./tests/example.org,*.example.org.cert.pem",
+			PrivateKeyFile: "./tests/example.org,*.example.org.key.pem",
+		},
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal("config should be valid, got:", err)
+	}
+	_, server := getMockServerConn(sc, t)
+	for name, expected := range map[string]string{
+		"mail2.guerrillamail.com": "mail2.guerrillamail.com",
+		"MAIL2.guerrillamail.com": "mail2.guerrillamail.com",
+		"smtp.example.org":        "example.org",
+		"example.org":             "example.org",
+		// the default
+		"mail.guerrillamail.com": "mail.guerrillamail.com",
+		"unknown.example.com":    "mail.guerrillamail.com",
+		"":                       "mail.guerrillamail.com",
+	} {
+		cert, err := handshake(server, name, &tls.Config{})
+		if err != nil {
+			t.Error("handshake failed for", name, err)
+			continue
+		}
+		if len(cert.DNSNames) == 0 || cert.DNSNames[0] != expected {
+			t.Error("expected the certificate of", expected, "for", name, "but got:", cert.DNSNames)
+		}
+	}
+
+	// min version & cipher suites
+	sc.TLSMinVersion = "1.2"
+	sc.TLSCiphers = "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	server.setConfig(sc)
+	if err := server.configureSSL(); err != nil {
+		t.Fatal("configureSSL failed:", err)
+	}
+	if _, err := handshake(server, "", &tls.Config{MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Error("expecting TLS 1.1 to be refused")
+	}
+	if _, err := handshake(server, "", &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}); err == nil {
+		t.Error("expecting a cipher suite that is not listed to be refused")
+	}
+	if _, err := handshake(server, "", &tls.Config{MaxVersion: tls.VersionTLS12}); err != nil {
+		t.Error("expecting TLS 1.2 to be accepted, got:", err)
+	}
+
+	sc.TLSMinVersion = "1.9"
+	sc.TLSCiphers = "TLS_NOPE"
+	if err := sc.Validate(); err == nil || !strings.Contains(err.Error(), "tls_min_version") ||
+		!strings.Contains(err.Error(), "tls_ciphers") {
+		t.Error("expecting tls_min_version and tls_ciphers to be invalid, got:", err)
+	}
+}
+
+// Test that the certificates of the ACME hosts are from the ACME cache, and that the static
+// certificates are used for other names & when the CA fails
+func TestACMECertificates(t *testing.T) {
+	testcert.GenerateCert("mail.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	testcert.GenerateCert("mail.acme.example", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	cacheDir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	// a certificate that was obtained earlier, the cache has the key followed by the chain
+	key, _ := ioutil.ReadFile("./tests/mail.acme.example.key.pem")
+	cert, _ := ioutil.ReadFile("./tests/mail.acme.example.cert.pem")
+	if err := ioutil.WriteFile(cacheDir+"/mail.acme.example", append(key, cert...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a CA that always fails
+	ca := httptest.NewServer(http.NotFoundHandler())
+	defer ca.Close()
+
+	sc := getMockServerConfig()
+	sc.ACME = &ACMEConfig{
+		DirectoryURL: ca.URL,
+		CacheDir:     cacheDir,
+		Hosts:        []string{"mail.acme.example", "new.acme.example"},
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal("config should be valid, got:", err)
+	}
+	_, server := getMockServerConn(sc, t)
+	for name, expected := range map[string]string{
+		"mail.acme.example":   "mail.acme.example",
+		"MAIL.acme.example.":  "mail.acme.example",
+		"unknown.example.com": "mail.guerrillamail.com",
+		"":                    "mail.guerrillamail.com",
+		// the CA failed
+		"new.acme.example": "mail.guerrillamail.com",
+	} {
+		cert, err := handshake(server, name, &tls.Config{})
+		if err != nil {
+			t.Error("handshake failed for", name, err)
+			continue
+		}
+		if len(cert.DNSNames) == 0 || cert.DNSNames[0] != expected {
+			t.Error("expected the certificate of", expected, "for", name, "but got:", cert.DNSNames)
+		}
+	}
+
+	// without static certificates
+	sc.PublicKeyFile, sc.PrivateKeyFile = "", ""
+	if err := sc.Validate(); err != nil {
+		t.Fatal("config should be valid without static certificates, got:", err)
+	}
+	server.setConfig(sc)
+	if err := server.configureSSL(); err != nil {
+		t.Fatal("configureSSL failed:", err)
+	}
+	if cert, err := handshake(server, "", &tls.Config{}); err != nil || cert.DNSNames[0] != "mail.acme.example" {
+		t.Error("expecting the certificate of the first host when there is no server name, got:", err)
+	}
+	if _, err := handshake(server, "unknown.example.com", &tls.Config{}); err == nil {
+		t.Error("expecting the handshake to fail when there is no certificate")
+	}
+
+	sc.ACME.Hosts = nil
+	if err := sc.Validate(); err == nil || !strings.Contains(err.Error(), "acme hosts") {
+		t.Error("expecting the acme hosts to be required, got:", err)
+	}
+}
+
+// Test that STARTTLS gets a tempfail when all handshake slots are taken
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	sc := getMockServerConfig()
+	sc.MaxConcurrentHandshakes = 1
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	server.handshakeWait = time.Millisecond * 100
+	// saturate: pretend another client is in the middle of a handshake
+	sem := server.handshakeSem.Load().(chan bool)
+	sem <- true
+
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	// Wait for the greeting from the server
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	w.PrintfLine("HELO test.test.com")
+	line, _ = r.ReadLine()
+	w.PrintfLine("STARTTLS")
+	line, _ = r.ReadLine()
+	expected := "454 4.7.0"
+	if strings.Index(line, expected) != 0 {
+		t.Error("expected", expected, "but got:", line)
+	}
+
+	// free the slot, the next STARTTLS can proceed
+	<-sem
+	w.PrintfLine("STARTTLS")
+	line, _ = r.ReadLine()
+	expected = "220 2.0.0"
+	if strings.Index(line, expected) != 0 {
+		t.Error("expected", expected, "but got:", line)
+	}
+	// abandon the handshake
+	conn.Client.Close()
+	wg.Wait() // wait for handleClient to exit
+	if len(sem) != 0 {
+		t.Error("handshake slot was not released, slots taken:", len(sem))
+	}
+}
+
+// Test that the JA3 fingerprint of the TLS client is captured during the handshake,
+// and that it is kept for the following transactions
+func TestJA3Fingerprint(t *testing.T) {
+	testcert.GenerateCert("mail2.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	cert, err := tls.LoadX509KeyPair("./tests/mail2.guerrillamail.com.cert.pem", "./tests/mail2.guerrillamail.com.key.pem")
+	if err != nil {
+		t.Fatal("could not load the test cert:", err)
+	}
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	client := NewClient(serverConn, 1, mainlog, mail.NewPool(5))
+	go func() {
+		tlsClient := tls.Client(clientConn, &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			CurvePreferences:   []tls.CurveID{tls.CurveP256},
+		})
+		tlsClient.Handshake()
+	}()
+	if err := client.upgradeToTLS(&tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatal("handshake failed:", err)
+	}
+	fp, _ := client.Values[backends.ValueJA3].(string)
+	if len(fp) != 32 || fp != client.ja3 {
+		t.Error("expecting a fingerprint to be captured, got:", fp)
+	}
+	client.resetTransaction()
+	if client.Values[backends.ValueJA3] != fp {
+		t.Error("the fingerprint should be kept after the transaction is reset")
+	}
+}
+
+// Test that the details of the TLS connection are set on the envelope
+func TestTLSInfo(t *testing.T) {
+	testcert.GenerateCert("mail2.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	testcert.GenerateCert("client.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	cert, err := tls.LoadX509KeyPair("./tests/mail2.guerrillamail.com.cert.pem", "./tests/mail2.guerrillamail.com.key.pem")
+	if err != nil {
+		t.Fatal("could not load the test cert:", err)
+	}
+	clientCert, err := tls.LoadX509KeyPair("./tests/client.guerrillamail.com.cert.pem", "./tests/client.guerrillamail.com.key.pem")
+	if err != nil {
+		t.Fatal("could not load the test client cert:", err)
+	}
+	clientX509, _ := x509.ParseCertificate(clientCert.Certificate[0])
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+
+	for _, withCert := range []bool{false, true} {
+		serverConn, clientConn := net.Pipe()
+		client := NewClient(serverConn, 1, mainlog, mail.NewPool(5))
+		state := make(chan tls.ConnectionState, 1)
+		go func() {
+			config := &tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         "mail2.guerrillamail.com",
+				MaxVersion:         tls.VersionTLS12,
+			}
+			if withCert {
+				config.Certificates = []tls.Certificate{clientCert}
+			}
+			tlsClient := tls.Client(clientConn, config)
+			tlsClient.Handshake()
+			state <- tlsClient.ConnectionState()
+		}()
+		// the certificate is not verified, it is only reported
+		if err := client.upgradeToTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+		}); err != nil {
+			t.Fatal("handshake failed:", err)
+		}
+		clientState := <-state
+		info := client.TLSInfo
+		if info == nil {
+			t.Fatal("expecting the TLS info to be set")
+		}
+		if client.TLSVersion() != "TLSv1.2" || info.Version != "TLSv1.2" {
+			t.Error("expecting TLSv1.2, got:", client.TLSVersion())
+		}
+		if client.TLSCipherSuite() != tlsCipherName(clientState.CipherSuite) || info.CipherSuite == "" {
+			t.Error("expecting the negotiated cipher suite, got:", client.TLSCipherSuite())
+		}
+		if client.TLSServerName() != "mail2.guerrillamail.com" {
+			t.Error("expecting the SNI name, got:", client.TLSServerName())
+		}
+		subject, ok := client.TLSClientSubject()
+		if ok != withCert || info.ClientCert != withCert {
+			t.Error("expecting a client certificate to be", withCert)
+		}
+		if withCert && subject != clientX509.Subject.String() {
+			t.Error("expecting the subject of the client certificate, got:", subject)
+		}
+		client.resetTransaction()
+		if client.TLSInfo != info {
+			t.Error("the TLS info should be kept after the transaction is reset")
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	if e.TLSVersion() != "" || e.TLSCipherSuite() != "" || e.TLSServerName() != "" {
+		t.Error("expecting no TLS details without TLS")
+	}
+	if _, ok := e.TLSClientSubject(); ok {
+		t.Error("expecting no client certificate without TLS")
+	}
+}
+
+// newTestCert returns a certificate for the client authentication with the common name cn,
+// signed by parent or self-signed if parent is nil
+func newTestCert(t *testing.T, cn string, isCA bool, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Guerrilla Test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn + ".internal"},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := template, crypto.Signer(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey.(crypto.Signer)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// clientCertSession connects to a server that has sc, presenting cert after STARTTLS if not nil.
+// Returns the client after the connection is closed, and the error of the handshake
+func clientCertSession(t *testing.T, sc *ServerConfig, cert *tls.Certificate) (*client, error) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	_, server := getMockServerConn(sc, t)
+	// a buffered connection, both sides write during a handshake that fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(serverConn, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn))
+	w := textproto.NewWriter(bufio.NewWriter(conn))
+	expect := func(cmd, expected string) {
+		w.PrintfLine(cmd)
+		line, _ := r.ReadLine()
+		for strings.Index(line, "250-") == 0 {
+			line, _ = r.ReadLine()
+		}
+		if strings.Index(line, expected) != 0 {
+			t.Error(cmd, "expected", expected, "but got:", line)
+		}
+	}
+	r.ReadLine()
+	expect("EHLO test.test.com", "250 ")
+	if sc.ClientAuth == ClientAuthRequire {
+		expect("MAIL FROM:<test@example.com>", "530")
+	}
+	expect("STARTTLS", "220")
+	config := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	if cert != nil {
+		// sent even if it isn't signed by one of the CAs that the server asks for
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.Handshake()
+	if err == nil {
+		r = textproto.NewReader(bufio.NewReader(tlsConn))
+		w = textproto.NewWriter(bufio.NewWriter(tlsConn))
+		expect("EHLO test.test.com", "250 ")
+		expect("MAIL FROM:<test@example.com>", "250")
+		w.PrintfLine("QUIT")
+		r.ReadLine()
+	}
+	conn.Close()
+	wg.Wait()
+	return client, err
+}
+
+func TestClientCertAuth(t *testing.T) {
+	testcert.GenerateCert("mail.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/")
+	dir, err := ioutil.TempDir("", "clientauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "Guerrilla Test CA", true, nil)
+	caFile := dir + "/ca.pem"
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	valid := newTestCert(t, "relay1", false, &ca)
+	untrusted := newTestCert(t, "relay2", false, nil)
+
+	sc := getMockServerConfig()
+	sc.ClientAuth = ClientAuthRequire
+	sc.ClientCAFile = caFile
+	if err := sc.Validate(); err != nil {
+		t.Fatal("config should be valid, got:", err)
+	}
+	client, err := clientCertSession(t, sc, &valid)
+	if err != nil {
+		t.Fatal("expecting the valid certificate to be accepted, got:", err)
+	}
+	if client.authLogin != "relay1" {
+		t.Error("expecting the client to be authenticated as relay1, got:", client.authLogin)
+	}
+	if _, err := clientCertSession(t, sc, &untrusted); err == nil {
+		t.Error("expecting the untrusted certificate to be refused")
+	}
+	if _, err := clientCertSession(t, sc, nil); err == nil {
+		t.Error("expecting the handshake without a certificate to be refused")
+	}
+
+	// the certificate is optional
+	sc.ClientAuth = ClientAuthRequest
+	if client, err := clientCertSession(t, sc, nil); err != nil || client.authLogin != "" {
+		t.Error("expecting an unauthenticated client without a certificate, got:", err, client.authLogin)
+	}
+	if _, err := clientCertSession(t, sc, &untrusted); err == nil {
+		t.Error("expecting the untrusted certificate to be refused")
+	}
+
+	// the certificate is mapped by the hook
+	setClientCertMapper(func(cert *x509.Certificate) string {
+		return cert.DNSNames[0]
+	})
+	defer setClientCertMapper(nil)
+	if client, err := clientCertSession(t, sc, &valid); err != nil || client.authLogin != "relay1.internal" {
+		t.Error("expecting the client to be authenticated as relay1.internal, got:", err, client.authLogin)
+	}
+
+	sc.ClientAuth = "maybe"
+	sc.ClientCAFile = dir + "/none.pem"
+	if err := sc.Validate(); err == nil || !strings.Contains(err.Error(), "client_auth") ||
+		!strings.Contains(err.Error(), "client_ca_file") {
+		t.Error("expecting client_auth and client_ca_file to be invalid, got:", err)
+	}
+}
+
+func TestJA3String(t *testing.T) {
+	// a ClientHello with a GREASE cipher and extension, which are skipped
+	hello := []byte{
+		0x01, 0x00, 0x00, 0x00, // handshake header, length set below
+		0x03, 0x03, // version
+	}
+	hello = append(hello, make([]byte, 32)...) // random
+	hello = append(hello, 0x00)                // session id
+	hello = append(hello, 0x00, 0x06, 0x1a, 0x1a, 0xc0, 0x2f, 0xc0, 0x2b)
+	hello = append(hello, 0x01, 0x00) // compression
+	exts := []byte{
+		0x2a, 0x2a, 0x00, 0x00, // GREASE
+		0x00, 0x0a, 0x00, 0x06, 0x00, 0x04, 0x00, 0x1d, 0x00, 0x17, // supported groups
+		0x00, 0x0b, 0x00, 0x02, 0x01, 0x00, // point formats
+		0xff, 0x01, 0x00, 0x01, 0x00, // renegotiation info
+	}
+	hello = append(hello, 0x00, byte(len(exts)))
+	hello = append(hello, exts...)
+	hello[3] = byte(len(hello) - 4)
+	record := append([]byte{0x16, 0x03, 0x01, 0x00, byte(len(hello))}, hello...)
+
+	s, err := ja3String(record)
+	expected := "771,49199-49195,10-11-65281,29-23,0"
+	if err != nil || s != expected {
+		t.Error("expected", expected, "but got:", s, err)
+	}
+	if _, err := ja3String(record[:40]); err == nil {
+		t.Error("expecting an error for a truncated ClientHello")
+	}
+}
+
+// Test that internationalized domains are accepted in RCPT TO, and that
+// allowed_hosts given in either form match
+func TestIDNRcpt(t *testing.T) {
+	var mainlog log.Logger
+	var logOpenError error
+	sc := getMockServerConfig()
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	server.setAllowedHosts([]string{"münchen.example", "xn--bcher-kva.example"})
+	if err := server.backend().Start(); err != nil {
+		t.Fatal("backend did not start:", err)
+	}
+	defer server.backend().Shutdown()
+
+	if addr, err := extractEmail("<user@MÜNCHEN.example>", &response.Canned); err != nil || addr.Host != "xn--mnchen-3ya.example" {
+		t.Error("expecting the host in ASCII form, got:", addr.Host, err)
+	}
+
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	w.PrintfLine("HELO test.test.com")
+	line, _ = r.ReadLine()
+	w.PrintfLine("MAIL FROM:<test@example.com>")
+	line, _ = r.ReadLine()
+	for _, rcpt := range []string{
+		"<user@münchen.example>",
+		"<user@xn--mnchen-3ya.example>",
+		"<user@bücher.example>",
+	} {
+		w.PrintfLine("RCPT TO:" + rcpt)
+		line, _ = r.ReadLine()
+		expected := "250 2.1.5"
+		if strings.Index(line, expected) != 0 {
+			t.Error("RCPT TO:", rcpt, "expected", expected, "but got:", line)
+		}
+	}
+	w.PrintfLine("QUIT")
+	line, _ = r.ReadLine()
+	wg.Wait() // wait for handleClient to exit
+}
+
+// Test that a save which was waiting on the old backend during a backend swap
+// is handed to the new backend, and that the save in-flight on the old backend completes
+func TestProcessBackendSwap(t *testing.T) {
+	sc := getMockServerConfig()
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	_, server := getMockServerConn(sc, t)
+
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	backends.Svc.AddProcessor("slowsave", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					started <- true
+					<-release
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	oldBackend, err := backends.New(backends.BackendConfig{"save_process": "slowsave", "save_workers_size": 2}, mainlog)
+	if err != nil {
+		t.Fatal("old backend failed:", err)
+	}
+	if err = oldBackend.Start(); err != nil {
+		t.Fatal("old backend did not start:", err)
+	}
+	server.setBackend(oldBackend)
+
+	var wg sync.WaitGroup
+	var inFlight, waiting backends.Result
+	wg.Add(1)
+	go func() {
+		inFlight = server.process(mail.NewEnvelope("127.0.0.1", 1))
+		wg.Done()
+	}()
+	<-started
+
+	// the old backend is shutting down, it waits for the in-flight save
+	wg.Add(1)
+	go func() {
+		oldBackend.Shutdown()
+		wg.Done()
+	}()
+	time.Sleep(time.Millisecond * 50)
+	// this save got the old backend before the swap
+	wg.Add(1)
+	go func() {
+		waiting = server.process(mail.NewEnvelope("127.0.0.1", 2))
+		wg.Done()
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	newBackend, err := backends.New(backends.BackendConfig{"save_workers_size": 1}, mainlog)
+	if err != nil {
+		t.Fatal("new backend failed:", err)
+	}
+	if err = newBackend.Start(); err != nil {
+		t.Fatal("new backend did not start:", err)
+	}
+	defer newBackend.Shutdown()
+	server.setBackend(newBackend)
+	close(release)
+	wg.Wait()
+
+	if inFlight.Code() >= 300 {
+		t.Error("the in-flight save should complete on the old backend, got:", inFlight)
+	}
+	if waiting.Code() >= 300 {
+		t.Error("the waiting save should be handed to the new backend, got:", waiting)
+	}
+}
+
+// sendMessageIDBatch sends 2 messages with the same Message-ID and returns the replies to the DATA
+func sendMessageIDBatch(t *testing.T, mode string) []string {
+	var mainlog log.Logger
+	var logOpenError error
+	sc := getMockServerConfig()
+	sc.DuplicateMessageID = mode
+	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	// getMockServerConn does not set the hosts when the TLS certificate is missing
+	server.setAllowedHosts([]string{"test.com"})
+	if err := server.backend().Start(); err != nil {
+		t.Fatal("backend did not start:", err)
+	}
+	defer server.backend().Shutdown()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	line, _ := r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	w.PrintfLine("HELO test.test.com")
+	line, _ = r.ReadLine()
+	var replies []string
+	for i := 0; i < 2; i++ {
+		w.PrintfLine("MAIL FROM:<sender@example.com>")
+		line, _ = r.ReadLine()
+		w.PrintfLine("RCPT TO:<test@test.com>")
+		if line, _ = r.ReadLine(); strings.Index(line, "250") != 0 {
+			t.Error("expected the recipient to be accepted, got:", line)
+		}
+		w.PrintfLine("DATA")
+		if line, _ = r.ReadLine(); strings.Index(line, "354") != 0 {
+			t.Error("expected 354 to the DATA, got:", line)
+		}
+		w.PrintfLine("Subject: batch\r\nMessage-ID: <same@example.com>\r\n\r\nhello\r\n.")
+		line, _ = r.ReadLine()
+		replies = append(replies, line)
+	}
+	w.PrintfLine("QUIT")
+	line, _ = r.ReadLine()
+	wg.Wait()
+	return replies
+}
+
+// Test a batch of messages that re-use a Message-ID
+func TestDuplicateMessageID(t *testing.T) {
+	replies := sendMessageIDBatch(t, DuplicateMessageIDReject)
+	if strings.Index(replies[0], "250") != 0 {
+		t.Error("expected the first message to be accepted, got:", replies[0])
+	}
+	if strings.Index(replies[1], "550 5.6.0") != 0 {
+		t.Error("expected the duplicate to be rejected, got:", replies[1])
+	}
+
+	replies = sendMessageIDBatch(t, DuplicateMessageIDRewrite)
+	for i := range replies {
+		if strings.Index(replies[i], "250") != 0 {
+			t.Error("expected message", i, "to be accepted, got:", replies[i])
+		}
+	}
+}
+
+func TestCheckMessageIDRewrite(t *testing.T) {
+	sc := getMockServerConfig()
+	conn, server := getMockServerConn(sc, t)
+	mainlog, _ := log.GetLogger(sc.LogFile, "debug")
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	msg := "Subject: batch\nMessage-ID:\n <same@example.com>\n\nMessage-ID: <body@example.com>\n"
+	client.Data.WriteString(msg)
+	id, ok := server.checkMessageID(client, DuplicateMessageIDReject)
+	if !ok || id != "<same@example.com>" || client.Data.String() != msg {
+		t.Error("the first message should not change, got:", id, client.Data.String())
+	}
+	// not recorded until the message is accepted
+	if _, ok = server.checkMessageID(client, DuplicateMessageIDReject); !ok {
+		t.Error("the Message-ID should not be recorded by the check")
+	}
+	client.messageIDs = map[string]bool{id: true}
+	if id, ok = server.checkMessageID(client, DuplicateMessageIDRewrite); !ok {
+		t.Error("rewrite mode should not reject")
+	}
+	found, _, _ := findMessageID(client.Data.Bytes())
+	if found != id || id == "<same@example.com>" || !strings.HasSuffix(id, ".same@example.com>") {
+		t.Error("expecting a new Message-ID, got:", found, id)
+	}
+	if !strings.HasSuffix(client.Data.String(), "\n\nMessage-ID: <body@example.com>\n") {
+		t.Error("the body should not change, got:", client.Data.String())
+	}
+	if _, ok = server.checkMessageID(client, DuplicateMessageIDReject); !ok {
+		t.Error("the rewritten Message-ID should be new")
+	}
+}
+
 // TODO
 // - test github issue #44 and #42
+
+// tcpPair returns the two ends of a TCP connection, the mock connection can't time out
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serverConn, clientConn
+}
+
+// Test that a client talking before the greeting is disconnected
+func TestGreetingDelay(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.GreetingDelay = 1
+	sc.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	_, server := getMockServerConn(sc, t)
+
+	// talks early
+	serverConn, clientConn := tcpPair(t)
+	defer clientConn.Close()
+	go server.handleClient(NewClient(serverConn, 1, mainlog, mail.NewPool(5)))
+	if _, err := clientConn.Write([]byte("EHLO test.test.com\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := textproto.NewReader(bufio.NewReader(clientConn))
+	if line, _ := r.ReadLine(); strings.Index(line, "554 5.5.1") != 0 {
+		t.Error("expecting a 554 for talking before the greeting, got:", line)
+	}
+	clientConn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := r.ReadLine(); err == nil {
+		t.Error("expecting the connection to be closed")
+	}
+
+	// waits for the greeting
+	serverConn, clientConn = tcpPair(t)
+	defer clientConn.Close()
+	start := time.Now()
+	go server.handleClient(NewClient(serverConn, 2, mainlog, mail.NewPool(5)))
+	r = textproto.NewReader(bufio.NewReader(clientConn))
+	if line, _ := r.ReadLine(); strings.Index(line, "220") != 0 {
+		t.Error("expecting the greeting, got:", line)
+	}
+	if time.Since(start) < time.Second {
+		t.Error("expecting the greeting to be delayed")
+	}
+	w := textproto.NewWriter(bufio.NewWriter(clientConn))
+	w.PrintfLine("HELO test.test.com")
+	if line, _ := r.ReadLine(); strings.Index(line, "250") != 0 {
+		t.Error("expecting the session to go on after the greeting, got:", line)
+	}
+	w.PrintfLine("QUIT")
+	r.ReadLine()
+}
+
+// Test that the 5xx replies are delayed more and more
+func TestErrorDelay(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.ErrorDelay = 1
+	sc.StartTLSOn = false
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	r.ReadLine()
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	// how long the reply to cmd takes
+	timeReply := func(cmd, expected string) time.Duration {
+		start := time.Now()
+		w.PrintfLine(cmd)
+		if line, _ := r.ReadLine(); strings.Index(line, expected) != 0 {
+			t.Error("expected", expected, "but got:", line)
+		}
+		return time.Since(start)
+	}
+	if d := timeReply("HELO test.test.com", "250"); d >= time.Second {
+		t.Error("expecting no delay before errors, got:", d)
+	}
+	if d := timeReply("BOGUS", "554"); d < time.Second {
+		t.Error("expecting the first error to be delayed a second, got:", d)
+	}
+	if d := timeReply("BOGUS", "554"); d < time.Second*2 {
+		t.Error("expecting the second error to be delayed two seconds, got:", d)
+	}
+	if d := timeReply("NOOP", "2"); d >= time.Second {
+		t.Error("expecting no delay for a reply that is not an error, got:", d)
+	}
+	w.PrintfLine("QUIT")
+	r.ReadLine()
+	wg.Wait()
+}
+
+// Test that the context of the envelope is cancelled when the client goes away during the save,
+// and that the session goes on when it does not
+func TestWatchConn(t *testing.T) {
+	sc := getMockServerConfig()
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	_, server := getMockServerConn(sc, t)
+
+	// the client stays
+	serverConn, clientConn := tcpPair(t)
+	defer clientConn.Close()
+	client := NewClient(serverConn, 1, mainlog, mail.NewPool(5))
+	ctx, stop := server.watchConn(client)
+	clientConn.Write([]byte("NOOP\r\n"))
+	select {
+	case <-ctx.Done():
+		t.Error("expecting the context not to be cancelled, a command came")
+	case <-time.After(time.Millisecond * 100):
+	}
+	stop()
+	client.setTimeout(5)
+	if line, err := client.bufin.ReadString('\n'); line != "NOOP\r\n" {
+		t.Error("expecting to read the command after the save, got:", line, err)
+	}
+
+	// the client goes away
+	serverConn, clientConn = tcpPair(t)
+	client = NewClient(serverConn, 2, mainlog, mail.NewPool(5))
+	ctx, stop = server.watchConn(client)
+	defer stop()
+	clientConn.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second * 2):
+		t.Error("expecting the context to be cancelled")
+	}
+}
+
+// lmtpBackend fails the delivery to the "full" recipient, for testing LMTP
+type lmtpBackend struct {
+	rcptBackend
+}
+
+func (b *lmtpBackend) Process(e *mail.Envelope) backends.Result {
+	results := make([]backends.Result, len(e.RcptTo))
+	for i := range e.RcptTo {
+		if e.RcptTo[i].User == "full" {
+			results[i] = backends.NewResult("452 4.2.2 Mailbox full")
+		} else {
+			results[i] = backends.NewResult("250 2.0.0 OK " + e.RcptTo[i].String())
+		}
+	}
+	return backends.NewRcptResults(backends.NewResult("250 2.0.0 OK"), results)
+}
+
+func TestLMTP(t *testing.T) {
+	for _, protocol := range []string{ProtocolSMTP, ProtocolLMTP} {
+		sc := getMockServerConfig()
+		sc.Protocol = protocol
+		sc.StartTLSOn = false
+		mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+		if logOpenError != nil {
+			mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+		}
+		conn, server := getMockServerConn(sc, t)
+		server, err := newServer(sc, &lmtpBackend{rcptBackend{server.backend()}}, mainlog)
+		if err != nil {
+			t.Fatal("new server failed because:", err)
+		}
+		server.setAllowedHosts([]string{"test.com"})
+		client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			server.handleClient(client)
+			wg.Done()
+		}()
+		r := textproto.NewReader(bufio.NewReader(conn.Client))
+		if line, _ := r.ReadLine(); !strings.Contains(line, strings.ToUpper(protocol)) {
+			t.Error("expected the greeting to name", protocol, "got:", line)
+		}
+		w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+		hello, wrongHello := "EHLO", "LHLO"
+		if protocol == ProtocolLMTP {
+			hello, wrongHello = "LHLO", "EHLO"
+		}
+		w.PrintfLine(wrongHello + " test.test.com")
+		if line, _ := r.ReadLine(); strings.Index(line, "500 5.5.1") != 0 {
+			t.Error(protocol, "expected", wrongHello, "to be refused, got:", line)
+		}
+		w.PrintfLine(hello + " test.test.com")
+		if _, lines, err := r.ReadResponse(250); err != nil {
+			t.Error(protocol, "expected", hello, "to be accepted, got:", lines, err)
+		}
+		w.PrintfLine("MAIL FROM:<sender@example.com>")
+		r.ReadLine()
+		w.PrintfLine("RCPT TO:<test@test.com>")
+		r.ReadLine()
+		w.PrintfLine("RCPT TO:<full@test.com>")
+		r.ReadLine()
+		w.PrintfLine("DATA")
+		r.ReadLine()
+		w.PrintfLine("Subject: lmtp\r\n\r\nhello\r\n.")
+		var replies []string
+		line, _ := r.ReadLine()
+		replies = append(replies, line)
+		if protocol == ProtocolLMTP {
+			line, _ = r.ReadLine()
+			replies = append(replies, line)
+		}
+		w.PrintfLine("QUIT")
+		if line, _ = r.ReadLine(); strings.Index(line, "221") != 0 {
+			t.Error(protocol, "expected the reply to QUIT, got:", line)
+		}
+		wg.Wait()
+
+		expected := []string{"250 2.0.0 OK"}
+		if protocol == ProtocolLMTP {
+			expected = []string{"250 2.0.0 OK test@test.com", "452 4.2.2 Mailbox full"}
+		}
+		if len(replies) != len(expected) {
+			t.Fatal(protocol, "expected", expected, "got:", replies)
+		}
+		for i := range expected {
+			if replies[i] != expected[i] {
+				t.Error(protocol, "expected", expected[i], "got:", replies[i])
+			}
+		}
+	}
+}
+
+func TestClientProtocol(t *testing.T) {
+	for _, test := range []struct {
+		lmtp, esmtp, tls bool
+		login            string
+		protocol         string
+	}{
+		{false, false, false, "", "SMTP"},
+		{false, true, false, "", "ESMTP"},
+		{false, true, true, "", "ESMTPS"},
+		{false, true, false, "alice", "ESMTPA"},
+		{false, true, true, "alice", "ESMTPSA"},
+		// TLS from the start, greeted with HELO
+		{false, false, true, "", "ESMTPS"},
+		{true, true, false, "", "LMTP"},
+		{true, true, true, "alice", "LMTPSA"},
+	} {
+		c := &client{esmtp: test.esmtp, authLogin: test.login, Envelope: mail.NewEnvelope("127.0.0.1", 1)}
+		c.TLS = test.tls
+		if p := c.protocol(test.lmtp); p != test.protocol {
+			t.Errorf("expecting %s for %+v, got: %s", test.protocol, test, p)
+		}
+	}
+	if v := tlsVersionName(tls.VersionTLS12); v != "TLSv1.2" {
+		t.Error("unexpected TLS version name:", v)
+	}
+	if c := tlsCipherName(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256); c != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" {
+		t.Error("unexpected cipher name:", c)
+	}
+	if c := tlsCipherName(0x1301); c != "TLS_AES_128_GCM_SHA256" {
+		t.Error("unexpected TLS 1.3 cipher name:", c)
+	}
+}
+
+func TestDSNParams(t *testing.T) {
+	ret, envID, err := dsnMailParams(esmtpParams("<alice@example.com> RET=full ENVID=QQ+2B314 SIZE=100"))
+	if err != nil || ret != "FULL" || envID != "QQ+314" {
+		t.Error("unexpected MAIL FROM params:", ret, envID, err)
+	}
+	dsn, err := dsnRcptParams(esmtpParams("<bob@example.com> NOTIFY=FAILURE,delay ORCPT=rfc822;Bob+2Bx@example.com"))
+	if err != nil || strings.Join(dsn.Notify, ",") != "FAILURE,DELAY" || dsn.ORCPT != "rfc822;Bob+x@example.com" {
+		t.Error("unexpected RCPT TO params:", dsn, err)
+	}
+	if dsn, err := dsnRcptParams(esmtpParams("<bob@example.com>")); err != nil || len(dsn.Notify) != 0 || dsn.ORCPT != "" {
+		t.Error("expecting no params, got:", dsn, err)
+	}
+	for _, params := range []string{"RET=BODY", "ENVID=a+zz", "ENVID=" + strings.Repeat("a", 101)} {
+		if _, _, err := dsnMailParams(esmtpParams("<> " + params)); err == nil {
+			t.Error("expecting an error for", params)
+		}
+	}
+	for _, params := range []string{"NOTIFY=NEVER,FAILURE", "NOTIFY=SOMETIMES", "NOTIFY=DELAY,DELAY", "ORCPT=bob@example.com", "ORCPT=rfc822;a+2"} {
+		if _, err := dsnRcptParams(esmtpParams("<bob@example.com> " + params)); err == nil {
+			t.Error("expecting an error for", params)
+		}
+	}
+}
+
+func TestCustomResponses(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.StartTLSOn = false
+	sc.Greeting = "ESMTP ready"
+	sc.Responses = map[string]string{
+		"FailRcptCmd":    "550 No such user here",
+		"SuccessQuitCmd": "221 2.0.0 See you",
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal("expecting the responses to be valid:", err)
+	}
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	_, server := getMockServerConn(sc, t)
+	serverConn, clientConn := tcpPair(t)
+	defer clientConn.Close()
+	go server.handleClient(NewClient(serverConn, 1, mainlog, mail.NewPool(5)))
+	r := textproto.NewReader(bufio.NewReader(clientConn))
+	w := textproto.NewWriter(bufio.NewWriter(clientConn))
+	if line, _ := r.ReadLine(); line != "220 saggydimes.test.com ESMTP ready" {
+		t.Error("expecting the custom greeting, got:", line)
+	}
+	w.PrintfLine("HELO test.test.com")
+	r.ReadLine()
+	w.PrintfLine("QUIT")
+	if line, _ := r.ReadLine(); line != "221 2.0.0 See you" {
+		t.Error("expecting the custom reply to QUIT, got:", line)
+	}
+	if server.canned().FailRcptCmd != "550 5.1.1 No such user here" {
+		t.Error("expecting the enhanced code to be kept, got:", server.canned().FailRcptCmd)
+	}
+	if response.Canned.SuccessQuitCmd != "221 2.0.0 Bye" {
+		t.Error("the canned responses should not change, got:", response.Canned.SuccessQuitCmd)
+	}
+
+	for _, responses := range []map[string]string{
+		{"NoSuchResponse": "550 5.1.1 No such user"},
+		{"FailRcptCmd": "No such user"},
+		{"FailRcptCmd": "250 2.1.5 OK"},
+		{"FailRcptCmd": "550 4.1.1 No such user"},
+		{"FailRcptCmd": "550 No such\r\n250 user"},
+	} {
+		sc.Responses = responses
+		if err := sc.Validate(); err == nil {
+			t.Error("expecting the responses to be invalid:", responses)
+		}
+	}
+	sc.Responses = nil
+	sc.Greeting = "ready\r\n250 OK"
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting the greeting to be invalid")
+	}
+}
+
+func TestAllowedNets(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.StartTLSOn = false
+	sc.AllowedNets = []string{"192.0.2.0/24", "2001:db8::/32"}
+	sc.DeniedNets = []string{"192.0.2.66"}
+	sc.DeniedNetsReply = true
+	if err := sc.Validate(); err != nil {
+		t.Fatal("expecting the networks to be valid:", err)
+	}
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	_, server := getMockServerConn(sc, t)
+
+	// greet returns the first line the client at ip gets
+	greet := func(ip string) string {
+		serverConn, clientConn := tcpPair(t)
+		defer clientConn.Close()
+		c := NewClient(serverConn, 1, mainlog, mail.NewPool(5))
+		// simulates a client from ip
+		c.RemoteIP = ip
+		go server.handleClient(c)
+		clientConn.SetDeadline(time.Now().Add(time.Second * 5))
+		r := textproto.NewReader(bufio.NewReader(clientConn))
+		line, _ := r.ReadLine()
+		if strings.Index(line, "220") == 0 {
+			textproto.NewWriter(bufio.NewWriter(clientConn)).PrintfLine("QUIT")
+		} else if _, err := r.ReadLine(); err == nil {
+			t.Error("expecting the connection to be closed for", ip)
+		}
+		return line
+	}
+	for ip, code := range map[string]string{
+		"192.0.2.10":   "220",
+		"2001:db8::1":  "220",
+		"192.0.2.66":   "554",
+		"198.51.100.1": "554",
+		"2001:db9::1":  "554",
+	} {
+		if line := greet(ip); strings.Index(line, code) != 0 {
+			t.Errorf("expecting %s for %s, got: %s", code, ip, line)
+		}
+	}
+
+	// reloaded, closed without a reply
+	sc.AllowedNets = nil
+	sc.DeniedNetsReply = false
+	server.setConfig(sc)
+	if line := greet("198.51.100.1"); strings.Index(line, "220") != 0 {
+		t.Error("expecting all the networks to be allowed, got:", line)
+	}
+	if line := greet("192.0.2.66"); line != "" {
+		t.Error("expecting no reply, got:", line)
+	}
+
+	for _, nets := range []string{"192.0.2.0/33", "example.com", "2001:db8::/129"} {
+		sc.DeniedNets = []string{nets}
+		if err := sc.Validate(); err == nil {
+			t.Error("expecting an invalid network:", nets)
+		}
+	}
+}
+
+func TestDataTimeout(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.StartTLSOn = false
+	sc.TimeoutCommand = 1
+	sc.TimeoutData = 2
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	_, server := getMockServerConn(sc, t)
+	// accepts the recipients
+	server, err := newServer(sc, &rcptBackend{server.backend()}, mainlog)
+	if err != nil {
+		t.Fatal("new server failed because:", err)
+	}
+	server.setAllowedHosts([]string{"test.com"})
+	serverConn, clientConn := tcpPair(t)
+	defer clientConn.Close()
+	go server.handleClient(NewClient(serverConn, 1, mainlog, mail.NewPool(5)))
+	clientConn.SetDeadline(time.Now().Add(time.Second * 10))
+	r := textproto.NewReader(bufio.NewReader(clientConn))
+	w := textproto.NewWriter(bufio.NewWriter(clientConn))
+	r.ReadLine()
+	for _, cmd := range []string{"HELO test.test.com", "MAIL FROM:<alice@example.com>", "RCPT TO:<bob@test.com>", "DATA"} {
+		w.PrintfLine(cmd)
+		r.ReadLine()
+	}
+	// stalls in the middle of the message, for longer than the command timeout
+	w.PrintfLine("Subject: stalled")
+	start := time.Now()
+	line, _ := r.ReadLine()
+	if strings.Index(line, "421 4.4.2") != 0 {
+		t.Error("expecting a 421 for the timeout, got:", line)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second*2 {
+		t.Error("expecting the data timeout, not the command timeout, got:", elapsed)
+	}
+	if _, err := r.ReadLine(); err == nil {
+		t.Error("expecting the connection to be closed")
+	}
+
+	// the command timeout
+	serverConn, clientConn = tcpPair(t)
+	defer clientConn.Close()
+	go server.handleClient(NewClient(serverConn, 2, mainlog, mail.NewPool(5)))
+	clientConn.SetDeadline(time.Now().Add(time.Second * 10))
+	r = textproto.NewReader(bufio.NewReader(clientConn))
+	r.ReadLine()
+	start = time.Now()
+	if line, _ := r.ReadLine(); strings.Index(line, "421 4.4.2") != 0 || time.Since(start) > time.Second*2 {
+		t.Error("expecting a 421 after the command timeout, got:", line, time.Since(start))
+	}
+}
+
+func TestDotReader(t *testing.T) {
+	for _, test := range []struct {
+		data, message, rest string
+		bare                bool
+	}{
+		{"Subject: hi\r\n\r\nbody\r\n.\r\nQUIT\r\n", "Subject: hi\n\nbody\n", "QUIT\r\n", false},
+		{".\r\n", "", "", false},
+		{"..stuffed\r\n.\r\n", ".stuffed\n", "", false},
+		// a bare LF can't end the message, or start a stuffed line
+		{"body\n.\nMAIL FROM:<evil@example.com>\r\n.\r\n", "body\n.\nMAIL FROM:<evil@example.com>\n", "", true},
+		{"body\n..x\r\n.\r\n", "body\n..x\n", "", true},
+		{"body\r\n.\nsmuggled\r\n.\r\n", "body\n\nsmuggled\n", "", true},
+		// neither can a bare CR
+		{"body\r\n.\rsmuggled\r\n.\r\n", "body\nsmuggled\n", "", true},
+		{"body\r.\r\nsmuggled\r\n.\r\n", "body.\nsmuggled\n", "", true},
+		{"body\r\r\n.\r\n", "body\n", "", true},
+	} {
+		for _, strict := range []bool{false, true} {
+			in := bufio.NewReader(strings.NewReader(test.data))
+			message, err := ioutil.ReadAll(newDotReader(in, strict))
+			if string(message) != test.message {
+				t.Errorf("expecting %q for %q, got: %q", test.message, test.data, message)
+			}
+			if rest, _ := ioutil.ReadAll(in); string(rest) != test.rest {
+				t.Errorf("expecting %q after the message %q, got: %q", test.rest, test.data, rest)
+			}
+			if expected := error(nil); strict && test.bare {
+				if err != ErrBareLineBreak {
+					t.Errorf("expecting ErrBareLineBreak for %q, got: %v", test.data, err)
+				}
+			} else if err != expected {
+				t.Errorf("unexpected error for %q: %v", test.data, err)
+			}
+		}
+	}
+	if _, err := ioutil.ReadAll(newDotReader(bufio.NewReader(strings.NewReader("body\r\n")), false)); err != io.ErrUnexpectedEOF {
+		t.Error("expecting io.ErrUnexpectedEOF for a message without an end, got:", err)
+	}
+}
+
+func TestStrictCRLF(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.StartTLSOn = false
+	sc.StrictCRLF = true
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	_, server := getMockServerConn(sc, t)
+	server, err := newServer(sc, &rcptBackend{server.backend()}, mainlog)
+	if err != nil {
+		t.Fatal("new server failed because:", err)
+	}
+	server.setAllowedHosts([]string{"test.com"})
+	serverConn, clientConn := tcpPair(t)
+	defer clientConn.Close()
+	go server.handleClient(NewClient(serverConn, 1, mainlog, mail.NewPool(5)))
+	clientConn.SetDeadline(time.Now().Add(time.Second * 10))
+	r := textproto.NewReader(bufio.NewReader(clientConn))
+	r.ReadLine()
+	// the smuggled MAIL FROM is part of the message, which is rejected
+	clientConn.Write([]byte("HELO test.test.com\r\nMAIL FROM:<alice@example.com>\r\nRCPT TO:<bob@test.com>\r\nDATA\r\n"))
+	for i := 0; i < 4; i++ {
+		r.ReadLine()
+	}
+	clientConn.Write([]byte("Subject: hi\r\n\r\nbody\n.\nMAIL FROM:<evil@example.com>\r\n.\r\n"))
+	if line, _ := r.ReadLine(); strings.Index(line, "550 5.5.2") != 0 {
+		t.Error("expecting the message to be rejected, got:", line)
+	}
+	// the session goes on
+	clientConn.Write([]byte("NOOP\r\n"))
+	if line, _ := r.ReadLine(); strings.Index(line, "200") != 0 {
+		t.Error("expecting the session to go on, got:", line)
+	}
+}
+
+// Test that an authenticated user may only have MaxSessionsPerUser sessions at once
+func TestMaxSessionsPerUser(t *testing.T) {
+	sc := getMockServerConfig()
+	sc.StartTLSOn = false
+	sc.XClientOn = true
+	sc.MaxSessionsPerUser = 2
+	mainlog, logOpenError := log.GetLogger(sc.LogFile, "debug")
+	if logOpenError != nil {
+		mainlog.WithError(logOpenError).Errorf("Failed creating a logger for mock conn [%s]", sc.ListenInterface)
+	}
+	_, server := getMockServerConn(sc, t)
+	type session struct {
+		conn net.Conn
+		r    *textproto.Reader
+		done chan struct{}
+	}
+	id := uint64(0)
+	// starts a session, and sends cmd after the greeting
+	start := func(cmd string) (session, string) {
+		id++
+		serverConn, clientConn := tcpPair(t)
+		s := session{conn: clientConn, r: textproto.NewReader(bufio.NewReader(clientConn)), done: make(chan struct{})}
+		go func() {
+			server.handleClient(NewClient(serverConn, id, mainlog, mail.NewPool(5)))
+			close(s.done)
+		}()
+		clientConn.SetDeadline(time.Now().Add(time.Second * 10))
+		s.r.ReadLine()
+		clientConn.Write([]byte("HELO test.test.com\r\n"))
+		s.r.ReadLine()
+		clientConn.Write([]byte(cmd + "\r\n"))
+		line, _ := s.r.ReadLine()
+		return s, line
+	}
+	var sessions []session
+	for i := 0; i < 2; i++ {
+		s, line := start("XCLIENT LOGIN=alice")
+		defer s.conn.Close()
+		if strings.Index(line, "250") != 0 {
+			t.Fatal("expecting the session to be admitted, got:", line)
+		}
+		sessions = append(sessions, s)
+	}
+	s, line := start("XCLIENT LOGIN=alice")
+	defer s.conn.Close()
+	if line != "421 4.7.0 too many sessions for user" {
+		t.Error("expecting the session to be rejected, got:", line)
+	}
+	if _, err := s.r.ReadLine(); err == nil {
+		t.Error("expecting the session to be closed")
+	}
+	// other users, and the sessions that are not authenticated
+	for _, cmd := range []string{"XCLIENT LOGIN=bob", "NOOP"} {
+		s, line := start(cmd)
+		defer s.conn.Close()
+		if strings.Index(line, "2") != 0 {
+			t.Error("expecting", cmd, "to be admitted, got:", line)
+		}
+	}
+	// a session that drops is uncounted
+	sessions[0].conn.Close()
+	<-sessions[0].done
+	s, line = start("XCLIENT LOGIN=alice")
+	defer s.conn.Close()
+	if strings.Index(line, "250") != 0 {
+		t.Error("expecting the session to be admitted after a disconnect, got:", line)
+	}
+}
+
+func TestValidHeloSyntax(t *testing.T) {
+	for helo, valid := range map[string]bool{
+		"mail.example.com":     true,
+		"mail.example.com.":    true,
+		"xn--bcher-kva.test":   true,
+		"[192.0.2.1]":          true,
+		"[IPv6:2001:db8::1]":   true,
+		"":                     false,
+		"localhost":            false,
+		"192.0.2.1":            false,
+		"[2001:db8::1]":        false,
+		"[IPv6:192.0.2.1]":     false,
+		"[999.0.2.1]":          false,
+		"-mail.example.com":    false,
+		"mail..example.com":    false,
+		"mail_1.example.com":   false,
+		"mail.example.com foo": false,
+	} {
+		if validHeloSyntax(helo) != valid {
+			t.Errorf("expecting %q to be valid: %v", helo, valid)
+		}
+	}
+}
+
+// Test each helo_validation mode with valid & invalid names
+func TestHeloValidation(t *testing.T) {
+	var lookups int64
+	defer func(lookupHost func(context.Context, string) ([]string, error)) {
+		heloLookupHost = lookupHost
+	}(heloLookupHost)
+	heloLookupHost = func(ctx context.Context, host string) ([]string, error) {
+		atomic.AddInt64(&lookups, 1)
+		switch host {
+		case "mail.example.com":
+			return []string{"192.0.2.1"}, nil
+		case "slow.example.com":
+			return nil, &net.DNSError{Err: "timeout", Name: host, IsTimeout: true, IsTemporary: true}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	mainlog, logOpenError := log.GetLogger(log.OutputOff.String(), "debug")
+	if logOpenError != nil {
+		t.Fatal(logOpenError)
+	}
+	// talk sends the commands, returns the codes of the replies & the HELO kept on the envelope
+	talk := func(validation string, cmds ...string) ([]int, string) {
+		sc := getMockServerConfig()
+		sc.StartTLSOn = false
+		sc.HeloValidation = validation
+		_, server := getMockServerConn(sc, t)
+		serverConn, clientConn := tcpPair(t)
+		defer clientConn.Close()
+		client := NewClient(serverConn, 1, mainlog, mail.NewPool(5))
+		done := make(chan bool)
+		go func() {
+			server.handleClient(client)
+			close(done)
+		}()
+		clientConn.SetDeadline(time.Now().Add(time.Second * 10))
+		r := textproto.NewReader(bufio.NewReader(clientConn))
+		r.ReadLine()
+		var codes []int
+		for _, cmd := range append(cmds, "QUIT") {
+			clientConn.Write([]byte(cmd + "\r\n"))
+			code, _, _ := r.ReadResponse(0)
+			codes = append(codes, code)
+		}
+		<-done
+		return codes[:len(cmds)], client.Helo
+	}
+	expect := func(codes []int, helo string, wantCodes []int, wantHelo string) {
+		t.Helper()
+		if !reflect.DeepEqual(codes, wantCodes) || helo != wantHelo {
+			t.Errorf("expecting %v with HELO %q, got: %v with HELO %q", wantCodes, wantHelo, codes, helo)
+		}
+	}
+
+	codes, helo := talk(HeloValidationNone, "HELO localhost", "EHLO")
+	expect(codes, helo, []int{250, 250}, "")
+
+	codes, helo = talk(HeloValidationSyntax, "EHLO localhost", "HELO", "EHLO [192.0.2.1]", "HELO nx.example.com")
+	expect(codes, helo, []int{501, 501, 250, 250}, "nx.example.com")
+	codes, helo = talk(HeloValidationSyntax, "EHLO mail.example.com", "EHLO bad_name.example.com")
+	// a rejected name doesn't replace the one that was accepted
+	expect(codes, helo, []int{250, 501}, "mail.example.com")
+	if n := atomic.LoadInt64(&lookups); n != 0 {
+		t.Error("expecting no lookups when only the syntax is checked, got:", n)
+	}
+
+	codes, helo = talk(HeloValidationResolvable, "EHLO localhost", "EHLO nx.example.com", "EHLO [IPv6:2001:db8::1]")
+	expect(codes, helo, []int{501, 550, 250}, "[IPv6:2001:db8::1]")
+	codes, helo = talk(HeloValidationResolvable, "HELO mail.example.com")
+	expect(codes, helo, []int{250}, "mail.example.com")
+	// a temporary error doesn't reject the name
+	codes, helo = talk(HeloValidationResolvable, "HELO slow.example.com")
+	expect(codes, helo, []int{250}, "slow.example.com")
+	if n := atomic.LoadInt64(&lookups); n != 3 {
+		t.Error("expecting 3 lookups, got:", n)
+	}
+
+	// the failure is cached by the server
+	sc := getMockServerConfig()
+	_, server := getMockServerConn(sc, t)
+	for i := 0; i < 3; i++ {
+		if reply := server.checkHelo("NX.example.com", HeloValidationResolvable, &response.Canned); reply != response.Canned.FailHeloNotResolvable {
+			t.Error("expecting the name not to resolve, got:", reply)
+		}
+	}
+	if n := atomic.LoadInt64(&lookups); n != 4 {
+		t.Error("expecting the failure to be cached, got lookups:", n)
+	}
+	server.heloFailures.expires["nx.example.com"] = time.Now().Add(-time.Second)
+	server.checkHelo("nx.example.com", HeloValidationResolvable, &response.Canned)
+	if n := atomic.LoadInt64(&lookups); n != 5 {
+		t.Error("expecting the name to be looked up after the failure expired, got lookups:", n)
+	}
+}
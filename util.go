@@ -1,21 +1,28 @@
 package guerrilla
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
+	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/response"
 )
 
 var extractEmailRegex, _ = regexp.Compile(`<(.+?)@(.+?)>`) // go home regex, you're drunk!
 
-func extractEmail(str string) (mail.Address, error) {
+func extractEmail(str string, canned *response.Responses) (mail.Address, error) {
 	email := mail.Address{}
 	var err error
 	if len(str) > RFC2821LimitPath {
-		return email, errors.New(response.Canned.FailPathTooLong)
+		return email, errors.New(canned.FailPathTooLong)
 	}
 	if matched := extractEmailRegex.FindStringSubmatch(str); len(matched) > 2 {
 		email.User = matched[1]
@@ -26,21 +33,269 @@ func extractEmail(str string) (mail.Address, error) {
 	}
 	err = nil
 	if email.User == "" || email.Host == "" {
-		err = errors.New(response.Canned.FailInvalidAddress)
+		err = errors.New(canned.FailInvalidAddress)
 	} else if len(email.User) > RFC2832LimitLocalPart {
-		err = errors.New(response.Canned.FailLocalPartTooLong)
+		err = errors.New(canned.FailLocalPartTooLong)
 	} else if len(email.Host) > RFC2821LimitDomain {
-		err = errors.New(response.Canned.FailDomainTooLong)
+		err = errors.New(canned.FailDomainTooLong)
 	}
 	return email, err
 }
 
+// findMessageID returns the value of the Message-ID header, and the position of the value in data
+// (including folded lines). Returns an empty string if the header was not found
+func findMessageID(data []byte) (id string, start int, end int) {
+	pos := 0
+	for pos < len(data) {
+		lineEnd := bytes.IndexByte(data[pos:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(data)
+		} else {
+			lineEnd += pos
+		}
+		line := bytes.TrimRight(data[pos:lineEnd], "\r")
+		if len(line) == 0 {
+			// end of header
+			break
+		}
+		if len(line) >= 11 && strings.EqualFold(string(line[:11]), "Message-ID:") {
+			start = pos + 11
+			end = pos + len(line)
+			// unfold
+			for next := lineEnd + 1; next < len(data) && (data[next] == ' ' || data[next] == '\t'); {
+				nextEnd := bytes.IndexByte(data[next:], '\n')
+				if nextEnd == -1 {
+					nextEnd = len(data)
+				} else {
+					nextEnd += next
+				}
+				end = next + len(bytes.TrimRight(data[next:nextEnd], "\r"))
+				next = nextEnd + 1
+			}
+			id = strings.Join(strings.Fields(string(data[start:end])), "")
+			return id, start, end
+		}
+		pos = lineEnd + 1
+	}
+	return "", 0, 0
+}
+
 var validhostRegex, _ = regexp.Compile(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\-]*[A-Za-z0-9])$`)
 
+// validHost returns the host in its ASCII form, or an empty string if the host is invalid
 func validHost(host string) string {
 	host = strings.Trim(host, " ")
+	host, err := mail.ASCIIHost(host)
+	if err != nil {
+		return ""
+	}
 	if validhostRegex.MatchString(host) {
 		return host
 	}
 	return ""
 }
+
+// loadSenderDomains reads a sender_domains_file, returns the domains of each login.
+// Each line is a login followed by its domains, separated by commas or spaces.
+// Blank lines and lines starting with # are skipped
+func loadSenderDomains(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[string][]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expecting a login and its domains", i+1)
+		}
+		login := strings.ToLower(fields[0])
+		for _, d := range fields[1:] {
+			host, err := mail.ASCIIHost(d)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			domains[login] = append(domains[login], strings.ToLower(host))
+		}
+	}
+	return domains, nil
+}
+
+// esmtpParams returns the parameters after the path of a MAIL FROM or RCPT TO command,
+// eg. "RET=HDRS", by their upper-case keyword (RFC 5321 section 4.1.2)
+func esmtpParams(arg string) map[string]string {
+	end := strings.LastIndex(arg, ">")
+	if end == -1 {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, p := range strings.Fields(arg[end+1:]) {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		} else {
+			params[strings.ToUpper(kv[0])] = ""
+		}
+	}
+	return params
+}
+
+// decodeXtext decodes the xtext of the ENVID & ORCPT parameters, where "+" is followed by
+// the hex of a character, see RFC 3461 section 4
+func decodeXtext(s string) (string, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '=' {
+			return "", errors.New("invalid xtext")
+		}
+		if c == '+' {
+			if i+3 > len(s) {
+				return "", errors.New("invalid xtext")
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errors.New("invalid xtext")
+			}
+			c = byte(v)
+			i += 2
+		}
+		b = append(b, c)
+	}
+	return string(b), nil
+}
+
+// dsnMailParams returns the RET & ENVID parameters of MAIL FROM (RFC 3461 section 4.3 & 4.4)
+func dsnMailParams(params map[string]string) (ret string, envID string, err error) {
+	if v, ok := params["RET"]; ok {
+		ret = strings.ToUpper(v)
+		if ret != "FULL" && ret != "HDRS" {
+			return "", "", errors.New("invalid RET")
+		}
+	}
+	if v, ok := params["ENVID"]; ok {
+		if len(v) > 100 {
+			return "", "", errors.New("ENVID too long")
+		}
+		if envID, err = decodeXtext(v); err != nil {
+			return "", "", err
+		}
+	}
+	return ret, envID, nil
+}
+
+// dsnRcptParams returns the NOTIFY & ORCPT parameters of RCPT TO (RFC 3461 section 4.1 & 4.2)
+func dsnRcptParams(params map[string]string) (dsn backends.DSNRcpt, err error) {
+	if v, ok := params["NOTIFY"]; ok {
+		seen := make(map[string]bool)
+		for _, n := range strings.Split(strings.ToUpper(v), ",") {
+			switch n {
+			case backends.DSNNotifyNever, backends.DSNNotifySuccess, backends.DSNNotifyFailure, backends.DSNNotifyDelay:
+			default:
+				return dsn, errors.New("invalid NOTIFY")
+			}
+			if seen[n] {
+				return dsn, errors.New("repeated NOTIFY")
+			}
+			seen[n] = true
+			dsn.Notify = append(dsn.Notify, n)
+		}
+		if seen[backends.DSNNotifyNever] && len(dsn.Notify) > 1 {
+			// NEVER must be alone
+			return dsn, errors.New("invalid NOTIFY")
+		}
+	}
+	if v, ok := params["ORCPT"]; ok {
+		kv := strings.SplitN(v, ";", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return dsn, errors.New("invalid ORCPT")
+		}
+		addr, err := decodeXtext(kv[1])
+		if err != nil || addr == "" {
+			return dsn, errors.New("invalid ORCPT")
+		}
+		dsn.ORCPT = kv[0] + ";" + addr
+	}
+	return dsn, nil
+}
+
+// unixSocketPrefix starts a listen_interface that is a unix socket, the path follows
+const unixSocketPrefix = "unix:"
+
+// listenAddress returns the network & the address to listen on for a listen_interface,
+// "unix" & the path for a unix socket, "tcp" & <ip>:<port> otherwise
+func listenAddress(listenInterface string) (network, address string) {
+	if strings.HasPrefix(listenInterface, unixSocketPrefix) {
+		return "unix", strings.TrimPrefix(listenInterface, unixSocketPrefix)
+	}
+	return "tcp", listenInterface
+}
+
+// parseSocketMode parses the socket_mode, the permission bits in octal, eg. "0660"
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if m > 0777 {
+		return 0, errors.New("not permission bits: " + mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// removeStaleSocket removes the unix socket at path, left behind if the server didn't exit cleanly.
+// Other kinds of files are not removed, then listening fails
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// parseNets parses a list of networks in CIDR notation, eg. "192.0.2.0/24" or "2001:db8::/32".
+// An IP without a prefix length is a network of that IP only
+func parseNets(nets []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, n := range nets {
+		n = strings.TrimSpace(n)
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", n)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", n)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// netsContain returns true if ip is in one of nets
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}